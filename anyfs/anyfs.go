@@ -0,0 +1,473 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package anyfs opens archives of any supported format, detecting the format
+// from the contents of the archive.
+package anyfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"strconv"
+
+	"github.com/dpeckett/archivefs/arfs"
+	"github.com/dpeckett/archivefs/compression"
+	"github.com/dpeckett/archivefs/cpiofs"
+	"github.com/dpeckett/archivefs/debfs"
+	"github.com/dpeckett/archivefs/encryption"
+	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/initramfs"
+	"github.com/dpeckett/archivefs/signature"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/archivefs/zipfs"
+	"github.com/dpeckett/archivefs/zstdseekable"
+)
+
+var (
+	// ErrUnknownFormat is returned when the format of an archive is not
+	// recognized.
+	ErrUnknownFormat = archiveerrors.Define(archiveerrors.ErrUnsupportedFeature, "unknown archive format")
+	// ErrEncrypted is returned for encrypted archives, which must be
+	// decrypted first (see encryption.NewReaderAt).
+	ErrEncrypted = errors.New("archive is encrypted")
+)
+
+// Format is an archive format.
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	// FormatTar is an uncompressed tar archive.
+	FormatTar
+	// FormatTarGzip is a gzip compressed tar archive (including eStargz).
+	FormatTarGzip
+	// FormatTarBzip2 is a bzip2 compressed tar archive.
+	FormatTarBzip2
+	// FormatTarXz is an xz compressed tar archive.
+	FormatTarXz
+	// FormatTarZstd is a zstd compressed tar archive.
+	FormatTarZstd
+	// FormatAr is an ar(1) archive.
+	FormatAr
+	// FormatDeb is a Debian binary package.
+	FormatDeb
+	// FormatEROFS is an EROFS filesystem image.
+	FormatEROFS
+	// FormatZip is a zip archive.
+	FormatZip
+	// FormatCpio is an uncompressed cpio archive.
+	FormatCpio
+	// FormatInitramfs is a Linux initramfs image, made up of several cpio
+	// archives or of compressed cpio archives.
+	FormatInitramfs
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatTar:
+		return "tar"
+	case FormatTarGzip:
+		return "tar+gzip"
+	case FormatTarBzip2:
+		return "tar+bzip2"
+	case FormatTarXz:
+		return "tar+xz"
+	case FormatTarZstd:
+		return "tar+zstd"
+	case FormatAr:
+		return "ar"
+	case FormatDeb:
+		return "deb"
+	case FormatEROFS:
+		return "erofs"
+	case FormatZip:
+		return "zip"
+	case FormatCpio:
+		return "cpio"
+	case FormatInitramfs:
+		return "initramfs"
+	default:
+		return "unknown"
+	}
+}
+
+// Compressed reports whether the format is a compressed tar archive.
+func (f Format) Compressed() bool {
+	return f >= FormatTarGzip && f <= FormatTarZstd
+}
+
+// Open opens an archive, detecting its format from its contents. Compressed
+// tar archives are decompressed and spooled as they are indexed (see
+// tarfs.OpenReader), except for seekable zstd archives which are read in
+// place if the size of ra can be determined (see zstdseekable). For Debian
+// packages the data archive is returned. Zip archives can only be opened if
+// the size of ra can be determined.
+//
+// If the returned filesystem implements io.Closer, it must be closed to
+// release any spooled data.
+func Open(ra io.ReaderAt) (fs.FS, Format, error) {
+	return OpenWithOptions(ra, nil)
+}
+
+// DefaultStrictLimits are the limits applied to tar archives (including the
+// data archives of Debian packages) in strict mode, unless others are given.
+var DefaultStrictLimits = tarfs.Limits{
+	MaxEntries:    1 << 20,
+	MaxTotalSize:  16 << 30,
+	MaxPathDepth:  256,
+	MaxPathLength: 4096,
+}
+
+// OpenOptions configures how an archive is opened.
+type OpenOptions struct {
+	// Strict enables the most defensive behavior of every format, intended
+	// for services that open archives from untrusted sources: malformed or
+	// unsafe archives are rejected (see the Strict option of tarfs, arfs,
+	// debfs, erofs, zipfs, cpiofs and initramfs), symbolic links are never
+	// followed when resolving paths of tar archives (they can still be read
+	// with ReadLink), and tar archives are bounded by Limits (or
+	// DefaultStrictLimits).
+	Strict bool
+	// Limits bounds the resources consumed when indexing tar archives
+	// (including the data archives of Debian packages).
+	Limits tarfs.Limits
+	// PublicKeys, if set, are the keys trusted to sign the archive. The
+	// archive must then have a valid Signature (see signature.Verify), which
+	// is checked by reading every file before the archive is returned.
+	// Files are read from the archive again when they are opened, so this
+	// only protects an archive that can't change once opened (see
+	// OpenWithOptions).
+	PublicKeys []ed25519.PublicKey
+	// Signature is the detached signature of the archive (see
+	// signature.Sign).
+	Signature []byte
+	// SignatureOptions configures the verification of the signature.
+	SignatureOptions *signature.Options
+}
+
+// OpenWithOptions opens an archive, as for Open, with the given options. If
+// the signature of the archive is required but missing or invalid, the
+// returned error wraps signature.ErrMissingSignature or
+// signature.ErrInvalidSignature respectively.
+//
+// The signature is verified once, when the archive is opened, and later reads
+// go back to ra. When verifying a signature the caller must therefore supply
+// an immutable ra (eg. a file nobody else can write to, or a copy in memory),
+// otherwise data that changes after it is opened is served unverified.
+func OpenWithOptions(ra io.ReaderAt, opts *OpenOptions) (fs.FS, Format, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+
+	if len(opts.PublicKeys) > 0 && len(opts.Signature) == 0 {
+		return nil, FormatUnknown, signature.ErrMissingSignature
+	}
+
+	fsys, format, err := open(ra, opts)
+	if err != nil {
+		return nil, format, err
+	}
+
+	if len(opts.PublicKeys) > 0 {
+		if err := signature.Verify(fsys, opts.Signature, opts.PublicKeys, opts.SignatureOptions); err != nil {
+			if closer, ok := fsys.(io.Closer); ok {
+				_ = closer.Close()
+			}
+
+			return nil, format, fmt.Errorf("failed to verify %s archive: %w", format, err)
+		}
+	}
+
+	return fsys, format, nil
+}
+
+func open(ra io.ReaderAt, opts *OpenOptions) (fs.FS, Format, error) {
+	format, err := Detect(ra)
+	if err != nil {
+		return nil, FormatUnknown, err
+	}
+
+	limits := opts.Limits
+	if opts.Strict && limits == (tarfs.Limits{}) {
+		limits = DefaultStrictLimits
+	}
+
+	tarOpts := &tarfs.Options{
+		Strict: opts.Strict,
+		Limits: limits,
+	}
+	if opts.Strict {
+		tarOpts.SymlinkPolicy = tarfs.SymlinkNoFollow
+	}
+
+	var fsys fs.FS
+	switch format {
+	case FormatTar:
+		fsys, err = tarfs.OpenWithOptions(ra, tarOpts)
+	case FormatAr:
+		fsys, err = arfs.OpenWithOptions(ra, &arfs.Options{Strict: opts.Strict})
+	case FormatDeb:
+		var pkg *debfs.Package
+		pkg, err = debfs.OpenWithOptions(ra, &debfs.Options{Strict: opts.Strict, Limits: limits})
+		if err == nil {
+			_ = pkg.Control.Close()
+			fsys = pkg.Data
+		}
+	case FormatEROFS:
+		fsys, err = erofs.OpenWithOptions(ra, &erofs.Options{Strict: opts.Strict})
+	case FormatZip:
+		size, ok := sizeOf(ra)
+		if !ok {
+			err = fmt.Errorf("%w: zip archive of unknown size", archiveerrors.ErrUnsupportedFeature)
+			break
+		}
+
+		fsys, err = zipfs.OpenWithOptions(ra, size, &zipfs.Options{Strict: opts.Strict})
+	case FormatCpio:
+		fsys, err = cpiofs.OpenWithOptions(ra, &cpiofs.Options{Strict: opts.Strict})
+	case FormatInitramfs:
+		fsys, err = initramfs.OpenWithOptions(ra, &initramfs.Options{Strict: opts.Strict})
+	default:
+		if format == FormatTarZstd {
+			if zr, ok := openSeekable(ra); ok {
+				fsys, err = tarfs.OpenWithOptions(zr, tarOpts)
+				break
+			}
+		}
+
+		var r io.ReadCloser
+		r, err = decompress(newReader(ra), format)
+		if err != nil {
+			break
+		}
+		defer r.Close()
+
+		fsys, err = tarfs.OpenReader(r, tarOpts)
+	}
+	if err != nil {
+		return nil, format, fmt.Errorf("failed to open %s archive: %w", format, err)
+	}
+
+	return fsys, format, nil
+}
+
+// Detect detects the format of an archive from its contents. Compressed
+// archives are partially decompressed to identify their contents.
+func Detect(ra io.ReaderAt) (Format, error) {
+	header := make([]byte, erofs.SuperBlockOffset+4)
+	n, err := ra.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return FormatUnknown, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte(arMagic)):
+		if bytes.HasPrefix(header[len(arMagic):], []byte("debian-binary")) {
+			return FormatDeb, nil
+		}
+		return FormatAr, nil
+	case isEROFS(header):
+		return FormatEROFS, nil
+	case isTar(header):
+		return FormatTar, nil
+	case bytes.HasPrefix(header, []byte(zipMagic)), bytes.HasPrefix(header, []byte(zipEmptyMagic)):
+		return FormatZip, nil
+	case isCpio(header):
+		return detectCpio(ra)
+	case encryption.IsEncrypted(header):
+		return FormatUnknown, ErrEncrypted
+	}
+
+	algorithm := compression.Detect(header)
+	if algorithm == compression.None {
+		return FormatUnknown, ErrUnknownFormat
+	}
+
+	// Check whether the decompressed archive starts with a tar header, or is
+	// a compressed initramfs image.
+	r, err := compression.Decompress(newReader(ra), algorithm)
+	if err != nil {
+		return FormatUnknown, fmt.Errorf("failed to decompress %s archive: %w", algorithm, err)
+	}
+	defer r.Close()
+
+	block := make([]byte, blockSize)
+	if _, err := io.ReadFull(r, block); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return FormatUnknown, fmt.Errorf("failed to decompress %s archive: %w", algorithm, err)
+	}
+
+	switch {
+	case isCpio(block):
+		return FormatInitramfs, nil
+	case isTar(block):
+		if format := compressedFormat(header); format != FormatUnknown {
+			return format, nil
+		}
+
+		return FormatUnknown, fmt.Errorf("%w: %s compressed tar archive", compression.ErrUnsupported, algorithm)
+	default:
+		return FormatUnknown, ErrUnknownFormat
+	}
+}
+
+// detectCpio distinguishes a single cpio archive from an initramfs image that
+// starts with one, by whether anything other than padding follows the
+// trailer of the archive.
+func detectCpio(ra io.ReaderAt) (Format, error) {
+	fsys, err := cpiofs.Open(ra)
+	if err != nil {
+		// Leave it to cpiofs to report the error when opened.
+		return FormatCpio, nil
+	}
+
+	buf := make([]byte, 4096)
+	for offset := fsys.Size(); ; {
+		n, err := ra.ReadAt(buf, offset)
+		if bytes.ContainsFunc(buf[:n], func(r rune) bool { return r != 0 }) {
+			return FormatInitramfs, nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return FormatCpio, nil
+			}
+
+			return FormatUnknown, err
+		}
+		offset += int64(n)
+	}
+}
+
+const (
+	arMagic       = "!<arch>\n"
+	zipMagic      = "PK\x03\x04"
+	zipEmptyMagic = "PK\x05\x06"
+	blockSize     = 512
+)
+
+// compressedFormat returns the format of a compressed tar archive from
+// the magic number of its compression.
+func compressedFormat(header []byte) Format {
+	switch compression.Detect(header) {
+	case compression.Gzip:
+		return FormatTarGzip
+	case compression.Bzip2:
+		return FormatTarBzip2
+	case compression.Xz:
+		return FormatTarXz
+	case compression.Zstd:
+		return FormatTarZstd
+	default:
+		return FormatUnknown
+	}
+}
+
+// decompress returns a reader that decompresses a compressed tar archive.
+func decompress(r io.Reader, format Format) (io.ReadCloser, error) {
+	algorithms := map[Format]compression.Algorithm{
+		FormatTarGzip:  compression.Gzip,
+		FormatTarBzip2: compression.Bzip2,
+		FormatTarXz:    compression.Xz,
+		FormatTarZstd:  compression.Zstd,
+	}
+
+	algorithm, ok := algorithms[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: compression of %s", archiveerrors.ErrUnsupportedFeature, format)
+	}
+
+	return compression.Decompress(r, algorithm)
+}
+
+// openSeekable opens a seekable zstd archive, if ra is one and its size can
+// be determined.
+func openSeekable(ra io.ReaderAt) (*zstdseekable.Reader, bool) {
+	size, ok := sizeOf(ra)
+	if !ok {
+		return nil, false
+	}
+
+	zr, err := zstdseekable.Open(ra, size)
+	if err != nil {
+		return nil, false
+	}
+
+	return zr, true
+}
+
+// sizeOf returns the size of ra, if it can be determined.
+func sizeOf(ra io.ReaderAt) (int64, bool) {
+	switch ra := ra.(type) {
+	case interface{ Size() int64 }:
+		return ra.Size(), true
+	case interface{ Stat() (fs.FileInfo, error) }:
+		fi, err := ra.Stat()
+		if err != nil {
+			return 0, false
+		}
+		return fi.Size(), true
+	default:
+		return 0, false
+	}
+}
+
+func newReader(ra io.ReaderAt) io.Reader {
+	return bufio.NewReader(io.NewSectionReader(ra, 0, math.MaxInt64))
+}
+
+func isEROFS(header []byte) bool {
+	if len(header) < erofs.SuperBlockOffset+4 {
+		return false
+	}
+
+	return binary.LittleEndian.Uint32(header[erofs.SuperBlockOffset:]) == erofs.SuperBlockMagicV1
+}
+
+// isCpio reports whether header starts with the magic of an SVR4 (newc or
+// crc) cpio archive.
+func isCpio(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("070701")) || bytes.HasPrefix(header, []byte("070702"))
+}
+
+// isTar reports whether block is a tar header, either by its magic (ustar,
+// pax, and GNU archives) or by its checksum (V7 archives).
+func isTar(block []byte) bool {
+	if len(block) < blockSize || block[0] == 0 {
+		return false
+	}
+
+	if bytes.HasPrefix(block[257:], []byte("ustar")) {
+		return true
+	}
+
+	field := bytes.TrimRight(bytes.TrimLeft(block[148:156], " "), " \x00")
+	checksum, err := strconv.ParseInt(string(field), 8, 64)
+	if err != nil {
+		return false
+	}
+
+	var unsigned, signed int64
+	for i, b := range block[:blockSize] {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		unsigned += int64(b)
+		signed += int64(int8(b))
+	}
+
+	return checksum == unsigned || checksum == signed
+}
@@ -0,0 +1,347 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package anyfs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/anyfs"
+	"github.com/dpeckett/archivefs/cpiofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/signature"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	toybox, err := os.ReadFile("../tarfs/testdata/toybox.tar")
+	require.NoError(t, err)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err = gw.Write(toybox)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	var zstded bytes.Buffer
+	zw, err := zstd.NewWriter(&zstded)
+	require.NoError(t, err)
+	_, err = zw.Write(toybox)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	var zipped bytes.Buffer
+	zipw := zip.NewWriter(&zipped)
+	w, err := zipw.Create("etc/hostname")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("alpha\n"))
+	require.NoError(t, err)
+	require.NoError(t, zipw.Close())
+
+	microcode := createCpio("kernel/x86/microcode/GenuineIntel.bin")
+	cpio := createCpio("etc/hostname")
+
+	var initramfs bytes.Buffer
+	initramfs.Write(microcode)
+	initramfs.Write(make([]byte, 512))
+	gw = gzip.NewWriter(&initramfs)
+	_, err = gw.Write(cpio)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	tests := []struct {
+		name   string
+		ra     io.ReaderAt
+		format anyfs.Format
+		file   string
+	}{
+		{"Tar", bytes.NewReader(toybox), anyfs.FormatTar, "bin/toybox"},
+		{"V7", openFile(t, "../tarfs/testdata/v7.tar"), anyfs.FormatTar, "small.txt"},
+		{"Gzip", bytes.NewReader(gzipped.Bytes()), anyfs.FormatTarGzip, "bin/toybox"},
+		{"Zstd", bytes.NewReader(zstded.Bytes()), anyfs.FormatTarZstd, "bin/toybox"},
+		{"EStargz", openFile(t, "../tarfs/testdata/toybox.estargz"), anyfs.FormatTarGzip, "bin/toybox"},
+		{"Ar", openFile(t, "../arfs/testdata/multi_archive.a"), anyfs.FormatAr, ""},
+		{"Deb", openFile(t, "../debfs/testdata/hello_xz.deb"), anyfs.FormatDeb, ""},
+		{"EROFS", openFile(t, "../erofs/testdata/toybox.img"), anyfs.FormatEROFS, "bin/toybox"},
+		{"Zip", bytes.NewReader(zipped.Bytes()), anyfs.FormatZip, "etc/hostname"},
+		{"Cpio", bytes.NewReader(append(cpio, make([]byte, 512)...)), anyfs.FormatCpio, "etc/hostname"},
+		{"Initramfs", bytes.NewReader(initramfs.Bytes()), anyfs.FormatInitramfs, "etc/hostname"},
+		{"CompressedInitramfs", bytes.NewReader(initramfs.Bytes()[len(microcode)+512:]), anyfs.FormatInitramfs, "etc/hostname"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, format, err := anyfs.Open(tt.ra)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				if closer, ok := fsys.(io.Closer); ok {
+					require.NoError(t, closer.Close())
+				}
+			})
+
+			require.Equal(t, tt.format, format)
+
+			entries, err := fs.ReadDir(fsys, ".")
+			require.NoError(t, err)
+			require.NotEmpty(t, entries)
+
+			if tt.file != "" {
+				_, err := fs.Stat(fsys, tt.file)
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, _, err := anyfs.Open(bytes.NewReader([]byte("hello world")))
+		require.ErrorIs(t, err, anyfs.ErrUnknownFormat)
+
+		// Compressed data that isn't a tar archive.
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err = gw.Write(bytes.Repeat([]byte("hello world"), 100))
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		_, _, err = anyfs.Open(bytes.NewReader(buf.Bytes()))
+		require.ErrorIs(t, err, anyfs.ErrUnknownFormat)
+	})
+}
+
+// createCpio creates a newc cpio archive containing an empty file.
+func createCpio(name string) []byte {
+	var buf bytes.Buffer
+
+	for _, name := range []string{name, cpiofs.TrailerName} {
+		fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			cpiofs.MagicNewc, 0, 0o100644, 0, 0, 1, 0, 0, 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+	}
+
+	return buf.Bytes()
+}
+
+func openFile(t *testing.T, name string) io.ReaderAt {
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	return f
+}
+
+func TestConvert(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/sh"))
+	require.NoError(t, src.Symlink("busybox", "usr/bin/ls"))
+	require.NoError(t, src.SetOwner("usr/bin/busybox", 1000, 1000))
+	require.NoError(t, src.SetXattr("usr/bin/busybox", "user.comment", "hello"))
+
+	for _, format := range []anyfs.Format{
+		anyfs.FormatTar,
+		anyfs.FormatTarGzip,
+		anyfs.FormatTarXz,
+		anyfs.FormatTarZstd,
+		anyfs.FormatEROFS,
+	} {
+		t.Run(format.String(), func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "archive"))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			require.NoError(t, anyfs.Convert(f, format, src, nil))
+
+			fsys, detected, err := anyfs.Open(f)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				if closer, ok := fsys.(io.Closer); ok {
+					require.NoError(t, closer.Close())
+				}
+			})
+			require.Equal(t, format, detected)
+
+			data, err := fs.ReadFile(fsys, "usr/bin/sh")
+			require.NoError(t, err)
+			require.Equal(t, "busybox", string(data))
+
+			target, err := fsys.(archivefs.ReadLinkFS).ReadLink("usr/bin/ls")
+			require.NoError(t, err)
+			require.Equal(t, "busybox", target)
+
+			fi, err := fs.Stat(fsys, "usr/bin/busybox")
+			require.NoError(t, err)
+
+			switch sys := fi.Sys().(type) {
+			case *tar.Header:
+				require.Equal(t, 1000, sys.Uid)
+				require.Equal(t, 1000, sys.Gid)
+				require.Equal(t, "hello", sys.PAXRecords["SCHILY.xattr.user.comment"])
+			case archivefs.Owner:
+				uid, gid := sys.Owner()
+				require.Equal(t, 1000, uid)
+				require.Equal(t, 1000, gid)
+			default:
+				t.Fatalf("unexpected sys type %T", sys)
+			}
+		})
+	}
+
+	t.Run("Ar", func(t *testing.T) {
+		src := fstest.MapFS{
+			"hello.txt": {Data: []byte("hello"), Mode: 0o644},
+		}
+
+		var buf bytes.Buffer
+		require.NoError(t, anyfs.Convert(&buf, anyfs.FormatAr, src, nil))
+
+		fsys, format, err := anyfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, anyfs.FormatAr, format)
+
+		data, err := fs.ReadFile(fsys, "hello.txt")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("WriterAt", func(t *testing.T) {
+		err := anyfs.Convert(&bytes.Buffer{}, anyfs.FormatEROFS, src, nil)
+		require.Error(t, err)
+	})
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+
+	var archive bytes.Buffer
+	require.NoError(t, anyfs.Convert(&archive, anyfs.FormatTarZstd, fsys, nil))
+
+	// The signature covers the contents, not the format, of the archive.
+	var sig bytes.Buffer
+	require.NoError(t, signature.Sign(&sig, fsys, priv, nil))
+
+	opts := &anyfs.OpenOptions{
+		PublicKeys: []ed25519.PublicKey{pub},
+		Signature:  sig.Bytes(),
+	}
+
+	opened, format, err := anyfs.OpenWithOptions(bytes.NewReader(archive.Bytes()), opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, opened.(io.Closer).Close())
+	})
+	require.Equal(t, anyfs.FormatTarZstd, format)
+
+	data, err := fs.ReadFile(opened, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "alpha\n", string(data))
+
+	t.Run("Tampered", func(t *testing.T) {
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("bravo\n"), 0o644))
+
+		var tampered bytes.Buffer
+		require.NoError(t, anyfs.Convert(&tampered, anyfs.FormatTar, fsys, nil))
+
+		_, _, err := anyfs.OpenWithOptions(bytes.NewReader(tampered.Bytes()), opts)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+
+	t.Run("MissingSignature", func(t *testing.T) {
+		_, _, err := anyfs.OpenWithOptions(bytes.NewReader(archive.Bytes()), &anyfs.OpenOptions{
+			PublicKeys: []ed25519.PublicKey{pub},
+		})
+		require.ErrorIs(t, err, signature.ErrMissingSignature)
+	})
+}
+
+func TestOpenStrict(t *testing.T) {
+	newTar := func(headers ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range headers {
+			require.NoError(t, tw.WriteHeader(hdr))
+		}
+		require.NoError(t, tw.Close())
+		return buf.Bytes()
+	}
+
+	archive := newTar(
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644},
+		&tar.Header{Name: "etc/name", Typeflag: tar.TypeSymlink, Linkname: "hostname"},
+	)
+
+	fsys, _, err := anyfs.OpenWithOptions(bytes.NewReader(archive), &anyfs.OpenOptions{Strict: true})
+	require.NoError(t, err)
+
+	_, err = fs.Stat(fsys, "etc/hostname")
+	require.NoError(t, err)
+
+	// Symbolic links are never followed.
+	_, err = fs.Stat(fsys, "etc/name")
+	require.ErrorIs(t, err, archiveerrors.ErrInsecurePath)
+
+	target, err := fsys.(archivefs.ReadLinkFS).ReadLink("etc/name")
+	require.NoError(t, err)
+	require.Equal(t, "hostname", target)
+
+	t.Run("Unsafe", func(t *testing.T) {
+		unsafe := newTar(&tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"})
+
+		_, _, err := anyfs.OpenWithOptions(bytes.NewReader(unsafe), nil)
+		require.NoError(t, err)
+
+		_, _, err = anyfs.OpenWithOptions(bytes.NewReader(unsafe), &anyfs.OpenOptions{Strict: true})
+		require.ErrorIs(t, err, archiveerrors.ErrInsecurePath)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		_, _, err := anyfs.OpenWithOptions(bytes.NewReader(archive), &anyfs.OpenOptions{
+			Strict: true,
+			Limits: tarfs.Limits{MaxEntries: 2},
+		})
+		require.ErrorIs(t, err, archiveerrors.ErrLimitExceeded)
+
+		deep := newTar(&tar.Header{Name: strings.Repeat("a/", anyfs.DefaultStrictLimits.MaxPathDepth) + "b", Typeflag: tar.TypeReg})
+
+		_, _, err = anyfs.OpenWithOptions(bytes.NewReader(deep), nil)
+		require.NoError(t, err)
+
+		_, _, err = anyfs.OpenWithOptions(bytes.NewReader(deep), &anyfs.OpenOptions{Strict: true})
+		require.ErrorIs(t, err, archiveerrors.ErrLimitExceeded)
+	})
+}
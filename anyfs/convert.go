@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package anyfs
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/dpeckett/archivefs/arfs"
+	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ConvertOptions configures how a filesystem is converted to an archive.
+type ConvertOptions struct {
+	// Tar configures the creation of tar archives (including compressed
+	// tar archives).
+	Tar *tarfs.CreateOptions
+	// Ar configures the creation of ar(1) archives.
+	Ar *arfs.CreateOptions
+}
+
+// Convert writes the filesystem src to dst as an archive of the given
+// format, eg. converting a tar archive opened with tarfs into an EROFS image.
+// Ownership, symbolic links, device numbers, extended attributes, hard links,
+// and holes in sparse files (see archivefs.SparseFS) are preserved where
+// supported by the format.
+//
+// EROFS images are written with random access, so dst must implement
+// io.WriterAt (eg. *os.File). Debian packages and bzip2 compression are not
+// supported.
+func Convert(dst io.Writer, format Format, src fs.FS, opts *ConvertOptions) error {
+	if opts == nil {
+		opts = &ConvertOptions{}
+	}
+
+	switch format {
+	case FormatTar:
+		return tarfs.CreateWithOptions(dst, src, opts.Tar)
+	case FormatTarGzip, FormatTarXz, FormatTarZstd:
+		w, err := compress(dst, format)
+		if err != nil {
+			return err
+		}
+
+		if err := tarfs.CreateWithOptions(w, src, opts.Tar); err != nil {
+			_ = w.Close()
+			return err
+		}
+
+		return w.Close()
+	case FormatAr:
+		return arfs.CreateWithOptions(dst, src, opts.Ar)
+	case FormatEROFS:
+		wa, ok := dst.(io.WriterAt)
+		if !ok {
+			return errors.New("erofs images require a destination that implements io.WriterAt")
+		}
+
+		return erofs.Create(wa, src)
+	default:
+		return fmt.Errorf("%w: archive format %s", archiveerrors.ErrUnsupportedFeature, format)
+	}
+}
+
+// compress returns a writer that compresses a tar archive.
+func compress(w io.Writer, format Format) (io.WriteCloser, error) {
+	switch format {
+	case FormatTarGzip:
+		return gzip.NewWriter(w), nil
+	case FormatTarXz:
+		return xz.NewWriter(w)
+	case FormatTarZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("%w: compression of %s", archiveerrors.ErrUnsupportedFeature, format)
+	}
+}
@@ -0,0 +1,424 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package archivefstest implements support for testing implementations of
+// filesystems, complementing testing/fstest.
+package archivefstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"sync"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+)
+
+const (
+	// linkTimeout is how long resolving a symbolic link may take, before it
+	// is assumed the filesystem doesn't detect loops.
+	linkTimeout = 10 * time.Second
+	// concurrency is the number of goroutines reading files at once.
+	concurrency = 8
+	// missingName is the name of a file assumed not to exist.
+	missingName = ".archivefstest-missing"
+)
+
+// TestFS tests a filesystem implementation. It walks the entire tree of
+// files in fsys, checking that:
+//
+//   - ReadLink and StatLink (if fsys implements archivefs.ReadLinkFS) agree
+//     with the directory entries, and fail for missing files.
+//   - Resolving symbolic links terminates, even for dangling links or loops,
+//     and Stat and Open agree on the result.
+//   - Reading directories in pages of any size returns the same entries.
+//   - Files can be read concurrently, and if they implement io.ReaderAt, so
+//     can a single open file.
+//
+// The expected files are then passed to fstest.TestFS, with any symbolic
+// links that can't be resolved hidden, as fstest.TestFS treats them as
+// errors. Every file is read into memory, so fsys should be small.
+//
+// If TestFS finds any problems, it returns an error describing all of them.
+func TestFS(fsys fs.FS, expected ...string) error {
+	t := &tester{fsys: fsys}
+
+	t.walk()
+	t.checkLinks()
+	t.checkPagination()
+	t.checkConcurrentReads()
+
+	// Loops would hang fstest.TestFS too.
+	if !t.hung {
+		if err := fstest.TestFS(resolvedFS{fsys}, expected...); err != nil {
+			t.errors = append(t.errors, err)
+		}
+	}
+
+	return errors.Join(t.errors...)
+}
+
+type entry struct {
+	name string
+	typ  fs.FileMode
+}
+
+type tester struct {
+	fsys    fs.FS
+	entries []entry
+	errors  []error
+	// hung is set if a symbolic link couldn't be resolved in time.
+	hung bool
+}
+
+func (t *tester) errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Errorf(format, args...))
+}
+
+func (t *tester) walk() {
+	err := fs.WalkDir(t.fsys, ".", func(name string, de fs.DirEntry, err error) error {
+		if err != nil {
+			t.errorf("%s: %w", name, err)
+			return nil
+		}
+
+		t.entries = append(t.entries, entry{name: name, typ: de.Type()})
+		return nil
+	})
+	if err != nil {
+		t.errorf("walk: %w", err)
+	}
+}
+
+func (t *tester) checkLinks() {
+	linkFS, ok := t.fsys.(archivefs.ReadLinkFS)
+	if ok {
+		t.checkReadLinkFS(linkFS)
+	}
+
+	for _, e := range t.entries {
+		if e.typ&fs.ModeSymlink != 0 {
+			t.checkSymlink(e.name)
+		}
+	}
+}
+
+func (t *tester) checkReadLinkFS(linkFS archivefs.ReadLinkFS) {
+	for _, e := range t.entries {
+		fi, err := linkFS.StatLink(e.name)
+		if err != nil {
+			t.errorf("%s: StatLink: %w", e.name, err)
+			continue
+		}
+
+		if fi.Mode().Type() != e.typ {
+			t.errorf("%s: StatLink returned type %v, ReadDir returned %v", e.name, fi.Mode().Type(), e.typ)
+		}
+
+		if e.name != "." && fi.Name() != path.Base(e.name) {
+			t.errorf("%s: StatLink returned name %q", e.name, fi.Name())
+		}
+
+		if e.typ&fs.ModeSymlink != 0 {
+			target, err := linkFS.ReadLink(e.name)
+			if err != nil {
+				t.errorf("%s: ReadLink: %w", e.name, err)
+			} else if target == "" {
+				t.errorf("%s: ReadLink returned an empty target", e.name)
+			}
+			continue
+		}
+
+		if target, err := linkFS.ReadLink(e.name); err == nil {
+			t.errorf("%s: ReadLink of a non symbolic link returned %q", e.name, target)
+		}
+
+		// Without a symbolic link to follow, Stat and StatLink must agree.
+		sfi, err := fs.Stat(t.fsys, e.name)
+		if err != nil {
+			t.errorf("%s: Stat: %w", e.name, err)
+		} else if sfi.Mode() != fi.Mode() || sfi.Size() != fi.Size() || !sfi.ModTime().Equal(fi.ModTime()) {
+			t.errorf("%s: Stat and StatLink disagree: %s, %s", e.name, fs.FormatFileInfo(sfi), fs.FormatFileInfo(fi))
+		}
+	}
+
+	if slices.ContainsFunc(t.entries, func(e entry) bool { return e.name == missingName }) {
+		return
+	}
+
+	if _, err := linkFS.StatLink(missingName); !errors.Is(err, fs.ErrNotExist) {
+		t.errorf("%s: StatLink of a missing file returned %v, want fs.ErrNotExist", missingName, err)
+	}
+
+	if _, err := linkFS.ReadLink(missingName); !errors.Is(err, fs.ErrNotExist) {
+		t.errorf("%s: ReadLink of a missing file returned %v, want fs.ErrNotExist", missingName, err)
+	}
+
+	for _, name := range []string{"/" + missingName, "../" + missingName} {
+		if _, err := linkFS.StatLink(name); err == nil {
+			t.errorf("%s: StatLink of an invalid path succeeded", name)
+		}
+	}
+}
+
+func (t *tester) checkSymlink(name string) {
+	var (
+		fi      fs.FileInfo
+		statErr error
+	)
+	if !t.bounded(name, "Stat", func() { fi, statErr = fs.Stat(t.fsys, name) }) {
+		return
+	}
+
+	var (
+		f       fs.File
+		openErr error
+	)
+	if !t.bounded(name, "Open", func() { f, openErr = t.fsys.Open(name) }) {
+		return
+	}
+
+	if (statErr == nil) != (openErr == nil) {
+		t.errorf("%s: Stat and Open disagree: %v, %v", name, statErr, openErr)
+	}
+
+	if statErr == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		t.errorf("%s: Stat returned a symbolic link", name)
+	}
+
+	if f != nil {
+		ofi, err := f.Stat()
+		if err != nil {
+			t.errorf("%s: Open: Stat: %w", name, err)
+		} else if statErr == nil && ofi.Mode().Type() != fi.Mode().Type() {
+			t.errorf("%s: Stat returned type %v, Open returned %v", name, fi.Mode().Type(), ofi.Mode().Type())
+		}
+
+		if err := f.Close(); err != nil {
+			t.errorf("%s: Close: %w", name, err)
+		}
+	}
+
+	// Resolving paths through the link must terminate too.
+	t.bounded(path.Join(name, missingName), "Open", func() {
+		if f, err := t.fsys.Open(path.Join(name, missingName)); err == nil {
+			_ = f.Close()
+		}
+	})
+}
+
+// bounded runs fn, reporting whether it returned in time. A filesystem that
+// doesn't detect symbolic link loops will never return.
+func (t *tester) bounded(name, op string, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(linkTimeout):
+		t.errorf("%s: %s did not return after %v, symbolic link loop?", name, op, linkTimeout)
+		t.hung = true
+		return false
+	}
+}
+
+func (t *tester) checkPagination() {
+	for _, e := range t.entries {
+		if !e.typ.IsDir() {
+			continue
+		}
+
+		entries, err := fs.ReadDir(t.fsys, e.name)
+		if err != nil {
+			t.errorf("%s: ReadDir: %w", e.name, err)
+			continue
+		}
+
+		want := make([]string, len(entries))
+		for i, de := range entries {
+			want[i] = de.Name()
+		}
+
+		for _, n := range []int{1, 2, 3, 7} {
+			got, err := t.readDirPages(e.name, n)
+			if err != nil {
+				t.errorf("%s: %w", e.name, err)
+				break
+			} else if !slices.Equal(got, want) {
+				t.errorf("%s: ReadDir(%d) returned %q, want %q", e.name, n, got, want)
+				break
+			}
+		}
+	}
+}
+
+// readDirPages reads the named directory n entries at a time, returning the
+// sorted names of its entries.
+func (t *tester) readDirPages(name string, n int) ([]string, error) {
+	f, err := t.fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %w", err)
+	}
+	defer f.Close()
+
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, fmt.Errorf("Open returned %T, which is not a fs.ReadDirFile", f)
+	}
+
+	var names []string
+	for {
+		entries, err := dir.ReadDir(n)
+		if len(entries) > n {
+			return nil, fmt.Errorf("ReadDir(%d) returned %d entries", n, len(entries))
+		}
+
+		for _, de := range entries {
+			names = append(names, de.Name())
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("ReadDir(%d): %w", n, err)
+		} else if len(entries) == 0 {
+			return nil, fmt.Errorf("ReadDir(%d) returned no entries and no error", n)
+		}
+	}
+
+	if entries, err := dir.ReadDir(n); len(entries) != 0 || !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("ReadDir(%d) at the end of the directory returned %d entries, %v, want io.EOF", n, len(entries), err)
+	}
+
+	if entries, err := dir.ReadDir(-1); len(entries) != 0 || err != nil {
+		return nil, fmt.Errorf("ReadDir(-1) at the end of the directory returned %d entries, %v, want none", len(entries), err)
+	}
+
+	slices.Sort(names)
+	return names, nil
+}
+
+func (t *tester) checkConcurrentReads() {
+	var names []string
+	contents := make(map[string][]byte)
+	for _, e := range t.entries {
+		if !e.typ.IsRegular() {
+			continue
+		}
+
+		data, err := fs.ReadFile(t.fsys, e.name)
+		if err != nil {
+			t.errorf("%s: ReadFile: %w", e.name, err)
+			continue
+		}
+
+		names = append(names, e.name)
+		contents[e.name] = data
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	report := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		t.errors = append(t.errors, err)
+	}
+
+	// Every goroutine reads every file, each starting at a different one.
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := range names {
+				name := names[(i+j)%len(names)]
+
+				data, err := fs.ReadFile(t.fsys, name)
+				if err != nil {
+					report(fmt.Errorf("%s: concurrent ReadFile: %w", name, err))
+				} else if !bytes.Equal(data, contents[name]) {
+					report(fmt.Errorf("%s: concurrent ReadFile returned different contents", name))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		t.checkConcurrentReadAt(name, contents[name])
+	}
+}
+
+// checkConcurrentReadAt reads the named file in chunks concurrently, using a
+// single open file.
+func (t *tester) checkConcurrentReadAt(name string, data []byte) {
+	f, err := t.fsys.Open(name)
+	if err != nil {
+		t.errorf("%s: Open: %w", name, err)
+		return
+	}
+	defer f.Close()
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok || len(data) == 0 {
+		return
+	}
+
+	chunkSize := max(1, (len(data)+4*concurrency-1)/(4*concurrency))
+
+	errs := make([]error, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for off := i * chunkSize; off < len(data); off += concurrency * chunkSize {
+				want := data[off:min(off+chunkSize, len(data))]
+
+				buf := make([]byte, len(want))
+				n, err := ra.ReadAt(buf, int64(off))
+				if n != len(buf) || (err != nil && !errors.Is(err, io.EOF)) {
+					errs[i] = fmt.Errorf("%s: concurrent ReadAt(%d, %d) returned %d, %v", name, len(buf), off, n, err)
+					return
+				}
+
+				if !bytes.Equal(buf, want) {
+					errs[i] = fmt.Errorf("%s: concurrent ReadAt(%d, %d) returned different contents", name, len(buf), off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.errors = append(t.errors, err)
+		}
+	}
+}
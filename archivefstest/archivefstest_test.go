@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefstest_test
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestFS(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.MkdirAll("links", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, fsys.WriteFile(fmt.Sprintf("etc/ssl/cert%d.pem", i), []byte(fmt.Sprintf("cert %d", i)), 0o644))
+	}
+	require.NoError(t, fsys.Symlink("../etc/hostname", "links/hostname"))
+	require.NoError(t, fsys.Symlink("../etc/ssl", "links/ssl"))
+	require.NoError(t, fsys.Symlink("missing", "links/dangling"))
+	require.NoError(t, fsys.Symlink("loop", "links/loop"))
+	require.NoError(t, fsys.Symlink("b", "links/a"))
+	require.NoError(t, fsys.Symlink("a", "links/b"))
+
+	t.Run("Valid", func(t *testing.T) {
+		require.NoError(t, archivefstest.TestFS(fsys, "etc/hostname", "etc/ssl/cert0.pem", "links/hostname"))
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		err := archivefstest.TestFS(unpagedFS{fsys}, "etc/hostname")
+		require.ErrorContains(t, err, "etc/ssl: ReadDir(1) returned 10 entries")
+	})
+
+	t.Run("ReadLink", func(t *testing.T) {
+		err := archivefstest.TestFS(readLinkFS{fsys}, "etc/hostname")
+		require.ErrorContains(t, err, "etc/hostname: ReadLink of a non symbolic link returned \"\"")
+	})
+}
+
+// unpagedFS ignores the number of entries requested from directories.
+type unpagedFS struct {
+	*memfs.FS
+}
+
+func (u unpagedFS) Open(name string) (fs.File, error) {
+	f, err := u.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir, ok := f.(fs.ReadDirFile); ok {
+		return unpagedDir{dir}, nil
+	}
+
+	return f, nil
+}
+
+type unpagedDir struct {
+	fs.ReadDirFile
+}
+
+func (d unpagedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	return d.ReadDirFile.ReadDir(-1)
+}
+
+// readLinkFS doesn't check that files are symbolic links.
+type readLinkFS struct {
+	*memfs.FS
+}
+
+func (r readLinkFS) ReadLink(name string) (string, error) {
+	target, err := r.FS.ReadLink(name)
+	if err != nil {
+		if _, statErr := r.FS.StatLink(name); statErr == nil {
+			return "", nil
+		}
+	}
+
+	return target, err
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefstest
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// resolvedFS hides symbolic links that can't be resolved (eg. dangling links
+// or loops) from directory listings.
+type resolvedFS struct {
+	fsys fs.FS
+}
+
+func (r resolvedFS) Open(name string) (fs.File, error) {
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir, ok := f.(fs.ReadDirFile); ok {
+		return &resolvedDir{ReadDirFile: dir, fsys: r.fsys, name: name}, nil
+	}
+
+	return f, nil
+}
+
+func (r resolvedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(r.fsys, name)
+	return resolved(r.fsys, name, entries), err
+}
+
+func (r resolvedFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, name)
+}
+
+func (r resolvedFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+// ReadLink and Lstat implement fs.ReadLinkFS (Go 1.25), so that symbolic
+// links are recognized by fstest.TestFS, including within fs.Sub.
+func (r resolvedFS) ReadLink(name string) (string, error) {
+	if fsys, ok := r.fsys.(archivefs.ReadLinkFS); ok {
+		return fsys.ReadLink(name)
+	}
+
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (r resolvedFS) Lstat(name string) (fs.FileInfo, error) {
+	if fsys, ok := r.fsys.(archivefs.ReadLinkFS); ok {
+		return fsys.StatLink(name)
+	}
+
+	return fs.Stat(r.fsys, name)
+}
+
+type resolvedDir struct {
+	fs.ReadDirFile
+	fsys fs.FS
+	name string
+}
+
+func (d *resolvedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		if len(entries) == 0 || err != nil || n <= 0 {
+			return resolved(d.fsys, d.name, entries), err
+		}
+
+		// Don't return an empty page unless at the end of the directory.
+		if entries = resolved(d.fsys, d.name, entries); len(entries) > 0 {
+			return entries, nil
+		}
+	}
+}
+
+// resolved removes the entries of the named directory that are symbolic
+// links which can't be resolved.
+func resolved(fsys fs.FS, dir string, entries []fs.DirEntry) []fs.DirEntry {
+	return slices.DeleteFunc(entries, func(de fs.DirEntry) bool {
+		if de.Type()&fs.ModeSymlink == 0 {
+			return false
+		}
+
+		_, err := fs.Stat(fsys, path.Join(dir, de.Name()))
+		return err != nil
+	})
+}
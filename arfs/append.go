@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package arfs
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// Append adds the files in the root of src to an existing ar(1) archive.
+// Members with the same name as a file in src are replaced. Only the part of
+// the archive following the first modified member is rewritten, long
+// filenames are added to the GNU long filename table.
+//
+// If the archive shrinks, rw must implement Truncate(size int64) error (as
+// *os.File does). Symbol tables are not updated, so archives of object files
+// should be re-indexed with ranlib(1) afterwards.
+func Append(rw io.ReadWriteSeeker, src fs.FS) error {
+	ra, ok := rw.(io.ReaderAt)
+	if !ok {
+		ra = &seekReaderAt{rs: rw}
+	}
+
+	fsys, err := Open(ra)
+	if err != nil {
+		return err
+	}
+
+	hdrs, err := readHeaders(src, &CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	// Find the members that need to be removed.
+	cut := fsys.end
+	var removed []span
+	for _, hdr := range hdrs {
+		if e, ok := fsys.entries[archivefs.CleanPath(hdr.Name)]; ok {
+			removed = append(removed, e.span)
+			cut = min(cut, e.span.start)
+		}
+	}
+
+	// Adding long filenames requires rewriting the long filename table.
+	longNames := parseLongNameTable(fsys.longNames)
+	table := bytes.NewBuffer(slices.Clone(fsys.longNames))
+	addLongNames(table, longNames, hdrs)
+
+	rewriteTable := table.Len() != len(fsys.longNames)
+	if rewriteTable {
+		if fsys.longNames != nil {
+			removed = append(removed, fsys.longNamesSpan)
+			cut = min(cut, fsys.longNamesSpan.start)
+		} else {
+			cut = min(cut, fsys.firstMember)
+		}
+	}
+
+	// Buffer the retained members that follow the cut, as they will be
+	// overwritten.
+	var tail bytes.Buffer
+	if rewriteTable {
+		if err := writeLongNameTable(&tail, table.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	slices.SortFunc(removed, func(a, b span) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	offset := cut
+	for _, s := range append(removed, span{start: fsys.end, end: fsys.end}) {
+		if s.start > offset {
+			if _, err := io.Copy(&tail, io.NewSectionReader(ra, offset, s.start-offset)); err != nil {
+				return fmt.Errorf("failed to read existing members: %w", err)
+			}
+		}
+		offset = max(offset, s.end)
+	}
+
+	size := cut + int64(tail.Len())
+	for _, hdr := range hdrs {
+		size += 60 + hdr.Size + hdr.Size%2
+	}
+
+	truncater, canTruncate := rw.(interface{ Truncate(size int64) error })
+	if size < fsys.end && !canTruncate {
+		return errors.New("archive would shrink but does not support truncation")
+	}
+
+	if _, err := rw.Seek(cut, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := rw.Write(tail.Bytes()); err != nil {
+		return err
+	}
+
+	if err := writeMembers(rw, src, hdrs, LongNameGNU, longNames); err != nil {
+		return err
+	}
+
+	if size < fsys.end {
+		return truncater.Truncate(size)
+	}
+
+	return nil
+}
+
+// parseLongNameTable returns the offset of each name in a GNU long filename
+// table.
+func parseLongNameTable(table []byte) map[string]int {
+	longNames := map[string]int{}
+
+	var offset int
+	for _, line := range bytes.SplitAfter(table, []byte("\n")) {
+		if name := string(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("/"))); name != "" {
+			longNames[name] = offset
+		}
+		offset += len(line)
+	}
+
+	return longNames
+}
+
+// seekReaderAt adapts an io.ReadSeeker into an io.ReaderAt.
+type seekReaderAt struct {
+	rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.rs, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+
+	return n, err
+}
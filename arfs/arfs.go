@@ -37,26 +37,70 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/readdir"
 )
 
 var (
-	_ fs.FS        = (*FS)(nil)
-	_ fs.ReadDirFS = (*FS)(nil)
-	_ fs.StatFS    = (*FS)(nil)
+	_ fs.FS          = (*FS)(nil)
+	_ fs.ReadDirFS   = (*FS)(nil)
+	_ fs.StatFS      = (*FS)(nil)
+	_ fs.ReadDirFile = (*rootDir)(nil)
+	_ io.ReadSeeker  = (*file)(nil)
+	_ io.ReaderAt    = (*file)(nil)
 )
 
+// ErrCorrupted is returned when an archive is truncated or malformed, within
+// an *archiveerrors.ErrCorrupted giving the offset of the malformed member.
+var ErrCorrupted = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "corrupted archive")
+
 // FS is a filesystem that represents a Debian .deb flavored `ar(1)` archive.
 type FS struct {
 	entries map[string]*Entry
+	// longNames is the GNU long filename table, if present.
+	longNames []byte
+	// longNamesSpan is the location of the long filename table member.
+	longNamesSpan span
+	// firstMember is the offset of the first (non-symbol table) member.
+	firstMember int64
+	// end is the offset of the end of the archive.
+	end int64
+}
+
+// span is the location of a member (including its header and padding) within
+// the archive.
+type span struct {
+	start, end int64
+}
+
+// Options configures how an archive is opened.
+type Options struct {
+	// Strict enables the most defensive behavior, for archives from untrusted
+	// sources: archives containing more than one member with the same name
+	// (or more than one long filename table) are rejected as corrupted,
+	// rather than the last member shadowing the others.
+	Strict bool
 }
 
 // Open a new `ar(1)` archive from the given `io.ReaderAt`.
 func Open(ra io.ReaderAt) (*FS, error) {
+	return OpenWithOptions(ra, nil)
+}
+
+// OpenWithOptions opens an `ar(1)` archive with the given options.
+func OpenWithOptions(ra io.ReaderAt, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	// Validate the archive header.
 	offset, err := checkAr(ra)
 	if err != nil {
@@ -64,63 +108,151 @@ func Open(ra io.ReaderAt) (*FS, error) {
 	}
 
 	// Read the entries from the archive.
-	entries := map[string]*Entry{}
+	fsys := &FS{
+		entries:     map[string]*Entry{},
+		firstMember: -1,
+	}
+	// importLibrary is set once a "/" linker member has been seen, as every
+	// Windows import library begins with one.
+	var importLibrary bool
 	for {
 		line := make([]byte, 60)
 
 		n, err := ra.ReadAt(line, offset)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-
+		if err != nil && !errors.Is(err, io.EOF) {
 			return nil, err
 		}
 
-		if n == 1 && line[0] == '\n' {
-			return nil, io.EOF
+		// Tolerate a trailing newline after the final member.
+		if n == 0 || (n == 1 && line[0] == '\n') {
+			break
 		}
 		if n != 60 {
-			return nil, errors.New("short read")
+			return nil, corrupted(offset, errors.New("truncated member header"))
 		}
 
 		e, err := parseArEntry(line)
 		if err != nil {
-			return nil, err
+			return nil, corrupted(offset, err)
 		}
 
-		if strings.Contains(e.Filename, "/") {
-			return nil, fmt.Errorf("invalid filename: %s", e.Filename)
+		if e.FileSize < 0 {
+			return nil, corrupted(offset, fmt.Errorf("invalid member size: %d", e.FileSize))
 		}
 
 		begin := offset + int64(n)
-		e.data = func() io.Reader {
-			return io.NewSectionReader(ra, begin, e.FileSize)
+		// Leave room for the padding byte that follows odd sized members.
+		if e.FileSize > math.MaxInt64-begin-1 {
+			return nil, corrupted(offset, fmt.Errorf("invalid member size: %d", e.FileSize))
+		}
+
+		if e.FileSize > 0 {
+			// Make sure the member data is actually present.
+			if _, err := ra.ReadAt(make([]byte, 1), begin+e.FileSize-1); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, corrupted(offset, errors.New("truncated member data"))
+				}
+
+				return nil, err
+			}
+		}
+
+		e.span = span{start: offset, end: begin + e.FileSize + (e.FileSize % 2)}
+		offset = e.span.end
+
+		switch {
+		case e.Filename == "//":
+			// GNU long filename table.
+			if opts.Strict && fsys.longNames != nil {
+				return nil, corrupted(e.span.start, errors.New("duplicate long filename table"))
+			}
+
+			fsys.longNames = make([]byte, e.FileSize)
+			if _, err := ra.ReadAt(fsys.longNames, begin); err != nil {
+				return nil, fmt.Errorf("failed to read long filename table: %w", err)
+			}
+			fsys.longNamesSpan = e.span
+			continue
+		case isSymbolTable(e.Filename):
+			importLibrary = importLibrary || e.Filename == "/"
+			continue
+		}
+
+		name, prefixLen, err := resolveName(e, fsys.longNames, func(n int64) ([]byte, error) {
+			buf := make([]byte, n)
+			_, err := ra.ReadAt(buf, begin)
+			return buf, err
+		})
+		if err != nil {
+			return nil, corrupted(e.span.start, err)
+		}
+		begin += prefixLen
+
+		// Import members of Windows import libraries all share the name of
+		// the DLL, so expose them by the symbol they import instead.
+		if importLibrary {
+			if e.Import, err = readImportObject(io.NewSectionReader(ra, begin, e.FileSize)); err != nil {
+				return nil, err
+			} else if e.Import != nil {
+				name = e.Import.Symbol
+			}
 		}
-		offset += int64(n) + e.FileSize + (e.FileSize % 2)
 
-		entries[e.Filename] = e
+		e.Filename = archivefs.CleanPath(name)
+		if e.Filename == "" || strings.Contains(e.Filename, "/") {
+			return nil, corrupted(e.span.start, fmt.Errorf("invalid filename: %q", name))
+		}
+
+		size := e.FileSize
+		e.data = func() *io.SectionReader {
+			return io.NewSectionReader(ra, begin, size)
+		}
+
+		if opts.Strict {
+			if _, ok := fsys.entries[e.Filename]; ok {
+				return nil, corrupted(e.span.start, fmt.Errorf("duplicate member: %q", e.Filename))
+			}
+		}
+
+		if fsys.firstMember < 0 {
+			fsys.firstMember = e.span.start
+		}
+
+		fsys.entries[e.Filename] = e
+	}
+
+	fsys.end = offset
+	if fsys.firstMember < 0 {
+		fsys.firstMember = offset
 	}
 
-	return &FS{entries: entries}, nil
+	return fsys, nil
 }
 
 // Open a file from the archive.
 func (fsys *FS) Open(name string) (fs.File, error) {
-	name = sanitizePath(name)
+	cleaned := archivefs.CleanPath(name)
+
+	if cleaned == "" {
+		entries, err := fsys.ReadDir(".")
+		if err != nil {
+			return nil, err
+		}
 
-	e, ok := fsys.entries[name]
+		return &rootDir{Entries: readdir.New(entries)}, nil
+	}
+
+	e, ok := fsys.entries[cleaned]
 	if !ok {
-		return nil, fs.ErrNotExist
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
 	}
 
-	return &file{Entry: e, Reader: e.data()}, nil
+	return &file{Entry: e, SectionReader: e.data()}, nil
 }
 
 // ReadDir reads the contents of the archive.
 func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	name = sanitizePath(name)
-	if name != "" {
+	if archivefs.CleanPath(name) != "" {
 		return nil, errors.New("ar does not support directories")
 	}
 
@@ -138,18 +270,18 @@ func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
 
 // Stat a file in the archive.
 func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
-	name = sanitizePath(name)
+	cleaned := archivefs.CleanPath(name)
 
-	if name == "" {
+	if cleaned == "" {
 		return &Entry{
 			Filename: ".",
 			FileMode: fs.ModeDir,
 		}, nil
 	}
 
-	e, ok := fsys.entries[name]
+	e, ok := fsys.entries[cleaned]
 	if !ok {
-		return nil, fs.ErrNotExist
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
 	}
 
 	return e, nil
@@ -162,20 +294,25 @@ func parseArEntry(line []byte) (*Entry, error) {
 		return nil, errors.New("malformed file entry line length")
 	}
 
-	if line[58] != 0x60 && line[59] != 0x0A {
+	if line[58] != 0x60 || line[59] != 0x0A {
 		return nil, errors.New("malformed file entry line endings")
 	}
 
-	mode, err := strconv.ParseUint(strings.TrimSpace(string(line[40:48])), 8, 32)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse file mode: %w", err)
+	// Special members (eg. the long filename table) may omit the mode.
+	var mode uint64
+	if input := strings.TrimSpace(string(line[40:48])); input != "" {
+		var err error
+		mode, err = strconv.ParseUint(input, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file mode: %w", err)
+		}
 	}
 
 	// The tar package has a handy conversion function for the unix file mode bits.
 	fileMode := (&tar.Header{Mode: int64(mode)}).FileInfo().Mode()
 
 	e := Entry{
-		Filename: sanitizePath(string(line[0:16])),
+		Filename: strings.TrimSpace(string(line[0:16])),
 		FileMode: fileMode,
 	}
 
@@ -200,6 +337,70 @@ func parseArEntry(line []byte) (*Entry, error) {
 	return &e, nil
 }
 
+// corrupted wraps an error describing a malformed member with ErrCorrupted.
+func corrupted(offset int64, err error) error {
+	return &archiveerrors.ErrCorrupted{
+		Offset: offset,
+		Detail: err.Error(),
+		Err:    fmt.Errorf("%w: %w", ErrCorrupted, err),
+	}
+}
+
+// isSymbolTable reports whether the member with the given raw name is a
+// symbol table.
+func isSymbolTable(name string) bool {
+	return name == "/" || name == "/SYM64/" || name == "__.SYMDEF" || name == "__.SYMDEF SORTED"
+}
+
+// resolveName returns the filename of a member, handling GNU and BSD long
+// filenames. For BSD long filenames, the name is read from the start of the
+// member data using readPrefix, and the size of the prefix is returned (and
+// removed from the entry's size).
+func resolveName(e *Entry, longNames []byte, readPrefix func(n int64) ([]byte, error)) (string, int64, error) {
+	name := e.Filename
+	switch {
+	case strings.HasPrefix(name, "#1/"):
+		// BSD long filename, stored at the start of the member data.
+		nameLen, err := strconv.ParseInt(strings.TrimPrefix(name, "#1/"), 10, 64)
+		if err != nil || nameLen < 0 || nameLen > e.FileSize {
+			return "", 0, fmt.Errorf("invalid BSD long filename: %s", name)
+		}
+
+		buf, err := readPrefix(nameLen)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read BSD long filename: %w", err)
+		}
+
+		e.FileSize -= nameLen
+		return strings.TrimRight(string(buf), "\x00"), nameLen, nil
+	case strings.HasPrefix(name, "/"):
+		// GNU long filename, an offset into the long filename table.
+		name, err := lookupLongName(longNames, strings.TrimPrefix(name, "/"))
+		return name, 0, err
+	default:
+		// GNU terminates short filenames with a slash.
+		return strings.TrimSuffix(name, "/"), 0, nil
+	}
+}
+
+// lookupLongName returns the filename at the given offset in a GNU or MSVC
+// long filename table.
+func lookupLongName(longNames []byte, offset string) (string, error) {
+	i, err := strconv.Atoi(offset)
+	if err != nil || i < 0 || i >= len(longNames) {
+		return "", fmt.Errorf("invalid long filename offset: %s", offset)
+	}
+
+	// GNU terminates names with "/\n", MSVC with a NUL byte.
+	name := string(longNames[i:])
+	end := strings.IndexAny(name, "\n\x00")
+	if end < 0 {
+		return "", fmt.Errorf("unterminated long filename at offset: %d", i)
+	}
+
+	return strings.TrimSuffix(name[:end], "/"), nil
+}
+
 // Given a brand spank'n new os.File entry, go ahead and make sure it looks
 // like an `ar(1)` archive, and not some random file.
 func checkAr(ra io.ReaderAt) (int64, error) {
@@ -213,13 +414,11 @@ func checkAr(ra io.ReaderAt) (int64, error) {
 	return int64(len(header)), nil
 }
 
-func sanitizePath(name string) string {
-	return strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(filepath.ToSlash(strings.TrimSpace(name))), "."), "/")
-}
-
+// file is an open member. Member data is a section of the underlying archive
+// so it supports random access.
 type file struct {
 	*Entry
-	io.Reader
+	*io.SectionReader
 }
 
 func (f *file) Stat() (fs.FileInfo, error) {
@@ -230,6 +429,26 @@ func (f *file) Close() error {
 	return nil
 }
 
+// rootDir is the root directory of the archive.
+type rootDir struct {
+	readdir.Entries
+}
+
+func (d *rootDir) Stat() (fs.FileInfo, error) {
+	return &Entry{
+		Filename: ".",
+		FileMode: fs.ModeDir,
+	}, nil
+}
+
+func (d *rootDir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *rootDir) Close() error {
+	return nil
+}
+
 type Entry struct {
 	Filename  string
 	Timestamp int64
@@ -237,7 +456,10 @@ type Entry struct {
 	Gid       int64
 	FileMode  fs.FileMode
 	FileSize  int64
-	data      func() io.Reader
+	// Import is set for the short import members of Windows import libraries.
+	Import *ImportObject
+	data   func() *io.SectionReader
+	span   span
 }
 
 func (e *Entry) Name() string {
@@ -264,6 +486,11 @@ func (e *Entry) Sys() any {
 	return e
 }
 
+// Owner returns the numeric owner of the member.
+func (e *Entry) Owner() (uid, gid int) {
+	return int(e.Uid), int(e.Gid)
+}
+
 func (e *Entry) Type() fs.FileMode {
 	return e.FileMode & fs.ModeType
 }
@@ -10,15 +10,23 @@
 package arfs_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/dpeckett/archivefs/archivefstest"
 	"github.com/dpeckett/archivefs/arfs"
-	"github.com/dpeckett/archivefs/internal/testutil"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/hashfs"
 
 	"github.com/stretchr/testify/require"
 )
@@ -69,6 +77,42 @@ func TestArFS(t *testing.T) {
 
 	require.Equal(t, "hello.txt", dir[0].Name())
 	require.Equal(t, "lamp.txt", dir[1].Name())
+
+	_, err = fsys.Stat("/hello.txt")
+	require.NoError(t, err)
+
+	// Names are cleaned leniently (eg. a leading slash is accepted), so check
+	// conformance through a view that rejects invalid names.
+	require.NoError(t, archivefstest.TestFS(validNamesFS{fsys}, "hello.txt", "lamp.txt"))
+}
+
+// validNamesFS rejects names that are not valid, as required by fs.FS.
+type validNamesFS struct {
+	*arfs.FS
+}
+
+func (fsys validNamesFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.FS.Open(name)
+}
+
+func (fsys validNamesFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.FS.ReadDir(name)
+}
+
+func (fsys validNamesFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.FS.Stat(name)
 }
 
 func TestArFSDirHash(t *testing.T) {
@@ -81,7 +125,7 @@ func TestArFSDirHash(t *testing.T) {
 	srcFS, err := arfs.Open(srcFile)
 	require.NoError(t, err)
 
-	h, err := testutil.HashFS(srcFS)
+	h, err := hashfs.Hash(srcFS, nil)
 	require.NoError(t, err)
 
 	require.Equal(t, "h1:dTg4rf4sgf9d5r3dq6QekgeMcuDikVhqVELvfFkedDU=", h)
@@ -112,8 +156,507 @@ func TestArFSCreate(t *testing.T) {
 	dstFS, err := arfs.Open(dstFile)
 	require.NoError(t, err)
 
-	h, err := testutil.HashFS(dstFS)
+	h, err := hashfs.Hash(dstFS, nil)
 	require.NoError(t, err)
 
 	require.Equal(t, "h1:dTg4rf4sgf9d5r3dq6QekgeMcuDikVhqVELvfFkedDU=", h)
 }
+
+func TestArFSCreateLongNames(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"debian-binary":                      {Data: []byte("2.0\n"), Mode: 0o644},
+		"a-rather-long-filename.txt":         {Data: []byte("long\n"), Mode: 0o644},
+		"another-rather-long-filename.o.txt": {Data: []byte("longer\n"), Mode: 0o600},
+	}
+
+	for _, format := range []arfs.LongNameFormat{arfs.LongNameGNU, arfs.LongNameBSD} {
+		t.Run(fmt.Sprintf("Format%d", format), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, arfs.CreateWithOptions(&buf, srcFS, &arfs.CreateOptions{LongNames: format}))
+
+			if format == arfs.LongNameGNU {
+				// The date, owner and mode fields of the table are blank.
+				require.Contains(t, buf.String(), "\n//"+strings.Repeat(" ", 46))
+			}
+
+			dstFS, err := arfs.Open(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+
+			dir, err := dstFS.ReadDir(".")
+			require.NoError(t, err)
+			require.Len(t, dir, len(srcFS))
+
+			for name, f := range srcFS {
+				content, err := fs.ReadFile(dstFS, name)
+				require.NoError(t, err)
+				require.Equal(t, f.Data, content)
+
+				fi, err := dstFS.Stat(name)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(f.Data)), fi.Size())
+				require.Equal(t, f.Mode, fi.Mode())
+			}
+		})
+	}
+}
+
+func TestArFSCreateDeterministic(t *testing.T) {
+	create := func(modTime time.Time, mode fs.FileMode) []byte {
+		srcFS := fstest.MapFS{
+			"b.txt": {Data: []byte("b\n"), Mode: mode, ModTime: modTime},
+			"a.txt": {Data: []byte("a\n"), Mode: mode, ModTime: modTime},
+		}
+
+		var buf bytes.Buffer
+		require.NoError(t, arfs.CreateWithOptions(&buf, srcFS, &arfs.CreateOptions{Deterministic: true}))
+
+		return buf.Bytes()
+	}
+
+	a := create(time.Now(), 0o600)
+	b := create(time.Unix(1361157466, 0), 0o755)
+	require.Equal(t, a, b)
+
+	fsys, err := arfs.Open(bytes.NewReader(a))
+	require.NoError(t, err)
+
+	fi, err := fsys.Stat("a.txt")
+	require.NoError(t, err)
+
+	require.Zero(t, fi.ModTime().Unix())
+	require.Equal(t, fs.FileMode(0o644), fi.Mode())
+	require.Zero(t, fi.Sys().(*arfs.Entry).Uid)
+	require.Zero(t, fi.Sys().(*arfs.Entry).Gid)
+}
+
+func TestArFSAppend(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.a"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	require.NoError(t, arfs.Create(f, fstest.MapFS{
+		"a.txt":                      {Data: []byte("a\n"), Mode: 0o644},
+		"b.txt":                      {Data: []byte("a much longer b\n"), Mode: 0o644},
+		"c.txt":                      {Data: []byte("c\n"), Mode: 0o644},
+		"a-rather-long-filename.txt": {Data: []byte("long\n"), Mode: 0o644},
+	}))
+
+	// Replace a member with a shorter one, and add a long filename.
+	require.NoError(t, arfs.Append(f, fstest.MapFS{
+		"b.txt":                     {Data: []byte("b\n"), Mode: 0o600},
+		"another-long-filename.txt": {Data: []byte("longer\n"), Mode: 0o644},
+	}))
+
+	fsys, err := arfs.Open(f)
+	require.NoError(t, err)
+
+	expected := map[string]string{
+		"a.txt":                      "a\n",
+		"b.txt":                      "b\n",
+		"c.txt":                      "c\n",
+		"a-rather-long-filename.txt": "long\n",
+		"another-long-filename.txt":  "longer\n",
+	}
+
+	dir, err := fsys.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, dir, len(expected))
+
+	for name, data := range expected {
+		content, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err)
+		require.Equal(t, data, string(content))
+	}
+
+	fi, err := fsys.Stat("b.txt")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode())
+}
+
+func TestArFSReader(t *testing.T) {
+	for _, format := range []arfs.LongNameFormat{arfs.LongNameGNU, arfs.LongNameBSD} {
+		t.Run(fmt.Sprintf("Format%d", format), func(t *testing.T) {
+			srcFS := fstest.MapFS{
+				"debian-binary":              {Data: []byte("2.0\n"), Mode: 0o644},
+				"a-rather-long-filename.txt": {Data: []byte("long\n"), Mode: 0o644},
+				"odd.txt":                    {Data: []byte("odd"), Mode: 0o644},
+			}
+
+			var buf bytes.Buffer
+			require.NoError(t, arfs.CreateWithOptions(&buf, srcFS, &arfs.CreateOptions{LongNames: format}))
+
+			r := arfs.NewReader(io.MultiReader(&buf))
+
+			var names []string
+			for {
+				e, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+
+				// Skip reading one of the members entirely.
+				names = append(names, e.Filename)
+				if e.Filename == "odd.txt" {
+					continue
+				}
+
+				content, err := io.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, srcFS[e.Filename].Data, content)
+				require.Equal(t, int64(len(content)), e.Size())
+			}
+
+			require.Equal(t, []string{"a-rather-long-filename.txt", "debian-binary", "odd.txt"}, names)
+		})
+	}
+}
+
+func TestArFSCreatePreserveMetadata(t *testing.T) {
+	f, err := os.Open("testdata/multi_archive.a")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	srcFS, err := arfs.Open(f)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, arfs.CreateWithOptions(&buf, srcFS, &arfs.CreateOptions{
+		Header: func(name string, hdr *tar.Header) error {
+			if name == "lamp.txt" {
+				hdr.Uid = 1000
+				hdr.Mode = 0o600
+			}
+			return nil
+		},
+	}))
+
+	dstFS, err := arfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	fi, err := dstFS.Stat("hello.txt")
+	require.NoError(t, err)
+
+	require.Equal(t, int64(1361157466), fi.ModTime().Unix())
+	require.Equal(t, int64(501), fi.Sys().(*arfs.Entry).Uid)
+	require.Equal(t, int64(20), fi.Sys().(*arfs.Entry).Gid)
+
+	fi, err = dstFS.Stat("lamp.txt")
+	require.NoError(t, err)
+
+	require.Equal(t, int64(1000), fi.Sys().(*arfs.Entry).Uid)
+	require.Equal(t, int64(20), fi.Sys().(*arfs.Entry).Gid)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode())
+}
+
+func TestArFSReadDirFile(t *testing.T) {
+	f, err := os.Open("testdata/multi_archive.a")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := arfs.Open(f)
+	require.NoError(t, err)
+
+	root, err := fsys.Open(".")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, root.Close())
+	})
+
+	dir, ok := root.(fs.ReadDirFile)
+	require.True(t, ok)
+
+	var names []string
+	for {
+		entries, err := dir.ReadDir(1)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+
+	require.Equal(t, []string{"hello.txt", "lamp.txt"}, names)
+}
+
+func TestArFSCorrupted(t *testing.T) {
+	var valid bytes.Buffer
+	require.NoError(t, arfs.Create(&valid, fstest.MapFS{
+		"hello.txt": {Data: []byte("Hello world!\n"), Mode: 0o644},
+	}))
+
+	header := func(name, size string) string {
+		return fmt.Sprintf("%-16s%-12s%-6s%-6s%-8s%-10s`\n", name, "0", "0", "0", "644", size)
+	}
+
+	tests := map[string][]byte{
+		"TruncatedHeader": valid.Bytes()[:40],
+		"TruncatedData":   valid.Bytes()[:valid.Len()-4],
+		"NegativeSize":    []byte("!<arch>\n" + header("hello.txt", "-5")),
+		"InvalidSize":     []byte("!<arch>\n" + header("hello.txt", "abc")),
+		"OversizedData":   []byte("!<arch>\n" + header("hello.txt", "999999999") + "hello"),
+		"HugeSize":        []byte("!<arch>\n" + header("hello.txt", "9999999999") + "hello"),
+		"LongNameOffset":  []byte("!<arch>\n" + header("/42", "0")),
+		"BSDLongName":     []byte("!<arch>\n" + header("#1/20", "4") + "name"),
+		"HeaderEnding":    []byte("!<arch>\n" + header("hello.txt", "0")[:58] + "xx"),
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := arfs.Open(bytes.NewReader(data))
+			require.ErrorIs(t, err, arfs.ErrCorrupted)
+
+			r := arfs.NewReader(bytes.NewReader(data))
+			for err == nil {
+				_, err = r.Next()
+				if err == nil {
+					_, err = io.ReadAll(r)
+				}
+			}
+			require.ErrorIs(t, err, arfs.ErrCorrupted)
+		})
+	}
+}
+
+func TestArFSStrict(t *testing.T) {
+	header := func(name, size string) string {
+		return fmt.Sprintf("%-16s%-12s%-6s%-6s%-8s%-10s`\n", name, "0", "0", "0", "644", size)
+	}
+
+	duplicate := []byte("!<arch>\n" + header("hello.txt", "2") + "a\n" + header("hello.txt", "2") + "b\n")
+
+	// By default the last member wins.
+	fsys, err := arfs.Open(bytes.NewReader(duplicate))
+	require.NoError(t, err)
+
+	data, err := fs.ReadFile(fsys, "hello.txt")
+	require.NoError(t, err)
+	require.Equal(t, "b\n", string(data))
+
+	_, err = arfs.OpenWithOptions(bytes.NewReader(duplicate), &arfs.Options{Strict: true})
+	require.ErrorIs(t, err, arfs.ErrCorrupted)
+
+	var corrupted *archiveerrors.ErrCorrupted
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, int64(70), corrupted.Offset)
+
+	longNames := []byte("!<arch>\n" + header("//", "0") + header("//", "0"))
+	_, err = arfs.OpenWithOptions(bytes.NewReader(longNames), &arfs.Options{Strict: true})
+	require.ErrorIs(t, err, arfs.ErrCorrupted)
+
+	var valid bytes.Buffer
+	require.NoError(t, arfs.Create(&valid, fstest.MapFS{
+		"a.txt": {Data: []byte("a\n"), Mode: 0o644},
+		"b.txt": {Data: []byte("b\n"), Mode: 0o644},
+	}))
+
+	_, err = arfs.OpenWithOptions(bytes.NewReader(valid.Bytes()), &arfs.Options{Strict: true})
+	require.NoError(t, err)
+}
+
+func FuzzArFS(f *testing.F) {
+	for _, format := range []arfs.LongNameFormat{arfs.LongNameGNU, arfs.LongNameBSD} {
+		var buf bytes.Buffer
+		require.NoError(f, arfs.CreateWithOptions(&buf, fstest.MapFS{
+			"debian-binary":              {Data: []byte("2.0\n"), Mode: 0o644},
+			"a-rather-long-filename.txt": {Data: []byte("long\n"), Mode: 0o644},
+		}, &arfs.CreateOptions{LongNames: format}))
+		f.Add(buf.Bytes())
+	}
+
+	data, err := os.ReadFile("testdata/multi_archive.a")
+	require.NoError(f, err)
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if fsys, err := arfs.Open(bytes.NewReader(data)); err == nil {
+			entries, err := fsys.ReadDir(".")
+			require.NoError(t, err)
+
+			for _, e := range entries {
+				_, err := fs.ReadFile(fsys, e.Name())
+				require.NoError(t, err)
+			}
+		}
+
+		r := arfs.NewReader(bytes.NewReader(data))
+		for {
+			if _, err := r.Next(); err != nil {
+				break
+			}
+
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestArFSSeek(t *testing.T) {
+	f, err := os.Open("testdata/multi_archive.a")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := arfs.Open(f)
+	require.NoError(t, err)
+
+	arFile, err := fsys.Open("hello.txt")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, arFile.Close())
+	})
+
+	rs, ok := arFile.(io.ReadSeeker)
+	require.True(t, ok)
+
+	_, err = rs.Seek(-7, io.SeekEnd)
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(rs)
+	require.NoError(t, err)
+	require.Equal(t, "world!\n", string(content))
+
+	ra, ok := arFile.(io.ReaderAt)
+	require.True(t, ok)
+
+	buf := make([]byte, 5)
+	_, err = ra.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(buf))
+
+	// Reads must not extend beyond the end of the member.
+	_, err = ra.ReadAt(buf, 10)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestArFSImportLibrary(t *testing.T) {
+	t.Run("GNU", func(t *testing.T) {
+		// Generated with llvm-dlltool, the COFF objects and import members all
+		// share the (long) name of the DLL.
+		f, err := os.Open("testdata/hello.lib")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := arfs.Open(f)
+		require.NoError(t, err)
+
+		fi, err := fsys.Stat("HelloWorld")
+		require.NoError(t, err)
+
+		imp := fi.Sys().(*arfs.Entry).Import
+		require.NotNil(t, imp)
+		require.Equal(t, uint16(0x8664), imp.Machine)
+		require.Equal(t, "HelloWorld", imp.Symbol)
+		require.Equal(t, "averyveryverylongdllname.dll", imp.DLL)
+
+		fi, err = fsys.Stat("GoodbyeWorld")
+		require.NoError(t, err)
+		require.Equal(t, uint16(2), fi.Sys().(*arfs.Entry).Import.OrdinalOrHint)
+
+		fi, err = fsys.Stat("averyveryverylongdllname.dll")
+		require.NoError(t, err)
+		require.Nil(t, fi.Sys().(*arfs.Entry).Import)
+	})
+
+	t.Run("MSVC", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.WriteString("!<arch>\n")
+
+		member := func(name string, data []byte) {
+			fmt.Fprintf(&buf, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", name, "0", "", "", "0", len(data))
+			buf.Write(data)
+			if len(data)%2 != 0 {
+				buf.WriteString("\n")
+			}
+		}
+
+		// First and second linker members.
+		member("/", []byte{0, 0, 0, 0})
+		member("/", []byte{0, 0, 0, 0, 0, 0, 0, 0})
+		// MSVC terminates long filenames with a NUL byte.
+		member("//", []byte("averyveryverylongobjectname.obj\x00hello.dll\x00"))
+		member("/0", []byte("not really an object"))
+
+		imp := []byte{0, 0, 0xff, 0xff, 0, 0, 0x64, 0x86, 0, 0, 0, 0, 21, 0, 0, 0, 1, 0, 0x4, 0}
+		imp = append(imp, []byte("HelloWorld\x00hello.dll\x00")...)
+		member("hello.dll/", imp)
+
+		fsys, err := arfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		dir, err := fsys.ReadDir(".")
+		require.NoError(t, err)
+		require.Len(t, dir, 2)
+		require.Equal(t, "HelloWorld", dir[0].Name())
+		require.Equal(t, "averyveryverylongobjectname.obj", dir[1].Name())
+
+		fi, err := fsys.Stat("HelloWorld")
+		require.NoError(t, err)
+
+		require.Equal(t, &arfs.ImportObject{
+			Machine:       0x8664,
+			OrdinalOrHint: 1,
+			NameType:      1,
+			Symbol:        "HelloWorld",
+			DLL:           "hello.dll",
+		}, fi.Sys().(*arfs.Entry).Import)
+
+		// The streaming reader names members the same way, and leaves the
+		// import object to be read.
+		r := arfs.NewReader(bytes.NewReader(buf.Bytes()))
+
+		var names []string
+		for {
+			e, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, e.Name())
+
+			if e.Import != nil {
+				data, err := io.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, imp, data)
+			}
+		}
+		require.Equal(t, []string{"averyveryverylongobjectname.obj", "HelloWorld"}, names)
+	})
+
+	t.Run("NotImportLibrary", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.WriteString("!<arch>\n")
+
+		// Members that merely begin with the import object signature, one of
+		// which is malformed.
+		for _, member := range [][2]string{
+			{"a.bin", "\x00\x00\xff\xff\x00\x00\x64\x86\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00ab\x00\x00"},
+			{"b.bin", "\x00\x00\xff\xff\x00\x00\x64\x86\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00abcd"},
+		} {
+			fmt.Fprintf(&buf, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", member[0], "0", "0", "0", "644", len(member[1]))
+			buf.WriteString(member[1])
+		}
+
+		fsys, err := arfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		for _, name := range []string{"a.bin", "b.bin"} {
+			fi, err := fsys.Stat(name)
+			require.NoError(t, err)
+			require.Nil(t, fi.Sys().(*arfs.Entry).Import)
+		}
+	})
+}
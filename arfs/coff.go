@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package arfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ImportObject describes a short import member of a Windows (MSVC) import
+// library. Each one imports a single symbol from a DLL.
+type ImportObject struct {
+	// Machine is the COFF machine type (eg. 0x8664 for x86-64).
+	Machine uint16
+	// OrdinalOrHint is the import ordinal, or a hint into the DLL's export
+	// name table, depending on NameType.
+	OrdinalOrHint uint16
+	// Type is the import type (0 = code, 1 = data, 2 = const).
+	Type uint8
+	// NameType describes how the import name is derived from the symbol.
+	NameType uint8
+	// Symbol is the name of the imported symbol.
+	Symbol string
+	// DLL is the name of the DLL the symbol is imported from.
+	DLL string
+}
+
+// readImportObject parses a short import object, returning nil if the member
+// is not a well formed import object.
+func readImportObject(r io.Reader) (*ImportObject, error) {
+	var hdr struct {
+		Sig1          uint16
+		Sig2          uint16
+		Version       uint16
+		Machine       uint16
+		TimeDateStamp uint32
+		SizeOfData    uint32
+		OrdinalOrHint uint16
+		Flags         uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Anonymous objects share the signature but have a non-zero version.
+	if hdr.Sig1 != 0 || hdr.Sig2 != 0xFFFF || hdr.Version != 0 {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(hdr.SizeOfData)))
+	if err != nil {
+		return nil, err
+	}
+
+	symbol, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return nil, nil
+	}
+
+	dll, _, ok := bytes.Cut(rest, []byte{0})
+	if !ok {
+		return nil, nil
+	}
+
+	return &ImportObject{
+		Machine:       hdr.Machine,
+		OrdinalOrHint: hdr.OrdinalOrHint,
+		Type:          uint8(hdr.Flags & 0x3),
+		NameType:      uint8((hdr.Flags >> 2) & 0x7),
+		Symbol:        string(symbol),
+		DLL:           string(dll),
+	}, nil
+}
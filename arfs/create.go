@@ -11,62 +11,216 @@ package arfs
 
 import (
 	"archive/tar"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"strconv"
+	"time"
+
+	"github.com/dpeckett/archivefs"
 )
 
+// LongNameFormat is the format used to store filenames longer than 16
+// characters.
+type LongNameFormat int
+
+const (
+	// LongNameGNU stores long filenames in a GNU "//" filename table.
+	LongNameGNU LongNameFormat = iota
+	// LongNameBSD stores long filenames at the start of the member data, using
+	// the BSD "#1/N" convention.
+	LongNameBSD
+)
+
+// CreateOptions configures how an ar(1) archive is created.
+type CreateOptions struct {
+	// LongNames is the format used to store filenames longer than 16
+	// characters.
+	LongNames LongNameFormat
+	// Deterministic zeroes timestamps and owners and uses fixed file modes
+	// (equivalent to `ar D`), so the same input always produces a
+	// bit-for-bit identical archive. Members are always written in
+	// lexical order.
+	Deterministic bool
+	// Header, if set, is called with the header of each member before it is
+	// written, allowing its metadata (eg. ModTime, Uid, Gid, Mode) to be
+	// overridden. The name and size of the member cannot be changed.
+	Header func(name string, hdr *tar.Header) error
+}
+
+// Owner may be implemented by the value returned from fs.FileInfo.Sys() to
+// supply the numeric owner of a file.
+type Owner = archivefs.Owner
+
 // Create creates an ar(1) archive from the given filesystem.
 func Create(dst io.Writer, src fs.FS) error {
+	return CreateWithOptions(dst, src, nil)
+}
+
+// CreateWithOptions creates an ar(1) archive from the given filesystem.
+func CreateWithOptions(dst io.Writer, src fs.FS, opts *CreateOptions) error {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
 	// Write the ar(1) magic header
 	if _, err := io.WriteString(dst, "!<arch>\n"); err != nil {
 		return err
 	}
 
-	entries, err := fs.ReadDir(src, ".")
+	hdrs, err := readHeaders(src, opts)
 	if err != nil {
 		return err
 	}
 
+	// Build the GNU long filename table.
+	var table bytes.Buffer
+	longNames := map[string]int{}
+	if opts.LongNames == LongNameGNU {
+		addLongNames(&table, longNames, hdrs)
+
+		if err := writeLongNameTable(dst, table.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return writeMembers(dst, src, hdrs, opts.LongNames, longNames)
+}
+
+// readHeaders builds an ar(1) header for each file in the root of src.
+func readHeaders(src fs.FS, opts *CreateOptions) ([]*tar.Header, error) {
+	entries, err := fs.ReadDir(src, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var hdrs []*tar.Header
 	for _, d := range entries {
 		if d.IsDir() {
-			return errors.New("directories are not supported")
+			return nil, errors.New("directories are not supported")
 		}
 
 		if d.Type()&fs.ModeSymlink != 0 {
-			return errors.New("symlinks are not supported")
+			return nil, errors.New("symlinks are not supported")
 		}
 
 		fi, err := d.Info()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		hdr, err := tar.FileInfoHeader(fi, "")
 		if err != nil {
+			return nil, err
+		}
+
+		// Preserve the original owner of the file.
+		if sys, ok := fi.Sys().(Owner); ok {
+			hdr.Uid, hdr.Gid = sys.Owner()
+		}
+
+		if opts.Deterministic {
+			hdr.ModTime = time.Unix(0, 0)
+			hdr.Uid = 0
+			hdr.Gid = 0
+			hdr.Mode = 0o644
+		}
+
+		if opts.Header != nil {
+			name, size := hdr.Name, hdr.Size
+			if err := opts.Header(d.Name(), hdr); err != nil {
+				return nil, err
+			}
+
+			if hdr.Name != name || hdr.Size != size {
+				return nil, fmt.Errorf("name and size of %s cannot be changed", d.Name())
+			}
+		}
+
+		hdrs = append(hdrs, hdr)
+	}
+
+	return hdrs, nil
+}
+
+// addLongNames appends any filenames longer than 16 characters to a GNU long
+// filename table, recording the offset of each name.
+func addLongNames(table *bytes.Buffer, longNames map[string]int, hdrs []*tar.Header) {
+	for _, hdr := range hdrs {
+		name := archivefs.CleanPath(hdr.Name)
+		if _, ok := longNames[name]; ok || len(name) <= 16 {
+			continue
+		}
+
+		longNames[name] = table.Len()
+		table.WriteString(name + "/\n")
+	}
+}
+
+// writeLongNameTable writes a GNU long filename table member, if the table is
+// not empty.
+func writeLongNameTable(w io.Writer, table []byte) error {
+	if len(table) == 0 {
+		return nil
+	}
+
+	// As with GNU ar, the date, owner and mode fields of the table are blank.
+	if _, err := fmt.Fprintf(w, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", "//", "", "", "", "", len(table)); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(table); err != nil {
+		return err
+	}
+
+	if len(table)%2 != 0 {
+		if _, err := io.WriteString(w, "\n"); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// writeMembers writes a member for each of the given headers, reading the
+// file contents from src.
+func writeMembers(dst io.Writer, src fs.FS, hdrs []*tar.Header, format LongNameFormat, longNames map[string]int) error {
+	for _, hdr := range hdrs {
+		name := archivefs.CleanPath(hdr.Name)
+
+		var longName string
+		if len(name) > 16 {
+			switch format {
+			case LongNameGNU:
+				name = "/" + strconv.Itoa(longNames[name])
+			case LongNameBSD:
+				longName = name
+				name = "#1/" + strconv.Itoa(len(longName))
+			default:
+				return fmt.Errorf("unsupported long filename format: %d", format)
+			}
+		}
 
 		// Write ar(1) header for the file
-		if err := writeArHeader(dst, hdr); err != nil {
+		if err := writeArHeader(dst, name, hdr, int64(len(longName))+hdr.Size); err != nil {
 			return err
 		}
 
-		// Write file data (if not a directory)
-		if !d.IsDir() {
-			if err := writeArData(dst, src, d.Name(), hdr.Size); err != nil {
-				return err
-			}
+		if _, err := io.WriteString(dst, longName); err != nil {
+			return err
+		}
+
+		if err := writeArData(dst, src, hdr.Name, int64(len(longName))); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func writeArHeader(w io.Writer, hdr *tar.Header) error {
-	name := sanitizePath(hdr.Name)
+func writeArHeader(w io.Writer, name string, hdr *tar.Header, size int64) error {
 	if len(name) > 16 {
 		return fmt.Errorf("file name too long: %s", name)
 	}
@@ -79,7 +233,7 @@ func writeArHeader(w io.Writer, hdr *tar.Header) error {
 		strconv.Itoa(hdr.Uid),
 		strconv.Itoa(hdr.Gid),
 		fmt.Sprintf("%07o", hdr.Mode),
-		fmt.Sprintf("%-10d", hdr.Size),
+		fmt.Sprintf("%-10d", size),
 	)
 
 	// Write the ar header to the output
@@ -90,7 +244,7 @@ func writeArHeader(w io.Writer, hdr *tar.Header) error {
 	return nil
 }
 
-func writeArData(w io.Writer, src fs.FS, path string, size int64) error {
+func writeArData(w io.Writer, src fs.FS, path string, prefixLen int64) error {
 	// Open the file to read its data
 	file, err := src.Open(path)
 	if err != nil {
@@ -104,8 +258,8 @@ func writeArData(w io.Writer, src fs.FS, path string, size int64) error {
 		return err
 	}
 
-	// Handle padding if the file size is odd (ar format requires even size)
-	if n%2 != 0 {
+	// Handle padding if the member size is odd (ar format requires even size)
+	if (prefixLen+n)%2 != 0 {
 		if _, err := io.WriteString(w, "\n"); err != nil {
 			return err
 		}
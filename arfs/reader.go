@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package arfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+)
+
+var (
+	_ archivefs.Iterator = (*Iterator)(nil)
+)
+
+// Reader provides sequential access to the members of an ar(1) archive, for
+// use when the archive is streamed and an io.ReaderAt is not available.
+type Reader struct {
+	r         io.Reader
+	started   bool
+	longNames []byte
+	// importLibrary is set once a "/" linker member has been seen.
+	importLibrary bool
+	// remaining is the number of unread bytes in the current member.
+	remaining int64
+	// pad is the number of padding bytes following the current member.
+	pad int64
+	// member is the offset of the current member header.
+	member int64
+	// offset is the offset of the next member header.
+	offset int64
+	err    error
+}
+
+// NewReader creates a new Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next advances to the next member in the archive. Any remaining data in the
+// current member is discarded. io.EOF is returned at the end of the archive.
+func (ar *Reader) Next() (*Entry, error) {
+	if ar.err != nil {
+		return nil, ar.err
+	}
+
+	e, err := ar.next()
+	if err != nil {
+		ar.err = err
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (ar *Reader) next() (*Entry, error) {
+	if !ar.started {
+		ar.started = true
+
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(ar.r, header); err != nil {
+			return nil, fmt.Errorf("failed to read ar archive header: %w", err)
+		}
+		if string(header) != "!<arch>\n" {
+			return nil, errors.New("invalid ar archive header")
+		}
+		ar.offset = int64(len(header))
+	}
+
+	for {
+		if err := ar.skip(); err != nil {
+			return nil, err
+		}
+
+		offset := ar.offset
+
+		line := make([]byte, 60)
+		n, err := io.ReadFull(ar.r, line)
+		if err != nil {
+			// Tolerate a trailing newline after the final member.
+			if errors.Is(err, io.EOF) || (n == 1 && line[0] == '\n') {
+				return nil, io.EOF
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, corrupted(offset, errors.New("truncated member header"))
+			}
+
+			return nil, err
+		}
+
+		e, err := parseArEntry(line)
+		if err != nil {
+			return nil, corrupted(offset, err)
+		}
+
+		if e.FileSize < 0 {
+			return nil, corrupted(offset, fmt.Errorf("invalid member size: %d", e.FileSize))
+		}
+
+		ar.member = offset
+		ar.remaining = e.FileSize
+		ar.pad = e.FileSize % 2
+		ar.offset += int64(n) + e.FileSize + ar.pad
+
+		switch {
+		case e.Filename == "//":
+			// GNU long filename table, read incrementally so a bogus size
+			// can't trigger a huge allocation.
+			ar.longNames, err = io.ReadAll(ar)
+			if err != nil {
+				return nil, corrupted(offset, fmt.Errorf("failed to read long filename table: %w", err))
+			}
+			continue
+		case isSymbolTable(e.Filename):
+			ar.importLibrary = ar.importLibrary || e.Filename == "/"
+			continue
+		}
+
+		name, _, err := resolveName(e, ar.longNames, func(n int64) ([]byte, error) {
+			buf, err := io.ReadAll(io.LimitReader(ar, n))
+			if err == nil && int64(len(buf)) != n {
+				err = io.ErrUnexpectedEOF
+			}
+			return buf, err
+		})
+		if err != nil {
+			return nil, corrupted(offset, err)
+		}
+
+		if ar.importLibrary {
+			if e.Import, err = ar.readImportObject(); err != nil {
+				return nil, err
+			} else if e.Import != nil {
+				name = e.Import.Symbol
+			}
+		}
+
+		e.Filename = archivefs.CleanPath(name)
+		if e.Filename == "" || strings.Contains(e.Filename, "/") {
+			return nil, corrupted(offset, fmt.Errorf("invalid filename: %q", name))
+		}
+
+		return e, nil
+	}
+}
+
+// readImportObject parses the current member as a short import object, so
+// that it is named by the symbol it imports (as it is by FS). The bytes read
+// are returned to the member.
+func (ar *Reader) readImportObject() (*ImportObject, error) {
+	var consumed bytes.Buffer
+	imp, err := readImportObject(io.TeeReader(io.LimitReader(ar, ar.remaining), &consumed))
+
+	ar.r = io.MultiReader(&consumed, ar.r)
+	ar.remaining += int64(consumed.Len())
+
+	return imp, err
+}
+
+// Read reads from the current member. It returns io.EOF at the end of the
+// member, until Next is called to advance to the next member.
+func (ar *Reader) Read(p []byte) (int, error) {
+	if ar.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > ar.remaining {
+		p = p[:ar.remaining]
+	}
+
+	n, err := ar.r.Read(p)
+	ar.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && ar.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// skip discards any unread data and padding from the current member.
+func (ar *Reader) skip() error {
+	remaining, pad := ar.remaining, ar.pad
+	ar.remaining, ar.pad = 0, 0
+
+	if _, err := io.CopyN(io.Discard, ar.r, remaining); err != nil {
+		if errors.Is(err, io.EOF) {
+			return corrupted(ar.member, errors.New("truncated member data"))
+		}
+		return err
+	}
+
+	// Tolerate archives that omit the padding after the final member.
+	if _, err := io.CopyN(io.Discard, ar.r, pad); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// Iterator adapts a Reader to the archivefs.Iterator interface.
+type Iterator struct {
+	ar *Reader
+}
+
+// NewIterator returns an Iterator over the members of the ar(1) archive read
+// from r.
+func NewIterator(r io.Reader) *Iterator {
+	return &Iterator{ar: NewReader(r)}
+}
+
+// Next advances to the next member in the archive. Any remaining data in the
+// current member is discarded. io.EOF is returned at the end of the archive.
+func (it *Iterator) Next() (*archivefs.Entry, io.Reader, error) {
+	e, err := it.ar.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return archivefs.NewEntryFromInfo(e.Filename, e), it.ar, nil
+}
@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+// Windows file attributes that may be conveyed by an archive.
+const (
+	FileAttributeReadOnly uint32 = 0x1
+	FileAttributeHidden   uint32 = 0x2
+	FileAttributeSystem   uint32 = 0x4
+	FileAttributeArchive  uint32 = 0x20
+)
+
+// FileAttributes may be implemented by the value returned from
+// fs.FileInfo.Sys() to supply the Windows attributes of a file (eg. the
+// FileAttribute* flags), eg. when extracting an archive created on Windows.
+type FileAttributes interface {
+	FileAttributes() uint32
+}
@@ -0,0 +1,316 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package blockcache caches fixed-size blocks of an io.ReaderAt in memory
+// and/or on disk, evicting the least recently used blocks. This greatly
+// reduces the cost of the many small reads issued by filesystems (eg. erofs
+// and tarfs) when they are backed by a slow remote source, such as an object
+// in cloud storage.
+package blockcache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	_ io.ReaderAt = (*ReaderAt)(nil)
+)
+
+// Options configures a block cache.
+type Options struct {
+	// BlockSize is the size of each cached block in bytes, defaults to 64 KiB.
+	BlockSize int
+	// MemoryBlocks is the maximum number of blocks cached in memory, defaults
+	// to 256. A negative value disables the memory cache.
+	MemoryBlocks int
+	// DiskBlocks is the maximum number of blocks cached on disk, in a
+	// temporary file that is removed by Close. Blocks evicted from memory are
+	// moved to the disk cache. Zero disables the disk cache.
+	DiskBlocks int
+	// Dir is the directory for the disk cache, defaults to os.TempDir().
+	Dir string
+}
+
+// Stats describes the effectiveness of a cache.
+type Stats struct {
+	// Hits is the number of block reads served from memory.
+	Hits int64
+	// DiskHits is the number of block reads served from disk.
+	DiskHits int64
+	// Misses is the number of block reads from the underlying reader.
+	Misses int64
+}
+
+// ReaderAt caches the blocks of an underlying io.ReaderAt. Concurrent reads
+// of the same uncached block are coalesced into a single read. It is safe
+// for concurrent use. The contents of the underlying reader must not change.
+type ReaderAt struct {
+	ra        io.ReaderAt
+	blockSize int64
+
+	mu       sync.Mutex
+	mem      *lru[[]byte]
+	disk     *diskCache
+	inflight map[int64]*load
+	stats    Stats
+}
+
+// load is a pending read of a block from the underlying reader.
+type load struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// New returns a ReaderAt that caches blocks of ra.
+func New(ra io.ReaderAt, opts *Options) (*ReaderAt, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = 64 * 1024
+	}
+
+	memoryBlocks := opts.MemoryBlocks
+	if memoryBlocks == 0 {
+		memoryBlocks = 256
+	}
+
+	r := &ReaderAt{
+		ra:        ra,
+		blockSize: int64(blockSize),
+		inflight:  map[int64]*load{},
+	}
+
+	if opts.DiskBlocks > 0 {
+		disk, err := newDiskCache(opts.Dir, opts.DiskBlocks, r.blockSize)
+		if err != nil {
+			return nil, err
+		}
+		r.disk = disk
+	}
+
+	if memoryBlocks > 0 {
+		r.mem = newLRU[[]byte](memoryBlocks)
+		if r.disk != nil {
+			r.mem.onEvict = r.disk.put
+		}
+	}
+
+	return r, nil
+}
+
+// ReadAt reads len(p) bytes starting at off, from the cache if possible.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / r.blockSize
+
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+
+		start := pos - index*r.blockSize
+		if start >= int64(len(block)) {
+			return n, io.EOF
+		}
+
+		n += copy(p[n:], block[start:])
+
+		// A short block is the last in the underlying reader.
+		if int64(len(block)) < r.blockSize && n < len(p) {
+			return n, io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// Stats returns the cache statistics.
+func (r *ReaderAt) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+// Close removes the disk cache (if any). The underlying reader is not
+// closed.
+func (r *ReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.disk == nil {
+		return nil
+	}
+
+	err := r.disk.close()
+	r.disk = nil
+	if r.mem != nil {
+		r.mem.onEvict = nil
+	}
+
+	return err
+}
+
+// block returns the contents of a block, which is only shorter than the
+// block size if it is the last block.
+func (r *ReaderAt) block(index int64) ([]byte, error) {
+	r.mu.Lock()
+
+	if r.mem != nil {
+		if data, ok := r.mem.get(index); ok {
+			r.stats.Hits++
+			r.mu.Unlock()
+			return data, nil
+		}
+	}
+
+	if r.disk != nil {
+		if data, ok := r.disk.get(index); ok {
+			r.stats.DiskHits++
+			if r.mem != nil {
+				r.mem.put(index, data)
+			}
+			r.mu.Unlock()
+			return data, nil
+		}
+	}
+
+	if l, ok := r.inflight[index]; ok {
+		r.mu.Unlock()
+		<-l.done
+		return l.data, l.err
+	}
+
+	l := &load{done: make(chan struct{})}
+	r.inflight[index] = l
+	r.stats.Misses++
+	r.mu.Unlock()
+
+	l.data, l.err = r.read(index)
+
+	r.mu.Lock()
+	delete(r.inflight, index)
+	if l.err == nil {
+		if r.mem != nil {
+			r.mem.put(index, l.data)
+		} else if r.disk != nil {
+			r.disk.put(index, l.data)
+		}
+	}
+	r.mu.Unlock()
+
+	close(l.done)
+
+	return l.data, l.err
+}
+
+// read reads a block from the underlying reader.
+func (r *ReaderAt) read(index int64) ([]byte, error) {
+	data := make([]byte, r.blockSize)
+	n, err := r.ra.ReadAt(data, index*r.blockSize)
+	if n < len(data) && err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return data[:n], nil
+}
+
+// diskCache stores blocks in fixed size slots of a temporary file.
+type diskCache struct {
+	f         *os.File
+	blockSize int64
+	// slots maps each cached block to its slot.
+	slots *lru[diskSlot]
+	// free holds slots that can be reused.
+	free []int64
+	next int64
+}
+
+type diskSlot struct {
+	slot int64
+	size int
+}
+
+func newDiskCache(dir string, maxBlocks int, blockSize int64) (*diskCache, error) {
+	f, err := os.CreateTemp(dir, "blockcache-*")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{f: f, blockSize: blockSize}
+	c.slots = newLRU[diskSlot](maxBlocks)
+	c.slots.onEvict = func(index int64, s diskSlot) {
+		c.free = append(c.free, s.slot)
+	}
+
+	return c, nil
+}
+
+// get reads a cached block, failures are treated as a miss.
+func (c *diskCache) get(index int64) ([]byte, bool) {
+	s, ok := c.slots.get(index)
+	if !ok {
+		return nil, false
+	}
+
+	data := make([]byte, s.size)
+	if _, err := c.f.ReadAt(data, s.slot*c.blockSize); err != nil {
+		c.slots.remove(index)
+		c.free = append(c.free, s.slot)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// put caches a block, failures are ignored (as the block can always be read
+// again).
+func (c *diskCache) put(index int64, data []byte) {
+	if _, ok := c.slots.get(index); ok {
+		return
+	}
+
+	// Evict a block first, if needed, so that its slot can be reused.
+	if c.slots.len() >= c.slots.max {
+		c.slots.evictOldest()
+	}
+
+	var slot int64
+	if len(c.free) > 0 {
+		slot = c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+	} else {
+		slot = c.next
+		c.next++
+	}
+
+	if _, err := c.f.WriteAt(data, slot*c.blockSize); err != nil {
+		c.free = append(c.free, slot)
+		return
+	}
+
+	c.slots.put(index, diskSlot{slot: slot, size: len(data)})
+}
+
+func (c *diskCache) close() error {
+	return errors.Join(c.f.Close(), os.Remove(c.f.Name()))
+}
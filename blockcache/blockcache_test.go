@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package blockcache_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/archivefs/blockcache"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderAt(t *testing.T) {
+	data := make([]byte, 10*1024+123)
+	_, err := rand.New(rand.NewSource(1)).Read(data)
+	require.NoError(t, err)
+
+	t.Run("Memory", func(t *testing.T) {
+		src := &countingReaderAt{ra: bytes.NewReader(data)}
+		r, err := blockcache.New(src, &blockcache.Options{BlockSize: 1024})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, r.Close())
+		})
+
+		checkReads(t, r, data)
+
+		reads := src.reads.Load()
+		checkReads(t, r, data)
+		require.Equal(t, reads, src.reads.Load())
+
+		stats := r.Stats()
+		require.Equal(t, int64(11), stats.Misses)
+		require.NotZero(t, stats.Hits)
+		require.Zero(t, stats.DiskHits)
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		dir := t.TempDir()
+
+		src := &countingReaderAt{ra: bytes.NewReader(data)}
+		r, err := blockcache.New(src, &blockcache.Options{
+			BlockSize:    1024,
+			MemoryBlocks: 2,
+			DiskBlocks:   16,
+			Dir:          dir,
+		})
+		require.NoError(t, err)
+
+		checkReads(t, r, data)
+
+		// Blocks evicted from memory are read from disk.
+		reads := src.reads.Load()
+		checkReads(t, r, data)
+		require.Equal(t, reads, src.reads.Load())
+		require.NotZero(t, r.Stats().DiskHits)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		require.NoError(t, r.Close())
+
+		entries, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		// Reads still work, without the disk cache.
+		checkReads(t, r, data)
+	})
+
+	t.Run("DiskOnly", func(t *testing.T) {
+		src := &countingReaderAt{ra: bytes.NewReader(data)}
+		r, err := blockcache.New(src, &blockcache.Options{
+			BlockSize:    1024,
+			MemoryBlocks: -1,
+			DiskBlocks:   4,
+			Dir:          t.TempDir(),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, r.Close())
+		})
+
+		checkReads(t, r, data)
+
+		stats := r.Stats()
+		require.Zero(t, stats.Hits)
+		require.NotZero(t, stats.DiskHits)
+		require.Greater(t, stats.Misses, int64(11))
+	})
+
+	t.Run("Coalesce", func(t *testing.T) {
+		src := &countingReaderAt{ra: bytes.NewReader(data), delay: 10 * time.Millisecond}
+		r, err := blockcache.New(src, &blockcache.Options{BlockSize: 1024})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				buf := make([]byte, 100)
+				_, err := r.ReadAt(buf, 10)
+				require.NoError(t, err)
+				require.Equal(t, data[10:110], buf)
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, int32(1), src.reads.Load())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errBroken := errors.New("broken")
+
+		src := &countingReaderAt{ra: bytes.NewReader(data), err: errBroken}
+		r, err := blockcache.New(src, nil)
+		require.NoError(t, err)
+
+		_, err = r.ReadAt(make([]byte, 10), 0)
+		require.ErrorIs(t, err, errBroken)
+
+		// Errors are not cached.
+		src.err = nil
+
+		buf := make([]byte, 10)
+		_, err = r.ReadAt(buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data[:10], buf)
+	})
+
+	t.Run("TarFS", func(t *testing.T) {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("etc", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/data", data, 0o644))
+
+		var archive bytes.Buffer
+		require.NoError(t, tarfs.Create(&archive, fsys))
+
+		src := &countingReaderAt{ra: bytes.NewReader(archive.Bytes())}
+		r, err := blockcache.New(src, &blockcache.Options{BlockSize: 4096})
+		require.NoError(t, err)
+
+		tarFS, err := tarfs.Open(r)
+		require.NoError(t, err)
+
+		contents, err := fs.ReadFile(tarFS, "etc/data")
+		require.NoError(t, err)
+		require.Equal(t, data, contents)
+
+		// Every block is only read once.
+		require.LessOrEqual(t, src.reads.Load(), int32(archive.Len()/4096+1))
+	})
+}
+
+// checkReads reads the whole of r in variously sized chunks, and checks the
+// behavior at the end of the data.
+func checkReads(t *testing.T, r io.ReaderAt, data []byte) {
+	t.Helper()
+
+	for _, size := range []int{1, 100, 1024, 3000} {
+		for off := 0; off < len(data); off += size {
+			buf := make([]byte, size)
+			n, err := r.ReadAt(buf, int64(off))
+			if off+size > len(data) {
+				require.ErrorIs(t, err, io.EOF)
+				require.Equal(t, len(data)-off, n)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, size, n)
+			}
+			require.Equal(t, data[off:off+n], buf[:n])
+		}
+	}
+
+	_, err := r.ReadAt(make([]byte, 1), int64(len(data)))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+type countingReaderAt struct {
+	ra    io.ReaderAt
+	reads atomic.Int32
+	delay time.Duration
+	err   error
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	time.Sleep(r.delay)
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	return r.ra.ReadAt(p, off)
+}
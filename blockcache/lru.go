@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package blockcache
+
+import (
+	"container/list"
+)
+
+// lru is a least recently used cache of values keyed by block index. It is
+// not safe for concurrent use.
+type lru[V any] struct {
+	max   int
+	order *list.List
+	items map[int64]*list.Element
+	// onEvict, if set, is called with each value evicted from the cache.
+	onEvict func(index int64, value V)
+}
+
+type lruEntry[V any] struct {
+	index int64
+	value V
+}
+
+func newLRU[V any](max int) *lru[V] {
+	return &lru[V]{
+		max:   max,
+		order: list.New(),
+		items: map[int64]*list.Element{},
+	}
+}
+
+func (c *lru[V]) len() int {
+	return len(c.items)
+}
+
+// get returns the cached value, marking it as the most recently used.
+func (c *lru[V]) get(index int64) (V, bool) {
+	e, ok := c.items[index]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[V]).value, true
+}
+
+// put caches a value, evicting the least recently used value if the cache is
+// full.
+func (c *lru[V]) put(index int64, value V) {
+	if e, ok := c.items[index]; ok {
+		e.Value.(*lruEntry[V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	if len(c.items) >= c.max {
+		c.evictOldest()
+	}
+
+	c.items[index] = c.order.PushFront(&lruEntry[V]{index: index, value: value})
+}
+
+func (c *lru[V]) remove(index int64) {
+	if e, ok := c.items[index]; ok {
+		c.order.Remove(e)
+		delete(c.items, index)
+	}
+}
+
+func (c *lru[V]) evictOldest() {
+	e := c.order.Back()
+	if e == nil {
+		return
+	}
+
+	entry := e.Value.(*lruEntry[V])
+	c.order.Remove(e)
+	delete(c.items, entry.index)
+
+	if c.onEvict != nil {
+		c.onEvict(entry.index, entry.value)
+	}
+}
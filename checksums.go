@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrChecksumMismatch is returned when the contents of a file do not match
+// the checksum recorded in a manifest.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumOptions configures the hashing of files.
+type ChecksumOptions struct {
+	// Concurrency is the number of files to hash concurrently. If less than
+	// or equal to one, files are hashed sequentially.
+	Concurrency int
+}
+
+// Checksums returns the hex encoded SHA-256 digest of every regular file in
+// fsys, keyed by path.
+func Checksums(fsys fs.FS, opts *ChecksumOptions) (map[string]string, error) {
+	if opts == nil {
+		opts = &ChecksumOptions{}
+	}
+
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			names = append(names, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashFiles(fsys, names, opts.Concurrency, false)
+}
+
+// WriteChecksums writes a manifest of the SHA-256 digests of every regular
+// file in fsys to w, in the format used by sha256sum(1) (ie. SHA256SUMS
+// files). Entries are sorted by path.
+func WriteChecksums(w io.Writer, fsys fs.FS, opts *ChecksumOptions) error {
+	sums, err := Checksums(fsys, opts)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		// Escape unusual names in the same way as sha256sum(1).
+		prefix, escaped := "", name
+		if strings.ContainsAny(name, "\\\n\r") {
+			prefix = "\\"
+			escaped = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(name)
+		}
+
+		if _, err := fmt.Fprintf(bw, "%s%s  %s\n", prefix, sums[name], escaped); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// VerifyChecksums verifies the files in fsys against a manifest in the
+// format used by sha256sum(1), read from r. Files that are not listed in
+// the manifest are ignored. Every file is checked, and the returned error
+// (if any) joins the errors for each file that is missing or does not
+// match (the latter wrapping ErrChecksumMismatch).
+func VerifyChecksums(fsys fs.FS, r io.Reader, opts *ChecksumOptions) error {
+	if opts == nil {
+		opts = &ChecksumOptions{}
+	}
+
+	want, err := readChecksums(r)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var errs []error
+	for _, name := range names {
+		if !fs.ValidPath(name) {
+			errs = append(errs, &fs.PathError{Op: "verify", Path: name, Err: fs.ErrInvalid})
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	got, err := hashFiles(fsys, names, opts.Concurrency, true)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		switch sum, ok := got[name]; {
+		case !ok:
+			errs = append(errs, &fs.PathError{Op: "verify", Path: name, Err: fs.ErrNotExist})
+		case sum != want[name]:
+			errs = append(errs, &fs.PathError{Op: "verify", Path: name, Err: ErrChecksumMismatch})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// readChecksums parses a manifest in the format used by sha256sum(1).
+func readChecksums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(sum) != hex.EncodedLen(sha256.Size) || name == "" {
+			return nil, fmt.Errorf("malformed checksum manifest line %d", lineNo)
+		}
+
+		// The second separator character indicates text (' ') or binary
+		// ('*') mode, which makes no difference here.
+		if name[0] == ' ' || name[0] == '*' {
+			name = name[1:]
+		}
+
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(name)
+		}
+
+		sums[strings.TrimPrefix(name, "./")] = strings.ToLower(sum)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+// hashFiles returns the hex encoded SHA-256 digests of the named files. If
+// ignoreMissing is set, files that do not exist are omitted from the result
+// rather than returning an error.
+func hashFiles(fsys fs.FS, names []string, workers int, ignoreMissing bool) (map[string]string, error) {
+	sums := make(map[string]string, len(names))
+	var mu sync.Mutex
+
+	hashOne := func(name string) error {
+		sum, err := hashFile(fsys, name)
+		if err != nil {
+			if ignoreMissing && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		mu.Lock()
+		sums[name] = sum
+		mu.Unlock()
+
+		return nil
+	}
+
+	if workers <= 1 {
+		for _, name := range names {
+			if err := hashOne(name); err != nil {
+				return nil, err
+			}
+		}
+
+		return sums, nil
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for name := range work {
+				if err := hashOne(name); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case work <- name:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read file %s: %w", name, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
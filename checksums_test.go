@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums(t *testing.T) {
+	src := fstest.MapFS{
+		"hello.txt":     {Data: []byte("hello\n")},
+		"dir/empty":     {Data: []byte{}},
+		"dir/back\\ash": {Data: []byte("escaped")},
+		"link":          {Data: []byte("hello.txt"), Mode: fs.ModeSymlink},
+	}
+
+	for _, concurrency := range []int{0, 4} {
+		sums, err := archivefs.Checksums(src, &archivefs.ChecksumOptions{Concurrency: concurrency})
+		require.NoError(t, err)
+		require.Len(t, sums, 3)
+		require.Equal(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", sums["hello.txt"])
+		require.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", sums["dir/empty"])
+	}
+
+	var manifest bytes.Buffer
+	require.NoError(t, archivefs.WriteChecksums(&manifest, src, nil))
+
+	require.Equal(t, `\`+"044c5f4a04d6114914bde9e6ef5e5c8001e5b15101114d235aa61cdde7c6d718  dir/back\\\\ash\n"+
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  dir/empty\n"+
+		"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  hello.txt\n", manifest.String())
+
+	t.Run("Verify", func(t *testing.T) {
+		require.NoError(t, archivefs.VerifyChecksums(src, bytes.NewReader(manifest.Bytes()), &archivefs.ChecksumOptions{
+			Concurrency: 2,
+		}))
+
+		// Binary mode and "./" prefixed paths are accepted.
+		err := archivefs.VerifyChecksums(src, strings.NewReader(
+			"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03 *./hello.txt\n"), nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		modified := fstest.MapFS{
+			"hello.txt": {Data: []byte("goodbye\n")},
+			"dir/empty": {Data: []byte{}},
+		}
+
+		err := archivefs.VerifyChecksums(modified, bytes.NewReader(manifest.Bytes()), nil)
+		require.ErrorIs(t, err, archivefs.ErrChecksumMismatch)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.ErrorContains(t, err, "hello.txt")
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		err := archivefs.VerifyChecksums(src, strings.NewReader("not a manifest\n"), nil)
+		require.Error(t, err)
+	})
+}
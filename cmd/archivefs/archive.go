@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpeckett/archivefs/anyfs"
+)
+
+// archive is an open archive of any format.
+type archive struct {
+	fsys   fs.FS
+	format anyfs.Format
+	f      *os.File
+}
+
+// openArchive opens the named archive, detecting its format.
+func openArchive(name string) (*archive, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, format, err := anyfs.Open(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return &archive{fsys: fsys, format: format, f: f}, nil
+}
+
+func (a *archive) Close() error {
+	var errs []error
+	if closer, ok := a.fsys.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	errs = append(errs, a.f.Close())
+
+	return errors.Join(errs...)
+}
+
+// writeArchive writes fsys to the named file as an archive, or to stdout if
+// the name is "-". If format is unknown, it is inferred from the name of the
+// file.
+func writeArchive(name string, format anyfs.Format, fsys fs.FS, stdout io.Writer) error {
+	if format == anyfs.FormatUnknown {
+		format = formatFromName(name)
+		if format == anyfs.FormatUnknown {
+			return fmt.Errorf("unable to infer the format of %s, use -format", name)
+		}
+	}
+
+	if name == "-" {
+		return anyfs.Convert(stdout, format, fsys, nil)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if err := anyfs.Convert(f, format, fsys, nil); err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+
+	return f.Close()
+}
+
+// formats is the list of formats that archives can be created in.
+var formats = []anyfs.Format{
+	anyfs.FormatTar,
+	anyfs.FormatTarGzip,
+	anyfs.FormatTarXz,
+	anyfs.FormatTarZstd,
+	anyfs.FormatAr,
+	anyfs.FormatEROFS,
+}
+
+// formatFlag is a flag.Value selecting the format of an archive.
+type formatFlag struct {
+	format anyfs.Format
+}
+
+func (f *formatFlag) String() string {
+	if f.format == anyfs.FormatUnknown {
+		return ""
+	}
+
+	return f.format.String()
+}
+
+func (f *formatFlag) Set(s string) error {
+	for _, format := range formats {
+		if format.String() == s {
+			f.format = format
+			return nil
+		}
+	}
+
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		names[i] = format.String()
+	}
+
+	return fmt.Errorf("unsupported format %q (must be one of %s)", s, strings.Join(names, ", "))
+}
+
+// formatFromName infers the format of an archive from its file extension.
+func formatFromName(name string) anyfs.Format {
+	name = strings.ToLower(filepath.Base(name))
+
+	for _, ext := range []struct {
+		suffix string
+		format anyfs.Format
+	}{
+		{".tar", anyfs.FormatTar},
+		{".tar.gz", anyfs.FormatTarGzip},
+		{".tgz", anyfs.FormatTarGzip},
+		{".tar.xz", anyfs.FormatTarXz},
+		{".txz", anyfs.FormatTarXz},
+		{".tar.zst", anyfs.FormatTarZstd},
+		{".tzst", anyfs.FormatTarZstd},
+		{".a", anyfs.FormatAr},
+		{".ar", anyfs.FormatAr},
+		{".erofs", anyfs.FormatEROFS},
+		{".img", anyfs.FormatEROFS},
+	} {
+		if strings.HasSuffix(name, ext.suffix) {
+			return ext.format
+		}
+	}
+
+	return anyfs.FormatUnknown
+}
+
+// localFS is a local directory, as for os.DirFS, that doesn't follow
+// symbolic links.
+type localFS struct {
+	fs.FS
+	dir string
+}
+
+func newLocalFS(dir string) *localFS {
+	return &localFS{FS: os.DirFS(dir), dir: dir}
+}
+
+func (l *localFS) ReadLink(name string) (string, error) {
+	path, err := l.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: unwrapPathError(err)}
+	}
+
+	return filepath.ToSlash(target), nil
+}
+
+func (l *localFS) StatLink(name string) (fs.FileInfo, error) {
+	path, err := l.join("statlink", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "statlink", Path: name, Err: unwrapPathError(err)}
+	}
+
+	return fi, nil
+}
+
+func (l *localFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return filepath.Join(l.dir, filepath.FromSlash(name)), nil
+}
+
+// unwrapPathError removes the local path from errors returned by the os
+// package.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+
+	return err
+}
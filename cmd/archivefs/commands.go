@@ -0,0 +1,488 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/vfs"
+	"github.com/dpeckett/archivefs/signature"
+)
+
+func setupList(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	long := flags.Bool("l", false, "list the mode, owner, size and modification time of each entry")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errUsage
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		w := bufio.NewWriter(stdout)
+
+		root := "."
+		if len(args) == 2 && isPattern(args[1]) {
+			names, err := archivefs.Glob(a.fsys, args[1])
+			if err != nil {
+				return err
+			}
+
+			if len(names) == 0 {
+				return &fs.PathError{Op: "glob", Path: args[1], Err: fs.ErrNotExist}
+			}
+
+			for _, name := range names {
+				if *long {
+					fi, err := vfs.Lstat(a.fsys, name)
+					if err != nil {
+						return err
+					}
+
+					e, err := archivefs.NewEntry(a.fsys, name, fi)
+					if err != nil {
+						return err
+					}
+
+					err = writeLongEntry(w, e)
+				} else {
+					_, err = fmt.Fprintln(w, name)
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			return w.Flush()
+		} else if len(args) == 2 && args[1] != "." {
+			root = args[1]
+
+			// Symbolic links are listed rather than followed, as for any other
+			// entry.
+			fi, err := vfs.Lstat(a.fsys, root)
+			if err != nil {
+				return err
+			}
+
+			e, err := archivefs.NewEntry(a.fsys, root, fi)
+			if err != nil {
+				return err
+			}
+
+			if !e.Mode.IsDir() {
+				if *long {
+					err = writeLongEntry(w, e)
+				} else {
+					_, err = fmt.Fprintln(w, root)
+				}
+				if err != nil {
+					return err
+				}
+
+				return w.Flush()
+			}
+		}
+
+		err = fs.WalkDir(a.fsys, root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !*long {
+				_, err := fmt.Fprintln(w, name)
+				return err
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			e, err := archivefs.NewEntry(a.fsys, name, fi)
+			if err != nil {
+				return err
+			}
+
+			return writeLongEntry(w, e)
+		})
+		if err != nil {
+			return err
+		}
+
+		return w.Flush()
+	}
+}
+
+// writeLongEntry writes a line describing an entry, in a format similar to
+// `tar -tv`.
+func writeLongEntry(w io.Writer, e *archivefs.Entry) error {
+	size := fmt.Sprint(e.Size)
+	if e.Mode&fs.ModeDevice != 0 {
+		size = fmt.Sprintf("%d,%d", e.Major, e.Minor)
+	}
+
+	name := e.Name
+	if e.Mode&fs.ModeSymlink != 0 {
+		name += " -> " + e.Linkname
+	}
+
+	_, err := fmt.Fprintf(w, "%s %d/%d %10s %s %s\n", e.Mode, e.Uid, e.Gid, size, e.ModTime.UTC().Format("2006-01-02 15:04"), name)
+	return err
+}
+
+func setupCat(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	return func(args []string, stdout io.Writer) error {
+		if len(args) < 2 {
+			return errUsage
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		for _, arg := range args[1:] {
+			if !isPattern(arg) {
+				if err := catFile(stdout, a.fsys, arg); err != nil {
+					return err
+				}
+				continue
+			}
+
+			names, err := archivefs.Glob(a.fsys, arg)
+			if err != nil {
+				return err
+			}
+
+			if len(names) == 0 {
+				return &fs.PathError{Op: "glob", Path: arg, Err: fs.ErrNotExist}
+			}
+
+			for _, name := range names {
+				// Directories matched by a pattern are skipped.
+				if fi, err := fs.Stat(a.fsys, name); err == nil && fi.IsDir() {
+					continue
+				}
+
+				if err := catFile(stdout, a.fsys, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// isPattern reports whether a path argument is a pattern (see
+// archivefs.Glob).
+func isPattern(arg string) bool {
+	return strings.ContainsAny(arg, `*?[{\`)
+}
+
+func catFile(w io.Writer, fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func setupExtract(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	dir := flags.String("C", ".", "extract into `DIR`")
+	preserveOwner := flags.Bool("preserve-owner", false, "preserve the owner of each entry (typically requires root)")
+	preserveXattrs := flags.Bool("preserve-xattrs", false, "preserve extended attributes")
+	var symlinks symlinkPolicyFlag
+	flags.Var(&symlinks, "symlinks", "the `POLICY` for symbolic links: untouched, relative (rewrite absolute targets), fail (if a target is outside the directory) or skip")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		return archivefs.Extract(context.Background(), a.fsys, *dir, &archivefs.ExtractOptions{
+			PreserveOwner:  *preserveOwner,
+			PreserveXattrs: *preserveXattrs,
+			Symlinks:       symlinks.policy,
+		})
+	}
+}
+
+// symlinkPolicyFlag is a flag.Value selecting how symbolic links are
+// extracted.
+type symlinkPolicyFlag struct {
+	policy archivefs.SymlinkPolicy
+}
+
+var symlinkPolicies = map[string]archivefs.SymlinkPolicy{
+	"untouched": archivefs.SymlinksUntouched,
+	"relative":  archivefs.SymlinksRelative,
+	"fail":      archivefs.SymlinksFailEscaping,
+	"skip":      archivefs.SymlinksSkip,
+}
+
+func (f *symlinkPolicyFlag) String() string {
+	for name, policy := range symlinkPolicies {
+		if policy == f.policy {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func (f *symlinkPolicyFlag) Set(s string) error {
+	policy, ok := symlinkPolicies[s]
+	if !ok {
+		return fmt.Errorf("unsupported symlink policy %q", s)
+	}
+
+	f.policy = policy
+	return nil
+}
+
+func setupCreate(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	var format formatFlag
+	flags.Var(&format, "format", "the `FORMAT` of the archive: tar, tar+gzip, tar+xz, tar+zstd, ar or erofs")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("%s: not a directory", args[0])
+		}
+
+		return writeArchive(args[1], format.format, newLocalFS(args[0]), stdout)
+	}
+}
+
+func setupConvert(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	var format formatFlag
+	flags.Var(&format, "format", "the `FORMAT` of the new archive: tar, tar+gzip, tar+xz, tar+zstd, ar or erofs")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		return writeArchive(args[1], format.format, a.fsys, stdout)
+	}
+}
+
+func setupDiskUsage(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	summarize := flags.Bool("s", false, "only display the total")
+	apparentSize := flags.Bool("apparent-size", false, "display apparent sizes rather than disk usage")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		report, err := archivefs.DiskUsage(a.fsys, nil)
+		if err != nil {
+			return err
+		}
+
+		dirs := []string{"."}
+		if !*summarize {
+			dirs = dirs[:0]
+			for dir := range report.Dirs {
+				dirs = append(dirs, dir)
+			}
+			slices.SortFunc(dirs, compareDepthFirst)
+		}
+
+		w := bufio.NewWriter(stdout)
+		for _, dir := range dirs {
+			size := report.Dirs[dir].DiskSize
+			if *apparentSize {
+				size = report.Dirs[dir].ApparentSize
+			}
+
+			if _, err := fmt.Fprintf(w, "%d\t%s\n", size, dir); err != nil {
+				return err
+			}
+		}
+
+		return w.Flush()
+	}
+}
+
+// compareDepthFirst orders paths as they are visited by a depth-first walk,
+// with directories after their contents (as for du(1)).
+func compareDepthFirst(a, b string) int {
+	var aElems, bElems []string
+	if a != "." {
+		aElems = strings.Split(a, "/")
+	}
+	if b != "." {
+		bElems = strings.Split(b, "/")
+	}
+
+	for i := 0; i < len(aElems) && i < len(bElems); i++ {
+		if c := strings.Compare(aElems[i], bElems[i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(bElems) - len(aElems)
+}
+
+func setupVerify(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	mtree := flags.String("mtree", "", "verify the archive against an mtree(5) manifest")
+	sha256sums := flags.String("sha256sums", "", "verify the archive against a sha256sum(1) manifest")
+	sig := flags.String("signature", "", "verify the archive against a detached signature (requires -keys)")
+	keys := flags.String("keys", "", "the trusted public keys, in OpenSSH authorized_keys format")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) != 1 || (*sig == "") != (*keys == "") {
+			return errUsage
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		opts := &archivefs.ChecksumOptions{Concurrency: runtime.NumCPU()}
+
+		// Reading every file detects truncated or corrupt archives.
+		sums, err := archivefs.Checksums(a.fsys, opts)
+		if err != nil {
+			return err
+		}
+
+		if *mtree != "" {
+			if err := verifyManifest(*mtree, func(r io.Reader) error {
+				return archivefs.VerifyMtree(a.fsys, r, nil)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if *sha256sums != "" {
+			if err := verifyManifest(*sha256sums, func(r io.Reader) error {
+				return archivefs.VerifyChecksums(a.fsys, r, opts)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if *sig != "" {
+			if err := verifySignature(a.fsys, *sig, *keys); err != nil {
+				return err
+			}
+		}
+
+		_, err = fmt.Fprintf(stdout, "%s: OK (%s archive, %d files)\n", args[0], a.format, len(sums))
+		return err
+	}
+}
+
+func verifySignature(fsys fs.FS, sigName, keysName string) error {
+	sig, err := os.ReadFile(sigName)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(keysName)
+	if err != nil {
+		return err
+	}
+
+	keys, err := signature.ParsePublicKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", keysName, err)
+	}
+
+	return signature.Verify(fsys, sig, keys, nil)
+}
+
+func setupSign(flags *flag.FlagSet) func(args []string, stdout io.Writer) error {
+	key := flags.String("key", "", "the Ed25519 private key to sign with, in OpenSSH or PKCS #8 format")
+
+	return func(args []string, stdout io.Writer) error {
+		if len(args) != 1 || *key == "" {
+			return errUsage
+		}
+
+		data, err := os.ReadFile(*key)
+		if err != nil {
+			return err
+		}
+
+		priv, err := signature.ParsePrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *key, err)
+		}
+
+		a, err := openArchive(args[0])
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		return signature.Sign(stdout, a.fsys, priv, nil)
+	}
+}
+
+func verifyManifest(name string, verify func(r io.Reader) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return verify(bufio.NewReader(f))
+}
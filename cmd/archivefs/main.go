@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Command archivefs lists, extracts, creates, converts and verifies archives
+// of any format supported by archivefs.
+//
+// Usage:
+//
+//	archivefs ls [-l] ARCHIVE [PATH|PATTERN]
+//	archivefs cat ARCHIVE PATH|PATTERN...
+//	archivefs extract [-C DIR] [flags] ARCHIVE
+//	archivefs create [-format FORMAT] DIR OUTPUT
+//	archivefs convert [-format FORMAT] ARCHIVE OUTPUT
+//	archivefs verify [-mtree FILE] [-sha256sums FILE] [-signature FILE -keys FILE] ARCHIVE
+//	archivefs sign -key FILE ARCHIVE
+//
+// The format of an archive (including its compression) is detected from its
+// contents. The format of a created archive is inferred from the name of the
+// output file (eg. .tar.zst or .erofs), unless given with -format. An output
+// of "-" writes the archive to stdout.
+//
+// Signatures are created with Ed25519 keys, and verified against a list of
+// trusted public keys, both in the formats used by OpenSSH (see package
+// signature).
+//
+// Paths given to ls and cat may be patterns, as for archivefs.Glob (eg.
+// "etc/**/*.conf" or "usr/{bin,sbin}/*").
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// errUsage is returned when a command is invoked with invalid arguments, once
+// its usage has been printed.
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setup defines the flags of the command, returning the function that
+	// runs it.
+	setup func(flags *flag.FlagSet) func(args []string, stdout io.Writer) error
+}
+
+var commands = []command{
+	{name: "ls", args: "[-l] ARCHIVE [PATH|PATTERN]", summary: "list the contents of an archive", setup: setupList},
+	{name: "cat", args: "ARCHIVE PATH|PATTERN...", summary: "write the contents of files to stdout", setup: setupCat},
+	{name: "extract", args: "[-C DIR] [flags] ARCHIVE", summary: "extract an archive to a directory", setup: setupExtract},
+	{name: "create", args: "[-format FORMAT] DIR OUTPUT", summary: "create an archive from a directory", setup: setupCreate},
+	{name: "convert", args: "[-format FORMAT] ARCHIVE OUTPUT", summary: "convert an archive to another format", setup: setupConvert},
+	{name: "du", args: "[-s] [-apparent-size] ARCHIVE", summary: "display the disk usage of each directory in an archive", setup: setupDiskUsage},
+	{name: "verify", args: "[-mtree FILE] [-sha256sums FILE] [-signature FILE -keys FILE] ARCHIVE", summary: "check an archive can be read, and optionally matches a manifest or signature", setup: setupVerify},
+	{name: "sign", args: "-key FILE ARCHIVE", summary: "write a detached signature of an archive to stdout", setup: setupSign},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "archivefs: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage(stderr)
+		if len(args) == 0 {
+			return errUsage
+		}
+		return nil
+	}
+
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == args[0] })
+	if i < 0 {
+		fmt.Fprintf(stderr, "archivefs: unknown command %q\n\n", args[0])
+		usage(stderr)
+		return errUsage
+	}
+	cmd := commands[i]
+
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: archivefs %s %s\n", cmd.name, cmd.args)
+		if hasFlags(flags) {
+			fmt.Fprintln(stderr, "\nFlags:")
+			flags.PrintDefaults()
+		}
+	}
+
+	runCmd := cmd.setup(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+
+	err := runCmd(flags.Args(), stdout)
+	if errors.Is(err, errUsage) {
+		flags.Usage()
+	}
+
+	return err
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: archivefs COMMAND [ARGS]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nRun 'archivefs COMMAND -h' for the usage of a command.")
+}
+
+func hasFlags(flags *flag.FlagSet) bool {
+	var n int
+	flags.VisitAll(func(*flag.Flag) { n++ })
+	return n > 0
+}
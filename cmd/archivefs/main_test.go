@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/signature"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require elevated privileges on Windows")
+	}
+
+	srcDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "etc/ssl"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "etc/hostname"), []byte("alpha\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "etc/ssl/cert.pem"), []byte("cert"), 0o600))
+	require.NoError(t, os.Symlink("hostname", filepath.Join(srcDir, "etc/name")))
+
+	var sums bytes.Buffer
+	require.NoError(t, archivefs.WriteChecksums(&sums, newLocalFS(srcDir), nil))
+
+	sumsPath := filepath.Join(t.TempDir(), "SHA256SUMS")
+	require.NoError(t, os.WriteFile(sumsPath, sums.Bytes(), 0o644))
+
+	outDir := t.TempDir()
+	tarPath := filepath.Join(outDir, "root.tar.zst")
+	erofsPath := filepath.Join(outDir, "root.img")
+
+	t.Run("Create", func(t *testing.T) {
+		_, err := runCommand(t, "create", srcDir, tarPath)
+		require.NoError(t, err)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		stdout, err := runCommand(t, "ls", tarPath)
+		require.NoError(t, err)
+		require.Equal(t, ".\netc\netc/hostname\netc/name\netc/ssl\netc/ssl/cert.pem\n", stdout)
+
+		stdout, err = runCommand(t, "ls", "-l", tarPath, "etc/name")
+		require.NoError(t, err)
+		require.Contains(t, stdout, "etc/name -> hostname\n")
+		require.True(t, strings.HasPrefix(stdout, "Lrwxrwxrwx "))
+
+		stdout, err = runCommand(t, "ls", tarPath, "**/{*.pem,host*}")
+		require.NoError(t, err)
+		require.Equal(t, "etc/hostname\netc/ssl/cert.pem\n", stdout)
+
+		_, err = runCommand(t, "ls", tarPath, "**/*.key")
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		// Formats that can only be read are detected too.
+		var zipped bytes.Buffer
+		zw := zip.NewWriter(&zipped)
+		w, err := zw.Create("etc/hostname")
+		require.NoError(t, err)
+		_, err = w.Write([]byte("alpha\n"))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		zipPath := filepath.Join(t.TempDir(), "root.zip")
+		require.NoError(t, os.WriteFile(zipPath, zipped.Bytes(), 0o644))
+
+		stdout, err = runCommand(t, "ls", zipPath)
+		require.NoError(t, err)
+		require.Equal(t, ".\netc\netc/hostname\n", stdout)
+	})
+
+	t.Run("Cat", func(t *testing.T) {
+		stdout, err := runCommand(t, "cat", tarPath, "etc/name", "etc/ssl/cert.pem")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\ncert", stdout)
+
+		_, err = runCommand(t, "cat", tarPath, "etc/missing")
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		stdout, err = runCommand(t, "cat", tarPath, "etc/**")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\nalpha\ncert", stdout)
+	})
+
+	t.Run("Convert", func(t *testing.T) {
+		_, err := runCommand(t, "convert", tarPath, erofsPath)
+		require.NoError(t, err)
+
+		stdout, err := runCommand(t, "cat", erofsPath, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", stdout)
+
+		_, err = runCommand(t, "convert", tarPath, filepath.Join(outDir, "root.unknown"))
+		require.ErrorContains(t, err, "use -format")
+	})
+
+	t.Run("Extract", func(t *testing.T) {
+		dir := t.TempDir()
+
+		_, err := runCommand(t, "extract", "-C", dir, erofsPath)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(filepath.Join(dir, "etc/ssl/cert.pem"))
+		require.NoError(t, err)
+		require.Equal(t, "cert", string(data))
+
+		target, err := os.Readlink(filepath.Join(dir, "etc/name"))
+		require.NoError(t, err)
+		require.Equal(t, "hostname", target)
+	})
+
+	t.Run("DiskUsage", func(t *testing.T) {
+		stdout, err := runCommand(t, "du", "-apparent-size", tarPath)
+		require.NoError(t, err)
+		require.Equal(t, "4\tetc/ssl\n10\tetc\n10\t.\n", stdout)
+
+		stdout, err = runCommand(t, "du", "-s", tarPath)
+		require.NoError(t, err)
+		require.Equal(t, "8192\t.\n", stdout)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		stdout, err := runCommand(t, "verify", "-sha256sums", sumsPath, tarPath)
+		require.NoError(t, err)
+		require.Equal(t, tarPath+": OK (tar+zstd archive, 2 files)\n", stdout)
+
+		badSumsPath := filepath.Join(t.TempDir(), "SHA256SUMS")
+		require.NoError(t, os.WriteFile(badSumsPath, []byte(strings.Repeat("0", 64)+"  etc/hostname\n"), 0o644))
+
+		_, err = runCommand(t, "verify", "-sha256sums", badSumsPath, erofsPath)
+		require.ErrorIs(t, err, archivefs.ErrChecksumMismatch)
+	})
+
+	t.Run("Sign", func(t *testing.T) {
+		stdout, err := runCommand(t, "sign", "-key", "../../signature/testdata/id_ed25519", tarPath)
+		require.NoError(t, err)
+
+		sigPath := filepath.Join(t.TempDir(), "root.sig")
+		require.NoError(t, os.WriteFile(sigPath, []byte(stdout), 0o644))
+
+		// The signature remains valid after conversion.
+		stdout, err = runCommand(t, "verify", "-signature", sigPath, "-keys", "../../signature/testdata/id_ed25519.pub", erofsPath)
+		require.NoError(t, err)
+		require.Equal(t, erofsPath+": OK (erofs archive, 2 files)\n", stdout)
+
+		untrusted, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		keysPath := filepath.Join(t.TempDir(), "authorized_keys")
+		require.NoError(t, os.WriteFile(keysPath, signature.MarshalPublicKey(untrusted), 0o644))
+
+		_, err = runCommand(t, "verify", "-signature", sigPath, "-keys", keysPath, erofsPath)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+
+		_, err = runCommand(t, "verify", "-signature", sigPath, erofsPath)
+		require.ErrorIs(t, err, errUsage)
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		_, err := runCommand(t, "ls")
+		require.ErrorIs(t, err, errUsage)
+
+		_, err = runCommand(t, "unknown")
+		require.ErrorIs(t, err, errUsage)
+	})
+}
+
+func runCommand(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	err := run(args, &stdout, &stderr)
+	return stdout.String(), err
+}
@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package composefs provides access to composefs [1] images, EROFS images
+// containing only the metadata of a filesystem, with the contents of its
+// regular files stored in a separate content-addressed object directory
+// (which is usually shared by many images, so that identical files are only
+// stored once).
+//
+// The data of each external file is stored in the image as a chunk based
+// inode consisting only of holes, so that it has the correct size, with the
+// trusted.overlay.redirect extended attribute naming its object relative to
+// the object directory (eg. "/9e/3ba1..."). Small files may be stored in the
+// image instead.
+//
+// [1] https://github.com/containers/composefs
+package composefs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ fs.ReadDirFS         = (*Filesystem)(nil)
+	_ fs.StatFS            = (*Filesystem)(nil)
+	_ archivefs.ReadLinkFS = (*Filesystem)(nil)
+	_ archivefs.LinkFS     = (*Filesystem)(nil)
+	_ fs.ReadDirFile       = (*dir)(nil)
+)
+
+const (
+	// RedirectXattr names the object holding the data of an external file.
+	RedirectXattr = "trusted.overlay.redirect"
+	// MetacopyXattr marks a file as containing only metadata, its value may
+	// hold the fs-verity digest of the object.
+	MetacopyXattr = "trusted.overlay.metacopy"
+
+	// escapedPrefix is the prefix of the overlay xattrs of the files in the
+	// image, which are escaped so they aren't interpreted by overlayfs.
+	escapedPrefix = "trusted.overlay.overlay."
+	overlayPrefix = "trusted.overlay."
+)
+
+// Options configures how an image is opened.
+type Options struct {
+	// Strict opens the image in strict mode (see erofs.Options).
+	Strict bool
+}
+
+// Filesystem is a composefs image, merged with its object directory.
+type Filesystem struct {
+	image   *erofs.Filesystem
+	objects fs.FS
+}
+
+// Open opens a composefs image, reading the contents of external files from
+// the object directory objects.
+func Open(image io.ReaderAt, objects fs.FS) (*Filesystem, error) {
+	return OpenWithOptions(image, objects, nil)
+}
+
+// OpenWithOptions opens a composefs image with the given options.
+func OpenWithOptions(image io.ReaderAt, objects fs.FS, opts *Options) (*Filesystem, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	fsys, err := erofs.OpenWithOptions(image, &erofs.Options{Strict: opts.Strict})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filesystem{
+		image:   fsys,
+		objects: objects,
+	}, nil
+}
+
+// Open opens the named file. The contents of external files are read from
+// their object, which must exist and be of the size recorded in the image.
+func (fsys *Filesystem) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fi, err := fsys.image.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	object, ok, err := redirect(fi)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if !ok {
+		f, err := fsys.image.Open(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		if fi.IsDir() {
+			return &dir{file: file{File: f, fi: &fileInfo{FileInfo: fi}}}, nil
+		}
+
+		return &file{File: f, fi: &fileInfo{FileInfo: fi}}, nil
+	}
+
+	f, err := fsys.objects.Open(object)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("failed to open object %q: %w", object, err)}
+	}
+
+	objectInfo, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("failed to stat object %q: %w", object, err)}
+	}
+
+	if !objectInfo.Mode().IsRegular() || objectInfo.Size() != fi.Size() {
+		_ = f.Close()
+
+		detail := fmt.Sprintf("object %q has size %d, expected %d", object, objectInfo.Size(), fi.Size())
+		if !objectInfo.Mode().IsRegular() {
+			detail = fmt.Sprintf("object %q is not a regular file", object)
+		}
+
+		return nil, &fs.PathError{Op: "open", Path: name, Err: &archiveerrors.ErrCorrupted{Offset: -1, Detail: detail}}
+	}
+
+	return &file{File: f, fi: &fileInfo{FileInfo: fi}}, nil
+}
+
+// ReadDir reads the named directory, returning all its directory entries
+// sorted by filename.
+func (fsys *Filesystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := fsys.image.ReadDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	for i, de := range entries {
+		entries[i] = &dirEntry{DirEntry: de}
+	}
+
+	return entries, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fsys *Filesystem) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fi, err := fsys.image.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return &fileInfo{FileInfo: fi}, nil
+}
+
+// ReadLink returns the destination of the named symbolic link.
+func (fsys *Filesystem) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := fsys.image.ReadLink(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+// StatLink returns a FileInfo describing the file without following any
+// symbolic links.
+func (fsys *Filesystem) StatLink(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fi, err := fsys.image.StatLink(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return &fileInfo{FileInfo: fi}, nil
+}
+
+// FileID returns the inode number of the named file, without following any
+// symbolic links, and the number of hard links to it.
+func (fsys *Filesystem) FileID(name string) (id uint64, nlink int, err error) {
+	if !fs.ValidPath(name) {
+		return 0, 0, &fs.PathError{Op: "fileid", Path: name, Err: fs.ErrInvalid}
+	}
+
+	id, nlink, err = fsys.image.FileID(name)
+	if err != nil {
+		return 0, 0, &fs.PathError{Op: "fileid", Path: name, Err: err}
+	}
+
+	return id, nlink, nil
+}
+
+// redirect returns the path of the object holding the data of a file, within
+// the object directory, if it is an external file.
+func redirect(fi fs.FileInfo) (string, bool, error) {
+	ino, ok := fi.Sys().(*erofs.Inode)
+	if !ok || !fi.Mode().IsRegular() {
+		return "", false, nil
+	}
+
+	xattrs, err := ino.Xattrs()
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := xattrs[RedirectXattr]
+	if !ok {
+		return "", false, nil
+	}
+
+	object := strings.TrimPrefix(value, "/")
+	if !fs.ValidPath(object) || object == "." {
+		return "", false, fmt.Errorf("invalid redirect %q: %w", value, archiveerrors.ErrInsecurePath)
+	}
+
+	return object, true, nil
+}
+
+type file struct {
+	fs.File
+	fi fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+type dir struct {
+	file
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.File.(fs.ReadDirFile).ReadDir(n)
+	for i, de := range entries {
+		entries[i] = &dirEntry{DirEntry: de}
+	}
+
+	return entries, err
+}
+
+// dirEntry is an entry of a directory in the image, hiding the extended
+// attributes used by composefs.
+type dirEntry struct {
+	fs.DirEntry
+}
+
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	fi, err := de.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{FileInfo: fi}, nil
+}
+
+// fileInfo describes a file in the image, hiding the extended attributes
+// used by composefs.
+type fileInfo struct {
+	fs.FileInfo
+}
+
+func (fi *fileInfo) Sys() any {
+	if ino, ok := fi.FileInfo.Sys().(*erofs.Inode); ok {
+		return &inodeSys{Inode: ino}
+	}
+
+	return fi.FileInfo.Sys()
+}
+
+// inodeSys exposes the metadata of an inode, with the extended attributes
+// of the original file.
+type inodeSys struct {
+	*erofs.Inode
+}
+
+func (sys *inodeSys) ExtendedAttributes() map[string]string {
+	xattrs := map[string]string{}
+	for name, value := range sys.Inode.ExtendedAttributes() {
+		switch {
+		case name == RedirectXattr || name == MetacopyXattr:
+			continue
+		case strings.HasPrefix(name, escapedPrefix):
+			name = overlayPrefix + strings.TrimPrefix(name, escapedPrefix)
+		case strings.HasPrefix(name, overlayPrefix):
+			// Other overlay xattrs are internal to composefs (eg. whiteouts).
+			continue
+		}
+
+		xattrs[name] = value
+	}
+
+	return xattrs
+}
@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package composefs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/composefs"
+	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeFS(t *testing.T) {
+	tool := bytes.Repeat([]byte("tool"), 4096)
+	motd := []byte("hello world\n")
+
+	objects := memfs.New()
+	meta := memfs.New()
+	require.NoError(t, meta.MkdirAll("etc", 0o755))
+	require.NoError(t, meta.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, meta.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, meta.Symlink("../usr/bin/tool", "etc/tool"))
+	require.NoError(t, meta.SetXattr("etc", "trusted.overlay.overlay.opaque", "y"))
+
+	addExternal(t, meta, objects, "usr/bin/tool", tool)
+	addExternal(t, meta, objects, "etc/motd", motd)
+	require.NoError(t, meta.SetXattr("usr/bin/tool", "security.capability", "cap"))
+	require.NoError(t, meta.Link("usr/bin/tool", "usr/bin/tool2"))
+
+	fsys, err := composefs.Open(createImage(t, meta), objects)
+	require.NoError(t, err)
+
+	require.NoError(t, archivefstest.TestFS(fsys, "etc/hostname", "etc/motd", "etc/tool", "usr/bin/tool", "usr/bin/tool2"))
+
+	for name, want := range map[string][]byte{
+		"etc/hostname":  []byte("alpha\n"),
+		"etc/motd":      motd,
+		"etc/tool":      tool,
+		"usr/bin/tool":  tool,
+		"usr/bin/tool2": tool,
+	} {
+		data, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, data, name)
+	}
+
+	fi, err := fsys.Stat("usr/bin/tool")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(tool)), fi.Size())
+	require.Equal(t, fs.FileMode(0o755), fi.Mode())
+
+	// The xattrs used by composefs are hidden, and escaped xattrs restored.
+	xattrs := func(name string) map[string]string {
+		fi, err := fsys.StatLink(name)
+		require.NoError(t, err)
+
+		return fi.Sys().(archivefs.ExtendedAttributes).ExtendedAttributes()
+	}
+
+	require.Equal(t, map[string]string{"security.capability": "cap"}, xattrs("usr/bin/tool"))
+	require.Equal(t, map[string]string{"trusted.overlay.opaque": "y"}, xattrs("etc"))
+	require.Empty(t, xattrs("etc/motd"))
+
+	entries, err := fsys.ReadDir("etc")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	fi, err = entries[1].Info()
+	require.NoError(t, err)
+	require.Equal(t, "motd", fi.Name())
+	require.Empty(t, fi.Sys().(archivefs.ExtendedAttributes).ExtendedAttributes())
+
+	target, err := fsys.ReadLink("etc/tool")
+	require.NoError(t, err)
+	require.Equal(t, "../usr/bin/tool", target)
+
+	id, nlink, err := fsys.FileID("usr/bin/tool2")
+	require.NoError(t, err)
+	require.Equal(t, 2, nlink)
+
+	id2, _, err := fsys.FileID("usr/bin/tool")
+	require.NoError(t, err)
+	require.Equal(t, id, id2)
+
+	f, err := fsys.Open("etc/motd")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, "motd", fi.Name())
+
+	t.Run("MissingObject", func(t *testing.T) {
+		fsys, err := composefs.Open(createImage(t, meta), memfs.New())
+		require.NoError(t, err)
+
+		_, err = fs.ReadFile(fsys, "usr/bin/tool")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		// Files stored in the image can still be read.
+		_, err = fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+	})
+
+	t.Run("ObjectSize", func(t *testing.T) {
+		truncated := memfs.New()
+		require.NoError(t, fs.WalkDir(objects, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			require.NoError(t, truncated.MkdirAll(filepath.Dir(name), 0o755))
+			return truncated.WriteFile(name, []byte("short"), 0o644)
+		}))
+
+		fsys, err := composefs.Open(createImage(t, meta), truncated)
+		require.NoError(t, err)
+
+		_, err = fs.ReadFile(fsys, "usr/bin/tool")
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+
+	t.Run("InvalidRedirect", func(t *testing.T) {
+		meta := memfs.New()
+		require.NoError(t, meta.WriteFile("passwd", nil, 0o644))
+		require.NoError(t, meta.SetXattr("passwd", composefs.RedirectXattr, "/../../etc/passwd"))
+
+		fsys, err := composefs.Open(createImage(t, meta), objects)
+		require.NoError(t, err)
+
+		_, err = fsys.Open("passwd")
+		require.ErrorIs(t, err, archiveerrors.ErrInsecurePath)
+	})
+}
+
+// addExternal adds a file to a composefs image, with its contents stored in
+// the object directory.
+func addExternal(t *testing.T, meta, objects *memfs.FS, name string, data []byte) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	require.NoError(t, objects.MkdirAll(digest[:2], 0o755))
+	require.NoError(t, objects.WriteFile(digest[:2]+"/"+digest[2:], data, 0o644))
+
+	require.NoError(t, meta.WriteFile(name, nil, 0o755))
+	require.NoError(t, meta.Truncate(name, int64(len(data))))
+	require.NoError(t, meta.SetXattr(name, composefs.RedirectXattr, "/"+digest[:2]+"/"+digest[2:]))
+	require.NoError(t, meta.SetXattr(name, composefs.MetacopyXattr, ""))
+}
+
+// metadataFS reports external files as consisting only of holes, so they
+// aren't stored in the image.
+type metadataFS struct {
+	*memfs.FS
+}
+
+func (fsys *metadataFS) DataExtents(name string) ([]archivefs.Extent, error) {
+	fi, err := fsys.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := fi.Sys().(archivefs.ExtendedAttributes).ExtendedAttributes()[composefs.RedirectXattr]; ok {
+		return nil, nil
+	}
+
+	return []archivefs.Extent{{Length: fi.Size()}}, nil
+}
+
+// createImage creates a composefs image from a memfs.FS.
+func createImage(t *testing.T, meta *memfs.FS) io.ReaderAt {
+	f, err := os.Create(filepath.Join(t.TempDir(), "image.cfs"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	require.NoError(t, erofs.Create(f, &metadataFS{FS: meta}))
+
+	return f
+}
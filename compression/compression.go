@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package compression detects the compression of a stream from its magic
+// number, and decompresses it. Decompressed streams can be spooled to provide
+// an io.ReaderAt, eg. for opening compressed archives with tarfs.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ErrUnsupported is returned when a stream is compressed with an algorithm
+// that can be detected but not decompressed.
+var ErrUnsupported = archiveerrors.Define(archiveerrors.ErrUnsupportedFeature, "unsupported compression")
+
+// Algorithm is a compression algorithm.
+type Algorithm int
+
+const (
+	// None is an uncompressed stream.
+	None Algorithm = iota
+	// Gzip is a gzip compressed stream.
+	Gzip
+	// Bzip2 is a bzip2 compressed stream.
+	Bzip2
+	// Xz is an xz compressed stream.
+	Xz
+	// Zstd is a zstd compressed stream (including the seekable format).
+	Zstd
+	// LZ4 is an LZ4 compressed stream (frame or legacy format).
+	LZ4
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	case Zstd:
+		return "zstd"
+	case LZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("Algorithm(%d)", int(a))
+	}
+}
+
+// Extension returns the conventional file extension of the algorithm (eg.
+// ".gz"), or an empty string for uncompressed streams.
+func (a Algorithm) Extension() string {
+	switch a {
+	case Gzip:
+		return ".gz"
+	case Bzip2:
+		return ".bz2"
+	case Xz:
+		return ".xz"
+	case Zstd:
+		return ".zst"
+	case LZ4:
+		return ".lz4"
+	default:
+		return ""
+	}
+}
+
+// magicSize is the number of bytes required to detect every algorithm.
+const magicSize = 6
+
+var magics = []struct {
+	magic     []byte
+	algorithm Algorithm
+}{
+	{[]byte{0x1f, 0x8b}, Gzip},
+	{[]byte("BZh"), Bzip2},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, Xz},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, LZ4},
+	{[]byte{0x02, 0x21, 0x4c, 0x18}, LZ4},
+}
+
+// Detect returns the compression algorithm of a stream from its first bytes,
+// or None if the magic number is not recognized.
+func Detect(header []byte) Algorithm {
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.algorithm
+		}
+	}
+
+	return None
+}
+
+// NewReader detects the compression algorithm of r and returns a reader
+// that decompresses it. Uncompressed streams are returned unchanged (apart
+// from buffering).
+func NewReader(r io.Reader) (io.ReadCloser, Algorithm, error) {
+	br := bufio.NewReader(r)
+
+	header, err := br.Peek(magicSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, None, err
+	}
+
+	algorithm := Detect(header)
+
+	dr, err := Decompress(br, algorithm)
+	if err != nil {
+		return nil, algorithm, err
+	}
+
+	return dr, algorithm, nil
+}
+
+// Decompress returns a reader that decompresses r with the given algorithm.
+// The returned reader must be closed, but r is not closed.
+func Decompress(r io.Reader, algorithm Algorithm) (io.ReadCloser, error) {
+	switch algorithm {
+	case None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Bzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case Xz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case LZ4:
+		return io.NopCloser(newLZ4Reader(r)), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, algorithm)
+	}
+}
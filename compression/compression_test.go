@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package compression_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/dpeckett/archivefs/compression"
+	"github.com/dpeckett/archivefs/zstdseekable"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func TestNewReader(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world\n"), 10000)
+
+	vectors := []struct {
+		name      string
+		compress  func(w io.Writer) (io.WriteCloser, error)
+		algorithm compression.Algorithm
+	}{
+		{"None", func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }, compression.None},
+		{"Gzip", func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }, compression.Gzip},
+		{"Xz", func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }, compression.Xz},
+		{"Zstd", func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }, compression.Zstd},
+		{"ZstdSeekable", func(w io.Writer) (io.WriteCloser, error) {
+			return zstdseekable.NewWriter(w, &zstdseekable.WriterOptions{FrameSize: 4096})
+		}, compression.Zstd},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			var compressed bytes.Buffer
+			w, err := v.compress(&compressed)
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			require.Equal(t, v.algorithm, compression.Detect(compressed.Bytes()))
+
+			r, algorithm, err := compression.NewReader(bytes.NewReader(compressed.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, v.algorithm, algorithm)
+
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, data, decompressed)
+
+			ra, algorithm, err := compression.NewReaderAt(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, ra.Close())
+			})
+			require.Equal(t, v.algorithm, algorithm)
+
+			buf := make([]byte, 12)
+			_, err = ra.ReadAt(buf, 12*5000)
+			require.NoError(t, err)
+			require.Equal(t, "hello world\n", string(buf))
+
+			n, err := ra.ReadAt(buf, int64(len(data)-6))
+			require.ErrorIs(t, err, io.EOF)
+			require.Equal(t, "world\n", string(buf[:n]))
+		})
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		r, algorithm, err := compression.NewReader(bytes.NewReader(nil))
+		require.NoError(t, err)
+		require.Equal(t, compression.None, algorithm)
+
+		decompressed, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Empty(t, decompressed)
+	})
+
+	t.Run("Bzip2", func(t *testing.T) {
+		require.Equal(t, compression.Bzip2, compression.Detect([]byte("BZh91AY&SY")))
+		require.Equal(t, ".bz2", compression.Bzip2.Extension())
+	})
+}
+
+func TestLZ4(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world\n"), 10000)
+
+	// Written by "lz4 -9", "lz4 -B4 -BD -BX --content-size" (linked 64KiB
+	// blocks with checksums) and "lz4 -l" respectively.
+	for _, name := range []string{"hello.txt.lz4", "hello-linked.txt.lz4", "hello-legacy.txt.lz4"} {
+		t.Run(name, func(t *testing.T) {
+			compressed, err := os.ReadFile(filepath.Join("testdata", name))
+			require.NoError(t, err)
+
+			require.Equal(t, compression.LZ4, compression.Detect(compressed))
+
+			r, algorithm, err := compression.NewReader(bytes.NewReader(compressed))
+			require.NoError(t, err)
+			require.Equal(t, compression.LZ4, algorithm)
+
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, data, decompressed)
+
+			_, err = io.ReadAll(mustDecompress(t, compressed[:len(compressed)-3]))
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		})
+	}
+
+	t.Run("Concatenated", func(t *testing.T) {
+		compressed, err := os.ReadFile("testdata/hello.txt.lz4")
+		require.NoError(t, err)
+
+		// A skippable frame between two frames.
+		skippable := []byte{0x5a, 0x2a, 0x4d, 0x18, 0x02, 0x00, 0x00, 0x00, 0xff, 0xff}
+		compressed = append(append(slices.Clone(compressed), skippable...), compressed...)
+
+		decompressed, err := io.ReadAll(mustDecompress(t, compressed))
+		require.NoError(t, err)
+		require.Equal(t, append(slices.Clone(data), data...), decompressed)
+	})
+
+	t.Run("UncompressedBlock", func(t *testing.T) {
+		frame := []byte{
+			0x04, 0x22, 0x4d, 0x18, 0x60, 0x40, 0x82,
+			0x05, 0x00, 0x00, 0x80, 'h', 'e', 'l', 'l', 'o',
+			0x00, 0x00, 0x00, 0x00,
+		}
+
+		decompressed, err := io.ReadAll(mustDecompress(t, frame))
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(decompressed))
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		compressed, err := os.ReadFile("testdata/hello-linked.txt.lz4")
+		require.NoError(t, err)
+
+		compressed = slices.Clone(compressed)
+		compressed[len(compressed)/2] ^= 0xff
+
+		_, err = io.ReadAll(mustDecompress(t, compressed))
+		require.ErrorContains(t, err, "checksum mismatch")
+	})
+}
+
+func mustDecompress(t *testing.T, compressed []byte) io.Reader {
+	r, err := compression.Decompress(bytes.NewReader(compressed), compression.LZ4)
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestSpool(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+
+	t.Run("TempFile", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := compression.NewSpool(bytes.NewReader(data), &compression.SpoolOptions{MemoryLimit: 64 * 1024, TempDir: dir})
+
+		buf := make([]byte, 16)
+		_, err := s.ReadAt(buf, int64(len(data)-16))
+		require.NoError(t, err)
+		require.Equal(t, "0123456789abcdef", string(buf))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		// Earlier data is read from the temporary file.
+		_, err = s.ReadAt(buf, 32)
+		require.NoError(t, err)
+		require.Equal(t, "0123456789abcdef", string(buf))
+
+		require.NoError(t, s.Close())
+
+		entries, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		s := compression.NewSpool(bytes.NewReader(data), nil)
+
+		_, err := s.ReadAt(make([]byte, 16), 0)
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		_, err = s.ReadAt(make([]byte, 16), 0)
+		require.ErrorIs(t, err, fs.ErrClosed)
+	})
+
+	t.Run("MaxSize", func(t *testing.T) {
+		s := compression.NewSpool(bytes.NewReader(data), &compression.SpoolOptions{MaxSize: 64 * 1024})
+		t.Cleanup(func() {
+			require.NoError(t, s.Close())
+		})
+
+		_, err := s.ReadAt(make([]byte, 16), 0)
+		require.NoError(t, err)
+
+		_, err = s.ReadAt(make([]byte, 16), int64(len(data)-16))
+		require.ErrorIs(t, err, compression.ErrTooLarge)
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,415 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// lz4FrameMagic is the magic number of the LZ4 frame format.
+	lz4FrameMagic = 0x184d2204
+	// lz4SkippableMagic is the magic number of skippable frames, the low
+	// four bits may take any value.
+	lz4SkippableMagic = 0x184d2a50
+	// lz4LegacyMagic is the magic number of the legacy LZ4 format (as written
+	// by "lz4 -l"), the only LZ4 format supported by the kernel.
+	lz4LegacyMagic = 0x184c2102
+	// lz4LegacyBlockSize is the uncompressed size of each legacy block.
+	lz4LegacyBlockSize = 8 << 20
+	// lz4LegacyMaxCompressedSize is the largest possible size of a compressed
+	// legacy block (LZ4_COMPRESSBOUND of the block size).
+	lz4LegacyMaxCompressedSize = lz4LegacyBlockSize + lz4LegacyBlockSize/255 + 16
+	// lz4WindowSize is how far back a match may refer to, including into
+	// the previous block of a frame with linked blocks.
+	lz4WindowSize = 64 << 10
+)
+
+// lz4Reader decompresses a series of LZ4 frames (and skippable frames), or
+// legacy LZ4 streams, concatenated together.
+type lz4Reader struct {
+	r io.Reader
+	// next reads the next block of the stream into buf.
+	next func() error
+	// streams is the number of frames or legacy streams started.
+	streams int
+	src     []byte
+	buf     []byte
+	pos     int
+	err     error
+
+	// The descriptor of the current frame.
+	linked        bool
+	blockChecksum bool
+	contentHash   *xxh32
+	contentSize   int64
+	blockMaxSize  int
+	decompressed  int64
+}
+
+func newLZ4Reader(r io.Reader) *lz4Reader {
+	lr := &lz4Reader{r: r}
+	lr.next = lr.readMagic
+
+	return lr
+}
+
+func (lr *lz4Reader) Read(p []byte) (int, error) {
+	for lr.pos == len(lr.buf) {
+		if lr.err != nil {
+			return 0, lr.err
+		}
+
+		lr.err = lr.next()
+	}
+
+	n := copy(p, lr.buf[lr.pos:])
+	lr.pos += n
+
+	return n, nil
+}
+
+// readMagic starts the next frame or legacy stream.
+func (lr *lz4Reader) readMagic() error {
+	lr.buf, lr.pos = lr.buf[:0], 0
+
+	magic, err := lr.readUint32()
+	if err != nil {
+		if errors.Is(err, io.EOF) && lr.streams > 0 {
+			return io.EOF
+		}
+
+		return truncated(err, "lz4: truncated magic")
+	}
+	lr.streams++
+
+	switch {
+	case magic == lz4FrameMagic:
+		if err := lr.readFrameDescriptor(); err != nil {
+			return err
+		}
+		lr.next = lr.readFrameBlock
+	case magic&0xfffffff0 == lz4SkippableMagic:
+		size, err := lr.readUint32()
+		if err != nil {
+			return truncated(err, "lz4: truncated skippable frame")
+		}
+
+		if _, err := io.CopyN(io.Discard, lr.r, int64(size)); err != nil {
+			return truncated(err, "lz4: truncated skippable frame")
+		}
+	case magic == lz4LegacyMagic:
+		lr.next = lr.readLegacyBlock
+	default:
+		return fmt.Errorf("lz4: invalid magic: %#x", magic)
+	}
+
+	return nil
+}
+
+// readFrameDescriptor reads the descriptor that follows the magic number of
+// a frame.
+func (lr *lz4Reader) readFrameDescriptor() error {
+	descriptor := make([]byte, 2, 14)
+	if _, err := io.ReadFull(lr.r, descriptor); err != nil {
+		return truncated(err, "lz4: truncated frame descriptor")
+	}
+
+	flags, bd := descriptor[0], descriptor[1]
+	if flags>>6 != 1 {
+		return fmt.Errorf("lz4: unsupported frame version: %d", flags>>6)
+	}
+
+	if flags&0x02 != 0 || bd&0x8f != 0 {
+		return errors.New("lz4: reserved bits set in frame descriptor")
+	}
+
+	if flags&0x01 != 0 {
+		return fmt.Errorf("%w: lz4 dictionaries", ErrUnsupported)
+	}
+
+	blockMaxSizes := map[byte]int{4: 64 << 10, 5: 256 << 10, 6: 1 << 20, 7: 4 << 20}
+	blockMaxSize, ok := blockMaxSizes[bd>>4]
+	if !ok {
+		return fmt.Errorf("lz4: invalid block maximum size: %d", bd>>4)
+	}
+
+	lr.linked = flags&0x20 == 0
+	lr.blockChecksum = flags&0x10 != 0
+	lr.blockMaxSize = blockMaxSize
+	lr.contentSize = -1
+	lr.contentHash = nil
+	lr.decompressed = 0
+
+	if flags&0x08 != 0 {
+		descriptor = descriptor[:10]
+		if _, err := io.ReadFull(lr.r, descriptor[2:]); err != nil {
+			return truncated(err, "lz4: truncated frame descriptor")
+		}
+
+		lr.contentSize = int64(binary.LittleEndian.Uint64(descriptor[2:]))
+		if lr.contentSize < 0 {
+			return fmt.Errorf("lz4: invalid content size: %d", uint64(lr.contentSize))
+		}
+	}
+
+	if flags&0x04 != 0 {
+		lr.contentHash = &xxh32{}
+	}
+
+	var checksum [1]byte
+	if _, err := io.ReadFull(lr.r, checksum[:]); err != nil {
+		return truncated(err, "lz4: truncated frame descriptor")
+	}
+
+	if byte(xxh32Sum(descriptor)>>8) != checksum[0] {
+		return errors.New("lz4: frame descriptor checksum mismatch")
+	}
+
+	return nil
+}
+
+// readFrameBlock decompresses the next block of a frame, verifying the
+// checksums of the frame once it ends.
+func (lr *lz4Reader) readFrameBlock() error {
+	size, err := lr.readUint32()
+	if err != nil {
+		return truncated(err, "lz4: truncated block header")
+	}
+
+	if size == 0 {
+		lr.buf, lr.pos = lr.buf[:0], 0
+		lr.next = lr.readMagic
+
+		return lr.endFrame()
+	}
+
+	uncompressed := size&0x80000000 != 0
+	size &= 0x7fffffff
+
+	if int(size) > lr.blockMaxSize {
+		return fmt.Errorf("lz4: invalid block size: %d", size)
+	}
+
+	if err := lr.readSource(int(size)); err != nil {
+		return err
+	}
+
+	if lr.blockChecksum {
+		checksum, err := lr.readUint32()
+		if err != nil {
+			return truncated(err, "lz4: truncated block checksum")
+		}
+
+		if xxh32Sum(lr.src) != checksum {
+			return errors.New("lz4: block checksum mismatch")
+		}
+	}
+
+	// Matches in linked blocks may refer to the end of the previous block.
+	var history int
+	if lr.linked {
+		history = min(len(lr.buf), lz4WindowSize)
+		copy(lr.buf, lr.buf[len(lr.buf)-history:])
+	}
+	lr.buf = lr.buf[:history]
+
+	if uncompressed {
+		lr.buf = append(lr.buf, lr.src...)
+	} else {
+		lr.buf, err = decodeLZ4Block(lr.buf, lr.src, history+lr.blockMaxSize)
+		if err != nil {
+			return err
+		}
+	}
+	lr.pos = history
+
+	block := lr.buf[history:]
+	lr.decompressed += int64(len(block))
+	if lr.contentHash != nil {
+		lr.contentHash.Write(block)
+	}
+
+	return nil
+}
+
+// endFrame verifies the size and checksum of the frame that has just ended.
+func (lr *lz4Reader) endFrame() error {
+	if lr.contentSize >= 0 && lr.decompressed != lr.contentSize {
+		return fmt.Errorf("lz4: content size mismatch: expected %d, got %d", lr.contentSize, lr.decompressed)
+	}
+
+	if lr.contentHash != nil {
+		checksum, err := lr.readUint32()
+		if err != nil {
+			return truncated(err, "lz4: truncated content checksum")
+		}
+
+		if lr.contentHash.Sum32() != checksum {
+			return errors.New("lz4: content checksum mismatch")
+		}
+	}
+
+	return nil
+}
+
+// readLegacyBlock decompresses the next block of a legacy stream. Legacy
+// streams consist of independently compressed blocks, each preceded by its
+// compressed size, and end at the end of the underlying reader.
+func (lr *lz4Reader) readLegacyBlock() error {
+	lr.buf, lr.pos = lr.buf[:0], 0
+
+	size, err := lr.readUint32()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+
+		return truncated(err, "lz4: truncated block header")
+	}
+
+	// Legacy streams may be concatenated.
+	if size == lz4LegacyMagic {
+		return nil
+	}
+
+	if size > lz4LegacyMaxCompressedSize {
+		return fmt.Errorf("lz4: invalid block size: %d", size)
+	}
+
+	if err := lr.readSource(int(size)); err != nil {
+		return err
+	}
+
+	lr.buf, err = decodeLZ4Block(lr.buf, lr.src, lz4LegacyBlockSize)
+
+	return err
+}
+
+// readSource reads the next size bytes of the stream (a block) into src.
+func (lr *lz4Reader) readSource(size int) error {
+	if cap(lr.src) < size {
+		lr.src = make([]byte, size)
+	}
+	lr.src = lr.src[:size]
+
+	if _, err := io.ReadFull(lr.r, lr.src); err != nil {
+		return truncated(err, "lz4: truncated block")
+	}
+
+	return nil
+}
+
+func (lr *lz4Reader) readUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(lr.r, b[:]); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+// truncated replaces the end of file errors of a partial read with an error
+// describing what was truncated.
+func truncated(err error, detail string) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s: %w", detail, io.ErrUnexpectedEOF)
+	}
+
+	return err
+}
+
+// decodeLZ4Block appends the decompressed contents of an LZ4 block to dst,
+// which may hold the preceding output that matches can refer to. The
+// decompressed length of dst must not exceed maxSize.
+func decodeLZ4Block(dst, src []byte, maxSize int) ([]byte, error) {
+	length := func(i int, n int) (int, int, error) {
+		if n != 15 {
+			return i, n, nil
+		}
+
+		for {
+			if i >= len(src) {
+				return 0, 0, errors.New("lz4: truncated sequence")
+			}
+
+			b := src[i]
+			i++
+			n += int(b)
+
+			if n > maxSize {
+				return 0, 0, errors.New("lz4: block too large")
+			}
+
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+
+	var i int
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		var literals, match int
+		var err error
+		i, literals, err = length(i, int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+
+		if literals > len(src)-i {
+			return nil, errors.New("lz4: truncated literals")
+		}
+		if len(dst)+literals > maxSize {
+			return nil, errors.New("lz4: block too large")
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+
+		// The last sequence consists only of literals.
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, errors.New("lz4: truncated match offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("lz4: invalid match offset: %d", offset)
+		}
+
+		i, match, err = length(i, int(token&15))
+		if err != nil {
+			return nil, err
+		}
+		match += 4
+
+		if len(dst)+match > maxSize {
+			return nil, errors.New("lz4: block too large")
+		}
+
+		// Matches may overlap the data they produce, so are copied a byte at
+		// a time.
+		start := len(dst) - offset
+		for j := 0; j < match; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+
+	return dst, nil
+}
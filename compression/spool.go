@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"sync"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/zstdseekable"
+)
+
+// DefaultSpoolMemoryLimit is the amount of data a Spool will buffer in memory
+// before spilling to a temporary file.
+const DefaultSpoolMemoryLimit = 32 << 20
+
+// ErrTooLarge is returned when a spooled stream exceeds its maximum size.
+var ErrTooLarge = archiveerrors.Define(archiveerrors.ErrLimitExceeded, "stream too large")
+
+var (
+	_ ReadAtCloser = (*Spool)(nil)
+)
+
+// ReadAtCloser is an io.ReaderAt that must be closed to release its
+// resources.
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// SpoolOptions configures how a Spool buffers a stream.
+type SpoolOptions struct {
+	// MemoryLimit is the amount of data to buffer in memory before spilling to
+	// a temporary file. Defaults to DefaultSpoolMemoryLimit, a negative value
+	// always uses a temporary file.
+	MemoryLimit int64
+	// MaxSize is the maximum size of the stream, zero means unlimited.
+	MaxSize int64
+	// TempDir is the directory to create the temporary file in, if empty the
+	// default directory for temporary files is used.
+	TempDir string
+}
+
+// NewReaderAt detects the compression algorithm of ra and returns an
+// io.ReaderAt for the decompressed data. Uncompressed data is read in place,
+// as are seekable zstd streams (see zstdseekable) if size is known (ie. not
+// negative). Otherwise the data is decompressed into a Spool as it is read.
+// The returned reader must be closed.
+func NewReaderAt(ra io.ReaderAt, size int64, opts *SpoolOptions) (ReadAtCloser, Algorithm, error) {
+	header := make([]byte, magicSize)
+	n, err := ra.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, None, err
+	}
+
+	algorithm := Detect(header[:n])
+	switch algorithm {
+	case None:
+		return nopCloser{ra}, algorithm, nil
+	case Zstd:
+		if size >= 0 {
+			if zr, err := zstdseekable.Open(ra, size); err == nil {
+				return zr, algorithm, nil
+			}
+		}
+	}
+
+	if size < 0 {
+		size = math.MaxInt64
+	}
+
+	r, err := Decompress(io.NewSectionReader(ra, 0, size), algorithm)
+	if err != nil {
+		return nil, algorithm, err
+	}
+
+	return &decompressedSpool{Spool: NewSpool(r, opts), r: r}, algorithm, nil
+}
+
+// Spool is an io.ReaderAt that lazily buffers data from a non-seekable
+// reader, in memory or a temporary file for larger streams. Data is only
+// read from the underlying reader as it is needed. It is safe for concurrent
+// use.
+type Spool struct {
+	mu       sync.Mutex
+	src      io.Reader
+	srcErr   error
+	memLimit int64
+	maxSize  int64
+	tempDir  string
+	buf      []byte
+	file     *os.File
+	size     int64
+	closed   bool
+}
+
+// NewSpool returns a Spool that buffers data read from r.
+func NewSpool(r io.Reader, opts *SpoolOptions) *Spool {
+	if opts == nil {
+		opts = &SpoolOptions{}
+	}
+
+	s := &Spool{
+		src:      r,
+		memLimit: opts.MemoryLimit,
+		maxSize:  opts.MaxSize,
+		tempDir:  opts.TempDir,
+	}
+	if s.memLimit == 0 {
+		s.memLimit = DefaultSpoolMemoryLimit
+	}
+
+	return s
+}
+
+// ReadAt reads len(p) bytes starting at off, reading from the underlying
+// reader as needed. It returns fs.ErrClosed once the spool is closed.
+func (s *Spool) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, fs.ErrClosed
+	}
+
+	// Zero length reads still check there is data at off, so that they only
+	// report io.EOF at the end of the stream.
+	for s.size < off+int64(max(len(p), 1)) && s.srcErr == nil {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if off >= s.size {
+		return 0, s.eof()
+	}
+
+	short := int64(len(p)) > s.size-off
+	if short {
+		p = p[:s.size-off]
+	}
+
+	if s.file != nil {
+		n, err := s.file.ReadAt(p, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+	} else {
+		copy(p, s.buf[off:])
+	}
+
+	if short {
+		return len(p), s.eof()
+	}
+
+	return len(p), nil
+}
+
+// Close releases the buffered data, and removes the temporary file (if
+// any). The underlying reader is not closed.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.buf = nil
+
+	if s.file != nil {
+		name := s.file.Name()
+		err := s.file.Close()
+		s.file = nil
+		return errors.Join(err, os.Remove(name))
+	}
+
+	return nil
+}
+
+// fill reads the next chunk of data from the source reader.
+func (s *Spool) fill() error {
+	chunk := make([]byte, 32*1024)
+	n, err := s.src.Read(chunk)
+	if err != nil {
+		s.srcErr = err
+	}
+	chunk = chunk[:n]
+
+	if s.maxSize > 0 && s.size+int64(n) > s.maxSize {
+		s.srcErr = fmt.Errorf("stream is larger than %d bytes: %w", s.maxSize, ErrTooLarge)
+		return s.srcErr
+	}
+
+	if s.file == nil && s.size+int64(n) > s.memLimit {
+		f, err := os.CreateTemp(s.tempDir, "spool-*")
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(s.buf); err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			return err
+		}
+
+		s.file = f
+		s.buf = nil
+	}
+
+	if s.file != nil {
+		if _, err := s.file.WriteAt(chunk, s.size); err != nil {
+			return err
+		}
+	} else {
+		s.buf = append(s.buf, chunk...)
+	}
+	s.size += int64(n)
+
+	return nil
+}
+
+// eof returns the error to report once all spooled data has been consumed.
+func (s *Spool) eof() error {
+	if s.srcErr == nil || errors.Is(s.srcErr, io.EOF) {
+		return io.EOF
+	}
+
+	return s.srcErr
+}
+
+// decompressedSpool also closes the decompressor.
+type decompressedSpool struct {
+	*Spool
+	r io.Closer
+}
+
+func (s *decompressedSpool) Close() error {
+	return errors.Join(s.Spool.Close(), s.r.Close())
+}
+
+type nopCloser struct {
+	io.ReaderAt
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package compression
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The 32-bit variant of xxHash (with a seed of zero), used for the checksums
+// of LZ4 frames.
+
+const (
+	xxh32Prime1 uint32 = 2654435761
+	xxh32Prime2 uint32 = 2246822519
+	xxh32Prime3 uint32 = 3266489917
+	xxh32Prime4 uint32 = 668265263
+	xxh32Prime5 uint32 = 374761393
+)
+
+// xxh32 is a streaming xxHash32 digest. The zero value is ready to use.
+type xxh32 struct {
+	v       [4]uint32
+	started bool
+	total   uint64
+	mem     [16]byte
+	memSize int
+}
+
+// xxh32Sum returns the xxHash32 digest of b.
+func xxh32Sum(b []byte) uint32 {
+	var h xxh32
+	h.Write(b)
+
+	return h.Sum32()
+}
+
+func (h *xxh32) Write(b []byte) {
+	if !h.started {
+		// The initial state wraps around, so is computed at run time.
+		p1, p2 := xxh32Prime1, xxh32Prime2
+		h.v = [4]uint32{p1 + p2, p2, 0, -p1}
+		h.started = true
+	}
+
+	h.total += uint64(len(b))
+
+	if h.memSize > 0 {
+		n := copy(h.mem[h.memSize:], b)
+		h.memSize += n
+		b = b[n:]
+
+		if h.memSize < len(h.mem) {
+			return
+		}
+
+		h.stripe(h.mem[:])
+		h.memSize = 0
+	}
+
+	for ; len(b) >= len(h.mem); b = b[len(h.mem):] {
+		h.stripe(b)
+	}
+
+	h.memSize = copy(h.mem[:], b)
+}
+
+// stripe consumes 16 bytes of input.
+func (h *xxh32) stripe(b []byte) {
+	for i := range h.v {
+		h.v[i] = xxh32Round(h.v[i], binary.LittleEndian.Uint32(b[4*i:]))
+	}
+}
+
+func (h *xxh32) Sum32() uint32 {
+	var acc uint32
+	if h.total >= uint64(len(h.mem)) {
+		acc = bits.RotateLeft32(h.v[0], 1) + bits.RotateLeft32(h.v[1], 7) +
+			bits.RotateLeft32(h.v[2], 12) + bits.RotateLeft32(h.v[3], 18)
+	} else {
+		acc = xxh32Prime5
+	}
+
+	acc += uint32(h.total)
+
+	b := h.mem[:h.memSize]
+	for ; len(b) >= 4; b = b[4:] {
+		acc += binary.LittleEndian.Uint32(b) * xxh32Prime3
+		acc = bits.RotateLeft32(acc, 17) * xxh32Prime4
+	}
+
+	for _, c := range b {
+		acc += uint32(c) * xxh32Prime5
+		acc = bits.RotateLeft32(acc, 11) * xxh32Prime1
+	}
+
+	acc ^= acc >> 15
+	acc *= xxh32Prime2
+	acc ^= acc >> 13
+	acc *= xxh32Prime3
+	acc ^= acc >> 16
+
+	return acc
+}
+
+func xxh32Round(acc, input uint32) uint32 {
+	acc += input * xxh32Prime2
+	acc = bits.RotateLeft32(acc, 13)
+
+	return acc * xxh32Prime1
+}
@@ -0,0 +1,210 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// ErrEscapesRoot is returned when resolving a path in a confined filesystem,
+// or extracting an entry, would leave its root.
+var ErrEscapesRoot = archiveerrors.Define(archiveerrors.ErrInsecurePath, "path escapes from root")
+
+var (
+	_ fs.ReadDirFS = (*confinedFS)(nil)
+	_ fs.StatFS    = (*confinedFS)(nil)
+	_ ReadLinkFS   = (*confinedFS)(nil)
+)
+
+// ConfinedSub returns a read-only view of the subtree of fsys rooted at dir,
+// as for chroot(2). Unlike fs.Sub, symbolic links are resolved by the
+// returned filesystem: absolute targets are relative to dir, and any path
+// that would leave dir (eg. via "..") fails with ErrEscapesRoot. This makes
+// it suitable for exposing part of an archive to untrusted path input.
+//
+// Symbolic links are only recognized if fsys implements ReadLinkFS.
+func ConfinedSub(fsys fs.FS, dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+
+	fi, err := fs.Stat(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	return &confinedFS{fsys: fsys, dir: dir}, nil
+}
+
+type confinedFS struct {
+	fsys fs.FS
+	dir  string
+}
+
+func (fsys *confinedFS) Open(name string) (fs.File, error) {
+	realName, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.fsys.Open(realName)
+	if err != nil {
+		return nil, err
+	}
+
+	if path.Base(realName) == path.Base(name) || name == "." {
+		return f, nil
+	}
+
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return &renamedDir{renamedFile{File: f, name: path.Base(name)}}, nil
+	}
+
+	return &renamedFile{File: f, name: path.Base(name)}, nil
+}
+
+func (fsys *confinedFS) Stat(name string) (fs.FileInfo, error) {
+	realName, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := lstat(fsys.fsys, realName)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.renameInfo(name, fi), nil
+}
+
+func (fsys *confinedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	realName, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.ReadDir(fsys.fsys, realName)
+}
+
+func (fsys *confinedFS) ReadLink(name string) (string, error) {
+	realName, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	return readLink(fsys.fsys, realName)
+}
+
+func (fsys *confinedFS) StatLink(name string) (fs.FileInfo, error) {
+	realName, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := lstat(fsys.fsys, realName)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.renameInfo(name, fi), nil
+}
+
+// resolve returns the name in the underlying filesystem of the named entry,
+// following symbolic links (including the final element, if follow is set).
+func (fsys *confinedFS) resolve(op, name string, follow bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	var links int
+	var resolved []string
+	remaining := name
+	if remaining == "." {
+		remaining = ""
+	}
+
+	for remaining != "" {
+		var elem string
+		elem, remaining, _ = strings.Cut(remaining, "/")
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", &fs.PathError{Op: op, Path: name, Err: ErrEscapesRoot}
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		realName := path.Join(fsys.dir, path.Join(resolved...), elem)
+
+		fi, err := lstat(fsys.fsys, realName)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 && (remaining != "" || follow) {
+			links++
+			if links > MaxSymlinkHops {
+				return "", &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+
+			target, err := readLink(fsys.fsys, realName)
+			if err != nil {
+				return "", err
+			}
+
+			if path.IsAbs(target) {
+				resolved = resolved[:0]
+			}
+
+			if remaining != "" {
+				target = strings.TrimPrefix(target, "/") + "/" + remaining
+			}
+			remaining = strings.TrimPrefix(target, "/")
+			continue
+		}
+
+		resolved = append(resolved, elem)
+	}
+
+	return path.Join(fsys.dir, path.Join(resolved...)), nil
+}
+
+// renameInfo returns fi, with the base name of the entry in the confined
+// filesystem.
+func (fsys *confinedFS) renameInfo(name string, fi fs.FileInfo) fs.FileInfo {
+	if name == "." || fi.Name() == path.Base(name) {
+		return fi
+	}
+
+	return &renamedFileInfo{FileInfo: fi, name: path.Base(name)}
+}
+
+// renamedDir is an open directory with a rewritten name.
+type renamedDir struct {
+	renamedFile
+}
+
+func (d *renamedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	return d.File.(fs.ReadDirFile).ReadDir(n)
+}
@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfinedSub(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("rootfs/etc", 0o755))
+	require.NoError(t, src.MkdirAll("rootfs/usr/lib", 0o755))
+	require.NoError(t, src.WriteFile("secret", []byte("secret"), 0o600))
+	require.NoError(t, src.WriteFile("rootfs/etc/hostname", []byte("confined"), 0o644))
+	require.NoError(t, src.MkdirAll("rootfs/var/lib", 0o755))
+	require.NoError(t, src.WriteFile("rootfs/usr/lib/os-release", []byte("ID=test"), 0o644))
+	require.NoError(t, src.WriteFile("rootfs/var/lib/state", []byte("state"), 0o644))
+	require.NoError(t, src.Symlink("../usr/lib/os-release", "rootfs/etc/os-release"))
+	require.NoError(t, src.Symlink("/etc", "rootfs/usr/etc"))
+
+	fsys, err := archivefs.ConfinedSub(src, "rootfs")
+	require.NoError(t, err)
+
+	require.NoError(t, fstest.TestFS(fsys, "var/lib/state", "etc/hostname", "etc/os-release", "usr/lib/os-release"))
+
+	require.NoError(t, src.Symlink("../../secret", "rootfs/etc/escape"))
+	require.NoError(t, src.Symlink("/secret", "rootfs/etc/secret"))
+
+	data, err := fs.ReadFile(fsys, "etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=test", string(data))
+
+	data, err = fs.ReadFile(fsys, "usr/etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "confined", string(data))
+
+	fi, err := fs.Stat(fsys, "usr/etc")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, "etc", fi.Name())
+
+	require.Equal(t, []string{"escape", "hostname", "os-release", "secret"}, readDirNames(t, fsys, "usr/etc"))
+
+	_, err = fs.ReadFile(fsys, "etc/escape")
+	require.ErrorIs(t, err, archivefs.ErrEscapesRoot)
+
+	// Absolute targets are relative to the new root.
+	_, err = fs.ReadFile(fsys, "etc/secret")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	target, err := fsys.(archivefs.ReadLinkFS).ReadLink("etc/escape")
+	require.NoError(t, err)
+	require.Equal(t, "../../secret", target)
+
+	fi, err = fsys.(archivefs.ReadLinkFS).StatLink("usr/etc")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	_, err = archivefs.ConfinedSub(src, "secret")
+	require.Error(t, err)
+}
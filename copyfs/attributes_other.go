@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import "io/fs"
+
+// setAttributes does nothing, Windows file attributes have no equivalent on
+// other platforms.
+func setAttributes(_ string, _ fs.FileInfo) error {
+	return nil
+}
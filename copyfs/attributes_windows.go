@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// attributeMask is the set of Windows file attributes that are preserved.
+const attributeMask = syscall.FILE_ATTRIBUTE_READONLY | syscall.FILE_ATTRIBUTE_HIDDEN
+
+// setAttributes sets the read-only and hidden attributes of a copied file
+// from the source, if known.
+func setAttributes(path string, fi fs.FileInfo) error {
+	var attrs uint32
+	switch sys := fi.Sys().(type) {
+	case *syscall.Win32FileAttributeData:
+		attrs = sys.FileAttributes
+	case archivefs.FileAttributes:
+		attrs = sys.FileAttributes()
+	default:
+		return nil
+	}
+
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	current, err := syscall.GetFileAttributes(pathPtr)
+	if err != nil {
+		return &fs.PathError{Op: "GetFileAttributes", Path: path, Err: err}
+	}
+
+	if err := syscall.SetFileAttributes(pathPtr, current&^attributeMask|attrs&attributeMask); err != nil {
+		return &fs.PathError{Op: "SetFileAttributes", Path: path, Err: err}
+	}
+
+	return nil
+}
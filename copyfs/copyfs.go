@@ -0,0 +1,802 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package copyfs copies the contents of a filesystem to a local directory,
+// or to another writable filesystem.
+package copyfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/osutil"
+)
+
+// Options configures how a filesystem is copied.
+type Options struct {
+	// PreserveOwner sets the numeric owner of each copied entry from the
+	// source (if available from fs.FileInfo.Sys()). Failures due to
+	// insufficient privileges are ignored unless running as root.
+	PreserveOwner bool
+	// PreserveMode sets the exact permission bits (including setuid, setgid,
+	// and sticky bits) of each copied file and directory, ignoring the umask.
+	PreserveMode bool
+	// PreserveTimes sets the modification time of each copied file and
+	// directory. Directory times are applied after their children have been
+	// copied. The times of symbolic links are not preserved.
+	PreserveTimes bool
+	// PreserveXattrs sets the extended attributes of each copied entry from
+	// the source (if available from fs.FileInfo.Sys()). As with ownership,
+	// failures due to insufficient privileges are ignored unless running as
+	// root.
+	PreserveXattrs bool
+	// PreserveHardLinks recreates hard links at the destination, rather than
+	// copying the contents of each link. Hard links are detected using
+	// archivefs.FileID.
+	PreserveHardLinks bool
+	// PreserveAttributes sets the read-only and hidden attributes of each
+	// copied file and directory on Windows, if conveyed by the source with
+	// archivefs.FileAttributes. It has no effect on other platforms.
+	PreserveAttributes bool
+	// LongPaths prefixes destination paths with \\?\ on Windows, so that
+	// paths longer than MAX_PATH (260 characters) can be created. It has no
+	// effect on other platforms.
+	LongPaths bool
+	// SkipXattrs is a list of extended attribute prefixes that should not be
+	// copied. If nil, DefaultSkipXattrs is used.
+	SkipXattrs []string
+	// Overwrite determines what happens when an entry already exists at the
+	// destination. Existing directories are always merged into.
+	Overwrite OverwritePolicy
+	// SpecialFiles determines how device nodes, named pipes, and sockets are
+	// handled.
+	SpecialFiles SpecialFilePolicy
+	// Symlinks determines how symbolic links are copied, and how their
+	// targets are rewritten.
+	Symlinks SymlinkPolicy
+	// Resume reuses entries that already exist at the destination and match
+	// the source, allowing an interrupted copy to be resumed. Entries that
+	// don't match are handled according to the overwrite policy (typically
+	// OverwriteAlways when resuming).
+	Resume ResumeMode
+	// Conflict, if set, is called for each entry that already exists at the
+	// destination, once the overwrite policy has been applied.
+	Conflict func(c Conflict)
+	// Sparse skips over blocks of zeros in regular files rather than writing
+	// them, creating holes at the destination (on filesystems that support
+	// them). Holes reported by the source (see archivefs.SparseFS) are always
+	// preserved.
+	Sparse bool
+	// Reflink attempts to clone the contents of regular files when both the
+	// source and destination are local files (eg. with os.DirFS), which on
+	// filesystems that support it (eg. btrfs, xfs) shares the underlying
+	// storage. If cloning isn't possible the contents are copied, allowing
+	// the kernel to accelerate the copy where possible. Progress is not
+	// reported while such files are copied.
+	Reflink bool
+	// Atomic writes each regular file to a temporary file in the destination
+	// directory, and renames it into place once it is complete. Incomplete
+	// files are never visible under their final names, and are removed if
+	// the copy fails.
+	Atomic bool
+	// DryRun walks and validates the source, detecting conflicts and
+	// computing statistics, without writing anything to the destination. The
+	// operations that would have been performed are returned in
+	// Stats.Operations.
+	DryRun bool
+	// RateLimit is the maximum rate, in bytes per second, at which file
+	// contents are copied (across all workers). If zero, the rate is not
+	// limited. Rate limiting prevents the copy from being offloaded to the
+	// kernel, though reflinks are still created.
+	RateLimit int64
+	// Concurrency is the number of regular files to copy concurrently. If
+	// less than or equal to one, files are copied sequentially.
+	Concurrency int
+	// Progress, if set, is called as each entry is copied, and periodically
+	// while the contents of large files are copied. Calls are serialized,
+	// even when copying concurrently.
+	Progress func(p Progress)
+}
+
+// OverwritePolicy determines how entries that already exist at the
+// destination are handled.
+type OverwritePolicy int
+
+const (
+	// OverwriteNever fails the copy with an error satisfying
+	// errors.Is(err, fs.ErrExist).
+	OverwriteNever OverwritePolicy = iota
+	// OverwriteSkip leaves the existing entry in place.
+	OverwriteSkip
+	// OverwriteAlways replaces the existing entry. Existing directories are
+	// never replaced by other types of entry.
+	OverwriteAlways
+	// OverwriteIfNewer replaces the existing entry only if the source has a
+	// more recent modification time.
+	OverwriteIfNewer
+)
+
+// Conflict describes an entry that already exists at the destination.
+type Conflict struct {
+	// Path is the source path of the entry.
+	Path string
+	// Existing describes the entry at the destination.
+	Existing fs.FileInfo
+	// Overwritten is true if the existing entry was replaced.
+	Overwritten bool
+}
+
+// Progress describes the progress of a copy.
+type Progress struct {
+	// Path is the source path of the entry being copied.
+	Path string
+	// FileBytes is the number of bytes of the current file copied so far.
+	FileBytes int64
+	// FileSize is the size of the current file.
+	FileSize int64
+	// Stats are the aggregate statistics for the copy so far.
+	Stats Stats
+}
+
+// Stats summarizes a copy.
+type Stats struct {
+	// Files is the number of regular files copied.
+	Files int
+	// Dirs is the number of directories created.
+	Dirs int
+	// Symlinks is the number of symbolic links created.
+	Symlinks int
+	// HardLinks is the number of hard links created.
+	HardLinks int
+	// Special is the number of device nodes and named pipes created.
+	Special int
+	// Skipped is the number of entries that were not copied.
+	Skipped int
+	// Reused is the number of existing entries that matched the source and
+	// were reused.
+	Reused int
+	// ReusedBytes is the size of the contents of reused files.
+	ReusedBytes int64
+	// Bytes is the number of bytes of file contents copied.
+	Bytes int64
+	// Duration is the time taken by the copy.
+	Duration time.Duration
+	// Operations are the planned operations, only populated for dry runs.
+	Operations []Operation
+}
+
+// OperationType is the type of a planned operation.
+type OperationType int
+
+const (
+	// OpMkdir creates a directory.
+	OpMkdir OperationType = iota
+	// OpWriteFile creates a regular file.
+	OpWriteFile
+	// OpSymlink creates a symbolic link.
+	OpSymlink
+	// OpLink creates a hard link.
+	OpLink
+	// OpSkip leaves an existing entry in place.
+	OpSkip
+	// OpReuse reuses an existing entry that matches the source.
+	OpReuse
+	// OpMknod creates a device node or named pipe.
+	OpMknod
+)
+
+func (t OperationType) String() string {
+	switch t {
+	case OpMkdir:
+		return "mkdir"
+	case OpWriteFile:
+		return "write"
+	case OpSymlink:
+		return "symlink"
+	case OpLink:
+		return "link"
+	case OpSkip:
+		return "skip"
+	case OpReuse:
+		return "reuse"
+	case OpMknod:
+		return "mknod"
+	default:
+		return fmt.Sprintf("OperationType(%d)", int(t))
+	}
+}
+
+// Operation describes a change a copy would make to the destination.
+type Operation struct {
+	Type OperationType
+	// Path is the source path of the entry.
+	Path string
+	// NewPath is the destination path of the entry.
+	NewPath string
+	// Size is the size of a regular file.
+	Size int64
+	// Link is the target of a symbolic link, or the destination path of the
+	// file a hard link refers to.
+	Link string
+}
+
+// CopyFS copies the filesystem fsys into the directory dir, creating dir if
+// necessary.
+//
+// Files are created with mode 0o666 plus any execute permissions from the
+// source, and directories are created with mode 0o777 (before umask).
+//
+// Symbolic links are recreated at the destination, provided fsys implements
+// archivefs.ReadLinkFS. Link targets are copied verbatim and are not
+// followed.
+//
+// CopyFS will not overwrite existing files. If a file name in fsys already
+// exists in the destination, CopyFS will return an error such that
+// errors.Is(err, fs.ErrExist) will be true.
+func CopyFS(dir string, fsys fs.FS) error {
+	_, err := CopyFSWithOptions(dir, fsys, nil)
+	return err
+}
+
+// CopyFSWithOptions copies the filesystem fsys into the directory dir,
+// creating dir if necessary, and returns a summary of the copy. See CopyFS
+// for details.
+func CopyFSWithOptions(dir string, fsys fs.FS, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.LongPaths {
+		var err error
+		dir, err = longPath(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &copier{
+		dir:   dir,
+		fsys:  fsys,
+		opts:  opts,
+		links: map[uint64]string{},
+	}
+
+	if opts.RateLimit > 0 {
+		c.bucket = newTokenBucket(opts.RateLimit)
+	}
+
+	start := time.Now()
+	err := c.copy()
+	c.stats.Duration = time.Since(start)
+
+	return &c.stats, err
+}
+
+type copier struct {
+	dir   string
+	fsys  fs.FS
+	opts  *Options
+	stats Stats
+	// dirs holds the directories that have been created. Directory metadata
+	// is applied once all of their children have been copied, so that
+	// read-only directories can be populated and their modification times
+	// aren't clobbered.
+	dirs []dirMetadata
+	// links holds the destination path of the first copy of each hard
+	// linked file.
+	links map[uint64]string
+	// hardLinks holds the hard links to be created once all regular files
+	// have been copied.
+	hardLinks []hardLink
+	// pool, if non-nil, copies regular files concurrently.
+	pool *osutil.Pool[fileJob]
+	// bucket, if non-nil, limits the rate at which file contents are
+	// copied.
+	bucket *tokenBucket
+	// mu protects stats and serializes calls to the progress callback.
+	mu sync.Mutex
+}
+
+type dirMetadata struct {
+	path string
+	fi   fs.FileInfo
+}
+
+type hardLink struct {
+	path    string
+	newPath string
+	target  string
+}
+
+type fileJob struct {
+	path    string
+	newPath string
+	fi      fs.FileInfo
+}
+
+func (c *copier) copy() error {
+	if err := c.walk(); err != nil {
+		return err
+	}
+
+	for _, l := range c.hardLinks {
+		if c.opts.DryRun {
+			c.plan(Operation{Type: OpLink, Path: l.path, NewPath: l.newPath, Link: l.target})
+		} else if err := os.Link(l.target, l.newPath); err != nil {
+			return err
+		}
+		c.update(func(s *Stats) { s.HardLinks++ })
+		c.progress(Progress{Path: l.path})
+	}
+
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		if err := c.applyMetadata(c.dirs[i].path, c.dirs[i].fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walk creates the directory tree and copies each entry, handing regular
+// files off to a pool of workers if copying concurrently.
+func (c *copier) walk() error {
+	walkFn := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		return c.copyEntry(path, d)
+	}
+
+	if c.opts.Concurrency <= 1 || c.opts.DryRun {
+		return fs.WalkDir(c.fsys, ".", walkFn)
+	}
+
+	c.pool = osutil.NewPool(context.Background(), c.opts.Concurrency, func(job fileJob) error {
+		return c.copyRegular(job.path, job.newPath, job.fi)
+	})
+
+	err := fs.WalkDir(c.fsys, ".", walkFn)
+	if poolErr := c.pool.Wait(); err == nil {
+		err = poolErr
+	}
+
+	return err
+}
+
+func (c *copier) copyEntry(path string, d fs.DirEntry) error {
+	fpath, err := localize(path)
+	if err != nil {
+		return err
+	}
+	newPath := filepath.Join(c.dir, fpath)
+
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	if existing, err := os.Lstat(newPath); err == nil && !(existing.IsDir() && d.IsDir()) {
+		reuse, err := c.reusable(path, newPath, fi, existing)
+		if err != nil {
+			return err
+		}
+
+		if reuse {
+			c.reuse(path, newPath, fi)
+			return nil
+		}
+
+		overwrite, err := c.resolveConflict(path, newPath, fi, existing)
+		if err != nil {
+			return err
+		}
+
+		if !overwrite {
+			if c.opts.DryRun {
+				c.plan(Operation{Type: OpSkip, Path: path, NewPath: newPath})
+			}
+			c.update(func(s *Stats) { s.Skipped++ })
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	switch fi.Mode().Type() {
+	case fs.ModeDir:
+		if c.opts.DryRun {
+			c.plan(Operation{Type: OpMkdir, Path: path, NewPath: newPath})
+		} else {
+			if err := os.MkdirAll(newPath, 0o777); err != nil {
+				return err
+			}
+			c.dirs = append(c.dirs, dirMetadata{path: newPath, fi: fi})
+		}
+		c.update(func(s *Stats) { s.Dirs++ })
+
+		c.progress(Progress{Path: path})
+
+		return nil
+	case fs.ModeSymlink:
+		if c.opts.Symlinks == SymlinksSkip {
+			if c.opts.DryRun {
+				c.plan(Operation{Type: OpSkip, Path: path, NewPath: newPath})
+			}
+			c.update(func(s *Stats) { s.Skipped++ })
+			return nil
+		}
+
+		if err := c.copySymlink(path, newPath); err != nil {
+			return err
+		}
+
+		if !c.opts.DryRun {
+			if err := c.applyMetadata(newPath, fi); err != nil {
+				return err
+			}
+		}
+
+		c.update(func(s *Stats) { s.Symlinks++ })
+		c.progress(Progress{Path: path, FileBytes: fi.Size(), FileSize: fi.Size()})
+
+		return nil
+	case 0:
+		if c.opts.PreserveHardLinks {
+			if id, nlink, ok := getFileID(c.fsys, path, fi); ok && nlink > 1 {
+				// The link target may still be being copied, so links are
+				// created once all files have been copied.
+				if target, ok := c.links[id]; ok {
+					c.hardLinks = append(c.hardLinks, hardLink{path: path, newPath: newPath, target: target})
+					return nil
+				}
+				c.links[id] = newPath
+			}
+		}
+
+		if c.opts.DryRun {
+			c.plan(Operation{Type: OpWriteFile, Path: path, NewPath: newPath, Size: fi.Size()})
+			c.update(func(s *Stats) {
+				s.Files++
+				s.Bytes += fi.Size()
+			})
+			c.progress(Progress{Path: path, FileBytes: fi.Size(), FileSize: fi.Size()})
+
+			return nil
+		}
+
+		if c.pool == nil {
+			return c.copyRegular(path, newPath, fi)
+		}
+
+		return c.pool.Go(fileJob{path: path, newPath: newPath, fi: fi})
+	default:
+		return c.copySpecial(path, newPath, fi)
+	}
+}
+
+// copyRegular copies the contents and metadata of a regular file.
+func (c *copier) copyRegular(path, newPath string, fi fs.FileInfo) error {
+	if !c.opts.Atomic {
+		if err := c.copyFile(path, newPath); err != nil {
+			return err
+		}
+
+		if err := c.applyMetadata(newPath, fi); err != nil {
+			return err
+		}
+	} else if err := c.copyFileAtomic(path, newPath, fi); err != nil {
+		return err
+	}
+
+	c.update(func(s *Stats) { s.Files++ })
+	c.progress(Progress{Path: path, FileBytes: fi.Size(), FileSize: fi.Size()})
+
+	return nil
+}
+
+// reuse records an existing entry that matches the source.
+func (c *copier) reuse(path, newPath string, fi fs.FileInfo) {
+	if c.opts.PreserveHardLinks {
+		if id, nlink, ok := getFileID(c.fsys, path, fi); ok && nlink > 1 {
+			if _, ok := c.links[id]; !ok {
+				c.links[id] = newPath
+			}
+		}
+	}
+
+	var size int64
+	if fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+
+	if c.opts.DryRun {
+		c.plan(Operation{Type: OpReuse, Path: path, NewPath: newPath, Size: size})
+	}
+
+	c.update(func(s *Stats) {
+		s.Reused++
+		s.ReusedBytes += size
+	})
+	c.progress(Progress{Path: path, FileBytes: fi.Size(), FileSize: fi.Size()})
+}
+
+// resolveConflict applies the overwrite policy to an entry that already
+// exists at the destination, removing the existing entry if it is to be
+// overwritten.
+func (c *copier) resolveConflict(path, newPath string, fi, existing fs.FileInfo) (bool, error) {
+	var overwrite bool
+	switch c.opts.Overwrite {
+	case OverwriteSkip:
+	case OverwriteAlways:
+		overwrite = true
+	case OverwriteIfNewer:
+		overwrite = fi.ModTime().After(existing.ModTime())
+	default:
+		return false, &os.PathError{Op: "CopyFS", Path: path, Err: fs.ErrExist}
+	}
+
+	if overwrite {
+		if existing.IsDir() {
+			return false, &os.PathError{Op: "CopyFS", Path: path, Err: fmt.Errorf("cannot replace directory: %w", fs.ErrExist)}
+		}
+
+		if !c.opts.DryRun {
+			if err := os.Remove(newPath); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if c.opts.Conflict != nil {
+		c.opts.Conflict(Conflict{Path: path, Existing: existing, Overwritten: overwrite})
+	}
+
+	return overwrite, nil
+}
+
+// plan records an operation that would be performed by a dry run.
+func (c *copier) plan(op Operation) {
+	c.update(func(s *Stats) { s.Operations = append(s.Operations, op) })
+}
+
+// update applies fn to the copy statistics.
+func (c *copier) update(fn func(s *Stats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fn(&c.stats)
+}
+
+func (c *copier) progress(p Progress) {
+	if c.opts.Progress == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p.Stats = c.stats
+	c.opts.Progress(p)
+}
+
+// applyMetadata sets the ownership, permissions, and modification time of
+// a copied entry.
+func (c *copier) applyMetadata(path string, fi fs.FileInfo) error {
+	if c.opts.PreserveOwner {
+		if uid, gid, ok := archivefs.LookupOwner(fi); ok {
+			if err := osutil.SetOwner(path, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.opts.PreserveXattrs {
+		skip := c.opts.SkipXattrs
+		if skip == nil {
+			skip = DefaultSkipXattrs
+		}
+
+		if err := osutil.SetXattrs(path, archivefs.Xattrs(fi), skip); err != nil {
+			return err
+		}
+	}
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	if c.opts.PreserveMode {
+		if err := osutil.SetMode(path, fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.PreserveTimes {
+		if err := osutil.SetModTime(path, fi.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	// Attributes are set last, as a read-only file can't be modified.
+	if c.opts.PreserveAttributes {
+		if err := setAttributes(path, fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *copier) copySymlink(path, newPath string) error {
+	linkFS, ok := c.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return &os.PathError{Op: "CopyFS", Path: path, Err: errors.New("source filesystem does not support symlinks")}
+	}
+
+	target, err := linkFS.ReadLink(path)
+	if err != nil {
+		return err
+	}
+
+	target, err = c.rewriteTarget(path, target)
+	if err != nil {
+		return err
+	}
+
+	if c.opts.DryRun {
+		c.plan(Operation{Type: OpSymlink, Path: path, NewPath: newPath, Link: target})
+		return nil
+	}
+
+	return os.Symlink(target, newPath)
+}
+
+// copyFileAtomic copies a regular file to a temporary file in the
+// destination directory, and renames it into place once its contents and
+// metadata have been written.
+func (c *copier) copyFileAtomic(path, newPath string, fi fs.FileInfo) error {
+	tmpPath := filepath.Join(filepath.Dir(newPath),
+		fmt.Sprintf(".%s.tmp%016x", filepath.Base(newPath), rand.Uint64()))
+
+	if err := c.copyFile(path, tmpPath); err != nil {
+		return err
+	}
+
+	if err := c.applyMetadata(tmpPath, fi); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+func (c *copier) copyFile(path, newPath string) error {
+	r, err := c.fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	info, err := r.Stat()
+	if err != nil {
+		return err
+	}
+
+	var extents []archivefs.Extent
+	if sparseFS, ok := c.fsys.(archivefs.SparseFS); ok {
+		extents, err = sparseFS.DataExtents(path)
+		if err != nil {
+			return err
+		}
+
+		if !archivefs.HasHoles(extents, info.Size()) {
+			extents = nil
+		}
+	}
+
+	w, err := os.OpenFile(newPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666|info.Mode()&0o777)
+	if err != nil {
+		return err
+	}
+
+	var dst io.Writer = w
+	closeFn := w.Close
+	if c.opts.Sparse || extents != nil {
+		sw := &sparseWriter{f: w, extents: extents, detectZeros: c.opts.Sparse}
+		dst, closeFn = sw, sw.Close
+	}
+
+	if src, ok := r.(*os.File); ok && c.opts.Reflink {
+		if err := reflink(w, src); err == nil {
+			c.update(func(s *Stats) { s.Bytes += info.Size() })
+			return w.Close()
+		}
+		// Otherwise fall back to copying. Progress isn't reported so that,
+		// unless holes are being punched, the copy can be offloaded to the
+		// kernel (eg. with copy_file_range(2)).
+	} else if c.opts.Progress != nil {
+		dst = &progressWriter{w: dst, c: c, path: path, size: info.Size()}
+	}
+
+	if c.bucket != nil {
+		dst = &rateLimitedWriter{w: dst, bucket: c.bucket}
+	}
+
+	n, err := io.Copy(dst, r)
+	c.update(func(s *Stats) { s.Bytes += n })
+	if err != nil {
+		_ = w.Close()
+		if c.opts.Atomic {
+			_ = os.Remove(newPath)
+		}
+		return &os.PathError{Op: "Copy", Path: newPath, Err: err}
+	}
+
+	if err := closeFn(); err != nil {
+		if c.opts.Atomic {
+			_ = os.Remove(newPath)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// progressWriter reports progress as the contents of a file are written.
+type progressWriter struct {
+	w       io.Writer
+	c       *copier
+	path    string
+	size    int64
+	written int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+
+	pw.c.mu.Lock()
+	defer pw.c.mu.Unlock()
+
+	progress := Progress{
+		Path:      pw.path,
+		FileBytes: pw.written,
+		FileSize:  pw.size,
+		Stats:     pw.c.stats,
+	}
+	progress.Stats.Bytes += pw.written
+	pw.c.opts.Progress(progress)
+
+	return n, err
+}
+
+// getFileID returns the identity of the underlying file, if known.
+func getFileID(fsys fs.FS, name string, fi fs.FileInfo) (id uint64, nlink int, ok bool) {
+	id, nlink, err := archivefs.LookupFileID(fsys, name, fi)
+	return id, nlink, err == nil && id != 0
+}
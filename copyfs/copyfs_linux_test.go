@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs/copyfs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyFSXattrs(t *testing.T) {
+	src := fstest.MapFS{
+		"file": {Data: []byte("data"), Mode: 0o644, Sys: &memfs.FileInfoSys{
+			Xattrs: map[string]string{
+				"user.comment":  "hello",
+				"trusted.label": "secret",
+			},
+		}},
+	}
+
+	dir := t.TempDir()
+	_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{PreserveXattrs: true})
+	require.NoError(t, err)
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(filepath.Join(dir, "file"), "user.comment", buf)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("extended attributes are not supported by the filesystem")
+	}
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+
+	_, err = syscall.Getxattr(filepath.Join(dir, "file"), "trusted.label", buf)
+	require.ErrorIs(t, err, syscall.ENODATA)
+}
+
+func TestCopyFSSparseHoles(t *testing.T) {
+	src := fstest.MapFS{
+		"sparse": {Data: append([]byte("data"), make([]byte, 8<<20)...), Mode: 0o644},
+	}
+
+	dir := t.TempDir()
+	_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{Sparse: true})
+	require.NoError(t, err)
+
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Stat(filepath.Join(dir, "sparse"), &st))
+	require.Equal(t, int64(len(src["sparse"].Data)), st.Size)
+
+	// Blocks are 512 bytes, the zeros should not have been allocated.
+	require.Less(t, st.Blocks*512, int64(1<<20))
+}
+
+func TestCopyFSSparseSource(t *testing.T) {
+	f, err := os.Open("../tarfs/testdata/sparse-holes.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	src, err := tarfs.Open(f)
+	require.NoError(t, err)
+
+	// Holes reported by the source are preserved, even without Sparse.
+	dir := t.TempDir()
+	_, err = copyfs.CopyFSWithOptions(dir, src, nil)
+	require.NoError(t, err)
+
+	want, err := fs.ReadFile(src, "sparse.db")
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(filepath.Join(dir, "sparse.db"))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Stat(filepath.Join(dir, "sparse.db"), &st))
+	require.Less(t, st.Blocks*512, st.Size)
+}
+
+func TestCopyFSSpecialFilesCreate(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.Mknod("fifo", fs.ModeNamedPipe|0o600, 0, 0))
+	require.NoError(t, src.Mknod("null", fs.ModeDevice|fs.ModeCharDevice|0o666, 1, 3))
+	require.NoError(t, src.Mknod("sock", fs.ModeSocket|0o755, 0, 0))
+
+	dir := t.TempDir()
+	stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		SpecialFiles: copyfs.SpecialFilesCreate,
+	})
+	require.NoError(t, err)
+
+	fi, err := os.Lstat(filepath.Join(dir, "fifo"))
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeNamedPipe, fi.Mode().Type())
+
+	// Creating device nodes requires privileges, otherwise it is skipped.
+	fi, err = os.Lstat(filepath.Join(dir, "null"))
+	if err == nil {
+		require.Equal(t, fs.ModeDevice|fs.ModeCharDevice, fi.Mode().Type())
+		require.Equal(t, uint64(0x103), uint64(fi.Sys().(*syscall.Stat_t).Rdev))
+		require.Equal(t, 2, stats.Special)
+		require.Equal(t, 1, stats.Skipped)
+	} else {
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.Equal(t, 1, stats.Special)
+		require.Equal(t, 2, stats.Skipped)
+	}
+}
@@ -0,0 +1,755 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/archivefs/copyfs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyFS(t *testing.T) {
+	src := memfs.New()
+
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/hello", []byte("#!/bin/sh\necho hello\n"), 0o755))
+	require.NoError(t, src.WriteFile("usr/README", []byte("readme"), 0o644))
+	require.NoError(t, src.Symlink("usr/bin", "bin"))
+	require.NoError(t, src.Symlink("/etc/missing", "usr/dangling"))
+
+	dir := t.TempDir()
+	require.NoError(t, copyfs.CopyFS(dir, src))
+
+	data, err := os.ReadFile(filepath.Join(dir, "usr/bin/hello"))
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho hello\n", string(data))
+
+	fi, err := os.Stat(filepath.Join(dir, "usr/bin/hello"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&0o100)
+
+	target, err := os.Readlink(filepath.Join(dir, "bin"))
+	require.NoError(t, err)
+	require.Equal(t, "usr/bin", target)
+
+	target, err = os.Readlink(filepath.Join(dir, "usr/dangling"))
+	require.NoError(t, err)
+	require.Equal(t, "/etc/missing", target)
+
+	// Existing files are not overwritten.
+	require.ErrorIs(t, copyfs.CopyFS(dir, src), fs.ErrExist)
+
+	t.Run("SymlinksNotSupported", func(t *testing.T) {
+		src := fstest.MapFS{
+			"link": {Data: []byte("target"), Mode: fs.ModeSymlink},
+		}
+
+		require.Error(t, copyfs.CopyFS(t.TempDir(), src))
+	})
+}
+
+func TestCopyFSWithOptions(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	owner := &memfs.FileInfoSys{Uid: os.Getuid(), Gid: os.Getgid()}
+
+	src := fstest.MapFS{
+		"etc":        {Mode: fs.ModeDir | 0o555, ModTime: modTime, Sys: owner},
+		"etc/shadow": {Data: []byte("root:*:"), Mode: 0o600, ModTime: modTime, Sys: owner},
+		"tmp":        {Mode: fs.ModeDir | fs.ModeSticky | 0o777, ModTime: modTime},
+	}
+
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		// Allow the temporary directory to be removed.
+		_ = os.Chmod(filepath.Join(dir, "etc"), 0o755)
+	})
+
+	_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		PreserveOwner: true,
+		PreserveMode:  true,
+		PreserveTimes: true,
+	})
+	require.NoError(t, err)
+
+	fi, err := os.Stat(filepath.Join(dir, "etc"))
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDir|0o555, fi.Mode())
+	require.True(t, modTime.Equal(fi.ModTime()))
+
+	fi, err = os.Stat(filepath.Join(dir, "etc/shadow"))
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode())
+	require.True(t, modTime.Equal(fi.ModTime()))
+
+	fi, err = os.Stat(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDir|fs.ModeSticky|0o777, fi.Mode())
+}
+
+func TestCopyFSHardLinks(t *testing.T) {
+	src := memfs.New()
+
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/sh"))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/ls"))
+	require.NoError(t, src.WriteFile("usr/bin/other", []byte("busybox"), 0o755))
+
+	dir := t.TempDir()
+	_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{PreserveHardLinks: true})
+	require.NoError(t, err)
+
+	busybox, err := os.Stat(filepath.Join(dir, "usr/bin/busybox"))
+	require.NoError(t, err)
+
+	for _, name := range []string{"sh", "ls"} {
+		fi, err := os.Stat(filepath.Join(dir, "usr/bin", name))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(busybox, fi), name)
+	}
+
+	other, err := os.Stat(filepath.Join(dir, "usr/bin/other"))
+	require.NoError(t, err)
+	require.False(t, os.SameFile(busybox, other))
+}
+
+func TestCopyFSProgress(t *testing.T) {
+	src := memfs.New()
+
+	require.NoError(t, src.MkdirAll("data", 0o755))
+	require.NoError(t, src.WriteFile("data/large", bytes.Repeat([]byte("x"), 1<<20), 0o644))
+	require.NoError(t, src.WriteFile("data/small", []byte("small"), 0o644))
+	require.NoError(t, src.Symlink("data/small", "link"))
+
+	var updates []copyfs.Progress
+	stats, err := copyfs.CopyFSWithOptions(t.TempDir(), src, &copyfs.Options{
+		Progress: func(p copyfs.Progress) {
+			updates = append(updates, p)
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 2, stats.Files)
+	require.Equal(t, 2, stats.Dirs)
+	require.Equal(t, 1, stats.Symlinks)
+	require.Equal(t, int64(1<<20+5), stats.Bytes)
+	require.NotZero(t, stats.Duration)
+
+	// The large file is reported incrementally.
+	var largeUpdates int
+	for _, p := range updates {
+		if p.Path == "data/large" {
+			largeUpdates++
+			require.Equal(t, int64(1<<20), p.FileSize)
+		}
+	}
+	require.Greater(t, largeUpdates, 1)
+
+	last := updates[len(updates)-1]
+	require.Equal(t, "link", last.Path)
+	require.Equal(t, stats.Bytes, last.Stats.Bytes)
+	require.Equal(t, stats.Files, last.Stats.Files)
+}
+
+func TestCopyFSOverwrite(t *testing.T) {
+	now := time.Now()
+
+	src := fstest.MapFS{
+		"newer": {Data: []byte("new"), Mode: 0o644, ModTime: now},
+		"older": {Data: []byte("new"), Mode: 0o644, ModTime: now.Add(-2 * time.Hour)},
+		"fresh": {Data: []byte("new"), Mode: 0o644, ModTime: now},
+	}
+
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+
+		for _, name := range []string{"newer", "older"} {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte("old"), 0o644))
+			require.NoError(t, os.Chtimes(path, now.Add(-time.Hour), now.Add(-time.Hour)))
+		}
+
+		return dir
+	}
+
+	readAll := func(t *testing.T, dir string) map[string]string {
+		contents := map[string]string{}
+		for name := range src {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			contents[name] = string(data)
+		}
+		return contents
+	}
+
+	t.Run("Never", func(t *testing.T) {
+		_, err := copyfs.CopyFSWithOptions(setup(t), src, nil)
+		require.ErrorIs(t, err, fs.ErrExist)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		dir := setup(t)
+
+		var conflicts []copyfs.Conflict
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Overwrite: copyfs.OverwriteSkip,
+			Conflict: func(c copyfs.Conflict) {
+				conflicts = append(conflicts, c)
+			},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 1, stats.Files)
+		require.Equal(t, 2, stats.Skipped)
+		require.Len(t, conflicts, 2)
+		for _, c := range conflicts {
+			require.False(t, c.Overwritten)
+		}
+
+		require.Equal(t, map[string]string{"newer": "old", "older": "old", "fresh": "new"}, readAll(t, dir))
+	})
+
+	t.Run("Always", func(t *testing.T) {
+		dir := setup(t)
+
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Overwrite: copyfs.OverwriteAlways,
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 3, stats.Files)
+		require.Zero(t, stats.Skipped)
+
+		require.Equal(t, map[string]string{"newer": "new", "older": "new", "fresh": "new"}, readAll(t, dir))
+	})
+
+	t.Run("IfNewer", func(t *testing.T) {
+		dir := setup(t)
+
+		conflicts := map[string]bool{}
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Overwrite: copyfs.OverwriteIfNewer,
+			Conflict: func(c copyfs.Conflict) {
+				conflicts[c.Path] = c.Overwritten
+			},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 2, stats.Files)
+		require.Equal(t, 1, stats.Skipped)
+		require.Equal(t, map[string]bool{"newer": true, "older": false}, conflicts)
+
+		require.Equal(t, map[string]string{"newer": "new", "older": "old", "fresh": "new"}, readAll(t, dir))
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "fresh"), 0o755))
+
+		_, err := copyfs.CopyFSWithOptions(dir, fstest.MapFS{"fresh": src["fresh"]}, &copyfs.Options{
+			Overwrite: copyfs.OverwriteAlways,
+		})
+		require.ErrorIs(t, err, fs.ErrExist)
+	})
+}
+
+func TestCopyFSConcurrency(t *testing.T) {
+	src := memfs.New()
+
+	for i := 0; i < 10; i++ {
+		dir := fmt.Sprintf("dir%d", i)
+		require.NoError(t, src.MkdirAll(dir, 0o755))
+
+		for j := 0; j < 20; j++ {
+			name := fmt.Sprintf("%s/file%d", dir, j)
+			require.NoError(t, src.WriteFile(name, []byte(name), 0o644))
+		}
+	}
+	require.NoError(t, src.Link("dir0/file0", "dir9/link"))
+
+	dir := t.TempDir()
+
+	var updates int
+	stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		Concurrency:       4,
+		PreserveHardLinks: true,
+		PreserveTimes:     true,
+		Progress: func(p copyfs.Progress) {
+			updates++
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 200, stats.Files)
+	require.Equal(t, 11, stats.Dirs)
+	require.Equal(t, 1, stats.HardLinks)
+	require.NotZero(t, updates)
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 20; j++ {
+			name := fmt.Sprintf("dir%d/file%d", i, j)
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			require.Equal(t, name, string(data))
+		}
+	}
+
+	target, err := os.Stat(filepath.Join(dir, "dir0/file0"))
+	require.NoError(t, err)
+
+	link, err := os.Stat(filepath.Join(dir, "dir9/link"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(target, link))
+
+	t.Run("Error", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), nil, 0o644))
+
+		src := fstest.MapFS{"existing": {Data: []byte("new")}}
+		for i := 0; i < 50; i++ {
+			src[fmt.Sprintf("file%d", i)] = &fstest.MapFile{Data: []byte("data")}
+		}
+
+		_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{Concurrency: 4})
+		require.ErrorIs(t, err, fs.ErrExist)
+	})
+}
+
+func TestCopyFSSparse(t *testing.T) {
+	var data []byte
+	data = append(data, []byte("header")...)
+	data = append(data, make([]byte, 1<<20)...)
+	data = append(data, []byte("middle")...)
+	data = append(data, make([]byte, 1<<20+123)...)
+
+	src := fstest.MapFS{
+		"sparse": {Data: data, Mode: 0o644},
+		"zeros":  {Data: make([]byte, 10000), Mode: 0o644},
+		"empty":  {Mode: 0o644},
+	}
+
+	dir := t.TempDir()
+	stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		Sparse:   true,
+		Progress: func(p copyfs.Progress) {},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)+10000), stats.Bytes)
+
+	for name, f := range src {
+		copied, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(f.Data, copied), name)
+	}
+}
+
+func TestCopyFSReflink(t *testing.T) {
+	srcDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "file"), bytes.Repeat([]byte("data"), 10000), 0o644))
+
+	dir := t.TempDir()
+	stats, err := copyfs.CopyFSWithOptions(dir, os.DirFS(srcDir), &copyfs.Options{
+		Reflink: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Files)
+	require.Equal(t, int64(40000), stats.Bytes)
+
+	data, err := os.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("data"), 10000), data)
+}
+
+func TestCopyFSDryRun(t *testing.T) {
+	src := memfs.New()
+
+	require.NoError(t, src.MkdirAll("data", 0o755))
+	require.NoError(t, src.WriteFile("data/file", []byte("hello"), 0o644))
+	require.NoError(t, src.WriteFile("existing", []byte("new"), 0o644))
+	require.NoError(t, src.Link("data/file", "data/hardlink"))
+	require.NoError(t, src.Symlink("data/file", "symlink"))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), []byte("old"), 0o644))
+
+	var conflicts []copyfs.Conflict
+	stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		DryRun:            true,
+		PreserveHardLinks: true,
+		Overwrite:         copyfs.OverwriteAlways,
+		Conflict: func(c copyfs.Conflict) {
+			conflicts = append(conflicts, c)
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []copyfs.Operation{
+		{Type: copyfs.OpMkdir, Path: ".", NewPath: dir},
+		{Type: copyfs.OpMkdir, Path: "data", NewPath: filepath.Join(dir, "data")},
+		{Type: copyfs.OpWriteFile, Path: "data/file", NewPath: filepath.Join(dir, "data/file"), Size: 5},
+		{Type: copyfs.OpWriteFile, Path: "existing", NewPath: filepath.Join(dir, "existing"), Size: 3},
+		{Type: copyfs.OpSymlink, Path: "symlink", NewPath: filepath.Join(dir, "symlink"), Link: "data/file"},
+		{Type: copyfs.OpLink, Path: "data/hardlink", NewPath: filepath.Join(dir, "data/hardlink"), Link: filepath.Join(dir, "data/file")},
+	}, stats.Operations)
+
+	require.Equal(t, 2, stats.Files)
+	require.Equal(t, 1, stats.HardLinks)
+	require.Equal(t, int64(8), stats.Bytes)
+
+	require.Len(t, conflicts, 1)
+	require.True(t, conflicts[0].Overwritten)
+
+	// Nothing was written.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	data, err := os.ReadFile(filepath.Join(dir, "existing"))
+	require.NoError(t, err)
+	require.Equal(t, "old", string(data))
+
+	t.Run("Conflict", func(t *testing.T) {
+		_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{DryRun: true})
+		require.ErrorIs(t, err, fs.ErrExist)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			DryRun:    true,
+			Overwrite: copyfs.OverwriteSkip,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Skipped)
+		require.Contains(t, stats.Operations, copyfs.Operation{Type: copyfs.OpSkip, Path: "existing", NewPath: filepath.Join(dir, "existing")})
+	})
+}
+
+func TestCopyTo(t *testing.T) {
+	src := memfs.New()
+
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/sh"))
+	require.NoError(t, src.Symlink("busybox", "usr/bin/ls"))
+	require.NoError(t, src.SetOwner("usr/bin/busybox", 1000, 1000))
+	require.NoError(t, src.SetXattr("usr/bin/busybox", "user.comment", "hello"))
+
+	dst := memfs.New()
+	require.NoError(t, copyfs.CopyTo(dst, src))
+
+	data, err := fs.ReadFile(dst, "usr/bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", string(data))
+
+	target, err := dst.ReadLink("usr/bin/ls")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", target)
+
+	fi, err := fs.Stat(dst, "usr/bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+
+	sys := fi.Sys().(*memfs.FileInfoSys)
+	require.Equal(t, 1000, sys.Uid)
+	require.Equal(t, 1000, sys.Gid)
+	require.Equal(t, 2, sys.Nlink)
+	require.Equal(t, map[string]string{"user.comment": "hello"}, sys.Xattrs)
+
+	t.Run("MapFS", func(t *testing.T) {
+		dst := memfs.New()
+		require.NoError(t, copyfs.CopyTo(dst, fstest.MapFS{
+			"dir/file": {Data: []byte("hello"), Mode: 0o600},
+		}))
+
+		data, err := fs.ReadFile(dst, "dir/file")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+}
+
+func TestCopyFSResume(t *testing.T) {
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	src := fstest.MapFS{
+		"complete": {Data: []byte("complete"), Mode: 0o644, ModTime: modTime},
+		"partial":  {Data: []byte("partial"), Mode: 0o644, ModTime: modTime},
+		"modified": {Data: []byte("modified"), Mode: 0o644, ModTime: modTime},
+		"missing":  {Data: []byte("missing"), Mode: 0o644, ModTime: modTime},
+	}
+
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+
+		for name, data := range map[string]string{
+			"complete": "complete",
+			"partial":  "par",
+			"modified": "MODIFIED",
+		} {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+			require.NoError(t, os.Chtimes(path, modTime, modTime))
+		}
+
+		return dir
+	}
+
+	check := func(t *testing.T, dir string) {
+		for name, f := range src {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			require.Equal(t, string(f.Data), string(data), name)
+		}
+	}
+
+	t.Run("SizeAndTime", func(t *testing.T) {
+		dir := setup(t)
+
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Resume:        copyfs.ResumeSizeAndTime,
+			Overwrite:     copyfs.OverwriteAlways,
+			PreserveTimes: true,
+		})
+		require.NoError(t, err)
+
+		// The modified file has the same size and time, so isn't detected.
+		require.Equal(t, 2, stats.Reused)
+		require.Equal(t, int64(16), stats.ReusedBytes)
+		require.Equal(t, 2, stats.Files)
+
+		data, err := os.ReadFile(filepath.Join(dir, "modified"))
+		require.NoError(t, err)
+		require.Equal(t, "MODIFIED", string(data))
+	})
+
+	t.Run("Contents", func(t *testing.T) {
+		dir := setup(t)
+
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Resume:    copyfs.ResumeContents,
+			Overwrite: copyfs.OverwriteAlways,
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 1, stats.Reused)
+		require.Equal(t, int64(8), stats.ReusedBytes)
+		require.Equal(t, 3, stats.Files)
+
+		check(t, dir)
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		src := memfs.New()
+		require.NoError(t, src.Symlink("target", "link"))
+
+		dir := t.TempDir()
+		require.NoError(t, os.Symlink("target", filepath.Join(dir, "link")))
+
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Resume: copyfs.ResumeContents,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Reused)
+		require.Zero(t, stats.ReusedBytes)
+	})
+}
+
+func TestCopyFSSpecialFiles(t *testing.T) {
+	src := fstest.MapFS{
+		"file": {Data: []byte("data"), Mode: 0o644},
+		"fifo": {Mode: fs.ModeNamedPipe | 0o644},
+		"sock": {Mode: fs.ModeSocket | 0o755},
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := copyfs.CopyFSWithOptions(t.TempDir(), src, nil)
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		dir := t.TempDir()
+
+		stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			SpecialFiles: copyfs.SpecialFilesSkip,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Files)
+		require.Equal(t, 2, stats.Skipped)
+
+		_, err = os.Lstat(filepath.Join(dir, "fifo"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestCopyFSAtomic(t *testing.T) {
+	src := fstest.MapFS{
+		"dir/file": {Data: []byte("hello"), Mode: 0o600},
+	}
+
+	dir := t.TempDir()
+	stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		Atomic:       true,
+		PreserveMode: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Files)
+
+	data, err := os.ReadFile(filepath.Join(dir, "dir/file"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	entries, err := os.ReadDir(filepath.Join(dir, "dir"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	t.Run("Failure", func(t *testing.T) {
+		dir := t.TempDir()
+
+		_, err := copyfs.CopyFSWithOptions(dir, &failingFS{MapFS: src}, &copyfs.Options{
+			Atomic: true,
+		})
+		require.ErrorIs(t, err, errReadFailed)
+
+		// No partial files are left behind.
+		entries, err := os.ReadDir(filepath.Join(dir, "dir"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+}
+
+var errReadFailed = errors.New("read failed")
+
+// failingFS is a filesystem whose files fail partway through being read.
+type failingFS struct {
+	fstest.MapFS
+}
+
+func (fsys *failingFS) Open(name string) (fs.File, error) {
+	f, err := fsys.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return f, nil
+	}
+
+	return &failingFile{File: f}, nil
+}
+
+type failingFile struct {
+	fs.File
+	read bool
+}
+
+func (f *failingFile) Read(p []byte) (int, error) {
+	if f.read {
+		return 0, errReadFailed
+	}
+	f.read = true
+
+	return f.File.Read(p[:1])
+}
+
+func TestCopyFSSymlinkPolicy(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.Symlink("/bin/busybox", "usr/bin/sh"))
+	require.NoError(t, src.Symlink("/", "root"))
+	require.NoError(t, src.Symlink("/etc/passwd", "passwd"))
+	require.NoError(t, src.Symlink("../lib", "usr/lib"))
+
+	readLinks := func(t *testing.T, dir string) map[string]string {
+		targets := map[string]string{}
+		for _, name := range []string{"usr/bin/sh", "root", "passwd", "usr/lib"} {
+			target, err := os.Readlink(filepath.Join(dir, name))
+			require.NoError(t, err)
+			targets[name] = target
+		}
+		return targets
+	}
+
+	t.Run("Untouched", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, copyfs.CopyFS(dir, src))
+
+		require.Equal(t, map[string]string{
+			"usr/bin/sh": "/bin/busybox",
+			"root":       "/",
+			"passwd":     "/etc/passwd",
+			"usr/lib":    "../lib",
+		}, readLinks(t, dir))
+	})
+
+	t.Run("Relative", func(t *testing.T) {
+		dir := t.TempDir()
+		_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+			Symlinks: copyfs.SymlinksRelative,
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]string{
+			"usr/bin/sh": "../../bin/busybox",
+			"root":       ".",
+			"passwd":     "etc/passwd",
+			"usr/lib":    "../lib",
+		}, readLinks(t, dir))
+	})
+
+	t.Run("FailAbsolute", func(t *testing.T) {
+		_, err := copyfs.CopyFSWithOptions(t.TempDir(), src, &copyfs.Options{
+			Symlinks: copyfs.SymlinksFailAbsolute,
+		})
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		stats, err := copyfs.CopyFSWithOptions(t.TempDir(), src, &copyfs.Options{
+			Symlinks: copyfs.SymlinksSkip,
+		})
+		require.NoError(t, err)
+
+		require.Zero(t, stats.Symlinks)
+		require.Equal(t, 4, stats.Skipped)
+	})
+}
+
+func TestCopyFSRateLimit(t *testing.T) {
+	src := fstest.MapFS{}
+	for i := 0; i < 4; i++ {
+		src[fmt.Sprintf("file%d", i)] = &fstest.MapFile{Data: bytes.Repeat([]byte{byte(i)}, 64*1024), Mode: 0o644}
+	}
+
+	dir := t.TempDir()
+	stats, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{
+		RateLimit:   1 << 20,
+		Concurrency: 2,
+	})
+	require.NoError(t, err)
+
+	// 256KiB at 1MiB/s should take about 250ms.
+	require.Equal(t, int64(256*1024), stats.Bytes)
+	require.GreaterOrEqual(t, stats.Duration, 200*time.Millisecond)
+
+	for name, f := range src {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, f.Data, data)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/copyfs"
+	"github.com/stretchr/testify/require"
+)
+
+type attributesSys uint32
+
+func (a attributesSys) FileAttributes() uint32 {
+	return uint32(a)
+}
+
+func TestCopyFSLongPaths(t *testing.T) {
+	name := strings.Repeat("a", 100)
+	path := strings.Join([]string{name, name, name, "file"}, "/")
+
+	src := fstest.MapFS{
+		path: {Data: []byte("hello"), Mode: 0o644},
+	}
+
+	dir := t.TempDir()
+	_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{LongPaths: true})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(`\\?\` + filepath.Join(dir, filepath.FromSlash(path)))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+}
+
+func TestCopyFSAttributes(t *testing.T) {
+	src := fstest.MapFS{
+		"hidden":   {Data: []byte("hidden"), Mode: 0o644, Sys: attributesSys(archivefs.FileAttributeHidden)},
+		"readonly": {Data: []byte("readonly"), Mode: 0o644, Sys: attributesSys(archivefs.FileAttributeReadOnly)},
+	}
+
+	dir := t.TempDir()
+	_, err := copyfs.CopyFSWithOptions(dir, src, &copyfs.Options{PreserveAttributes: true})
+	require.NoError(t, err)
+
+	getAttributes := func(name string) uint32 {
+		pathPtr, err := syscall.UTF16PtrFromString(filepath.Join(dir, name))
+		require.NoError(t, err)
+
+		attrs, err := syscall.GetFileAttributes(pathPtr)
+		require.NoError(t, err)
+
+		return attrs
+	}
+
+	require.NotZero(t, getAttributes("hidden")&syscall.FILE_ATTRIBUTE_HIDDEN)
+	require.NotZero(t, getAttributes("readonly")&syscall.FILE_ATTRIBUTE_READONLY)
+
+	// Allow the temporary directory to be cleaned up.
+	require.NoError(t, os.Chmod(filepath.Join(dir, "readonly"), 0o644))
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// WritableFS is a filesystem that can be copied into, such as memfs.FS.
+type WritableFS interface {
+	// MkdirAll creates a directory named path, along with any necessary
+	// parents. If path is already a directory, MkdirAll does nothing.
+	MkdirAll(path string, perm fs.FileMode) error
+	// WriteFile writes data to the named file, creating it if necessary.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(oldname, newname string) error
+}
+
+// The following interfaces are optionally implemented by a WritableFS to
+// preserve additional metadata.
+type (
+	linkFS interface {
+		Link(oldname, newname string) error
+	}
+
+	ownerFS interface {
+		SetOwner(name string, uid, gid int) error
+	}
+
+	xattrFS interface {
+		SetXattr(name, attr, value string) error
+	}
+)
+
+// CopyTo copies the filesystem src into dst. Paths are passed to dst as
+// slash separated, unrooted paths (as accepted by fs.ValidPath).
+//
+// Directories and files are created with the permission bits of the
+// source, and symbolic links are recreated provided src implements
+// archivefs.ReadLinkFS. If dst supports them (with Link, SetOwner, and
+// SetXattr methods), hard links, ownership, and extended attributes are
+// also preserved.
+//
+// The contents of each file are read into memory before being written.
+// Whether existing files are replaced is determined by dst.
+func CopyTo(dst WritableFS, src fs.FS) error {
+	links := map[uint64]string{}
+
+	return fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			if err := dst.MkdirAll(path, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			linkFS, ok := src.(archivefs.ReadLinkFS)
+			if !ok {
+				return &fs.PathError{Op: "CopyTo", Path: path, Err: errors.New("source filesystem does not support symlinks")}
+			}
+
+			target, err := linkFS.ReadLink(path)
+			if err != nil {
+				return err
+			}
+
+			// Ownership and extended attributes are not set on symbolic
+			// links, as the optional setters follow them.
+			return dst.Symlink(target, path)
+		case 0:
+			if linker, ok := dst.(linkFS); ok {
+				if id, nlink, ok := getFileID(src, path, fi); ok && nlink > 1 {
+					if target, ok := links[id]; ok {
+						return linker.Link(target, path)
+					}
+					links[id] = path
+				}
+			}
+
+			data, err := fs.ReadFile(src, path)
+			if err != nil {
+				return err
+			}
+
+			if err := dst.WriteFile(path, data, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return &fs.PathError{Op: "CopyTo", Path: path, Err: fs.ErrInvalid}
+		}
+
+		return setMetadataTo(dst, path, fi)
+	})
+}
+
+// setMetadataTo sets the ownership and extended attributes of an entry
+// copied into dst, where supported.
+func setMetadataTo(dst WritableFS, path string, fi fs.FileInfo) error {
+	if ownerFS, ok := dst.(ownerFS); ok {
+		if uid, gid, ok := archivefs.LookupOwner(fi); ok {
+			if err := ownerFS.SetOwner(path, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if xattrFS, ok := dst.(xattrFS); ok {
+		for attr, value := range archivefs.Xattrs(fi) {
+			if err := xattrFS.SetXattr(path, attr, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
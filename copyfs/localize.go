@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var errInvalidPath = archiveerrors.Define(archiveerrors.ErrInsecurePath, "invalid path")
+
+// localize converts a slash-separated path into an operating system path.
+// It fails if the path is not valid or cannot be represented safely on the
+// current operating system (eg. it contains a backslash or drive letter on
+// Windows).
+func localize(path string) (string, error) {
+	if !fs.ValidPath(path) || strings.ContainsRune(path, 0) {
+		return "", &fs.PathError{Op: "localize", Path: path, Err: errInvalidPath}
+	}
+
+	if runtime.GOOS == "windows" {
+		// Backslashes would be interpreted as separators.
+		if strings.ContainsRune(path, '\\') {
+			return "", &fs.PathError{Op: "localize", Path: path, Err: errInvalidPath}
+		}
+
+		if _, err := archivefs.SanitizePath(path, &archivefs.SanitizeOptions{RejectReservedNames: true}); err != nil {
+			return "", &fs.PathError{Op: "localize", Path: path, Err: errInvalidPath}
+		}
+	}
+
+	return filepath.FromSlash(path), nil
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+// longPath returns path unchanged, only Windows has a path length limit
+// that needs to be worked around.
+func longPath(path string) (string, error) {
+	return path, nil
+}
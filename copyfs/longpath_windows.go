@@ -0,0 +1,35 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath converts a directory path to an absolute, \\?\ prefixed path,
+// which is not subject to the MAX_PATH (260 character) limit.
+func longPath(path string) (string, error) {
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path, nil
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(path, `\\`) {
+		// UNC paths (\\server\share) are prefixed with \\?\UNC\.
+		return `\\?\UNC\` + path[2:], nil
+	}
+
+	return `\\?\` + path, nil
+}
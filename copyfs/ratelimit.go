@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitChunkSize is the maximum number of bytes written at once by a
+// rate limited writer, so that throughput is smoothed.
+const rateLimitChunkSize = 32 * 1024
+
+// tokenBucket limits the rate at which bytes are copied. It is shared by all
+// workers, so the limit applies to the copy as a whole.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate: float64(rate),
+		last: time.Now(),
+	}
+}
+
+// wait takes n tokens from the bucket, blocking until they would have been
+// available. Tokens accumulate for at most one second while idle.
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	// Taking the tokens up front (going into debt if necessary) ensures
+	// concurrent writers are served in order.
+	b.tokens -= float64(n)
+
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+
+	b.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// rateLimitedWriter limits the rate at which bytes are written.
+type rateLimitedWriter struct {
+	w      io.Writer
+	bucket *tokenBucket
+}
+
+func (rw *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), rateLimitChunkSize)]
+		rw.bucket.wait(len(chunk))
+
+		n, err := rw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, from linux/fs.h.
+const ficlone = 0x40049409
+
+// reflink clones the contents of src into dst, sharing the underlying
+// extents. This is only supported by some filesystems (eg. btrfs, xfs).
+func reflink(dst, src *os.File) error {
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ctrlErr error
+	var errno syscall.Errno
+	err = dstConn.Control(func(dstFd uintptr) {
+		ctrlErr = srcConn.Control(func(srcFd uintptr) {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dstFd, ficlone, srcFd)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
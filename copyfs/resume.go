@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// ResumeMode determines how existing entries at the destination are
+// checked to see if they can be reused, rather than copied again.
+type ResumeMode int
+
+const (
+	// ResumeNone never reuses existing entries.
+	ResumeNone ResumeMode = iota
+	// ResumeSizeAndTime reuses existing files with the same size and
+	// modification time as the source. This is only effective if the
+	// destination was populated with PreserveTimes.
+	ResumeSizeAndTime
+	// ResumeContents reuses existing files with the same contents as the
+	// source.
+	ResumeContents
+)
+
+// reusable reports whether an existing entry at the destination matches
+// the source, and so doesn't need to be copied again. Regular files are
+// compared according to the resume mode, and symbolic links by target.
+func (c *copier) reusable(path, newPath string, fi, existing fs.FileInfo) (bool, error) {
+	if c.opts.Resume == ResumeNone || fi.Mode().Type() != existing.Mode().Type() {
+		return false, nil
+	}
+
+	switch fi.Mode().Type() {
+	case fs.ModeSymlink:
+		linkFS, ok := c.fsys.(archivefs.ReadLinkFS)
+		if !ok {
+			return false, nil
+		}
+
+		target, err := linkFS.ReadLink(path)
+		if err != nil {
+			return false, err
+		}
+
+		target, err = c.rewriteTarget(path, target)
+		if err != nil {
+			return false, err
+		}
+
+		existingTarget, err := os.Readlink(newPath)
+		if err != nil {
+			return false, err
+		}
+
+		return target == existingTarget, nil
+	case 0:
+		if fi.Size() != existing.Size() {
+			return false, nil
+		}
+
+		switch c.opts.Resume {
+		case ResumeSizeAndTime:
+			return fi.ModTime().Equal(existing.ModTime()), nil
+		case ResumeContents:
+			return c.sameContents(path, newPath)
+		}
+	}
+
+	return false, nil
+}
+
+// sameContents reports whether a source file has the same contents as a
+// file at the destination.
+func (c *copier) sameContents(path, newPath string) (bool, error) {
+	r, err := c.fsys.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	f, err := os.Open(newPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return equalReaders(r, f)
+}
+
+func equalReaders(a, b io.Reader) (bool, error) {
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, len(bufA))
+
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		if errA != nil && !errors.Is(errA, io.ErrUnexpectedEOF) && !errors.Is(errA, io.EOF) {
+			return false, errA
+		}
+
+		m, errB := io.ReadFull(b, bufB)
+		if errB != nil && !errors.Is(errB, io.ErrUnexpectedEOF) && !errors.Is(errB, io.EOF) {
+			return false, errB
+		}
+
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+
+		if errA != nil || errB != nil {
+			return errA != nil && errB != nil, nil
+		}
+	}
+}
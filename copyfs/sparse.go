@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// sparseBlockSize is the granularity at which runs of zeros are detected.
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// sparseWriter writes to a file, seeking over holes rather than writing them
+// so that they are recreated at the destination.
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+	// extents, if set, are the extents of the source file that contain data,
+	// the holes between them are skipped.
+	extents []archivefs.Extent
+	// detectZeros skips blocks of zeros within the data.
+	detectZeros bool
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	if w.extents == nil {
+		return w.writeData(p)
+	}
+
+	var n int
+	for n < len(p) {
+		end := w.offset + int64(len(p)-n)
+
+		// Skip the hole (if any) at the current offset.
+		if data := archivefs.SeekData(w.extents, w.offset); data != w.offset {
+			if data < 0 {
+				data = end
+			}
+
+			skipped := int(min(data, end) - w.offset)
+			n += skipped
+			w.offset += int64(skipped)
+			continue
+		}
+
+		hole := archivefs.SeekHole(w.extents, w.offset, end)
+		written, err := w.writeData(p[n : n+int(hole-w.offset)])
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// writeData writes data at the current offset, skipping over blocks of zeros
+// if enabled.
+func (w *sparseWriter) writeData(p []byte) (int, error) {
+	if !w.detectZeros {
+		written, err := w.f.WriteAt(p, w.offset)
+		w.offset += int64(written)
+		return written, err
+	}
+
+	var n int
+	for n < len(p) {
+		// Align blocks with the file offset, so that holes are block aligned.
+		blockLen := min(len(p)-n, sparseBlockSize-int(w.offset%sparseBlockSize))
+		if bytes.Equal(p[n:n+blockLen], zeroBlock[:blockLen]) {
+			n += blockLen
+			w.offset += int64(blockLen)
+			continue
+		}
+
+		// Coalesce consecutive non-zero blocks into a single write.
+		end := n + blockLen
+		for end < len(p) {
+			next := min(len(p)-end, sparseBlockSize)
+			if bytes.Equal(p[end:end+next], zeroBlock[:next]) {
+				break
+			}
+			end += next
+		}
+
+		written, err := w.f.WriteAt(p[n:end], w.offset)
+		n += written
+		w.offset += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close extends the file to its full size, in case it ends with a hole, and
+// closes it.
+func (w *sparseWriter) Close() error {
+	if err := w.f.Truncate(w.offset); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
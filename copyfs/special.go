@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// SpecialFilePolicy determines how device nodes, named pipes, and sockets
+// are handled.
+type SpecialFilePolicy int
+
+const (
+	// SpecialFilesError fails the copy with an error satisfying
+	// errors.Is(err, fs.ErrInvalid).
+	SpecialFilesError SpecialFilePolicy = iota
+	// SpecialFilesSkip skips special files.
+	SpecialFilesSkip
+	// SpecialFilesCreate recreates device nodes and named pipes at the
+	// destination. Special files that cannot be created due to insufficient
+	// privileges (creating device nodes typically requires root), or that
+	// aren't supported on the current platform, are skipped. Sockets are
+	// always skipped.
+	SpecialFilesCreate
+)
+
+func (c *copier) copySpecial(path, newPath string, fi fs.FileInfo) error {
+	switch c.opts.SpecialFiles {
+	case SpecialFilesSkip:
+		return c.skipSpecial(path)
+	case SpecialFilesCreate:
+	default:
+		return &os.PathError{Op: "CopyFS", Path: path, Err: os.ErrInvalid}
+	}
+
+	mode := fi.Mode()
+	if mode&(fs.ModeDevice|fs.ModeNamedPipe) == 0 {
+		return c.skipSpecial(path)
+	}
+
+	var major, minor uint32
+	if mode&fs.ModeDevice != 0 {
+		var ok bool
+		major, minor, ok = archivefs.LookupDevice(fi)
+		if !ok {
+			return &os.PathError{Op: "CopyFS", Path: path, Err: errors.New("unknown device numbers")}
+		}
+	}
+
+	if c.opts.DryRun {
+		c.plan(Operation{Type: OpMknod, Path: path, NewPath: newPath})
+	} else {
+		if err := mknod(newPath, mode, major, minor); err != nil {
+			if errors.Is(err, fs.ErrPermission) || errors.Is(err, errors.ErrUnsupported) {
+				return c.skipSpecial(path)
+			}
+			return &os.PathError{Op: "mknod", Path: newPath, Err: err}
+		}
+
+		if err := c.applyMetadata(newPath, fi); err != nil {
+			return err
+		}
+	}
+
+	c.update(func(s *Stats) { s.Special++ })
+	c.progress(Progress{Path: path})
+
+	return nil
+}
+
+func (c *copier) skipSpecial(path string) error {
+	c.update(func(s *Stats) { s.Skipped++ })
+	c.progress(Progress{Path: path})
+
+	return nil
+}
@@ -0,0 +1,39 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// mknod creates a device node or named pipe.
+func mknod(path string, mode fs.FileMode, major, minor uint32) error {
+	var typ uint32
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		typ = syscall.S_IFIFO
+	case mode&fs.ModeCharDevice != 0:
+		typ = syscall.S_IFCHR
+	case mode&fs.ModeDevice != 0:
+		typ = syscall.S_IFBLK
+	default:
+		return errors.ErrUnsupported
+	}
+
+	return syscall.Mknod(path, typ|uint32(mode.Perm()), int(mkdev(major, minor)))
+}
+
+// mkdev encodes device numbers as glibc's makedev does.
+func mkdev(major, minor uint32) uint64 {
+	return (uint64(major)&0xfffff000)<<32 | (uint64(major)&0xfff)<<8 |
+		(uint64(minor)&0xffffff00)<<12 | uint64(minor)&0xff
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// mknod is not supported on this platform.
+func mknod(_ string, _ fs.FileMode, _, _ uint32) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// SymlinkPolicy determines how symbolic links are copied, and how their
+// targets are rewritten. See archivefs.SymlinkPolicy.
+type SymlinkPolicy = archivefs.SymlinkPolicy
+
+const (
+	// SymlinksUntouched copies targets verbatim, so that they may refer to
+	// paths on the host (eg. /etc/passwd).
+	SymlinksUntouched = archivefs.SymlinksUntouched
+	// SymlinksRelative rewrites absolute targets to be relative to the
+	// destination directory, eg. a link at usr/bin/sh to /bin/busybox
+	// becomes ../../bin/busybox. Relative targets that would leave the
+	// destination directory fail as for SymlinksFailEscaping.
+	SymlinksRelative = archivefs.SymlinksRelative
+	// SymlinksFailEscaping fails the copy if a link has an absolute target, or
+	// a relative target that would leave the destination directory.
+	SymlinksFailEscaping = archivefs.SymlinksFailEscaping
+	// SymlinksSkip doesn't copy symbolic links, they are counted as skipped.
+	SymlinksSkip = archivefs.SymlinksSkip
+	// SymlinksFailAbsolute fails the copy with an error satisfying
+	// errors.Is(err, fs.ErrInvalid) (and errors.ErrInsecurePath) if a link has
+	// an absolute target.
+	SymlinksFailAbsolute = archivefs.SymlinksFailAbsolute
+)
+
+// rewriteTarget applies the symlink policy to the target of the link at
+// path.
+func (c *copier) rewriteTarget(path, target string) (string, error) {
+	target, err := c.opts.Symlinks.Target(c.fsys, path, target)
+	if err != nil {
+		return "", &os.PathError{Op: "CopyFS", Path: path, Err: fmt.Errorf("%w: %w", err, fs.ErrInvalid)}
+	}
+
+	return target, nil
+}
@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package copyfs
+
+// DefaultSkipXattrs is the list of extended attribute prefixes that are not
+// copied by default. Attributes in the trusted namespace are only meaningful
+// to privileged processes on the originating system.
+var DefaultSkipXattrs = []string{"trusted."}
@@ -0,0 +1,616 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package cpiofs provides access to SVR4 cpio archives ("newc" archives, and
+// those with checksums), the format of Linux initramfs images.
+package cpiofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/readdir"
+)
+
+var (
+	_ fs.FS                = (*FS)(nil)
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ archivefs.LinkFS     = (*FS)(nil)
+	_ fs.ReadDirFile       = (*dir)(nil)
+	_ io.ReadSeeker        = (*file)(nil)
+	_ io.ReaderAt          = (*file)(nil)
+	_ archivefs.Owner      = (*Entry)(nil)
+	_ archivefs.Device     = (*Entry)(nil)
+)
+
+var (
+	// ErrCorrupted is returned when an archive is truncated or malformed,
+	// within an *archiveerrors.ErrCorrupted giving the offset of the
+	// malformed entry.
+	ErrCorrupted = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "corrupted archive")
+	// ErrChecksumMismatch is returned when the data of an entry doesn't
+	// match the checksum in its header.
+	ErrChecksumMismatch = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "checksum mismatch")
+)
+
+// FS is a filesystem that represents a cpio archive.
+type FS struct {
+	root *Entry
+	// size is the size of the archive, up to the end of its trailer.
+	size int64
+}
+
+// Options configures how an archive is opened.
+type Options struct {
+	// Strict enables the most defensive behavior, for archives from untrusted
+	// sources: archives containing entries with ".." components in their
+	// names, more than one entry with the same name, or data for entries
+	// that can't have any, are rejected as corrupted.
+	Strict bool
+}
+
+// Open opens a cpio archive from the given io.ReaderAt.
+func Open(ra io.ReaderAt) (*FS, error) {
+	return OpenWithOptions(ra, nil)
+}
+
+// OpenWithOptions opens a cpio archive with the given options. Entries are
+// read up to the trailer of the archive, any data following it (eg. another
+// archive, see FS.Size) is ignored.
+//
+// As when an archive is extracted, later entries replace earlier entries
+// with the same name, and regular files with more than one link that share
+// an inode number (and device) are hard links to the same file. Their data
+// is stored with one of the links, usually the last.
+func OpenWithOptions(ra io.ReaderAt, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	fsys := &FS{root: newRoot()}
+
+	seen := map[string]bool{}
+	links := map[linkKey]*contents{}
+
+	var offset int64
+	for {
+		h, name, err := readHeader(io.NewSectionReader(ra, offset, math.MaxInt64-offset), offset)
+		if err != nil {
+			return nil, err
+		}
+
+		dataOffset := align4(offset + HeaderSize + int64(h.NameSize))
+		end := align4(dataOffset + int64(h.FileSize))
+
+		if name == TrailerName {
+			fsys.size = end
+			break
+		}
+
+		if h.FileSize > 0 {
+			// Make sure the entry data is actually present.
+			if _, err := ra.ReadAt(make([]byte, 1), dataOffset+int64(h.FileSize)-1); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, corrupted(offset, errors.New("truncated entry data"))
+				}
+
+				return nil, err
+			}
+		}
+
+		if h.Magic == MagicCRC {
+			data := &entryReader{r: io.NewSectionReader(ra, dataOffset, int64(h.FileSize)), remaining: int64(h.FileSize), check: &h.Check, offset: offset, name: name}
+			if _, err := io.Copy(io.Discard, data); err != nil {
+				return nil, err
+			}
+		}
+
+		e := &Entry{
+			Header:   *h,
+			name:     archivefs.CleanPath(name),
+			contents: &contents{ra: ra, offset: dataOffset, size: int64(h.FileSize)},
+		}
+
+		if opts.Strict {
+			if _, err := archivefs.SanitizePath(name, &archivefs.SanitizeOptions{RejectDotDot: true}); err != nil {
+				return nil, corrupted(offset, err)
+			}
+
+			if seen[e.name] {
+				return nil, corrupted(offset, fmt.Errorf("duplicate entry: %q", name))
+			}
+			seen[e.name] = true
+
+			if !e.Mode().IsRegular() && e.Mode()&fs.ModeSymlink == 0 && h.FileSize != 0 {
+				return nil, corrupted(offset, fmt.Errorf("entry %q of type %v has non-zero size %d", name, e.Mode().Type(), h.FileSize))
+			}
+		}
+
+		switch {
+		case e.Mode()&fs.ModeSymlink != 0:
+			if h.FileSize >= maxNameSize {
+				return nil, corrupted(offset, fmt.Errorf("symbolic link %q target is too long", name))
+			}
+
+			target := make([]byte, h.FileSize)
+			if _, err := ra.ReadAt(target, dataOffset); err != nil {
+				return nil, fmt.Errorf("failed to read symbolic link %q: %w", name, err)
+			}
+			e.target = string(target)
+		case e.Mode().IsRegular() && h.Nlink > 1:
+			key := linkKey{devMajor: h.DevMajor, devMinor: h.DevMinor, ino: h.Ino}
+			if c, ok := links[key]; ok {
+				if h.FileSize > 0 {
+					*c = *e.contents
+				}
+				e.contents = c
+			} else {
+				links[key] = e.contents
+			}
+		}
+
+		if e.name == "" {
+			if !e.IsDir() {
+				return nil, corrupted(offset, fmt.Errorf("root entry %q is not a directory", name))
+			}
+
+			e.children = fsys.root.children
+			fsys.root = e
+		} else if err := fsys.root.add(e); err != nil {
+			return nil, corrupted(offset, err)
+		}
+
+		offset = end
+	}
+
+	fsys.number()
+
+	return fsys, nil
+}
+
+// Size returns the size of the archive, up to the end of its trailer
+// (including padding). Initramfs images, for example, may consist of several
+// archives concatenated together.
+func (fsys *FS) Size() int64 {
+	return fsys.size
+}
+
+// Open opens the named file, following any symbolic links.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	e, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	e = e.renamed(name)
+
+	if e.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dir{Entry: e, Entries: readdir.New(entries)}, nil
+	}
+
+	return &file{Entry: e, SectionReader: e.contents.open()}, nil
+}
+
+// ReadDir reads the named directory, following any symbolic links.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(e.children))
+	for _, child := range e.children {
+		entries = append(entries, child)
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+// Stat returns a FileInfo describing the named file, following any symbolic
+// links.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return e.renamed(name), nil
+}
+
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) ReadLink(name string) (string, error) {
+	e, err := fsys.lookup(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	if e.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return e.target, nil
+}
+
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	e, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return e, nil
+}
+
+// FileID returns the id of the named entry, without following any symbolic
+// links, and the number of hard links to it within the archive. Hard links
+// share the same id. Ids are only meaningful within the filesystem.
+func (fsys *FS) FileID(name string) (id uint64, nlink int, err error) {
+	e, err := fsys.lookup(name)
+	if err != nil {
+		return 0, 0, &fs.PathError{Op: "fileid", Path: name, Err: err}
+	}
+
+	return e.id, e.contents.nlink, nil
+}
+
+// lookup returns the named entry, following symbolic links in all but the
+// final component of the name.
+func (fsys *FS) lookup(name string) (*Entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	if name == "." {
+		return fsys.root, nil
+	}
+
+	parent, err := fsys.resolve(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := parent.children[path.Base(name)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return e, nil
+}
+
+// resolve returns the named entry, following symbolic links.
+func (fsys *FS) resolve(name string) (*Entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	return fsys.resolveWithHops(name, 0)
+}
+
+func (fsys *FS) resolveWithHops(name string, hops int) (*Entry, error) {
+	e := fsys.root
+
+	// Symbolic link targets are resolved lexically, never above the root.
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return e, nil
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if !e.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+
+		var ok bool
+		e, ok = e.children[component]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		if e.Mode()&fs.ModeSymlink != 0 {
+			hops++
+			if hops > archivefs.MaxSymlinkHops {
+				return nil, fmt.Errorf("too many levels of symbolic links: %s: %w", name, fs.ErrInvalid)
+			}
+
+			// Relative targets are relative to the directory containing the
+			// link.
+			target := e.target
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(e.name), target)
+			}
+
+			var err error
+			e, err = fsys.resolveWithHops(target, hops)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// number assigns an id to every entry (the root is 1, and hard links share
+// the id of the first link), and counts the links to each.
+func (fsys *FS) number() {
+	next := uint64(1)
+	ids := map[*contents]uint64{}
+
+	var walk func(e *Entry)
+	walk = func(e *Entry) {
+		if id, ok := ids[e.contents]; ok {
+			e.id = id
+		} else {
+			e.id = next
+			ids[e.contents] = next
+			next++
+		}
+		e.contents.nlink++
+
+		names := make([]string, 0, len(e.children))
+		for name := range e.children {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		for _, name := range names {
+			walk(e.children[name])
+		}
+	}
+
+	walk(fsys.root)
+}
+
+// corrupted wraps an error describing a malformed entry with ErrCorrupted.
+func corrupted(offset int64, err error) error {
+	return &archiveerrors.ErrCorrupted{
+		Offset: offset,
+		Detail: err.Error(),
+		Err:    fmt.Errorf("%w: %w", ErrCorrupted, err),
+	}
+}
+
+// readHeader reads the header and name of the entry at offset from r.
+func readHeader(r io.Reader, offset int64) (*Header, string, error) {
+	buf := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, "", corrupted(offset, errors.New("missing trailer"))
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, "", corrupted(offset, errors.New("truncated header"))
+		}
+
+		return nil, "", err
+	}
+
+	h, err := parseHeader(buf)
+	if err != nil {
+		if errors.Is(err, archiveerrors.ErrUnsupportedFeature) {
+			return nil, "", err
+		}
+
+		return nil, "", corrupted(offset, err)
+	}
+
+	if h.NameSize == 0 || h.NameSize > maxNameSize {
+		return nil, "", corrupted(offset, fmt.Errorf("invalid name size: %d", h.NameSize))
+	}
+
+	name := make([]byte, h.NameSize)
+	if _, err := io.ReadFull(r, name); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, "", corrupted(offset, errors.New("truncated name"))
+		}
+
+		return nil, "", err
+	}
+
+	if name[len(name)-1] != 0 {
+		return nil, "", corrupted(offset, errors.New("name is not NUL terminated"))
+	}
+
+	return h, string(name[:len(name)-1]), nil
+}
+
+// linkKey identifies the file that hard links refer to.
+type linkKey struct {
+	devMajor, devMinor, ino uint32
+}
+
+// contents is the data of an entry, which is shared by hard links.
+type contents struct {
+	ra     io.ReaderAt
+	offset int64
+	size   int64
+	// nlink is the number of entries sharing the contents.
+	nlink int
+}
+
+func (c *contents) open() *io.SectionReader {
+	return io.NewSectionReader(c.ra, c.offset, c.size)
+}
+
+// Entry is a file in the archive. It implements fs.FileInfo and fs.DirEntry.
+type Entry struct {
+	// Header is the header of the entry. For hard links, the data of the
+	// file may be stored with another link (see Entry.Size).
+	Header
+	name     string
+	target   string
+	contents *contents
+	children map[string]*Entry
+	id       uint64
+}
+
+// newRoot returns a default root directory.
+func newRoot() *Entry {
+	return newDir("")
+}
+
+// newDir returns a default entry for a directory that is implied by the
+// names of other entries.
+func newDir(name string) *Entry {
+	return &Entry{
+		Header: Header{
+			Mode:  S_IFDIR | 0o755,
+			Nlink: 2,
+		},
+		name:     name,
+		contents: &contents{},
+	}
+}
+
+// add adds an entry beneath the directory, creating any missing parent
+// directories. An existing entry with the same name is replaced, keeping its
+// children if both are directories.
+func (d *Entry) add(e *Entry) error {
+	parent := d
+	dirName, base := path.Split(e.name)
+	if dirName != "" {
+		for _, component := range strings.Split(strings.TrimSuffix(dirName, "/"), "/") {
+			child, ok := parent.children[component]
+			if !ok {
+				child = newDir(path.Join(parent.name, component))
+				parent.setChild(component, child)
+			} else if !child.IsDir() {
+				return fmt.Errorf("parent %q of %q is not a directory", child.name, e.name)
+			}
+
+			parent = child
+		}
+	}
+
+	if existing, ok := parent.children[base]; ok && existing.IsDir() && e.IsDir() {
+		e.children = existing.children
+	}
+	parent.setChild(base, e)
+
+	return nil
+}
+
+func (d *Entry) setChild(name string, e *Entry) {
+	if d.children == nil {
+		d.children = map[string]*Entry{}
+	}
+
+	d.children[name] = e
+}
+
+// renamed returns the entry as found by the given name, as the entry may have
+// been reached through a symbolic link.
+func (e *Entry) renamed(name string) *Entry {
+	name = archivefs.CleanPath(name)
+	if name == "" || path.Base(name) == path.Base(e.name) {
+		return e
+	}
+
+	renamed := *e
+	renamed.name = name
+
+	return &renamed
+}
+
+func (e *Entry) Name() string {
+	if e.name == "" {
+		return "."
+	}
+
+	return path.Base(e.name)
+}
+
+// Size returns the size of the file's data, which for hard links may be
+// stored with another link.
+func (e *Entry) Size() int64 {
+	return e.contents.size
+}
+
+func (e *Entry) Mode() fs.FileMode {
+	return e.FileMode()
+}
+
+func (e *Entry) ModTime() time.Time {
+	return time.Unix(int64(e.Mtime), 0)
+}
+
+func (e *Entry) IsDir() bool {
+	return e.Mode().IsDir()
+}
+
+func (e *Entry) Sys() any {
+	return e
+}
+
+func (e *Entry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e *Entry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+// file is an open file. File data is a section of the underlying archive so
+// it supports random access.
+type file struct {
+	*Entry
+	*io.SectionReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.Entry, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// dir is an open directory.
+type dir struct {
+	*Entry
+	readdir.Entries
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.Entry, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,302 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package cpiofs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/cpiofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPIOFS(t *testing.T) {
+	entries := []entry{
+		{name: ".", mode: cpiofs.S_IFDIR | 0o700},
+		{name: "bin", mode: cpiofs.S_IFDIR | 0o755},
+		// Hard links, with the data stored in the last link.
+		{name: "bin/sh", mode: cpiofs.S_IFREG | 0o755, ino: 10, nlink: 2},
+		{name: "bin/busybox", mode: cpiofs.S_IFREG | 0o755, ino: 10, nlink: 2, data: "busybox"},
+		{name: "sbin", mode: cpiofs.S_IFLNK | 0o777, data: "bin"},
+		{name: "dev/console", mode: cpiofs.S_IFCHR | 0o600, rdevMajor: 5, rdevMinor: 1},
+		{name: "etc/motd", mode: cpiofs.S_IFREG | 0o644, uid: 1000, gid: 1000, data: "hello\n"},
+	}
+
+	archive := createArchive(cpiofs.MagicNewc, entries)
+	// Trailing data, eg. another archive.
+	archive = append(archive, make([]byte, 512)...)
+
+	fsys, err := cpiofs.Open(bytes.NewReader(archive))
+	require.NoError(t, err)
+
+	require.Equal(t, int64(len(archive)-512), fsys.Size())
+
+	require.NoError(t, archivefstest.TestFS(fsys, "bin/sh", "bin/busybox", "sbin", "dev/console", "etc/motd"))
+
+	fi, err := fsys.Stat(".")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDir|0o700, fi.Mode())
+
+	data, err := fs.ReadFile(fsys, "sbin/sh")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", string(data))
+
+	target, err := fsys.ReadLink("sbin")
+	require.NoError(t, err)
+	require.Equal(t, "bin", target)
+
+	fi, err = fsys.StatLink("sbin")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	fi, err = fsys.Stat("sbin")
+	require.NoError(t, err)
+	require.Equal(t, "sbin", fi.Name())
+	require.True(t, fi.IsDir())
+
+	shID, nlink, err := fsys.FileID("bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, 2, nlink)
+
+	busyboxID, _, err := fsys.FileID("bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, shID, busyboxID)
+
+	motdID, nlink, err := fsys.FileID("etc/motd")
+	require.NoError(t, err)
+	require.Equal(t, 1, nlink)
+	require.NotEqual(t, shID, motdID)
+
+	fi, err = fsys.Stat("dev/console")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDevice|fs.ModeCharDevice, fi.Mode().Type())
+	major, minor := fi.Sys().(archivefs.Device).Device()
+	require.Equal(t, [2]uint32{5, 1}, [2]uint32{major, minor})
+
+	fi, err = fsys.Stat("etc/motd")
+	require.NoError(t, err)
+	uid, gid := fi.Sys().(archivefs.Owner).Owner()
+	require.Equal(t, [2]int{1000, 1000}, [2]int{uid, gid})
+
+	f, err := fsys.Open("etc/motd")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	buf := make([]byte, 4)
+	_, err = f.(io.ReaderAt).ReadAt(buf, 1)
+	require.NoError(t, err)
+	require.Equal(t, "ello", string(buf))
+
+	t.Run("CRC", func(t *testing.T) {
+		archive := createArchive(cpiofs.MagicCRC, entries)
+
+		fsys, err := cpiofs.Open(bytes.NewReader(archive))
+		require.NoError(t, err)
+
+		data, err := fs.ReadFile(fsys, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "hello\n", string(data))
+
+		corrupted := bytes.Replace(archive, []byte("hello\n"), []byte("jello\n"), 1)
+
+		_, err = cpiofs.Open(bytes.NewReader(corrupted))
+		require.ErrorIs(t, err, cpiofs.ErrChecksumMismatch)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		for _, size := range []int{50, 200, len(archive) - 512 - 200} {
+			_, err := cpiofs.Open(bytes.NewReader(archive[:size]))
+			require.ErrorIs(t, err, cpiofs.ErrCorrupted, "size %d", size)
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		_, err := cpiofs.OpenWithOptions(bytes.NewReader(archive), &cpiofs.Options{Strict: true})
+		require.NoError(t, err)
+
+		for _, entries := range [][]entry{
+			{{name: "etc/motd", mode: cpiofs.S_IFREG}, {name: "etc/motd", mode: cpiofs.S_IFREG}},
+			{{name: "../etc/motd", mode: cpiofs.S_IFREG}},
+			{{name: "etc", mode: cpiofs.S_IFDIR, data: "data"}},
+		} {
+			archive := createArchive(cpiofs.MagicNewc, entries)
+
+			_, err := cpiofs.Open(bytes.NewReader(archive))
+			require.NoError(t, err)
+
+			_, err = cpiofs.OpenWithOptions(bytes.NewReader(archive), &cpiofs.Options{Strict: true})
+			require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+		}
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		archive := createArchive(cpiofs.MagicNewc, []entry{
+			{name: "etc/motd", mode: cpiofs.S_IFREG | 0o644, data: "hello\n"},
+			{name: "etc", mode: cpiofs.S_IFDIR | 0o700},
+			{name: "etc/motd", mode: cpiofs.S_IFREG | 0o644, data: "goodbye\n"},
+		})
+
+		fsys, err := cpiofs.Open(bytes.NewReader(archive))
+		require.NoError(t, err)
+
+		fi, err := fsys.Stat("etc")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o700, fi.Mode())
+
+		data, err := fs.ReadFile(fsys, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "goodbye\n", string(data))
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		it := cpiofs.NewIterator(bytes.NewReader(archive))
+
+		var names []string
+		contents := map[string]string{}
+		entriesByName := map[string]*archivefs.Entry{}
+		for {
+			e, r, err := it.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+
+			names = append(names, e.Name)
+			contents[e.Name] = string(data)
+			entriesByName[e.Name] = e
+		}
+
+		require.Equal(t, []string{"bin", "bin/sh", "bin/busybox", "sbin", "dev/console", "etc/motd"}, names)
+
+		require.True(t, entriesByName["bin"].Mode.IsDir())
+		require.Empty(t, entriesByName["bin/sh"].HardLink)
+		require.Equal(t, 2, entriesByName["bin/sh"].Nlink)
+		require.Equal(t, "bin/sh", entriesByName["bin/busybox"].HardLink)
+		require.Equal(t, "busybox", contents["bin/busybox"])
+		require.Equal(t, fs.ModeSymlink, entriesByName["sbin"].Mode.Type())
+		require.Equal(t, "bin", entriesByName["sbin"].Linkname)
+		require.Equal(t, 1000, entriesByName["etc/motd"].Uid)
+		require.Equal(t, "hello\n", contents["etc/motd"])
+
+		// The iterator stops at the trailer.
+		_, _, err := it.Next()
+		require.ErrorIs(t, err, io.EOF)
+
+		t.Run("Skip", func(t *testing.T) {
+			it := cpiofs.NewIterator(bytes.NewReader(archive))
+
+			var names []string
+			for {
+				e, _, err := it.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+
+				names = append(names, e.Name)
+			}
+
+			require.Len(t, names, 6)
+		})
+
+		t.Run("CRC", func(t *testing.T) {
+			archive := createArchive(cpiofs.MagicCRC, entries)
+			corrupted := bytes.Replace(archive, []byte("hello\n"), []byte("jello\n"), 1)
+
+			it := cpiofs.NewIterator(bytes.NewReader(corrupted))
+
+			var err error
+			for err == nil {
+				_, _, err = it.Next()
+			}
+			require.ErrorIs(t, err, cpiofs.ErrChecksumMismatch)
+		})
+
+		t.Run("Truncated", func(t *testing.T) {
+			for _, size := range []int{50, 200, len(archive) - 512 - 200} {
+				it := cpiofs.NewIterator(bytes.NewReader(archive[:size]))
+
+				var err error
+				for err == nil {
+					_, _, err = it.Next()
+				}
+				require.ErrorIs(t, err, cpiofs.ErrCorrupted, "size %d", size)
+			}
+		})
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		odc := append([]byte("070707"), make([]byte, cpiofs.HeaderSize)...)
+
+		_, err := cpiofs.Open(bytes.NewReader(odc))
+		require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+	})
+}
+
+type entry struct {
+	name                 string
+	mode                 uint32
+	uid, gid             uint32
+	ino, nlink           uint32
+	rdevMajor, rdevMinor uint32
+	data                 string
+}
+
+// createArchive creates a cpio archive containing the given entries.
+func createArchive(magic string, entries []entry) []byte {
+	var buf bytes.Buffer
+
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	write := func(e entry) {
+		var check uint32
+		if magic == cpiofs.MagicCRC {
+			for _, b := range []byte(e.data) {
+				check += uint32(b)
+			}
+		}
+
+		if e.nlink == 0 {
+			e.nlink = 1
+		}
+
+		fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			magic, e.ino, e.mode, e.uid, e.gid, e.nlink, 1700000000, len(e.data),
+			0, 0, e.rdevMajor, e.rdevMinor, len(e.name)+1, check)
+		buf.WriteString(e.name)
+		buf.WriteByte(0)
+		pad()
+		buf.WriteString(e.data)
+		pad()
+	}
+
+	for _, e := range entries {
+		write(e)
+	}
+	write(entry{name: cpiofs.TrailerName})
+
+	return buf.Bytes()
+}
@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package cpiofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"strconv"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+const (
+	// MagicNewc is the magic number of SVR4 "newc" archives.
+	MagicNewc = "070701"
+	// MagicCRC is the magic number of SVR4 archives with checksums.
+	MagicCRC = "070702"
+	// magicODC is the magic number of POSIX.1 portable (odc) archives.
+	magicODC = "070707"
+	// magicBinary is the magic number of old binary archives (in either byte
+	// order).
+	magicBinary = 0o070707
+)
+
+// HeaderSize is the size of the header of each entry.
+const HeaderSize = 110
+
+// TrailerName is the name of the entry that marks the end of an archive.
+const TrailerName = "TRAILER!!!"
+
+// maxNameSize is the maximum size of the name of an entry (including its
+// NUL terminator), and of the target of a symbolic link, as for Linux.
+const maxNameSize = 4096
+
+// Unix file type bits of Header.Mode.
+const (
+	S_IFMT   = 0o170000
+	S_IFSOCK = 0o140000
+	S_IFLNK  = 0o120000
+	S_IFREG  = 0o100000
+	S_IFBLK  = 0o060000
+	S_IFDIR  = 0o040000
+	S_IFCHR  = 0o020000
+	S_IFIFO  = 0o010000
+	S_ISUID  = 0o004000
+	S_ISGID  = 0o002000
+	S_ISVTX  = 0o001000
+)
+
+// Header is the header of an entry, as stored in the archive.
+type Header struct {
+	Magic     string // MagicNewc or MagicCRC
+	Ino       uint32 // Inode number
+	Mode      uint32 // Unix file type and permissions
+	Uid       uint32 // User id
+	Gid       uint32 // Group id
+	Nlink     uint32 // Number of links
+	Mtime     uint32 // Modification time, in seconds since the epoch
+	FileSize  uint32 // Size of the entry's data
+	DevMajor  uint32 // Major number of the device containing the file
+	DevMinor  uint32 // Minor number of the device containing the file
+	RDevMajor uint32 // Major number of a character or block device
+	RDevMinor uint32 // Minor number of a character or block device
+	NameSize  uint32 // Size of the name, including its NUL terminator
+	Check     uint32 // Checksum of the data (for MagicCRC), otherwise zero
+}
+
+// Owner returns the numeric owner of the entry.
+func (h *Header) Owner() (uid, gid int) {
+	return int(h.Uid), int(h.Gid)
+}
+
+// Device returns the major and minor numbers of a character or block device.
+func (h *Header) Device() (major, minor uint32) {
+	return h.RDevMajor, h.RDevMinor
+}
+
+// FileMode returns the type and permissions of the entry.
+func (h *Header) FileMode() fs.FileMode {
+	mode := fs.FileMode(h.Mode).Perm()
+	if h.Mode&S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if h.Mode&S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if h.Mode&S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch h.Mode & S_IFMT {
+	case S_IFREG:
+	case S_IFDIR:
+		mode |= fs.ModeDir
+	case S_IFLNK:
+		mode |= fs.ModeSymlink
+	case S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case S_IFBLK:
+		mode |= fs.ModeDevice
+	case S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case S_IFSOCK:
+		mode |= fs.ModeSocket
+	default:
+		mode |= fs.ModeIrregular
+	}
+
+	return mode
+}
+
+// parseHeader parses the header of an entry.
+func parseHeader(buf []byte) (*Header, error) {
+	if len(buf) != HeaderSize {
+		return nil, errors.New("truncated header")
+	}
+
+	h := &Header{Magic: string(buf[:6])}
+	switch h.Magic {
+	case MagicNewc, MagicCRC:
+	case magicODC:
+		return nil, fmt.Errorf("%w: odc cpio archives", archiveerrors.ErrUnsupportedFeature)
+	default:
+		if magic := binary.LittleEndian.Uint16(buf); magic == magicBinary || bits.ReverseBytes16(magic) == magicBinary {
+			return nil, fmt.Errorf("%w: binary cpio archives", archiveerrors.ErrUnsupportedFeature)
+		}
+
+		return nil, fmt.Errorf("invalid magic: %q", buf[:6])
+	}
+
+	fields := []*uint32{
+		&h.Ino, &h.Mode, &h.Uid, &h.Gid, &h.Nlink, &h.Mtime, &h.FileSize,
+		&h.DevMajor, &h.DevMinor, &h.RDevMajor, &h.RDevMinor, &h.NameSize, &h.Check,
+	}
+	for i, field := range fields {
+		value := buf[6+i*8 : 6+(i+1)*8]
+
+		v, err := strconv.ParseUint(string(value), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header field: %q", value)
+		}
+		*field = uint32(v)
+	}
+
+	return h, nil
+}
+
+// align4 rounds offset up to the next multiple of four.
+func align4(offset int64) int64 {
+	return (offset + 3) &^ 3
+}
@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package cpiofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ archivefs.Iterator = (*Iterator)(nil)
+)
+
+// Iterator provides sequential access to the entries of a cpio archive, for
+// use when the archive is streamed and an io.ReaderAt is not available.
+// Entry names are cleaned as for Open, and iteration ends at the trailer.
+//
+// Hard links are reported with HardLink set to the name of the first link.
+// As newc archives usually store the data of a hard linked file with its last
+// link, a hard link may have contents, which replace those of the file (as
+// they do when the kernel unpacks an initramfs image).
+type Iterator struct {
+	r io.Reader
+	// offset is the offset of the next entry.
+	offset int64
+	data   *entryReader
+	// pad is the padding following the data of the current entry.
+	pad   int64
+	links map[linkKey]string
+	err   error
+}
+
+// NewIterator returns an Iterator over the entries of the cpio archive read
+// from r.
+func NewIterator(r io.Reader) *Iterator {
+	return &Iterator{
+		r:     r,
+		links: map[linkKey]string{},
+	}
+}
+
+// Next advances to the next entry in the archive. Any remaining data in the
+// current entry is discarded. io.EOF is returned once the trailer is reached.
+func (it *Iterator) Next() (*archivefs.Entry, io.Reader, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+
+	e, r, err := it.next()
+	if err != nil {
+		it.err = err
+		return nil, nil, err
+	}
+
+	return e, r, nil
+}
+
+func (it *Iterator) next() (*archivefs.Entry, io.Reader, error) {
+	for {
+		if err := it.skip(); err != nil {
+			return nil, nil, err
+		}
+
+		offset := it.offset
+		h, name, err := readHeader(it.r, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		nameEnd := offset + HeaderSize + int64(h.NameSize)
+		dataOffset := align4(nameEnd)
+		if _, err := io.CopyN(io.Discard, it.r, dataOffset-nameEnd); err != nil {
+			return nil, nil, corrupted(offset, errors.New("truncated name"))
+		}
+
+		it.offset = align4(dataOffset + int64(h.FileSize))
+		it.pad = it.offset - dataOffset - int64(h.FileSize)
+		it.data = &entryReader{r: it.r, remaining: int64(h.FileSize), offset: offset, name: name}
+		if h.Magic == MagicCRC {
+			it.data.check = &h.Check
+		}
+
+		if name == TrailerName {
+			return nil, nil, io.EOF
+		}
+
+		e := &Entry{
+			Header:   *h,
+			name:     archivefs.CleanPath(name),
+			contents: &contents{size: int64(h.FileSize)},
+		}
+
+		// There might be a root entry.
+		if e.name == "" {
+			continue
+		}
+
+		entry := archivefs.NewEntryFromInfo(e.name, e)
+		entry.Nlink = max(int(h.Nlink), 1)
+
+		switch {
+		case e.Mode()&fs.ModeSymlink != 0:
+			if h.FileSize >= maxNameSize {
+				return nil, nil, corrupted(offset, fmt.Errorf("symbolic link %q target is too long", name))
+			}
+
+			var target strings.Builder
+			if _, err := io.Copy(&target, it.data); err != nil {
+				return nil, nil, err
+			}
+			entry.Linkname = target.String()
+		case e.Mode().IsRegular() && h.Nlink > 1:
+			key := linkKey{devMajor: h.DevMajor, devMinor: h.DevMinor, ino: h.Ino}
+			if first, ok := it.links[key]; ok {
+				entry.HardLink = first
+			} else {
+				it.links[key] = e.name
+			}
+		}
+
+		return entry, it.data, nil
+	}
+}
+
+// skip discards any unread data and padding from the current entry.
+func (it *Iterator) skip() error {
+	if it.data == nil {
+		return nil
+	}
+
+	data, pad := it.data, it.pad
+	it.data, it.pad = nil, 0
+
+	if _, err := io.Copy(io.Discard, data); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(io.Discard, it.r, pad); err != nil {
+		if errors.Is(err, io.EOF) {
+			return corrupted(data.offset, errors.New("truncated entry data"))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// entryReader reads the data of an entry, verifying its checksum (for
+// MagicCRC archives) once it has all been read.
+type entryReader struct {
+	r         io.Reader
+	remaining int64
+	sum       uint32
+	check     *uint32
+	// offset and name identify the entry, for errors.
+	offset int64
+	name   string
+}
+
+func (er *entryReader) Read(p []byte) (int, error) {
+	if er.remaining <= 0 {
+		if er.check != nil && er.sum != *er.check {
+			err := fmt.Errorf("%w: got %08x, expected %08x", ErrChecksumMismatch, er.sum, *er.check)
+			return 0, &archiveerrors.ErrCorrupted{Offset: er.offset, Detail: fmt.Sprintf("entry %q", er.name), Err: err}
+		}
+
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > er.remaining {
+		p = p[:er.remaining]
+	}
+
+	n, err := er.r.Read(p)
+	er.remaining -= int64(n)
+	for _, b := range p[:n] {
+		er.sum += uint32(b)
+	}
+
+	if errors.Is(err, io.EOF) {
+		if er.remaining > 0 {
+			return n, corrupted(er.offset, errors.New("truncated entry data"))
+		}
+
+		err = nil
+	}
+
+	return n, err
+}
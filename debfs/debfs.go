@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package debfs provides access to the contents of Debian binary packages.
+package debfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/dpeckett/archivefs/arfs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/tarfs"
+)
+
+// Package is a Debian binary package.
+type Package struct {
+	// Version is the format version from the debian-binary member (eg. "2.0").
+	Version string
+	// Control is the contents of the control archive.
+	Control *tarfs.FS
+	// Data is the contents of the data archive.
+	Data *tarfs.FS
+}
+
+// Options configures how a package is opened.
+type Options struct {
+	// Strict enables the most defensive behavior, for packages from untrusted
+	// sources, when opening both the ar(1) container (see arfs.Options) and
+	// the control and data archives (see tarfs.Options, symbolic links are
+	// never followed when resolving paths).
+	Strict bool
+	// Limits bounds the resources consumed when indexing each of the control
+	// and data archives.
+	Limits tarfs.Limits
+}
+
+// Open opens a Debian binary package. The control and data archives are
+// decompressed (gzip, xz, zstd, bzip2, or uncompressed, detected from their
+// contents) and spooled as they are indexed. The returned package must be
+// closed to release the spooled data.
+func Open(ra io.ReaderAt) (*Package, error) {
+	return OpenWithOptions(ra, nil)
+}
+
+// OpenWithOptions opens a Debian binary package with the given options.
+func OpenWithOptions(ra io.ReaderAt, opts *Options) (*Package, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	ar, err := arfs.OpenWithOptions(ra, &arfs.Options{Strict: opts.Strict})
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := fs.ReadFile(ar, "debian-binary")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read debian-binary: %w", err)
+	}
+
+	pkg := &Package{
+		Version: strings.TrimSpace(string(version)),
+	}
+
+	if !strings.HasPrefix(pkg.Version, "2.") {
+		return nil, fmt.Errorf("%w: package format version %s", archiveerrors.ErrUnsupportedFeature, pkg.Version)
+	}
+
+	tarOpts := &tarfs.Options{
+		Strict:     opts.Strict,
+		Limits:     opts.Limits,
+		Decompress: true,
+	}
+	if opts.Strict {
+		tarOpts.SymlinkPolicy = tarfs.SymlinkNoFollow
+	}
+
+	pkg.Control, err = openTar(ar, "control.tar", tarOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg.Data, err = openTar(ar, "data.tar", tarOpts)
+	if err != nil {
+		_ = pkg.Close()
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+// Close releases the spooled control and data archives.
+func (pkg *Package) Close() error {
+	var errs []error
+	for _, fsys := range []*tarfs.FS{pkg.Control, pkg.Data} {
+		if fsys != nil {
+			errs = append(errs, fsys.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// openTar opens the (possibly compressed) tar archive member with the given
+// name prefix.
+func openTar(ar *arfs.FS, prefix string, opts *tarfs.Options) (*tarfs.FS, error) {
+	entries, err := ar.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.Name() != prefix && !strings.HasPrefix(e.Name(), prefix+".") {
+			continue
+		}
+
+		f, err := ar.Open(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		fsys, err := tarfs.OpenReader(f, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", e.Name(), err)
+		}
+
+		return fsys, nil
+	}
+
+	return nil, fmt.Errorf("missing %s member: %w", prefix, fs.ErrNotExist)
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package debfs_test
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/dpeckett/archivefs/debfs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebFS(t *testing.T) {
+	for _, compression := range []string{"gzip", "xz", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			f, err := os.Open("testdata/hello_" + compression + ".deb")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			pkg, err := debfs.Open(f)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, pkg.Close())
+			})
+
+			require.Equal(t, "2.0", pkg.Version)
+
+			control, err := fs.ReadFile(pkg.Control, "control")
+			require.NoError(t, err)
+			require.Contains(t, string(control), "Package: hello\n")
+
+			readme, err := fs.ReadFile(pkg.Data, "usr/share/doc/hello/README")
+			require.NoError(t, err)
+			require.Equal(t, "Hello, world!\n", string(readme))
+		})
+	}
+}
+
+func TestDebFSOptions(t *testing.T) {
+	f, err := os.Open("testdata/hello_xz.deb")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	pkg, err := debfs.OpenWithOptions(f, &debfs.Options{Strict: true})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, pkg.Close())
+	})
+
+	readme, err := fs.ReadFile(pkg.Data, "usr/share/doc/hello/README")
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!\n", string(readme))
+
+	_, err = debfs.OpenWithOptions(f, &debfs.Options{Limits: tarfs.Limits{MaxEntries: 1}})
+	require.ErrorIs(t, err, archiveerrors.ErrLimitExceeded)
+}
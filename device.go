@@ -0,0 +1,36 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+)
+
+// Device may be implemented by the value returned from fs.FileInfo.Sys() to
+// supply the major and minor numbers of a character or block device.
+type Device interface {
+	Device() (major, minor uint32)
+}
+
+// LookupDevice returns the major and minor numbers of a device file, if
+// known. They are taken from a *tar.Header, a Device implementation, or a
+// platform specific stat structure returned by fi.Sys().
+func LookupDevice(fi fs.FileInfo) (major, minor uint32, ok bool) {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		return uint32(sys.Devmajor), uint32(sys.Devminor), true
+	case Device:
+		major, minor = sys.Device()
+		return major, minor, true
+	}
+
+	return sysDevice(fi.Sys())
+}
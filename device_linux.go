@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import "syscall"
+
+// sysDevice returns the device numbers recorded by sys, if it is a platform
+// specific type that records them.
+func sysDevice(sys any) (major, minor uint32, ok bool) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	rdev := uint64(st.Rdev)
+	major = uint32((rdev>>8)&0xfff) | uint32((rdev>>32)&^0xfff)
+	minor = uint32(rdev&0xff) | uint32((rdev>>12)&^0xff)
+
+	return major, minor, true
+}
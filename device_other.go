@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+// sysDevice returns the device numbers recorded by sys, if it is a platform
+// specific type that records them. Only Linux is supported.
+func sysDevice(sys any) (major, minor uint32, ok bool) {
+	return 0, 0, false
+}
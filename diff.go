@@ -0,0 +1,350 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"strings"
+)
+
+// ChangeKind is the kind of change made to an entry.
+type ChangeKind int
+
+const (
+	// ChangeAdded indicates the entry only exists in the second filesystem.
+	ChangeAdded ChangeKind = iota
+	// ChangeRemoved indicates the entry only exists in the first filesystem.
+	ChangeRemoved
+	// ChangeModified indicates the entry exists in both filesystems, but
+	// differs.
+	ChangeModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// DiffFlags describe the properties of entries that are compared, or that
+// differ.
+type DiffFlags uint
+
+const (
+	// DiffType is the type of the entry (eg. file, directory, symlink).
+	DiffType DiffFlags = 1 << iota
+	// DiffContent is the contents of a regular file, the target of a
+	// symbolic link, or the major and minor numbers of a device.
+	DiffContent
+	// DiffMode is the permission bits (including setuid, setgid and sticky).
+	DiffMode
+	// DiffOwner is the numeric owner.
+	DiffOwner
+	// DiffModTime is the modification time.
+	DiffModTime
+	// DiffXattrs is the extended attributes.
+	DiffXattrs
+
+	// DiffAll compares every property.
+	DiffAll = DiffType | DiffContent | DiffMode | DiffOwner | DiffModTime | DiffXattrs
+)
+
+// String returns a human readable list of the flags, eg. "content,mode".
+func (f DiffFlags) String() string {
+	var names []string
+	for _, flag := range []struct {
+		flag DiffFlags
+		name string
+	}{
+		{DiffType, "type"},
+		{DiffContent, "content"},
+		{DiffMode, "mode"},
+		{DiffOwner, "owner"},
+		{DiffModTime, "mtime"},
+		{DiffXattrs, "xattrs"},
+	} {
+		if f&flag.flag != 0 {
+			names = append(names, flag.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Change describes a difference between two filesystems.
+type Change struct {
+	// Path is the path of the entry.
+	Path string
+	// Kind is the kind of change.
+	Kind ChangeKind
+	// Flags describes the properties that differ, for modified entries.
+	Flags DiffFlags
+}
+
+func (c Change) String() string {
+	return c.Kind.String() + " " + c.Path
+}
+
+// DiffOptions configures the comparison of filesystems.
+type DiffOptions struct {
+	// Compare is the set of properties that are compared. If zero, every
+	// property is compared. Comparing only metadata (ie. excluding
+	// DiffContent) avoids reading the contents of files.
+	Compare DiffFlags
+}
+
+// Diff compares two filesystems, returning the entries that were added,
+// removed or modified in b relative to a, in lexical order (as for
+// fs.WalkDir). Every descendant of an added or removed directory is
+// included. Symbolic links are compared, rather than followed, if the
+// filesystems implement ReadLinkFS.
+func Diff(a, b fs.FS, opts *DiffOptions) ([]Change, error) {
+	compare := DiffAll
+	if opts != nil && opts.Compare != 0 {
+		compare = opts.Compare
+	}
+
+	d := &differ{a: a, b: b, compare: compare}
+	if err := d.diffDir("."); err != nil {
+		return nil, err
+	}
+
+	return d.changes, nil
+}
+
+type differ struct {
+	a, b    fs.FS
+	compare DiffFlags
+	changes []Change
+}
+
+// diffDir compares the contents of a directory that exists in both
+// filesystems.
+func (d *differ) diffDir(dir string) error {
+	aEntries, err := fs.ReadDir(d.a, dir)
+	if err != nil {
+		return err
+	}
+
+	bEntries, err := fs.ReadDir(d.b, dir)
+	if err != nil {
+		return err
+	}
+
+	for len(aEntries) > 0 || len(bEntries) > 0 {
+		switch {
+		case len(bEntries) == 0 || (len(aEntries) > 0 && aEntries[0].Name() < bEntries[0].Name()):
+			if err := d.addTree(d.a, path.Join(dir, aEntries[0].Name()), aEntries[0], ChangeRemoved); err != nil {
+				return err
+			}
+			aEntries = aEntries[1:]
+		case len(aEntries) == 0 || bEntries[0].Name() < aEntries[0].Name():
+			if err := d.addTree(d.b, path.Join(dir, bEntries[0].Name()), bEntries[0], ChangeAdded); err != nil {
+				return err
+			}
+			bEntries = bEntries[1:]
+		default:
+			if err := d.diffEntry(path.Join(dir, aEntries[0].Name()), aEntries[0], bEntries[0]); err != nil {
+				return err
+			}
+			aEntries, bEntries = aEntries[1:], bEntries[1:]
+		}
+	}
+
+	return nil
+}
+
+// diffEntry compares an entry that exists in both filesystems.
+func (d *differ) diffEntry(name string, aEntry, bEntry fs.DirEntry) error {
+	aInfo, err := aEntry.Info()
+	if err != nil {
+		return err
+	}
+
+	bInfo, err := bEntry.Info()
+	if err != nil {
+		return err
+	}
+
+	flags, err := d.diffInfo(name, aInfo, bInfo)
+	if err != nil {
+		return err
+	}
+
+	if flags != 0 {
+		d.changes = append(d.changes, Change{Path: name, Kind: ChangeModified, Flags: flags})
+	}
+
+	switch {
+	case aInfo.IsDir() && bInfo.IsDir():
+		return d.diffDir(name)
+	case aInfo.IsDir():
+		return d.addChildren(d.a, name, ChangeRemoved)
+	case bInfo.IsDir():
+		return d.addChildren(d.b, name, ChangeAdded)
+	}
+
+	return nil
+}
+
+// diffInfo returns the properties that differ between two versions of an
+// entry.
+func (d *differ) diffInfo(name string, aInfo, bInfo fs.FileInfo) (DiffFlags, error) {
+	var flags DiffFlags
+
+	aMode, bMode := aInfo.Mode(), bInfo.Mode()
+	if aMode.Type() != bMode.Type() {
+		// The remaining properties aren't comparable.
+		return DiffType & d.compare, nil
+	}
+
+	if d.compare&DiffMode != 0 && aMode&^fs.ModeType != bMode&^fs.ModeType {
+		flags |= DiffMode
+	}
+
+	a, b := NewEntryFromInfo(name, aInfo), NewEntryFromInfo(name, bInfo)
+
+	if d.compare&DiffOwner != 0 {
+		if a.Uid != b.Uid || a.Gid != b.Gid {
+			flags |= DiffOwner
+		}
+	}
+
+	if d.compare&DiffModTime != 0 && !aInfo.ModTime().Equal(bInfo.ModTime()) {
+		flags |= DiffModTime
+	}
+
+	if d.compare&DiffXattrs != 0 && !maps.Equal(a.Xattrs, b.Xattrs) {
+		flags |= DiffXattrs
+	}
+
+	if d.compare&DiffContent != 0 {
+		equal, err := d.equalContent(name, aInfo, bInfo)
+		if err != nil {
+			return 0, err
+		}
+
+		if !equal {
+			flags |= DiffContent
+		}
+	}
+
+	return flags, nil
+}
+
+// equalContent reports whether the contents of two versions of an entry
+// (of the same type) are equal.
+func (d *differ) equalContent(name string, aInfo, bInfo fs.FileInfo) (bool, error) {
+	mode := aInfo.Mode()
+	switch {
+	case mode.IsRegular():
+		if aInfo.Size() != bInfo.Size() {
+			return false, nil
+		}
+
+		return equalFiles(d.a, d.b, name)
+	case mode&fs.ModeSymlink != 0:
+		aTarget, err := readLink(d.a, name)
+		if err != nil {
+			return false, err
+		}
+
+		bTarget, err := readLink(d.b, name)
+		if err != nil {
+			return false, err
+		}
+
+		return aTarget == bTarget, nil
+	case mode&fs.ModeDevice != 0:
+		aMajor, aMinor, _ := LookupDevice(aInfo)
+		bMajor, bMinor, _ := LookupDevice(bInfo)
+		return aMajor == bMajor && aMinor == bMinor, nil
+	}
+
+	return true, nil
+}
+
+// addTree records an entry that only exists in one filesystem, along with
+// all of its descendants.
+func (d *differ) addTree(fsys fs.FS, name string, de fs.DirEntry, kind ChangeKind) error {
+	d.changes = append(d.changes, Change{Path: name, Kind: kind})
+
+	if !de.IsDir() {
+		return nil
+	}
+
+	return d.addChildren(fsys, name, kind)
+}
+
+// addChildren records the descendants of a directory that only exists in
+// one filesystem.
+func (d *differ) addChildren(fsys fs.FS, dir string, kind ChangeKind) error {
+	return fs.WalkDir(fsys, dir, func(name string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name != dir {
+			d.changes = append(d.changes, Change{Path: name, Kind: kind})
+		}
+
+		return nil
+	})
+}
+
+// equalFiles reports whether the contents of the named file are the same
+// in both filesystems.
+func equalFiles(a, b fs.FS, name string) (bool, error) {
+	aFile, err := a.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+
+	bFile, err := b.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+
+	aBuf, bBuf := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		aN, aErr := io.ReadFull(aFile, aBuf)
+		bN, bErr := io.ReadFull(bFile, bBuf)
+
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+
+		aEOF := errors.Is(aErr, io.EOF) || errors.Is(aErr, io.ErrUnexpectedEOF)
+		bEOF := errors.Is(bErr, io.EOF) || errors.Is(bErr, io.ErrUnexpectedEOF)
+		switch {
+		case aErr != nil && !aEOF:
+			return false, aErr
+		case bErr != nil && !bEOF:
+			return false, bErr
+		case aEOF || bEOF:
+			return aEOF == bEOF, nil
+		}
+	}
+}
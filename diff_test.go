@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	newFS := func(t *testing.T) *memfs.FS {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+		require.NoError(t, fsys.MkdirAll("var/lib", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/passwd", []byte("root"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o644))
+		require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+		return fsys
+	}
+
+	a := newFS(t)
+
+	changes, err := archivefs.Diff(a, newFS(t), nil)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	b := newFS(t)
+	require.NoError(t, b.WriteFile("etc/hostname", []byte("bravo"), 0o644))
+	require.NoError(t, b.SetOwner("etc/passwd", 0, 42))
+	require.NoError(t, b.SetXattr("etc/passwd", "user.comment", "hello"))
+	require.NoError(t, b.Rename("etc/ssl", "etc/tls"))
+	require.NoError(t, b.Rename("etc/name", "var/name"))
+	require.NoError(t, b.Symlink("passwd", "etc/name"))
+	require.NoError(t, b.WriteFile("var/lib/state", nil, 0o600))
+
+	changes, err = archivefs.Diff(a, b, nil)
+	require.NoError(t, err)
+	require.Equal(t, []archivefs.Change{
+		{Path: "etc/hostname", Kind: archivefs.ChangeModified, Flags: archivefs.DiffContent},
+		{Path: "etc/name", Kind: archivefs.ChangeModified, Flags: archivefs.DiffContent},
+		{Path: "etc/passwd", Kind: archivefs.ChangeModified, Flags: archivefs.DiffOwner | archivefs.DiffXattrs},
+		{Path: "etc/ssl", Kind: archivefs.ChangeRemoved},
+		{Path: "etc/ssl/cert.pem", Kind: archivefs.ChangeRemoved},
+		{Path: "etc/tls", Kind: archivefs.ChangeAdded},
+		{Path: "etc/tls/cert.pem", Kind: archivefs.ChangeAdded},
+		{Path: "var/lib/state", Kind: archivefs.ChangeAdded},
+		{Path: "var/name", Kind: archivefs.ChangeAdded},
+	}, changes)
+	require.Equal(t, "owner,xattrs", changes[2].Flags.String())
+
+	t.Run("MetadataOnly", func(t *testing.T) {
+		changes, err := archivefs.Diff(a, b, &archivefs.DiffOptions{
+			Compare: archivefs.DiffType | archivefs.DiffMode | archivefs.DiffOwner,
+		})
+		require.NoError(t, err)
+		require.Equal(t, archivefs.Change{Path: "etc/passwd", Kind: archivefs.ChangeModified, Flags: archivefs.DiffOwner}, changes[0])
+	})
+
+	t.Run("Type", func(t *testing.T) {
+		b := newFS(t)
+		require.NoError(t, b.Rename("etc/ssl", "ssl"))
+		require.NoError(t, b.WriteFile("etc/ssl", []byte("not a directory"), 0o644))
+
+		changes, err := archivefs.Diff(a, b, &archivefs.DiffOptions{Compare: archivefs.DiffType})
+		require.NoError(t, err)
+		require.Equal(t, []archivefs.Change{
+			{Path: "etc/ssl", Kind: archivefs.ChangeModified, Flags: archivefs.DiffType},
+			{Path: "etc/ssl/cert.pem", Kind: archivefs.ChangeRemoved},
+			{Path: "ssl", Kind: archivefs.ChangeAdded},
+			{Path: "ssl/cert.pem", Kind: archivefs.ChangeAdded},
+		}, changes)
+	})
+
+	t.Run("EROFS", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, tarfs.Create(&buf, a))
+
+		tarFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		f, err := os.CreateTemp(t.TempDir(), "image")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, tarFS))
+
+		erofsFS, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		changes, err := archivefs.Diff(tarFS, erofsFS, nil)
+		require.NoError(t, err)
+		require.Empty(t, changes)
+	})
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"io/fs"
+	"path"
+	"slices"
+)
+
+// AllocatedSize may be implemented by the value returned from fs.FileInfo.Sys()
+// to supply the number of bytes of storage allocated to a file, eg. less than
+// its size for sparse or compressed files.
+type AllocatedSize interface {
+	AllocatedSize() int64
+}
+
+// DiskUsageOptions configures how disk usage is computed.
+type DiskUsageOptions struct {
+	// BlockSize is used to compute the disk size of files whose allocated
+	// size isn't supplied by the filesystem (see AllocatedSize), defaults to
+	// 4096.
+	BlockSize int64
+	// Largest is the number of largest files to report, defaults to 10.
+	Largest int
+}
+
+// Usage is the disk usage of a set of files.
+type Usage struct {
+	// ApparentSize is the total size of the regular files.
+	ApparentSize int64
+	// DiskSize is the total storage allocated to the regular files, or their
+	// size rounded up to whole blocks if unknown.
+	DiskSize int64
+	// Files is the number of files (of any type other than directory).
+	Files int
+	// Directories is the number of directories.
+	Directories int
+}
+
+// FileUsage is the disk usage of a single file.
+type FileUsage struct {
+	// Name is the path of the file.
+	Name string
+	// ApparentSize is the size of the file.
+	ApparentSize int64
+	// DiskSize is the storage allocated to the file.
+	DiskSize int64
+}
+
+// DiskUsageReport summarizes the disk usage of a filesystem.
+type DiskUsageReport struct {
+	// Total is the usage of the whole filesystem (the same as Dirs["."]).
+	Total Usage
+	// Dirs is the usage of each directory, including its subdirectories (but
+	// not the directory itself).
+	Dirs map[string]Usage
+	// Largest holds the largest regular files by apparent size, in
+	// descending order.
+	Largest []FileUsage
+}
+
+// DiskUsage reports the disk usage of fsys, as for du(1). Hard links to the
+// same file (see LinkFS) are only counted once, and symbolic links are not
+// followed.
+func DiskUsage(fsys fs.FS, opts *DiskUsageOptions) (*DiskUsageReport, error) {
+	if opts == nil {
+		opts = &DiskUsageOptions{}
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = 4096
+	}
+
+	largest := opts.Largest
+	if largest <= 0 {
+		largest = 10
+	}
+
+	report := &DiskUsageReport{
+		Dirs: map[string]Usage{".": {}},
+	}
+
+	seen := map[uint64]bool{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		var usage Usage
+		if d.IsDir() {
+			usage.Directories = 1
+
+			if _, ok := report.Dirs[name]; !ok {
+				report.Dirs[name] = Usage{}
+			}
+		} else {
+			usage.Files = 1
+
+			if d.Type().IsRegular() {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+
+				id, nlink, err := LookupFileID(fsys, name, fi)
+				if err != nil {
+					return err
+				}
+
+				if id == 0 || nlink == 1 || !seen[id] {
+					seen[id] = true
+
+					f := FileUsage{
+						Name:         name,
+						ApparentSize: fi.Size(),
+						DiskSize:     allocatedSize(fi, blockSize),
+					}
+
+					usage.ApparentSize = f.ApparentSize
+					usage.DiskSize = f.DiskSize
+
+					report.Largest = addLargest(report.Largest, f, largest)
+				}
+			}
+		}
+
+		// Add the usage to every ancestor.
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			report.Dirs[dir] = report.Dirs[dir].add(usage)
+			if dir == "." {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Total = report.Dirs["."]
+
+	return report, nil
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{
+		ApparentSize: u.ApparentSize + other.ApparentSize,
+		DiskSize:     u.DiskSize + other.DiskSize,
+		Files:        u.Files + other.Files,
+		Directories:  u.Directories + other.Directories,
+	}
+}
+
+// allocatedSize returns the storage allocated to a regular file.
+func allocatedSize(fi fs.FileInfo, blockSize int64) int64 {
+	if sys, ok := fi.Sys().(AllocatedSize); ok {
+		return sys.AllocatedSize()
+	}
+
+	if size, ok := sysAllocatedSize(fi.Sys()); ok {
+		return size
+	}
+
+	return (fi.Size() + blockSize - 1) / blockSize * blockSize
+}
+
+// addLargest adds a file to the list of the largest files, keeping at most
+// n files sorted in descending order of size (then name).
+func addLargest(files []FileUsage, f FileUsage, n int) []FileUsage {
+	i, _ := slices.BinarySearchFunc(files, f, func(a, b FileUsage) int {
+		if a.ApparentSize != b.ApparentSize {
+			if a.ApparentSize > b.ApparentSize {
+				return -1
+			}
+			return 1
+		}
+		if a.Name < b.Name {
+			return -1
+		}
+		return 1
+	})
+	if i >= n {
+		return files
+	}
+
+	files = slices.Insert(files, i, f)
+	if len(files) > n {
+		files = files[:n]
+	}
+
+	return files
+}
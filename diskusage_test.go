@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskUsage(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.MkdirAll("var/empty", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", bytes.Repeat([]byte("c"), 5000), 0o600))
+	require.NoError(t, fsys.WriteFile("etc/ssl/key.pem", bytes.Repeat([]byte("k"), 100), 0o600))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+	require.NoError(t, fsys.Link("etc/ssl/cert.pem", "etc/cert.pem"))
+
+	report, err := archivefs.DiskUsage(fsys, &archivefs.DiskUsageOptions{Largest: 2})
+	require.NoError(t, err)
+
+	// The hard link is only counted once.
+	require.Equal(t, archivefs.Usage{
+		ApparentSize: 5106,
+		DiskSize:     4096 * 4,
+		Files:        5,
+		Directories:  4,
+	}, report.Total)
+
+	require.Equal(t, report.Total, report.Dirs["."])
+	// The hard link is counted where it is first encountered.
+	require.Equal(t, archivefs.Usage{
+		ApparentSize: 100,
+		DiskSize:     4096,
+		Files:        2,
+	}, report.Dirs["etc/ssl"])
+	require.Equal(t, archivefs.Usage{Directories: 1}, report.Dirs["var"])
+	require.Equal(t, archivefs.Usage{}, report.Dirs["var/empty"])
+
+	require.Equal(t, []archivefs.FileUsage{
+		{Name: "etc/cert.pem", ApparentSize: 5000, DiskSize: 8192},
+		{Name: "etc/ssl/key.pem", ApparentSize: 100, DiskSize: 4096},
+	}, report.Largest)
+
+	t.Run("BlockSize", func(t *testing.T) {
+		report, err := archivefs.DiskUsage(fsys, &archivefs.DiskUsageOptions{BlockSize: 512})
+		require.NoError(t, err)
+		require.Equal(t, int64(512+5120+512), report.Total.DiskSize)
+		require.Len(t, report.Largest, 3)
+	})
+
+	t.Run("AllocatedSize", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, fsys))
+
+		image, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		report, err := archivefs.DiskUsage(image, &archivefs.DiskUsageOptions{BlockSize: 512})
+		require.NoError(t, err)
+
+		require.Equal(t, int64(5106), report.Total.ApparentSize)
+		// The small files are stored inline, and the large file in two blocks
+		// of the image (4 KiB), regardless of the configured block size.
+		require.Equal(t, int64(6+100+8192), report.Total.DiskSize)
+	})
+}
@@ -10,28 +10,16 @@
  * file, You can obtain one at http://mozilla.org/MPL/2.0/.
  */
 
-package erofs
+package archivefs
 
-import (
-	"archive/tar"
-	"io/fs"
-	"syscall"
-)
+import "syscall"
 
-func getOwner(fi fs.FileInfo) (uid, gid int) {
-	switch fi.Sys().(type) {
-	case *syscall.Stat_t:
-		stat := fi.Sys().(*syscall.Stat_t)
-
-		uid = int(stat.Uid)
-		gid = int(stat.Gid)
-
-	case *tar.Header:
-		hdr := fi.Sys().(*tar.Header)
-
-		uid = hdr.Uid
-		gid = hdr.Gid
+func sysAllocatedSize(sys any) (int64, bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
 	}
 
-	return
+	// st_blocks is always in units of 512 bytes.
+	return int64(stat.Blocks) * 512, true
 }
@@ -0,0 +1,232 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package dockerfs provides access to the root filesystem of container
+// images in Docker image archives, as written by "docker save", with the
+// layers of the image merged.
+//
+// The archive is read from an fs.FS, eg. a tarfs.FS for the archive itself
+// (or anyfs, if it is compressed), or os.DirFS for an extracted archive.
+// Archives written by recent versions of Docker are also OCI image layouts,
+// which can be opened with ocifs.
+package dockerfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/compression"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/jsondoc"
+	"github.com/dpeckett/archivefs/ocifs"
+	"github.com/dpeckett/archivefs/tarfs"
+)
+
+// ErrNotFound is returned when an archive contains no image with the
+// requested tag. It is the same error as ocifs.ErrNotFound.
+var ErrNotFound = ocifs.ErrNotFound
+
+// Manifest describes an image in an archive, the paths of its files are
+// relative to the root of the archive.
+type Manifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Image is a container image.
+type Image struct {
+	// Manifest is the entry for the image in the manifest of the archive.
+	Manifest Manifest
+	// Config is the configuration of the image.
+	Config ocifs.Config
+	// RootFS is the root filesystem of the image, its layers merged (see
+	// archivefs.Overlay).
+	RootFS fs.FS
+
+	layers []*tarfs.FS
+}
+
+// Options configures how an image is opened.
+type Options struct {
+	// Tag selects the image with the given tag (eg. "alpine:3.20", the tag
+	// defaults to "latest" if omitted), if the archive contains more than
+	// one. Otherwise the first image is opened.
+	Tag string
+	// Strict rejects layers that are unsafe to serve from untrusted sources
+	// (see tarfs.Options, symbolic links are never followed when resolving
+	// paths within a layer).
+	Strict bool
+	// Limits bounds the resources consumed when indexing each layer.
+	Limits tarfs.Limits
+}
+
+// Open opens the first image in a Docker image archive. Layers are
+// decompressed (if needed) and spooled as they are indexed, and verified
+// against the layer digests in the configuration of the image. The returned
+// image must be closed to release the spooled layers.
+func Open(archive fs.FS) (*Image, error) {
+	return OpenWithOptions(archive, nil)
+}
+
+// OpenWithOptions opens an image in a Docker image archive with the given
+// options.
+func OpenWithOptions(archive fs.FS, opts *Options) (*Image, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	var manifests []Manifest
+	if err := jsondoc.Read(archive, "manifest.json", &manifests); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	img := &Image{}
+	found := false
+	for _, m := range manifests {
+		if opts.Tag == "" || hasTag(m.RepoTags, opts.Tag) {
+			img.Manifest, found = m, true
+			break
+		}
+	}
+	if !found {
+		if opts.Tag != "" {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, opts.Tag)
+		}
+
+		return nil, ErrNotFound
+	}
+
+	if err := jsondoc.Read(archive, img.Manifest.Config, &img.Config); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	diffIDs := img.Config.RootFS.DiffIDs
+	if len(diffIDs) != len(img.Manifest.Layers) {
+		return nil, &archiveerrors.ErrCorrupted{Offset: -1, Detail: fmt.Sprintf("image has %d layers, but its config lists %d", len(img.Manifest.Layers), len(diffIDs))}
+	}
+
+	tarOpts := &tarfs.Options{
+		Strict: opts.Strict,
+		Limits: opts.Limits,
+	}
+	if opts.Strict {
+		tarOpts.SymlinkPolicy = tarfs.SymlinkNoFollow
+	}
+
+	layers := make([]fs.FS, 0, len(img.Manifest.Layers))
+	for i, name := range img.Manifest.Layers {
+		layer, err := openLayer(archive, name, diffIDs[i], tarOpts)
+		if err != nil {
+			_ = img.Close()
+			return nil, fmt.Errorf("failed to open layer %s: %w", name, err)
+		}
+
+		img.layers = append(img.layers, layer)
+		layers = append(layers, layer)
+	}
+
+	img.RootFS = archivefs.Overlay(layers...)
+
+	return img, nil
+}
+
+// Close releases the spooled layers of the image.
+func (img *Image) Close() error {
+	var errs []error
+	for _, layer := range img.layers {
+		errs = append(errs, layer.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// hasTag reports whether tags includes tag, which defaults to the latest
+// tag if it has none.
+func hasTag(tags []string, tag string) bool {
+	if !strings.Contains(path.Base(tag), ":") {
+		tag += ":latest"
+	}
+
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openLayer opens the (possibly compressed) tar archive of a layer, checking
+// the digest of the uncompressed archive matches diffID.
+func openLayer(archive fs.FS, name, diffID string, opts *tarfs.Options) (*tarfs.FS, error) {
+	algorithm, want, _ := strings.Cut(diffID, ":")
+	if algorithm != "sha256" {
+		return nil, fmt.Errorf("%w: digest algorithm %q", archiveerrors.ErrUnsupportedFeature, algorithm)
+	}
+
+	f, err := openFile(archive, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dr, _, err := compression.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress layer: %w", err)
+	}
+	defer dr.Close()
+
+	h := sha256.New()
+	r := io.TeeReader(dr, h)
+
+	layer, err := tarfs.OpenReader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verify(r, h, want); err != nil {
+		_ = layer.Close()
+		return nil, err
+	}
+
+	return layer, nil
+}
+
+// verify reads the remainder of r (eg. padding), and checks the digest of
+// everything read matches want.
+func verify(r io.Reader, h hash.Hash, want string) error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(want) {
+		return fmt.Errorf("layer sha256:%s: %w", want, tarfs.ErrDigestMismatch)
+	}
+
+	return nil
+}
+
+// openFile opens a file named by the manifest, which must be within the
+// archive.
+func openFile(archive fs.FS, name string) (fs.File, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, fmt.Errorf("invalid path %q: %w", name, archiveerrors.ErrInsecurePath)
+	}
+
+	return archive.Open(name)
+}
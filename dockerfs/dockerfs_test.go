@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package dockerfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/dockerfs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/ocifs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerFS(t *testing.T) {
+	base := tarball(t, map[string]string{
+		"etc/hostname": "base\n",
+		"etc/motd":     "hello\n",
+	})
+	top := tarball(t, map[string]string{
+		"etc/hostname": "top\n",
+		"etc/.wh.motd": "",
+	})
+
+	files := map[string]string{
+		"base/layer.tar":    string(base),
+		"top/layer.tar.gz":  string(gzipped(t, top)),
+		"alpine.json":       config(t, "amd64", base, top),
+		"busybox.json":      config(t, "arm64", base),
+		"invalid.json":      config(t, "amd64", base),
+		"wrong-digest.json": config(t, "amd64", top),
+	}
+
+	manifests := []dockerfs.Manifest{
+		{Config: "alpine.json", RepoTags: []string{"alpine:latest", "alpine:3.20"}, Layers: []string{"base/layer.tar", "top/layer.tar.gz"}},
+		{Config: "busybox.json", RepoTags: []string{"busybox:1.36"}, Layers: []string{"base/layer.tar"}},
+		{Config: "invalid.json", RepoTags: []string{"invalid:latest"}, Layers: []string{"../base/layer.tar"}},
+		{Config: "wrong-digest.json", RepoTags: []string{"wrong-digest:latest"}, Layers: []string{"base/layer.tar"}},
+	}
+	data, err := json.Marshal(manifests)
+	require.NoError(t, err)
+	files["manifest.json"] = string(data)
+
+	archive, err := tarfs.Open(bytes.NewReader(tarball(t, files)))
+	require.NoError(t, err)
+
+	img, err := dockerfs.Open(archive)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, img.Close())
+	})
+
+	require.Equal(t, []string{"alpine:latest", "alpine:3.20"}, img.Manifest.RepoTags)
+	require.Equal(t, "amd64", img.Config.Architecture)
+
+	require.NoError(t, archivefstest.TestFS(img.RootFS, "etc/hostname"))
+
+	data, err = fs.ReadFile(img.RootFS, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "top\n", string(data))
+
+	_, err = fs.Stat(img.RootFS, "etc/motd")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	t.Run("Tag", func(t *testing.T) {
+		img, err := dockerfs.OpenWithOptions(archive, &dockerfs.Options{Tag: "busybox:1.36"})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, img.Close())
+		})
+
+		require.Equal(t, "arm64", img.Config.Architecture)
+
+		data, err := fs.ReadFile(img.RootFS, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "hello\n", string(data))
+
+		img, err = dockerfs.OpenWithOptions(archive, &dockerfs.Options{Tag: "alpine"})
+		require.NoError(t, err)
+		require.NoError(t, img.Close())
+
+		_, err = dockerfs.OpenWithOptions(archive, &dockerfs.Options{Tag: "busybox"})
+		require.ErrorIs(t, err, dockerfs.ErrNotFound)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("InvalidPath", func(t *testing.T) {
+		_, err := dockerfs.OpenWithOptions(archive, &dockerfs.Options{Tag: "invalid"})
+		require.ErrorIs(t, err, archiveerrors.ErrInsecurePath)
+	})
+
+	t.Run("DigestMismatch", func(t *testing.T) {
+		_, err := dockerfs.OpenWithOptions(archive, &dockerfs.Options{Tag: "wrong-digest"})
+		require.ErrorIs(t, err, tarfs.ErrDigestMismatch)
+	})
+}
+
+// tarball returns a tar archive containing the given files.
+func tarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(contents)),
+		}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+// config returns the configuration of an image with the given (uncompressed)
+// layers.
+func config(t *testing.T, arch string, layers ...[]byte) string {
+	cfg := ocifs.Config{
+		Platform: ocifs.Platform{OS: "linux", Architecture: arch},
+		RootFS:   ocifs.RootFS{Type: "layers"},
+	}
+	for _, layer := range layers {
+		sum := sha256.Sum256(layer)
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	data, err := json.Marshal(cfg)
+	require.NoError(t, err)
+
+	return string(data)
+}
@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"cmp"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// DuplicateOptions configures the search for duplicate files.
+type DuplicateOptions struct {
+	// MinSize is the size of the smallest file that is considered, defaults
+	// to 1 (ie. empty files are ignored).
+	MinSize int64
+	// Concurrency is the number of files to hash concurrently. If less than
+	// or equal to one, files are hashed sequentially.
+	Concurrency int
+}
+
+// DuplicateGroup is a set of files with identical contents.
+type DuplicateGroup struct {
+	// Digest is the hex encoded SHA-256 digest of the contents.
+	Digest string
+	// Size is the size of each file.
+	Size int64
+	// Names holds the paths of the files, in lexical order.
+	Names []string
+	// Copies is the number of distinct copies of the contents, ie. the
+	// number of names less those that are hard links to another name.
+	Copies int
+}
+
+// Savings is the number of bytes that would be saved by storing the contents
+// only once (eg. by hard linking the files together).
+func (g *DuplicateGroup) Savings() int64 {
+	return int64(g.Copies-1) * g.Size
+}
+
+// ExtensionUsage is a breakdown of the files with a given extension.
+type ExtensionUsage struct {
+	// Files is the number of files (hard links are only counted once).
+	Files int
+	// Size is the total size of the files.
+	Size int64
+	// DuplicateFiles is the number of files that duplicate the contents of
+	// another file.
+	DuplicateFiles int
+	// DuplicateSize is the total size of the duplicate files.
+	DuplicateSize int64
+}
+
+// DuplicateReport summarizes the duplicate files in a filesystem.
+type DuplicateReport struct {
+	// Files is the number of regular files considered (hard links to the
+	// same file are only counted once).
+	Files int
+	// Size is the total size of the files.
+	Size int64
+	// UniqueSize is the total size of the distinct contents of the files.
+	UniqueSize int64
+	// Savings is the number of bytes that would be saved by storing each
+	// distinct contents only once, ie. Size - UniqueSize.
+	Savings int64
+	// Groups holds the sets of files with identical contents, in descending
+	// order of savings (then name).
+	Groups []DuplicateGroup
+	// Extensions is the breakdown of the files by (lower case) extension,
+	// including the leading dot, or "" for files without one.
+	Extensions map[string]ExtensionUsage
+}
+
+// FindDuplicates hashes the regular files in fsys and reports those with
+// identical contents, eg. to estimate the benefit of deduplication (as
+// offered by erofs) before building an image. Only files that share their
+// size with another file are hashed. Hard links to the same file (see
+// LinkFS) are not considered duplicates, and symbolic links are not
+// followed.
+func FindDuplicates(fsys fs.FS, opts *DuplicateOptions) (*DuplicateReport, error) {
+	if opts == nil {
+		opts = &DuplicateOptions{}
+	}
+
+	minSize := opts.MinSize
+	if minSize <= 0 {
+		minSize = 1
+	}
+
+	report := &DuplicateReport{
+		Extensions: map[string]ExtensionUsage{},
+	}
+
+	// Group the names of each file by file ID, so that hard links are only
+	// counted once.
+	type file struct {
+		names []string
+		size  int64
+	}
+	var files []*file
+	byID := map[uint64]*file{}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if fi.Size() < minSize {
+			return nil
+		}
+
+		id, nlink, err := LookupFileID(fsys, name, fi)
+		if err != nil {
+			return err
+		}
+
+		if id != 0 && nlink > 1 {
+			if f, ok := byID[id]; ok {
+				f.names = append(f.names, name)
+				return nil
+			}
+		}
+
+		f := &file{names: []string{name}, size: fi.Size()}
+		if id != 0 && nlink > 1 {
+			byID[id] = f
+		}
+		files = append(files, f)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bySize := map[int64][]*file{}
+	for _, f := range files {
+		bySize[f.size] = append(bySize[f.size], f)
+
+		report.Files++
+		report.Size += f.size
+
+		ext := extension(f.names[0])
+		usage := report.Extensions[ext]
+		usage.Files++
+		usage.Size += f.size
+		report.Extensions[ext] = usage
+	}
+
+	// Only files of the same size can have the same contents.
+	var names []string
+	for _, f := range files {
+		if len(bySize[f.size]) > 1 {
+			names = append(names, f.names[0])
+		}
+	}
+
+	sums, err := hashFiles(fsys, names, opts.Concurrency, false)
+	if err != nil {
+		return nil, err
+	}
+
+	type content struct {
+		digest string
+		size   int64
+	}
+	byContent := map[content][]*file{}
+	for _, f := range files {
+		if sum, ok := sums[f.names[0]]; ok {
+			c := content{digest: sum, size: f.size}
+			byContent[c] = append(byContent[c], f)
+		}
+	}
+
+	for c, dups := range byContent {
+		if len(dups) < 2 {
+			continue
+		}
+
+		g := DuplicateGroup{
+			Digest: c.digest,
+			Size:   c.size,
+			Copies: len(dups),
+		}
+		for _, f := range dups {
+			g.Names = append(g.Names, f.names...)
+		}
+		slices.Sort(g.Names)
+
+		// Files are visited in lexical order, so the first copy is treated as
+		// the original.
+		for _, f := range dups[1:] {
+			ext := extension(f.names[0])
+			usage := report.Extensions[ext]
+			usage.DuplicateFiles++
+			usage.DuplicateSize += f.size
+			report.Extensions[ext] = usage
+		}
+
+		report.Savings += g.Savings()
+		report.Groups = append(report.Groups, g)
+	}
+
+	report.UniqueSize = report.Size - report.Savings
+
+	slices.SortFunc(report.Groups, func(a, b DuplicateGroup) int {
+		if c := cmp.Compare(b.Savings(), a.Savings()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Names[0], b.Names[0])
+	})
+
+	return report, nil
+}
+
+// extension returns the lower case extension of a file name.
+func extension(name string) string {
+	return strings.ToLower(path.Ext(name))
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	license := bytes.Repeat([]byte("l"), 1000)
+	icon := bytes.Repeat([]byte("i"), 300)
+
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("usr/share/doc/a", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/share/doc/b", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/share/icons", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/share/doc/a/COPYING", license, 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/doc/b/COPYING", license, 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/doc/b/LICENSE.txt", license, 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/icons/a.PNG", icon, 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/icons/b.png", icon, 0o644))
+	// Same size, different contents.
+	require.NoError(t, fsys.WriteFile("usr/share/icons/c.png", bytes.Repeat([]byte("j"), 300), 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/doc/a/empty", nil, 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/doc/b/empty", nil, 0o644))
+	// Existing hard links aren't duplicates.
+	require.NoError(t, fsys.Link("usr/share/icons/b.png", "usr/share/icons/d.png"))
+	require.NoError(t, fsys.Symlink("a/COPYING", "usr/share/doc/COPYING"))
+
+	digest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	for _, concurrency := range []int{0, 4} {
+		report, err := archivefs.FindDuplicates(fsys, &archivefs.DuplicateOptions{Concurrency: concurrency})
+		require.NoError(t, err)
+
+		require.Equal(t, []archivefs.DuplicateGroup{
+			{
+				Digest: digest(license),
+				Size:   1000,
+				Names:  []string{"usr/share/doc/a/COPYING", "usr/share/doc/b/COPYING", "usr/share/doc/b/LICENSE.txt"},
+				Copies: 3,
+			},
+			{
+				Digest: digest(icon),
+				Size:   300,
+				Names:  []string{"usr/share/icons/a.PNG", "usr/share/icons/b.png", "usr/share/icons/d.png"},
+				Copies: 2,
+			},
+		}, report.Groups)
+		require.Equal(t, int64(2000), report.Groups[0].Savings())
+
+		require.Equal(t, 6, report.Files)
+		require.Equal(t, int64(3900), report.Size)
+		require.Equal(t, int64(2300), report.Savings)
+		require.Equal(t, int64(1600), report.UniqueSize)
+
+		require.Equal(t, map[string]archivefs.ExtensionUsage{
+			"":     {Files: 2, Size: 2000, DuplicateFiles: 1, DuplicateSize: 1000},
+			".txt": {Files: 1, Size: 1000, DuplicateFiles: 1, DuplicateSize: 1000},
+			".png": {Files: 3, Size: 900, DuplicateFiles: 1, DuplicateSize: 300},
+		}, report.Extensions)
+	}
+
+	t.Run("MinSize", func(t *testing.T) {
+		report, err := archivefs.FindDuplicates(fsys, &archivefs.DuplicateOptions{MinSize: 500})
+		require.NoError(t, err)
+
+		require.Len(t, report.Groups, 1)
+		require.Equal(t, 3, report.Files)
+		require.Equal(t, int64(2000), report.Savings)
+	})
+}
@@ -0,0 +1,355 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package encryption encrypts archives at rest with AES-256-GCM. Data is
+// split into fixed size chunks that are authenticated individually (using
+// the STREAM construction), so that an encrypted archive can be decrypted
+// with random access and opened in place (eg. with tarfs.Open or anyfs.Open)
+// without first decrypting it to disk.
+//
+// The encrypted format consists of a header (magic, chunk size, and a random
+// salt) followed by the encrypted chunks. Each file is encrypted with its own
+// key, derived from the provided key and the salt.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// KeySize is the size of an encryption key in bytes.
+const KeySize = 32
+
+const (
+	magic    = "\x89AFSENC\n"
+	saltSize = 32
+	// headerSize is the size of the header, the magic, chunk size and salt.
+	headerSize = len(magic) + 4 + saltSize
+	// defaultChunkSize is the default amount of plaintext in each chunk.
+	defaultChunkSize = 64 * 1024
+	// maxChunkSize limits the size of chunks that will be read.
+	maxChunkSize = 16 << 20
+	// lastChunkFlag is set in the nonce of the final chunk.
+	lastChunkFlag = 1
+)
+
+var (
+	// ErrNotEncrypted is returned when data is not in the encrypted format.
+	ErrNotEncrypted = errors.New("not an encrypted archive")
+	// ErrDecrypt is returned when data cannot be decrypted, because the key
+	// is wrong or the data has been modified or truncated.
+	ErrDecrypt = errors.New("failed to decrypt")
+)
+
+var (
+	_ io.ReaderAt = (*ReaderAt)(nil)
+)
+
+// GenerateKey returns a new random key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// IsEncrypted reports whether header is the start of an encrypted archive.
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(magic))
+}
+
+// ReaderAt decrypts an encrypted archive with random access. The most
+// recently read chunk is cached. It is safe for concurrent use.
+type ReaderAt struct {
+	ra        io.ReaderAt
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int64
+	chunks    int64
+	size      int64
+
+	mu         sync.Mutex
+	cached     int64
+	cachedData []byte
+}
+
+// NewReaderAt returns a ReaderAt for the encrypted archive of the given size
+// in ra. The first and last chunks are decrypted, so that ErrDecrypt is
+// returned immediately if the key is wrong or the data has been truncated.
+func NewReaderAt(ra io.ReaderAt, size int64, key []byte) (*ReaderAt, error) {
+	header := make([]byte, headerSize)
+	if _, err := ra.ReadAt(header, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNotEncrypted
+		}
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	aead, chunkSize, err := parseHeader(header, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every chunk is full, except the last which may be empty.
+	sealedSize := chunkSize + int64(aead.Overhead())
+	payload := size - int64(headerSize)
+	if payload < int64(aead.Overhead()) {
+		return nil, fmt.Errorf("%w: truncated data", ErrDecrypt)
+	}
+
+	chunks := (payload + sealedSize - 1) / sealedSize
+	last := payload - (chunks-1)*sealedSize
+	if last < int64(aead.Overhead()) {
+		return nil, fmt.Errorf("%w: truncated data", ErrDecrypt)
+	}
+
+	r := &ReaderAt{
+		ra:        ra,
+		aead:      aead,
+		header:    header,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		size:      (chunks-1)*chunkSize + last - int64(aead.Overhead()),
+		cached:    -1,
+	}
+
+	if _, err := r.chunk(0); err != nil {
+		return nil, err
+	}
+
+	// Only the last chunk is sealed as such, so truncating the data at a
+	// chunk boundary is detected here.
+	if _, err := r.chunk(chunks - 1); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Size returns the size of the decrypted data.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of decrypted data starting at off.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		index := pos / r.chunkSize
+
+		data, err := r.chunk(index)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], data[pos-index*r.chunkSize:])
+	}
+
+	return n, nil
+}
+
+// chunk returns the decrypted contents of a chunk.
+func (r *ReaderAt) chunk(index int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cached == index {
+		return r.cachedData, nil
+	}
+
+	sealedSize := r.chunkSize + int64(r.aead.Overhead())
+	offset := int64(headerSize) + index*sealedSize
+	if index == r.chunks-1 {
+		sealedSize = r.size - index*r.chunkSize + int64(r.aead.Overhead())
+	}
+
+	sealed := make([]byte, sealedSize)
+	if _, err := r.ra.ReadAt(sealed, offset); err != nil {
+		return nil, fmt.Errorf("failed to read chunk %d: %w", index, err)
+	}
+
+	data, err := r.aead.Open(sealed[:0], chunkNonce(index, index == r.chunks-1), sealed, r.header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d", ErrDecrypt, index)
+	}
+
+	r.cached = index
+	r.cachedData = data
+
+	return data, nil
+}
+
+// Reader decrypts an encrypted archive from a non-seekable io.Reader, eg. so
+// that it can be opened with tarfs.OpenReader.
+type Reader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	index     int64
+	// sealed holds the next chunk, and one byte more to detect the last
+	// chunk.
+	sealed []byte
+	data   []byte
+	err    error
+}
+
+// NewReader returns a Reader that decrypts the encrypted archive read from
+// r.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotEncrypted
+		}
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	aead, chunkSize, err := parseHeader(header, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:         r,
+		aead:      aead,
+		header:    header,
+		chunkSize: int(chunkSize),
+		sealed:    make([]byte, 0, int(chunkSize)+aead.Overhead()+1),
+	}, nil
+}
+
+// Read reads decrypted data, which is only returned once the chunk it is in
+// has been authenticated.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		r.err = r.next()
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+// next decrypts the next chunk.
+func (r *Reader) next() error {
+	sealedSize := r.chunkSize + r.aead.Overhead()
+
+	// Read the remainder of the chunk, and a byte of the next chunk.
+	start := len(r.sealed)
+	r.sealed = r.sealed[:cap(r.sealed)]
+	n, err := io.ReadFull(r.r, r.sealed[start:])
+	r.sealed = r.sealed[:start+n]
+
+	last := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	}
+
+	sealed := r.sealed
+	if !last {
+		sealed = r.sealed[:sealedSize]
+	}
+
+	data, err := r.aead.Open(nil, chunkNonce(r.index, last), sealed, r.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrDecrypt, r.index)
+	}
+	r.data = data
+	r.index++
+
+	if last {
+		// Read returns EOF once the remaining data has been consumed.
+		r.sealed = r.sealed[:0]
+		return io.EOF
+	}
+
+	// Keep the byte of the next chunk.
+	r.sealed = append(r.sealed[:0], r.sealed[sealedSize:]...)
+
+	return nil
+}
+
+// parseHeader validates a header and returns the cipher for the data that
+// follows it.
+func parseHeader(header, key []byte) (cipher.AEAD, int64, error) {
+	if !IsEncrypted(header) {
+		return nil, 0, ErrNotEncrypted
+	}
+
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(magic):]))
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, 0, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+
+	aead, err := newAEAD(key, header[len(magic)+4:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return aead, chunkSize, nil
+}
+
+// newAEAD derives the key of a file from its salt, and returns its cipher.
+func newAEAD(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size: %d", len(key))
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk, its index followed by a flag
+// that is set for the last chunk, so that chunks cannot be reordered and the
+// data cannot be truncated.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = lastChunkFlag
+	}
+
+	return nonce
+}
@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package encryption_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+
+	"github.com/dpeckett/archivefs/anyfs"
+	"github.com/dpeckett/archivefs/encryption"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	key, err := encryption.GenerateKey()
+	require.NoError(t, err)
+
+	encrypt := func(t *testing.T, data []byte) []byte {
+		var buf bytes.Buffer
+		w, err := encryption.NewWriter(&buf, key, &encryption.WriterOptions{ChunkSize: 1000})
+		require.NoError(t, err)
+
+		// Write in odd sized pieces, to span chunks.
+		for p := data; len(p) > 0; {
+			n := min(len(p), 333)
+			_, err := w.Write(p[:n])
+			require.NoError(t, err)
+			p = p[n:]
+		}
+		require.NoError(t, w.Close())
+
+		_, err = w.Write([]byte("more"))
+		require.Error(t, err)
+
+		return buf.Bytes()
+	}
+
+	for _, size := range []int{0, 1, 1000, 2000, 2500} {
+		t.Run(fmt.Sprintf("Size%d", size), func(t *testing.T) {
+			data := make([]byte, size)
+			_, err := rand.New(rand.NewSource(int64(size))).Read(data)
+			require.NoError(t, err)
+
+			encrypted := encrypt(t, data)
+
+			ra, err := encryption.NewReaderAt(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+			require.NoError(t, err)
+			require.Equal(t, int64(size), ra.Size())
+
+			all, err := io.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+			require.NoError(t, err)
+			require.Equal(t, data, all)
+
+			if size > 0 {
+				off := size / 3
+				buf := make([]byte, size+1)
+				n, err := ra.ReadAt(buf, int64(off))
+				require.ErrorIs(t, err, io.EOF)
+				require.Equal(t, data[off:], buf[:n])
+			}
+
+			r, err := encryption.NewReader(bytes.NewReader(encrypted), key)
+			require.NoError(t, err)
+
+			all, err = io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, data, all)
+		})
+	}
+
+	data := bytes.Repeat([]byte("hello world\n"), 500)
+	encrypted := encrypt(t, data)
+
+	t.Run("WrongKey", func(t *testing.T) {
+		other, err := encryption.GenerateKey()
+		require.NoError(t, err)
+
+		_, err = encryption.NewReaderAt(bytes.NewReader(encrypted), int64(len(encrypted)), other)
+		require.ErrorIs(t, err, encryption.ErrDecrypt)
+
+		r, err := encryption.NewReader(bytes.NewReader(encrypted), other)
+		require.NoError(t, err)
+
+		_, err = io.ReadAll(r)
+		require.ErrorIs(t, err, encryption.ErrDecrypt)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		// Drop the last chunk.
+		truncated := encrypted[:len(encrypted)-(len(data)%1000+16)]
+
+		_, err := encryption.NewReaderAt(bytes.NewReader(truncated), int64(len(truncated)), key)
+		require.ErrorIs(t, err, encryption.ErrDecrypt)
+
+		r, err := encryption.NewReader(bytes.NewReader(truncated), key)
+		require.NoError(t, err)
+
+		_, err = io.ReadAll(r)
+		require.ErrorIs(t, err, encryption.ErrDecrypt)
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		modified := bytes.Clone(encrypted)
+		modified[len(modified)/2] ^= 1
+
+		ra, err := encryption.NewReaderAt(bytes.NewReader(modified), int64(len(modified)), key)
+		require.NoError(t, err)
+
+		_, err = io.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+		require.ErrorIs(t, err, encryption.ErrDecrypt)
+	})
+
+	t.Run("NotEncrypted", func(t *testing.T) {
+		_, err := encryption.NewReaderAt(bytes.NewReader(data), int64(len(data)), key)
+		require.ErrorIs(t, err, encryption.ErrNotEncrypted)
+
+		_, err = encryption.NewReader(bytes.NewReader(nil), key)
+		require.ErrorIs(t, err, encryption.ErrNotEncrypted)
+	})
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	key, err := encryption.GenerateKey()
+	require.NoError(t, err)
+
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+
+	var encrypted bytes.Buffer
+	w, err := encryption.NewWriter(&encrypted, key, nil)
+	require.NoError(t, err)
+	require.NoError(t, anyfs.Convert(w, anyfs.FormatTarZstd, src, nil))
+	require.NoError(t, w.Close())
+
+	_, _, err = anyfs.Open(bytes.NewReader(encrypted.Bytes()))
+	require.ErrorIs(t, err, anyfs.ErrEncrypted)
+
+	t.Run("ReaderAt", func(t *testing.T) {
+		ra, err := encryption.NewReaderAt(bytes.NewReader(encrypted.Bytes()), int64(encrypted.Len()), key)
+		require.NoError(t, err)
+
+		fsys, format, err := anyfs.Open(ra)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, fsys.(io.Closer).Close())
+		})
+		require.Equal(t, anyfs.FormatTarZstd, format)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(hostname))
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		r, err := encryption.NewReader(bytes.NewReader(encrypted.Bytes()), key)
+		require.NoError(t, err)
+
+		fsys, err := tarfs.OpenReader(r, &tarfs.Options{Decompress: true})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, fsys.Close())
+		})
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(hostname))
+	})
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errClosed = errors.New("writer is closed")
+
+// WriterOptions configures how an archive is encrypted.
+type WriterOptions struct {
+	// ChunkSize is the amount of data encrypted in each chunk, defaults to
+	// 64 KiB. Random access reads decrypt at least a whole chunk.
+	ChunkSize int
+}
+
+// Writer encrypts data written to it, eg. an archive created with
+// tarfs.Create.
+type Writer struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	index     int64
+	buf       []byte
+	err       error
+}
+
+// NewWriter returns a Writer that writes data encrypted with key to w. The
+// header is written immediately.
+func NewWriter(w io.Writer, key []byte, opts *WriterOptions) (*Writer, error) {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	chunkSize = min(chunkSize, maxChunkSize)
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(chunkSize))
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:         w,
+		aead:      aead,
+		header:    header,
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// Write encrypts p, writing a chunk each time more than a full chunk of data
+// has been buffered (the final chunk is only known once the writer is
+// closed).
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	var n int
+	for len(p) > 0 {
+		if len(w.buf) == w.chunkSize {
+			if err := w.flushChunk(false); err != nil {
+				return n, err
+			}
+		}
+
+		chunk := min(len(p), w.chunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:chunk]...)
+		p = p[chunk:]
+		n += chunk
+	}
+
+	return n, nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := w.flushChunk(true); err != nil {
+		return err
+	}
+
+	w.err = errClosed
+	return nil
+}
+
+func (w *Writer) flushChunk(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.index, last), w.buf, w.header)
+	if _, err := w.w.Write(sealed); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.index++
+	w.buf = w.buf[:0]
+
+	return nil
+}
@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"time"
+)
+
+// Entry describes a file in a filesystem, gathering the metadata supplied by
+// each backend (through fs.FileInfo.Sys() and the optional interfaces) so that
+// it can be consumed without knowing where it came from.
+type Entry struct {
+	// Name is the slash-separated path of the file.
+	Name string
+	// Mode is the file mode and permission bits.
+	Mode fs.FileMode
+	// Size is the length in bytes of a regular file, and zero otherwise.
+	Size int64
+	// ModTime is the modification time.
+	ModTime time.Time
+	// AccessTime is the access time, if known.
+	AccessTime time.Time
+	// ChangeTime is the change time, if known.
+	ChangeTime time.Time
+	// Uid is the numeric user ID of the owner, zero (root) if unknown.
+	Uid int
+	// Gid is the numeric group ID of the owner, zero (root) if unknown.
+	Gid int
+	// Linkname is the target of a symbolic link.
+	Linkname string
+	// HardLink is the name of an earlier entry that this entry is a hard link
+	// to. It is only set by an Iterator, in which case the contents of the
+	// entry are empty.
+	HardLink string
+	// Major is the major device number of a device file.
+	Major uint32
+	// Minor is the minor device number of a device file.
+	Minor uint32
+	// Xattrs holds the extended attributes of the file, if known.
+	Xattrs map[string]string
+	// Ino identifies the underlying file, hard links to the same file share
+	// the same id (see LinkFS). It is zero if unknown.
+	Ino uint64
+	// Nlink is the number of hard links to the file.
+	Nlink int
+	// Attributes holds the Windows attributes of the file (eg.
+	// FileAttributeReadOnly), if known.
+	Attributes uint32
+	// Info is the FileInfo the entry was populated from, for access to
+	// backend specific metadata.
+	Info fs.FileInfo
+}
+
+// WalkInfoFunc is the type of the function called by WalkInfo to visit each
+// file. As for fs.WalkDirFunc, the function may return fs.SkipDir to skip a
+// directory, or fs.SkipAll to stop the walk. If err is non-nil the entry is
+// nil, and the function decides how to handle the error (returning nil
+// continues the walk).
+type WalkInfoFunc func(path string, entry *Entry, err error) error
+
+// WalkInfo walks the file tree rooted at the root of fsys in lexical order,
+// calling fn with an Entry describing each file.
+func WalkInfo(fsys fs.FS, fn WalkInfoFunc) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fn(name, nil, err)
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return fn(name, nil, err)
+		}
+
+		entry, err := NewEntry(fsys, name, fi)
+		if err != nil {
+			return fn(name, nil, err)
+		}
+
+		return fn(name, entry, nil)
+	})
+}
+
+// NewEntry returns an Entry describing the named file, populated from its
+// FileInfo (which should not follow symbolic links) and the optional
+// interfaces implemented by fsys.
+func NewEntry(fsys fs.FS, name string, fi fs.FileInfo) (*Entry, error) {
+	e := NewEntryFromInfo(name, fi)
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		target, err := readLink(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		e.Linkname = target
+	}
+
+	var err error
+	e.Ino, e.Nlink, err = LookupFileID(fsys, name, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// NewEntryFromInfo returns an Entry describing a file, populated only from
+// its FileInfo. This suits files that are not part of a filesystem, eg. the
+// entries of an archive that is being streamed.
+func NewEntryFromInfo(name string, fi fs.FileInfo) *Entry {
+	e := &Entry{
+		Name:    name,
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+		Xattrs:  Xattrs(fi),
+		Nlink:   1,
+		Info:    fi,
+	}
+
+	if fi.Mode().IsRegular() {
+		e.Size = fi.Size()
+	}
+
+	e.Uid, e.Gid, _ = LookupOwner(fi)
+
+	if fi.Mode()&fs.ModeDevice != 0 {
+		e.Major, e.Minor, _ = LookupDevice(fi)
+	}
+
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		e.AccessTime = hdr.AccessTime
+		e.ChangeTime = hdr.ChangeTime
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			e.Linkname = hdr.Linkname
+		}
+	}
+
+	if attrs, ok := fi.Sys().(FileAttributes); ok {
+		e.Attributes = attrs.FileAttributes()
+	}
+
+	if fileID, ok := fi.Sys().(FileID); ok {
+		e.Ino, e.Nlink = fileID.FileID()
+		e.Nlink = max(e.Nlink, 1)
+	}
+
+	return e
+}
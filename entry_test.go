@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupOwnerAndDevice(t *testing.T) {
+	t.Run("TarHeader", func(t *testing.T) {
+		fi := (&tar.Header{Typeflag: tar.TypeChar, Name: "null", Mode: 0o666, Uid: 1000, Gid: 1001, Devmajor: 1, Devminor: 3}).FileInfo()
+
+		uid, gid, ok := archivefs.LookupOwner(fi)
+		require.True(t, ok)
+		require.Equal(t, 1000, uid)
+		require.Equal(t, 1001, gid)
+
+		major, minor, ok := archivefs.LookupDevice(fi)
+		require.True(t, ok)
+		require.Equal(t, uint32(1), major)
+		require.Equal(t, uint32(3), minor)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		fi, err := fs.Stat(fstest.MapFS{"hello": &fstest.MapFile{Data: []byte("hello")}}, "hello")
+		require.NoError(t, err)
+
+		_, _, ok := archivefs.LookupOwner(fi)
+		require.False(t, ok)
+
+		_, _, ok = archivefs.LookupDevice(fi)
+		require.False(t, ok)
+	})
+}
+
+func TestWalkInfo(t *testing.T) {
+	t.Run("MemFS", func(t *testing.T) {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("dev", 0o755))
+		require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, fsys.WriteFile("usr/bin/busybox", []byte("#!/bin/sh"), 0o755))
+		require.NoError(t, fsys.SetOwner("usr/bin/busybox", 1000, 1001))
+		require.NoError(t, fsys.SetXattr("usr/bin/busybox", "security.capability", "cap"))
+		require.NoError(t, fsys.Link("usr/bin/busybox", "usr/bin/ash"))
+		require.NoError(t, fsys.Symlink("busybox", "usr/bin/sh"))
+		require.NoError(t, fsys.Mknod("dev/null", fs.ModeDevice|fs.ModeCharDevice|0o666, 1, 3))
+
+		entries := map[string]*archivefs.Entry{}
+		require.NoError(t, archivefs.WalkInfo(fsys, func(path string, entry *archivefs.Entry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			require.Equal(t, path, entry.Name)
+			entries[path] = entry
+			return nil
+		}))
+
+		require.Len(t, entries, 8)
+
+		busybox := entries["usr/bin/busybox"]
+		require.Equal(t, fs.FileMode(0o755), busybox.Mode)
+		require.Equal(t, int64(9), busybox.Size)
+		require.Equal(t, 1000, busybox.Uid)
+		require.Equal(t, 1001, busybox.Gid)
+		require.Equal(t, map[string]string{"security.capability": "cap"}, busybox.Xattrs)
+		require.NotZero(t, busybox.Ino)
+		require.Equal(t, 2, busybox.Nlink)
+		require.Equal(t, busybox.Ino, entries["usr/bin/ash"].Ino)
+
+		sh := entries["usr/bin/sh"]
+		require.Equal(t, fs.ModeSymlink, sh.Mode.Type())
+		require.Equal(t, "busybox", sh.Linkname)
+
+		null := entries["dev/null"]
+		require.Equal(t, uint32(1), null.Major)
+		require.Equal(t, uint32(3), null.Minor)
+		require.Zero(t, null.Size)
+
+		require.Zero(t, entries["usr"].Size)
+	})
+
+	t.Run("TarFS", func(t *testing.T) {
+		mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		atime := mtime.Add(time.Hour)
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       "etc/hostname",
+			Mode:       0o644,
+			Uid:        1000,
+			ModTime:    mtime,
+			AccessTime: atime,
+			Format:     tar.FormatPAX,
+		}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     "etc/hostname.bak",
+			Linkname: "etc/hostname",
+		}))
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		entries := map[string]*archivefs.Entry{}
+		require.NoError(t, archivefs.WalkInfo(fsys, func(path string, entry *archivefs.Entry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			entries[path] = entry
+			return nil
+		}))
+
+		hostname := entries["etc/hostname"]
+		require.Equal(t, 1000, hostname.Uid)
+		require.True(t, hostname.ModTime.Equal(mtime))
+		require.True(t, hostname.AccessTime.Equal(atime))
+		require.Equal(t, 2, hostname.Nlink)
+		require.Equal(t, hostname.Ino, entries["etc/hostname.bak"].Ino)
+	})
+
+	t.Run("SkipDir", func(t *testing.T) {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("a/b", 0o755))
+		require.NoError(t, fsys.MkdirAll("c", 0o755))
+
+		var paths []string
+		require.NoError(t, archivefs.WalkInfo(fsys, func(path string, entry *archivefs.Entry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			paths = append(paths, path)
+			if path == "a" {
+				return fs.SkipDir
+			}
+
+			return nil
+		}))
+
+		require.Equal(t, []string{".", "a", "c"}, paths)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errBroken := errors.New("broken")
+
+		err := archivefs.WalkInfo(memfs.New(), func(path string, entry *archivefs.Entry, err error) error {
+			return errBroken
+		})
+		require.ErrorIs(t, err, errBroken)
+
+		// Symbolic links can't be read without ReadLinkFS.
+		fsys := memfs.New()
+		require.NoError(t, fsys.Symlink("target", "link"))
+
+		var failed []string
+		require.NoError(t, archivefs.WalkInfo(readDirOnlyFS{fsys}, func(path string, entry *archivefs.Entry, err error) error {
+			if err != nil {
+				require.Nil(t, entry)
+				failed = append(failed, path)
+			}
+
+			return nil
+		}))
+
+		require.Equal(t, []string{"link"}, failed)
+	})
+}
+
+// readDirOnlyFS hides the optional interfaces of a filesystem.
+type readDirOnlyFS struct {
+	fsys *memfs.FS
+}
+
+func (fsys readDirOnlyFS) Open(name string) (fs.File, error) {
+	return fsys.fsys.Open(name)
+}
+
+func (fsys readDirOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fsys.fsys.ReadDir(name)
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// chunkRun is a run of consecutive chunks of a chunk based inode, that are
+// either all holes or stored in consecutive blocks of the same device.
+type chunkRun struct {
+	// offset is the offset of the run within the file.
+	offset int64
+	// length is the length of the run (the last chunk may be partial).
+	length int64
+	// addr is the block address of the first chunk, or NullAddr for holes.
+	addr uint32
+	// device is the id of the device holding the chunks, 0 for the image
+	// itself.
+	device uint16
+}
+
+// chunkRuns reads the block map (or chunk indexes) of a chunk based inode.
+func (ino *Inode) chunkRuns() ([]chunkRun, error) {
+	blockSize := int64(ino.image.BlockSize())
+	chunkSize := int64(1) << ino.chunkBits
+	chunks := (int64(ino.size) + chunkSize - 1) >> ino.chunkBits
+
+	entrySize := int64(4)
+	if ino.chunkIndexes {
+		entrySize = ChunkIndexSize
+	}
+
+	// The block map must fit within the image.
+	if chunks > ino.image.sb.BlockAddrToOffset(ino.image.Blocks())/entrySize {
+		return nil, &archiveerrors.ErrCorrupted{Offset: ino.chunksOff, Detail: fmt.Sprintf("invalid chunk count at inode %d", ino.nid)}
+	}
+
+	buf, err := ino.image.bytesAt(ino.chunksOff, chunks*entrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Device ids are masked to the number of devices, as by Linux.
+	slots := ino.image.slots
+	deviceMask := uint16(1)<<bits.Len16(uint16(len(slots))) - 1
+
+	var runs []chunkRun
+	for i := int64(0); i < chunks; i++ {
+		var (
+			addr   uint32
+			device uint16
+		)
+		if ino.chunkIndexes {
+			device = binary.LittleEndian.Uint16(buf[i*entrySize+2:]) & deviceMask
+			addr = binary.LittleEndian.Uint32(buf[i*entrySize+4:])
+		} else {
+			addr = binary.LittleEndian.Uint32(buf[i*entrySize:])
+		}
+		offset := i * chunkSize
+		length := min(chunkSize, int64(ino.size)-offset)
+
+		blocks := int64(ino.image.Blocks())
+		if device > 0 {
+			if int(device) > len(slots) {
+				return nil, &archiveerrors.ErrCorrupted{Offset: ino.chunksOff + i*entrySize, Detail: fmt.Sprintf("invalid device of chunk %d at inode %d", i, ino.nid)}
+			}
+
+			// The size of devices isn't always recorded.
+			blocks = int64(slots[device-1].Blocks)
+			if blocks == 0 {
+				blocks = math.MaxUint32
+			}
+		}
+
+		if addr != NullAddr && int64(addr)+(length+blockSize-1)/blockSize > blocks {
+			return nil, &archiveerrors.ErrCorrupted{Offset: ino.chunksOff + i*entrySize, Detail: fmt.Sprintf("invalid block address of chunk %d at inode %d", i, ino.nid)}
+		}
+
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if (addr == NullAddr && last.addr == NullAddr) ||
+				(addr != NullAddr && last.addr != NullAddr && device == last.device && int64(addr) == int64(last.addr)+last.length/blockSize) {
+				last.length += length
+				continue
+			}
+		}
+
+		runs = append(runs, chunkRun{offset: offset, length: length, addr: addr, device: device})
+	}
+
+	return runs, nil
+}
+
+// DataExtents returns the extents of the file that contain data. Holes are
+// only possible in chunk based inodes, other inodes consist of a single
+// extent.
+func (ino *Inode) DataExtents() ([]archivefs.Extent, error) {
+	if ino.DataLayout() != InodeDataLayoutChunkBased {
+		if ino.size == 0 {
+			return nil, nil
+		}
+
+		return []archivefs.Extent{{Length: int64(ino.size)}}, nil
+	}
+
+	runs, err := ino.chunkRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	extents := []archivefs.Extent{}
+	for _, run := range runs {
+		if run.addr == NullAddr {
+			continue
+		}
+
+		// Runs of data may be stored in different places in the image, but
+		// are contiguous within the file.
+		if n := len(extents); n > 0 && extents[n-1].End() == run.offset {
+			extents[n-1].Length += run.length
+			continue
+		}
+
+		extents = append(extents, archivefs.Extent{Offset: run.offset, Length: run.length})
+	}
+
+	return extents, nil
+}
+
+// zeroReader reads an endless stream of zeros, eg. for holes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs
+
+import (
+	"github.com/dpeckett/archivefs"
+)
+
+var (
+	_ archivefs.Device        = (*Inode)(nil)
+	_ archivefs.FileID        = (*Inode)(nil)
+	_ archivefs.AllocatedSize = (*Inode)(nil)
+)
+
+// encodeDev encodes a device number in the format used by the kernel
+// (new_encode_dev).
+func encodeDev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
+
+// decodeDev decodes a device number encoded with encodeDev.
+func decodeDev(dev uint32) (major, minor uint32) {
+	major = (dev & 0xfff00) >> 8
+	minor = (dev & 0xff) | ((dev >> 12) & 0xfff00)
+	return
+}
@@ -27,27 +27,66 @@ package erofs
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/readdir"
 )
 
 var (
-	_ fs.FS        = (*Filesystem)(nil)
-	_ fs.ReadDirFS = (*Filesystem)(nil)
-	_ fs.StatFS    = (*Filesystem)(nil)
+	_ fs.FS              = (*Filesystem)(nil)
+	_ fs.ReadDirFS       = (*Filesystem)(nil)
+	_ fs.StatFS          = (*Filesystem)(nil)
+	_ archivefs.LinkFS   = (*Filesystem)(nil)
+	_ archivefs.SparseFS = (*Filesystem)(nil)
+	_ fs.ReadDirFile     = (*dir)(nil)
 )
 
+// ErrSymlinkNotFollowed is returned in strict mode when resolving a path
+// would require following a symbolic link.
+var ErrSymlinkNotFollowed = archiveerrors.Define(archiveerrors.ErrInsecurePath, "symlink not followed in strict mode")
+
+// ErrDeviceNotFound is returned when reading data stored on an extra device
+// of the image that was not provided (see Options).
+var ErrDeviceNotFound = errors.New("device not found")
+
+// Options configures how an image is opened.
+type Options struct {
+	// Strict enables the most defensive behavior, for images from untrusted
+	// sources: symbolic links are never followed when resolving paths (use
+	// ReadLink to read them explicitly), and directories containing invalid
+	// entry names are rejected as corrupted.
+	Strict bool
+	// Devices are the extra devices of an image with a device table (see
+	// Image.DeviceSlots), in the order of the table. Data stored on missing
+	// (or nil) devices can't be read, but the rest of the image can be.
+	Devices []io.ReaderAt
+}
+
 type Filesystem struct {
-	image *Image
-	root  *dirEntry
+	image  *Image
+	root   *dirEntry
+	strict bool
 }
 
 func Open(src io.ReaderAt) (*Filesystem, error) {
-	image := &Image{src: src}
+	return OpenWithOptions(src, nil)
+}
+
+// OpenWithOptions opens an EROFS image with the given options.
+func OpenWithOptions(src io.ReaderAt, opts *Options) (*Filesystem, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	image := &Image{src: src, devices: opts.Devices}
 
 	if err := image.initSuperBlock(); err != nil {
 		return nil, err
@@ -60,6 +99,7 @@ func Open(src io.ReaderAt) (*Filesystem, error) {
 			nid:   image.RootNid(),
 			typ:   FT_DIR,
 		},
+		strict: opts.Strict,
 	}, nil
 }
 
@@ -69,17 +109,30 @@ func (fsys *Filesystem) Open(name string) (fs.File, error) {
 		return nil, err
 	}
 
-	return &file{
+	f := file{
 		image: fsys.image,
 		de:    de,
-	}, nil
+	}
+
+	if de.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dir{file: f, Entries: readdir.New(entries)}, nil
+	}
+
+	return &f, nil
 }
 
 func (fsys *Filesystem) ReadDir(name string) ([]fs.DirEntry, error) {
-	de, err := fsys.resolve(name, false)
+	r := &resolution{dirs: map[uint64]bool{}}
+	de, err := fsys.resolveWith(name, false, r)
 	if err != nil {
 		return nil, err
 	}
+	r.dirs[de.nid] = true
 
 	if !de.IsDir() {
 		return nil, errors.New("not a directory")
@@ -97,6 +150,16 @@ func (fsys *Filesystem) ReadDir(name string) ([]fs.DirEntry, error) {
 			return nil
 		}
 
+		if fsys.strict && strings.ContainsAny(name, "/\x00") {
+			return &archiveerrors.ErrCorrupted{Offset: -1, Detail: fmt.Sprintf("invalid entry name %q at inode %d", name, ino.Nid())}
+		}
+
+		// Directories can't be hard linked, so an entry referring to a
+		// directory traversed to reach this one would form a cycle.
+		if r.dirs[nid] {
+			return &archiveerrors.ErrCorrupted{Offset: -1, Detail: fmt.Sprintf("directory cycle at inode %d", ino.Nid())}
+		}
+
 		dirents = append(dirents, &dirEntry{
 			image: de.image,
 			name:  name,
@@ -166,11 +229,66 @@ func (fsys *Filesystem) StatLink(name string) (fs.FileInfo, error) {
 	}, nil
 }
 
+// FileID returns the inode number of the named file, without following any
+// symbolic links, and the number of hard links to it.
+func (fsys *Filesystem) FileID(name string) (id uint64, nlink int, err error) {
+	de, err := fsys.resolve(name, true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ino, err := de.getInode()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	id, nlink = ino.FileID()
+	return id, nlink, nil
+}
+
+// DataExtents returns the extents of the named regular file that contain
+// data, holes are only possible in chunk based inodes.
+func (fsys *Filesystem) DataExtents(name string) ([]archivefs.Extent, error) {
+	de, err := fsys.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ino, err := de.getInode()
+	if err != nil {
+		return nil, err
+	}
+
+	if !ino.IsRegular() {
+		return nil, &fs.PathError{Op: "dataextents", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return ino.DataExtents()
+}
+
 func (fsys *Filesystem) resolve(name string, noResolveLastSymlink bool) (*dirEntry, error) {
+	return fsys.resolveWith(name, noResolveLastSymlink, &resolution{})
+}
+
+// resolution is the state of the resolution of a single path.
+type resolution struct {
+	// hops is the number of symbolic links followed.
+	hops int
+	// dirs records the inode numbers of the directories traversed, if not
+	// nil.
+	dirs map[uint64]bool
+}
+
+// resolveWith resolves a path, recording its progress in r.
+func (fsys *Filesystem) resolveWith(name string, noResolveLastSymlink bool, r *resolution) (*dirEntry, error) {
 	de := fsys.root
 
 	components := splitPath(name)
 	for i, comp := range components {
+		if r.dirs != nil {
+			r.dirs[de.nid] = true
+		}
+
 		child, err := de.lookup(comp)
 		if err != nil {
 			return nil, err
@@ -182,6 +300,15 @@ func (fsys *Filesystem) resolve(name string, noResolveLastSymlink bool) (*dirEnt
 		}
 
 		if ino.IsSymlink() && !(noResolveLastSymlink && i == len(components)-1) {
+			if fsys.strict {
+				return nil, fmt.Errorf("symlink %q: %w", strings.Join(components[:i+1], "/"), ErrSymlinkNotFollowed)
+			}
+
+			r.hops++
+			if r.hops > archivefs.MaxSymlinkHops {
+				return nil, fmt.Errorf("too many levels of symbolic links: %s: %w", name, fs.ErrInvalid)
+			}
+
 			link, err := ino.Readlink()
 			if err != nil {
 				return nil, err
@@ -194,7 +321,7 @@ func (fsys *Filesystem) resolve(name string, noResolveLastSymlink bool) (*dirEnt
 				link = filepath.Join(strings.Join(components[:i], "/"), link)
 			}
 
-			child, err = fsys.resolve(link, noResolveLastSymlink)
+			child, err = fsys.resolveWith(link, noResolveLastSymlink, r)
 			if err != nil {
 				return nil, err
 			}
@@ -235,6 +362,12 @@ func (f *file) Stat() (fs.FileInfo, error) {
 	return f.de.Info()
 }
 
+// dir is an open directory.
+type dir struct {
+	file
+	readdir.Entries
+}
+
 type dirEntry struct {
 	image         *Image
 	name          string
@@ -242,6 +375,7 @@ type dirEntry struct {
 	nid           uint64
 	readInodeOnce sync.Once
 	inode         *Inode
+	inodeErr      error
 }
 
 func (de *dirEntry) Name() string {
@@ -252,13 +386,15 @@ func (de *dirEntry) IsDir() bool {
 	return de.typ == FT_DIR
 }
 
+// Type returns the type bits of the entry, as fs.DirEntry requires, the
+// permission bits are only reported by Info.
 func (de *dirEntry) Type() fs.FileMode {
 	ino, err := de.getInode()
 	if err != nil {
 		return 0
 	}
 
-	return ino.Mode()
+	return ino.Mode().Type()
 }
 
 func (de *dirEntry) Info() (fs.FileInfo, error) {
@@ -297,11 +433,16 @@ func (de *dirEntry) getInode() (Inode, error) {
 	de.readInodeOnce.Do(func() {
 		ino, err := de.image.Inode(de.nid)
 		if err != nil {
-			panic(err)
+			de.inodeErr = err
+			return
 		}
 		de.inode = &ino
 	})
 
+	if de.inodeErr != nil {
+		return Inode{}, de.inodeErr
+	}
+
 	return *de.inode, nil
 }
 
@@ -10,15 +10,24 @@
 package erofs_test
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/archivefstest"
 	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/rogpeppe/go-internal/dirhash"
 
 	"github.com/stretchr/testify/require"
@@ -34,6 +43,15 @@ func TestEROFS(t *testing.T) {
 	fsys, err := erofs.Open(f)
 	require.NoError(t, err)
 
+	t.Run("Conformance", func(t *testing.T) {
+		// Names are cleaned leniently (eg. a leading slash is accepted), so
+		// check conformance through a view that rejects invalid names.
+		view, err := archivefs.Filter(fsys, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, archivefstest.TestFS(view, "etc/passwd", "init", "bin", "usr/bin/toybox"))
+	})
+
 	t.Run("Open", func(t *testing.T) {
 		t.Run("File", func(t *testing.T) {
 			f, err := fsys.Open("/usr/bin/toybox")
@@ -91,25 +109,63 @@ func TestEROFS(t *testing.T) {
 
 		require.Len(t, entries, 5)
 
+		var fi fs.FileInfo
+
 		require.Equal(t, "group", entries[0].Name())
 		require.False(t, entries[0].IsDir())
-		require.Equal(t, 0o644, int(entries[0].Type()))
+		require.Zero(t, entries[0].Type())
+
+		fi, err = entries[0].Info()
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
 
 		require.Equal(t, "os-release", entries[1].Name())
 		require.False(t, entries[1].IsDir())
-		require.Equal(t, 0o644, int(entries[1].Type()))
+		require.Zero(t, entries[1].Type())
+
+		fi, err = entries[1].Info()
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
 
 		require.Equal(t, "passwd", entries[2].Name())
 		require.False(t, entries[2].IsDir())
-		require.Equal(t, 0o644, int(entries[2].Type()))
+		require.Zero(t, entries[2].Type())
+
+		fi, err = entries[2].Info()
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
 
 		require.Equal(t, "rc", entries[3].Name())
 		require.True(t, entries[3].IsDir())
-		require.True(t, entries[3].Type()&fs.ModeDir > 0)
+		require.Equal(t, fs.ModeDir, entries[3].Type())
 
 		require.Equal(t, "resolv.conf", entries[4].Name())
 		require.False(t, entries[4].IsDir())
-		require.Equal(t, 0o644, int(entries[4].Type()))
+		require.Zero(t, entries[4].Type())
+
+		fi, err = entries[4].Info()
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
+	})
+
+	t.Run("OpenDir", func(t *testing.T) {
+		f, err := fsys.Open("etc")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		dir, ok := f.(fs.ReadDirFile)
+		require.True(t, ok)
+
+		entries, err := dir.ReadDir(2)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, "group", entries[0].Name())
+
+		entries, err = dir.ReadDir(-1)
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
 	})
 
 	t.Run("Stat", func(t *testing.T) {
@@ -278,3 +334,359 @@ func TestEROFSCreate(t *testing.T) {
 
 	require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
 }
+
+func TestEROFSSparse(t *testing.T) {
+	srcFile, err := os.Open("../tarfs/testdata/sparse-holes.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srcFile.Close())
+	})
+
+	srcFS, err := tarfs.Open(srcFile)
+	require.NoError(t, err)
+
+	dstFile, err := os.Create(filepath.Join(t.TempDir(), "sparse.img"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dstFile.Close())
+	})
+
+	require.NoError(t, erofs.Create(dstFile, srcFS))
+
+	dstFS, err := erofs.Open(dstFile)
+	require.NoError(t, err)
+
+	// The holes are preserved.
+	extents, err := dstFS.DataExtents("sparse.db")
+	require.NoError(t, err)
+
+	require.Equal(t, []archivefs.Extent{{Length: 4096}, {Offset: 65536, Length: 4096}}, extents)
+
+	fi, err := dstFS.Stat("sparse.db")
+	require.NoError(t, err)
+
+	require.Equal(t, int64(81920), fi.Size())
+	require.Equal(t, int64(8192), fi.Sys().(archivefs.AllocatedSize).AllocatedSize())
+
+	want, err := fs.ReadFile(srcFS, "sparse.db")
+	require.NoError(t, err)
+
+	got, err := fs.ReadFile(dstFS, "sparse.db")
+	require.NoError(t, err)
+
+	require.Equal(t, want, got)
+
+	// Other files consist of a single extent.
+	f, err := os.Open("testdata/toybox.img")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	extents, err = fsys.DataExtents("usr/bin/toybox")
+	require.NoError(t, err)
+
+	require.Equal(t, []archivefs.Extent{{Length: 849544}}, extents)
+}
+
+func TestEROFSXattrs(t *testing.T) {
+	motd := bytes.Repeat([]byte("hello\n"), 1000)
+	long := strings.Repeat("x", 4000)
+
+	image := createImage(t, func(fsys *memfs.FS) {
+		require.NoError(t, fsys.MkdirAll("etc", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/motd", motd, 0o644))
+		require.NoError(t, fsys.WriteFile("etc/issue", []byte("welcome\n"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/empty", nil, 0o644))
+		require.NoError(t, fsys.SetXattr("etc/empty", "user.comment", "empty"))
+		require.NoError(t, fsys.SetXattr("etc", "trusted.overlay.opaque", "y"))
+		require.NoError(t, fsys.SetXattr("etc/hostname", "user.comment", "hostname"))
+		require.NoError(t, fsys.SetXattr("etc/hostname", "security.selinux", "system_u:object_r:etc_t:s0"))
+		require.NoError(t, fsys.SetXattr("etc/motd", "user.empty", ""))
+		// Too large to be inlined with the data.
+		require.NoError(t, fsys.SetXattr("etc/issue", "user.long", long))
+		// Without a supported prefix.
+		require.NoError(t, fsys.SetXattr("etc/issue", "other.name", "value"))
+	})
+
+	fsys, err := erofs.Open(image)
+	require.NoError(t, err)
+
+	xattrs := func(name string) map[string]string {
+		fi, err := fsys.Stat(name)
+		require.NoError(t, err)
+
+		xattrs, err := fi.Sys().(*erofs.Inode).Xattrs()
+		require.NoError(t, err)
+
+		return xattrs
+	}
+
+	require.Equal(t, map[string]string{"trusted.overlay.opaque": "y"}, xattrs("etc"))
+	require.Equal(t, map[string]string{
+		"user.comment":     "hostname",
+		"security.selinux": "system_u:object_r:etc_t:s0",
+	}, xattrs("etc/hostname"))
+	require.Equal(t, map[string]string{"user.empty": ""}, xattrs("etc/motd"))
+	require.Equal(t, map[string]string{"user.long": long}, xattrs("etc/issue"))
+	require.Equal(t, map[string]string{"user.comment": "empty"}, xattrs("etc/empty"))
+	require.Nil(t, xattrs("."))
+
+	entries, err := fsys.ReadDir("/etc")
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// The data following the xattrs is intact.
+	for name, want := range map[string][]byte{
+		"etc/hostname": []byte("alpha\n"),
+		"etc/motd":     motd,
+		"etc/issue":    []byte("welcome\n"),
+		"etc/empty":    {},
+	} {
+		data, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err)
+		require.Equal(t, want, data, name)
+	}
+
+	// Extended attributes are reported by the file info.
+	var buf bytes.Buffer
+	require.NoError(t, archivefs.WriteMtree(&buf, fsys, nil))
+	require.Contains(t, buf.String(), "xattr.user.comment=")
+
+	t.Run("Shared", func(t *testing.T) {
+		data, err := io.ReadAll(io.NewSectionReader(image, 0, math.MaxInt64))
+		require.NoError(t, err)
+
+		img, err := erofs.OpenImage(bytes.NewReader(data))
+		require.NoError(t, err)
+		sb := img.SuperBlock()
+
+		xattrsOff := func(name string) int64 {
+			fi, err := fsys.Stat(name)
+			require.NoError(t, err)
+
+			ino := fi.Sys().(*erofs.Inode)
+			off := sb.NidToOffset(ino.Nid())
+			if ino.Layout() == erofs.InodeLayoutExtended {
+				return off + int64(binary.Size(erofs.InodeExtended{}))
+			}
+			return off + int64(binary.Size(erofs.InodeCompact{}))
+		}
+
+		// Replace the xattrs of etc/motd with a reference to the first xattr
+		// of etc/hostname (security.selinux), and an inline xattr.
+		shared := xattrsOff("etc/hostname") + erofs.XattrHeaderSize
+		off := xattrsOff("etc/motd")
+		data[off+4] = 1
+		binary.LittleEndian.PutUint32(data[off+erofs.XattrHeaderSize:], uint32(shared/4))
+		copy(data[off+erofs.XattrHeaderSize+4:], []byte{3, 1, 0, 0, 'f', 'o', 'o', 0})
+
+		fsys, err := erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		fi, err := fsys.Stat("etc/motd")
+		require.NoError(t, err)
+
+		xattrs, err := fi.Sys().(*erofs.Inode).Xattrs()
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{
+			"security.selinux": "system_u:object_r:etc_t:s0",
+			"user.foo":         "",
+		}, xattrs)
+
+		// Corrupted shared xattr counts are detected.
+		data[off+4] = 100
+
+		fsys, err = erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		fi, err = fsys.Stat("etc/motd")
+		require.NoError(t, err)
+
+		_, err = fi.Sys().(*erofs.Inode).Xattrs()
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+}
+
+func TestEROFSStrict(t *testing.T) {
+	image := createImage(t, func(fsys *memfs.FS) {
+		require.NoError(t, fsys.MkdirAll("etc", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+		require.NoError(t, fsys.Symlink("etc", "config"))
+	})
+
+	fsys, err := erofs.OpenWithOptions(image, &erofs.Options{Strict: true})
+	require.NoError(t, err)
+
+	data, err := fs.ReadFile(fsys, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "alpha\n", string(data))
+
+	// Symbolic links are never followed.
+	_, err = fs.ReadFile(fsys, "etc/name")
+	require.ErrorIs(t, err, erofs.ErrSymlinkNotFollowed)
+	require.ErrorIs(t, err, archiveerrors.ErrInsecurePath)
+
+	_, err = fs.Stat(fsys, "config/hostname")
+	require.ErrorIs(t, err, erofs.ErrSymlinkNotFollowed)
+
+	// But can be read explicitly.
+	target, err := fsys.ReadLink("etc/name")
+	require.NoError(t, err)
+	require.Equal(t, "hostname", target)
+
+	fi, err := fsys.StatLink("config")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	// Unlike the default behavior.
+	fsys, err = erofs.Open(image)
+	require.NoError(t, err)
+
+	data, err = fs.ReadFile(fsys, "config/name")
+	require.NoError(t, err)
+	require.Equal(t, "alpha\n", string(data))
+}
+
+func TestEROFSCorrupted(t *testing.T) {
+	image := createImage(t, func(fsys *memfs.FS) {
+		require.NoError(t, fsys.WriteFile("hello.txt", []byte("Hello world!\n"), 0o644))
+		require.NoError(t, fsys.Symlink("loop2", "loop1"))
+		require.NoError(t, fsys.Symlink("loop1", "loop2"))
+	})
+
+	data, err := io.ReadAll(io.NewSectionReader(image, 0, math.MaxInt64))
+	require.NoError(t, err)
+
+	t.Run("BlockSize", func(t *testing.T) {
+		corrupted := bytes.Clone(data)
+		// The block size bits follow the magic and checksum of the superblock.
+		corrupted[erofs.SuperBlockOffset+12] = 40
+
+		_, err := erofs.Open(bytes.NewReader(corrupted))
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+
+	t.Run("Inode", func(t *testing.T) {
+		fsys, err := erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		nid, _, err := fsys.FileID("hello.txt")
+		require.NoError(t, err)
+
+		img, err := erofs.OpenImage(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		// Set an unsupported data layout.
+		corrupted := bytes.Clone(data)
+		sb := img.SuperBlock()
+		corrupted[sb.NidToOffset(nid)] |= 0x0e
+
+		fsys, err = erofs.Open(bytes.NewReader(corrupted))
+		require.NoError(t, err)
+
+		// Errors are returned (repeatedly) rather than panicking.
+		for range 2 {
+			_, err = fsys.Stat("hello.txt")
+			require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+		}
+	})
+
+	t.Run("SymlinkLoop", func(t *testing.T) {
+		fsys, err := erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		_, err = fsys.Open("loop1")
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	})
+
+	t.Run("DirectoryCycle", func(t *testing.T) {
+		image := createImage(t, func(fsys *memfs.FS) {
+			require.NoError(t, fsys.MkdirAll("etc", 0o755))
+			require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		})
+
+		data, err := io.ReadAll(io.NewSectionReader(image, 0, math.MaxInt64))
+		require.NoError(t, err)
+
+		// Rename the ".." entry of etc, so that it appears to be a child.
+		require.Equal(t, 1, bytes.Count(data, []byte("...hostname")))
+		corrupted := bytes.Replace(data, []byte("...hostname"), []byte("..xhostname"), 1)
+
+		fsys, err := erofs.Open(bytes.NewReader(corrupted))
+		require.NoError(t, err)
+
+		_, err = fsys.ReadDir("/etc")
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+
+		err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			return err
+		})
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+}
+
+func FuzzEROFS(f *testing.F) {
+	image := createImage(f, func(fsys *memfs.FS) {
+		require.NoError(f, fsys.MkdirAll("etc", 0o755))
+		require.NoError(f, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		require.NoError(f, fsys.WriteFile("etc/motd", bytes.Repeat([]byte("hello\n"), 1000), 0o644))
+		require.NoError(f, fsys.Symlink("hostname", "etc/name"))
+		require.NoError(f, fsys.SetXattr("etc/hostname", "user.comment", "hostname"))
+	})
+
+	data, err := io.ReadAll(io.NewSectionReader(image, 0, math.MaxInt64))
+	require.NoError(f, err)
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, strict := range []bool{false, true} {
+			fsys, err := erofs.OpenWithOptions(bytes.NewReader(data), &erofs.Options{Strict: strict})
+			if err != nil {
+				continue
+			}
+
+			_ = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+
+				if fi, err := d.Info(); err == nil {
+					_, _ = fi.Sys().(*erofs.Inode).Xattrs()
+				}
+
+				if d.Type()&fs.ModeSymlink != 0 {
+					_, _ = fsys.ReadLink(name)
+				} else if !d.IsDir() {
+					// The size of the file may be corrupted.
+					if f, err := fsys.Open(name); err == nil {
+						_, _ = io.Copy(io.Discard, io.LimitReader(f, 1<<20))
+					}
+				}
+
+				return nil
+			})
+		}
+	})
+}
+
+// createImage creates an EROFS image from the files added to a memfs.FS.
+func createImage(tb testing.TB, populate func(fsys *memfs.FS)) io.ReaderAt {
+	fsys := memfs.New()
+	populate(fsys)
+
+	f, err := os.Create(filepath.Join(tb.TempDir(), "image.erofs"))
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		require.NoError(tb, f.Close())
+	})
+
+	require.NoError(tb, erofs.Create(f, fsys))
+
+	return f
+}
@@ -34,11 +34,12 @@ package erofs
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/fs"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
 )
 
 const (
@@ -51,6 +52,10 @@ const (
 
 	// Max file name length.
 	MaxNameLen = 255
+
+	// Supported block sizes in bit shift (512 bytes to 64 KiB).
+	MinBlockSizeBits = 9
+	MaxBlockSizeBits = 16
 )
 
 // Bit definitions for Inode*::Format.
@@ -91,9 +96,25 @@ const (
 //
 // This is not exhaustive, unused features are not listed.
 const (
-	FeatureIncompatSupported = 0x0
+	FeatureIncompatChunkedFile = 0x00000004
+	FeatureIncompatDeviceTable = 0x00000008
+
+	FeatureIncompatSupported = FeatureIncompatChunkedFile | FeatureIncompatDeviceTable
 )
 
+// Bit definitions for the chunk format of chunk based inodes (stored in place
+// of the raw block address).
+const (
+	ChunkFormatBlkBitsMask = 0x001f
+	ChunkFormatIndexes     = 0x0020
+)
+
+// NullAddr is the block address of chunks that are holes.
+const NullAddr = 0xffffffff
+
+// ChunkIndexSize is the size of the entries of chunk indexes.
+const ChunkIndexSize = 8
+
 // SuperBlock represents on-disk superblock.
 type SuperBlock struct {
 	Magic           uint32    // Filesystem magic number
@@ -179,10 +200,23 @@ type Dirent struct {
 
 var DirentSize = int64(binary.Size(Dirent{}))
 
+// DeviceSlot represents an on-disk entry of the device table, describing an
+// extra device (eg. a container image blob) holding data of the image.
+type DeviceSlot struct {
+	Tag             [64]uint8 // Device tag (eg. the digest of a blob)
+	Blocks          uint32    // Total number of blocks
+	MappedBlockAddr uint32    // Start block address in a unified address space
+	Reserved        [56]uint8 // Reserved for future use
+}
+
+var DeviceSlotSize = int64(binary.Size(DeviceSlot{}))
+
 // Image represents an open EROFS image.
 type Image struct {
-	src io.ReaderAt
-	sb  SuperBlock
+	src     io.ReaderAt
+	sb      SuperBlock
+	devices []io.ReaderAt
+	slots   []DeviceSlot
 }
 
 // OpenImage returns an Image providing access to the contents in the image file src.
@@ -218,6 +252,26 @@ func (i *Image) RootNid() uint64 {
 	return uint64(i.sb.RootNid)
 }
 
+// DeviceSlots returns the device table of this image, describing its extra
+// devices.
+func (i *Image) DeviceSlots() []DeviceSlot {
+	return i.slots
+}
+
+// device returns the reader of the device with the given id, the image
+// itself for id 0.
+func (i *Image) device(id uint16) (io.ReaderAt, error) {
+	if id == 0 {
+		return i.src, nil
+	}
+
+	if int(id) > len(i.devices) || i.devices[id-1] == nil {
+		return nil, fmt.Errorf("device %d: %w", id, ErrDeviceNotFound)
+	}
+
+	return i.devices[id-1], nil
+}
+
 // initSuperBlock initializes the superblock of this image.
 func (i *Image) initSuperBlock() error {
 	if err := i.unmarshalFrom(SuperBlockOffset, &i.sb); err != nil {
@@ -225,7 +279,11 @@ func (i *Image) initSuperBlock() error {
 	}
 
 	if i.sb.Magic != SuperBlockMagicV1 {
-		return fmt.Errorf("unknown magic: 0x%x", i.sb.Magic)
+		return &archiveerrors.ErrCorrupted{Offset: SuperBlockOffset, Detail: fmt.Sprintf("unknown magic: 0x%x", i.sb.Magic)}
+	}
+
+	if i.sb.BlockSizeBits < MinBlockSizeBits || i.sb.BlockSizeBits > MaxBlockSizeBits {
+		return &archiveerrors.ErrCorrupted{Offset: SuperBlockOffset, Detail: fmt.Sprintf("invalid block size bits: %d", i.sb.BlockSizeBits)}
 	}
 
 	if err := i.verifyChecksum(); err != nil {
@@ -233,7 +291,16 @@ func (i *Image) initSuperBlock() error {
 	}
 
 	if featureIncompat := i.sb.FeatureIncompat & ^uint32(FeatureIncompatSupported); featureIncompat != 0 {
-		return fmt.Errorf("unsupported incompatible features detected: 0x%x", featureIncompat)
+		return fmt.Errorf("unsupported incompatible features detected: 0x%x: %w", featureIncompat, archiveerrors.ErrUnsupportedFeature)
+	}
+
+	if i.sb.FeatureIncompat&FeatureIncompatDeviceTable != 0 && i.sb.ExtraDevices > 0 {
+		off := int64(i.sb.DevTableSlotOff) * DeviceSlotSize
+
+		i.slots = make([]DeviceSlot, i.sb.ExtraDevices)
+		if err := i.unmarshalFrom(off, i.slots); err != nil {
+			return &archiveerrors.ErrCorrupted{Offset: off, Detail: "truncated device table", Err: err}
+		}
 	}
 
 	return nil
@@ -258,12 +325,12 @@ func (i *Image) verifyChecksum() error {
 
 	off := SuperBlockOffset + int64(binary.Size(i.sb))
 	if buf, err := i.bytesAt(off, int64(i.BlockSize())-off); err != nil {
-		return errors.New("image size is too small")
+		return &archiveerrors.ErrCorrupted{Offset: off, Detail: "image size is too small", Err: err}
 	} else {
 		checksum = ^crc32.Update(checksum, table, buf)
 	}
 	if checksum != i.sb.Checksum {
-		return fmt.Errorf("invalid checksum: 0x%x, expected: 0x%x", checksum, i.sb.Checksum)
+		return &archiveerrors.ErrCorrupted{Offset: SuperBlockOffset, Detail: fmt.Sprintf("invalid checksum: 0x%x, expected: 0x%x", checksum, i.sb.Checksum)}
 	}
 
 	return nil
@@ -300,7 +367,7 @@ func (sb *SuperBlock) checksum() error {
 // image.
 func (i *Image) inodeFormatAt(off int64) (uint16, error) {
 	if !checkInodeAlignment(off) {
-		return 0, fmt.Errorf("invalid inode alignment at offset %d", off)
+		return 0, &archiveerrors.ErrCorrupted{Offset: off, Detail: "invalid inode alignment"}
 	}
 	buf, err := i.bytesAt(off, 2)
 	if err != nil {
@@ -313,7 +380,7 @@ func (i *Image) inodeFormatAt(off int64) (uint16, error) {
 // the image.
 func (i *Image) inodeCompactAt(off int64) (*InodeCompact, error) {
 	if !checkInodeAlignment(off) {
-		return nil, fmt.Errorf("invalid inode alignment at offset %d", off)
+		return nil, &archiveerrors.ErrCorrupted{Offset: off, Detail: "invalid inode alignment"}
 	}
 	var inode InodeCompact
 	if err := i.unmarshalFrom(int64(off), &inode); err != nil {
@@ -327,7 +394,7 @@ func (i *Image) inodeCompactAt(off int64) (*InodeCompact, error) {
 // the image.
 func (i *Image) inodeExtendedAt(off int64) (*InodeExtended, error) {
 	if !checkInodeAlignment(off) {
-		return nil, fmt.Errorf("invalid inode alignment at offset %d", off)
+		return nil, &archiveerrors.ErrCorrupted{Offset: off, Detail: "invalid inode alignment"}
 	}
 
 	var inode InodeExtended
@@ -341,7 +408,7 @@ func (i *Image) inodeExtendedAt(off int64) (*InodeExtended, error) {
 func (i *Image) direntAt(off int64) (*Dirent, error) {
 	// Each valid dirent should be aligned to 4 bytes.
 	if off&3 != 0 {
-		return nil, fmt.Errorf("invalid dirent alignment at offset %d", off)
+		return nil, &archiveerrors.ErrCorrupted{Offset: off, Detail: "invalid dirent alignment"}
 	}
 
 	var dirent Dirent
@@ -378,12 +445,9 @@ func (i *Image) Inode(nid uint64) (Inode, error) {
 			return Inode{}, err
 		}
 
-		if ino.XattrCount != 0 {
-			return Inode{}, fmt.Errorf("unsupported xattr at inode %d", nid)
-		}
-
 		rawBlockAddr = ino.RawBlockAddr
 		inodeSize = int64(binary.Size(*ino))
+		inode.xattrSize = xattrSize(ino.XattrCount)
 
 		inode.size = uint64(ino.Size)
 		inode.nlink = uint32(ino.Nlink)
@@ -399,12 +463,9 @@ func (i *Image) Inode(nid uint64) (Inode, error) {
 			return Inode{}, err
 		}
 
-		if ino.XattrCount != 0 {
-			return Inode{}, fmt.Errorf("unsupported xattr at inode %d", nid)
-		}
-
 		rawBlockAddr = ino.RawBlockAddr
 		inodeSize = int64(binary.Size(*ino))
+		inode.xattrSize = xattrSize(ino.XattrCount)
 
 		inode.size = ino.Size
 		inode.nlink = ino.Nlink
@@ -415,7 +476,16 @@ func (i *Image) Inode(nid uint64) (Inode, error) {
 		inode.mtimeNsec = ino.MtimeNsec
 
 	default:
-		return Inode{}, fmt.Errorf("unsupported layout at inode %d", nid)
+		return Inode{}, fmt.Errorf("unsupported layout at inode %d: %w", nid, archiveerrors.ErrUnsupportedFeature)
+	}
+
+	// The inline xattrs follow the inode, and precede any inline data or
+	// block map.
+	inode.xattrOff = off + inodeSize
+	inodeSize += inode.xattrSize
+
+	if inode.IsCharDev() || inode.IsBlockDev() {
+		inode.rdev = rawBlockAddr
 	}
 
 	blockSize := int64(i.BlockSize())
@@ -427,8 +497,8 @@ func (i *Image) Inode(nid uint64) (Inode, error) {
 		// the remaining room of the metadata block.
 		tailSize := int64(inode.size) & (blockSize - 1)
 		if tailSize == 0 || tailSize > blockSize-inodeSize {
-			return Inode{}, fmt.Errorf("inline data not found or cross block boundary at inode %d, tail size: %d",
-				nid, tailSize)
+			return Inode{}, &archiveerrors.ErrCorrupted{Offset: off, Detail: fmt.Sprintf("inline data not found or cross block boundary at inode %d, tail size: %d",
+				nid, tailSize)}
 		}
 		inode.idataOff = off + inodeSize
 		fallthrough
@@ -436,8 +506,22 @@ func (i *Image) Inode(nid uint64) (Inode, error) {
 	case InodeDataLayoutFlatPlain:
 		inode.dataOff = i.sb.BlockAddrToOffset(rawBlockAddr)
 
+	case InodeDataLayoutChunkBased:
+		// The block map or chunk indexes follow the inode, chunk indexes are
+		// aligned to their size.
+		chunkFormat := uint16(rawBlockAddr)
+		if chunkFormat&^(ChunkFormatBlkBitsMask|ChunkFormatIndexes) != 0 {
+			return Inode{}, fmt.Errorf("unsupported chunk format 0x%x at inode %d: %w", chunkFormat, nid, archiveerrors.ErrUnsupportedFeature)
+		}
+		inode.chunkBits = i.sb.BlockSizeBits + uint8(chunkFormat&ChunkFormatBlkBitsMask)
+		inode.chunksOff = off + inodeSize
+		if chunkFormat&ChunkFormatIndexes != 0 {
+			inode.chunkIndexes = true
+			inode.chunksOff = roundUp(inode.chunksOff, ChunkIndexSize)
+		}
+
 	default:
-		return Inode{}, fmt.Errorf("unsupported data layout at inode %d", nid)
+		return Inode{}, fmt.Errorf("unsupported data layout at inode %d: %w", nid, archiveerrors.ErrUnsupportedFeature)
 	}
 
 	return inode, nil
@@ -445,6 +529,10 @@ func (i *Image) Inode(nid uint64) (Inode, error) {
 
 // bytesAt returns the bytes at [off, off+n) of the image.
 func (i *Image) bytesAt(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: off, Detail: fmt.Sprintf("invalid extent of %d bytes", n)}
+	}
+
 	buf := make([]byte, n)
 	if _, err := i.src.ReadAt(buf, off); err != nil {
 		return nil, err
@@ -481,6 +569,18 @@ type Inode struct {
 	// if it's not zero in the metadata block.
 	idataOff int64
 
+	// chunksOff points to the block map (or chunk indexes, if chunkIndexes
+	// is set) of a chunk based inode, and chunkBits is the chunk size in bit
+	// shift.
+	chunksOff    int64
+	chunkBits    uint8
+	chunkIndexes bool
+
+	// xattrOff points to the inline xattrs of this inode, and xattrSize is
+	// their size (zero if there are none).
+	xattrOff  int64
+	xattrSize int64
+
 	// blocks indicates the count of blocks that store the data associated
 	// with this inode. It will count in the metadata block that includes
 	// the inline data as well.
@@ -498,6 +598,7 @@ type Inode struct {
 	uid       uint32
 	gid       uint32
 	nlink     uint32
+	rdev      uint32
 }
 
 // bitRange returns the bits within the range [bit, bit+bits) in value.
@@ -583,7 +684,7 @@ func (ino *Inode) Mode() fs.FileMode {
 		mode |= fs.ModeDir
 	}
 	if ino.IsCharDev() {
-		mode |= fs.ModeCharDevice
+		mode |= fs.ModeDevice | fs.ModeCharDevice
 	}
 	if ino.IsBlockDev() {
 		mode |= fs.ModeDevice
@@ -611,6 +712,51 @@ func (ino *Inode) GID() uint32 {
 	return ino.gid
 }
 
+// Owner returns the numeric owner of the inode.
+func (ino *Inode) Owner() (uid, gid int) {
+	return int(ino.uid), int(ino.gid)
+}
+
+// FileID returns the inode number and link count, inodes with more than one
+// link are shared by several directory entries.
+func (ino *Inode) FileID() (id uint64, nlink int) {
+	return ino.nid, int(ino.nlink)
+}
+
+// AllocatedSize returns the number of bytes of the image used to store the
+// data of the inode. Inline data is stored in the metadata block, after the
+// inode, and holes in chunk based inodes are not allocated.
+func (ino *Inode) AllocatedSize() int64 {
+	blockSize := int64(ino.image.BlockSize())
+	if ino.DataLayout() == InodeDataLayoutChunkBased {
+		runs, err := ino.chunkRuns()
+		if err != nil {
+			return ino.blocks * blockSize
+		}
+
+		var allocated int64
+		for _, run := range runs {
+			// Chunks stored on extra devices aren't part of the image.
+			if run.addr != NullAddr && run.device == 0 {
+				allocated += roundUp(run.length, blockSize)
+			}
+		}
+
+		return allocated
+	}
+
+	if ino.idataOff != 0 {
+		return (ino.blocks-1)*blockSize + int64(ino.size)&(blockSize-1)
+	}
+
+	return ino.blocks * blockSize
+}
+
+// Device returns the major and minor numbers of a device inode.
+func (ino *Inode) Device() (major, minor uint32) {
+	return decodeDev(ino.rdev)
+}
+
 // Data returns the read-only file data of this inode.
 func (ino *Inode) Data() (io.Reader, error) {
 	switch dataLayout := ino.DataLayout(); dataLayout {
@@ -626,8 +772,30 @@ func (ino *Inode) Data() (io.Reader, error) {
 		readers = append(readers, io.NewSectionReader(ino.image.src, int64(ino.idataOff), int64(idataSize)))
 		return io.MultiReader(readers...), nil
 
+	case InodeDataLayoutChunkBased:
+		runs, err := ino.chunkRuns()
+		if err != nil {
+			return nil, err
+		}
+
+		readers := make([]io.Reader, 0, len(runs))
+		for _, run := range runs {
+			if run.addr == NullAddr {
+				readers = append(readers, io.LimitReader(zeroReader{}, run.length))
+				continue
+			}
+
+			src, err := ino.image.device(run.device)
+			if err != nil {
+				return nil, fmt.Errorf("data of inode %d: %w", ino.nid, err)
+			}
+
+			readers = append(readers, io.NewSectionReader(src, ino.image.sb.BlockAddrToOffset(run.addr), run.length))
+		}
+		return io.MultiReader(readers...), nil
+
 	default:
-		return nil, errors.New("unsupported data layout")
+		return nil, fmt.Errorf("unsupported data layout at inode %d: %w", ino.nid, archiveerrors.ErrUnsupportedFeature)
 	}
 }
 
@@ -699,7 +867,7 @@ func (ino *Inode) getDirentName(d *Dirent, direntOff int64, block blockData, las
 		nameLen = uint32(next.NameOff - d.NameOff)
 	}
 	if uint32(d.NameOff)+nameLen > block.size || nameLen > MaxNameLen || nameLen == 0 {
-		return nil, errors.New("corrupted dirent")
+		return nil, &archiveerrors.ErrCorrupted{Offset: block.base + int64(d.NameOff), Detail: "corrupted dirent"}
 	}
 	name, err := ino.image.bytesAt(int64(block.base)+int64(d.NameOff), int64(nameLen))
 	if err != nil {
@@ -709,7 +877,7 @@ func (ino *Inode) getDirentName(d *Dirent, direntOff int64, block blockData, las
 		// Optional padding may exist at the end of a block.
 		n := bytes.IndexByte(name, 0)
 		if n == 0 {
-			return nil, errors.New("corrupted dirent")
+			return nil, &archiveerrors.ErrCorrupted{Offset: block.base + int64(d.NameOff), Detail: "corrupted dirent"}
 		}
 		if n != -1 {
 			name = name[:n]
@@ -725,7 +893,7 @@ func (ino *Inode) getDirent0(block blockData) (*Dirent, error) {
 		return nil, err
 	}
 	if d0.NameOff < uint16(DirentSize) || uint32(d0.NameOff) >= block.size {
-		return nil, fmt.Errorf("invalid nameOff0 %d at inode %d", d0.NameOff, ino.Nid())
+		return nil, &archiveerrors.ErrCorrupted{Offset: block.base, Detail: fmt.Sprintf("invalid nameOff0 %d at inode %d", d0.NameOff, ino.Nid())}
 	}
 	return d0, nil
 }
@@ -864,8 +1032,8 @@ func (ino *Inode) Readlink() (string, error) {
 	size := int64(ino.size)
 	if ino.idataOff != 0 {
 		// Inline symlink data shouldn't cross block boundary.
-		if ino.blocks > 1 {
-			return "", fmt.Errorf("inline data cross block boundary at inode %d", ino.Nid())
+		if ino.size >= uint64(ino.image.BlockSize()) {
+			return "", &archiveerrors.ErrCorrupted{Offset: ino.idataOff, Detail: fmt.Sprintf("inline data cross block boundary at inode %d", ino.Nid())}
 		}
 		off = int64(ino.idataOff)
 	} else {
@@ -20,6 +20,8 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/dpeckett/archivefs"
 )
 
 const (
@@ -45,6 +47,14 @@ type writer struct {
 	dst        io.WriterAt
 	inodes     map[string]any
 	inodeOrder []string
+	// hardlinks maps the path of each additional hard link to a file to the
+	// path of its first link (which owns the inode).
+	hardlinks map[string]string
+	// chunks holds the block map of each file stored as a chunk based inode
+	// (as it contains holes).
+	chunks map[string][]uint32
+	// xattrs holds the encoded inline xattrs of each inode that has any.
+	xattrs map[string][]byte
 }
 
 func (w *writer) write() error {
@@ -77,6 +87,10 @@ func (w *writer) write() error {
 		// TODO: other fields (volume name, etc.)
 	}
 
+	if len(w.chunks) > 0 {
+		sb.FeatureIncompat |= FeatureIncompatChunkedFile
+	}
+
 	if err := sb.checksum(); err != nil {
 		return fmt.Errorf("failed to calculate superblock checksum: %w", err)
 	}
@@ -96,6 +110,8 @@ func (w *writer) write() error {
 
 // firstPass precomputes the layout of the blocks, and inodes.
 func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
+	w.chunks = map[string][]uint32{}
+
 	for _, path := range w.inodeOrder {
 		ino := w.inodes[path]
 
@@ -105,17 +121,35 @@ func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
 		}
 		_ = data.Close()
 
-		inlined := size <= MaxInlineDataSize
+		// Special files have no data, and store the device number in place of
+		// the block address.
+		special := isSpecial(ino)
+
+		// The inline xattrs follow the inode.
+		inodeSize := int64(binary.Size(ino)) + int64(len(w.xattrs[path]))
+
+		// Empty files have no tail to inline.
+		inlined := size > 0 && size <= MaxInlineDataSize && !special && inodeSize+size <= BlockSize
 		if inlined {
 			// if the size of the inode and data exceeds the block size, we need to
 			// pad to the next block boundary before inlining the data.
 			spaceAvailable := roundUp(metaSize, BlockSize) - metaSize
-			if spaceAvailable > 0 && int64(binary.Size(ino))+size > spaceAvailable {
+			if spaceAvailable > 0 && inodeSize+size > spaceAvailable {
 				// Pad the metadata to the next block boundary.
 				metaSize = roundUp(metaSize, BlockSize)
 			}
 		}
 
+		// Files containing holes are stored as chunk based inodes, so that
+		// the holes are not allocated.
+		var chunks []uint32
+		if !inlined && isRegular(ino) {
+			chunks, err = w.chunksForFile(path, size, dataSize/BlockSize)
+			if err != nil {
+				return metaSize, dataSize, fmt.Errorf("failed to get data extents for %q: %w", path, err)
+			}
+		}
+
 		// Allocate the inode number.
 		nid, err := offsetToNID(metaSize)
 		if err != nil {
@@ -128,9 +162,14 @@ func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
 			ino.Size = uint32(size)
 			if inlined {
 				ino.Format = setBits(ino.Format, InodeDataLayoutFlatInline, InodeDataLayoutBit, InodeDataLayoutBits)
+			} else if chunks != nil {
+				// A chunk size of one block, with a block map.
+				ino.Format = setBits(ino.Format, InodeDataLayoutChunkBased, InodeDataLayoutBit, InodeDataLayoutBits)
 			} else {
 				ino.Format = setBits(ino.Format, InodeDataLayoutFlatPlain, InodeDataLayoutBit, InodeDataLayoutBits)
-				ino.RawBlockAddr = uint32(dataSize / BlockSize)
+				if !special {
+					ino.RawBlockAddr = uint32(dataSize / BlockSize)
+				}
 			}
 			w.inodes[path] = ino
 
@@ -139,9 +178,14 @@ func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
 			ino.Size = uint64(size)
 			if inlined {
 				ino.Format = setBits(ino.Format, InodeDataLayoutFlatInline, InodeDataLayoutBit, InodeDataLayoutBits)
+			} else if chunks != nil {
+				// A chunk size of one block, with a block map.
+				ino.Format = setBits(ino.Format, InodeDataLayoutChunkBased, InodeDataLayoutBit, InodeDataLayoutBits)
 			} else {
 				ino.Format = setBits(ino.Format, InodeDataLayoutFlatPlain, InodeDataLayoutBit, InodeDataLayoutBits)
-				ino.RawBlockAddr = uint32(dataSize / BlockSize)
+				if !special {
+					ino.RawBlockAddr = uint32(dataSize / BlockSize)
+				}
 			}
 			w.inodes[path] = ino
 
@@ -149,12 +193,27 @@ func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
 			return metaSize, dataSize, fmt.Errorf("unsupported inode type %T", ino)
 		}
 
-		metaSize += int64(binary.Size(ino))
+		metaSize += inodeSize
 
 		if inlined {
 			metaSize += size
 			metaSize = roundUp(metaSize, InodeSlotSize)
+		} else if chunks != nil {
+			w.chunks[path] = chunks
+
+			// The block map follows the inode.
+			metaSize += int64(len(chunks)) * 4
+			metaSize = roundUp(metaSize, InodeSlotSize)
+
+			for _, addr := range chunks {
+				if addr != NullAddr {
+					dataSize += BlockSize
+				}
+			}
 		} else {
+			// The inline xattrs may leave the next inode unaligned.
+			metaSize = roundUp(metaSize, InodeSlotSize)
+
 			dataSize += size
 			dataSize = roundUp(dataSize, BlockSize)
 		}
@@ -169,14 +228,23 @@ func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
 	for _, path := range w.inodeOrder {
 		ino := w.inodes[path]
 
+		if chunks, ok := w.chunks[path]; ok {
+			for i, addr := range chunks {
+				if addr != NullAddr {
+					chunks[i] += uint32(dataBlockAddr)
+				}
+			}
+			continue
+		}
+
 		switch ino := ino.(type) {
 		case InodeCompact:
-			if !isInlined(ino) {
+			if !isInlined(ino) && !isSpecial(ino) {
 				ino.RawBlockAddr += uint32(dataBlockAddr)
 				w.inodes[path] = ino
 			}
 		case InodeExtended:
-			if !isInlined(ino) {
+			if !isInlined(ino) && !isSpecial(ino) {
 				ino.RawBlockAddr += uint32(dataBlockAddr)
 				w.inodes[path] = ino
 			}
@@ -209,6 +277,22 @@ func (w *writer) writeMetadata(metaBlockAddr int64) error {
 		if err := binary.Write(io.NewOffsetWriter(w.dst, off), binary.LittleEndian, ino); err != nil {
 			return fmt.Errorf("failed to write inode for %q: %w", path, err)
 		}
+		off += int64(binary.Size(ino))
+
+		// The inline xattrs follow the inode.
+		if xattrs, ok := w.xattrs[path]; ok {
+			if _, err := w.dst.WriteAt(xattrs, off); err != nil {
+				return fmt.Errorf("failed to write xattrs for %q: %w", path, err)
+			}
+			off += int64(len(xattrs))
+		}
+
+		// The block map of chunk based inodes follows the inode.
+		if chunks, ok := w.chunks[path]; ok {
+			if err := binary.Write(io.NewOffsetWriter(w.dst, off), binary.LittleEndian, chunks); err != nil {
+				return fmt.Errorf("failed to write block map for %q: %w", path, err)
+			}
+		}
 
 		// Small files are stored in the inline with the inode.
 		if isInlined(ino) {
@@ -218,7 +302,7 @@ func (w *writer) writeMetadata(metaBlockAddr int64) error {
 			}
 
 			// Write the inlined data.
-			_, err = io.Copy(io.NewOffsetWriter(w.dst, off+int64(binary.Size(ino))), data)
+			_, err = io.Copy(io.NewOffsetWriter(w.dst, off), data)
 			_ = data.Close()
 			if err != nil {
 				return fmt.Errorf("failed to write inline data for %q: %w", path, err)
@@ -253,7 +337,11 @@ func (w *writer) writeData() error {
 			return fmt.Errorf("failed to get data for %q: %w", path, err)
 		}
 
-		_, err = io.Copy(io.NewOffsetWriter(w.dst, int64(rawBlockAddr)*BlockSize), data)
+		if chunks, ok := w.chunks[path]; ok {
+			err = w.writeChunks(data, chunks)
+		} else {
+			_, err = io.Copy(io.NewOffsetWriter(w.dst, int64(rawBlockAddr)*BlockSize), data)
+		}
 		_ = data.Close()
 		if err != nil {
 			return fmt.Errorf("failed to write data for %q: %w", path, err)
@@ -263,8 +351,71 @@ func (w *writer) writeData() error {
 	return nil
 }
 
+// writeChunks writes the blocks of a file that are not holes to the addresses
+// given by its block map.
+func (w *writer) writeChunks(data io.Reader, chunks []uint32) error {
+	buf := make([]byte, BlockSize)
+	for _, addr := range chunks {
+		n, err := io.ReadFull(data, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		if addr == NullAddr {
+			continue
+		}
+
+		if _, err := w.dst.WriteAt(buf[:n], int64(addr)*BlockSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chunksForFile returns the block map of a file if it contains holes (of at
+// least a block), allocating its data blocks from firstBlock (relative to the
+// start of the data blocks). Otherwise it returns nil.
+func (w *writer) chunksForFile(path string, size, firstBlock int64) ([]uint32, error) {
+	extents, err := archivefs.LookupDataExtents(w.src, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !archivefs.HasHoles(extents, size) {
+		return nil, nil
+	}
+
+	chunks := make([]uint32, (size+BlockSize-1)/BlockSize)
+	for i := range chunks {
+		chunks[i] = NullAddr
+	}
+
+	addr := firstBlock
+	for _, e := range extents {
+		for i := e.Offset / BlockSize; i < min(int64(len(chunks)), (e.End()+BlockSize-1)/BlockSize); i++ {
+			if chunks[i] == NullAddr {
+				chunks[i] = uint32(addr)
+				addr++
+			}
+		}
+	}
+
+	// Holes smaller than a block must be stored.
+	if addr-firstBlock == int64(len(chunks)) {
+		return nil, nil
+	}
+
+	return chunks, nil
+}
+
 func (w *writer) populateInodes() error {
 	w.inodes = map[string]any{}
+	w.hardlinks = map[string]string{}
+	w.xattrs = map[string][]byte{}
+
+	// links holds the path of the first link to each hard linked file.
+	links := map[uint64]string{}
 
 	err := fs.WalkDir(w.src, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -276,6 +427,21 @@ func (w *writer) populateInodes() error {
 			return err
 		}
 
+		if fi.Mode().IsRegular() {
+			id, nlink, err := archivefs.LookupFileID(w.src, path, fi)
+			if err != nil {
+				return err
+			}
+
+			if id != 0 && nlink > 1 {
+				if first, ok := links[id]; ok {
+					w.hardlinks[path] = first
+					return w.addLink(first)
+				}
+				links[id] = path
+			}
+		}
+
 		nlink := 1
 		if fi.IsDir() {
 			entries, err := fs.ReadDir(w.src, path)
@@ -286,7 +452,12 @@ func (w *writer) populateInodes() error {
 			nlink = len(entries) + 2
 		}
 
-		w.inodes[path] = toInode(fi, nlink)
+		xattrs := encodeXattrs(archivefs.Xattrs(fi))
+		if xattrs != nil {
+			w.xattrs[path] = xattrs
+		}
+
+		w.inodes[path] = toInode(fi, nlink, xattrCount(int64(len(xattrs))))
 		w.inodeOrder = append(w.inodeOrder, path)
 
 		return nil
@@ -298,6 +469,22 @@ func (w *writer) populateInodes() error {
 	return nil
 }
 
+// addLink increments the link count of the inode at path.
+func (w *writer) addLink(path string) error {
+	switch ino := w.inodes[path].(type) {
+	case InodeCompact:
+		ino.Nlink++
+		w.inodes[path] = ino
+	case InodeExtended:
+		ino.Nlink++
+		w.inodes[path] = ino
+	default:
+		return fmt.Errorf("unsupported inode type %T", ino)
+	}
+
+	return nil
+}
+
 func (w *writer) dataForInode(path string, ino any) (io.ReadCloser, int64, error) {
 	type readLinkFS interface {
 		ReadLink(name string) (string, error)
@@ -344,6 +531,9 @@ func (w *writer) dataForInode(path string, ino any) (io.ReadCloser, int64, error
 
 		for _, de := range entries {
 			path := filepath.Clean(filepath.Join(path, de.Name()))
+			if first, ok := w.hardlinks[path]; ok {
+				path = first
+			}
 
 			ino, ok := w.inodes[path]
 			if !ok {
@@ -387,15 +577,22 @@ func (w *writer) dataForInode(path string, ino any) (io.ReadCloser, int64, error
 
 		return io.NopCloser(bytes.NewReader([]byte(target))), int64(len(target)), nil
 
-	// TODO: device files, named pipes, sockets, etc.
+	case S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+		return io.NopCloser(bytes.NewReader(nil)), 0, nil
 
 	default:
 		return nil, 0, fmt.Errorf("unsupported file type %o", mode&S_IFMT)
 	}
 }
 
-func toInode(fi fs.FileInfo, nlink int) any {
-	uid, gid := getOwner(fi)
+func toInode(fi fs.FileInfo, nlink int, xattrCount uint16) any {
+	e := archivefs.NewEntryFromInfo(fi.Name(), fi)
+	uid, gid := e.Uid, e.Gid
+
+	var rdev uint32
+	if fi.Mode()&fs.ModeDevice != 0 {
+		rdev = encodeDev(e.Major, e.Minor)
+	}
 
 	// Can we use a compact inode?
 	compact := fi.Size() <= math.MaxUint32 &&
@@ -404,22 +601,28 @@ func toInode(fi fs.FileInfo, nlink int) any {
 
 	if compact {
 		return InodeCompact{
-			Format: setBits(0, InodeLayoutCompact, InodeLayoutBit, InodeLayoutBits),
-			Mode:   statModeFromFileMode(fi.Mode()),
-			Nlink:  uint16(nlink),
-			UID:    uint16(uid),
-			GID:    uint16(gid),
+			Format:     setBits(0, InodeLayoutCompact, InodeLayoutBit, InodeLayoutBits),
+			XattrCount: xattrCount,
+			Mode:       statModeFromFileMode(fi.Mode()),
+			Nlink:      uint16(nlink),
+			UID:        uint16(uid),
+			GID:        uint16(gid),
+
+			RawBlockAddr: rdev,
 		}
 	}
 
 	return InodeExtended{
-		Format:    setBits(0, InodeLayoutExtended, InodeLayoutBit, InodeLayoutBits),
-		Mode:      statModeFromFileMode(fi.Mode()),
-		Nlink:     uint32(nlink),
-		UID:       uint32(uid),
-		GID:       uint32(gid),
-		Mtime:     uint64(fi.ModTime().Unix()),
-		MtimeNsec: uint32(fi.ModTime().Nanosecond()),
+		Format:     setBits(0, InodeLayoutExtended, InodeLayoutBit, InodeLayoutBits),
+		XattrCount: xattrCount,
+		Mode:       statModeFromFileMode(fi.Mode()),
+		Nlink:      uint32(nlink),
+		UID:        uint32(uid),
+		GID:        uint32(gid),
+		Mtime:      uint64(fi.ModTime().Unix()),
+		MtimeNsec:  uint32(fi.ModTime().Nanosecond()),
+
+		RawBlockAddr: rdev,
 	}
 }
 
@@ -524,6 +727,38 @@ func isInlined(ino any) bool {
 	return bitRange(format, InodeDataLayoutBit, InodeDataLayoutBits) == InodeDataLayoutFlatInline
 }
 
+// isRegular reports whether the inode is a regular file.
+func isRegular(ino any) bool {
+	switch ino := ino.(type) {
+	case InodeCompact:
+		return ino.Mode&S_IFMT == S_IFREG
+	case InodeExtended:
+		return ino.Mode&S_IFMT == S_IFREG
+	default:
+		return false
+	}
+}
+
+// isSpecial reports whether the inode is a device, named pipe, or socket.
+func isSpecial(ino any) bool {
+	var mode uint16
+	switch ino := ino.(type) {
+	case InodeCompact:
+		mode = ino.Mode
+	case InodeExtended:
+		mode = ino.Mode
+	default:
+		return false
+	}
+
+	switch mode & S_IFMT {
+	case S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+		return true
+	default:
+		return false
+	}
+}
+
 func setBits(value, newValue, bit, bits uint16) uint16 {
 	mask := uint16((1<<bits)-1) << bit
 	return (value & ^mask) | ((newValue << bit) & mask)
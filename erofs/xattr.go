@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ archivefs.ExtendedAttributes = (*Inode)(nil)
+)
+
+// XattrHeader represents the on-disk header of the inline xattrs of an inode,
+// it is followed by the ids of any shared xattrs and then the inline xattr
+// entries.
+type XattrHeader struct {
+	NameFilter  uint32   // Bloom filter of xattr names (unused)
+	SharedCount uint8    // Number of shared xattrs
+	Reserved    [7]uint8 // Reserved for future use
+}
+
+// XattrEntry represents the on-disk header of an xattr entry, it is followed
+// by the name (without its prefix) and the value, padded to 4 bytes.
+type XattrEntry struct {
+	NameLen   uint8  // Length of the name
+	NameIndex uint8  // Index of the name prefix
+	ValueSize uint16 // Size of the value
+}
+
+var (
+	XattrHeaderSize = int64(binary.Size(XattrHeader{}))
+	XattrEntrySize  = int64(binary.Size(XattrEntry{}))
+)
+
+// xattrPrefixes are the name prefixes of xattrs, by their index. Entries with
+// other indexes are not supported.
+var xattrPrefixes = []string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+}
+
+// xattrSize returns the size of the inline xattrs of an inode, from its xattr
+// count.
+func xattrSize(count uint16) int64 {
+	if count == 0 {
+		return 0
+	}
+
+	return XattrHeaderSize + int64(count-1)*4
+}
+
+// Xattrs returns the extended attributes of the inode, both inline and
+// shared. Attributes with unsupported name prefixes are omitted.
+func (ino *Inode) Xattrs() (map[string]string, error) {
+	if ino.xattrSize == 0 {
+		return nil, nil
+	}
+
+	buf, err := ino.image.bytesAt(ino.xattrOff, ino.xattrSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr XattrHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+
+	sharedEnd := XattrHeaderSize + int64(hdr.SharedCount)*4
+	if sharedEnd > ino.xattrSize {
+		return nil, &archiveerrors.ErrCorrupted{Offset: ino.xattrOff, Detail: fmt.Sprintf("invalid shared xattr count at inode %d", ino.nid)}
+	}
+
+	xattrs := map[string]string{}
+
+	sharedOff := ino.image.sb.BlockAddrToOffset(ino.image.sb.XattrBlockAddr)
+	for off := XattrHeaderSize; off < sharedEnd; off += 4 {
+		entryOff := sharedOff + int64(binary.LittleEndian.Uint32(buf[off:]))*4
+
+		hdr, err := ino.image.bytesAt(entryOff, XattrEntrySize)
+		if err != nil {
+			return nil, err
+		}
+		entry := decodeXattrEntry(hdr)
+
+		data, err := ino.image.bytesAt(entryOff+XattrEntrySize, int64(entry.NameLen)+int64(entry.ValueSize))
+		if err != nil {
+			return nil, err
+		}
+
+		addXattr(xattrs, entry, data)
+	}
+
+	for off := sharedEnd; off < ino.xattrSize; {
+		if off+XattrEntrySize > ino.xattrSize {
+			return nil, &archiveerrors.ErrCorrupted{Offset: ino.xattrOff + off, Detail: fmt.Sprintf("truncated xattr entry at inode %d", ino.nid)}
+		}
+		entry := decodeXattrEntry(buf[off:])
+
+		end := off + XattrEntrySize + int64(entry.NameLen) + int64(entry.ValueSize)
+		if end > ino.xattrSize {
+			return nil, &archiveerrors.ErrCorrupted{Offset: ino.xattrOff + off, Detail: fmt.Sprintf("xattr entry exceeds xattr area at inode %d", ino.nid)}
+		}
+
+		addXattr(xattrs, entry, buf[off+XattrEntrySize:end])
+
+		off = roundUp(end, 4)
+	}
+
+	return xattrs, nil
+}
+
+// ExtendedAttributes returns the extended attributes of the inode, or nil if
+// they can't be read (see Xattrs).
+func (ino *Inode) ExtendedAttributes() map[string]string {
+	xattrs, err := ino.Xattrs()
+	if err != nil {
+		return nil
+	}
+
+	return xattrs
+}
+
+// decodeXattrEntry decodes the xattr entry header at the start of buf.
+func decodeXattrEntry(buf []byte) XattrEntry {
+	return XattrEntry{
+		NameLen:   buf[0],
+		NameIndex: buf[1],
+		ValueSize: binary.LittleEndian.Uint16(buf[2:]),
+	}
+}
+
+// addXattr adds an xattr entry, given its name (without prefix) followed by
+// its value, to xattrs.
+func addXattr(xattrs map[string]string, entry XattrEntry, data []byte) {
+	if int(entry.NameIndex) >= len(xattrPrefixes) || xattrPrefixes[entry.NameIndex] == "" {
+		return
+	}
+
+	name := xattrPrefixes[entry.NameIndex] + string(data[:entry.NameLen])
+	xattrs[name] = string(data[entry.NameLen:])
+}
+
+// encodeXattrs encodes the inline xattrs of an inode, returning nil if there
+// are none. Attributes that can't be stored (those without a supported name
+// prefix, or with a name or value that is too long) are omitted.
+func encodeXattrs(xattrs map[string]string) []byte {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var entries []byte
+	for _, name := range names {
+		index, suffix, ok := xattrPrefix(name)
+		value := xattrs[name]
+		if !ok || len(suffix) > math.MaxUint8 || len(value) > math.MaxUint16 {
+			continue
+		}
+
+		// The size of the inline xattrs is limited by the xattr count.
+		entrySize := roundUp(XattrEntrySize+int64(len(suffix))+int64(len(value)), 4)
+		if xattrSize(math.MaxUint16) < XattrHeaderSize+int64(len(entries))+entrySize {
+			continue
+		}
+
+		entries = append(entries, uint8(len(suffix)), index)
+		entries = binary.LittleEndian.AppendUint16(entries, uint16(len(value)))
+		entries = append(entries, suffix...)
+		entries = append(entries, value...)
+		entries = append(entries, make([]byte, roundUp(int64(len(entries)), 4)-int64(len(entries)))...)
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return append(make([]byte, XattrHeaderSize), entries...)
+}
+
+// xattrCount returns the xattr count of an inode, from the size of its inline
+// xattrs.
+func xattrCount(size int64) uint16 {
+	if size == 0 {
+		return 0
+	}
+
+	return uint16((size-XattrHeaderSize)/4 + 1)
+}
+
+// xattrPrefix returns the index of the prefix of an xattr name, and the
+// remainder of the name.
+func xattrPrefix(name string) (index uint8, suffix string, ok bool) {
+	for i, prefix := range xattrPrefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return uint8(i), name[len(prefix):], true
+		}
+	}
+
+	return 0, "", false
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package errors defines the kinds of error returned by archivefs and its
+// backends, so that callers can handle them by kind rather than by matching
+// error strings.
+//
+// Errors of a kind are matched with the standard library's errors.Is, eg.
+// errors.Is(err, ErrLimitExceeded), or for corrupted archives with errors.As
+// and *ErrCorrupted (which reports where the corruption was detected).
+// Backends may define more specific errors of a kind with Define, these match
+// both themselves and their kind.
+package errors
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnsupportedFeature is returned when an archive uses a feature (eg. a
+	// compression algorithm, entry type, or on-disk layout) that isn't
+	// supported.
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	// ErrLimitExceeded is returned when an archive exceeds a configured limit,
+	// eg. on its size or number of entries.
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrInsecurePath is returned when a path, or the target of a link, would
+	// escape the root of an archive or destination directory.
+	ErrInsecurePath = errors.New("insecure path")
+)
+
+// ErrCorrupted is returned when an archive is truncated or malformed. Any
+// *ErrCorrupted matches any other with errors.Is, eg.
+// errors.Is(err, &ErrCorrupted{}).
+type ErrCorrupted struct {
+	// Offset is the offset within the archive at which the corruption was
+	// detected, or -1 if unknown.
+	Offset int64
+	// Detail describes the corruption.
+	Detail string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *ErrCorrupted) Error() string {
+	msg := "corrupted archive"
+	if e.Offset >= 0 {
+		msg += fmt.Sprintf(" at offset %d", e.Offset)
+	}
+
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	} else if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *ErrCorrupted) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrCorrupted) Is(target error) bool {
+	_, ok := target.(*ErrCorrupted)
+	return ok
+}
+
+// Define returns a new error with the given text that is of the given kind
+// (eg. ErrLimitExceeded), for backends to define more specific errors.
+func Define(kind error, text string) error {
+	return &kindError{kind: kind, text: text}
+}
+
+type kindError struct {
+	kind error
+	text string
+}
+
+func (e *kindError) Error() string {
+	return e.text
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
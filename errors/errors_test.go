@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package errors_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	t.Run("Define", func(t *testing.T) {
+		errTooMany := archiveerrors.Define(archiveerrors.ErrLimitExceeded, "too many entries")
+		err := fmt.Errorf("failed to open archive: %w", errTooMany)
+
+		require.EqualError(t, errTooMany, "too many entries")
+		require.ErrorIs(t, err, errTooMany)
+		require.ErrorIs(t, err, archiveerrors.ErrLimitExceeded)
+		require.NotErrorIs(t, err, archiveerrors.ErrInsecurePath)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		err := fmt.Errorf("failed to read header: %w", &archiveerrors.ErrCorrupted{Offset: 512, Err: io.ErrUnexpectedEOF})
+
+		require.EqualError(t, err, "failed to read header: corrupted archive at offset 512: unexpected EOF")
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		var corrupted *archiveerrors.ErrCorrupted
+		require.True(t, errors.As(err, &corrupted))
+		require.Equal(t, int64(512), corrupted.Offset)
+
+		require.EqualError(t, &archiveerrors.ErrCorrupted{Offset: -1, Detail: "bad magic"}, "corrupted archive: bad magic")
+		require.EqualError(t, &archiveerrors.ErrCorrupted{Offset: -1}, "corrupted archive")
+	})
+
+	t.Run("DefinedCorrupted", func(t *testing.T) {
+		errBadMap := archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "invalid sparse map")
+
+		require.ErrorIs(t, errBadMap, &archiveerrors.ErrCorrupted{})
+		require.NotErrorIs(t, errBadMap, archiveerrors.ErrUnsupportedFeature)
+	})
+}
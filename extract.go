@@ -0,0 +1,347 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/dpeckett/archivefs/internal/osutil"
+)
+
+// ExtractOptions configures how a filesystem is extracted.
+type ExtractOptions struct {
+	// Concurrency is the number of regular files to extract concurrently,
+	// defaults to the number of CPUs.
+	Concurrency int
+	// PreserveOwner sets the numeric owner of each extracted entry from the
+	// source (if known), and keeps the setuid, setgid and sticky bits of
+	// its mode, which are otherwise cleared. Failures due to insufficient
+	// privileges are ignored unless running as root. It has no effect on
+	// Windows.
+	PreserveOwner bool
+	// PreserveXattrs sets the extended attributes of each extracted file and
+	// directory from the source (if known). As with ownership, failures due
+	// to insufficient privileges are ignored unless running as root. It has
+	// no effect on platforms other than Linux.
+	PreserveXattrs bool
+	// Symlinks determines how symbolic links are extracted.
+	Symlinks SymlinkPolicy
+	// Filter, if set, is called for each path in the filesystem and reports
+	// whether it should be extracted. Excluding a directory excludes
+	// everything beneath it.
+	Filter func(path string, d fs.DirEntry) (bool, error)
+}
+
+// Extract extracts the contents of fsys into dir (which is created if
+// needed), preserving modes, modification times, symbolic links and hard
+// links (detected using LookupFileID). Regular files are written concurrently.
+//
+// Extraction is safe for untrusted filesystems. Entries are always created
+// beneath dir, failing with ErrEscapesRoot otherwise, and existing files are
+// never overwritten or written through. Symbolic links are created last, so
+// that no other entry can be written through them. Device nodes, named pipes
+// and sockets are skipped, and the setuid, setgid and sticky bits are only
+// kept with PreserveOwner.
+func Extract(ctx context.Context, fsys fs.FS, dir string, opts *ExtractOptions) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	e := &extractor{fsys: fsys, dir: dir, opts: opts}
+	if err := e.scan(ctx); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	// Directories are created writable, their final modes are set once all
+	// of their contents have been extracted.
+	for _, d := range e.dirs {
+		if err := e.mkdir(d.name); err != nil {
+			return err
+		}
+	}
+
+	if err := e.extractFiles(ctx, concurrency); err != nil {
+		return err
+	}
+
+	for _, l := range e.hardlinks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := os.Link(e.path(l.link), e.path(l.name)); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range e.symlinks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := e.symlink(l); err != nil {
+			return err
+		}
+	}
+
+	// Apply directory metadata deepest first, so that setting the modification
+	// time of a directory isn't undone by changes to its children.
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		if err := e.setMetadata(e.path(e.dirs[i].name), e.dirs[i].fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractEntry is an entry of the filesystem being extracted.
+type extractEntry struct {
+	name string
+	fi   fs.FileInfo
+	// link is the target of a symbolic link, or the first path of a hard
+	// linked file.
+	link string
+}
+
+type extractor struct {
+	fsys      fs.FS
+	dir       string
+	opts      *ExtractOptions
+	dirs      []extractEntry
+	files     []extractEntry
+	hardlinks []extractEntry
+	symlinks  []extractEntry
+}
+
+// scan walks the filesystem, validating every entry before anything is
+// written.
+func (e *extractor) scan(ctx context.Context) error {
+	// links holds the path of the first entry for each hard linked file.
+	links := map[uint64]string{}
+
+	return fs.WalkDir(e.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		if !safeName(name) {
+			return &fs.PathError{Op: "extract", Path: name, Err: ErrEscapesRoot}
+		}
+
+		if e.opts.Filter != nil {
+			include, err := e.opts.Filter(name, d)
+			if err != nil {
+				return err
+			}
+
+			if !include {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+
+				return nil
+			}
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			e.dirs = append(e.dirs, extractEntry{name: name, fi: fi})
+		case 0:
+			id, nlink, err := LookupFileID(e.fsys, name, fi)
+			if err != nil {
+				return err
+			}
+
+			if id != 0 && nlink > 1 {
+				if first, ok := links[id]; ok {
+					e.hardlinks = append(e.hardlinks, extractEntry{name: name, fi: fi, link: first})
+					return nil
+				}
+				links[id] = name
+			}
+
+			e.files = append(e.files, extractEntry{name: name, fi: fi})
+		case fs.ModeSymlink:
+			if e.opts.Symlinks == SymlinksSkip {
+				return nil
+			}
+
+			target, err := readLink(e.fsys, name)
+			if err != nil {
+				return err
+			}
+
+			target, err = e.opts.Symlinks.Target(e.fsys, name, target)
+			if err != nil {
+				return &fs.PathError{Op: "extract", Path: name, Err: err}
+			}
+
+			e.symlinks = append(e.symlinks, extractEntry{name: name, fi: fi, link: target})
+		}
+
+		return nil
+	})
+}
+
+// safeName reports whether name can be safely joined to the extraction
+// directory.
+func safeName(name string) bool {
+	if !fs.ValidPath(name) {
+		return false
+	}
+
+	// Backslashes and drive letters are path separators on Windows.
+	return runtime.GOOS != "windows" || !strings.ContainsAny(name, `\:`)
+}
+
+// path returns the local path an entry is extracted to.
+func (e *extractor) path(name string) string {
+	return filepath.Join(e.dir, filepath.FromSlash(name))
+}
+
+func (e *extractor) mkdir(name string) error {
+	err := os.Mkdir(e.path(name), 0o700)
+	if err == nil || !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	// Merge into existing directories, but never follow symbolic links out
+	// of the extraction directory.
+	fi, err := os.Lstat(e.path(name))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return &fs.PathError{Op: "extract", Path: name, Err: ErrEscapesRoot}
+	case !fi.IsDir():
+		return &fs.PathError{Op: "extract", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	return nil
+}
+
+func (e *extractor) extractFiles(ctx context.Context, concurrency int) error {
+	pool := osutil.NewPool(ctx, concurrency, e.extractFile)
+	for _, f := range e.files {
+		if err := pool.Go(f); err != nil {
+			break
+		}
+	}
+
+	return pool.Wait()
+}
+
+func (e *extractor) extractFile(entry extractEntry) error {
+	r, err := e.fsys.Open(entry.name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// O_EXCL ensures we never write through an existing file or symlink.
+	path := e.path(entry.name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract file %s: %w", entry.name, err)
+	}
+
+	return e.setMetadata(path, entry.fi)
+}
+
+// symlink creates a symbolic link and sets its owner. Its other metadata is
+// never applied, as that would follow the link.
+func (e *extractor) symlink(entry extractEntry) error {
+	path := e.path(entry.name)
+	if err := os.Symlink(filepath.FromSlash(entry.link), path); err != nil {
+		return err
+	}
+
+	if e.opts.PreserveOwner {
+		if uid, gid, ok := LookupOwner(entry.fi); ok {
+			if err := osutil.SetOwner(path, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setMetadata applies the ownership, extended attributes, mode and
+// modification time of an entry to an extracted file or directory.
+func (e *extractor) setMetadata(path string, fi fs.FileInfo) error {
+	if e.opts.PreserveOwner {
+		if uid, gid, ok := LookupOwner(fi); ok {
+			if err := osutil.SetOwner(path, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if e.opts.PreserveXattrs {
+		if err := osutil.SetXattrs(path, Xattrs(fi), nil); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	mode := fi.Mode()
+	if !e.opts.PreserveOwner {
+		// Otherwise a setuid file would be owned by whoever extracted it.
+		mode &^= fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	}
+
+	if err := osutil.SetMode(path, mode); err != nil {
+		return err
+	}
+
+	return osutil.SetModTime(path, fi.ModTime())
+}
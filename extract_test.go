@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtract(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require elevated privileges on Windows")
+	}
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.MkdirAll("var/cache", 0o700))
+	require.NoError(t, src.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, src.WriteFile("usr/bin/busybox", []byte("#!/bin/sh"), 0o755))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/ash"))
+	require.NoError(t, src.Symlink("/usr/bin/busybox", "usr/bin/sh"))
+	require.NoError(t, src.Symlink("../hostname", "etc/ssl/hostname"))
+
+	t.Run("Extract", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "rootfs")
+		fsys := archivefs.NormalizeTimes(src, &archivefs.TimesOptions{Time: mtime})
+		require.NoError(t, archivefs.Extract(context.Background(), fsys, dir, nil))
+
+		data, err := os.ReadFile(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(data))
+
+		fi, err := os.Stat(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(mtime))
+
+		fi, err = os.Stat(filepath.Join(dir, "etc"))
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(mtime))
+
+		fi, err = os.Stat(filepath.Join(dir, "var/cache"))
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o700, fi.Mode())
+
+		busybox, err := os.Stat(filepath.Join(dir, "usr/bin/busybox"))
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o755), busybox.Mode())
+
+		ash, err := os.Stat(filepath.Join(dir, "usr/bin/ash"))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(busybox, ash))
+
+		target, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+		require.NoError(t, err)
+		require.Equal(t, "/usr/bin/busybox", target)
+	})
+
+	t.Run("SpecialBits", func(t *testing.T) {
+		src := memfs.New()
+		require.NoError(t, src.MkdirAll("tmp", fs.ModeSticky|0o777))
+		require.NoError(t, src.WriteFile("su", []byte("#!/bin/sh"), fs.ModeSetuid|0o755))
+
+		fi, err := fs.Stat(src, "su")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSetuid|0o755, fi.Mode())
+
+		// The bits are cleared, unless ownership is preserved too.
+		dir := t.TempDir()
+		require.NoError(t, archivefs.Extract(context.Background(), src, dir, nil))
+
+		fi, err = os.Stat(filepath.Join(dir, "su"))
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o755), fi.Mode())
+
+		fi, err = os.Stat(filepath.Join(dir, "tmp"))
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o777, fi.Mode())
+
+		dir = t.TempDir()
+		require.NoError(t, archivefs.Extract(context.Background(), src, dir, &archivefs.ExtractOptions{
+			PreserveOwner: true,
+		}))
+
+		fi, err = os.Stat(filepath.Join(dir, "su"))
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSetuid|0o755, fi.Mode())
+
+		fi, err = os.Stat(filepath.Join(dir, "tmp"))
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|fs.ModeSticky|0o777, fi.Mode())
+	})
+
+	t.Run("Relative", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, archivefs.Extract(context.Background(), src, dir, &archivefs.ExtractOptions{
+			Symlinks: archivefs.SymlinksRelative,
+		}))
+
+		target, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+		require.NoError(t, err)
+		require.Equal(t, "../../usr/bin/busybox", target)
+	})
+
+	t.Run("FailEscaping", func(t *testing.T) {
+		dir := t.TempDir()
+		err := archivefs.Extract(context.Background(), src, dir, &archivefs.ExtractOptions{
+			Symlinks: archivefs.SymlinksFailEscaping,
+		})
+		require.ErrorIs(t, err, archivefs.ErrEscapesRoot)
+
+		// Nothing is written if the filesystem fails validation.
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("ChainedEscape", func(t *testing.T) {
+		// Neither link escapes lexically, but once sub/a exists sub/b
+		// resolves through it to a file outside of the extraction directory.
+		src := memfs.New()
+		require.NoError(t, src.MkdirAll("sub", 0o755))
+		require.NoError(t, src.Symlink("..", "sub/a"))
+		require.NoError(t, src.Symlink("a/../outside", "sub/b"))
+
+		for _, policy := range []archivefs.SymlinkPolicy{archivefs.SymlinksFailEscaping, archivefs.SymlinksRelative} {
+			parent := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(parent, "outside"), []byte("secret\n"), 0o644))
+
+			dir := filepath.Join(parent, "x")
+			err := archivefs.Extract(context.Background(), src, dir, &archivefs.ExtractOptions{
+				Symlinks: policy,
+			})
+			require.ErrorIs(t, err, archivefs.ErrEscapesRoot)
+
+			_, err = os.ReadFile(filepath.Join(dir, "sub/b"))
+			require.ErrorIs(t, err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, archivefs.Extract(context.Background(), src, dir, &archivefs.ExtractOptions{
+			Filter: func(path string, d fs.DirEntry) (bool, error) {
+				return path != "usr", nil
+			},
+			Symlinks: archivefs.SymlinksSkip,
+		}))
+
+		_, err := os.Lstat(filepath.Join(dir, "usr"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = os.Lstat(filepath.Join(dir, "etc/ssl/hostname"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Existing", func(t *testing.T) {
+		dir := t.TempDir()
+		outside := t.TempDir()
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "etc")))
+
+		err := archivefs.Extract(context.Background(), src, dir, nil)
+		require.ErrorIs(t, err, archivefs.ErrEscapesRoot)
+
+		entries, err := os.ReadDir(outside)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		dir = t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "etc/hostname"), []byte("beta\n"), 0o644))
+
+		err = archivefs.Extract(context.Background(), src, dir, nil)
+		require.ErrorIs(t, err, fs.ErrExist)
+
+		data, err := os.ReadFile(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, "beta\n", string(data))
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := archivefs.Extract(ctx, src, t.TempDir(), nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
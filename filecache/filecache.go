@@ -0,0 +1,401 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package filecache caches the contents of whole files in memory and/or on
+// disk, in front of filesystems that are slow to read from (eg. compressed
+// erofs images, or tarfs archives backed by a remote source), evicting the
+// least recently used files. Unlike blockcache, files are cached after they
+// have been decompressed or extracted.
+package filecache
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/dpeckett/archivefs"
+)
+
+var (
+	_ fs.ReadDirFS         = (*cachedFS)(nil)
+	_ fs.ReadFileFS        = (*cachedFS)(nil)
+	_ fs.StatFS            = (*cachedFS)(nil)
+	_ archivefs.ReadLinkFS = (*cachedFS)(nil)
+)
+
+// Options configures a file cache.
+type Options struct {
+	// MemorySize is the maximum total size in bytes of the files cached in
+	// memory, defaults to 64 MiB. A negative value disables the memory cache.
+	MemorySize int64
+	// DiskSize is the maximum total size in bytes of the files cached on
+	// disk, in a temporary directory that is removed by Close. Files evicted
+	// from memory are moved to the disk cache. Zero disables the disk cache.
+	DiskSize int64
+	// Dir is the parent directory of the disk cache, defaults to
+	// os.TempDir().
+	Dir string
+	// MaxFileSize is the size of the largest file that will be cached,
+	// defaults to a quarter of the larger of MemorySize and DiskSize. Larger
+	// files are always read from the underlying filesystem.
+	MaxFileSize int64
+}
+
+// Stats describes the effectiveness of a cache.
+type Stats struct {
+	// Hits is the number of files served from memory.
+	Hits int64
+	// DiskHits is the number of files served from disk.
+	DiskHits int64
+	// Misses is the number of files read from an underlying filesystem.
+	Misses int64
+}
+
+// Cache caches the contents of the files of one or more filesystems, each of
+// which is identified by the identity of its backing image. Concurrent reads
+// of the same uncached file are coalesced into a single read. It is safe for
+// concurrent use.
+type Cache struct {
+	maxFileSize int64
+
+	mu       sync.Mutex
+	mem      *lru[[]byte]
+	disk     *diskCache
+	inflight map[key]*load
+	// generation is incremented by Invalidate, so that files loaded
+	// concurrently are not cached.
+	generation int64
+	stats      Stats
+}
+
+// key identifies a cached file.
+type key struct {
+	identity string
+	name     string
+}
+
+// load is a pending read of a file from an underlying filesystem.
+type load struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// New returns a new, empty, file cache.
+func New(opts *Options) (*Cache, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	memorySize := opts.MemorySize
+	if memorySize == 0 {
+		memorySize = 64 << 20
+	}
+
+	maxFileSize := opts.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = max(memorySize, opts.DiskSize) / 4
+	}
+
+	c := &Cache{
+		maxFileSize: maxFileSize,
+		inflight:    map[key]*load{},
+	}
+
+	if opts.DiskSize > 0 {
+		disk, err := newDiskCache(opts.Dir, opts.DiskSize)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+
+	if memorySize > 0 {
+		c.mem = newLRU[[]byte](memorySize)
+		if c.disk != nil {
+			c.mem.onEvict = c.disk.put
+		}
+	}
+
+	return c, nil
+}
+
+// FS returns a view of fsys that reads the contents of regular files through
+// the cache. The identity of the image backing fsys (eg. its digest) keys
+// the cached files, it must change whenever the contents of fsys do.
+func (c *Cache) FS(fsys fs.FS, identity string) fs.FS {
+	return &cachedFS{fsys: fsys, identity: identity, cache: c}
+}
+
+// Invalidate removes the cached files of the filesystem with the given
+// identity, eg. after its backing image has been replaced.
+func (c *Cache) Invalidate(identity string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	matches := func(k key) bool {
+		return k.identity == identity
+	}
+
+	if c.mem != nil {
+		c.mem.removeFunc(matches)
+	}
+
+	if c.disk != nil {
+		c.disk.removeFunc(matches)
+	}
+}
+
+// Stats returns the cache statistics.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// Close removes the disk cache (if any). The underlying filesystems are not
+// closed.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.disk == nil {
+		return nil
+	}
+
+	err := c.disk.close()
+	c.disk = nil
+	if c.mem != nil {
+		c.mem.onEvict = nil
+	}
+
+	return err
+}
+
+// get returns the contents of a file, calling read to read it from the
+// underlying filesystem if it isn't cached.
+func (c *Cache) get(k key, read func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+
+	if c.mem != nil {
+		if data, ok := c.mem.get(k); ok {
+			c.stats.Hits++
+			c.mu.Unlock()
+			return data, nil
+		}
+	}
+
+	if c.disk != nil {
+		if data, ok := c.disk.get(k); ok {
+			c.stats.DiskHits++
+			if c.mem != nil {
+				c.mem.put(k, data, int64(len(data)))
+			}
+			c.mu.Unlock()
+			return data, nil
+		}
+	}
+
+	if l, ok := c.inflight[k]; ok {
+		c.mu.Unlock()
+		<-l.done
+		return l.data, l.err
+	}
+
+	l := &load{done: make(chan struct{})}
+	c.inflight[k] = l
+	c.stats.Misses++
+	generation := c.generation
+	c.mu.Unlock()
+
+	l.data, l.err = read()
+
+	c.mu.Lock()
+	delete(c.inflight, k)
+	if l.err == nil && generation == c.generation {
+		if c.mem != nil {
+			c.mem.put(k, l.data, int64(len(l.data)))
+		} else if c.disk != nil {
+			c.disk.put(k, l.data)
+		}
+	}
+	c.mu.Unlock()
+
+	close(l.done)
+
+	return l.data, l.err
+}
+
+type cachedFS struct {
+	fsys     fs.FS
+	identity string
+	cache    *Cache
+}
+
+func (fsys *cachedFS) Open(name string) (fs.File, error) {
+	fi, err := fs.Stat(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() || fi.Size() > fsys.cache.maxFileSize {
+		return fsys.fsys.Open(name)
+	}
+
+	data, err := fsys.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file{Reader: bytes.NewReader(data), fi: fi}, nil
+}
+
+func (fsys *cachedFS) ReadFile(name string) ([]byte, error) {
+	fi, err := fs.Stat(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() || fi.Size() > fsys.cache.maxFileSize {
+		return fs.ReadFile(fsys.fsys, name)
+	}
+
+	data, err := fsys.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cached contents are shared, so the caller gets a copy.
+	return bytes.Clone(data), nil
+}
+
+func (fsys *cachedFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.fsys, name)
+}
+
+func (fsys *cachedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(fsys.fsys, name)
+}
+
+func (fsys *cachedFS) ReadLink(name string) (string, error) {
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	return linkFS.ReadLink(name)
+}
+
+func (fsys *cachedFS) StatLink(name string) (fs.FileInfo, error) {
+	if linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS); ok {
+		return linkFS.StatLink(name)
+	}
+
+	return fs.Stat(fsys.fsys, name)
+}
+
+// readFile returns the (shared) contents of the named regular file.
+func (fsys *cachedFS) readFile(name string) ([]byte, error) {
+	return fsys.cache.get(key{identity: fsys.identity, name: name}, func() ([]byte, error) {
+		return fs.ReadFile(fsys.fsys, name)
+	})
+}
+
+// file is an open file, whose contents were read through the cache.
+type file struct {
+	*bytes.Reader
+	fi fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// diskCache stores each file in a temporary directory.
+type diskCache struct {
+	dir   string
+	files *lru[string]
+	next  int64
+}
+
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	dir, err := os.MkdirTemp(dir, "filecache-*")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{dir: dir}
+	c.files = newLRU[string](maxSize)
+	c.files.onEvict = func(_ key, path string) {
+		_ = os.Remove(path)
+	}
+
+	return c, nil
+}
+
+// get reads a cached file, failures are treated as a miss.
+func (c *diskCache) get(k key) ([]byte, bool) {
+	path, ok := c.files.get(k)
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.files.remove(k)
+		_ = os.Remove(path)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// put caches a file, failures are ignored (as the file can always be read
+// again).
+func (c *diskCache) put(k key, data []byte) {
+	if _, ok := c.files.get(k); ok {
+		return
+	}
+
+	if int64(len(data)) > c.files.max {
+		return
+	}
+
+	path := filepath.Join(c.dir, strconv.FormatInt(c.next, 10))
+	c.next++
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		_ = os.Remove(path)
+		return
+	}
+
+	c.files.put(k, path, int64(len(data)))
+}
+
+// removeFunc removes the cached files for which del returns true.
+func (c *diskCache) removeFunc(del func(k key) bool) {
+	for _, path := range c.files.removeFunc(del) {
+		_ = os.Remove(path)
+	}
+}
+
+func (c *diskCache) close() error {
+	return os.RemoveAll(c.dir)
+}
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package filecache_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/archivefs/filecache"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCache(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, src.WriteFile("etc/motd", bytes.Repeat([]byte("welcome\n"), 128), 0o644))
+	require.NoError(t, src.WriteFile("etc/large", make([]byte, 8192), 0o644))
+
+	t.Run("Memory", func(t *testing.T) {
+		counting := &countingFS{FS: src}
+		cache, err := filecache.New(&filecache.Options{MemorySize: 4096, MaxFileSize: 2048})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, cache.Close())
+		})
+
+		fsys := cache.FS(counting, "image")
+		require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "etc/motd", "etc/large"))
+
+		opens := counting.opens.Load()
+
+		data, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(data))
+
+		f, err := fsys.Open("etc/motd")
+		require.NoError(t, err)
+		data, err = io.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Equal(t, bytes.Repeat([]byte("welcome\n"), 128), data)
+
+		// Cached files are not read from the underlying filesystem.
+		require.Equal(t, opens, counting.opens.Load())
+		require.NotZero(t, cache.Stats().Hits)
+
+		// Files larger than MaxFileSize are not cached.
+		_, err = fs.ReadFile(fsys, "etc/large")
+		require.NoError(t, err)
+		require.Equal(t, opens+1, counting.opens.Load())
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		dir := t.TempDir()
+
+		counting := &countingFS{FS: src}
+		cache, err := filecache.New(&filecache.Options{
+			MemorySize:  1024,
+			DiskSize:    1 << 20,
+			Dir:         dir,
+			MaxFileSize: 1 << 20,
+		})
+		require.NoError(t, err)
+
+		fsys := cache.FS(counting, "image")
+
+		for _, name := range []string{"etc/hostname", "etc/motd", "etc/large"} {
+			_, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err)
+		}
+
+		// Files evicted from (or too large for) memory are read from disk.
+		opens := counting.opens.Load()
+
+		data, err := fs.ReadFile(fsys, "etc/large")
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, 8192), data)
+		require.Equal(t, opens, counting.opens.Load())
+		require.NotZero(t, cache.Stats().DiskHits)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		require.NoError(t, cache.Close())
+
+		entries, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		// Reads still work, without the disk cache.
+		data, err = fs.ReadFile(fsys, "etc/large")
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, 8192), data)
+	})
+
+	t.Run("Identity", func(t *testing.T) {
+		cache, err := filecache.New(nil)
+		require.NoError(t, err)
+
+		other := memfs.New()
+		require.NoError(t, other.MkdirAll("etc", 0o755))
+		require.NoError(t, other.WriteFile("etc/hostname", []byte("beta\n"), 0o644))
+
+		data, err := fs.ReadFile(cache.FS(src, "alpha"), "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(data))
+
+		data, err = fs.ReadFile(cache.FS(other, "beta"), "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "beta\n", string(data))
+
+		// The cached contents are stale until the identity is invalidated.
+		data, err = fs.ReadFile(cache.FS(other, "alpha"), "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(data))
+
+		cache.Invalidate("alpha")
+
+		data, err = fs.ReadFile(cache.FS(other, "alpha"), "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "beta\n", string(data))
+	})
+
+	t.Run("Coalesce", func(t *testing.T) {
+		counting := &countingFS{FS: src, delay: 10 * time.Millisecond}
+		cache, err := filecache.New(nil)
+		require.NoError(t, err)
+
+		fsys := cache.FS(counting, "image")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				data, err := fs.ReadFile(fsys, "etc/hostname")
+				require.NoError(t, err)
+				require.Equal(t, "alpha\n", string(data))
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, int32(1), counting.opens.Load())
+	})
+
+	t.Run("TarFS", func(t *testing.T) {
+		var archive bytes.Buffer
+		require.NoError(t, tarfs.Create(&archive, src))
+
+		tarFS, err := tarfs.Open(bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+
+		cache, err := filecache.New(nil)
+		require.NoError(t, err)
+
+		fsys := cache.FS(tarFS, "sha256:0123")
+
+		// Returned contents may be modified by the caller.
+		data, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		copy(data, "gamma")
+
+		data, err = fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(data))
+	})
+}
+
+// countingFS counts the files opened from an underlying filesystem.
+type countingFS struct {
+	fs.FS
+	delay time.Duration
+	opens atomic.Int32
+}
+
+func (fsys *countingFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		fsys.opens.Add(1)
+		time.Sleep(fsys.delay)
+	}
+
+	return f, nil
+}
+
+func (fsys *countingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.FS, name)
+}
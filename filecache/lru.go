@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package filecache
+
+import (
+	"container/list"
+)
+
+// lru is a least recently used cache of values, bounded by their total size.
+// It is not safe for concurrent use.
+type lru[V any] struct {
+	max   int64
+	size  int64
+	order *list.List
+	items map[key]*list.Element
+	// onEvict, if set, is called with each value evicted from the cache
+	// (including values too large to be cached at all).
+	onEvict func(k key, value V)
+}
+
+type lruEntry[V any] struct {
+	key   key
+	value V
+	size  int64
+}
+
+func newLRU[V any](max int64) *lru[V] {
+	return &lru[V]{
+		max:   max,
+		order: list.New(),
+		items: map[key]*list.Element{},
+	}
+}
+
+// get returns the cached value, marking it as the most recently used.
+func (c *lru[V]) get(k key) (V, bool) {
+	e, ok := c.items[k]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[V]).value, true
+}
+
+// put caches a value of the given size, evicting the least recently used
+// values until it fits.
+func (c *lru[V]) put(k key, value V, size int64) {
+	c.remove(k)
+
+	if size > c.max {
+		if c.onEvict != nil {
+			c.onEvict(k, value)
+		}
+		return
+	}
+
+	for c.size+size > c.max {
+		c.evictOldest()
+	}
+
+	c.items[k] = c.order.PushFront(&lruEntry[V]{key: k, value: value, size: size})
+	c.size += size
+}
+
+// remove removes a value from the cache, without calling onEvict.
+func (c *lru[V]) remove(k key) (V, bool) {
+	e, ok := c.items[k]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	entry := e.Value.(*lruEntry[V])
+	c.order.Remove(e)
+	delete(c.items, k)
+	c.size -= entry.size
+
+	return entry.value, true
+}
+
+// removeFunc removes the values for which del returns true, without calling
+// onEvict, and returns them.
+func (c *lru[V]) removeFunc(del func(k key) bool) []V {
+	var removed []V
+	for k := range c.items {
+		if del(k) {
+			value, _ := c.remove(k)
+			removed = append(removed, value)
+		}
+	}
+
+	return removed
+}
+
+func (c *lru[V]) evictOldest() {
+	e := c.order.Back()
+	if e == nil {
+		return
+	}
+
+	entry := e.Value.(*lruEntry[V])
+	c.remove(entry.key)
+
+	if c.onEvict != nil {
+		c.onEvict(entry.key, entry.value)
+	}
+}
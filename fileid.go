@@ -0,0 +1,18 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+// FileID may be implemented by the value returned from fs.FileInfo.Sys() to
+// identify the underlying file, so that hard links to the same file can be
+// detected. Entries with the same id within a filesystem are hard links to
+// the same file.
+type FileID interface {
+	FileID() (id uint64, nlink int)
+}
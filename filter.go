@@ -0,0 +1,401 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/dpeckett/archivefs/internal/readdir"
+)
+
+// FilterOptions configures a filtered filesystem.
+type FilterOptions struct {
+	// Exclude is a list of path.Match patterns, entries whose path or base
+	// name matches any of the patterns are hidden.
+	Exclude []string
+	// Include, if set, is called for each entry (with the FileInfo of the
+	// entry, not following symbolic links) and the entry is hidden unless
+	// it returns true.
+	Include func(name string, fi fs.FileInfo) bool
+	// Rename, if set, rewrites the base name of each entry. It is passed the
+	// path of the parent directory in the filtered filesystem, and the base
+	// name of the entry in the underlying filesystem. Renamed entries must
+	// remain unique within their directory.
+	Rename func(dir, name string) string
+}
+
+var (
+	_ fs.ReadDirFS = (*filterFS)(nil)
+	_ fs.StatFS    = (*filterFS)(nil)
+	_ ReadLinkFS   = (*filterFS)(nil)
+)
+
+// Filter returns a read-only view of fsys that hides entries, and
+// optionally rewrites their names, according to opts. Hiding a directory
+// hides everything beneath it. Exclude patterns and the Include predicate
+// are evaluated against names in the underlying filesystem.
+//
+// Symbolic links are resolved by the underlying filesystem, and their
+// targets are not rewritten.
+func Filter(fsys fs.FS, opts *FilterOptions) (fs.FS, error) {
+	if opts == nil {
+		opts = &FilterOptions{}
+	}
+
+	for _, pattern := range opts.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return &filterFS{
+		fsys:    fsys,
+		exclude: opts.Exclude,
+		include: opts.Include,
+		rename:  opts.Rename,
+	}, nil
+}
+
+type filterFS struct {
+	fsys    fs.FS
+	exclude []string
+	include func(name string, fi fs.FileInfo) bool
+	rename  func(dir, name string) string
+}
+
+func (fsys *filterFS) Open(name string) (fs.File, error) {
+	realName, err := fsys.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.fsys.Open(realName)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &filterDir{File: f, fsys: fsys, name: name, realName: realName}, nil
+	}
+
+	if fsys.rename != nil {
+		return &renamedFile{File: f, name: path.Base(name)}, nil
+	}
+
+	return f, nil
+}
+
+func (fsys *filterFS) Stat(name string) (fs.FileInfo, error) {
+	realName, err := fsys.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fs.Stat(fsys.fsys, realName)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.renameInfo(name, fi), nil
+}
+
+func (fsys *filterFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	realName, err := fsys.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.readDir(name, realName)
+}
+
+func (fsys *filterFS) ReadLink(name string) (string, error) {
+	realName, err := fsys.resolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	return readLink(fsys.fsys, realName)
+}
+
+func (fsys *filterFS) StatLink(name string) (fs.FileInfo, error) {
+	realName, err := fsys.resolve("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := lstat(fsys.fsys, realName)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.renameInfo(name, fi), nil
+}
+
+// resolve returns the name in the underlying filesystem of the named entry,
+// or fs.ErrNotExist if it, or any of its parents, is hidden.
+func (fsys *filterFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return name, nil
+	}
+
+	dir, realDir := ".", "."
+	for _, elem := range strings.Split(name, "/") {
+		realName, err := fsys.lookup(dir, realDir, elem)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		dir, realDir = path.Join(dir, elem), realName
+	}
+
+	return realDir, nil
+}
+
+// lookup returns the underlying name of the visible entry called elem, in
+// the directory dir (whose underlying name is realDir).
+func (fsys *filterFS) lookup(dir, realDir, elem string) (string, error) {
+	if fsys.rename == nil {
+		realName := path.Join(realDir, elem)
+
+		var fi fs.FileInfo
+		if fsys.include != nil {
+			var err error
+			fi, err = lstat(fsys.fsys, realName)
+			if err != nil {
+				return "", unwrapPathError(err)
+			}
+		}
+
+		if fsys.hidden(realName, fi) {
+			return "", fs.ErrNotExist
+		}
+
+		return realName, nil
+	}
+
+	entries, err := fs.ReadDir(fsys.fsys, realDir)
+	if err != nil {
+		return "", unwrapPathError(err)
+	}
+
+	for _, de := range entries {
+		if fsys.rename(dir, de.Name()) != elem {
+			continue
+		}
+
+		realName := path.Join(realDir, de.Name())
+
+		visible, err := fsys.visible(realName, de)
+		if err != nil {
+			return "", err
+		}
+
+		if visible {
+			return realName, nil
+		}
+	}
+
+	return "", fs.ErrNotExist
+}
+
+// readDir returns the visible entries of the directory dir (whose
+// underlying name is realDir).
+func (fsys *filterFS) readDir(dir, realDir string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.fsys, realDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.filterEntries(dir, realDir, entries)
+}
+
+func (fsys *filterFS) filterEntries(dir, realDir string, entries []fs.DirEntry) ([]fs.DirEntry, error) {
+	filtered := make([]fs.DirEntry, 0, len(entries))
+	for _, de := range entries {
+		visible, err := fsys.visible(path.Join(realDir, de.Name()), de)
+		if err != nil {
+			return nil, err
+		}
+
+		if !visible {
+			continue
+		}
+
+		if fsys.rename != nil {
+			if name := fsys.rename(dir, de.Name()); name != de.Name() {
+				de = &renamedDirEntry{DirEntry: de, name: name}
+			}
+		}
+
+		filtered = append(filtered, de)
+	}
+
+	if fsys.rename != nil {
+		slices.SortFunc(filtered, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+
+	return filtered, nil
+}
+
+// visible reports whether the directory entry (with the underlying name
+// realName) is visible.
+func (fsys *filterFS) visible(realName string, de fs.DirEntry) (bool, error) {
+	var fi fs.FileInfo
+	if fsys.include != nil {
+		var err error
+		fi, err = de.Info()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return !fsys.hidden(realName, fi), nil
+}
+
+// hidden reports whether the entry with the underlying name realName should
+// be hidden. fi is only required if there is an Include predicate.
+func (fsys *filterFS) hidden(realName string, fi fs.FileInfo) bool {
+	base := path.Base(realName)
+	for _, pattern := range fsys.exclude {
+		if ok, _ := path.Match(pattern, realName); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+
+	return fsys.include != nil && !fsys.include(realName, fi)
+}
+
+// renameInfo returns fi, with the base name of the entry in the filtered
+// filesystem.
+func (fsys *filterFS) renameInfo(name string, fi fs.FileInfo) fs.FileInfo {
+	if fsys.rename == nil || name == "." || fi.Name() == path.Base(name) {
+		return fi
+	}
+
+	return &renamedFileInfo{FileInfo: fi, name: path.Base(name)}
+}
+
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+
+	return err
+}
+
+// renamedFile is an open file with a rewritten name.
+type renamedFile struct {
+	fs.File
+	name string
+}
+
+func (f *renamedFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &renamedFileInfo{FileInfo: fi, name: f.name}, nil
+}
+
+// filterDir is an open directory in the filtered filesystem.
+type filterDir struct {
+	fs.File
+	fsys     *filterFS
+	name     string
+	realName string
+	readdir.Entries
+	read bool
+}
+
+func (d *filterDir) Stat() (fs.FileInfo, error) {
+	fi, err := d.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.fsys.renameInfo(d.name, fi), nil
+}
+
+func (d *filterDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *filterDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		dirFile, ok := d.File.(fs.ReadDirFile)
+		if !ok {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: errors.ErrUnsupported}
+		}
+
+		entries, err := dirFile.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err = d.fsys.filterEntries(d.name, d.realName, entries)
+		if err != nil {
+			return nil, err
+		}
+
+		d.Entries, d.read = readdir.New(entries), true
+	}
+
+	return d.Entries.ReadDir(n)
+}
+
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *renamedFileInfo) Name() string {
+	return fi.name
+}
+
+type renamedDirEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (de *renamedDirEntry) Name() string {
+	return de.name
+}
+
+func (de *renamedDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := de.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return &renamedFileInfo{FileInfo: fi, name: de.name}, nil
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("src/.git", 0o755))
+	require.NoError(t, src.MkdirAll("src/pkg", 0o755))
+	require.NoError(t, src.WriteFile("src/.git/HEAD", []byte("ref"), 0o644))
+	require.NoError(t, src.WriteFile("src/main.go", []byte("package main"), 0o644))
+	require.NoError(t, src.WriteFile("src/main.o", []byte("object"), 0o644))
+	require.NoError(t, src.WriteFile("src/pkg/big.bin", make([]byte, 1024), 0o644))
+	require.NoError(t, src.Symlink("src/main.go", "link.go"))
+
+	t.Run("Exclude", func(t *testing.T) {
+		fsys, err := archivefs.Filter(src, &archivefs.FilterOptions{
+			Exclude: []string{".git", "*.o"},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"main.go", "pkg"}, readDirNames(t, fsys, "src"))
+
+		_, err = fs.Stat(fsys, "src/.git/HEAD")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fs.ReadFile(fsys, "src/main.o")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		target, err := fsys.(archivefs.ReadLinkFS).ReadLink("link.go")
+		require.NoError(t, err)
+		require.Equal(t, "src/main.go", target)
+
+		require.NoError(t, fstest.TestFS(fsys, "src/main.go", "src/pkg/big.bin"))
+	})
+
+	t.Run("Include", func(t *testing.T) {
+		fsys, err := archivefs.Filter(src, &archivefs.FilterOptions{
+			Include: func(name string, fi fs.FileInfo) bool {
+				return fi.IsDir() || fi.Size() < 512
+			},
+		})
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "src/pkg/big.bin")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		require.Empty(t, readDirNames(t, fsys, "src/pkg"))
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		fsys, err := archivefs.Filter(src, &archivefs.FilterOptions{
+			Exclude: []string{"src/.git"},
+			Rename: func(dir, name string) string {
+				return strings.ToUpper(name)
+			},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"LINK.GO", "SRC"}, readDirNames(t, fsys, "."))
+
+		data, err := fs.ReadFile(fsys, "SRC/MAIN.GO")
+		require.NoError(t, err)
+		require.Equal(t, "package main", string(data))
+
+		_, err = fs.Stat(fsys, "src/main.go")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		fi, err := fsys.(archivefs.ReadLinkFS).StatLink("LINK.GO")
+		require.NoError(t, err)
+		require.Equal(t, "LINK.GO", fi.Name())
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+		require.NoError(t, fstest.TestFS(fsys, "SRC/MAIN.GO", "SRC/MAIN.O", "SRC/PKG/BIG.BIN"))
+	})
+
+	t.Run("BadPattern", func(t *testing.T) {
+		_, err := archivefs.Filter(src, &archivefs.FilterOptions{
+			Exclude: []string{"["},
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,14 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package fusefs mounts any filesystem (eg. an erofs image, a tar archive,
+// or an overlay of several) read-only via FUSE, so that it can be browsed
+// without root privileges or kernel support for the archive format. FUSE is
+// only supported on Linux and macOS.
+package fusefs
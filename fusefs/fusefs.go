@@ -0,0 +1,262 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/vfs"
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Options configures a FUSE mount.
+type Options struct {
+	// FsName is the name of the filesystem shown in the mount table (eg.
+	// the path of the archive).
+	FsName string
+	// AllowOther allows users other than the one that mounted the
+	// filesystem to access it. This requires user_allow_other to be set in
+	// /etc/fuse.conf if not running as root.
+	AllowOther bool
+	// CacheTimeout is how long the kernel may cache the names and
+	// attributes of entries. As the filesystem is read-only this can be
+	// long, if zero it defaults to one minute.
+	CacheTimeout time.Duration
+	// Debug enables logging of every FUSE request.
+	Debug bool
+}
+
+// Server is a mounted filesystem.
+type Server struct {
+	server *fuse.Server
+}
+
+// Unmount unmounts the filesystem. It fails if the filesystem is busy.
+func (s *Server) Unmount() error {
+	return s.server.Unmount()
+}
+
+// Wait waits for the filesystem to be unmounted (eg. via fusermount -u).
+func (s *Server) Wait() {
+	s.server.Wait()
+}
+
+// Mount mounts fsys read-only at dir, and returns once the filesystem is
+// ready to be accessed. Symbolic links are only supported if fsys implements
+// archivefs.ReadLinkFS.
+func Mount(dir string, fsys fs.FS, opts *Options) (*Server, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	timeout := opts.CacheTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	fsName := opts.FsName
+	if fsName == "" {
+		fsName = "archivefs"
+	}
+
+	server, err := gofs.Mount(dir, &node{fsys: fsys, name: "."}, &gofs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther:  opts.AllowOther,
+			FsName:      fsName,
+			Name:        "archivefs",
+			Options:     []string{"ro"},
+			DirectMount: true,
+			Debug:       opts.Debug,
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		// The filesystem is immutable, so negative lookups can be cached too.
+		NegativeTimeout: &timeout,
+		NullPermissions: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{server: server}, nil
+}
+
+var (
+	_ gofs.NodeLookuper    = (*node)(nil)
+	_ gofs.NodeReaddirer   = (*node)(nil)
+	_ gofs.NodeGetattrer   = (*node)(nil)
+	_ gofs.NodeReadlinker  = (*node)(nil)
+	_ gofs.NodeOpener      = (*node)(nil)
+	_ gofs.NodeGetxattrer  = (*node)(nil)
+	_ gofs.NodeListxattrer = (*node)(nil)
+)
+
+// node is an entry in the mounted filesystem.
+type node struct {
+	gofs.Inode
+	fsys fs.FS
+	name string
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	childName := path.Join(n.name, name)
+
+	fi, err := vfs.Lstat(n.fsys, childName)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	fillAttr(fi, &out.Attr)
+
+	child := &node{fsys: n.fsys, name: childName}
+	return n.NewInode(ctx, child, gofs.StableAttr{
+		Mode: out.Attr.Mode & syscall.S_IFMT,
+		Ino:  out.Attr.Ino,
+	}), 0
+}
+
+func (n *node) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	entries, err := fs.ReadDir(n.fsys, n.name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, de := range entries {
+		list = append(list, fuse.DirEntry{
+			Name: de.Name(),
+			Mode: vfs.Mode(de.Type()),
+		})
+	}
+
+	return gofs.NewListDirStream(list), 0
+}
+
+func (n *node) Getattr(ctx context.Context, fh gofs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fi, err := vfs.Lstat(n.fsys, n.name)
+	if err != nil {
+		return toErrno(err)
+	}
+
+	fillAttr(fi, &out.Attr)
+
+	return 0
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := vfs.ReadLink(n.fsys, n.name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	return []byte(target), 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+
+	f, err := vfs.Open(n.fsys, n.name)
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+
+	// The contents of files never change, so the page cache can be kept
+	// across opens.
+	return &handle{f: f}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	fi, err := vfs.Lstat(n.fsys, n.name)
+	if err != nil {
+		return 0, toErrno(err)
+	}
+
+	value, ok := archivefs.Xattrs(fi)[attr]
+	if !ok {
+		return 0, syscall.Errno(fuse.ENOATTR)
+	}
+
+	if len(dest) == 0 {
+		return uint32(len(value)), 0
+	}
+
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+
+	return uint32(copy(dest, value)), 0
+}
+
+func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	fi, err := vfs.Lstat(n.fsys, n.name)
+	if err != nil {
+		return 0, toErrno(err)
+	}
+
+	xattrs := archivefs.Xattrs(fi)
+
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list string
+	for _, name := range names {
+		list += name + "\x00"
+	}
+
+	if len(dest) == 0 {
+		return uint32(len(list)), 0
+	}
+
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+
+	return uint32(copy(dest, list)), 0
+}
+
+var (
+	_ gofs.FileReader   = (*handle)(nil)
+	_ gofs.FileReleaser = (*handle)(nil)
+)
+
+// handle is an open file.
+type handle struct {
+	f *vfs.File
+}
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.f.ReadAt(dest, off)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, toErrno(err)
+	}
+
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	return toErrno(h.f.Close())
+}
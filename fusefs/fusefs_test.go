@@ -0,0 +1,84 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package fusefs_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/dpeckett/archivefs/fusefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMount(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o600))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+	require.NoError(t, fsys.SetOwner("etc/hostname", 1000, 100))
+	require.NoError(t, fsys.SetXattr("etc/hostname", "user.comment", "hello"))
+
+	dir := t.TempDir()
+
+	server, err := fusefs.Mount(dir, fsys, &fusefs.Options{FsName: "test"})
+	if err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	t.Cleanup(func() {
+		require.NoError(t, server.Unmount())
+	})
+
+	entries, err := os.ReadDir(filepath.Join(dir, "etc"))
+	require.NoError(t, err)
+
+	var names []string
+	for _, de := range entries {
+		names = append(names, de.Name())
+	}
+	require.Equal(t, []string{"hostname", "name", "ssl"}, names)
+
+	data, err := os.ReadFile(filepath.Join(dir, "etc/name"))
+	require.NoError(t, err)
+	require.Equal(t, "alpha\n", string(data))
+
+	target, err := os.Readlink(filepath.Join(dir, "etc/name"))
+	require.NoError(t, err)
+	require.Equal(t, "hostname", target)
+
+	fi, err := os.Stat(filepath.Join(dir, "etc/ssl/cert.pem"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode())
+	require.Equal(t, int64(4), fi.Size())
+
+	fi, err = os.Lstat(filepath.Join(dir, "etc/hostname"))
+	require.NoError(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+	require.Equal(t, uint32(1000), st.Uid)
+	require.Equal(t, uint32(100), st.Gid)
+
+	buf := make([]byte, 64)
+	n, err := unix.Getxattr(filepath.Join(dir, "etc/hostname"), "user.comment", buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+
+	_, err = os.Stat(filepath.Join(dir, "etc/missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = os.WriteFile(filepath.Join(dir, "etc/hostname"), []byte("bravo"), 0o644)
+	require.ErrorIs(t, err, syscall.EROFS)
+}
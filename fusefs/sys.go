@@ -0,0 +1,68 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package fusefs
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/vfs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// fillAttr populates the FUSE attributes of a file.
+func fillAttr(fi fs.FileInfo, attr *fuse.Attr) {
+	attr.Mode = vfs.Mode(fi.Mode())
+	attr.Size = uint64(fi.Size())
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Nlink = 1
+
+	if fi.IsDir() {
+		attr.Size, attr.Blocks = 4096, 8
+	}
+
+	mtime := fi.ModTime()
+	attr.SetTimes(&mtime, &mtime, &mtime)
+
+	e := archivefs.NewEntryFromInfo(fi.Name(), fi)
+	attr.Ino, attr.Nlink = e.Ino, uint32(e.Nlink)
+	attr.Uid, attr.Gid = uint32(e.Uid), uint32(e.Gid)
+
+	if fi.Mode()&fs.ModeDevice != 0 {
+		attr.Rdev = uint32(unix.Mkdev(e.Major, e.Minor))
+	}
+}
+
+// toErrno converts an error to the closest matching errno.
+func toErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	case errors.Is(err, errors.ErrUnsupported):
+		return syscall.ENOTSUP
+	}
+
+	return syscall.EIO
+}
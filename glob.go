@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Glob returns the names of all files in fsys matching pattern, in lexical
+// order, or nil if there are none. As for fs.Glob, the pattern syntax is that
+// of path.Match, with the addition of:
+//
+//   - "**" as a path component, which matches zero or more directories (eg.
+//     "usr/**/*.so" matches "usr/lib.so" and "usr/lib/x86_64/libc.so").
+//   - Brace expansion, "{a,b}" matches either of the (comma separated)
+//     alternatives, which may themselves be patterns, and may be nested.
+//
+// Symbolic links to directories are not followed by "**". The only possible
+// returned error is path.ErrBadPattern, other errors (eg. reading
+// directories) are ignored.
+func Glob(fsys fs.FS, pattern string) ([]string, error) {
+	patterns, err := expandBraces(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range patterns {
+		if err := validateGlob(p); err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []string
+	for _, p := range patterns {
+		components := strings.Split(p, "/")
+
+		// Start from the deepest directory that doesn't contain any wildcards.
+		var base []string
+		for len(base) < len(components)-1 && !hasGlobMeta(components[len(base)]) {
+			base = append(base, components[len(base)])
+		}
+
+		root := "."
+		if len(base) > 0 {
+			root = path.Join(base...)
+		}
+
+		_ = fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || name == "." {
+				return nil
+			}
+
+			nameComponents := strings.Split(name, "/")
+			if matchGlob(components, nameComponents, false) {
+				matches = append(matches, name)
+			}
+
+			// Skip directories that can't contain any matches.
+			if d.IsDir() && !matchGlob(components, nameComponents, true) {
+				return fs.SkipDir
+			}
+
+			return nil
+		})
+	}
+
+	slices.Sort(matches)
+	return slices.Compact(matches), nil
+}
+
+// MatchGlob reports whether name matches the pattern, see Glob for the
+// pattern syntax. The only possible returned error is path.ErrBadPattern.
+func MatchGlob(pattern, name string) (bool, error) {
+	patterns, err := expandBraces(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range patterns {
+		if err := validateGlob(p); err != nil {
+			return false, err
+		}
+	}
+
+	for _, p := range patterns {
+		if matchGlob(strings.Split(p, "/"), strings.Split(name, "/"), false) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchGlob reports whether the components of a name match the components
+// of a pattern. If prefix is set, it instead reports whether the name could
+// be the parent directory of a match.
+func matchGlob(pattern, name []string, prefix bool) bool {
+	if len(name) == 0 && prefix {
+		return len(pattern) > 0
+	}
+
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		return matchGlob(pattern[1:], name, prefix) || (len(name) > 0 && matchGlob(pattern, name[1:], prefix))
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+
+	return matchGlob(pattern[1:], name[1:], prefix)
+}
+
+// validateGlob checks the syntax of a (brace expanded) pattern.
+func validateGlob(pattern string) error {
+	for _, component := range strings.Split(pattern, "/") {
+		if _, err := path.Match(component, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasGlobMeta reports whether a pattern component contains any wildcards.
+func hasGlobMeta(component string) bool {
+	return strings.ContainsAny(component, `*?[\`)
+}
+
+// expandBraces expands the (possibly nested) brace expressions in a pattern,
+// eg. "a{b,c{d,e}}" expands to "ab", "acd" and "ace".
+func expandBraces(pattern string) ([]string, error) {
+	start := -1
+	var depth int
+	var alternatives []string
+	var last int
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			// Escaped characters are never special.
+			i++
+		case '[':
+			// Braces and commas within character classes are literal.
+			if end := strings.IndexByte(pattern[i+1:], ']'); end >= 0 {
+				i += end + 1
+			}
+		case '{':
+			if depth == 0 {
+				start, last = i, i+1
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			if depth == 0 {
+				// Unbalanced closing braces are literal.
+				continue
+			}
+
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			alternatives = append(alternatives, pattern[last:i])
+
+			var expanded []string
+			for _, alternative := range alternatives {
+				patterns, err := expandBraces(pattern[:start] + alternative + pattern[i+1:])
+				if err != nil {
+					return nil, err
+				}
+
+				expanded = append(expanded, patterns...)
+			}
+
+			return expanded, nil
+		}
+	}
+
+	if depth > 0 {
+		return nil, path.ErrBadPattern
+	}
+
+	return []string{pattern}, nil
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlob(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/hostname":                  {Data: []byte("alpha\n")},
+		"etc/ssl/certs/ca.pem":          {Data: []byte("ca")},
+		"etc/ssl/private/key.pem":       {Data: []byte("key")},
+		"usr/lib/libc.so":               {Data: []byte("libc")},
+		"usr/lib/x86_64/libssl.so":      {Data: []byte("libssl")},
+		"usr/lib/x86_64/libssl.so.3":    {Data: []byte("libssl")},
+		"usr/share/doc/README":          {Data: []byte("readme")},
+		"usr/share/doc/{literal}":       {Data: []byte("braces")},
+		"var/lib/dpkg/info/.hidden.pem": {Data: []byte("hidden")},
+		"var/empty":                     {Mode: fs.ModeDir | 0o755},
+	}
+
+	vectors := []struct {
+		pattern string
+		matches []string
+	}{
+		{"etc/hostname", []string{"etc/hostname"}},
+		{"etc/missing", nil},
+		{"etc/*", []string{"etc/hostname", "etc/ssl"}},
+		{"**/*.pem", []string{"etc/ssl/certs/ca.pem", "etc/ssl/private/key.pem", "var/lib/dpkg/info/.hidden.pem"}},
+		{"etc/**/*.pem", []string{"etc/ssl/certs/ca.pem", "etc/ssl/private/key.pem"}},
+		{"usr/**/*.so", []string{"usr/lib/libc.so", "usr/lib/x86_64/libssl.so"}},
+		{"usr/**/lib*.so*", []string{"usr/lib/libc.so", "usr/lib/x86_64/libssl.so", "usr/lib/x86_64/libssl.so.3"}},
+		{"usr/lib/**", []string{"usr/lib", "usr/lib/libc.so", "usr/lib/x86_64", "usr/lib/x86_64/libssl.so", "usr/lib/x86_64/libssl.so.3"}},
+		{"**/doc", []string{"usr/share/doc"}},
+		{"{etc,var}/*", []string{"etc/hostname", "etc/ssl", "var/empty", "var/lib"}},
+		{"etc/ssl/{certs,private}/*.pem", []string{"etc/ssl/certs/ca.pem", "etc/ssl/private/key.pem"}},
+		{"**/{*.so,lib{c,ssl}.so.3}", []string{"usr/lib/libc.so", "usr/lib/x86_64/libssl.so", "usr/lib/x86_64/libssl.so.3"}},
+		{"{usr/lib,etc}/**/{ca.pem,libssl.so}", []string{"etc/ssl/certs/ca.pem", "usr/lib/x86_64/libssl.so"}},
+		{`usr/share/doc/\{literal\}`, []string{"usr/share/doc/{literal}"}},
+		{"**", []string{
+			"etc", "etc/hostname", "etc/ssl", "etc/ssl/certs", "etc/ssl/certs/ca.pem", "etc/ssl/private", "etc/ssl/private/key.pem",
+			"usr", "usr/lib", "usr/lib/libc.so", "usr/lib/x86_64", "usr/lib/x86_64/libssl.so", "usr/lib/x86_64/libssl.so.3",
+			"usr/share", "usr/share/doc", "usr/share/doc/README", "usr/share/doc/{literal}",
+			"var", "var/empty", "var/lib", "var/lib/dpkg", "var/lib/dpkg/info", "var/lib/dpkg/info/.hidden.pem",
+		}},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.pattern, func(t *testing.T) {
+			matches, err := archivefs.Glob(fsys, v.pattern)
+			require.NoError(t, err)
+			require.Equal(t, v.matches, matches)
+
+			for _, name := range matches {
+				ok, err := archivefs.MatchGlob(v.pattern, name)
+				require.NoError(t, err)
+				require.True(t, ok, name)
+			}
+		})
+	}
+
+	t.Run("Compatible", func(t *testing.T) {
+		// Patterns without any extensions match the same files as fs.Glob.
+		for _, pattern := range []string{"*", "*/*", "etc/*/c*", "usr/lib/x86_64/libssl.so.[0-9]", "???"} {
+			expected, err := fs.Glob(fsys, pattern)
+			require.NoError(t, err)
+
+			matches, err := archivefs.Glob(fsys, pattern)
+			require.NoError(t, err)
+			require.Equal(t, expected, matches, pattern)
+		}
+	})
+
+	t.Run("BadPattern", func(t *testing.T) {
+		for _, pattern := range []string{"[", "etc/{a,b", "**/[a-", "{a,[}"} {
+			_, err := archivefs.Glob(fsys, pattern)
+			require.ErrorIs(t, err, path.ErrBadPattern, pattern)
+
+			_, err = archivefs.MatchGlob(pattern, "a")
+			require.ErrorIs(t, err, path.ErrBadPattern, pattern)
+		}
+	})
+}
@@ -3,8 +3,13 @@ module github.com/dpeckett/archivefs
 go 1.22.0
 
 require (
+	github.com/hanwen/go-fuse/v2 v2.7.2
+	github.com/klauspost/compress v1.17.11
 	github.com/rogpeppe/go-internal v1.9.0
 	github.com/stretchr/testify v1.8.1
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0
 )
 
 require (
@@ -0,0 +1,271 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package hashfs computes a single digest of the contents of a filesystem,
+// for content addressing archives independently of their format. By default
+// digests are identical to the "h1:" hashes of Go modules
+// (golang.org/x/mod/sumdb/dirhash).
+package hashfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// Algorithm is the hash function used to compute a digest.
+type Algorithm int
+
+const (
+	// H1 uses SHA-256, digests are prefixed with "h1:".
+	H1 Algorithm = iota
+	// SHA512 uses SHA-512, digests are prefixed with "sha512:".
+	SHA512
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case H1:
+		return "h1"
+	case SHA512:
+		return "sha512"
+	default:
+		return fmt.Sprintf("Algorithm(%d)", int(a))
+	}
+}
+
+func (a Algorithm) new() (hash.Hash, error) {
+	switch a {
+	case H1:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", a)
+	}
+}
+
+// Options configures how a filesystem is hashed.
+type Options struct {
+	// Algorithm is the hash function to use, defaults to H1.
+	Algorithm Algorithm
+	// IncludeSymlinks includes symbolic links (and their targets) in the
+	// digest, they are otherwise ignored. Requires a filesystem that
+	// implements archivefs.ReadLinkFS.
+	IncludeSymlinks bool
+	// IncludeMetadata includes the mode, numeric owner, device numbers and
+	// extended attributes of every file and directory in the digest (implies
+	// IncludeSymlinks). Modification times are not included, as they rarely
+	// survive conversion between formats.
+	IncludeMetadata bool
+	// Concurrency is the number of files to hash concurrently. If less than
+	// or equal to one, files are hashed sequentially.
+	Concurrency int
+}
+
+// Hash returns a digest of the contents of fsys, eg.
+// "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=".
+//
+// A summary is built with a line for each file (sorted by path) holding the
+// hex encoded hash of its contents and its path, and the digest is the base64
+// encoded hash of the summary. Directories and symbolic links are ignored
+// unless requested.
+func Hash(fsys fs.FS, opts *Options) (string, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if _, err := opts.Algorithm.new(); err != nil {
+		return "", err
+	}
+
+	var entries []*archivefs.Entry
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.Contains(path, "\n") {
+			return fmt.Errorf("hashfs: filenames with newlines are not supported: %q", path)
+		}
+
+		switch {
+		case d.IsDir():
+			if !opts.IncludeMetadata {
+				return nil
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			if !opts.IncludeSymlinks && !opts.IncludeMetadata {
+				return nil
+			}
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		e, err := archivefs.NewEntry(fsys, path, fi)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Sort by path (rather than in walk order), as for dirhash.
+	slices.SortFunc(entries, func(a, b *archivefs.Entry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	sums, err := hashContents(fsys, entries, opts)
+	if err != nil {
+		return "", err
+	}
+
+	h, _ := opts.Algorithm.new()
+	for i, e := range entries {
+		var kind string
+		switch e.Mode.Type() {
+		case fs.ModeDir:
+			kind = "dir "
+		case fs.ModeSymlink:
+			kind = "symlink "
+		}
+
+		var meta string
+		if opts.IncludeMetadata {
+			meta = " " + metadata(e, opts.Algorithm)
+		}
+
+		fmt.Fprintf(h, "%s%x%s  %s\n", kind, sums[i], meta, e.Name)
+	}
+
+	return opts.Algorithm.String() + ":" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashContents returns the hash of the contents of each entry, ie. the data
+// of a file or the target of a symbolic link (directories have no contents).
+func hashContents(fsys fs.FS, entries []*archivefs.Entry, opts *Options) ([][]byte, error) {
+	sums := make([][]byte, len(entries))
+
+	hashOne := func(i int) error {
+		e := entries[i]
+		h, _ := opts.Algorithm.new()
+
+		switch e.Mode.Type() {
+		case fs.ModeDir:
+		case fs.ModeSymlink:
+			io.WriteString(h, e.Linkname)
+		default:
+			f, err := fsys.Open(e.Name)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(h, f)
+			_ = f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read file %s: %w", e.Name, err)
+			}
+		}
+
+		sums[i] = h.Sum(nil)
+		return nil
+	}
+
+	if opts.Concurrency <= 1 {
+		for i := range entries {
+			if err := hashOne(i); err != nil {
+				return nil, err
+			}
+		}
+
+		return sums, nil
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range work {
+				if err := hashOne(i); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+
+	for i := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case work <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+// metadata returns a summary of the metadata of an entry, without any
+// consecutive spaces (which separate the path).
+func metadata(e *archivefs.Entry, algorithm Algorithm) string {
+	meta := fmt.Sprintf("mode=%s uid=%d gid=%d", e.Mode, e.Uid, e.Gid)
+
+	if e.Mode&fs.ModeDevice != 0 {
+		meta += fmt.Sprintf(" dev=%d,%d", e.Major, e.Minor)
+	}
+
+	if len(e.Xattrs) > 0 {
+		names := make([]string, 0, len(e.Xattrs))
+		for name := range e.Xattrs {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		h, _ := algorithm.new()
+		for _, name := range names {
+			fmt.Fprintf(h, "%s\x00%s\x00", name, e.Xattrs[name])
+		}
+
+		meta += fmt.Sprintf(" xattrs=%x", h.Sum(nil))
+	}
+
+	return meta
+}
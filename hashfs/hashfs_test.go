@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package hashfs_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/archivefs/hashfs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/rogpeppe/go-internal/dirhash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	newFS := func(t *testing.T) *memfs.FS {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o600))
+		require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+		return fsys
+	}
+
+	fsys := newFS(t)
+
+	h, err := hashfs.Hash(fsys, nil)
+	require.NoError(t, err)
+
+	t.Run("DirHash", func(t *testing.T) {
+		expected, err := dirhash.Hash1([]string{"etc/hostname", "etc/ssl/cert.pem"}, func(name string) (io.ReadCloser, error) {
+			return fsys.Open(name)
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, expected, h)
+	})
+
+	t.Run("Concurrency", func(t *testing.T) {
+		concurrent, err := hashfs.Hash(fsys, &hashfs.Options{Concurrency: 4})
+		require.NoError(t, err)
+
+		require.Equal(t, h, concurrent)
+	})
+
+	t.Run("Algorithm", func(t *testing.T) {
+		sha512, err := hashfs.Hash(fsys, &hashfs.Options{Algorithm: hashfs.SHA512})
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(sha512, "sha512:"))
+
+		_, err = hashfs.Hash(fsys, &hashfs.Options{Algorithm: hashfs.Algorithm(42)})
+		require.Error(t, err)
+	})
+
+	t.Run("IncludeSymlinks", func(t *testing.T) {
+		withSymlinks, err := hashfs.Hash(fsys, &hashfs.Options{IncludeSymlinks: true})
+		require.NoError(t, err)
+		require.NotEqual(t, h, withSymlinks)
+
+		other, err := hashfs.Hash(newFS(t), &hashfs.Options{IncludeSymlinks: true})
+		require.NoError(t, err)
+		require.Equal(t, withSymlinks, other)
+
+		retargeted := memfs.New()
+		require.NoError(t, retargeted.MkdirAll("etc/ssl", 0o755))
+		require.NoError(t, retargeted.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+		require.NoError(t, retargeted.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o600))
+		require.NoError(t, retargeted.Symlink("ssl/cert.pem", "etc/name"))
+
+		other, err = hashfs.Hash(retargeted, &hashfs.Options{IncludeSymlinks: true})
+		require.NoError(t, err)
+		require.NotEqual(t, withSymlinks, other)
+	})
+
+	t.Run("IncludeMetadata", func(t *testing.T) {
+		withMetadata, err := hashfs.Hash(fsys, &hashfs.Options{IncludeMetadata: true})
+		require.NoError(t, err)
+
+		other, err := hashfs.Hash(newFS(t), &hashfs.Options{IncludeMetadata: true})
+		require.NoError(t, err)
+		require.Equal(t, withMetadata, other)
+
+		chowned := newFS(t)
+		require.NoError(t, chowned.SetOwner("etc/hostname", 1000, 1000))
+
+		// Contents are unchanged.
+		other, err = hashfs.Hash(chowned, nil)
+		require.NoError(t, err)
+		require.Equal(t, h, other)
+
+		other, err = hashfs.Hash(chowned, &hashfs.Options{IncludeMetadata: true})
+		require.NoError(t, err)
+		require.NotEqual(t, withMetadata, other)
+
+		xattrs := newFS(t)
+		require.NoError(t, xattrs.SetXattr("etc/ssl", "user.comment", "certificates"))
+
+		other, err = hashfs.Hash(xattrs, &hashfs.Options{IncludeMetadata: true})
+		require.NoError(t, err)
+		require.NotEqual(t, withMetadata, other)
+	})
+
+	t.Run("Newline", func(t *testing.T) {
+		fsys := memfs.New()
+		require.NoError(t, fsys.WriteFile("bad\nname", nil, 0o644))
+
+		_, err := hashfs.Hash(fsys, nil)
+		require.ErrorContains(t, err, "newlines are not supported")
+	})
+}
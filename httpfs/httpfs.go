@@ -0,0 +1,265 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package httpfs serves filesystems read-only over HTTP, either as static
+// files (as for http.FileServer) or using WebDAV.
+package httpfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/dpeckett/archivefs/internal/vfs"
+)
+
+// Options configures the serving of a filesystem.
+type Options struct {
+	// DisableETags disables ETags, which are derived from the SHA-256
+	// digest of the contents of files. Computing the digest requires reading
+	// a file in its entirety the first time it is served.
+	DisableETags bool
+	// Prefix is the URL path prefix to strip from WebDAV requests. It is
+	// ignored by FileServer, use http.StripPrefix instead.
+	Prefix string
+}
+
+// FileServer returns a handler that serves HTTP requests with the contents
+// of fsys, similar to http.FileServer(http.FS(fsys)).
+//
+// Symbolic links are followed, and directories are listed unless they
+// contain an index.html file. Range requests are supported if the files of
+// fsys implement io.ReaderAt or io.Seeker (otherwise the entire file is
+// returned).
+func FileServer(fsys fs.FS, opts *Options) http.Handler {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	s := &fileServer{fsys: fsys}
+	if !opts.DisableETags {
+		s.etags = newETagCache(fsys)
+	}
+
+	return s
+}
+
+type fileServer struct {
+	fsys  fs.FS
+	etags *etagCache
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+
+	name := toName(upath)
+
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if fi.IsDir() {
+		// Directories must be requested with a trailing slash, so that
+		// relative links in listings and index pages resolve correctly.
+		if !strings.HasSuffix(upath, "/") {
+			localRedirect(w, r, path.Base(upath)+"/")
+			return
+		}
+
+		index := path.Join(name, "index.html")
+		if indexInfo, err := fs.Stat(s.fsys, index); err == nil && indexInfo.Mode().IsRegular() {
+			s.serveFile(w, r, index, indexInfo)
+			return
+		}
+
+		s.serveDir(w, r, name, fi)
+		return
+	}
+
+	if strings.HasSuffix(upath, "/") {
+		localRedirect(w, r, "../"+path.Base(upath))
+		return
+	}
+
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	s.serveFile(w, r, name, fi)
+}
+
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request, name string, fi fs.FileInfo) {
+	f, err := vfs.Open(s.fsys, name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+
+	if s.etags != nil {
+		etag, err := s.etags.etag(name)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		w.Header().Set("Etag", etag)
+	}
+
+	// Seeking backwards in files that only support sequential reads means
+	// reading them again from the start, so serve the entire file instead.
+	if !f.RandomAccess() && r.Header.Get("Range") != "" {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+	}
+
+	http.ServeContent(w, r, path.Base(name), fi.ModTime(), io.NewSectionReader(f, 0, fi.Size()))
+}
+
+func (s *fileServer) serveDir(w http.ResponseWriter, r *http.Request, name string, fi fs.FileInfo) {
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if !fi.ModTime().IsZero() {
+		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+	for _, de := range entries {
+		entryName := de.Name()
+		if isDir(s.fsys, path.Join(name, entryName), de) {
+			entryName += "/"
+		}
+
+		// The name may contain characters that are special in URLs (eg.
+		// '?' or '#'), or a colon that would be mistaken for a scheme.
+		href := url.URL{Path: "./" + entryName}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(href.String()), html.EscapeString(entryName))
+	}
+	b.WriteString("</pre>\n")
+
+	_, _ = io.WriteString(w, b.String())
+}
+
+// isDir reports whether a directory entry is a directory, or a symbolic
+// link to one.
+func isDir(fsys fs.FS, name string, de fs.DirEntry) bool {
+	if de.Type()&fs.ModeSymlink == 0 {
+		return de.IsDir()
+	}
+
+	fi, err := fs.Stat(fsys, name)
+	return err == nil && fi.IsDir()
+}
+
+// toName converts a URL path to the name of a file.
+func toName(upath string) string {
+	name := strings.TrimPrefix(path.Clean("/"+upath), "/")
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+// localRedirect redirects to a path relative to the current one, preserving
+// the query string.
+func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// httpError writes the HTTP error response corresponding to err. The
+// details of the error are not included, as they may reveal internal paths.
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// etagCache caches the ETags of files, which can't change.
+type etagCache struct {
+	fsys fs.FS
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+func newETagCache(fsys fs.FS) *etagCache {
+	return &etagCache{fsys: fsys, etags: map[string]string{}}
+}
+
+// etag returns the strong ETag of the named regular file.
+func (c *etagCache) etag(name string) (string, error) {
+	c.mu.Lock()
+	etag, ok := c.etags[name]
+	c.mu.Unlock()
+
+	if ok {
+		return etag, nil
+	}
+
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	etag = `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+
+	c.mu.Lock()
+	c.etags[name] = etag
+	c.mu.Unlock()
+
+	return etag, nil
+}
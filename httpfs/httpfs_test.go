@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package httpfs_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/archivefs/httpfs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer(t *testing.T) {
+	fsys := newTestFS(t)
+
+	srv := httptest.NewServer(httpfs.FileServer(fsys, nil))
+	t.Cleanup(srv.Close)
+
+	sum := sha256.Sum256([]byte("hello world\n"))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	t.Run("File", func(t *testing.T) {
+		resp, body := get(t, srv.URL+"/etc/motd", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "hello world\n", body)
+		require.Equal(t, etag, resp.Header.Get("Etag"))
+
+		resp, _ = get(t, srv.URL+"/etc/motd", map[string]string{"If-None-Match": etag})
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		resp, body := get(t, srv.URL+"/etc/motd", map[string]string{"Range": "bytes=6-10"})
+		require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		require.Equal(t, "world", body)
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		resp, body := get(t, srv.URL+"/etc/issue", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "hello world\n", body)
+
+		resp, _ = get(t, srv.URL+"/etc/dangling", nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+
+		resp, err := client.Get(srv.URL + "/etc")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		require.Equal(t, "etc/", resp.Header.Get("Location"))
+
+		resp, body := get(t, srv.URL+"/etc/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, body, `<a href="./issue">issue</a>`)
+		require.Contains(t, body, `<a href="./ssl/">ssl/</a>`)
+		require.Contains(t, body, `<a href="./tls/">tls/</a>`)
+		require.Contains(t, body, `<a href="./%3Fquery">?query</a>`)
+
+		resp, body = get(t, srv.URL+"/www/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "<h1>index</h1>", body)
+	})
+
+	t.Run("Method", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/etc/motd", "text/plain", strings.NewReader("bye"))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("Sequential", func(t *testing.T) {
+		// Range requests are ignored for files that don't support random
+		// access.
+		srv := httptest.NewServer(httpfs.FileServer(sequentialFS{fsys}, &httpfs.Options{DisableETags: true}))
+		t.Cleanup(srv.Close)
+
+		resp, body := get(t, srv.URL+"/etc/motd", map[string]string{"Range": "bytes=6-10"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "hello world\n", body)
+		require.Empty(t, resp.Header.Get("Etag"))
+	})
+}
+
+func TestWebDAVHandler(t *testing.T) {
+	fsys := newTestFS(t)
+
+	srv := httptest.NewServer(httpfs.WebDAVHandler(fsys, nil))
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest("PROPFIND", srv.URL+"/etc/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Depth", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	require.Contains(t, string(body), "<D:href>/etc/motd</D:href>")
+	require.Contains(t, string(body), "<D:href>/etc/issue</D:href>")
+	require.Contains(t, string(body), "<D:href>/etc/tls/</D:href>")
+	require.NotContains(t, string(body), "dangling")
+
+	sum := sha256.Sum256([]byte("hello world\n"))
+	require.Contains(t, string(body), "<D:getetag>\""+hex.EncodeToString(sum[:])+"\"</D:getetag>")
+
+	resp, body2 := get(t, srv.URL+"/etc/issue", map[string]string{"Range": "bytes=0-4"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "hello", body2)
+
+	req, err = http.NewRequest(http.MethodPut, srv.URL+"/etc/motd", strings.NewReader("bye"))
+	require.NoError(t, err)
+
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func newTestFS(t *testing.T) *memfs.FS {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.MkdirAll("www", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/motd", []byte("hello world\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/?query", nil, 0o644))
+	require.NoError(t, fsys.WriteFile("www/index.html", []byte("<h1>index</h1>"), 0o644))
+	require.NoError(t, fsys.Symlink("motd", "etc/issue"))
+	require.NoError(t, fsys.Symlink("ssl", "etc/tls"))
+	require.NoError(t, fsys.Symlink("missing", "etc/dangling"))
+	return fsys
+}
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(body)
+}
+
+// sequentialFS hides the io.ReaderAt and io.Seeker implementations of
+// files, as for eg. compressed archives.
+type sequentialFS struct {
+	fsys fs.FS
+}
+
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return f, nil
+	}
+
+	return struct{ fs.File }{f}, nil
+}
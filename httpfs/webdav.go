@@ -0,0 +1,231 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package httpfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/dpeckett/archivefs/internal/vfs"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAVHandler returns a handler that serves fsys read-only using WebDAV
+// (RFC 4918), allowing it to be mounted by eg. Windows Explorer, macOS
+// Finder or davfs2. Requests that would modify the filesystem fail with
+// 405 Method Not Allowed.
+//
+// Symbolic links are followed, and entries that can't be resolved (eg.
+// dangling symbolic links) are omitted from directory listings.
+func WebDAVHandler(fsys fs.FS, opts *Options) http.Handler {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	davFS := &davFS{fsys: fsys}
+	if !opts.DisableETags {
+		davFS.etags = newETagCache(fsys)
+	}
+
+	h := &webdav.Handler{
+		Prefix:     opts.Prefix,
+		FileSystem: davFS,
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH":
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND, LOCK, UNLOCK")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+var _ webdav.FileSystem = (*davFS)(nil)
+
+// davFS adapts a fs.FS to webdav.FileSystem.
+type davFS struct {
+	fsys  fs.FS
+	etags *etagCache
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	fi, err := d.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	name = toName(name)
+	if fi.IsDir() {
+		return &davDir{davFS: d, name: name, fi: fi}, nil
+	}
+
+	f, err := vfs.Open(d.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &davFile{SectionReader: io.NewSectionReader(f, 0, fi.Size()), f: f, fi: fi}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = toName(name)
+
+	fi, err := fs.Stat(d.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.fileInfo(name, fi), nil
+}
+
+// fileInfo wraps the FileInfo of a (possibly symlinked) file, so that it has
+// the name it was requested with and supports ETags.
+func (d *davFS) fileInfo(name string, fi fs.FileInfo) fs.FileInfo {
+	return &davFileInfo{FileInfo: fi, name: path.Base(name), path: name, etags: d.etags}
+}
+
+type davFileInfo struct {
+	fs.FileInfo
+	name  string
+	path  string
+	etags *etagCache
+}
+
+func (fi *davFileInfo) Name() string {
+	return fi.name
+}
+
+// ETag implements webdav.ETager.
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etags == nil || !fi.Mode().IsRegular() {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return fi.etags.etag(fi.path)
+}
+
+var _ webdav.File = (*davFile)(nil)
+
+// davFile is an open regular file.
+type davFile struct {
+	*io.SectionReader
+	f  *vfs.File
+	fi fs.FileInfo
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.fi.Name(), Err: fs.ErrInvalid}
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.fi.Name(), Err: fs.ErrPermission}
+}
+
+func (f *davFile) Close() error {
+	return f.f.Close()
+}
+
+var _ webdav.File = (*davDir)(nil)
+
+// davDir is an open directory.
+type davDir struct {
+	davFS   *davFS
+	name    string
+	fi      fs.FileInfo
+	entries []fs.FileInfo
+	read    bool
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: d.name, Err: fs.ErrInvalid}
+}
+
+// Readdir returns the next count entries of the directory (or all remaining
+// entries if count <= 0), as for os.File.Readdir.
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.read {
+		entries, err := fs.ReadDir(d.davFS.fsys, d.name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, de := range entries {
+			name := path.Join(d.name, de.Name())
+
+			fi, err := fs.Stat(d.davFS.fsys, name)
+			if err != nil {
+				continue
+			}
+
+			d.entries = append(d.entries, d.davFS.fileInfo(name, fi))
+		}
+		d.read = true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.name, Err: fs.ErrPermission}
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
@@ -0,0 +1,330 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package initramfs provides access to Linux initramfs images, with their
+// archives merged as they are when the image is unpacked by the kernel.
+//
+// An image consists of one or more segments, separated by zero padding.
+// Each segment is either an uncompressed cpio archive (eg. the early
+// microcode archive, which must be uncompressed so it can be found before
+// the rest of the image is unpacked) or a compressed stream (gzip, xz, zstd,
+// or LZ4) containing one or more cpio archives.
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/compression"
+	"github.com/dpeckett/archivefs/cpiofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ fs.FS                = (*FS)(nil)
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+)
+
+// cpioMagic is the common prefix of the magic numbers of cpio archives.
+var cpioMagic = []byte("0707")
+
+// Segment describes a segment of an image.
+type Segment struct {
+	// Offset is the offset of the segment within the image.
+	Offset int64
+	// Size is the size of the segment within the image (ie. the compressed
+	// size, for compressed segments), excluding any padding.
+	Size int64
+	// Compression is the compression algorithm of the segment.
+	Compression compression.Algorithm
+	// Archives holds the cpio archives of the segment, in order.
+	Archives []*cpiofs.FS
+}
+
+// Options configures how an image is opened.
+type Options struct {
+	// Strict opens the archives of the image in strict mode (see
+	// cpiofs.Options).
+	Strict bool
+	// Spool configures how the decompressed contents of compressed segments
+	// are buffered.
+	Spool compression.SpoolOptions
+}
+
+// FS is a filesystem that represents an initramfs image. Entries in later
+// archives replace those in earlier archives, and directories are merged.
+type FS struct {
+	root     fs.FS
+	segments []Segment
+	closers  []io.Closer
+}
+
+// Open opens an initramfs image from the given io.ReaderAt. The returned
+// filesystem must be closed to release the decompressed segments.
+func Open(ra io.ReaderAt) (*FS, error) {
+	return OpenWithOptions(ra, nil)
+}
+
+// OpenWithOptions opens an initramfs image with the given options.
+func OpenWithOptions(ra io.ReaderAt, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	fsys := &FS{}
+
+	var layers []fs.FS
+	var offset int64
+	for {
+		var err error
+		offset, err = skipPadding(ra, offset)
+		if err != nil {
+			_ = fsys.Close()
+			return nil, err
+		}
+
+		header := make([]byte, 6)
+		n, err := ra.ReadAt(header, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			_ = fsys.Close()
+			return nil, err
+		}
+		header = header[:n]
+
+		if n == 0 {
+			break
+		}
+
+		var segment *Segment
+		if bytes.HasPrefix(header, cpioMagic) {
+			segment, err = openArchive(ra, offset, opts)
+		} else {
+			segment, err = fsys.openCompressed(ra, offset, compression.Detect(header), opts)
+		}
+		if err != nil {
+			_ = fsys.Close()
+			return nil, fmt.Errorf("failed to open segment at offset %d: %w", offset, err)
+		}
+
+		fsys.segments = append(fsys.segments, *segment)
+		for _, archive := range segment.Archives {
+			layers = append(layers, archive)
+		}
+		offset += segment.Size
+	}
+
+	if len(fsys.segments) == 0 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: 0, Detail: "image contains no archives"}
+	}
+
+	fsys.root = archivefs.OverlayWithOptions(&archivefs.OverlayOptions{
+		Whiteouts: archivefs.WhiteoutNone,
+	}, layers...)
+
+	return fsys, nil
+}
+
+// Segments returns the segments of the image, in order.
+func (fsys *FS) Segments() []Segment {
+	return fsys.segments
+}
+
+// Close releases the decompressed segments of the image.
+func (fsys *FS) Close() error {
+	var errs []error
+	for _, c := range fsys.closers {
+		errs = append(errs, c.Close())
+	}
+	fsys.closers = nil
+
+	return errors.Join(errs...)
+}
+
+// Open opens the named file.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	return fsys.root.Open(name)
+}
+
+// ReadDir reads the named directory.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(fsys.root, name)
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.root, name)
+}
+
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) ReadLink(name string) (string, error) {
+	return fsys.root.(archivefs.ReadLinkFS).ReadLink(name)
+}
+
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	return fsys.root.(archivefs.ReadLinkFS).StatLink(name)
+}
+
+// openArchive opens the uncompressed cpio archive at offset.
+func openArchive(ra io.ReaderAt, offset int64, opts *Options) (*Segment, error) {
+	archive, err := cpiofs.OpenWithOptions(io.NewSectionReader(ra, offset, math.MaxInt64-offset), &cpiofs.Options{
+		Strict: opts.Strict,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Segment{
+		Offset:      offset,
+		Size:        archive.Size(),
+		Compression: compression.None,
+		Archives:    []*cpiofs.FS{archive},
+	}, nil
+}
+
+// openCompressed opens the compressed segment at offset, and the archives
+// it contains.
+func (fsys *FS) openCompressed(ra io.ReaderAt, offset int64, algorithm compression.Algorithm, opts *Options) (*Segment, error) {
+	segment := &Segment{
+		Offset:      offset,
+		Size:        -1,
+		Compression: algorithm,
+	}
+
+	// Segments are decompressed from a counting reader so that the size of
+	// gzip segments can be determined once they have been decompressed.
+	src := &countingReader{r: io.NewSectionReader(ra, offset, math.MaxInt64-offset)}
+	br := bufio.NewReader(src)
+
+	var r io.ReadCloser
+	var err error
+	switch algorithm {
+	case compression.Gzip:
+		// The gzip reader consumes exactly the bytes of the stream, as it
+		// is given an io.ByteReader.
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(br)
+		if err == nil {
+			zr.Multistream(false)
+			r = zr
+		}
+	case compression.Xz, compression.Zstd:
+		sizeOf := xzStreamSize
+		if algorithm == compression.Zstd {
+			sizeOf = zstdFrameSize
+		}
+
+		segment.Size, err = sizeOf(ra, offset)
+		if err == nil {
+			r, err = compression.Decompress(io.NewSectionReader(ra, offset, segment.Size), algorithm)
+		}
+	case compression.LZ4:
+		segment.Size, err = lz4StreamSize(ra, offset)
+		if err == nil {
+			r, err = compression.Decompress(io.NewSectionReader(ra, offset, segment.Size), algorithm)
+		}
+	case compression.None:
+		return nil, &archiveerrors.ErrCorrupted{Offset: offset, Detail: "unrecognized segment"}
+	default:
+		return nil, fmt.Errorf("%w: %s", compression.ErrUnsupported, algorithm)
+	}
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &archiveerrors.ErrCorrupted{Offset: offset, Detail: fmt.Sprintf("truncated %s segment", algorithm), Err: err}
+		}
+
+		return nil, err
+	}
+
+	spool := compression.NewSpool(r, &opts.Spool)
+	fsys.closers = append(fsys.closers, spool, r)
+
+	// The decompressed stream may contain several archives, separated by
+	// padding, all of which are read so the end of the stream is reached.
+	var archiveOffset int64
+	for {
+		archiveOffset, err = skipPadding(spool, archiveOffset)
+		if err != nil {
+			return nil, err
+		}
+
+		header := make([]byte, len(cpioMagic))
+		n, err := spool.ReadAt(header, archiveOffset)
+		if n == 0 && errors.Is(err, io.EOF) {
+			break
+		} else if !bytes.Equal(header[:n], cpioMagic) {
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+
+			return nil, &archiveerrors.ErrCorrupted{Offset: archiveOffset, Detail: "unrecognized data in decompressed segment"}
+		}
+
+		archive, err := openArchive(spool, archiveOffset, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		segment.Archives = append(segment.Archives, archive.Archives...)
+		archiveOffset += archive.Size
+	}
+
+	if segment.Size < 0 {
+		segment.Size = src.n - int64(br.Buffered())
+	}
+
+	return segment, nil
+}
+
+// skipPadding returns the offset of the first non-zero byte at or after
+// offset (or the end of the data).
+func skipPadding(ra io.ReaderAt, offset int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := ra.ReadAt(buf, offset)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return offset, nil
+			}
+			offset++
+		}
+
+		if errors.Is(err, io.EOF) {
+			return offset, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,276 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package initramfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"testing"
+
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/compression"
+	"github.com/dpeckett/archivefs/cpiofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/initramfs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func TestInitramfs(t *testing.T) {
+	microcode := createArchive([]entry{
+		{name: "kernel/x86/microcode/GenuineIntel.bin", mode: cpiofs.S_IFREG | 0o644, data: "microcode"},
+	})
+
+	image := pad(microcode, 512)
+	want := []initramfs.Segment{{Offset: 0, Size: int64(len(microcode)), Compression: compression.None}}
+
+	// add appends a compressed segment to the image, followed by padding.
+	add := func(algorithm compression.Algorithm, data []byte, padding int) {
+		compressed := compress(t, algorithm, data)
+		want = append(want, initramfs.Segment{Offset: int64(len(image)), Size: int64(len(compressed)), Compression: algorithm})
+		image = pad(append(image, compressed...), padding)
+	}
+
+	add(compression.Gzip, createArchive([]entry{
+		{name: "bin", mode: cpiofs.S_IFDIR | 0o755},
+		{name: "bin/busybox", mode: cpiofs.S_IFREG | 0o755, data: "busybox"},
+		{name: "bin/sh", mode: cpiofs.S_IFLNK | 0o777, data: "busybox"},
+		{name: "etc/hostname", mode: cpiofs.S_IFREG | 0o644, data: "gzip\n"},
+	}), 4)
+
+	// A segment containing more than one archive.
+	add(compression.Xz, slices.Concat(
+		pad(createArchive([]entry{{name: "etc/hostname", mode: cpiofs.S_IFREG | 0o644, data: "xz\n"}}), 512),
+		createArchive([]entry{{name: "etc/xz", mode: cpiofs.S_IFREG | 0o644, data: "xz\n"}}),
+	), 4)
+
+	add(compression.Zstd, createArchive([]entry{
+		{name: "etc/hostname", mode: cpiofs.S_IFREG | 0o644, data: "zstd\n"},
+	}), 1)
+
+	add(compression.LZ4, createArchive([]entry{
+		{name: "etc/hostname", mode: cpiofs.S_IFREG | 0o644, data: "lz4\n"},
+		{name: "etc/lz4", mode: cpiofs.S_IFREG | 0o644, data: string(bytes.Repeat([]byte("lz4 "), 1000))},
+	}), 512)
+
+	fsys, err := initramfs.Open(bytes.NewReader(image))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, fsys.Close())
+	})
+
+	var segments []initramfs.Segment
+	for _, segment := range fsys.Segments() {
+		require.NotEmpty(t, segment.Archives)
+		segment.Archives = nil
+		segments = append(segments, segment)
+	}
+	require.Equal(t, want, segments)
+	require.Len(t, fsys.Segments()[2].Archives, 2)
+
+	require.NoError(t, archivefstest.TestFS(fsys, "kernel/x86/microcode/GenuineIntel.bin", "bin/busybox", "bin/sh", "etc/hostname", "etc/xz", "etc/lz4"))
+
+	for name, contents := range map[string]string{
+		"kernel/x86/microcode/GenuineIntel.bin": "microcode",
+		"bin/sh":                                "busybox",
+		"etc/hostname":                          "lz4\n",
+		"etc/xz":                                "xz\n",
+		"etc/lz4":                               string(bytes.Repeat([]byte("lz4 "), 1000)),
+	} {
+		data, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err, name)
+		require.Equal(t, contents, string(data), name)
+	}
+
+	target, err := fsys.ReadLink("bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", target)
+
+	entries, err := fsys.ReadDir("etc")
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"hostname", "lz4", "xz"}, names)
+
+	t.Run("Truncated", func(t *testing.T) {
+		for _, segment := range want[1:4] {
+			size := segment.Offset + segment.Size/2
+			_, err := initramfs.Open(bytes.NewReader(image[:size]))
+			require.Error(t, err, "%s", segment.Compression)
+		}
+	})
+
+	t.Run("Unrecognized", func(t *testing.T) {
+		_, err := initramfs.Open(bytes.NewReader(append(bytes.Clone(microcode), "garbage"...)))
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+
+	t.Run("LZ4Frame", func(t *testing.T) {
+		frame := lz4Frame(createArchive([]entry{
+			{name: "etc/hostname", mode: cpiofs.S_IFREG | 0o644, data: "lz4 frame\n"},
+		}))
+		image := append(pad(bytes.Clone(microcode), 4), frame...)
+
+		fsys, err := initramfs.Open(bytes.NewReader(image))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, fsys.Close())
+		})
+
+		segment := fsys.Segments()[1]
+		require.Equal(t, compression.LZ4, segment.Compression)
+		require.Equal(t, int64(len(image)-len(frame)), segment.Offset)
+		require.Equal(t, int64(len(frame)), segment.Size)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "lz4 frame\n", string(hostname))
+
+		_, err = initramfs.Open(bytes.NewReader(image[:len(image)-2]))
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+}
+
+type entry struct {
+	name string
+	mode uint32
+	data string
+}
+
+// createArchive creates a newc cpio archive containing the given entries.
+func createArchive(entries []entry) []byte {
+	var buf bytes.Buffer
+
+	write := func(e entry) {
+		fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			cpiofs.MagicNewc, 0, e.mode, 0, 0, 1, 0, len(e.data), 0, 0, 0, 0, len(e.name)+1, 0)
+		buf.WriteString(e.name)
+		buf.WriteByte(0)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+		buf.WriteString(e.data)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+	}
+
+	for _, e := range entries {
+		write(e)
+	}
+	write(entry{name: cpiofs.TrailerName})
+
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, algorithm compression.Algorithm, data []byte) []byte {
+	var buf bytes.Buffer
+
+	var w io.WriteCloser
+	var err error
+	switch algorithm {
+	case compression.Gzip:
+		w = gzip.NewWriter(&buf)
+	case compression.Xz:
+		w, err = xz.NewWriter(&buf)
+	case compression.Zstd:
+		w, err = zstd.NewWriter(&buf)
+	case compression.LZ4:
+		return lz4Legacy(data)
+	}
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+// lz4Legacy compresses data in the legacy LZ4 format, as a single block.
+func lz4Legacy(data []byte) []byte {
+	var block []byte
+
+	length := func(n int) {
+		for ; n >= 255; n -= 255 {
+			block = append(block, 255)
+		}
+		block = append(block, byte(n))
+	}
+
+	sequence := func(literals []byte, offset, match int) {
+		token := byte(min(len(literals), 15)) << 4
+		if match > 0 {
+			token |= byte(min(match-4, 15))
+		}
+		block = append(block, token)
+		if len(literals) >= 15 {
+			length(len(literals) - 15)
+		}
+		block = append(block, literals...)
+
+		if match > 0 {
+			block = binary.LittleEndian.AppendUint16(block, uint16(offset))
+			if match-4 >= 15 {
+				length(match - 4 - 15)
+			}
+		}
+	}
+
+	// A greedy compressor, the last five bytes of which must be literals.
+	seen := map[uint32]int{}
+	anchor := 0
+	for i := 0; i+12 <= len(data); {
+		key := binary.LittleEndian.Uint32(data[i:])
+		if j, ok := seen[key]; ok && i-j <= 65535 {
+			match := 4
+			for i+match < len(data)-5 && data[j+match] == data[i+match] {
+				match++
+			}
+
+			sequence(data[anchor:i], i-j, match)
+			i += match
+			anchor = i
+			continue
+		}
+
+		seen[key] = i
+		i++
+	}
+	sequence(data[anchor:], 0, 0)
+
+	stream := []byte{0x02, 0x21, 0x4c, 0x18}
+	stream = binary.LittleEndian.AppendUint32(stream, uint32(len(block)))
+	return append(stream, block...)
+}
+
+// lz4Frame writes data in the LZ4 frame format, as uncompressed 64KiB blocks
+// without checksums.
+func lz4Frame(data []byte) []byte {
+	frame := []byte{0x04, 0x22, 0x4d, 0x18, 0x60, 0x40, 0x82}
+	for len(data) > 0 {
+		block := data[:min(len(data), 64<<10)]
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(block))|0x80000000)
+		frame = append(frame, block...)
+		data = data[len(block):]
+	}
+
+	return binary.LittleEndian.AppendUint32(frame, 0)
+}
+
+// pad pads data with zeros to a multiple of n bytes.
+func pad(data []byte, n int) []byte {
+	return append(data, make([]byte, (n-len(data)%n)%n)...)
+}
@@ -0,0 +1,441 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// The size of a compressed stream isn't recorded anywhere, and decompressors
+// read ahead, so the end of each compressed segment is found by walking the
+// structure of the stream (without decompressing it).
+
+const (
+	zstdMagic     = 0xfd2fb528
+	xzFooterMagic = "YZ"
+	xzFilterLZMA2 = 0x21
+	lz4FrameMagic = 0x184d2204
+	// lz4LegacyMagic is the magic number of the legacy LZ4 format (as written
+	// by "lz4 -l"), the only LZ4 format supported by the kernel.
+	lz4LegacyMagic = 0x184c2102
+	// lz4LegacyMaxCompressedSize is the largest possible size of a compressed
+	// block of the legacy format (LZ4_COMPRESSBOUND of its 8MiB blocks).
+	lz4LegacyMaxCompressedSize = 8<<20 + (8<<20)/255 + 16
+)
+
+// cursor reads sequentially from an io.ReaderAt.
+type cursor struct {
+	ra  io.ReaderAt
+	off int64
+}
+
+func (c *cursor) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := c.ra.ReadAt(buf, c.off); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+	c.off += int64(n)
+
+	return buf, nil
+}
+
+func (c *cursor) readByte() (byte, error) {
+	b, err := c.read(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+func (c *cursor) skip(n int64) {
+	c.off += n
+}
+
+// zstdFrameSize returns the size of the zstd frame at off.
+func zstdFrameSize(ra io.ReaderAt, off int64) (int64, error) {
+	c := &cursor{ra: ra, off: off}
+
+	header, err := c.read(5)
+	if err != nil {
+		return 0, err
+	}
+
+	if binary.LittleEndian.Uint32(header) != zstdMagic {
+		return 0, errors.New("invalid zstd magic")
+	}
+
+	descriptor := header[4]
+	singleSegment := descriptor&0x20 != 0
+	hasChecksum := descriptor&0x04 != 0
+
+	if !singleSegment {
+		// Window descriptor.
+		c.skip(1)
+	}
+	c.skip([]int64{0, 1, 2, 4}[descriptor&0x3])
+
+	switch descriptor >> 6 {
+	case 0:
+		if singleSegment {
+			c.skip(1)
+		}
+	case 1:
+		c.skip(2)
+	case 2:
+		c.skip(4)
+	case 3:
+		c.skip(8)
+	}
+
+	for {
+		header, err := c.read(3)
+		if err != nil {
+			return 0, err
+		}
+
+		block := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		last := block&1 != 0
+		size := int64(block >> 3)
+
+		switch (block >> 1) & 0x3 {
+		case 1:
+			// RLE blocks contain a single byte.
+			size = 1
+		case 3:
+			return 0, fmt.Errorf("reserved zstd block type at offset %d", c.off-3)
+		}
+		c.skip(size)
+
+		if last {
+			break
+		}
+	}
+
+	if hasChecksum {
+		c.skip(4)
+	}
+
+	// Make sure the frame is actually present.
+	if _, err := ra.ReadAt(make([]byte, 1), c.off-1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		return 0, err
+	}
+
+	return c.off - off, nil
+}
+
+// xzStreamSize returns the size of the xz stream at off. Blocks that don't
+// record their compressed size must be compressed with LZMA2 (as they are
+// by the kernel and xz-utils), the chunks of which are walked instead.
+func xzStreamSize(ra io.ReaderAt, off int64) (int64, error) {
+	c := &cursor{ra: ra, off: off}
+
+	header, err := c.read(12)
+	if err != nil {
+		return 0, err
+	}
+
+	if header[6] != 0 || header[7] > 0xf {
+		return 0, errors.New("invalid xz stream flags")
+	}
+	checkSize := xzCheckSize(header[7])
+
+	for {
+		indicator, err := c.readByte()
+		if err != nil {
+			return 0, err
+		}
+
+		// The index follows the last block.
+		if indicator == 0 {
+			break
+		}
+
+		blockStart := c.off - 1
+
+		rest, err := c.read(int(indicator)*4 + 3)
+		if err != nil {
+			return 0, err
+		}
+		blockHeader := append([]byte{indicator}, rest...)
+
+		compressedSize, err := xzBlockCompressedSize(ra, c.off, blockHeader)
+		if err != nil {
+			return 0, fmt.Errorf("xz block at offset %d: %w", blockStart, err)
+		}
+
+		c.skip(compressedSize)
+		c.off = off + align4(c.off-off)
+		c.skip(checkSize)
+	}
+
+	// Walk the index, consisting of a count of records, followed by the
+	// unpadded and uncompressed sizes of each block.
+	br := bufio.NewReader(io.NewSectionReader(ra, c.off, math.MaxInt64-c.off))
+	indexSize := int64(1)
+
+	uvarint := func() (uint64, error) {
+		v, err := binary.ReadUvarint(&countingByteReader{r: br, n: &indexSize})
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		return v, err
+	}
+
+	records, err := uvarint()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := uint64(0); i < records; i++ {
+		for j := 0; j < 2; j++ {
+			if _, err := uvarint(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Index padding and CRC32 (the indicator has already been read).
+	c.skip(align4(indexSize) - 1 + 4)
+
+	footer, err := c.read(12)
+	if err != nil {
+		return 0, err
+	}
+
+	if string(footer[10:]) != xzFooterMagic {
+		return 0, errors.New("invalid xz stream footer")
+	}
+
+	return c.off - off, nil
+}
+
+// xzBlockCompressedSize returns the compressed size of the xz block with the
+// given header, the data of which begins at off.
+func xzBlockCompressedSize(ra io.ReaderAt, off int64, header []byte) (int64, error) {
+	flags := header[1]
+
+	br := bytes.NewReader(header[2:])
+
+	if flags&0x40 != 0 {
+		size, err := binary.ReadUvarint(br)
+		if err != nil || size > math.MaxInt64 {
+			return 0, errors.New("invalid compressed size")
+		}
+
+		return int64(size), nil
+	}
+
+	if flags&0x80 != 0 {
+		if _, err := binary.ReadUvarint(br); err != nil {
+			return 0, errors.New("invalid uncompressed size")
+		}
+	}
+
+	var filter uint64
+	for i := 0; i <= int(flags&0x3); i++ {
+		var err error
+		filter, err = binary.ReadUvarint(br)
+		if err != nil {
+			return 0, errors.New("invalid filter flags")
+		}
+
+		propsSize, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, errors.New("invalid filter flags")
+		}
+
+		if propsSize > uint64(br.Len()) {
+			return 0, errors.New("invalid filter flags")
+		}
+		_, _ = br.Seek(int64(propsSize), io.SeekCurrent)
+	}
+
+	if filter != xzFilterLZMA2 {
+		return 0, fmt.Errorf("%w: xz filter %#x", archiveerrors.ErrUnsupportedFeature, filter)
+	}
+
+	c := &cursor{ra: ra, off: off}
+	for {
+		control, err := c.readByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case control == 0:
+			return c.off - off, nil
+		case control == 1 || control == 2:
+			// Uncompressed chunk.
+			size, err := c.read(2)
+			if err != nil {
+				return 0, err
+			}
+			c.skip(int64(binary.BigEndian.Uint16(size)) + 1)
+		case control >= 0x80:
+			// LZMA chunk, with new properties if the state is reset.
+			sizes, err := c.read(4)
+			if err != nil {
+				return 0, err
+			}
+			if control >= 0xc0 {
+				c.skip(1)
+			}
+			c.skip(int64(binary.BigEndian.Uint16(sizes[2:])) + 1)
+		default:
+			return 0, fmt.Errorf("invalid LZMA2 chunk at offset %d", c.off-1)
+		}
+	}
+}
+
+// xzCheckSize returns the size of the check of each block, for the given
+// check type.
+func xzCheckSize(check byte) int64 {
+	if check == 0 {
+		return 0
+	}
+
+	return 4 << ((check - 1) / 3)
+}
+
+// lz4StreamSize returns the size of the LZ4 frame, or legacy LZ4 stream, at
+// off.
+func lz4StreamSize(ra io.ReaderAt, off int64) (int64, error) {
+	c := &cursor{ra: ra, off: off}
+
+	magic, err := c.read(4)
+	if err != nil {
+		return 0, err
+	}
+
+	switch binary.LittleEndian.Uint32(magic) {
+	case lz4FrameMagic:
+		return lz4FrameSize(ra, off)
+	case lz4LegacyMagic:
+		return lz4LegacySize(ra, off)
+	default:
+		return 0, errors.New("invalid lz4 magic")
+	}
+}
+
+// lz4FrameSize returns the size of the LZ4 frame at off.
+func lz4FrameSize(ra io.ReaderAt, off int64) (int64, error) {
+	c := &cursor{ra: ra, off: off + 4}
+
+	flags, err := c.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	// The block descriptor, optional content size and dictionary id, and
+	// the header checksum.
+	c.skip(2)
+	if flags&0x08 != 0 {
+		c.skip(8)
+	}
+	if flags&0x01 != 0 {
+		c.skip(4)
+	}
+
+	var checksum int64
+	if flags&0x10 != 0 {
+		checksum = 4
+	}
+
+	for {
+		header, err := c.read(4)
+		if err != nil {
+			return 0, err
+		}
+
+		size := binary.LittleEndian.Uint32(header)
+		if size == 0 {
+			break
+		}
+
+		c.skip(int64(size&0x7fffffff) + checksum)
+	}
+
+	// The content checksum.
+	if flags&0x04 != 0 {
+		c.skip(4)
+	}
+
+	return c.off - off, nil
+}
+
+// lz4LegacySize returns the size of the legacy LZ4 stream at off. As the
+// format has no end marker, the stream ends at the end of the image, or at
+// the first block with an impossible size (eg. padding, or the magic number
+// of another segment).
+func lz4LegacySize(ra io.ReaderAt, off int64) (int64, error) {
+	c := &cursor{ra: ra, off: off + 4}
+	for {
+		header, err := c.read(4)
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+
+			return 0, err
+		}
+
+		size := binary.LittleEndian.Uint32(header)
+		if size == lz4LegacyMagic {
+			continue
+		}
+
+		if size == 0 || size > lz4LegacyMaxCompressedSize {
+			c.off -= 4
+			break
+		}
+
+		c.skip(int64(size))
+	}
+
+	return c.off - off, nil
+}
+
+// countingByteReader counts the bytes read from an io.ByteReader.
+type countingByteReader struct {
+	r io.ByteReader
+	n *int64
+}
+
+func (cr *countingByteReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		*cr.n++
+	}
+
+	return b, err
+}
+
+// align4 rounds offset up to the next multiple of four.
+func align4(offset int64) int64 {
+	return (offset + 3) &^ 3
+}
@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package jsondoc reads the JSON documents (eg. indexes, manifests and
+// configs) of container images, which are limited in size as they are read
+// into memory.
+package jsondoc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// MaxSize is the maximum size of a document.
+const MaxSize = 4 << 20
+
+// Read decodes the named document, which must be within fsys.
+func Read(fsys fs.FS, name string, v any) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fmt.Errorf("invalid path %q: %w", name, archiveerrors.ErrInsecurePath)
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return Decode(f, name, v)
+}
+
+// Decode decodes the document read from r, failing with
+// archiveerrors.ErrLimitExceeded if it is larger than MaxSize.
+func Decode(r io.Reader, name string, v any) error {
+	data, err := io.ReadAll(io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return err
+	}
+
+	if len(data) > MaxSize {
+		return fmt.Errorf("%w: %s is larger than %d bytes", archiveerrors.ErrLimitExceeded, name, MaxSize)
+	}
+
+	return json.Unmarshal(data, v)
+}
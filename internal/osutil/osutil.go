@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package osutil contains helpers shared by the packages that write the
+// contents of a filesystem to disk (archivefs.Extract and copyfs).
+package osutil
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// SetOwner sets the numeric owner of a file, without following symbolic
+// links. Failures due to insufficient privileges are ignored unless running
+// as root. Windows does not have numeric owners, so this does nothing there.
+func SetOwner(path string, uid, gid int) error {
+	if err := lchown(path, uid, gid); err != nil && !IgnorePermissionError(err) {
+		return err
+	}
+
+	return nil
+}
+
+// SetXattrs sets the extended attributes of a file, without following
+// symbolic links, skipping any attribute with one of the prefixes in skip.
+// As with SetOwner, failures due to insufficient privileges are ignored. On
+// platforms other than Linux it fails with errors.ErrUnsupported.
+func SetXattrs(path string, xattrs map[string]string, skip []string) error {
+	for attr, value := range xattrs {
+		if hasAnyPrefix(attr, skip) {
+			continue
+		}
+
+		if err := lsetxattr(path, attr, []byte(value)); err != nil && !IgnorePermissionError(err) {
+			return &fs.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// SetMode sets the permission bits of a file, including the setuid, setgid
+// and sticky bits.
+func SetMode(path string, mode fs.FileMode) error {
+	return os.Chmod(path, mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+}
+
+// SetModTime sets the modification time of a file, leaving its access time
+// unchanged. A zero time is ignored.
+func SetModTime(path string, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(path, time.Time{}, mtime)
+}
+
+// IgnorePermissionError reports whether err is a permission error that
+// should be ignored because the process is not privileged.
+func IgnorePermissionError(err error) bool {
+	return os.Geteuid() != 0 && errors.Is(err, fs.ErrPermission)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
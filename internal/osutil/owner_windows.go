@@ -10,21 +10,10 @@
  * file, You can obtain one at http://mozilla.org/MPL/2.0/.
  */
 
-package erofs
+package osutil
 
-import (
-	"archive/tar"
-	"io/fs"
-)
-
-func getOwner(fi fs.FileInfo) (uid, gid int) {
-	switch fi.Sys().(type) {
-	case *tar.Header:
-		hdr := fi.Sys().(*tar.Header)
-
-		uid = hdr.Uid
-		gid = hdr.Gid
-	}
-
-	return
+// lchown sets the numeric owner of a file, without following symbolic links.
+// Windows does not have numeric owners, so this does nothing.
+func lchown(path string, uid, gid int) error {
+	return nil
 }
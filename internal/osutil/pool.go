@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package osutil
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool runs jobs on a fixed number of goroutines. Once a job fails (or the
+// context is cancelled) no more jobs are accepted.
+type Pool[T any] struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	work   chan T
+	wg     sync.WaitGroup
+}
+
+// NewPool starts a pool of workers (at least one) that call fn for each job.
+func NewPool[T any](ctx context.Context, workers int, fn func(job T) error) *Pool[T] {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	p := &Pool[T]{ctx: ctx, cancel: cancel, work: make(chan T)}
+	for i := 0; i < max(workers, 1); i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			for job := range p.work {
+				if err := fn(job); err != nil {
+					p.cancel(err)
+				}
+			}
+		}()
+	}
+
+	return p
+}
+
+// Go hands a job to the next available worker, returning the error that
+// stopped the pool if it has stopped.
+func (p *Pool[T]) Go(job T) error {
+	if p.ctx.Err() != nil {
+		return context.Cause(p.ctx)
+	}
+
+	select {
+	case p.work <- job:
+		return nil
+	case <-p.ctx.Done():
+		return context.Cause(p.ctx)
+	}
+}
+
+// Wait waits for every job to complete, returning the error that stopped
+// the pool (if any). No more jobs may be submitted.
+func (p *Pool[T]) Wait() error {
+	close(p.work)
+	p.wg.Wait()
+
+	err := context.Cause(p.ctx)
+	p.cancel(nil)
+
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package osutil
+
+import "errors"
+
+// lsetxattr sets an extended attribute without following symbolic links.
+func lsetxattr(path, attr string, value []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package readdir pages through directory listings that are held in memory.
+package readdir
+
+import (
+	"io"
+	"io/fs"
+)
+
+// Entries is the listing of an open directory. Embedding it in an open
+// directory implements fs.ReadDirFile's ReadDir method.
+type Entries struct {
+	entries []fs.DirEntry
+	offset  int
+}
+
+// New returns a listing of entries, starting from the first.
+func New(entries []fs.DirEntry) Entries {
+	return Entries{entries: entries}
+}
+
+// ReadDir returns the next n entries of the listing, or io.EOF at the end of
+// it. If n <= 0, all the remaining entries are returned.
+func (e *Entries) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := e.entries[e.offset:]
+	if n <= 0 {
+		e.offset = len(e.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(remaining))
+	e.offset += n
+
+	return remaining[:n], nil
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+)
+
+var _ io.ReaderAt = (*File)(nil)
+
+// File provides random access to the contents of a file, even if the
+// underlying fs.File only supports sequential reads.
+type File struct {
+	mu   sync.Mutex
+	fsys fs.FS
+	name string
+	f    fs.File
+	// ra is set if f supports random access.
+	ra io.ReaderAt
+	// randomAccess is set if f supports io.ReaderAt or io.Seeker.
+	randomAccess bool
+	// offset is the position of f, for files that are read sequentially.
+	offset int64
+}
+
+// Open opens the named file for random access.
+func Open(fsys fs.FS, name string) (*File, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ra, _ := f.(io.ReaderAt)
+	_, seekable := f.(io.Seeker)
+
+	return &File{
+		fsys:         fsys,
+		name:         name,
+		f:            f,
+		ra:           ra,
+		randomAccess: ra != nil || seekable,
+	}, nil
+}
+
+// ReadAt implements io.ReaderAt. It is safe to call concurrently.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	// Most archive files support random access.
+	if f.ra != nil {
+		return f.ra.ReadAt(p, off)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if seeker, ok := f.f.(io.Seeker); ok {
+		if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+
+		return io.ReadFull(f.f, p)
+	}
+
+	// Otherwise, the file is read sequentially, reopening it when seeking
+	// backwards.
+	if off < f.offset {
+		rf, err := f.fsys.Open(f.name)
+		if err != nil {
+			return 0, err
+		}
+
+		_ = f.f.Close()
+		f.f, f.offset = rf, 0
+	}
+
+	if off > f.offset {
+		skipped, err := io.CopyN(io.Discard, f.f, off-f.offset)
+		f.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(f.f, p)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+// RandomAccess reports whether the underlying file supports random access,
+// otherwise reading backwards requires reopening the file.
+func (f *File) RandomAccess() bool {
+	return f.randomAccess
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.Close()
+}
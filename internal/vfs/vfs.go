@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package vfs contains helpers shared by the packages that serve a fs.FS
+// to the kernel or over the network.
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// POSIX file mode bits, these are the same on every platform that matters.
+const (
+	S_IFMT   = 0o170000
+	S_IFSOCK = 0o140000
+	S_IFLNK  = 0o120000
+	S_IFREG  = 0o100000
+	S_IFBLK  = 0o060000
+	S_IFDIR  = 0o040000
+	S_IFCHR  = 0o020000
+	S_IFIFO  = 0o010000
+	S_ISUID  = 0o4000
+	S_ISGID  = 0o2000
+	S_ISVTX  = 0o1000
+)
+
+// Lstat returns a FileInfo describing the named file, without following
+// symbolic links if supported by the filesystem.
+func Lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if linkFS, ok := fsys.(archivefs.ReadLinkFS); ok {
+		return linkFS.StatLink(name)
+	}
+
+	return fs.Stat(fsys, name)
+}
+
+// ReadLink returns the target of the named symbolic link.
+func ReadLink(fsys fs.FS, name string) (string, error) {
+	linkFS, ok := fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	return linkFS.ReadLink(name)
+}
+
+// Mode converts a file mode to POSIX mode bits.
+func Mode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= S_ISVTX
+	}
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		m |= S_IFDIR
+	case fs.ModeSymlink:
+		m |= S_IFLNK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		m |= S_IFCHR
+	case fs.ModeDevice:
+		m |= S_IFBLK
+	case fs.ModeNamedPipe:
+		m |= S_IFIFO
+	case fs.ModeSocket:
+		m |= S_IFSOCK
+	default:
+		m |= S_IFREG
+	}
+
+	return m
+}
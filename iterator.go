@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+)
+
+var (
+	_ Iterator = (*FSIterator)(nil)
+)
+
+// Iterator provides sequential access to the entries of an archive, without
+// requiring random access (eg. tarfs.NewIterator and arfs.NewIterator). This
+// allows generic pipelines (filters, converters, inspectors, etc.) to
+// process archives as they are streamed.
+type Iterator interface {
+	// Next advances to the next entry, returning a description of it and a
+	// reader for its contents. The reader is only valid until the next call
+	// to Next. io.EOF is returned once there are no more entries.
+	Next() (*Entry, io.Reader, error)
+}
+
+// FSIterator is an Iterator over the files of a filesystem, in the same
+// order as fs.WalkDir (parents before their children). The root directory
+// is not included.
+type FSIterator struct {
+	fsys fs.FS
+	// pending holds the names of the files yet to be visited, in reverse
+	// order.
+	pending []string
+	f       fs.File
+	err     error
+}
+
+// NewFSIterator returns an Iterator over the files of fsys. It should be
+// closed if it is not iterated to the end.
+func NewFSIterator(fsys fs.FS) *FSIterator {
+	it := &FSIterator{fsys: fsys}
+	if err := it.push("."); err != nil {
+		it.err = err
+	}
+
+	return it
+}
+
+// Next advances to the next file in the filesystem.
+func (it *FSIterator) Next() (*Entry, io.Reader, error) {
+	if err := it.closeFile(); err != nil {
+		it.err = err
+	}
+
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+
+	if len(it.pending) == 0 {
+		it.err = io.EOF
+		return nil, nil, it.err
+	}
+
+	name := it.pending[len(it.pending)-1]
+	it.pending = it.pending[:len(it.pending)-1]
+
+	e, r, err := it.next(name)
+	if err != nil {
+		it.err = err
+		return nil, nil, err
+	}
+
+	return e, r, nil
+}
+
+// Close closes the file that was last returned, if any.
+func (it *FSIterator) Close() error {
+	if it.err == nil {
+		it.err = errors.New("iterator is closed")
+	}
+
+	return it.closeFile()
+}
+
+func (it *FSIterator) next(name string) (*Entry, io.Reader, error) {
+	fi, err := lstat(it.fsys, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	e, err := NewEntry(it.fsys, name, fi)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case fi.IsDir():
+		if err := it.push(name); err != nil {
+			return nil, nil, err
+		}
+	case fi.Mode().IsRegular():
+		f, err := it.fsys.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		it.f = f
+
+		return e, f, nil
+	}
+
+	return e, eofReader{}, nil
+}
+
+// push adds the children of the named directory to the pending files.
+func (it *FSIterator) push(dir string) error {
+	entries, err := fs.ReadDir(it.fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		it.pending = append(it.pending, path.Join(dir, entries[i].Name()))
+	}
+
+	return nil
+}
+
+func (it *FSIterator) closeFile() error {
+	if it.f == nil {
+		return nil
+	}
+
+	err := it.f.Close()
+	it.f = nil
+
+	return err
+}
+
+// eofReader is the contents of an entry that is not a regular file.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
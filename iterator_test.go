@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/arfs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o600))
+	require.NoError(t, fsys.SetOwner("etc/ssl/cert.pem", 1000, 1000))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+	require.NoError(t, fsys.Link("etc/hostname", "etc/hostname.bak"))
+
+	t.Run("FS", func(t *testing.T) {
+		it := archivefs.NewFSIterator(fsys)
+		t.Cleanup(func() {
+			require.NoError(t, it.Close())
+		})
+
+		entries := collect(t, it)
+		require.Equal(t, []string{
+			"etc",
+			"etc/hostname",
+			"etc/hostname.bak",
+			"etc/name",
+			"etc/ssl",
+			"etc/ssl/cert.pem",
+		}, names(entries))
+
+		require.True(t, entries[0].Mode.IsDir())
+		require.Equal(t, "alpha\n", entries[1].contents)
+		require.Equal(t, "alpha\n", entries[2].contents)
+		require.Equal(t, entries[1].Ino, entries[2].Ino)
+		require.Equal(t, 2, entries[1].Nlink)
+		require.Equal(t, "hostname", entries[3].Linkname)
+		require.Equal(t, 1000, entries[5].Uid)
+		require.Equal(t, "cert", entries[5].contents)
+
+		_, _, err := it.Next()
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		var archive bytes.Buffer
+		require.NoError(t, tarfs.Create(&archive, fsys))
+
+		entries := collect(t, tarfs.NewIterator(&archive))
+		require.Equal(t, []string{
+			"etc",
+			"etc/hostname",
+			"etc/hostname.bak",
+			"etc/name",
+			"etc/ssl",
+			"etc/ssl/cert.pem",
+		}, names(entries))
+
+		require.True(t, entries[0].Mode.IsDir())
+		require.Equal(t, "alpha\n", entries[1].contents)
+		require.Equal(t, int64(6), entries[1].Size)
+		require.Equal(t, "etc/hostname", entries[2].HardLink)
+		require.Empty(t, entries[2].contents)
+		require.Equal(t, fs.ModeSymlink, entries[3].Mode.Type())
+		require.Equal(t, "hostname", entries[3].Linkname)
+		require.Equal(t, 1000, entries[5].Uid)
+		require.Equal(t, 1000, entries[5].Gid)
+		require.Equal(t, fs.FileMode(0o600), entries[5].Mode)
+		require.Equal(t, "cert", entries[5].contents)
+	})
+
+	t.Run("Ar", func(t *testing.T) {
+		src := memfs.New()
+		require.NoError(t, src.WriteFile("debian-binary", []byte("2.0\n"), 0o644))
+		require.NoError(t, src.WriteFile("control.tar", []byte("control"), 0o644))
+		require.NoError(t, src.SetOwner("control.tar", 1000, 1000))
+
+		var archive bytes.Buffer
+		require.NoError(t, arfs.Create(&archive, src))
+
+		entries := collect(t, arfs.NewIterator(&archive))
+		require.Equal(t, []string{"control.tar", "debian-binary"}, names(entries))
+
+		require.Equal(t, "control", entries[0].contents)
+		require.Equal(t, 1000, entries[0].Uid)
+		require.Equal(t, "2.0\n", entries[1].contents)
+		require.True(t, entries[1].Mode.IsRegular())
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		var archive bytes.Buffer
+		require.NoError(t, tarfs.Create(&archive, fsys))
+
+		it := tarfs.NewIterator(bytes.NewReader(archive.Bytes()[:1000]))
+
+		var err error
+		for err == nil {
+			_, _, err = it.Next()
+		}
+		require.False(t, errors.Is(err, io.EOF))
+	})
+}
+
+type iteratedEntry struct {
+	*archivefs.Entry
+	contents string
+}
+
+// collect reads every entry from an iterator.
+func collect(t *testing.T, it archivefs.Iterator) []iteratedEntry {
+	var entries []iteratedEntry
+	for {
+		e, r, err := it.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+		require.NoError(t, err)
+
+		contents, err := io.ReadAll(r)
+		require.NoError(t, err)
+
+		entries = append(entries, iteratedEntry{Entry: e, contents: string(contents)})
+	}
+}
+
+func names(entries []iteratedEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
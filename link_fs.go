@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"io/fs"
+)
+
+// LinkFS is the interface that a file system must implement to identify
+// hard links. Entries with the same (non-zero) id within a filesystem are
+// hard links to the same file.
+type LinkFS interface {
+	fs.FS
+
+	// FileID returns the id of the named file, without following any symbolic
+	// links, and the number of hard links to it. A zero id means the identity
+	// of the file is unknown.
+	FileID(name string) (id uint64, nlink int, err error)
+}
+
+// LookupFileID returns the id of the named file and the number of hard links
+// to it, using LinkFS if implemented by fsys or otherwise the FileID of
+// fi.Sys(). fi describes the file without following symbolic links, if nil
+// the file is stat'ed. A zero id means the identity of the file is unknown.
+func LookupFileID(fsys fs.FS, name string, fi fs.FileInfo) (id uint64, nlink int, err error) {
+	if linkFS, ok := fsys.(LinkFS); ok {
+		id, nlink, err = linkFS.FileID(name)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else {
+		if fi == nil {
+			if fi, err = lstat(fsys, name); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if fileID, ok := fi.Sys().(FileID); ok {
+			id, nlink = fileID.FileID()
+		}
+	}
+
+	if nlink < 1 {
+		nlink = 1
+	}
+
+	return id, nlink, nil
+}
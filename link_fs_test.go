@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkFS(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/busybox", []byte("#!/bin/sh"), 0o755))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/ash"))
+	require.NoError(t, src.Link("usr/bin/busybox", "usr/bin/sh"))
+	require.NoError(t, src.WriteFile("usr/bin/true", []byte("#!/bin/sh"), 0o755))
+
+	var buf bytes.Buffer
+	require.NoError(t, tarfs.Create(&buf, src))
+
+	tarFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "rootfs.img"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	// Convert the tar archive, so that the hard links are preserved across
+	// formats.
+	require.NoError(t, erofs.Create(f, tarFS))
+
+	erofsFS, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	for name, fsys := range map[string]archivefs.LinkFS{
+		"memfs": src,
+		"tarfs": tarFS,
+		"erofs": erofsFS,
+	} {
+		t.Run(name, func(t *testing.T) {
+			busybox, nlink, err := fsys.FileID("usr/bin/busybox")
+			require.NoError(t, err)
+			require.NotZero(t, busybox)
+			require.Equal(t, 3, nlink)
+
+			for _, link := range []string{"usr/bin/ash", "usr/bin/sh"} {
+				id, nlink, err := fsys.FileID(link)
+				require.NoError(t, err)
+				require.Equal(t, busybox, id)
+				require.Equal(t, 3, nlink)
+			}
+
+			id, nlink, err := fsys.FileID("usr/bin/true")
+			require.NoError(t, err)
+			require.NotEqual(t, busybox, id)
+			require.Equal(t, 1, nlink)
+
+			_, _, err = fsys.FileID("usr/bin/missing")
+			require.ErrorIs(t, err, fs.ErrNotExist)
+
+			data, err := fs.ReadFile(fsys, "usr/bin/sh")
+			require.NoError(t, err)
+			require.Equal(t, "#!/bin/sh", string(data))
+		})
+	}
+
+	t.Run("Sys", func(t *testing.T) {
+		// Filesystems that don't implement LinkFS fall back to FileID.
+		fsys := archivefs.NormalizeTimes(src, nil)
+
+		busybox, nlink, err := archivefs.LookupFileID(fsys, "usr/bin/busybox", nil)
+		require.NoError(t, err)
+		require.NotZero(t, busybox)
+		require.Equal(t, 3, nlink)
+
+		fi, err := fs.Stat(fsys, "usr/bin/ash")
+		require.NoError(t, err)
+
+		id, nlink, err := archivefs.LookupFileID(fsys, "usr/bin/ash", fi)
+		require.NoError(t, err)
+		require.Equal(t, busybox, id)
+		require.Equal(t, 3, nlink)
+
+		id, nlink, err = archivefs.LookupFileID(fsys, "usr", nil)
+		require.NoError(t, err)
+		require.Zero(t, id)
+		require.Equal(t, 1, nlink)
+	})
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"io/fs"
+)
+
+var (
+	_ fs.ReadDirFS = (*mapInfoFS)(nil)
+	_ fs.StatFS    = (*mapInfoFS)(nil)
+	_ ReadLinkFS   = (*mapInfoFS)(nil)
+)
+
+// mapInfoFS is a read-only view of a filesystem, with the FileInfo of each
+// file rewritten by mapInfo.
+type mapInfoFS struct {
+	fsys    fs.FS
+	mapInfo func(fi fs.FileInfo) fs.FileInfo
+}
+
+func (fsys *mapInfoFS) Open(name string) (fs.File, error) {
+	f, err := fsys.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return &mapInfoDir{mapInfoFile{File: f, fsys: fsys}}, nil
+	}
+
+	return &mapInfoFile{File: f, fsys: fsys}, nil
+}
+
+func (fsys *mapInfoFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.mapInfo(fi), nil
+}
+
+func (fsys *mapInfoFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.mapEntries(entries), nil
+}
+
+func (fsys *mapInfoFS) ReadLink(name string) (string, error) {
+	return readLink(fsys.fsys, name)
+}
+
+func (fsys *mapInfoFS) StatLink(name string) (fs.FileInfo, error) {
+	fi, err := lstat(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.mapInfo(fi), nil
+}
+
+func (fsys *mapInfoFS) mapEntries(entries []fs.DirEntry) []fs.DirEntry {
+	mapped := make([]fs.DirEntry, len(entries))
+	for i, de := range entries {
+		mapped[i] = &mapInfoDirEntry{DirEntry: de, fsys: fsys}
+	}
+
+	return mapped
+}
+
+type mapInfoDirEntry struct {
+	fs.DirEntry
+	fsys *mapInfoFS
+}
+
+func (de *mapInfoDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := de.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return de.fsys.mapInfo(fi), nil
+}
+
+type mapInfoFile struct {
+	fs.File
+	fsys *mapInfoFS
+}
+
+func (f *mapInfoFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.fsys.mapInfo(fi), nil
+}
+
+type mapInfoDir struct {
+	mapInfoFile
+}
+
+func (d *mapInfoDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.File.(fs.ReadDirFile).ReadDir(n)
+	return d.fsys.mapEntries(entries), err
+}
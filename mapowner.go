@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+)
+
+// OverflowID is the ID reported for owners that are not covered by an ID
+// mapping, as for Linux user namespaces.
+const OverflowID = 65534
+
+// IDMapping maps a contiguous range of user or group IDs, as for the lines
+// of /proc/<pid>/uid_map.
+type IDMapping struct {
+	// ID is the first ID of the range in the source filesystem.
+	ID int
+	// MappedID is the ID that ID is mapped to.
+	MappedID int
+	// Size is the number of IDs in the range.
+	Size int
+}
+
+// OwnerMapOptions configures the mapping of file ownership.
+type OwnerMapOptions struct {
+	// UIDMappings maps user IDs. User IDs that are not covered by a mapping
+	// are reported as OverflowID. If empty, user IDs are not changed.
+	UIDMappings []IDMapping
+	// GIDMappings maps group IDs. Group IDs that are not covered by a
+	// mapping are reported as OverflowID. If empty, group IDs are not
+	// changed.
+	GIDMappings []IDMapping
+	// Map, if set, is called to map the owner of each file, the ID
+	// mappings are ignored.
+	Map func(uid, gid int) (int, int)
+}
+
+// MapOwners returns a read-only view of fsys with the ownership of files
+// mapped according to opts, as for a user namespace. This allows eg.
+// rootless image builders to shift owners before creating an archive.
+//
+// The owner is reported via fs.FileInfo.Sys(), which will be a modified copy
+// of the underlying *tar.Header or *syscall.Stat_t if applicable, otherwise
+// a value implementing Owner (and forwarding the Device, ExtendedAttributes,
+// FileID and FileAttributes interfaces). Files without an owner are
+// treated as being owned by root.
+func MapOwners(fsys fs.FS, opts *OwnerMapOptions) fs.FS {
+	if opts == nil {
+		opts = &OwnerMapOptions{}
+	}
+
+	mapOwner := opts.Map
+	if mapOwner == nil {
+		uidMappings, gidMappings := opts.UIDMappings, opts.GIDMappings
+		mapOwner = func(uid, gid int) (int, int) {
+			return mapID(uidMappings, uid), mapID(gidMappings, gid)
+		}
+	}
+
+	return &mapInfoFS{fsys: fsys, mapInfo: func(fi fs.FileInfo) fs.FileInfo {
+		return mapOwnerInfo(fi, mapOwner)
+	}}
+}
+
+func mapID(mappings []IDMapping, id int) int {
+	if len(mappings) == 0 {
+		return id
+	}
+
+	for _, m := range mappings {
+		if id >= m.ID && id < m.ID+m.Size {
+			return m.MappedID + (id - m.ID)
+		}
+	}
+
+	return OverflowID
+}
+
+// mapOwnerInfo returns fi with its owner mapped.
+func mapOwnerInfo(fi fs.FileInfo, mapOwner func(uid, gid int) (int, int)) fs.FileInfo {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		hdr := *sys
+		hdr.Uid, hdr.Gid = mapOwner(sys.Uid, sys.Gid)
+		return &ownerFileInfo{FileInfo: fi, sys: &hdr}
+	case Owner:
+		uid, gid := sys.Owner()
+		uid, gid = mapOwner(uid, gid)
+		return &ownerFileInfo{FileInfo: fi, sys: &ownerSys{sys: sys, uid: uid, gid: gid}}
+	}
+
+	if sys, ok := mapSysOwner(fi.Sys(), mapOwner); ok {
+		return &ownerFileInfo{FileInfo: fi, sys: sys}
+	}
+
+	uid, gid := mapOwner(0, 0)
+	return &ownerFileInfo{FileInfo: fi, sys: &ownerSys{sys: fi.Sys(), uid: uid, gid: gid}}
+}
+
+type ownerFileInfo struct {
+	fs.FileInfo
+	sys any
+}
+
+func (fi *ownerFileInfo) Sys() any {
+	return fi.sys
+}
+
+// ownerSys reports a mapped owner, and forwards the other metadata of the
+// underlying file.
+type ownerSys struct {
+	sys      any
+	uid, gid int
+}
+
+func (sys *ownerSys) Owner() (uid, gid int) {
+	return sys.uid, sys.gid
+}
+
+func (sys *ownerSys) Device() (major, minor uint32) {
+	if dev, ok := sys.sys.(Device); ok {
+		return dev.Device()
+	}
+
+	return 0, 0
+}
+
+func (sys *ownerSys) ExtendedAttributes() map[string]string {
+	if xattrs, ok := sys.sys.(ExtendedAttributes); ok {
+		return xattrs.ExtendedAttributes()
+	}
+
+	return nil
+}
+
+func (sys *ownerSys) FileID() (id uint64, nlink int) {
+	if fileID, ok := sys.sys.(FileID); ok {
+		return fileID.FileID()
+	}
+
+	return 0, 1
+}
+
+func (sys *ownerSys) FileAttributes() uint32 {
+	if attrs, ok := sys.sys.(FileAttributes); ok {
+		return attrs.FileAttributes()
+	}
+
+	return 0
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapOwners(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("home/user", 0o755))
+	require.NoError(t, src.WriteFile("home/user/.profile", []byte("profile"), 0o644))
+	require.NoError(t, src.SetOwner("home/user", 101000, 101000))
+	require.NoError(t, src.SetOwner("home/user/.profile", 101000, 200000))
+	require.NoError(t, src.SetOwner(".", 100000, 100000))
+	require.NoError(t, src.SetOwner("home", 100000, 100000))
+	require.NoError(t, src.SetXattr("home/user/.profile", "user.comment", "hello"))
+
+	fsys := archivefs.MapOwners(src, &archivefs.OwnerMapOptions{
+		UIDMappings: []archivefs.IDMapping{{ID: 100000, MappedID: 0, Size: 65536}},
+		GIDMappings: []archivefs.IDMapping{{ID: 100000, MappedID: 0, Size: 65536}},
+	})
+
+	requireOwner := func(t *testing.T, fi fs.FileInfo, uid, gid int) {
+		switch sys := fi.Sys().(type) {
+		case *tar.Header:
+			require.Equal(t, uid, sys.Uid)
+			require.Equal(t, gid, sys.Gid)
+		case archivefs.Owner:
+			actualUID, actualGID := sys.Owner()
+			require.Equal(t, uid, actualUID)
+			require.Equal(t, gid, actualGID)
+		default:
+			t.Fatalf("unexpected sys type %T", sys)
+		}
+	}
+
+	fi, err := fs.Stat(fsys, "home/user")
+	require.NoError(t, err)
+	requireOwner(t, fi, 1000, 1000)
+
+	f, err := fsys.Open("home/user/.profile")
+	require.NoError(t, err)
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	requireOwner(t, fi, 1000, archivefs.OverflowID)
+	require.Equal(t, "hello", fi.Sys().(archivefs.ExtendedAttributes).ExtendedAttributes()["user.comment"])
+
+	entries, err := fs.ReadDir(fsys, "home")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	fi, err = entries[0].Info()
+	require.NoError(t, err)
+	requireOwner(t, fi, 1000, 1000)
+
+	require.NoError(t, fstest.TestFS(fsys, "home/user/.profile"))
+
+	t.Run("Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, tarfs.Create(&buf, fsys))
+
+		tarFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		fi, err := fs.Stat(tarFS, "home/user/.profile")
+		require.NoError(t, err)
+		requireOwner(t, fi, 1000, archivefs.OverflowID)
+
+		// Remap the tar headers back to the original owners.
+		restored := archivefs.MapOwners(tarFS, &archivefs.OwnerMapOptions{
+			Map: func(uid, gid int) (int, int) {
+				return uid + 100000, gid + 100000
+			},
+		})
+
+		fi, err = fs.Stat(restored, "home/user/.profile")
+		require.NoError(t, err)
+		requireOwner(t, fi, 101000, 100000+archivefs.OverflowID)
+
+		// The underlying header is not modified.
+		fi, err = fs.Stat(tarFS, "home/user/.profile")
+		require.NoError(t, err)
+		requireOwner(t, fi, 1000, archivefs.OverflowID)
+	})
+
+	t.Run("Unowned", func(t *testing.T) {
+		fsys := archivefs.MapOwners(fstest.MapFS{
+			"hello.txt": {Data: []byte("hello")},
+		}, &archivefs.OwnerMapOptions{
+			UIDMappings: []archivefs.IDMapping{{ID: 0, MappedID: 1000, Size: 1}},
+		})
+
+		fi, err := fs.Stat(fsys, "hello.txt")
+		require.NoError(t, err)
+		requireOwner(t, fi, 1000, 0)
+	})
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// BlobStats describes the contents of the content-addressed blob store used
+// when deduplication is enabled.
+type BlobStats struct {
+	// Blobs is the number of distinct file contents stored.
+	Blobs int
+	// References is the number of files referencing a stored blob.
+	References int
+	// Bytes is the total size of the stored blobs.
+	Bytes int64
+	// SavedBytes is the memory saved by sharing blobs between files.
+	SavedBytes int64
+}
+
+// BlobStats returns statistics about the deduplicated file contents. It
+// returns a zero value if deduplication is not enabled.
+func (rootFS *FS) BlobStats() BlobStats {
+	var stats BlobStats
+	if rootFS.blobs == nil {
+		return stats
+	}
+
+	rootFS.blobs.mu.Lock()
+	defer rootFS.blobs.mu.Unlock()
+
+	for _, b := range rootFS.blobs.blobs {
+		stats.Blobs++
+		stats.References += b.refs
+		stats.Bytes += int64(len(b.data))
+		stats.SavedBytes += int64(b.refs-1) * int64(len(b.data))
+	}
+
+	return stats
+}
+
+// blobStore is a content-addressed store of immutable file contents.
+type blobStore struct {
+	mu    sync.Mutex
+	blobs map[[sha256.Size]byte]*blob
+}
+
+type blob struct {
+	store *blobStore
+	sum   [sha256.Size]byte
+	data  []byte
+	refs  int
+}
+
+func newBlobStore() *blobStore {
+	return &blobStore{
+		blobs: make(map[[sha256.Size]byte]*blob),
+	}
+}
+
+// acquire adds a reference to the blob.
+func (b *blob) acquire() {
+	b.store.mu.Lock()
+	b.refs++
+	b.store.mu.Unlock()
+}
+
+// release drops a reference to the blob, removing it from the store once it
+// is no longer referenced.
+func (b *blob) release() {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	b.refs--
+	if b.refs == 0 {
+		delete(b.store.blobs, b.sum)
+	}
+}
+
+// intern moves the file contents into the blob store, sharing them with any
+// other file with identical contents. The file must be locked.
+func (f *file) intern(store *blobStore) {
+	if f.blob != nil {
+		return
+	}
+
+	sum := sha256.Sum256(f.data)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, ok := store.blobs[sum]
+	if !ok {
+		b = &blob{
+			store: store,
+			sum:   sum,
+			data:  f.data[:len(f.data):len(f.data)],
+		}
+		store.blobs[sum] = b
+	}
+	b.refs++
+
+	f.data = b.data
+	f.blob = b
+	f.shared = true
+}
@@ -0,0 +1,372 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	syspath "path"
+	"syscall"
+)
+
+// maxFileSize is the largest size a file may grow to, files are held in a
+// single slice so anything larger could never be allocated.
+const maxFileSize = 1 << 32
+
+var (
+	_ fs.File       = (*File)(nil)
+	_ io.ReadWriter = (*File)(nil)
+	_ io.Seeker     = (*File)(nil)
+	_ io.ReaderAt   = (*File)(nil)
+	_ io.WriterAt   = (*File)(nil)
+)
+
+// OpenFile is the generalized open call, it opens the named file with the
+// specified flag (os.O_RDONLY etc.). If the file does not exist, and the
+// os.O_CREATE flag is passed, it is created with mode perm. The os.O_APPEND,
+// os.O_EXCL, and os.O_TRUNC flags are also honored.
+func (rootFS *FS) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	child, err := rootFS.lookup(name, true)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		child, err = rootFS.create(name, perm)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	if _, ok := child.(*mounted); ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errReadOnly}
+	}
+
+	node, ok := child.(*file)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory: %w", fs.ErrInvalid)}
+	}
+
+	f := &File{name: syspath.Base(name), node: node, quota: rootFS.quota, blobs: rootFS.blobs, flag: flag}
+	if flag&os.O_TRUNC != 0 && f.writable() {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// File is an open file in the filesystem.
+type File struct {
+	name   string
+	node   *file
+	quota  *quota
+	blobs  *blobStore
+	flag   int
+	offset int64
+	closed bool
+	// dirty is set if the file has been modified through this handle.
+	dirty bool
+}
+
+func (f *File) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+
+	return childInfo(f.name, f.node), nil
+}
+
+func (f *File) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	if !f.readable() {
+		return 0, fmt.Errorf("file not open for reading: %w", fs.ErrPermission)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.node.data[f.offset:])
+	f.offset += int64(n)
+
+	return n, nil
+}
+
+func (f *File) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	if !f.writable() {
+		return 0, fmt.Errorf("file not open for writing: %w", fs.ErrPermission)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+
+	if err := f.node.writeAt(f.quota, b, f.offset); err != nil {
+		return 0, err
+	}
+	f.offset += int64(len(b))
+	f.dirty = true
+
+	return len(b), nil
+}
+
+// ReadAt reads len(b) bytes from the file starting at byte offset off. It
+// does not change the I/O offset.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	if !f.readable() {
+		return 0, fmt.Errorf("file not open for reading: %w", fs.ErrPermission)
+	}
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d: %w", off, fs.ErrInvalid)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt writes len(b) bytes to the file starting at byte offset off,
+// extending the file if necessary. It does not change the I/O offset, and is
+// not permitted if the file was opened with os.O_APPEND.
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	if !f.writable() {
+		return 0, fmt.Errorf("file not open for writing: %w", fs.ErrPermission)
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		return 0, fmt.Errorf("invalid use of WriteAt on file opened with O_APPEND: %w", fs.ErrInvalid)
+	}
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d: %w", off, fs.ErrInvalid)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if err := f.node.writeAt(f.quota, b, off); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+
+	return len(b), nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, fmt.Errorf("invalid whence: %d: %w", whence, fs.ErrInvalid)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d: %w", offset, fs.ErrInvalid)
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+// Truncate changes the size of the file. It does not change the I/O offset.
+func (f *File) Truncate(size int64) error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+
+	if !f.writable() {
+		return fmt.Errorf("file not open for writing: %w", fs.ErrPermission)
+	}
+
+	if size < 0 {
+		return fmt.Errorf("negative size: %d: %w", size, fs.ErrInvalid)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if err := f.node.truncate(f.quota, size); err != nil {
+		return err
+	}
+	f.dirty = true
+
+	return nil
+}
+
+func (f *File) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+
+	if f.dirty && f.blobs != nil {
+		f.node.mu.Lock()
+		f.node.intern(f.blobs)
+		f.node.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Truncate changes the size of the named file, following symbolic links.
+func (rootFS *FS) Truncate(name string, size int64) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fmt.Errorf("negative size: %d: %w", size, fs.ErrInvalid)}
+	}
+
+	child, err := rootFS.lookup(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "truncate", Path: name, Err: err}
+	}
+
+	switch c := child.(type) {
+	case *file:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if err := c.truncate(rootFS.quota, size); err != nil {
+			return &fs.PathError{Op: "truncate", Path: name, Err: err}
+		}
+
+		if rootFS.blobs != nil {
+			c.intern(rootFS.blobs)
+		}
+
+		return nil
+	case *mounted:
+		return &fs.PathError{Op: "truncate", Path: name, Err: errReadOnly}
+	default:
+		return &fs.PathError{Op: "truncate", Path: name, Err: fmt.Errorf("not a regular file: %w", fs.ErrInvalid)}
+	}
+}
+
+// writeAt writes b to the file at offset off, extending the file if
+// necessary. The file must be locked.
+func (node *file) writeAt(q *quota, b []byte, off int64) error {
+	if off > maxFileSize-int64(len(b)) {
+		return fmt.Errorf("file size exceeds %d bytes: %w", int64(maxFileSize), syscall.EFBIG)
+	}
+
+	end := off + int64(len(b))
+	if end > int64(len(node.data)) {
+		if err := q.reserveBytes(end - int64(len(node.data))); err != nil {
+			return err
+		}
+	}
+
+	node.unshare()
+	if end > int64(len(node.data)) {
+		node.data = growData(node.data, end)
+	}
+
+	copy(node.data[off:], b)
+
+	return nil
+}
+
+// truncate changes the size of the file. The file must be locked.
+func (node *file) truncate(q *quota, size int64) error {
+	if size > maxFileSize {
+		return fmt.Errorf("file size exceeds %d bytes: %w", int64(maxFileSize), syscall.EFBIG)
+	}
+
+	if err := q.reserveBytes(size - int64(len(node.data))); err != nil {
+		return err
+	}
+
+	node.unshare()
+	if size > int64(len(node.data)) {
+		node.data = growData(node.data, size)
+	} else {
+		node.data = node.data[:size]
+	}
+
+	return nil
+}
+
+func (f *File) readable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (f *File) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != os.O_RDONLY
+}
+
+// growData extends data to the given size, zero filling any gap.
+func growData(data []byte, size int64) []byte {
+	if int64(cap(data)) >= size {
+		grown := data[:size]
+		clear(grown[len(data):])
+		return grown
+	}
+
+	grown := make([]byte, size, max(size, min(2*int64(cap(data)), maxFileSize)))
+	copy(grown, data)
+
+	return grown
+}
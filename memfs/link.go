@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	syspath "path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// lastIno is the most recently allocated inode number.
+var lastIno atomic.Uint64
+
+func nextIno() uint64 {
+	return lastIno.Add(1)
+}
+
+// Link creates newname as a hard link to the oldname file. Both names refer
+// to the same underlying content. Only regular files can be hard linked.
+func (rootFS *FS) Link(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) || newname == "." {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+
+	child, err := rootFS.lookup(oldname, false)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	node, ok := child.(*file)
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fmt.Errorf("not a regular file: %w", fs.ErrPermission)}
+	}
+
+	dirPart, filePart := syspath.Split(newname)
+
+	dir, err := rootFS.getDir(strings.TrimSuffix(dirPart, "/"))
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if dir.children[filePart] != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+
+	node.mu.Lock()
+	node.nlink++
+	node.mu.Unlock()
+
+	dir.children[filePart] = node
+
+	return nil
+}
+
+// FileID returns the inode number of the named file, without following any
+// symbolic links, and the number of hard links to it. The inode number is
+// zero for directories, symbolic links, and special files.
+func (rootFS *FS) FileID(name string) (id uint64, nlink int, err error) {
+	fi, err := rootFS.StatLink(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if fileID, ok := fi.Sys().(archivefs.FileID); ok {
+		id, nlink = fileID.FileID()
+	}
+
+	return id, nlink, nil
+}
@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	syspath "path"
+	"slices"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// FromMapFS creates a new in-memory filesystem from the contents of a
+// fstest.MapFS. Symbolic links are represented by entries with the
+// fs.ModeSymlink mode and the link target as their data. Ownership, device
+// numbers, and extended attributes are taken from Sys, if it implements
+// archivefs.Owner, archivefs.Device, or is a *FileInfoSys.
+func FromMapFS(m fstest.MapFS) (*FS, error) {
+	rootFS := New()
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err := rootFS.addMapFile(name, m[name]); err != nil {
+			return nil, fmt.Errorf("failed to add %q: %w", name, err)
+		}
+	}
+
+	return rootFS, nil
+}
+
+func (rootFS *FS) addMapFile(name string, f *fstest.MapFile) error {
+	if !fs.ValidPath(name) {
+		return fs.ErrInvalid
+	}
+
+	meta := nodeMeta{
+		mode:    f.Mode,
+		modTime: f.ModTime,
+	}
+
+	if owner, ok := f.Sys.(archivefs.Owner); ok {
+		meta.uid, meta.gid = owner.Owner()
+	}
+
+	if sys, ok := f.Sys.(*FileInfoSys); ok {
+		meta.xattrs = maps.Clone(sys.Xattrs)
+	}
+
+	if name == "." {
+		rootFS.dir.setMeta(meta)
+		return nil
+	}
+
+	if dirPart := syspath.Dir(name); dirPart != "." {
+		if err := rootFS.MkdirAll(dirPart, 0o755); err != nil {
+			return err
+		}
+	}
+
+	switch f.Mode.Type() {
+	case fs.ModeDir:
+		existing, err := rootFS.lookup(name, false)
+		if err == nil {
+			if d, ok := existing.(*dir); ok {
+				d.setMeta(meta)
+				return nil
+			}
+		}
+
+		return rootFS.insert(name, newDir(syspath.Base(name), meta), false)
+
+	case fs.ModeSymlink:
+		return rootFS.insert(name, newSymlink(syspath.Base(name), string(f.Data), meta), false)
+
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+		var major, minor uint32
+		if dev, ok := f.Sys.(archivefs.Device); ok {
+			major, minor = dev.Device()
+		}
+
+		return rootFS.insert(name, newSpecial(syspath.Base(name), major, minor, meta), false)
+
+	default:
+		node, err := rootFS.newFile(slices.Clone(f.Data), meta)
+		if err != nil {
+			return err
+		}
+
+		return rootFS.insert(name, node, false)
+	}
+}
+
+// ToMapFS returns a copy of the filesystem as a fstest.MapFS. Each entry
+// has a *FileInfoSys as its Sys value, and symbolic links have their target
+// as their data. Hard links are copied as separate files.
+func (rootFS *FS) ToMapFS() (fstest.MapFS, error) {
+	m := fstest.MapFS{}
+
+	err := fs.WalkDir(rootFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := rootFS.StatLink(path)
+		if err != nil {
+			return err
+		}
+
+		f := &fstest.MapFile{
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+			Sys:     fi.Sys(),
+		}
+
+		switch fi.Mode().Type() {
+		case fs.ModeSymlink:
+			target, err := rootFS.ReadLink(path)
+			if err != nil {
+				return err
+			}
+			f.Data = []byte(target)
+		case 0:
+			f.Data, err = fs.ReadFile(rootFS, path)
+			if err != nil {
+				return err
+			}
+		}
+
+		m[path] = f
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -41,30 +41,80 @@
 package memfs
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	syspath "path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/readdir"
+)
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ fs.SubFS             = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ archivefs.LinkFS     = (*FS)(nil)
+	_ fs.ReadDirFile       = (*fhDir)(nil)
 )
 
 // FS is an in-memory filesystem that implements
 // io/fs.FS
 type FS struct {
-	dir *dir
+	dir   *dir
+	quota *quota
+	// blobs is the store of deduplicated file contents, if enabled.
+	blobs *blobStore
+}
+
+// Options configures an in-memory filesystem.
+type Options struct {
+	// MaxBytes is the maximum total size of file contents, zero means
+	// unlimited.
+	MaxBytes int64
+	// MaxFiles is the maximum number of files, directories, symbolic links,
+	// and special files, zero means unlimited.
+	MaxFiles int
+	// Dedup enables content-addressed storage of file contents, so files
+	// with identical contents share the same memory. Contents are hashed
+	// when a written file is closed. Quotas still apply to the logical size
+	// of each file.
+	Dedup bool
 }
 
 // New creates a new in-memory FileSystem.
 func New() *FS {
-	return &FS{
+	return NewWithOptions(nil)
+}
+
+// NewWithOptions creates a new in-memory FileSystem with the given options.
+func NewWithOptions(opts *Options) *FS {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	rootFS := &FS{
 		dir: &dir{
 			children: make(map[string]childI),
 		},
+		quota: &quota{
+			maxBytes: opts.MaxBytes,
+			maxFiles: opts.MaxFiles,
+		},
+	}
+
+	if opts.Dedup {
+		rootFS.blobs = newBlobStore()
 	}
+
+	return rootFS
 }
 
 // MkdirAll creates a directory named path,
@@ -87,11 +137,16 @@ func (rootFS *FS) MkdirAll(path string, perm os.FileMode) error {
 	parts := strings.Split(path, "/")
 
 	next := rootFS.dir
-	for _, part := range parts {
+	for i, part := range parts {
 		cur := next
 		cur.mu.Lock()
 		child := cur.children[part]
 		if child == nil {
+			if err := rootFS.quota.reserveFile(); err != nil {
+				cur.mu.Unlock()
+				return fmt.Errorf("failed to create directory: %s: %w", part, err)
+			}
+
 			newDir := &dir{
 				name:     part,
 				perm:     perm,
@@ -99,106 +154,133 @@ func (rootFS *FS) MkdirAll(path string, perm os.FileMode) error {
 			}
 			cur.children[part] = newDir
 			next = newDir
-		} else {
-			childDir, ok := child.(*dir)
-			if !ok {
-				return fmt.Errorf("not a directory: %s: %w", part, fs.ErrInvalid)
-			}
-			next = childDir
+			cur.mu.Unlock()
+			continue
 		}
 		cur.mu.Unlock()
+
+		switch child.(type) {
+		case *symlink, *mounted:
+			var err error
+			child, err = rootFS.lookup(strings.Join(parts[:i+1], "/"), true)
+			if err != nil {
+				return err
+			}
+		}
+
+		if m, ok := child.(*mounted); ok {
+			if fi, err := m.stat(true); err == nil && fi.IsDir() && i == len(parts)-1 {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", path, errReadOnly)
+		}
+
+		childDir, ok := child.(*dir)
+		if !ok {
+			return fmt.Errorf("not a directory: %s: %w", part, fs.ErrInvalid)
+		}
+		next = childDir
 	}
 
 	return nil
 }
 
 func (rootFS *FS) getDir(path string) (*dir, error) {
-	if path == "" {
-		return rootFS.dir, nil
+	child, err := rootFS.lookup(path, true)
+	if err != nil {
+		return nil, err
 	}
-	parts := strings.Split(path, "/")
 
-	cur := rootFS.dir
-	for _, part := range parts {
-		err := func() error {
-			cur.mu.Lock()
-			defer cur.mu.Unlock()
-			child := cur.children[part]
-			if child == nil {
-				return fmt.Errorf("not a directory: %s: %w", part, fs.ErrNotExist)
-			} else {
-				childDir, ok := child.(*dir)
-				if !ok {
-					return fmt.Errorf("no such file or directory: %s: %w", part, fs.ErrNotExist)
-				}
-				cur = childDir
-			}
-			return nil
-		}()
-		if err != nil {
-			return nil, err
-		}
+	if _, ok := child.(*mounted); ok {
+		return nil, fmt.Errorf("%s: %w", path, errReadOnly)
 	}
 
-	return cur, nil
+	childDir, ok := child.(*dir)
+	if !ok {
+		return nil, fmt.Errorf("not a directory: %s: %w", path, fs.ErrNotExist)
+	}
+
+	return childDir, nil
 }
 
 func (rootFS *FS) get(path string) (childI, error) {
-	if path == "" {
-		return rootFS.dir, nil
+	return rootFS.lookup(path, true)
+}
+
+// lookup finds the named node, following any symbolic links in the
+// intermediate path components. The final component is only followed if
+// follow is true.
+func (rootFS *FS) lookup(path string, follow bool) (childI, error) {
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
 	}
 
-	parts := strings.Split(path, "/")
+	// The stack of directories traversed, used to resolve "..".
+	stack := []*dir{rootFS.dir}
 
-	var (
-		cur = rootFS.dir
+	var hops int
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
 
-		chld childI
-		err  error
-	)
-	for i, part := range parts {
-		chld, err = func() (childI, error) {
-			cur.mu.Lock()
-			defer cur.mu.Unlock()
-			child := cur.children[part]
-			if child == nil {
-				return nil, fmt.Errorf("not a directory: %s: %w", part, fs.ErrNotExist)
-			} else {
-				_, isFile := child.(*File)
-				if isFile {
-					if i == len(parts)-1 {
-						return child, nil
-					} else {
-						return nil, fmt.Errorf("no such file or directory: %s: %w", part, fs.ErrNotExist)
-					}
-				}
-
-				childDir, ok := child.(*dir)
-				if !ok {
-					return nil, errors.New("not a directory")
-				}
-				cur = childDir
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
 			}
-			return child, nil
-		}()
-		if err != nil {
-			return nil, err
+			continue
 		}
-	}
 
-	return chld, nil
-}
+		cur := stack[len(stack)-1]
+		cur.mu.Lock()
+		child := cur.children[part]
+		cur.mu.Unlock()
 
-func (rootFS *FS) create(path string) (*File, error) {
-	if !fs.ValidPath(path) {
-		return nil, fmt.Errorf("invalid path: %s: %w", path, fs.ErrInvalid)
-	}
+		if child == nil {
+			return nil, fmt.Errorf("no such file or directory: %s: %w", part, fs.ErrNotExist)
+		}
 
-	if path == "." {
-		// root dir
-		path = ""
+		if link, ok := child.(*symlink); ok && (follow || len(parts) > 0) {
+			hops++
+			if hops > archivefs.MaxSymlinkHops {
+				return nil, fmt.Errorf("too many levels of symbolic links: %s: %w", path, fs.ErrInvalid)
+			}
+
+			if strings.HasPrefix(link.target, "/") {
+				stack = stack[:1]
+			}
+
+			parts = append(strings.Split(link.target, "/"), parts...)
+			continue
+		}
+
+		if m, ok := child.(*mounted); ok && len(parts) > 0 {
+			child, parts = m.resolve(parts)
+			if child != nil {
+				return child, nil
+			}
+			continue
+		}
+
+		if len(parts) == 0 {
+			return child, nil
+		}
+
+		childDir, ok := child.(*dir)
+		if !ok {
+			return nil, fmt.Errorf("not a directory: %s: %w", part, fs.ErrNotExist)
+		}
+		stack = append(stack, childDir)
 	}
 
+	return stack[len(stack)-1], nil
+}
+
+// create adds a new, empty file node. It fails if the path already exists.
+func (rootFS *FS) create(path string, perm os.FileMode) (*file, error) {
 	dirPart, filePart := syspath.Split(path)
 
 	dirPart = strings.TrimSuffix(dirPart, "/")
@@ -209,18 +291,19 @@ func (rootFS *FS) create(path string) (*File, error) {
 
 	dir.mu.Lock()
 	defer dir.mu.Unlock()
-	existing := dir.children[filePart]
-	if existing != nil {
-		_, ok := existing.(*File)
-		if !ok {
-			return nil, fmt.Errorf("path is a directory: %s: %w", path, fs.ErrExist)
-		}
+
+	if dir.children[filePart] != nil {
+		return nil, fmt.Errorf("file exists: %s: %w", path, fs.ErrExist)
+	}
+
+	if err := rootFS.quota.reserveFile(); err != nil {
+		return nil, err
 	}
 
-	newFile := &File{
-		name:    filePart,
-		perm:    0666,
-		content: &bytes.Buffer{},
+	newFile := &file{
+		ino:   nextIno(),
+		perm:  perm,
+		nlink: 1,
 	}
 	dir.children[filePart] = newFile
 
@@ -231,22 +314,17 @@ func (rootFS *FS) create(path string) (*File, error) {
 // If the file does not exist, WriteFile creates it with permissions perm
 // (before umask); otherwise WriteFile truncates it before writing, without changing permissions.
 func (rootFS *FS) WriteFile(path string, data []byte, perm os.FileMode) error {
-	if !fs.ValidPath(path) {
-		return fmt.Errorf("invalid path: %s: %w", path, fs.ErrInvalid)
+	f, err := rootFS.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
 	}
 
-	if path == "." {
-		// root dir
-		path = ""
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
 
-	f, err := rootFS.create(path)
-	if err != nil {
-		return err
-	}
-	f.content = bytes.NewBuffer(data)
-	f.perm = perm
-	return nil
+	return err
 }
 
 // Open opens the named file.
@@ -270,150 +348,466 @@ func (rootFS *FS) Open(name string) (fs.File, error) {
 	}
 
 	switch cc := child.(type) {
-	case *File:
-		handle := &File{
-			name:    cc.name,
-			perm:    cc.perm,
-			content: bytes.NewBuffer(cc.content.Bytes()),
-		}
-		return handle, nil
+	case *file:
+		return &File{name: syspath.Base(name), node: cc, quota: rootFS.quota}, nil
 	case *dir:
 		handle := &fhDir{
 			dir: cc,
 		}
 		return handle, nil
+	case *special:
+		return &fhSpecial{info: childInfo(cc.name, cc)}, nil
+	case *mounted:
+		return cc.open()
 	}
 
 	return nil, fmt.Errorf("unexpected file type in fs: %s: %w", name, fs.ErrInvalid)
 }
 
+// Stat returns a FileInfo describing the named file.
+func (rootFS *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		// root dir
+		name = ""
+	}
+
+	child, err := rootFS.get(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	if m, ok := child.(*mounted); ok {
+		return m.stat(true)
+	}
+
+	return childInfo(syspath.Base(name), child), nil
+}
+
+// ReadDir reads the named directory and returns a list of directory entries
+// sorted by filename.
+func (rootFS *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		// root dir
+		name = ""
+	}
+
+	child, err := rootFS.get(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	switch c := child.(type) {
+	case *dir:
+		return readDir(c), nil
+	case *mounted:
+		return fs.ReadDir(c.fsys, c.path)
+	default:
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+}
+
 // Sub returns an FS corresponding to the subtree rooted at path.
 func (rootFS *FS) Sub(path string) (fs.FS, error) {
+	if m, err := rootFS.get(path); err == nil {
+		if m, ok := m.(*mounted); ok {
+			return fs.Sub(m.fsys, m.path)
+		}
+	}
+
 	dir, err := rootFS.getDir(path)
 	if err != nil {
 		return nil, err
 	}
-	return &FS{dir: dir}, nil
+	return &FS{dir: dir, quota: rootFS.quota, blobs: rootFS.blobs}, nil
 }
 
-type dir struct {
-	mu       sync.Mutex
-	name     string
-	perm     os.FileMode
-	modTime  time.Time
-	children map[string]childI
+// Symlink creates newname as a symbolic link to oldname. Absolute targets are
+// resolved relative to the root of the filesystem.
+func (rootFS *FS) Symlink(oldname, newname string) error {
+	if !fs.ValidPath(newname) || newname == "." {
+		return fmt.Errorf("invalid path: %s: %w", newname, fs.ErrInvalid)
+	}
+
+	dirPart, filePart := syspath.Split(newname)
+
+	dir, err := rootFS.getDir(strings.TrimSuffix(dirPart, "/"))
+	if err != nil {
+		return err
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if dir.children[filePart] != nil {
+		return fmt.Errorf("file exists: %s: %w", newname, fs.ErrExist)
+	}
+
+	if err := rootFS.quota.reserveFile(); err != nil {
+		return err
+	}
+
+	dir.children[filePart] = &symlink{
+		name:   filePart,
+		target: oldname,
+	}
+
+	return nil
 }
 
-type fhDir struct {
-	dir *dir
-	idx int
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (rootFS *FS) ReadLink(name string) (string, error) {
+	child, err := rootFS.lstat("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	if m, ok := child.(*mounted); ok {
+		target, err := m.readLink()
+		if err != nil {
+			return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+		}
+		return target, nil
+	}
+
+	link, ok := child.(*symlink)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return link.target, nil
 }
 
-func (d *fhDir) Stat() (fs.FileInfo, error) {
-	fi := fileInfo{
-		name:    d.dir.name,
-		size:    4096,
-		modTime: d.dir.modTime,
-		mode:    d.dir.perm | fs.ModeDir,
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (rootFS *FS) StatLink(name string) (fs.FileInfo, error) {
+	child, err := rootFS.lstat("statlink", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := child.(*mounted); ok {
+		return m.stat(false)
 	}
-	return &fi, nil
+
+	return childInfo(syspath.Base(name), child), nil
 }
 
-func (d *fhDir) Read(b []byte) (int, error) {
-	return 0, errors.New("is a directory")
+func (rootFS *FS) lstat(op, name string) (childI, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		// root dir
+		name = ""
+	}
+
+	return rootFS.lookup(name, false)
 }
 
-func (d *fhDir) Close() error {
-	return nil
+// nodeMeta holds the metadata common to all types of node.
+type nodeMeta struct {
+	mode    fs.FileMode
+	modTime time.Time
+	uid     int
+	gid     int
+	xattrs  map[string]string
+}
+
+func newDir(name string, meta nodeMeta) *dir {
+	return &dir{
+		name:     name,
+		perm:     meta.mode.Perm(),
+		modTime:  meta.modTime,
+		uid:      meta.uid,
+		gid:      meta.gid,
+		xattrs:   meta.xattrs,
+		children: make(map[string]childI),
+	}
 }
 
-func (d *fhDir) ReadDir(n int) ([]fs.DirEntry, error) {
-	d.dir.mu.Lock()
-	defer d.dir.mu.Unlock()
+// setMeta replaces the metadata of the directory.
+func (d *dir) setMeta(meta nodeMeta) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.perm, d.modTime = meta.mode.Perm(), meta.modTime
+	d.uid, d.gid = meta.uid, meta.gid
+	d.xattrs = meta.xattrs
+}
 
-	names := make([]string, 0, len(d.dir.children))
-	for name := range d.dir.children {
-		names = append(names, name)
+// newFile returns a new file node holding data, which it takes ownership of.
+func (rootFS *FS) newFile(data []byte, meta nodeMeta) (*file, error) {
+	if err := rootFS.quota.reserveBytes(int64(len(data))); err != nil {
+		return nil, err
 	}
 
-	if n <= 0 {
-		n = len(names)
+	node := &file{
+		ino:     nextIno(),
+		perm:    meta.mode.Perm(),
+		data:    data,
+		modTime: meta.modTime,
+		uid:     meta.uid,
+		gid:     meta.gid,
+		xattrs:  meta.xattrs,
+		nlink:   1,
 	}
 
-	out := make([]fs.DirEntry, 0, n)
+	if rootFS.blobs != nil {
+		node.intern(rootFS.blobs)
+	}
 
-	for i := d.idx; i < n && i < len(names); i++ {
-		name := names[i]
-		child := d.dir.children[name]
+	return node, nil
+}
 
-		f, isFile := child.(*File)
-		if isFile {
-			stat, _ := f.Stat()
-			out = append(out, &dirEntry{
-				info: stat,
-			})
-		} else {
-			d := child.(*dir)
-			fi := fileInfo{
-				name:    d.name,
-				size:    4096,
-				modTime: d.modTime,
-				mode:    d.perm | fs.ModeDir,
-			}
-			out = append(out, &dirEntry{
-				info: &fi,
-			})
+func newSymlink(name, target string, meta nodeMeta) *symlink {
+	return &symlink{
+		name:    name,
+		target:  target,
+		modTime: meta.modTime,
+		uid:     meta.uid,
+		gid:     meta.gid,
+		xattrs:  meta.xattrs,
+	}
+}
+
+// insert adds a node to the filesystem. If replace is set, any existing
+// node at the path is replaced, otherwise an existing node is an error.
+func (rootFS *FS) insert(path string, child childI, replace bool) error {
+	if !fs.ValidPath(path) || path == "." {
+		return fs.ErrInvalid
+	}
+
+	dirPart, filePart := syspath.Split(path)
+
+	parent, err := rootFS.getDir(strings.TrimSuffix(dirPart, "/"))
+	if err != nil {
+		return err
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if existing := parent.children[filePart]; existing != nil {
+		if !replace {
+			return fmt.Errorf("file exists: %s: %w", path, fs.ErrExist)
 		}
 
-		d.idx = i
+		if f, ok := existing.(*file); ok {
+			rootFS.unlink(f)
+		}
+	} else if err := rootFS.quota.reserveFile(); err != nil {
+		return err
 	}
-	return out, nil
+
+	parent.children[filePart] = child
+
+	return nil
 }
 
-type File struct {
+// unlink drops a link to the file, releasing its contents once the last link
+// is removed.
+func (rootFS *FS) unlink(f *file) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nlink--
+	if f.nlink > 0 {
+		return
+	}
+
+	_ = rootFS.quota.reserveBytes(-int64(len(f.data)))
+	if f.blob != nil {
+		f.blob.release()
+		f.blob = nil
+	}
+}
+
+type symlink struct {
 	name    string
-	perm    os.FileMode
-	content *bytes.Buffer
+	target  string
 	modTime time.Time
-	closed  bool
+	uid     int
+	gid     int
+	xattrs  map[string]string
 }
 
-func (f *File) Stat() (fs.FileInfo, error) {
-	if f.closed {
-		return nil, fs.ErrClosed
-	}
-	fi := fileInfo{
-		name:    f.name,
-		size:    int64(f.content.Len()),
-		modTime: f.modTime,
-		mode:    f.perm,
-	}
-	return &fi, nil
+type dir struct {
+	mu       sync.Mutex
+	name     string
+	perm     os.FileMode
+	modTime  time.Time
+	uid      int
+	gid      int
+	xattrs   map[string]string
+	children map[string]childI
 }
 
-func (f *File) Read(b []byte) (int, error) {
-	if f.closed {
-		return 0, fs.ErrClosed
+type fhDir struct {
+	dir *dir
+	// Entries is populated on the first call to ReadDir.
+	readdir.Entries
+	read bool
+}
+
+func (d *fhDir) Stat() (fs.FileInfo, error) {
+	return childInfo(d.dir.name, d.dir), nil
+}
+
+func (d *fhDir) Read(b []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *fhDir) Close() error {
+	return nil
+}
+
+func (d *fhDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.Entries, d.read = readdir.New(readDir(d.dir)), true
 	}
-	return f.content.Read(b)
+
+	return d.Entries.ReadDir(n)
 }
 
-func (f *File) Close() error {
-	if f.closed {
-		return fs.ErrClosed
+// readDir returns the entries of a directory, sorted by name.
+func readDir(d *dir) []fs.DirEntry {
+	d.mu.Lock()
+	children := make(map[string]childI, len(d.children))
+	for name, child := range d.children {
+		children[name] = child
 	}
-	f.closed = true
-	return nil
+	d.mu.Unlock()
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for name, child := range children {
+		entries = append(entries, &dirEntry{
+			info: childInfo(name, child),
+		})
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries
+}
+
+// file is a regular file node. A file node has no name of its own, as it
+// may be hard linked into several directories.
+type file struct {
+	mu   sync.Mutex
+	ino  uint64
+	perm os.FileMode
+	data []byte
+	// shared is set if data is shared with a clone of the filesystem, or
+	// with other files through the blob store.
+	shared bool
+	// blob is the deduplicated blob holding the file contents, if any.
+	blob    *blob
+	modTime time.Time
+	uid     int
+	gid     int
+	xattrs  map[string]string
+	nlink   int
 }
 
 type childI interface {
 }
 
+// childInfo returns a FileInfo describing a node in the filesystem.
+func childInfo(name string, child childI) fs.FileInfo {
+	switch c := child.(type) {
+	case *file:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return &fileInfo{
+			name:    name,
+			size:    int64(len(c.data)),
+			modTime: c.modTime,
+			mode:    c.perm,
+			sys: &FileInfoSys{
+				Ino:    c.ino,
+				Nlink:  c.nlink,
+				Uid:    c.uid,
+				Gid:    c.gid,
+				Xattrs: maps.Clone(c.xattrs),
+			},
+		}
+	case *symlink:
+		return &fileInfo{
+			name:    c.name,
+			size:    int64(len(c.target)),
+			modTime: c.modTime,
+			mode:    fs.ModeSymlink | 0o777,
+			sys: &FileInfoSys{
+				Nlink:  1,
+				Uid:    c.uid,
+				Gid:    c.gid,
+				Xattrs: maps.Clone(c.xattrs),
+			},
+		}
+	case *special:
+		return &fileInfo{
+			name:    c.name,
+			modTime: c.modTime,
+			mode:    c.mode,
+			sys: &FileInfoSys{
+				Nlink:  1,
+				Uid:    c.uid,
+				Gid:    c.gid,
+				Major:  c.major,
+				Minor:  c.minor,
+				Xattrs: maps.Clone(c.xattrs),
+			},
+		}
+	case *mounted:
+		fi, err := c.stat(true)
+		if err != nil {
+			return &fileInfo{
+				name: c.name,
+				mode: fs.ModeDir | 0o555,
+			}
+		}
+		return fi
+	default:
+		d := child.(*dir)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return &fileInfo{
+			name:    d.name,
+			size:    4096,
+			modTime: d.modTime,
+			mode:    d.perm | fs.ModeDir,
+			sys: &FileInfoSys{
+				Nlink:  1,
+				Uid:    d.uid,
+				Gid:    d.gid,
+				Xattrs: maps.Clone(d.xattrs),
+			},
+		}
+	}
+}
+
 type fileInfo struct {
 	name    string
 	size    int64
 	modTime time.Time
 	mode    fs.FileMode
+	sys     any
 }
 
 // base name of the file
@@ -443,7 +837,7 @@ func (fi *fileInfo) IsDir() bool {
 
 // underlying data source (can return nil)
 func (fi *fileInfo) Sys() interface{} {
-	return nil
+	return fi.sys
 }
 
 type dirEntry struct {
@@ -459,7 +853,7 @@ func (de *dirEntry) IsDir() bool {
 }
 
 func (de *dirEntry) Type() fs.FileMode {
-	return de.info.Mode()
+	return de.info.Mode().Type()
 }
 
 func (de *dirEntry) Info() (fs.FileInfo, error) {
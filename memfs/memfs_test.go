@@ -41,11 +41,26 @@
 package memfs_test
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
+	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/erofs"
 	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
 
 	"github.com/stretchr/testify/require"
 )
@@ -106,3 +121,845 @@ func TestMemFS(t *testing.T) {
 
 	require.Equal(t, body, gotBody)
 }
+
+func TestMemFSSymlink(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, rootFS.WriteFile("usr/bin/busybox", []byte("busybox"), 0o755))
+
+	require.NoError(t, rootFS.Symlink("usr/bin", "bin"))
+	require.NoError(t, rootFS.Symlink("busybox", "usr/bin/sh"))
+	require.NoError(t, rootFS.Symlink("/usr/bin/busybox", "usr/bin/ls"))
+	require.NoError(t, rootFS.Symlink("../../bin/sh", "usr/bin/ash"))
+	require.NoError(t, rootFS.Symlink("loop", "loop"))
+
+	for _, name := range []string{"bin/busybox", "bin/sh", "usr/bin/ls", "bin/ash"} {
+		data, err := fs.ReadFile(rootFS, name)
+		require.NoError(t, err, name)
+		require.Equal(t, "busybox", string(data))
+	}
+
+	target, err := rootFS.ReadLink("bin/ls")
+	require.NoError(t, err)
+	require.Equal(t, "/usr/bin/busybox", target)
+
+	_, err = rootFS.ReadLink("usr/bin/busybox")
+	require.ErrorIs(t, err, fs.ErrInvalid)
+
+	fi, err := rootFS.StatLink("bin")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	fi, err = fs.Stat(rootFS, "bin")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	_, err = rootFS.Open("loop")
+	require.Error(t, err)
+
+	require.ErrorIs(t, rootFS.Symlink("busybox", "bin/sh"), fs.ErrExist)
+
+	// Writes follow symlinks.
+	require.NoError(t, rootFS.WriteFile("bin/sh", []byte("toybox"), 0o755))
+
+	data, err := fs.ReadFile(rootFS, "usr/bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "toybox", string(data))
+
+	entries, err := fs.ReadDir(rootFS, "usr/bin")
+	require.NoError(t, err)
+	for _, e := range entries {
+		if e.Name() != "busybox" {
+			require.Equal(t, fs.ModeSymlink, e.Type()&fs.ModeSymlink, e.Name())
+		}
+	}
+}
+
+func TestMemFSOpenFile(t *testing.T) {
+	rootFS := memfs.New()
+
+	_, err := rootFS.OpenFile("hello.txt", os.O_RDWR, 0o644)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	f, err := rootFS.OpenFile("hello.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+
+	_, err = f.Seek(7, io.SeekStart)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("there"))
+	require.NoError(t, err)
+
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, there!", string(data))
+
+	require.NoError(t, f.Truncate(5))
+	require.NoError(t, f.Close())
+
+	_, err = rootFS.OpenFile("hello.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	require.ErrorIs(t, err, fs.ErrExist)
+
+	f, err = rootFS.OpenFile("hello.txt", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte(", world!"))
+	require.NoError(t, err)
+
+	_, err = f.Read(make([]byte, 1))
+	require.ErrorIs(t, err, fs.ErrPermission)
+	require.NoError(t, f.Close())
+
+	data, err = fs.ReadFile(rootFS, "hello.txt")
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
+
+	f, err = rootFS.OpenFile("hello.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	fi, err := fs.Stat(rootFS, "hello.txt")
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+	require.Equal(t, fs.FileMode(0o644), fi.Mode())
+}
+
+func TestMemFSLink(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("bin", 0o755))
+	require.NoError(t, rootFS.WriteFile("bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, rootFS.Link("bin/busybox", "bin/sh"))
+
+	require.ErrorIs(t, rootFS.Link("bin/busybox", "bin/sh"), fs.ErrExist)
+	require.ErrorIs(t, rootFS.Link("bin", "dir"), fs.ErrPermission)
+
+	// Writes through one name are visible through the other.
+	require.NoError(t, rootFS.WriteFile("bin/sh", []byte("toybox"), 0o755))
+
+	data, err := fs.ReadFile(rootFS, "bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "toybox", string(data))
+
+	a, err := fs.Stat(rootFS, "bin/busybox")
+	require.NoError(t, err)
+
+	b, err := fs.Stat(rootFS, "bin/sh")
+	require.NoError(t, err)
+
+	require.Equal(t, "sh", b.Name())
+	require.Equal(t, a.Sys().(*memfs.FileInfoSys).Ino, b.Sys().(*memfs.FileInfoSys).Ino)
+	require.Equal(t, 2, b.Sys().(*memfs.FileInfoSys).Nlink)
+}
+
+func TestMemFSQuota(t *testing.T) {
+	rootFS := memfs.NewWithOptions(&memfs.Options{
+		MaxBytes: 10,
+		MaxFiles: 3,
+	})
+
+	require.NoError(t, rootFS.MkdirAll("dir", 0o755))
+	require.NoError(t, rootFS.WriteFile("dir/a.txt", []byte("12345"), 0o644))
+
+	err := rootFS.WriteFile("dir/b.txt", []byte("123456"), 0o644)
+	require.ErrorIs(t, err, memfs.ErrNoSpace)
+	require.ErrorIs(t, err, syscall.ENOSPC)
+
+	// Overwriting a file releases its previous contents.
+	require.NoError(t, rootFS.WriteFile("dir/a.txt", []byte("1234567890"), 0o644))
+
+	// The failed write still created b.txt, so we're out of files.
+	require.ErrorIs(t, rootFS.Symlink("a.txt", "dir/c.txt"), memfs.ErrNoSpace)
+	require.ErrorIs(t, rootFS.MkdirAll("other", 0o755), memfs.ErrNoSpace)
+}
+
+func TestMemFSSnapshot(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("etc", 0o755))
+	require.NoError(t, rootFS.WriteFile("etc/hostname", []byte("base"), 0o644))
+	require.NoError(t, rootFS.Link("etc/hostname", "etc/hostname.bak"))
+	require.NoError(t, rootFS.Symlink("hostname", "etc/name"))
+
+	snapshot := rootFS.Snapshot()
+	clone := rootFS.Clone()
+
+	require.NoError(t, rootFS.WriteFile("etc/hostname", []byte("original"), 0o644))
+	require.NoError(t, rootFS.WriteFile("etc/motd", []byte("hello"), 0o644))
+	require.NoError(t, clone.WriteFile("etc/hostname", []byte("clone"), 0o644))
+
+	for name, expected := range map[string]string{
+		"etc/name":         "base",
+		"etc/hostname.bak": "base",
+	} {
+		data, err := fs.ReadFile(snapshot, name)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(data))
+	}
+
+	_, err := fs.Stat(snapshot, "etc/motd")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	data, err := fs.ReadFile(rootFS, "etc/hostname.bak")
+	require.NoError(t, err)
+	require.Equal(t, "original", string(data))
+
+	// Hard links are preserved in the clone.
+	data, err = fs.ReadFile(clone, "etc/hostname.bak")
+	require.NoError(t, err)
+	require.Equal(t, "clone", string(data))
+
+	_, ok := snapshot.(interface {
+		WriteFile(string, []byte, fs.FileMode) error
+	})
+	require.False(t, ok)
+}
+
+func TestMemFSSetOwner(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("home/user", 0o755))
+	require.NoError(t, rootFS.WriteFile("home/user/.profile", []byte("export PS1='$ '"), 0o644))
+	require.NoError(t, rootFS.SetOwner("home/user", 1000, 1000))
+	require.NoError(t, rootFS.SetOwner("home/user/.profile", 1000, 100))
+
+	fi, err := fs.Stat(rootFS, "home/user/.profile")
+	require.NoError(t, err)
+
+	uid, gid := fi.Sys().(archivefs.Owner).Owner()
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 100, gid)
+
+	var buf bytes.Buffer
+	require.NoError(t, tarfs.Create(&buf, rootFS))
+
+	owners := map[string][2]int{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		owners[strings.TrimSuffix(hdr.Name, "/")] = [2]int{hdr.Uid, hdr.Gid}
+	}
+
+	require.Equal(t, [2]int{0, 0}, owners["home"])
+	require.Equal(t, [2]int{1000, 1000}, owners["home/user"])
+	require.Equal(t, [2]int{1000, 100}, owners["home/user/.profile"])
+}
+
+func TestMemFSMknod(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("dev", 0o755))
+	require.NoError(t, rootFS.Mknod("dev/null", fs.ModeDevice|fs.ModeCharDevice|0o666, 1, 3))
+	require.NoError(t, rootFS.Mknod("dev/console", fs.ModeDevice|fs.ModeCharDevice|0o600, 5, 1))
+	require.NoError(t, rootFS.Mknod("dev/initctl", fs.ModeNamedPipe|0o600, 0, 0))
+
+	require.ErrorIs(t, rootFS.Mknod("dev/null", fs.ModeDevice|fs.ModeCharDevice|0o666, 1, 3), fs.ErrExist)
+	require.ErrorIs(t, rootFS.Mknod("dev/zero", 0o666, 1, 5), fs.ErrInvalid)
+
+	fi, err := fs.Stat(rootFS, "dev/null")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, fi.Mode())
+
+	major, minor := fi.Sys().(archivefs.Device).Device()
+	require.Equal(t, uint32(1), major)
+	require.Equal(t, uint32(3), minor)
+
+	data, err := fs.ReadFile(rootFS, "dev/null")
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	t.Run("Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, tarfs.Create(&buf, rootFS))
+
+		hdrs := map[string]*tar.Header{}
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			hdrs[hdr.Name] = hdr
+		}
+
+		require.Equal(t, byte(tar.TypeChar), hdrs["dev/console"].Typeflag)
+		require.Equal(t, int64(5), hdrs["dev/console"].Devmajor)
+		require.Equal(t, int64(1), hdrs["dev/console"].Devminor)
+		require.Equal(t, byte(tar.TypeFifo), hdrs["dev/initctl"].Typeflag)
+	})
+
+	t.Run("EROFS", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "rootfs.img"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, rootFS))
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		fi, err := fs.Stat(fsys, "dev/console")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o600, fi.Mode())
+
+		major, minor := fi.Sys().(archivefs.Device).Device()
+		require.Equal(t, uint32(5), major)
+		require.Equal(t, uint32(1), minor)
+
+		fi, err = fs.Stat(fsys, "dev/initctl")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeNamedPipe|0o600, fi.Mode())
+	})
+}
+
+func TestMemFSMount(t *testing.T) {
+	base := fstest.MapFS{
+		"etc/os-release": {Data: []byte("ID=debian\n"), Mode: 0o644},
+		"usr/bin/sh":     {Data: []byte("#!"), Mode: 0o755},
+	}
+
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("layers", 0o755))
+	require.NoError(t, rootFS.Mount("layers/base", base))
+	require.NoError(t, rootFS.WriteFile("hostname", []byte("builder\n"), 0o644))
+	require.NoError(t, rootFS.Symlink("layers/base/etc", "etc"))
+
+	data, err := fs.ReadFile(rootFS, "layers/base/etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=debian\n", string(data))
+
+	data, err = fs.ReadFile(rootFS, "etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=debian\n", string(data))
+
+	fi, err := fs.Stat(rootFS, "layers/base")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, "base", fi.Name())
+
+	var files []string
+	err = fs.WalkDir(rootFS, "layers", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"layers/base/etc/os-release", "layers/base/usr/bin/sh"}, files)
+
+	sub, err := rootFS.Sub("layers/base/usr")
+	require.NoError(t, err)
+
+	_, err = fs.Stat(sub, "bin/sh")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, rootFS.WriteFile("layers/base/etc/hosts", nil, 0o644), fs.ErrPermission)
+	require.ErrorIs(t, rootFS.MkdirAll("layers/base/var", 0o755), fs.ErrPermission)
+	require.NoError(t, rootFS.MkdirAll("layers/base", 0o755))
+}
+
+func TestMemFSConformance(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("a/b/c", 0o755))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, rootFS.WriteFile(fmt.Sprintf("a/file%d.txt", i), []byte(strings.Repeat("x", i)), 0o644))
+	}
+	require.NoError(t, rootFS.WriteFile("a/b/c/d.txt", []byte("d"), 0o600))
+	require.NoError(t, rootFS.Mount("base", fstest.MapFS{
+		"etc/hostname": {Data: []byte("base\n"), Mode: 0o644},
+	}))
+
+	expected := []string{"a/b/c/d.txt", "base/etc/hostname"}
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("a/file%d.txt", i))
+	}
+
+	require.NoError(t, fstest.TestFS(rootFS, expected...))
+	require.NoError(t, fstest.TestFS(rootFS.Snapshot(), expected...))
+	require.NoError(t, archivefstest.TestFS(rootFS, expected...))
+
+	t.Run("ReadDirPagination", func(t *testing.T) {
+		f, err := rootFS.Open("a")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		dir, ok := f.(fs.ReadDirFile)
+		require.True(t, ok)
+
+		var names []string
+		for {
+			entries, err := dir.ReadDir(3)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(entries), 3)
+
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+		}
+
+		require.Len(t, names, 11)
+		require.True(t, slices.IsSorted(names))
+	})
+}
+
+func TestMemFSTruncateWriteAt(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.WriteFile("config", []byte("debug=false\n"), 0o644))
+
+	f, err := rootFS.OpenFile("config", os.O_RDWR, 0)
+	require.NoError(t, err)
+
+	n, err := f.WriteAt([]byte("true \n"), 6)
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+
+	// WriteAt doesn't move the offset.
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	require.Equal(t, "debug", string(buf))
+
+	_, err = f.ReadAt(buf, 6)
+	require.NoError(t, err)
+	require.Equal(t, "true ", string(buf))
+
+	_, err = f.WriteAt([]byte("!"), 14)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	data, err := fs.ReadFile(rootFS, "config")
+	require.NoError(t, err)
+	require.Equal(t, "debug=true \n\x00\x00!", string(data))
+
+	require.NoError(t, rootFS.Truncate("config", 11))
+
+	data, err = fs.ReadFile(rootFS, "config")
+	require.NoError(t, err)
+	require.Equal(t, "debug=true ", string(data))
+
+	require.NoError(t, rootFS.Truncate("config", 13))
+
+	data, err = fs.ReadFile(rootFS, "config")
+	require.NoError(t, err)
+	require.Equal(t, "debug=true \x00\x00", string(data))
+
+	require.ErrorIs(t, rootFS.Truncate("missing", 0), fs.ErrNotExist)
+
+	f, err = rootFS.OpenFile("config", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), 0)
+	require.ErrorIs(t, err, fs.ErrInvalid)
+	require.NoError(t, f.Close())
+
+	// Absurd sizes are refused rather than allocated.
+	f, err = rootFS.OpenFile("config", os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), 1<<62)
+	require.ErrorIs(t, err, syscall.EFBIG)
+	require.ErrorIs(t, f.Truncate(1<<62), syscall.EFBIG)
+	require.NoError(t, f.Close())
+
+	require.ErrorIs(t, rootFS.Truncate("config", 1<<62), syscall.EFBIG)
+}
+
+func TestMemFSDedup(t *testing.T) {
+	rootFS := memfs.NewWithOptions(&memfs.Options{Dedup: true})
+
+	license := []byte(strings.Repeat("Permission is hereby granted. ", 100))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, rootFS.WriteFile(fmt.Sprintf("copyright%d", i), license, 0o644))
+	}
+	require.NoError(t, rootFS.WriteFile("README", []byte("hello"), 0o644))
+
+	stats := rootFS.BlobStats()
+	require.Equal(t, 2, stats.Blobs)
+	require.Equal(t, 6, stats.References)
+	require.Equal(t, int64(len(license)+5), stats.Bytes)
+	require.Equal(t, int64(4*len(license)), stats.SavedBytes)
+
+	// Modifying a file must not affect the others sharing its contents.
+	f, err := rootFS.OpenFile("copyright0", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	data, err := fs.ReadFile(rootFS, "copyright1")
+	require.NoError(t, err)
+	require.Equal(t, license, data)
+
+	stats = rootFS.BlobStats()
+	require.Equal(t, 3, stats.Blobs)
+	require.Equal(t, 6, stats.References)
+
+	// Overwriting a file with unique contents releases the old blob.
+	require.NoError(t, rootFS.WriteFile("README", []byte("goodbye"), 0o644))
+
+	stats = rootFS.BlobStats()
+	require.Equal(t, 3, stats.Blobs)
+	require.Equal(t, int64(2*len(license)+1+7), stats.Bytes)
+}
+
+func TestMemFSSaveLoad(t *testing.T) {
+	rootFS := memfs.NewWithOptions(&memfs.Options{MaxFiles: 100})
+
+	require.NoError(t, rootFS.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, rootFS.MkdirAll("dev", 0o755))
+	require.NoError(t, rootFS.WriteFile("etc/hostname", []byte("builder\n"), 0o644))
+	require.NoError(t, rootFS.WriteFile("etc/ssl/cert.pem", []byte("-----BEGIN CERTIFICATE-----"), 0o600))
+	require.NoError(t, rootFS.Link("etc/ssl/cert.pem", "etc/ssl/ca.pem"))
+	require.NoError(t, rootFS.Symlink("hostname", "etc/name"))
+	require.NoError(t, rootFS.Mknod("dev/null", fs.ModeDevice|fs.ModeCharDevice|0o666, 1, 3))
+	require.NoError(t, rootFS.SetOwner("etc/ssl/cert.pem", 0, 101))
+
+	var buf bytes.Buffer
+	require.NoError(t, rootFS.Save(&buf))
+
+	restored, err := memfs.Load(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	require.NoError(t, fstest.TestFS(restored, "etc/hostname", "etc/ssl/cert.pem", "etc/ssl/ca.pem", "dev/null"))
+
+	data, err := fs.ReadFile(restored, "etc/name")
+	require.NoError(t, err)
+	require.Equal(t, "builder\n", string(data))
+
+	target, err := restored.ReadLink("etc/name")
+	require.NoError(t, err)
+	require.Equal(t, "hostname", target)
+
+	fi, err := fs.Stat(restored, "etc/ssl/ca.pem")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode())
+
+	sys := fi.Sys().(*memfs.FileInfoSys)
+	require.Equal(t, 2, sys.Nlink)
+	require.Equal(t, 101, sys.Gid)
+
+	fi, err = fs.Stat(restored, "dev/null")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, fi.Mode())
+
+	major, minor := fi.Sys().(archivefs.Device).Device()
+	require.Equal(t, uint32(1), major)
+	require.Equal(t, uint32(3), minor)
+
+	_, err = memfs.Load(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	require.Error(t, err)
+
+	require.NoError(t, rootFS.Mount("mnt", fstest.MapFS{}))
+	require.Error(t, rootFS.Save(io.Discard))
+}
+
+func TestMemFSNewFromTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	writeEntry := func(hdr *tar.Header, data string) {
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	writeEntry(&tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}, "")
+	writeEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/ping", Mode: 0o755, Uid: 0, Gid: 0,
+		PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "\x01\x00\x00\x02"}}, "ping")
+	writeEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644}, "old")
+	writeEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "./etc/motd", Mode: 0o644, Uid: 1000, Gid: 1000}, "welcome")
+	writeEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/ping6", Linkname: "usr/bin/ping"}, "")
+	writeEntry(&tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin"}, "")
+	writeEntry(&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}, "")
+	require.NoError(t, tw.Close())
+
+	rootFS, err := memfs.NewFromTar(&buf)
+	require.NoError(t, err)
+
+	data, err := fs.ReadFile(rootFS, "etc/motd")
+	require.NoError(t, err)
+	require.Equal(t, "welcome", string(data))
+
+	data, err = fs.ReadFile(rootFS, "bin/ping6")
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+
+	fi, err := fs.Stat(rootFS, "usr/bin/ping")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o755), fi.Mode())
+
+	sys := fi.Sys().(*memfs.FileInfoSys)
+	require.Equal(t, 2, sys.Nlink)
+	require.Equal(t, map[string]string{"security.capability": "\x01\x00\x00\x02"}, sys.Xattrs)
+
+	fi, err = fs.Stat(rootFS, "etc/motd")
+	require.NoError(t, err)
+
+	uid, gid := fi.Sys().(archivefs.Owner).Owner()
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 1000, gid)
+
+	fi, err = fs.Stat(rootFS, "dev/null")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, fi.Mode())
+
+	// Extended attributes survive a save and load.
+	var saved bytes.Buffer
+	require.NoError(t, rootFS.Save(&saved))
+
+	restored, err := memfs.Load(&saved)
+	require.NoError(t, err)
+
+	fi, err = fs.Stat(restored, "usr/bin/ping")
+	require.NoError(t, err)
+	require.Equal(t, "\x01\x00\x00\x02", fi.Sys().(*memfs.FileInfoSys).Xattrs["security.capability"])
+}
+
+func TestMemFSMapFS(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	rootFS, err := memfs.FromMapFS(fstest.MapFS{
+		"etc":          {Mode: fs.ModeDir | 0o700, ModTime: modTime},
+		"etc/hostname": {Data: []byte("builder\n"), Mode: 0o644, ModTime: modTime, Sys: &memfs.FileInfoSys{Uid: 1000, Gid: 100}},
+		"usr/bin/sh":   {Data: []byte("#!"), Mode: 0o755},
+		"bin":          {Data: []byte("usr/bin"), Mode: fs.ModeSymlink | 0o777},
+		"dev/null":     {Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Sys: &memfs.FileInfoSys{Major: 1, Minor: 3}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, fstest.TestFS(rootFS, "etc/hostname", "usr/bin/sh", "dev/null"))
+
+	data, err := fs.ReadFile(rootFS, "bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, "#!", string(data))
+
+	fi, err := fs.Stat(rootFS, "etc")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDir|0o700, fi.Mode())
+	require.True(t, modTime.Equal(fi.ModTime()))
+
+	m, err := rootFS.ToMapFS()
+	require.NoError(t, err)
+
+	require.Equal(t, "builder\n", string(m["etc/hostname"].Data))
+	require.Equal(t, fs.FileMode(0o644), m["etc/hostname"].Mode)
+	require.True(t, modTime.Equal(m["etc/hostname"].ModTime))
+
+	uid, gid := m["etc/hostname"].Sys.(archivefs.Owner).Owner()
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 100, gid)
+
+	require.Equal(t, fs.ModeSymlink|0o777, m["bin"].Mode)
+	require.Equal(t, "usr/bin", string(m["bin"].Data))
+
+	major, minor := m["dev/null"].Sys.(archivefs.Device).Device()
+	require.Equal(t, uint32(1), major)
+	require.Equal(t, uint32(3), minor)
+}
+
+func TestMemFSRename(t *testing.T) {
+	rootFS := memfs.New()
+
+	require.NoError(t, rootFS.MkdirAll("a/b", 0o755))
+	require.NoError(t, rootFS.MkdirAll("c", 0o755))
+	require.NoError(t, rootFS.WriteFile("a/b/file", []byte("hello"), 0o644))
+	require.NoError(t, rootFS.WriteFile("c/other", []byte("other"), 0o644))
+
+	require.NoError(t, rootFS.Rename("a/b/file", "c/other"))
+
+	data, err := fs.ReadFile(rootFS, "c/other")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	_, err = fs.Stat(rootFS, "a/b/file")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, rootFS.Rename("a/b", "c/d"))
+
+	fi, err := fs.Stat(rootFS, "c/d")
+	require.NoError(t, err)
+	require.Equal(t, "d", fi.Name())
+
+	require.ErrorIs(t, rootFS.Rename("c", "c/d/e"), fs.ErrInvalid)
+	require.ErrorIs(t, rootFS.Rename("missing", "c/e"), fs.ErrNotExist)
+	require.ErrorIs(t, rootFS.Rename("c/other", "c/d"), fs.ErrExist)
+}
+
+func TestMemFSWriteFileAtomic(t *testing.T) {
+	rootFS := memfs.New()
+
+	contents := [][]byte{
+		bytes.Repeat([]byte("a"), 4096),
+		bytes.Repeat([]byte("b"), 8192),
+	}
+
+	require.NoError(t, rootFS.WriteFileAtomic("config", contents[0], 0o600))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, rootFS.WriteFileAtomic("config", contents[i%2], 0o600))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		data, err := fs.ReadFile(rootFS, "config")
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, contents[0]) || bytes.Equal(data, contents[1]))
+	}
+
+	wg.Wait()
+
+	entries, err := fs.ReadDir(rootFS, ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	fi, err := entries[0].Info()
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode())
+}
+
+func TestMemFSOverlay(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, src.MkdirAll("usr/share/doc", 0o755))
+	require.NoError(t, src.WriteFile("etc/hostname", []byte("alpha\n"), 0o600))
+	require.NoError(t, src.WriteFile("etc/motd", []byte("welcome\n"), 0o644))
+	require.NoError(t, src.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o644))
+	require.NoError(t, src.WriteFile("usr/share/doc/README", []byte("readme"), 0o644))
+	require.NoError(t, src.Symlink("usr/share", "share"))
+	require.NoError(t, src.SetOwner("etc/hostname", 1000, 1000))
+
+	var archive bytes.Buffer
+	require.NoError(t, tarfs.Create(&archive, src))
+
+	lower, err := tarfs.Open(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+
+	o := memfs.NewOverlay(lower, nil)
+
+	// Modify a file, preserving its mode and owner.
+	require.NoError(t, o.WriteFile("etc/hostname", []byte("beta\n"), 0o644))
+
+	// Create files and directories, including through a symbolic link.
+	require.NoError(t, o.MkdirAll("var/lib/app", 0o700))
+	require.NoError(t, o.WriteFile("var/lib/app/state", []byte("state"), 0o600))
+	require.NoError(t, o.WriteFile("share/doc/NEWS", []byte("news"), 0o644))
+	require.NoError(t, o.Symlink("hostname", "etc/name"))
+
+	// Delete a file, and replace a directory with an empty one.
+	require.NoError(t, o.Remove("etc/motd"))
+	require.NoError(t, o.RemoveAll("etc/ssl"))
+	require.NoError(t, o.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, o.RemoveAll("etc/missing"))
+
+	require.ErrorIs(t, o.Remove("usr/share"), fs.ErrExist)
+	require.ErrorIs(t, o.Remove("etc/motd"), fs.ErrNotExist)
+	require.ErrorIs(t, o.WriteFile("etc/.wh.hostname", nil, 0o644), fs.ErrInvalid)
+
+	expected := map[string]string{
+		"etc/hostname":         "beta\n",
+		"etc/name":             "beta\n",
+		"share/doc/NEWS":       "news",
+		"usr/share/doc/NEWS":   "news",
+		"usr/share/doc/README": "readme",
+		"var/lib/app/state":    "state",
+		"share/doc/README":     "readme",
+	}
+	for name, data := range expected {
+		actual, err := fs.ReadFile(o, name)
+		require.NoError(t, err, name)
+		require.Equal(t, data, string(actual), name)
+	}
+
+	for _, name := range []string{"etc/motd", "etc/ssl/cert.pem"} {
+		_, err := fs.Stat(o, name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+
+	entries, err := fs.ReadDir(o, "etc/ssl")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	fi, err := fs.Stat(o, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode())
+	uid, gid := fi.Sys().(archivefs.Owner).Owner()
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 1000, gid)
+
+	require.NoError(t, archivefstest.TestFS(o, "var/lib/app/state", "etc/hostname", "etc/name", "usr/share/doc/NEWS"))
+
+	// The lower filesystem is untouched.
+	data, err := fs.ReadFile(lower, "etc/motd")
+	require.NoError(t, err)
+	require.Equal(t, "welcome\n", string(data))
+
+	t.Run("Upper", func(t *testing.T) {
+		var names []string
+		require.NoError(t, fs.WalkDir(o.Upper(), ".", func(name string, d fs.DirEntry, err error) error {
+			names = append(names, name)
+			return err
+		}))
+
+		require.Equal(t, []string{
+			".", "etc", "etc/.wh.motd", "etc/hostname", "etc/name", "etc/ssl", "etc/ssl/.wh..wh..opq",
+			"usr", "usr/share", "usr/share/doc", "usr/share/doc/NEWS",
+			"var", "var/lib", "var/lib/app", "var/lib/app/state",
+		}, names)
+
+		// Applying the upper layer to the lower filesystem gives the same result.
+		applied := archivefs.Overlay(lower, o.Upper())
+		diffs, err := archivefs.Diff(o, applied, nil)
+		require.NoError(t, err)
+		require.Empty(t, diffs)
+	})
+
+	t.Run("Serialize", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, tarfs.Create(&buf, o))
+
+		tarFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		// New entries have no modification time, which tar can't represent.
+		diffs, err := archivefs.Diff(o, tarFS, &archivefs.DiffOptions{Compare: archivefs.DiffAll &^ archivefs.DiffModTime})
+		require.NoError(t, err)
+		require.Empty(t, diffs)
+	})
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	syspath "path"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// errReadOnly is returned when attempting to modify a mounted filesystem.
+var errReadOnly = fmt.Errorf("read-only file system: %w", fs.ErrPermission)
+
+// Mount grafts fsys into the filesystem at path, shadowing any existing
+// directory at that path. The mounted filesystem is read-only, attempts to
+// modify it will fail with fs.ErrPermission.
+func (rootFS *FS) Mount(path string, fsys fs.FS) error {
+	if !fs.ValidPath(path) || path == "." {
+		return &fs.PathError{Op: "mount", Path: path, Err: fs.ErrInvalid}
+	}
+
+	dirPart, filePart := syspath.Split(path)
+
+	parent, err := rootFS.getDir(strings.TrimSuffix(dirPart, "/"))
+	if err != nil {
+		return &fs.PathError{Op: "mount", Path: path, Err: err}
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	switch parent.children[filePart].(type) {
+	case nil:
+		if err := rootFS.quota.reserveFile(); err != nil {
+			return &fs.PathError{Op: "mount", Path: path, Err: err}
+		}
+	case *dir, *mounted:
+	default:
+		return &fs.PathError{Op: "mount", Path: path, Err: fmt.Errorf("not a directory: %w", fs.ErrInvalid)}
+	}
+
+	parent.children[filePart] = &mounted{
+		name: filePart,
+		fsys: fsys,
+		path: ".",
+	}
+
+	return nil
+}
+
+// mounted refers to a path within a mounted filesystem. The node stored in
+// the tree refers to the root of the mounted filesystem.
+type mounted struct {
+	name string
+	fsys fs.FS
+	path string
+}
+
+// resolve returns the node for the given path components beneath the mount.
+// If the path steps back out of the mount, nil is returned along with the
+// remaining components (relative to the directory containing the mount).
+func (m *mounted) resolve(parts []string) (child *mounted, rest []string) {
+	var inner []string
+	for len(parts) > 0 {
+		part := parts[0]
+
+		switch part {
+		case "", ".":
+		case "..":
+			if len(inner) == 0 {
+				return nil, parts[1:]
+			}
+			inner = inner[:len(inner)-1]
+		default:
+			inner = append(inner, part)
+		}
+
+		parts = parts[1:]
+	}
+
+	if len(inner) == 0 {
+		return m, nil
+	}
+
+	return &mounted{
+		name: inner[len(inner)-1],
+		fsys: m.fsys,
+		path: strings.Join(inner, "/"),
+	}, nil
+}
+
+func (m *mounted) open() (fs.File, error) {
+	f, err := m.fsys.Open(m.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.path == "." {
+		return &mountedRoot{File: f, name: m.name}, nil
+	}
+
+	return f, nil
+}
+
+func (m *mounted) stat(follow bool) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	var err error
+	if linkFS, ok := m.fsys.(archivefs.ReadLinkFS); ok && !follow {
+		fi, err = linkFS.StatLink(m.path)
+	} else {
+		fi, err = fs.Stat(m.fsys, m.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.path == "." {
+		return &mountedInfo{FileInfo: fi, name: m.name}, nil
+	}
+
+	return fi, nil
+}
+
+func (m *mounted) readLink() (string, error) {
+	linkFS, ok := m.fsys.(archivefs.ReadLinkFS)
+	if !ok || m.path == "." {
+		return "", fs.ErrInvalid
+	}
+
+	return linkFS.ReadLink(m.path)
+}
+
+// mountedRoot is the open root directory of a mounted filesystem, it reports
+// the name of the mount point rather than ".".
+type mountedRoot struct {
+	fs.File
+	name string
+}
+
+func (f *mountedRoot) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &mountedInfo{FileInfo: fi, name: f.name}, nil
+}
+
+func (f *mountedRoot) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("not a directory")
+	}
+
+	return dir.ReadDir(n)
+}
+
+type mountedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *mountedInfo) Name() string {
+	return fi.name
+}
@@ -0,0 +1,489 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	syspath "path"
+	"strings"
+	"sync"
+
+	"github.com/dpeckett/archivefs"
+)
+
+var (
+	_ fs.ReadDirFS         = (*Overlay)(nil)
+	_ fs.StatFS            = (*Overlay)(nil)
+	_ archivefs.ReadLinkFS = (*Overlay)(nil)
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Overlay is a writable, copy-on-write view of a read-only lower filesystem
+// (eg. an erofs image or tar archive). Changes are recorded in an in-memory
+// upper layer, files are copied up (with their metadata) before they are
+// modified, and deletions are recorded as OCI whiteouts, so the lower
+// filesystem is never modified. The merged result can be serialized as a new
+// archive, eg. with tarfs.Create.
+type Overlay struct {
+	lower  fs.FS
+	upper  *FS
+	merged fs.FS
+	// mu serializes modifications, as they span both layers.
+	mu sync.Mutex
+}
+
+// NewOverlay returns a writable overlay of lower. The upper layer is created
+// with the given options (eg. to limit the size of the changes).
+func NewOverlay(lower fs.FS, opts *Options) *Overlay {
+	upper := NewWithOptions(opts)
+
+	return &Overlay{
+		lower:  lower,
+		upper:  upper,
+		merged: archivefs.Overlay(lower, upper),
+	}
+}
+
+// Upper returns the upper layer, which contains only the changes made to the
+// lower filesystem (with deletions recorded as OCI whiteouts), eg. for
+// serializing as an OCI image layer. It must not be modified directly.
+func (o *Overlay) Upper() *FS {
+	return o.upper
+}
+
+func (o *Overlay) Open(name string) (fs.File, error) {
+	return o.merged.Open(name)
+}
+
+func (o *Overlay) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(o.merged, name)
+}
+
+func (o *Overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(o.merged, name)
+}
+
+func (o *Overlay) ReadLink(name string) (string, error) {
+	return o.merged.(archivefs.ReadLinkFS).ReadLink(name)
+}
+
+func (o *Overlay) StatLink(name string) (fs.FileInfo, error) {
+	return o.merged.(archivefs.ReadLinkFS).StatLink(name)
+}
+
+// WriteFile writes data to the named file, creating it with permissions perm
+// if necessary. Existing files in the lower filesystem are copied up first,
+// so that their permissions and ownership are preserved.
+func (o *Overlay) WriteFile(name string, data []byte, perm os.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	realName, err := o.prepare("writefile", name, true)
+	if err != nil {
+		return err
+	}
+
+	if err := o.copyUp(realName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "writefile", Path: name, Err: err}
+	}
+
+	if _, err := o.clearWhiteout(realName); err != nil {
+		return &fs.PathError{Op: "writefile", Path: name, Err: err}
+	}
+
+	if err := o.upper.WriteFile(realName, data, perm); err != nil {
+		return &fs.PathError{Op: "writefile", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// MkdirAll creates the named directory, along with any necessary parents.
+// The permission bits perm are used for all directories that are created.
+func (o *Overlay) MkdirAll(name string, perm os.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		if parts[i] == "." {
+			continue
+		}
+
+		dir := strings.Join(parts[:i+1], "/")
+
+		fi, err := fs.Stat(o.merged, dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: fmt.Errorf("not a directory: %s: %w", dir, fs.ErrInvalid)}
+			}
+			continue
+		}
+
+		realName, err := o.prepare("mkdir", dir, false)
+		if err != nil {
+			return err
+		}
+
+		opaque, err := o.clearWhiteout(realName)
+		if err != nil {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+
+		if err := o.upper.insert(realName, newDir(syspath.Base(realName), nodeMeta{mode: fs.ModeDir | perm}), false); err != nil {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+
+		// Hide the contents of a deleted directory in the lower filesystem.
+		if opaque {
+			if err := o.upper.WriteFile(syspath.Join(realName, whiteoutOpaque), nil, 0); err != nil {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (o *Overlay) Symlink(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	realName, err := o.prepare("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+
+	if _, err := o.StatLink(realName); err == nil {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrExist}
+	}
+
+	if _, err := o.clearWhiteout(realName); err != nil {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: err}
+	}
+
+	if err := o.upper.Symlink(oldname, realName); err != nil {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: err}
+	}
+
+	return nil
+}
+
+// SetOwner changes the numeric uid and gid of the named file, following
+// symbolic links.
+func (o *Overlay) SetOwner(name string, uid, gid int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	realName, err := o.prepare("chown", name, true)
+	if err != nil {
+		return err
+	}
+
+	if err := o.copyUp(realName); err != nil {
+		return &fs.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	return o.upper.SetOwner(realName, uid, gid)
+}
+
+// SetXattr sets an extended attribute of the named file, following symbolic
+// links.
+func (o *Overlay) SetXattr(name, attr, value string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	realName, err := o.prepare("setxattr", name, true)
+	if err != nil {
+		return err
+	}
+
+	if err := o.copyUp(realName); err != nil {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+
+	return o.upper.SetXattr(realName, attr, value)
+}
+
+// Remove removes the named file or empty directory.
+func (o *Overlay) Remove(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.remove("remove", name, false)
+}
+
+// RemoveAll removes the named file or directory, and any children it
+// contains. It returns nil if the file doesn't exist.
+func (o *Overlay) RemoveAll(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.remove("removeall", name, true)
+}
+
+func (o *Overlay) remove(op, name string, all bool) error {
+	realName, err := o.prepare(op, name, false)
+	if err != nil {
+		return err
+	}
+
+	fi, err := o.StatLink(realName)
+	if err != nil {
+		if all && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	if fi.IsDir() && !all {
+		entries, err := fs.ReadDir(o.merged, realName)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("directory not empty: %w", fs.ErrExist)}
+		}
+	}
+
+	if err := o.removeUpper(realName); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// Entries that are still visible are from the lower filesystem.
+	if _, err := o.StatLink(realName); err == nil {
+		whiteout := syspath.Join(syspath.Dir(realName), whiteoutPrefix+syspath.Base(realName))
+		if err := o.upper.WriteFile(whiteout, nil, 0); err != nil {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// prepare validates a name to be modified, and returns it with any symbolic
+// links resolved (the final component only if follow is set). The parent
+// directory is copied up, so that it exists in the upper layer.
+func (o *Overlay) prepare(op, name string, follow bool) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	realName, err := o.resolve(name, follow)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	if realName == "." || strings.HasPrefix(syspath.Base(realName), whiteoutPrefix) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if err := o.copyUpDir(syspath.Dir(realName)); err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return realName, nil
+}
+
+// resolve returns the path of the named file with any symbolic links in the
+// merged filesystem resolved. The final component is only followed if follow
+// is true, and need not exist.
+func (o *Overlay) resolve(name string, follow bool) (string, error) {
+	parts := strings.Split(name, "/")
+
+	var resolved []string
+	var hops int
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		current := strings.Join(append(resolved, part), "/")
+
+		if len(parts) == 0 && !follow {
+			resolved = append(resolved, part)
+			break
+		}
+
+		fi, err := o.StatLink(current)
+		if err != nil {
+			if len(parts) == 0 && errors.Is(err, fs.ErrNotExist) {
+				resolved = append(resolved, part)
+				break
+			}
+
+			return "", err
+		}
+
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		hops++
+		if hops > archivefs.MaxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links: %s: %w", name, fs.ErrInvalid)
+		}
+
+		target, err := o.ReadLink(current)
+		if err != nil {
+			return "", err
+		}
+
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	if len(resolved) == 0 {
+		return ".", nil
+	}
+
+	return strings.Join(resolved, "/"), nil
+}
+
+// copyUpDir copies the named directory (and its parents) from the merged
+// filesystem into the upper layer, if they aren't already there. The name
+// must not contain any symbolic links.
+func (o *Overlay) copyUpDir(name string) error {
+	if name == "." {
+		return nil
+	}
+
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		if err := o.copyUp(strings.Join(parts[:i+1], "/")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyUp copies the named file (not following symbolic links) from the
+// merged filesystem into the upper layer, if it isn't already there. Its
+// parent directory must already have been copied up.
+func (o *Overlay) copyUp(name string) error {
+	if name == "." {
+		return nil
+	}
+
+	if _, err := o.upper.lstat("copyup", name); err == nil {
+		return nil
+	}
+
+	fi, err := o.StatLink(name)
+	if err != nil {
+		return err
+	}
+
+	e, err := archivefs.NewEntry(o.merged, name, fi)
+	if err != nil {
+		return err
+	}
+
+	meta := nodeMeta{
+		mode:    e.Mode,
+		modTime: e.ModTime,
+		uid:     e.Uid,
+		gid:     e.Gid,
+		xattrs:  e.Xattrs,
+	}
+
+	var child childI
+	switch e.Mode.Type() {
+	case fs.ModeDir:
+		child = newDir(syspath.Base(name), meta)
+	case fs.ModeSymlink:
+		child = newSymlink(syspath.Base(name), e.Linkname, meta)
+	case 0:
+		data, err := fs.ReadFile(o.merged, name)
+		if err != nil {
+			return err
+		}
+
+		if child, err = o.upper.newFile(data, meta); err != nil {
+			return err
+		}
+	default:
+		child = newSpecial(syspath.Base(name), e.Major, e.Minor, meta)
+	}
+
+	return o.upper.insert(name, child, false)
+}
+
+// clearWhiteout removes any whiteout of the named file from the upper layer,
+// and reports whether there was one.
+func (o *Overlay) clearWhiteout(name string) (bool, error) {
+	whiteout := syspath.Join(syspath.Dir(name), whiteoutPrefix+syspath.Base(name))
+
+	if err := o.upper.remove(whiteout); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// removeUpper removes the named file, and any children, from the upper
+// layer.
+func (o *Overlay) removeUpper(name string) error {
+	fi, err := o.upper.StatLink(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	if fi.IsDir() {
+		entries, err := o.upper.ReadDir(name)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := o.removeUpper(syspath.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return o.upper.remove(name)
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"io/fs"
+
+	"github.com/dpeckett/archivefs"
+)
+
+var (
+	_ archivefs.Owner              = (*FileInfoSys)(nil)
+	_ archivefs.ExtendedAttributes = (*FileInfoSys)(nil)
+	_ archivefs.FileID             = (*FileInfoSys)(nil)
+)
+
+// FileInfoSys is returned by the Sys() method of the FileInfo for entries in
+// the filesystem.
+type FileInfoSys struct {
+	// Ino uniquely identifies the underlying file, hard links to the same
+	// file share the same inode number. It is zero for directories, symbolic
+	// links, and special files.
+	Ino uint64
+	// Nlink is the number of hard links to the file.
+	Nlink int
+	// Uid is the numeric user ID of the owner.
+	Uid int
+	// Gid is the numeric group ID of the owner.
+	Gid int
+	// Major is the major device number of a device file.
+	Major uint32
+	// Minor is the minor device number of a device file.
+	Minor uint32
+	// Xattrs holds the extended attributes of the file.
+	Xattrs map[string]string
+}
+
+// Owner returns the numeric user and group IDs of the owner.
+func (sys *FileInfoSys) Owner() (uid, gid int) {
+	return sys.Uid, sys.Gid
+}
+
+// FileID returns the inode number and link count of the file.
+func (sys *FileInfoSys) FileID() (id uint64, nlink int) {
+	return sys.Ino, sys.Nlink
+}
+
+// ExtendedAttributes returns the extended attributes of the file.
+func (sys *FileInfoSys) ExtendedAttributes() map[string]string {
+	return sys.Xattrs
+}
+
+// Device returns the major and minor device numbers.
+func (sys *FileInfoSys) Device() (major, minor uint32) {
+	return sys.Major, sys.Minor
+}
+
+// SetOwner changes the numeric uid and gid of the named file, following
+// symbolic links.
+func (rootFS *FS) SetOwner(name string, uid, gid int) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chown", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		// root dir
+		name = ""
+	}
+
+	child, err := rootFS.lookup(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	switch c := child.(type) {
+	case *file:
+		c.mu.Lock()
+		c.uid, c.gid = uid, gid
+		c.mu.Unlock()
+	case *dir:
+		c.mu.Lock()
+		c.uid, c.gid = uid, gid
+		c.mu.Unlock()
+	case *special:
+		c.uid, c.gid = uid, gid
+	case *mounted:
+		return &fs.PathError{Op: "chown", Path: name, Err: errReadOnly}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// ErrNoSpace is returned when a write would exceed the filesystem's quota,
+// it wraps syscall.ENOSPC.
+var ErrNoSpace = fmt.Errorf("quota exceeded: %w", syscall.ENOSPC)
+
+// quota tracks the resources used by a filesystem.
+type quota struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxFiles int
+	bytes    int64
+	files    int
+}
+
+// reserveBytes adjusts the total size of file contents by delta, which may be
+// negative when a file shrinks.
+func (q *quota) reserveBytes(delta int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if delta > 0 && q.maxBytes > 0 && q.bytes+delta > q.maxBytes {
+		return fmt.Errorf("exceeded quota of %d bytes: %w", q.maxBytes, ErrNoSpace)
+	}
+	q.bytes += delta
+
+	return nil
+}
+
+// reserveFile accounts for a new file, directory, or symbolic link.
+func (q *quota) reserveFile() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxFiles > 0 && q.files+1 > q.maxFiles {
+		return fmt.Errorf("exceeded quota of %d files: %w", q.maxFiles, ErrNoSpace)
+	}
+	q.files++
+
+	return nil
+}
+
+// releaseFile accounts for a removed file, directory, or symbolic link.
+func (q *quota) releaseFile() {
+	q.mu.Lock()
+	q.files--
+	q.mu.Unlock()
+}
@@ -0,0 +1,231 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	syspath "path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// tempCounter is used to generate unique names for temporary files.
+var tempCounter atomic.Uint64
+
+// Rename renames (moves) oldname to newname. If newname already exists and
+// is not a directory, Rename replaces it. An existing directory can only be
+// replaced by a directory, and only if it is empty. Renames within a single
+// directory are atomic.
+func (rootFS *FS) Rename(oldname, newname string) error {
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) || oldname == "." || newname == "." {
+		return linkErr(fs.ErrInvalid)
+	}
+
+	if oldname == newname {
+		return nil
+	}
+
+	if strings.HasPrefix(newname, oldname+"/") {
+		return linkErr(fmt.Errorf("cannot move a directory into itself: %w", fs.ErrInvalid))
+	}
+
+	oldDirPart, oldFilePart := syspath.Split(oldname)
+	newDirPart, newFilePart := syspath.Split(newname)
+
+	oldParent, err := rootFS.getDir(strings.TrimSuffix(oldDirPart, "/"))
+	if err != nil {
+		return linkErr(err)
+	}
+
+	newParent, err := rootFS.getDir(strings.TrimSuffix(newDirPart, "/"))
+	if err != nil {
+		return linkErr(err)
+	}
+
+	if oldParent == newParent {
+		oldParent.mu.Lock()
+		defer oldParent.mu.Unlock()
+
+		child := oldParent.children[oldFilePart]
+		if child == nil {
+			return linkErr(fs.ErrNotExist)
+		}
+
+		if err := rootFS.replace(oldParent, newFilePart, child); err != nil {
+			return linkErr(err)
+		}
+		delete(oldParent.children, oldFilePart)
+
+		return nil
+	}
+
+	// Only one directory is locked at a time, so renames between directories
+	// are not atomic.
+	oldParent.mu.Lock()
+	child := oldParent.children[oldFilePart]
+	delete(oldParent.children, oldFilePart)
+	oldParent.mu.Unlock()
+
+	if child == nil {
+		return linkErr(fs.ErrNotExist)
+	}
+
+	newParent.mu.Lock()
+	err = rootFS.replace(newParent, newFilePart, child)
+	newParent.mu.Unlock()
+
+	if err != nil {
+		// Put the node back where it came from.
+		oldParent.mu.Lock()
+		if oldParent.children[oldFilePart] == nil {
+			oldParent.children[oldFilePart] = child
+		}
+		oldParent.mu.Unlock()
+
+		return linkErr(err)
+	}
+
+	return nil
+}
+
+// replace stores child in the directory under name, replacing any existing
+// node. The directory must be locked.
+func (rootFS *FS) replace(parent *dir, name string, child childI) error {
+	existing := parent.children[name]
+	if existing == child {
+		return nil
+	}
+
+	if existing != nil {
+		_, childIsDir := child.(*dir)
+
+		switch e := existing.(type) {
+		case *dir:
+			if !childIsDir {
+				return fmt.Errorf("is a directory: %w", fs.ErrExist)
+			}
+
+			e.mu.Lock()
+			empty := len(e.children) == 0
+			e.mu.Unlock()
+
+			if !empty {
+				return fmt.Errorf("directory not empty: %w", fs.ErrExist)
+			}
+		case *mounted:
+			return errReadOnly
+		default:
+			if childIsDir {
+				return fmt.Errorf("not a directory: %w", fs.ErrExist)
+			}
+
+			if f, ok := e.(*file); ok {
+				rootFS.unlink(f)
+			}
+		}
+
+		rootFS.quota.releaseFile()
+	}
+
+	parent.children[name] = renamed(child, name)
+
+	return nil
+}
+
+// renamed returns the node with its name changed. Nodes that may be shared
+// with clones of the filesystem are copied rather than modified.
+func renamed(child childI, name string) childI {
+	switch c := child.(type) {
+	case *dir:
+		c.mu.Lock()
+		c.name = name
+		c.mu.Unlock()
+	case *symlink:
+		link := *c
+		link.name = name
+		return &link
+	case *special:
+		node := *c
+		node.name = name
+		return &node
+	case *mounted:
+		m := *c
+		m.name = name
+		return &m
+	}
+
+	return child
+}
+
+// WriteFileAtomic writes data to the named file, replacing it atomically.
+// The data is written to a hidden temporary file which is then renamed into
+// place, so concurrent readers observe either the old or new contents, never
+// a partially written file. If the file does not exist it is created with
+// permissions perm, otherwise its permissions are replaced with perm.
+func (rootFS *FS) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	dirPart, filePart := syspath.Split(name)
+	tempName := dirPart + "." + filePart + ".tmp" + strconv.FormatUint(tempCounter.Add(1), 10)
+
+	if err := rootFS.WriteFile(tempName, data, perm); err != nil {
+		_ = rootFS.remove(tempName)
+		return err
+	}
+
+	if err := rootFS.Rename(tempName, name); err != nil {
+		_ = rootFS.remove(tempName)
+		return err
+	}
+
+	return nil
+}
+
+// remove deletes the named file or empty directory.
+func (rootFS *FS) remove(name string) error {
+	dirPart, filePart := syspath.Split(name)
+
+	parent, err := rootFS.getDir(strings.TrimSuffix(dirPart, "/"))
+	if err != nil {
+		return err
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	switch c := parent.children[filePart].(type) {
+	case nil:
+		return fs.ErrNotExist
+	case *dir:
+		c.mu.Lock()
+		empty := len(c.children) == 0
+		c.mu.Unlock()
+
+		if !empty {
+			return fmt.Errorf("directory not empty: %w", fs.ErrExist)
+		}
+	case *file:
+		rootFS.unlink(c)
+	}
+
+	delete(parent.children, filePart)
+	rootFS.quota.releaseFile()
+
+	return nil
+}
@@ -0,0 +1,370 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	syspath "path"
+	"slices"
+	"time"
+)
+
+// saveMagic identifies a serialized filesystem.
+const saveMagic = "MEMFS\x00\x00\x01"
+
+// Record types used in the serialized form.
+const (
+	recordEnd byte = iota
+	recordDir
+	recordFile
+	recordLink
+	recordSymlink
+	recordSpecial
+)
+
+// Save writes a binary encoding of the filesystem, including its contents
+// and metadata, to w. The filesystem can be restored with Load. Mounted
+// filesystems cannot be saved.
+func (rootFS *FS) Save(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	e.writeString(saveMagic)
+
+	rootFS.quota.mu.Lock()
+	e.writeVarint(rootFS.quota.maxBytes)
+	e.writeVarint(int64(rootFS.quota.maxFiles))
+	rootFS.quota.mu.Unlock()
+	e.writeBool(rootFS.blobs != nil)
+
+	if err := saveDir(e, "", rootFS.dir, map[*file]string{}); err != nil {
+		return err
+	}
+
+	e.writeByte(recordEnd)
+
+	if e.err != nil {
+		return e.err
+	}
+
+	return e.w.Flush()
+}
+
+func saveDir(e *encoder, path string, d *dir, files map[*file]string) error {
+	d.mu.Lock()
+	e.writeByte(recordDir)
+	e.writeString(path)
+	e.writeMeta(nodeMeta{mode: d.perm, modTime: d.modTime, uid: d.uid, gid: d.gid, xattrs: d.xattrs})
+
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	children := make([]childI, len(names))
+	for i, name := range names {
+		children[i] = d.children[name]
+	}
+	d.mu.Unlock()
+
+	for i, child := range children {
+		path := syspath.Join(path, names[i])
+
+		switch c := child.(type) {
+		case *dir:
+			if err := saveDir(e, path, c, files); err != nil {
+				return err
+			}
+		case *file:
+			if target, ok := files[c]; ok {
+				e.writeByte(recordLink)
+				e.writeString(path)
+				e.writeString(target)
+				continue
+			}
+			files[c] = path
+
+			c.mu.Lock()
+			e.writeByte(recordFile)
+			e.writeString(path)
+			e.writeMeta(nodeMeta{mode: c.perm, modTime: c.modTime, uid: c.uid, gid: c.gid, xattrs: c.xattrs})
+			e.writeBytes(c.data)
+			c.mu.Unlock()
+		case *symlink:
+			e.writeByte(recordSymlink)
+			e.writeString(path)
+			e.writeMeta(nodeMeta{modTime: c.modTime, uid: c.uid, gid: c.gid, xattrs: c.xattrs})
+			e.writeString(c.target)
+		case *special:
+			e.writeByte(recordSpecial)
+			e.writeString(path)
+			e.writeMeta(nodeMeta{mode: c.mode, modTime: c.modTime, uid: c.uid, gid: c.gid, xattrs: c.xattrs})
+			e.writeUvarint(uint64(c.major))
+			e.writeUvarint(uint64(c.minor))
+		case *mounted:
+			return fmt.Errorf("cannot save mounted filesystem: %s", path)
+		}
+
+		if e.err != nil {
+			return e.err
+		}
+	}
+
+	return e.err
+}
+
+// Load restores a filesystem previously written by Save.
+func Load(r io.Reader) (*FS, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+
+	if magic := d.readString(); d.err == nil && magic != saveMagic {
+		return nil, errors.New("invalid memfs header")
+	}
+
+	opts := &Options{
+		MaxBytes: d.readVarint(),
+		MaxFiles: int(d.readVarint()),
+		Dedup:    d.readBool(),
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("failed to read memfs header: %w", d.err)
+	}
+
+	rootFS := NewWithOptions(opts)
+
+	for {
+		typ := d.readByte()
+		if typ == recordEnd && d.err == nil {
+			return rootFS, nil
+		}
+
+		path := d.readString()
+
+		var meta nodeMeta
+		if typ != recordLink {
+			meta = d.readMeta()
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("failed to read record: %w", d.err)
+		}
+
+		if err := rootFS.loadRecord(d, typ, path, meta); err != nil {
+			return nil, fmt.Errorf("failed to load %q: %w", path, err)
+		}
+	}
+}
+
+func (rootFS *FS) loadRecord(d *decoder, typ byte, path string, meta nodeMeta) error {
+	if path == "" && typ == recordDir {
+		rootFS.dir.setMeta(meta)
+		return nil
+	}
+
+	var child childI
+	switch typ {
+	case recordDir:
+		child = newDir(syspath.Base(path), meta)
+	case recordFile:
+		data := d.readBytes()
+		if d.err != nil {
+			return d.err
+		}
+
+		node, err := rootFS.newFile(data, meta)
+		if err != nil {
+			return err
+		}
+		child = node
+	case recordLink:
+		target := d.readString()
+		if d.err != nil {
+			return d.err
+		}
+		return rootFS.Link(target, path)
+	case recordSymlink:
+		target := d.readString()
+		if d.err != nil {
+			return d.err
+		}
+		child = newSymlink(syspath.Base(path), target, meta)
+	case recordSpecial:
+		major, minor := d.readUvarint(), d.readUvarint()
+		if d.err != nil {
+			return d.err
+		}
+		child = newSpecial(syspath.Base(path), uint32(major), uint32(minor), meta)
+	default:
+		return fmt.Errorf("unknown record type %d", typ)
+	}
+
+	return rootFS.insert(path, child, false)
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *encoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *encoder) writeBool(b bool) {
+	if b {
+		e.writeByte(1)
+	} else {
+		e.writeByte(0)
+	}
+}
+
+func (e *encoder) writeUvarint(v uint64) {
+	e.write(binary.AppendUvarint(e.buf[:0], v))
+}
+
+func (e *encoder) writeVarint(v int64) {
+	e.write(binary.AppendVarint(e.buf[:0], v))
+}
+
+func (e *encoder) writeBytes(p []byte) {
+	e.writeUvarint(uint64(len(p)))
+	e.write(p)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeBytes([]byte(s))
+}
+
+func (e *encoder) writeMeta(meta nodeMeta) {
+	e.writeUvarint(uint64(meta.mode))
+	if meta.modTime.IsZero() {
+		e.writeBool(false)
+	} else {
+		e.writeBool(true)
+		e.writeVarint(meta.modTime.UnixNano())
+	}
+	e.writeVarint(int64(meta.uid))
+	e.writeVarint(int64(meta.gid))
+
+	attrs := make([]string, 0, len(meta.xattrs))
+	for attr := range meta.xattrs {
+		attrs = append(attrs, attr)
+	}
+	slices.Sort(attrs)
+
+	e.writeUvarint(uint64(len(attrs)))
+	for _, attr := range attrs {
+		e.writeString(attr)
+		e.writeString(meta.xattrs[attr])
+	}
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+
+	var b byte
+	b, d.err = d.r.ReadByte()
+	if errors.Is(d.err, io.EOF) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	return b
+}
+
+func (d *decoder) readBool() bool {
+	return d.readByte() != 0
+}
+
+func (d *decoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	var v uint64
+	v, d.err = binary.ReadUvarint(d.r)
+	if errors.Is(d.err, io.EOF) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	return v
+}
+
+func (d *decoder) readVarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	var v int64
+	v, d.err = binary.ReadVarint(d.r)
+	if errors.Is(d.err, io.EOF) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	return v
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readUvarint()
+	if d.err != nil {
+		return nil
+	}
+
+	// Copy incrementally so a corrupt length can't trigger a huge allocation.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(min(n, 1<<62))); err != nil {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+func (d *decoder) readMeta() (meta nodeMeta) {
+	meta.mode = fs.FileMode(d.readUvarint())
+	if d.readBool() {
+		meta.modTime = time.Unix(0, d.readVarint())
+	}
+	meta.uid = int(d.readVarint())
+	meta.gid = int(d.readVarint())
+
+	n := d.readUvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		if meta.xattrs == nil {
+			meta.xattrs = make(map[string]string)
+		}
+		attr := d.readString()
+		meta.xattrs[attr] = d.readString()
+	}
+
+	return
+}
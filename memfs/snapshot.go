@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"io/fs"
+	"maps"
+
+	"github.com/dpeckett/archivefs"
+)
+
+var (
+	_ fs.ReadDirFS         = (*readOnlyFS)(nil)
+	_ fs.StatFS            = (*readOnlyFS)(nil)
+	_ archivefs.ReadLinkFS = (*readOnlyFS)(nil)
+)
+
+// Clone returns a writable copy of the filesystem. File contents are shared
+// between the filesystems until they are modified (copy-on-write), so cloning
+// is cheap regardless of the amount of data stored.
+func (rootFS *FS) Clone() *FS {
+	rootFS.quota.mu.Lock()
+	q := &quota{
+		maxBytes: rootFS.quota.maxBytes,
+		maxFiles: rootFS.quota.maxFiles,
+		bytes:    rootFS.quota.bytes,
+		files:    rootFS.quota.files,
+	}
+	rootFS.quota.mu.Unlock()
+
+	return &FS{
+		dir:   cloneDir(rootFS.dir, map[*file]*file{}),
+		quota: q,
+		blobs: rootFS.blobs,
+	}
+}
+
+// Snapshot returns an immutable view of the current state of the filesystem.
+// Subsequent changes to the filesystem are not visible in the snapshot.
+func (rootFS *FS) Snapshot() fs.FS {
+	return &readOnlyFS{fsys: rootFS.Clone()}
+}
+
+// cloneDir copies a directory tree, files that are hard linked are cloned
+// only once so the links are preserved.
+func cloneDir(d *dir, files map[*file]*file) *dir {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	clone := &dir{
+		name:     d.name,
+		perm:     d.perm,
+		modTime:  d.modTime,
+		uid:      d.uid,
+		gid:      d.gid,
+		xattrs:   maps.Clone(d.xattrs),
+		children: make(map[string]childI, len(d.children)),
+	}
+
+	for name, child := range d.children {
+		switch c := child.(type) {
+		case *dir:
+			clone.children[name] = cloneDir(c, files)
+		case *file:
+			if _, ok := files[c]; !ok {
+				files[c] = c.clone()
+			}
+			clone.children[name] = files[c]
+		case *symlink:
+			link := *c
+			link.xattrs = maps.Clone(c.xattrs)
+			clone.children[name] = &link
+		case *special:
+			node := *c
+			node.xattrs = maps.Clone(c.xattrs)
+			clone.children[name] = &node
+		case *mounted:
+			// Mounted filesystems are read-only, so can be shared.
+			clone.children[name] = c
+		}
+	}
+
+	return clone
+}
+
+// clone returns a copy of the file that shares its contents.
+func (f *file) clone() *file {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Both files must copy the contents before modifying them.
+	f.shared = true
+	if f.blob != nil {
+		f.blob.acquire()
+	}
+
+	return &file{
+		ino:     f.ino,
+		perm:    f.perm,
+		data:    f.data,
+		shared:  true,
+		blob:    f.blob,
+		modTime: f.modTime,
+		uid:     f.uid,
+		gid:     f.gid,
+		xattrs:  maps.Clone(f.xattrs),
+		nlink:   f.nlink,
+	}
+}
+
+// unshare makes a private copy of the file contents, if they are shared with
+// a clone or another file. The file must be locked.
+func (f *file) unshare() {
+	if f.shared {
+		f.data = append([]byte(nil), f.data...)
+		f.shared = false
+	}
+
+	if f.blob != nil {
+		f.blob.release()
+		f.blob = nil
+	}
+}
+
+// readOnlyFS is a read-only view of a filesystem.
+type readOnlyFS struct {
+	fsys *FS
+}
+
+func (ro *readOnlyFS) Open(name string) (fs.File, error) {
+	return ro.fsys.Open(name)
+}
+
+func (ro *readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return ro.fsys.Stat(name)
+}
+
+func (ro *readOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return ro.fsys.ReadDir(name)
+}
+
+func (ro *readOnlyFS) ReadLink(name string) (string, error) {
+	return ro.fsys.ReadLink(name)
+}
+
+func (ro *readOnlyFS) StatLink(name string) (fs.FileInfo, error) {
+	return ro.fsys.StatLink(name)
+}
+
+func (ro *readOnlyFS) Sub(dir string) (fs.FS, error) {
+	sub, err := ro.fsys.Sub(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mounted filesystems are already read-only.
+	if sub, ok := sub.(*FS); ok {
+		return &readOnlyFS{fsys: sub}, nil
+	}
+
+	return sub, nil
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	syspath "path"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+)
+
+var _ archivefs.Device = (*FileInfoSys)(nil)
+
+// special is a device, named pipe, or socket node. Special nodes only carry
+// metadata, they have no contents.
+type special struct {
+	name    string
+	mode    fs.FileMode
+	major   uint32
+	minor   uint32
+	modTime time.Time
+	uid     int
+	gid     int
+	xattrs  map[string]string
+}
+
+func newSpecial(name string, major, minor uint32, meta nodeMeta) *special {
+	return &special{
+		name:    name,
+		mode:    meta.mode,
+		major:   major,
+		minor:   minor,
+		modTime: meta.modTime,
+		uid:     meta.uid,
+		gid:     meta.gid,
+		xattrs:  meta.xattrs,
+	}
+}
+
+// Mknod creates a special file. The type bits of mode must describe a block
+// device (fs.ModeDevice), a character device (fs.ModeDevice|fs.ModeCharDevice),
+// a named pipe, or a socket. The major and minor numbers are only meaningful
+// for devices.
+func (rootFS *FS) Mknod(name string, mode fs.FileMode, major, minor uint32) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "mknod", Path: name, Err: fs.ErrInvalid}
+	}
+
+	switch mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+	case fs.ModeNamedPipe, fs.ModeSocket:
+		major, minor = 0, 0
+	default:
+		return &fs.PathError{Op: "mknod", Path: name, Err: fmt.Errorf("unsupported file type %v: %w", mode.Type(), fs.ErrInvalid)}
+	}
+
+	dirPart, filePart := syspath.Split(name)
+
+	dir, err := rootFS.getDir(strings.TrimSuffix(dirPart, "/"))
+	if err != nil {
+		return &fs.PathError{Op: "mknod", Path: name, Err: err}
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if dir.children[filePart] != nil {
+		return &fs.PathError{Op: "mknod", Path: name, Err: fs.ErrExist}
+	}
+
+	if err := rootFS.quota.reserveFile(); err != nil {
+		return &fs.PathError{Op: "mknod", Path: name, Err: err}
+	}
+
+	dir.children[filePart] = &special{
+		name:  filePart,
+		mode:  mode & (fs.ModeType | fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		major: major,
+		minor: minor,
+	}
+
+	return nil
+}
+
+// fhSpecial is an open special file. Reading from it always returns io.EOF.
+type fhSpecial struct {
+	info fs.FileInfo
+}
+
+func (f *fhSpecial) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fhSpecial) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *fhSpecial) Close() error {
+	return nil
+}
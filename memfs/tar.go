@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	syspath "path"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// NewFromTar creates a new in-memory filesystem holding the contents of a tar
+// archive. Symbolic links, hard links, special files, ownership, and extended
+// attributes are preserved. Later entries replace earlier entries with the
+// same name, as they would when extracting the archive.
+func NewFromTar(r io.Reader) (*FS, error) {
+	rootFS := New()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		if err := rootFS.addTarEntry(tr, hdr); err != nil {
+			return nil, fmt.Errorf("failed to add %q: %w", hdr.Name, err)
+		}
+	}
+
+	return rootFS, nil
+}
+
+func (rootFS *FS) addTarEntry(tr *tar.Reader, hdr *tar.Header) error {
+	fi := hdr.FileInfo()
+
+	meta := nodeMeta{
+		mode:    fi.Mode(),
+		modTime: hdr.ModTime,
+		uid:     hdr.Uid,
+		gid:     hdr.Gid,
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if attr, ok := strings.CutPrefix(key, archivefs.PAXXattrPrefix); ok {
+			if meta.xattrs == nil {
+				meta.xattrs = make(map[string]string)
+			}
+			meta.xattrs[attr] = value
+		}
+	}
+
+	name := archivefs.CleanPath(hdr.Name)
+	if name == "" {
+		if hdr.Typeflag == tar.TypeDir {
+			rootFS.dir.setMeta(meta)
+		}
+		return nil
+	}
+
+	if dirPart := syspath.Dir(name); dirPart != "." {
+		if err := rootFS.MkdirAll(dirPart, 0o755); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		existing, err := rootFS.lookup(name, false)
+		if err == nil {
+			if d, ok := existing.(*dir); ok {
+				d.setMeta(meta)
+				return nil
+			}
+		}
+
+		return rootFS.insert(name, newDir(syspath.Base(name), meta), true)
+
+	case tar.TypeReg, tar.TypeRegA:
+		// Copy incrementally so a bogus size can't trigger a huge allocation.
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return err
+		}
+
+		node, err := rootFS.newFile(buf.Bytes(), meta)
+		if err != nil {
+			return err
+		}
+
+		return rootFS.insert(name, node, true)
+
+	case tar.TypeLink:
+		target, err := rootFS.lookup(archivefs.CleanPath(hdr.Linkname), false)
+		if err != nil {
+			return err
+		}
+
+		node, ok := target.(*file)
+		if !ok {
+			return fmt.Errorf("hard link target is not a regular file: %s: %w", hdr.Linkname, fs.ErrInvalid)
+		}
+
+		if existing, err := rootFS.lookup(name, false); err == nil && existing == childI(node) {
+			// Already linked.
+			return nil
+		}
+
+		node.mu.Lock()
+		node.nlink++
+		node.mu.Unlock()
+
+		if err := rootFS.insert(name, node, true); err != nil {
+			rootFS.unlink(node)
+			return err
+		}
+
+		return nil
+
+	case tar.TypeSymlink:
+		return rootFS.insert(name, newSymlink(syspath.Base(name), hdr.Linkname, meta), true)
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return rootFS.insert(name, newSpecial(syspath.Base(name), uint32(hdr.Devmajor), uint32(hdr.Devminor), meta), true)
+
+	default:
+		// Skip unsupported entry types (eg. GNU sparse files, volume labels).
+		return nil
+	}
+}
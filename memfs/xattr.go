@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memfs
+
+import (
+	"io/fs"
+)
+
+// SetXattr sets the value of an extended attribute on the named file,
+// following symbolic links.
+func (rootFS *FS) SetXattr(name, attr, value string) error {
+	if !fs.ValidPath(name) || attr == "" {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		// root dir
+		name = ""
+	}
+
+	child, err := rootFS.lookup(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+
+	if _, ok := child.(*mounted); ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: errReadOnly}
+	}
+
+	setXattr(child, attr, value)
+
+	return nil
+}
+
+func setXattr(child childI, attr, value string) {
+	set := func(xattrs *map[string]string) {
+		if *xattrs == nil {
+			*xattrs = make(map[string]string)
+		}
+		(*xattrs)[attr] = value
+	}
+
+	switch c := child.(type) {
+	case *file:
+		c.mu.Lock()
+		set(&c.xattrs)
+		c.mu.Unlock()
+	case *dir:
+		c.mu.Lock()
+		set(&c.xattrs)
+		c.mu.Unlock()
+	case *symlink:
+		set(&c.xattrs)
+	case *special:
+		set(&c.xattrs)
+	}
+}
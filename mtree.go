@@ -0,0 +1,473 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrMtreeMismatch is returned when a filesystem does not match an mtree
+// manifest.
+var ErrMtreeMismatch = errors.New("mtree mismatch")
+
+// DefaultMtreeKeywords is the list of keywords written to mtree manifests by
+// default. Modification times are omitted so that manifests are
+// reproducible.
+var DefaultMtreeKeywords = []string{"type", "mode", "uid", "gid", "size", "link", "sha256digest", "xattr"}
+
+// mtreeKeywords is the list of all supported keywords.
+var mtreeKeywords = []string{"type", "mode", "uid", "gid", "size", "time", "link", "sha256digest", "xattr"}
+
+// MtreeOptions configures the generation and verification of mtree
+// manifests.
+type MtreeOptions struct {
+	// Keywords is the list of keywords to write (defaults to
+	// DefaultMtreeKeywords), or to check when verifying (defaults to every
+	// supported keyword present in the manifest). The supported keywords are
+	// type, mode, uid, gid, size, time, link, sha256digest and xattr.
+	Keywords []string
+}
+
+// WriteMtree writes a BSD mtree(5) manifest describing every entry in fsys
+// to w. Each entry is written on a single line with its full path.
+// Extended attributes are written as "xattr.<name>=<base64 value>"
+// keywords.
+func WriteMtree(w io.Writer, fsys fs.FS, opts *MtreeOptions) error {
+	keywords := DefaultMtreeKeywords
+	if opts != nil && len(opts.Keywords) > 0 {
+		keywords = opts.Keywords
+	}
+
+	for _, keyword := range keywords {
+		if !slices.Contains(mtreeKeywords, keyword) {
+			return fmt.Errorf("unsupported mtree keyword: %s", keyword)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("#mtree\n"); err != nil {
+		return err
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		line := mtreeVis(name)
+		if name != "." {
+			line = "./" + line
+		}
+
+		for _, keyword := range keywords {
+			if keyword == "xattr" {
+				xattrs := Xattrs(fi)
+				for _, attr := range sortedKeys(xattrs) {
+					line += " xattr." + mtreeVis(attr) + "=" + base64.StdEncoding.EncodeToString([]byte(xattrs[attr]))
+				}
+				continue
+			}
+
+			value, ok, err := mtreeValue(fsys, name, fi, keyword)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				line += " " + keyword + "=" + value
+			}
+		}
+
+		_, err = bw.WriteString(line + "\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// VerifyMtree verifies fsys against a BSD mtree(5) manifest read from r.
+// Every entry is checked, and the returned error (if any) joins the errors
+// for each entry that is missing, is not described by the manifest, or has
+// a keyword that does not match (the latter two wrapping ErrMtreeMismatch).
+// Keywords that are not supported are ignored.
+func VerifyMtree(fsys fs.FS, r io.Reader, opts *MtreeOptions) error {
+	keywords := mtreeKeywords
+	if opts != nil && len(opts.Keywords) > 0 {
+		keywords = opts.Keywords
+	}
+
+	entries, err := readMtree(r)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	seen := map[string]bool{}
+	for _, e := range entries {
+		seen[e.path] = true
+
+		fi, err := lstat(fsys, e.path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := verifyMtreeEntry(fsys, e, fi, keywords); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !seen[name] {
+			errs = append(errs, &fs.PathError{Op: "verify", Path: name, Err: fmt.Errorf("unexpected entry: %w", ErrMtreeMismatch)})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+func verifyMtreeEntry(fsys fs.FS, e mtreeEntry, fi fs.FileInfo, keywords []string) error {
+	mismatch := func(keyword, want, got string) error {
+		return &fs.PathError{Op: "verify", Path: e.path, Err: fmt.Errorf("%s expected %q, got %q: %w", keyword, want, got, ErrMtreeMismatch)}
+	}
+
+	var errs []error
+	for _, keyword := range keywords {
+		if keyword == "xattr" {
+			want := map[string]string{}
+			for key, value := range e.keywords {
+				if attr, ok := strings.CutPrefix(key, "xattr."); ok {
+					want[mtreeUnvis(attr)] = value
+				}
+			}
+
+			if len(want) == 0 {
+				continue
+			}
+
+			got := Xattrs(fi)
+			for _, attr := range sortedKeys(want) {
+				value, ok := got[attr]
+				if !ok {
+					errs = append(errs, mismatch("xattr."+attr, want[attr], ""))
+				} else if encoded := base64.StdEncoding.EncodeToString([]byte(value)); encoded != want[attr] {
+					errs = append(errs, mismatch("xattr."+attr, want[attr], encoded))
+				}
+			}
+
+			for _, attr := range sortedKeys(got) {
+				if _, ok := want[attr]; !ok {
+					errs = append(errs, mismatch("xattr."+attr, "", base64.StdEncoding.EncodeToString([]byte(got[attr]))))
+				}
+			}
+			continue
+		}
+
+		want, ok := e.keywords[keyword]
+		if !ok && keyword == "sha256digest" {
+			want, ok = e.keywords["sha256"]
+		}
+		if !ok {
+			continue
+		}
+
+		got, applies, err := mtreeValue(fsys, e.path, fi, keyword)
+		if err != nil {
+			return err
+		}
+
+		if !applies {
+			continue
+		}
+
+		if !mtreeEqual(keyword, want, got) {
+			errs = append(errs, mismatch(keyword, want, got))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// mtreeEqual reports whether the manifest value of a keyword matches the
+// value generated from the filesystem.
+func mtreeEqual(keyword, want, got string) bool {
+	switch keyword {
+	case "mode":
+		wantMode, err := strconv.ParseUint(want, 8, 32)
+		return err == nil && fmt.Sprintf("%04o", wantMode) == got
+	case "time":
+		// Allow the nanoseconds to be truncated or omitted.
+		sec, nsec, _ := strings.Cut(want, ".")
+		nsec += "000000000"
+		return sec+"."+nsec[:9] == got
+	case "link":
+		return mtreeUnvis(want) == mtreeUnvis(got)
+	case "sha256digest":
+		return strings.EqualFold(want, got)
+	}
+
+	return want == got
+}
+
+// mtreeValue returns the value of a keyword for the named file, ok is false
+// if the keyword does not apply to the file.
+func mtreeValue(fsys fs.FS, name string, fi fs.FileInfo, keyword string) (value string, ok bool, err error) {
+	mode := fi.Mode()
+
+	switch keyword {
+	case "type":
+		return mtreeType(mode), true, nil
+	case "mode":
+		perm := uint32(mode.Perm())
+		if mode&fs.ModeSetuid != 0 {
+			perm |= 0o4000
+		}
+		if mode&fs.ModeSetgid != 0 {
+			perm |= 0o2000
+		}
+		if mode&fs.ModeSticky != 0 {
+			perm |= 0o1000
+		}
+		return fmt.Sprintf("%04o", perm), true, nil
+	case "uid":
+		uid, _, _ := LookupOwner(fi)
+		return strconv.Itoa(uid), true, nil
+	case "gid":
+		_, gid, _ := LookupOwner(fi)
+		return strconv.Itoa(gid), true, nil
+	case "size":
+		if !mode.IsRegular() {
+			return "", false, nil
+		}
+		return strconv.FormatInt(fi.Size(), 10), true, nil
+	case "time":
+		t := fi.ModTime()
+		return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond()), true, nil
+	case "link":
+		if mode&fs.ModeSymlink == 0 {
+			return "", false, nil
+		}
+
+		target, err := readLink(fsys, name)
+		if err != nil {
+			return "", false, err
+		}
+
+		return mtreeVis(target), true, nil
+	case "sha256digest":
+		if !mode.IsRegular() {
+			return "", false, nil
+		}
+
+		sum, err := hashFile(fsys, name)
+		if err != nil {
+			return "", false, err
+		}
+
+		return sum, true, nil
+	}
+
+	return "", false, fmt.Errorf("unsupported mtree keyword: %s", keyword)
+}
+
+func mtreeType(mode fs.FileMode) string {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return "dir"
+	case fs.ModeSymlink:
+		return "link"
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return "char"
+	case fs.ModeDevice:
+		return "block"
+	case fs.ModeNamedPipe:
+		return "fifo"
+	case fs.ModeSocket:
+		return "socket"
+	}
+
+	return "file"
+}
+
+// mtreeEntry is an entry parsed from an mtree manifest.
+type mtreeEntry struct {
+	path     string
+	keywords map[string]string
+}
+
+// readMtree parses an mtree(5) manifest, in either the hierarchical or full
+// path form.
+func readMtree(r io.Reader) ([]mtreeEntry, error) {
+	var entries []mtreeEntry
+
+	set := map[string]string{}
+	cwd := "."
+
+	var line string
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		// Lines may be continued with a trailing backslash.
+		if continued, ok := strings.CutSuffix(scanner.Text(), "\\"); ok {
+			line += continued + " "
+			continue
+		}
+		line += scanner.Text()
+
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, field := range fields[1:] {
+				key, value, _ := strings.Cut(field, "=")
+				set[key] = value
+			}
+			continue
+		case "/unset":
+			for _, key := range fields[1:] {
+				if key == "all" {
+					clear(set)
+				}
+				delete(set, key)
+			}
+			continue
+		case "..":
+			// Manifests written by mtree(8) finish by ascending from the root.
+			cwd = path.Dir(cwd)
+			continue
+		}
+
+		keywords := maps.Clone(set)
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			keywords[key] = value
+		}
+
+		name := mtreeUnvis(fields[0])
+		full := strings.Contains(name, "/")
+		if full {
+			name = path.Clean(name)
+		} else {
+			name = path.Join(cwd, name)
+		}
+
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("mtree manifest line %d: invalid path %q", lineNo, fields[0])
+		}
+
+		if !full && keywords["type"] == "dir" {
+			cwd = name
+		}
+
+		entries = append(entries, mtreeEntry{path: name, keywords: keywords})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// mtreeVis encodes a name as for vis(3), with whitespace, control and
+// special characters written as backslash escaped octal.
+func mtreeVis(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '\\' || c == '#' || c == '=' {
+			fmt.Fprintf(&sb, "\\%03o", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String()
+}
+
+// mtreeUnvis decodes a name encoded as for vis(3).
+func mtreeUnvis(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			sb.WriteByte(c)
+			continue
+		}
+
+		if i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		i++
+		switch s[i] {
+		case 's':
+			sb.WriteByte(' ')
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+
+	return sb.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
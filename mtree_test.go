@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMtree(t *testing.T) {
+	newFS := func(t *testing.T) *memfs.FS {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, fsys.WriteFile("usr/bin/hello world", []byte("hello\n"), 0o755|fs.ModeSetuid))
+		require.NoError(t, fsys.Symlink("hello world", "usr/bin/hi"))
+		require.NoError(t, fsys.SetOwner("usr/bin/hello world", 1000, 100))
+		require.NoError(t, fsys.SetXattr("usr/bin/hello world", "security.capability", "\x01\x00\x00\x02"))
+		return fsys
+	}
+
+	src := newFS(t)
+
+	var manifest bytes.Buffer
+	require.NoError(t, archivefs.WriteMtree(&manifest, src, nil))
+
+	require.Equal(t, `#mtree
+. type=dir mode=0000 uid=0 gid=0
+./usr type=dir mode=0755 uid=0 gid=0
+./usr/bin type=dir mode=0755 uid=0 gid=0
+./usr/bin/hello\040world type=file mode=4755 uid=1000 gid=100 size=6 sha256digest=5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03 xattr.security.capability=AQAAAg==
+./usr/bin/hi type=link mode=0777 uid=0 gid=0 link=hello\040world
+`, manifest.String())
+
+	t.Run("Verify", func(t *testing.T) {
+		require.NoError(t, archivefs.VerifyMtree(newFS(t), bytes.NewReader(manifest.Bytes()), nil))
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		modified := newFS(t)
+		require.NoError(t, modified.WriteFile("usr/bin/hello world", []byte("goodbye\n"), 0o755))
+		require.NoError(t, modified.WriteFile("usr/bin/extra", nil, 0o644))
+
+		err := archivefs.VerifyMtree(modified, bytes.NewReader(manifest.Bytes()), nil)
+		require.ErrorIs(t, err, archivefs.ErrMtreeMismatch)
+		require.ErrorContains(t, err, "sha256digest")
+		require.ErrorContains(t, err, "usr/bin/extra: unexpected entry")
+
+		// Only check the requested keywords.
+		modified = newFS(t)
+		require.NoError(t, modified.SetOwner("usr/bin/hello world", 0, 0))
+
+		require.NoError(t, archivefs.VerifyMtree(modified, bytes.NewReader(manifest.Bytes()), &archivefs.MtreeOptions{
+			Keywords: []string{"type", "sha256digest"},
+		}))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		err := archivefs.VerifyMtree(memfs.New(), bytes.NewReader(manifest.Bytes()), nil)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Hierarchical", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			".":            {Mode: fs.ModeDir | 0o755},
+			"etc":          {Mode: fs.ModeDir | 0o755},
+			"etc/hostname": {Data: []byte("test"), Mode: 0o644, ModTime: time.Unix(1700000000, 500000000)},
+			"motd":         {Mode: 0o600},
+		}
+
+		// As written by mtree -c.
+		manifest := `#	   user: root
+/set type=file uid=0 gid=0 mode=0644
+.               type=dir mode=0755
+    etc             type=dir mode=0755
+        hostname    size=4 \
+                    time=1700000000.5
+    ..
+    motd            mode=0600 size=0
+..
+`
+
+		require.NoError(t, archivefs.VerifyMtree(fsys, strings.NewReader(manifest), nil))
+
+		err := archivefs.VerifyMtree(fsys, strings.NewReader(strings.Replace(manifest, "time=1700000000.5", "time=1700000000.0", 1)), nil)
+		require.ErrorIs(t, err, archivefs.ErrMtreeMismatch)
+		require.ErrorContains(t, err, "etc/hostname")
+	})
+}
@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nfsfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io/fs"
+	"sync"
+
+	"github.com/dpeckett/archivefs/internal/vfs"
+)
+
+// handleSize is the size of a file handle: a random server instance
+// followed by the ID of the file.
+const handleSize = 16
+
+// handleTable assigns file handles to paths. Handles are only valid for the
+// lifetime of the server, after which clients will receive NFS3ERR_STALE.
+type handleTable struct {
+	instance [8]byte
+
+	mu    sync.Mutex
+	ids   map[string]uint64
+	names []string
+}
+
+func newHandleTable() *handleTable {
+	t := &handleTable{ids: map[string]uint64{}}
+	_, _ = rand.Read(t.instance[:])
+
+	// The root directory is always the first handle.
+	t.id(".")
+
+	return t
+}
+
+// id returns the ID of the named file, assigning one if required. IDs start
+// at one.
+func (t *handleTable) id(name string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, ok := t.ids[name]
+	if !ok {
+		t.names = append(t.names, name)
+		id = uint64(len(t.names))
+		t.ids[name] = id
+	}
+
+	return id
+}
+
+// handle returns the file handle of the named file.
+func (t *handleTable) handle(name string) []byte {
+	h := make([]byte, 0, handleSize)
+	h = append(h, t.instance[:]...)
+	return binary.BigEndian.AppendUint64(h, t.id(name))
+}
+
+// lookup returns the ID and name of the file referenced by a handle.
+func (t *handleTable) lookup(h []byte) (uint64, string, error) {
+	if len(h) != handleSize {
+		return 0, "", nfs3ErrBadHandle
+	}
+
+	if [8]byte(h[:8]) != t.instance {
+		return 0, "", nfs3ErrStale
+	}
+
+	id := binary.BigEndian.Uint64(h[8:])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id == 0 || id > uint64(len(t.names)) {
+		return 0, "", nfs3ErrStale
+	}
+
+	return id, t.names[id-1], nil
+}
+
+// maxOpenFiles is the number of files kept open between reads.
+const maxOpenFiles = 64
+
+// fileCache keeps recently read files open, as NFS has no notion of open
+// files, and reopening files that only support sequential reads (eg. in a
+// compressed archive) for every request would be very slow.
+type fileCache struct {
+	fsys fs.FS
+
+	mu    sync.Mutex
+	files map[string]*cachedFile
+	clock uint64
+}
+
+type cachedFile struct {
+	*vfs.File
+	refs     int
+	lastUsed uint64
+}
+
+func newFileCache(fsys fs.FS) *fileCache {
+	return &fileCache{fsys: fsys, files: map[string]*cachedFile{}}
+}
+
+// acquire returns the named file opened for reading, release must be called
+// once the file is no longer in use.
+func (c *fileCache) acquire(name string) (*cachedFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clock++
+
+	f, ok := c.files[name]
+	if !ok {
+		file, err := vfs.Open(c.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		f = &cachedFile{File: file}
+		c.files[name] = f
+	}
+
+	f.refs++
+	f.lastUsed = c.clock
+	c.evict()
+
+	return f, nil
+}
+
+func (c *fileCache) release(f *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f.refs--
+	c.evict()
+}
+
+// evict closes the least recently used files that are not in use, until at
+// most maxOpenFiles remain open.
+func (c *fileCache) evict() {
+	for len(c.files) > maxOpenFiles {
+		var oldestName string
+		var oldest *cachedFile
+		for name, f := range c.files {
+			if f.refs == 0 && (oldest == nil || f.lastUsed < oldest.lastUsed) {
+				oldestName, oldest = name, f
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+
+		delete(c.files, oldestName)
+		_ = oldest.Close()
+	}
+}
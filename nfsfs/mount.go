@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nfsfs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/dpeckett/archivefs/internal/vfs"
+)
+
+// MOUNT procedures (RFC 1813, section 5).
+const (
+	mountProcNull    = 0
+	mountProcMnt     = 1
+	mountProcDump    = 2
+	mountProcUmnt    = 3
+	mountProcUmntall = 4
+	mountProcExport  = 5
+)
+
+// MOUNT status codes (mountstat3).
+const (
+	mnt3OK        = 0
+	mnt3ErrNoEnt  = 2
+	mnt3ErrNotDir = 20
+)
+
+// maxMountPathLen is the maximum length of a mount path.
+const maxMountPathLen = 1024
+
+func (s *Server) mountProcedures() map[uint32]procedure {
+	return map[uint32]procedure{
+		mountProcNull:    func(d *decoder, e *encoder) error { return nil },
+		mountProcMnt:     s.mnt,
+		mountProcDump:    s.dump,
+		mountProcUmnt:    func(d *decoder, e *encoder) error { return nil },
+		mountProcUmntall: func(d *decoder, e *encoder) error { return nil },
+		mountProcExport:  s.export,
+	}
+}
+
+// mnt returns the handle of the export, or a directory beneath it.
+func (s *Server) mnt(d *decoder, e *encoder) error {
+	dirPath := d.str(maxMountPathLen)
+	if d.err != nil {
+		return d.err
+	}
+
+	name, ok := s.exportName(dirPath)
+	if !ok {
+		e.u32(mnt3ErrNoEnt)
+		return nil
+	}
+
+	fi, err := vfs.Lstat(s.fsys, name)
+	if err != nil {
+		e.u32(mnt3ErrNoEnt)
+		return nil
+	}
+
+	if !fi.IsDir() {
+		e.u32(mnt3ErrNotDir)
+		return nil
+	}
+
+	e.u32(mnt3OK)
+	e.opaque(s.handles.handle(name))
+	e.u32(2)
+	e.u32(authUnix)
+	e.u32(authNone)
+	return nil
+}
+
+// dump lists the mounted filesystems, which are not tracked.
+func (s *Server) dump(d *decoder, e *encoder) error {
+	e.bool(false)
+	return nil
+}
+
+// export lists the single exported filesystem, which is available to all
+// clients.
+func (s *Server) export(d *decoder, e *encoder) error {
+	e.bool(true)
+	e.str(s.exportPath)
+	e.bool(false)
+	e.bool(false)
+	return nil
+}
+
+// exportName returns the name within the filesystem of a mount path.
+func (s *Server) exportName(dirPath string) (string, bool) {
+	dirPath = path.Clean("/" + dirPath)
+	if dirPath == s.exportPath {
+		return ".", true
+	}
+
+	prefix := s.exportPath
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	name, ok := strings.CutPrefix(dirPath, prefix)
+	return name, ok
+}
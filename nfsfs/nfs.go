@@ -0,0 +1,625 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nfsfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/vfs"
+)
+
+// NFSv3 procedures (RFC 1813, section 3).
+const (
+	nfsProcNull        = 0
+	nfsProcGetattr     = 1
+	nfsProcSetattr     = 2
+	nfsProcLookup      = 3
+	nfsProcAccess      = 4
+	nfsProcReadlink    = 5
+	nfsProcRead        = 6
+	nfsProcWrite       = 7
+	nfsProcCreate      = 8
+	nfsProcMkdir       = 9
+	nfsProcSymlink     = 10
+	nfsProcMknod       = 11
+	nfsProcRemove      = 12
+	nfsProcRmdir       = 13
+	nfsProcRename      = 14
+	nfsProcLink        = 15
+	nfsProcReaddir     = 16
+	nfsProcReaddirplus = 17
+	nfsProcFsstat      = 18
+	nfsProcFsinfo      = 19
+	nfsProcPathconf    = 20
+	nfsProcCommit      = 21
+)
+
+// File types (ftype3).
+const (
+	nf3Reg  = 1
+	nf3Dir  = 2
+	nf3Blk  = 3
+	nf3Chr  = 4
+	nf3Lnk  = 5
+	nf3Sock = 6
+	nf3FIFO = 7
+)
+
+// Access permissions (ACCESS3_*).
+const (
+	access3Read    = 0x01
+	access3Lookup  = 0x02
+	access3Execute = 0x20
+)
+
+// Filesystem properties (FSF3_*).
+const (
+	fsf3Link        = 0x01
+	fsf3Symlink     = 0x02
+	fsf3Homogeneous = 0x08
+)
+
+const (
+	// maxHandleSize is the maximum size of an NFSv3 file handle.
+	maxHandleSize = 64
+	// maxNameLen is the maximum length of a file name.
+	maxNameLen = 255
+	// maxPathLen is the maximum length of a path (eg. a symlink target).
+	maxPathLen = 4096
+	// maxReadSize is the maximum number of bytes returned by READ.
+	maxReadSize = 1 << 20
+	// fattrSize is the encoded size of a fattr3.
+	fattrSize = 84
+)
+
+// nfsStatus is an NFSv3 status code (nfsstat3).
+type nfsStatus uint32
+
+const (
+	nfs3OK             nfsStatus = 0
+	nfs3ErrNoEnt       nfsStatus = 2
+	nfs3ErrIO          nfsStatus = 5
+	nfs3ErrAcces       nfsStatus = 13
+	nfs3ErrNotDir      nfsStatus = 20
+	nfs3ErrIsDir       nfsStatus = 21
+	nfs3ErrInval       nfsStatus = 22
+	nfs3ErrROFS        nfsStatus = 30
+	nfs3ErrNameTooLong nfsStatus = 63
+	nfs3ErrStale       nfsStatus = 70
+	nfs3ErrBadHandle   nfsStatus = 10001
+	nfs3ErrBadCookie   nfsStatus = 10003
+	nfs3ErrNotSupp     nfsStatus = 10004
+	nfs3ErrTooSmall    nfsStatus = 10005
+)
+
+func (s nfsStatus) Error() string {
+	switch s {
+	case nfs3ErrNoEnt:
+		return "no such file or directory"
+	case nfs3ErrIO:
+		return "input/output error"
+	case nfs3ErrAcces:
+		return "permission denied"
+	case nfs3ErrNotDir:
+		return "not a directory"
+	case nfs3ErrIsDir:
+		return "is a directory"
+	case nfs3ErrInval:
+		return "invalid argument"
+	case nfs3ErrROFS:
+		return "read-only file system"
+	case nfs3ErrNameTooLong:
+		return "file name too long"
+	case nfs3ErrStale:
+		return "stale file handle"
+	case nfs3ErrBadHandle:
+		return "bad file handle"
+	case nfs3ErrBadCookie:
+		return "bad cookie"
+	case nfs3ErrNotSupp:
+		return "operation not supported"
+	case nfs3ErrTooSmall:
+		return "buffer too small"
+	}
+
+	return "unknown error"
+}
+
+// toStatus converts an error to the closest matching NFSv3 status.
+func toStatus(err error) nfsStatus {
+	var status nfsStatus
+	switch {
+	case err == nil:
+		return nfs3OK
+	case errors.As(err, &status):
+		return status
+	case errors.Is(err, fs.ErrNotExist):
+		return nfs3ErrNoEnt
+	case errors.Is(err, fs.ErrPermission):
+		return nfs3ErrAcces
+	case errors.Is(err, fs.ErrInvalid):
+		return nfs3ErrInval
+	case errors.Is(err, errors.ErrUnsupported):
+		return nfs3ErrNotSupp
+	}
+
+	return nfs3ErrIO
+}
+
+func (s *Server) nfsProcedures() map[uint32]procedure {
+	return map[uint32]procedure{
+		nfsProcNull:        func(d *decoder, e *encoder) error { return nil },
+		nfsProcGetattr:     s.getattr,
+		nfsProcLookup:      s.lookup,
+		nfsProcAccess:      s.access,
+		nfsProcReadlink:    s.readlink,
+		nfsProcRead:        s.read,
+		nfsProcReaddir:     s.readdir,
+		nfsProcReaddirplus: s.readdirplus,
+		nfsProcFsstat:      s.fsstat,
+		nfsProcFsinfo:      s.fsinfo,
+		nfsProcPathconf:    s.pathconf,
+
+		// Procedures that modify the filesystem fail, the number of empty
+		// wcc_data (pre_op_attr + post_op_attr) and post_op_attr structures
+		// in the failure response varies.
+		nfsProcSetattr: readOnly(2),
+		nfsProcWrite:   readOnly(2),
+		nfsProcCreate:  readOnly(2),
+		nfsProcMkdir:   readOnly(2),
+		nfsProcSymlink: readOnly(2),
+		nfsProcMknod:   readOnly(2),
+		nfsProcRemove:  readOnly(2),
+		nfsProcRmdir:   readOnly(2),
+		nfsProcRename:  readOnly(4),
+		nfsProcLink:    readOnly(3),
+		nfsProcCommit:  readOnly(2),
+	}
+}
+
+// readOnly returns a procedure that fails with NFS3ERR_ROFS, followed by
+// the given number of empty optional attributes.
+func readOnly(emptyAttrs int) procedure {
+	return func(d *decoder, e *encoder) error {
+		e.u32(uint32(nfs3ErrROFS))
+		for i := 0; i < emptyAttrs; i++ {
+			e.bool(false)
+		}
+		return nil
+	}
+}
+
+func (s *Server) getattr(d *decoder, e *encoder) error {
+	h := d.opaque(maxHandleSize)
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	s.encodeAttr(e, name, fi)
+	return nil
+}
+
+func (s *Server) lookup(d *decoder, e *encoder) error {
+	h, elem := d.opaque(maxHandleSize), d.str(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+
+	dir, dirInfo, err := s.stat(h)
+	if err == nil && !dirInfo.IsDir() {
+		err = nfs3ErrNotDir
+	}
+	if err == nil {
+		switch {
+		case len(elem) > maxNameLen:
+			err = nfs3ErrNameTooLong
+		case elem == "" || strings.Contains(elem, "/"):
+			err = nfs3ErrNoEnt
+		}
+	}
+
+	var name string
+	var fi fs.FileInfo
+	if err == nil {
+		switch elem {
+		case ".":
+			name = dir
+		case "..":
+			name = path.Dir(dir)
+		default:
+			name = path.Join(dir, elem)
+		}
+
+		fi, err = vfs.Lstat(s.fsys, name)
+	}
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		s.encodePostOpAttr(e, dir, dirInfo)
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	e.opaque(s.handles.handle(name))
+	s.encodePostOpAttr(e, name, fi)
+	s.encodePostOpAttr(e, dir, dirInfo)
+	return nil
+}
+
+func (s *Server) access(d *decoder, e *encoder) error {
+	h, mask := d.opaque(maxHandleSize), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		e.bool(false)
+		return nil
+	}
+
+	// Permissions are enforced by the client, but nothing can be modified.
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, name, fi)
+	e.u32(mask & (access3Read | access3Lookup | access3Execute))
+	return nil
+}
+
+func (s *Server) readlink(d *decoder, e *encoder) error {
+	h := d.opaque(maxHandleSize)
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err == nil && fi.Mode()&fs.ModeSymlink == 0 {
+		err = nfs3ErrInval
+	}
+
+	var target string
+	if err == nil {
+		target, err = vfs.ReadLink(s.fsys, name)
+	}
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		s.encodePostOpAttr(e, name, fi)
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, name, fi)
+	e.str(target)
+	return nil
+}
+
+func (s *Server) read(d *decoder, e *encoder) error {
+	h, offset, count := d.opaque(maxHandleSize), d.u64(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err == nil {
+		switch {
+		case fi.IsDir():
+			err = nfs3ErrIsDir
+		case !fi.Mode().IsRegular():
+			err = nfs3ErrInval
+		}
+	}
+
+	var data []byte
+	if err == nil && offset < uint64(fi.Size()) {
+		data = make([]byte, min(count, maxReadSize, uint32(min(uint64(fi.Size())-offset, math.MaxUint32))))
+
+		var f *cachedFile
+		f, err = s.files.acquire(name)
+		if err == nil {
+			var n int
+			n, err = f.ReadAt(data, int64(offset))
+			s.files.release(f)
+
+			data = data[:n]
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		s.encodePostOpAttr(e, name, fi)
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, name, fi)
+	e.u32(uint32(len(data)))
+	e.bool(offset+uint64(len(data)) >= uint64(fi.Size()))
+	e.opaque(data)
+	return nil
+}
+
+func (s *Server) readdir(d *decoder, e *encoder) error {
+	h, cookie, _, count := d.opaque(maxHandleSize), d.u64(), d.next(8), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	return s.readDir(h, cookie, count, false, e)
+}
+
+func (s *Server) readdirplus(d *decoder, e *encoder) error {
+	h, cookie, _, _, count := d.opaque(maxHandleSize), d.u64(), d.next(8), d.u32(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	return s.readDir(h, cookie, count, true, e)
+}
+
+// readDir lists a directory for READDIR and READDIRPLUS. Cookies are the
+// index of the next entry in the directory. As the filesystem never changes,
+// the cookie verifier is always zero.
+func (s *Server) readDir(h []byte, cookie uint64, count uint32, plus bool, e *encoder) error {
+	dir, dirInfo, err := s.stat(h)
+	if err == nil && !dirInfo.IsDir() {
+		err = nfs3ErrNotDir
+	}
+
+	var entries []fs.DirEntry
+	if err == nil {
+		entries, err = fs.ReadDir(s.fsys, dir)
+	}
+	if err == nil && cookie > uint64(len(entries)) {
+		err = nfs3ErrBadCookie
+	}
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		s.encodePostOpAttr(e, dir, dirInfo)
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, dir, dirInfo)
+	e.fixed(make([]byte, 8))
+
+	// status + post_op_attr + cookieverf + list terminator + eof
+	size := 4 + 4 + fattrSize + 8 + 4 + 4
+
+	i := cookie
+	for ; i < uint64(len(entries)); i++ {
+		de := entries[i]
+		name := path.Join(dir, de.Name())
+
+		// value follows + fileid + name + cookie
+		entrySize := 4 + 8 + 4 + len(de.Name()) + pad(len(de.Name())) + 8
+		if plus {
+			// post_op_attr + post_op_fh3
+			entrySize += 4 + fattrSize + 4 + 4 + handleSize
+		}
+
+		if size+entrySize > int(count) {
+			if i == cookie {
+				e.buf = e.buf[:0]
+				e.u32(uint32(nfs3ErrTooSmall))
+				s.encodePostOpAttr(e, dir, dirInfo)
+				return nil
+			}
+			break
+		}
+		size += entrySize
+
+		fi, err := de.Info()
+		if err != nil {
+			fi = nil
+		}
+
+		e.bool(true)
+		if fi != nil {
+			e.u64(s.fileID(name, fi))
+		} else {
+			e.u64(s.handles.id(name))
+		}
+		e.str(de.Name())
+		e.u64(i + 1)
+
+		if plus {
+			s.encodePostOpAttr(e, name, fi)
+			e.bool(true)
+			e.opaque(s.handles.handle(name))
+		}
+	}
+
+	e.bool(false)
+	e.bool(i == uint64(len(entries)))
+	return nil
+}
+
+func (s *Server) fsstat(d *decoder, e *encoder) error {
+	h := d.opaque(maxHandleSize)
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		e.bool(false)
+		return nil
+	}
+
+	// The filesystem is read-only, so there is no free space.
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, name, fi)
+	for i := 0; i < 6; i++ {
+		e.u64(0)
+	}
+	// The filesystem never changes.
+	e.u32(math.MaxUint32)
+	return nil
+}
+
+func (s *Server) fsinfo(d *decoder, e *encoder) error {
+	h := d.opaque(maxHandleSize)
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		e.bool(false)
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, name, fi)
+	// rtmax, rtpref, rtmult
+	e.u32(maxReadSize)
+	e.u32(maxReadSize)
+	e.u32(4096)
+	// wtmax, wtpref, wtmult
+	e.u32(maxReadSize)
+	e.u32(maxReadSize)
+	e.u32(4096)
+	// dtpref
+	e.u32(64 * 1024)
+	// maxfilesize
+	e.u64(math.MaxInt64)
+	// time_delta
+	e.u32(0)
+	e.u32(1)
+	e.u32(fsf3Link | fsf3Symlink | fsf3Homogeneous)
+	return nil
+}
+
+func (s *Server) pathconf(d *decoder, e *encoder) error {
+	h := d.opaque(maxHandleSize)
+	if d.err != nil {
+		return d.err
+	}
+
+	name, fi, err := s.stat(h)
+	if err != nil {
+		e.u32(uint32(toStatus(err)))
+		e.bool(false)
+		return nil
+	}
+
+	e.u32(uint32(nfs3OK))
+	s.encodePostOpAttr(e, name, fi)
+	// linkmax, name_max
+	e.u32(math.MaxInt32)
+	e.u32(maxNameLen)
+	// no_trunc, chown_restricted, case_insensitive, case_preserving
+	e.bool(true)
+	e.bool(true)
+	e.bool(false)
+	e.bool(true)
+	return nil
+}
+
+// stat returns the name and attributes of the file referenced by a handle.
+func (s *Server) stat(h []byte) (string, fs.FileInfo, error) {
+	_, name, err := s.handles.lookup(h)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fi, err := vfs.Lstat(s.fsys, name)
+	if err != nil {
+		// The file can't have been removed, so the handle is stale.
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nfs3ErrStale
+		}
+
+		return name, nil, err
+	}
+
+	return name, fi, nil
+}
+
+// fileID returns the inode number of a file, or an ID derived from its handle
+// if the filesystem doesn't supply one.
+func (s *Server) fileID(name string, fi fs.FileInfo) uint64 {
+	if ino := archivefs.NewEntryFromInfo(name, fi).Ino; ino != 0 {
+		return ino
+	}
+
+	return s.handles.id(name)
+}
+
+// encodePostOpAttr writes an optional fattr3, fi may be nil.
+func (s *Server) encodePostOpAttr(e *encoder, name string, fi fs.FileInfo) {
+	e.bool(fi != nil)
+	if fi != nil {
+		s.encodeAttr(e, name, fi)
+	}
+}
+
+// encodeAttr writes a fattr3.
+func (s *Server) encodeAttr(e *encoder, name string, fi fs.FileInfo) {
+	mode := fi.Mode()
+
+	var typ uint32
+	switch mode.Type() {
+	case fs.ModeDir:
+		typ = nf3Dir
+	case fs.ModeSymlink:
+		typ = nf3Lnk
+	case fs.ModeDevice | fs.ModeCharDevice:
+		typ = nf3Chr
+	case fs.ModeDevice:
+		typ = nf3Blk
+	case fs.ModeNamedPipe:
+		typ = nf3FIFO
+	case fs.ModeSocket:
+		typ = nf3Sock
+	default:
+		typ = nf3Reg
+	}
+
+	entry := archivefs.NewEntryFromInfo(name, fi)
+	size := uint64(fi.Size())
+
+	e.u32(typ)
+	e.u32(vfs.Mode(mode) &^ vfs.S_IFMT)
+	e.u32(uint32(entry.Nlink))
+	e.u32(uint32(entry.Uid))
+	e.u32(uint32(entry.Gid))
+	e.u64(size)
+	// used
+	e.u64((size + 511) &^ 511)
+	e.u32(entry.Major)
+	e.u32(entry.Minor)
+	// fsid
+	e.u64(0)
+	e.u64(s.fileID(name, fi))
+
+	// The access and change times are reported as the modification time.
+	mtime := fi.ModTime()
+	for i := 0; i < 3; i++ {
+		e.u32(uint32(mtime.Unix()))
+		e.u32(uint32(mtime.Nanosecond()))
+	}
+}
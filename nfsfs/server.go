@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package nfsfs serves any filesystem read-only using NFSv3 (RFC 1813) over
+// TCP. The MOUNT protocol is served on the same port, and no portmapper is
+// required, eg. on Linux:
+//
+//	mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,nolock host:/ /mnt
+package nfsfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"sync"
+)
+
+// Options configures an NFS server.
+type Options struct {
+	// ExportPath is the path clients mount, if empty it defaults to "/".
+	ExportPath string
+}
+
+// Server serves a filesystem using NFSv3. Symbolic links are only supported
+// if the filesystem implements archivefs.ReadLinkFS.
+type Server struct {
+	fsys       fs.FS
+	exportPath string
+	handles    *handleTable
+	files      *fileCache
+	nfsProcs   map[uint32]procedure
+	mountProcs map[uint32]procedure
+}
+
+// NewServer returns a server for fsys.
+func NewServer(fsys fs.FS, opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	exportPath := opts.ExportPath
+	if exportPath == "" {
+		exportPath = "/"
+	}
+
+	s := &Server{
+		fsys:       fsys,
+		exportPath: path.Clean("/" + exportPath),
+		handles:    newHandleTable(),
+		files:      newFileCache(fsys),
+	}
+	s.nfsProcs = s.nfsProcedures()
+	s.mountProcs = s.mountProcedures()
+
+	return s
+}
+
+// Serve accepts connections on l, serving each in a new goroutine. It
+// returns when l.Accept fails, eg. because the listener was closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			_ = s.ServeConn(rwc)
+		}()
+	}
+}
+
+// ServeConn serves RPC requests on a single stream connection until it is
+// closed by the client, it closes rwc before returning. Requests are
+// processed concurrently.
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	var (
+		wmu sync.Mutex
+		wg  sync.WaitGroup
+	)
+	defer func() {
+		_ = rwc.Close()
+		wg.Wait()
+	}()
+
+	r := bufio.NewReader(rwc)
+	for {
+		call, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reply := s.handleCall(call)
+			if reply == nil {
+				return
+			}
+
+			wmu.Lock()
+			defer wmu.Unlock()
+
+			// Send errors will also cause the next read to fail.
+			_ = writeRecord(rwc, reply)
+		}()
+	}
+}
+
+// RPC record marking (RFC 5531, section 11).
+const (
+	lastFragment = 1 << 31
+	// maxRecordSize is the maximum size of a call, which is much larger than
+	// any read-only request.
+	maxRecordSize = 1 << 20
+)
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if len(record) > 0 && errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, err
+		}
+
+		n := binary.BigEndian.Uint32(hdr[:])
+		size := int(n &^ lastFragment)
+		if len(record)+size > maxRecordSize {
+			return nil, errors.New("record too large")
+		}
+
+		start := len(record)
+		record = append(record, make([]byte, size)...)
+		if _, err := io.ReadFull(r, record[start:]); err != nil {
+			return nil, err
+		}
+
+		if n&lastFragment != 0 {
+			return record, nil
+		}
+	}
+}
+
+func writeRecord(w io.Writer, record []byte) error {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(record)), uint32(len(record))|lastFragment)
+	_, err := w.Write(append(buf, record...))
+	return err
+}
+
+// ONC RPC (RFC 5531) constants.
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	rejectRPCMismatch = 0
+
+	authNone = 0
+	authUnix = 1
+
+	// maxAuthSize is the maximum size of the body of a credential.
+	maxAuthSize = 400
+)
+
+// Program numbers.
+const (
+	progNFS   = 100003
+	progMount = 100005
+
+	versNFS   = 3
+	versMount = 3
+)
+
+// procedure handles a call, writing the results to e. An error indicates
+// the arguments could not be decoded.
+type procedure func(d *decoder, e *encoder) error
+
+// handleCall processes an RPC call, returning the reply to send (if any).
+func (s *Server) handleCall(call []byte) []byte {
+	d := &decoder{buf: call}
+	xid, msgType, rpcvers := d.u32(), d.u32(), d.u32()
+	prog, vers, proc := d.u32(), d.u32(), d.u32()
+	// Credentials are ignored, the filesystem is read-only.
+	_, _ = d.u32(), d.opaque(maxAuthSize)
+	_, _ = d.u32(), d.opaque(maxAuthSize)
+	if d.err != nil || msgType != msgCall {
+		return nil
+	}
+
+	e := &encoder{}
+	e.u32(xid)
+	e.u32(msgReply)
+
+	if rpcvers != rpcVersion {
+		e.u32(replyDenied)
+		e.u32(rejectRPCMismatch)
+		e.u32(rpcVersion)
+		e.u32(rpcVersion)
+		return e.buf
+	}
+
+	e.u32(replyAccepted)
+	// The verifier.
+	e.u32(authNone)
+	e.u32(0)
+
+	var procs map[uint32]procedure
+	switch prog {
+	case progNFS:
+		if vers != versNFS {
+			e.u32(acceptProgMismatch)
+			e.u32(versNFS)
+			e.u32(versNFS)
+			return e.buf
+		}
+		procs = s.nfsProcs
+	case progMount:
+		if vers != versMount {
+			e.u32(acceptProgMismatch)
+			e.u32(versMount)
+			e.u32(versMount)
+			return e.buf
+		}
+		procs = s.mountProcs
+	default:
+		e.u32(acceptProgUnavail)
+		return e.buf
+	}
+
+	handler, ok := procs[proc]
+	if !ok {
+		e.u32(acceptProcUnavail)
+		return e.buf
+	}
+
+	results := &encoder{}
+	if err := handler(d, results); err != nil || d.err != nil {
+		e.u32(acceptGarbageArgs)
+		return e.buf
+	}
+
+	e.u32(acceptSuccess)
+	e.buf = append(e.buf, results.buf...)
+	return e.buf
+}
@@ -0,0 +1,258 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nfsfs_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/nfsfs"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	progNFS   = 100003
+	progMount = 100005
+)
+
+func TestServer(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o600))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+	require.NoError(t, fsys.SetOwner("etc/hostname", 1000, 100))
+
+	server := nfsfs.NewServer(fsys, nil)
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_ = server.ServeConn(serverConn)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, clientConn.Close())
+	})
+
+	c := &client{t: t, rw: clientConn}
+
+	// EXPORT
+	r := c.call(progMount, 5, func(m *request) {})
+	require.True(t, r.bool())
+	require.Equal(t, "/", string(r.opaque()))
+
+	// MNT
+	r = c.call(progMount, 1, func(m *request) { m.opaque([]byte("/")) })
+	require.Equal(t, uint32(0), r.u32())
+	root := r.opaque()
+
+	lookup := func(t *testing.T, dir []byte, name string) []byte {
+		r := c.call(progNFS, 3, func(m *request) {
+			m.opaque(dir)
+			m.opaque([]byte(name))
+		})
+		require.Equal(t, uint32(0), r.u32())
+		return r.opaque()
+	}
+
+	etc := lookup(t, root, "etc")
+
+	t.Run("Lookup", func(t *testing.T) {
+		r := c.call(progNFS, 3, func(m *request) {
+			m.opaque(etc)
+			m.opaque([]byte("missing"))
+		})
+		require.Equal(t, uint32(2), r.u32())
+
+		require.Equal(t, etc, lookup(t, lookup(t, etc, "ssl"), ".."))
+	})
+
+	t.Run("Getattr", func(t *testing.T) {
+		hostname := lookup(t, etc, "hostname")
+
+		r := c.call(progNFS, 1, func(m *request) { m.opaque(hostname) })
+		require.Equal(t, uint32(0), r.u32())
+		// type, mode, nlink, uid, gid, size
+		require.Equal(t, uint32(1), r.u32())
+		require.Equal(t, uint32(0o644), r.u32())
+		require.Equal(t, uint32(1), r.u32())
+		require.Equal(t, uint32(1000), r.u32())
+		require.Equal(t, uint32(100), r.u32())
+		require.Equal(t, uint64(6), r.u64())
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		hostname := lookup(t, etc, "hostname")
+
+		r := c.call(progNFS, 6, func(m *request) {
+			m.opaque(hostname)
+			m.u64(2)
+			m.u32(100)
+		})
+		require.Equal(t, uint32(0), r.u32())
+		r.postOpAttr()
+		require.Equal(t, uint32(4), r.u32())
+		require.True(t, r.bool())
+		require.Equal(t, "pha\n", string(r.opaque()))
+	})
+
+	t.Run("Readlink", func(t *testing.T) {
+		name := lookup(t, etc, "name")
+
+		r := c.call(progNFS, 5, func(m *request) { m.opaque(name) })
+		require.Equal(t, uint32(0), r.u32())
+		r.postOpAttr()
+		require.Equal(t, "hostname", string(r.opaque()))
+	})
+
+	t.Run("Readdirplus", func(t *testing.T) {
+		var names []string
+		var cookie uint64
+		for eof := false; !eof; {
+			// A small count forces the listing to be split.
+			r := c.call(progNFS, 17, func(m *request) {
+				m.opaque(etc)
+				m.u64(cookie)
+				m.u64(0)
+				m.u32(512)
+				m.u32(300)
+			})
+			require.Equal(t, uint32(0), r.u32())
+			r.postOpAttr()
+			r.u64()
+
+			for r.bool() {
+				r.u64()
+				names = append(names, string(r.opaque()))
+				cookie = r.u64()
+				r.postOpAttr()
+				require.True(t, r.bool())
+				r.opaque()
+			}
+			eof = r.bool()
+		}
+		require.Equal(t, []string{"hostname", "name", "ssl"}, names)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		// MKDIR
+		r := c.call(progNFS, 9, func(m *request) {
+			m.opaque(etc)
+			m.opaque([]byte("new"))
+		})
+		require.Equal(t, uint32(30), r.u32())
+	})
+
+	t.Run("StaleHandle", func(t *testing.T) {
+		r := c.call(progNFS, 1, func(m *request) { m.opaque(make([]byte, 16)) })
+		require.Equal(t, uint32(70), r.u32())
+	})
+}
+
+type client struct {
+	t   *testing.T
+	rw  io.ReadWriter
+	xid uint32
+}
+
+// call makes an RPC call, and returns the results.
+func (c *client) call(prog, proc uint32, build func(m *request)) *response {
+	c.t.Helper()
+
+	c.xid++
+
+	m := &request{buf: make([]byte, 4)}
+	m.u32(c.xid)
+	m.u32(0)
+	m.u32(2)
+	m.u32(prog)
+	m.u32(3)
+	m.u32(proc)
+	// AUTH_NONE credentials and verifier.
+	for i := 0; i < 4; i++ {
+		m.u32(0)
+	}
+	build(m)
+	binary.BigEndian.PutUint32(m.buf, uint32(len(m.buf)-4)|1<<31)
+
+	_, err := c.rw.Write(m.buf)
+	require.NoError(c.t, err)
+
+	var hdr [4]byte
+	_, err = io.ReadFull(c.rw, hdr[:])
+	require.NoError(c.t, err)
+
+	buf := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+	_, err = io.ReadFull(c.rw, buf)
+	require.NoError(c.t, err)
+
+	r := &response{buf: buf}
+	require.Equal(c.t, c.xid, r.u32())
+	// REPLY, MSG_ACCEPTED, AUTH_NONE verifier, SUCCESS
+	require.Equal(c.t, []uint32{1, 0, 0, 0, 0}, []uint32{r.u32(), r.u32(), r.u32(), r.u32(), r.u32()})
+
+	return r
+}
+
+// request is an XDR encoded call being built.
+type request struct {
+	buf []byte
+}
+
+func (m *request) u32(v uint32) {
+	m.buf = binary.BigEndian.AppendUint32(m.buf, v)
+}
+
+func (m *request) u64(v uint64) {
+	m.buf = binary.BigEndian.AppendUint64(m.buf, v)
+}
+
+func (m *request) opaque(b []byte) {
+	m.u32(uint32(len(b)))
+	m.buf = append(m.buf, b...)
+	m.buf = append(m.buf, make([]byte, (4-len(b)%4)%4)...)
+}
+
+// response is an XDR encoded reply being parsed.
+type response struct {
+	buf []byte
+}
+
+func (r *response) u32() uint32 {
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *response) u64() uint64 {
+	v := binary.BigEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v
+}
+
+func (r *response) bool() bool {
+	return r.u32() != 0
+}
+
+func (r *response) opaque() []byte {
+	n := int(r.u32())
+	b := r.buf[:n]
+	r.buf = r.buf[n+(4-n%4)%4:]
+	return b
+}
+
+// postOpAttr skips an optional fattr3.
+func (r *response) postOpAttr() {
+	if r.bool() {
+		r.buf = r.buf[84:]
+	}
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nfsfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortMessage = errors.New("short message")
+
+// decoder reads XDR (RFC 4506) encoded values, any error is sticky.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = errShortMessage
+		return make([]byte, max(n, 0))
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+// opaque reads variable length opaque data, of at most limit bytes.
+func (d *decoder) opaque(limit int) []byte {
+	n := d.u32()
+	if n > uint32(limit) {
+		d.err = errShortMessage
+		return nil
+	}
+
+	b := d.next(int(n))
+	d.next(pad(int(n)))
+	return b
+}
+
+func (d *decoder) str(limit int) string {
+	return string(d.opaque(limit))
+}
+
+// encoder builds XDR encoded values.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u32(1)
+	} else {
+		e.u32(0)
+	}
+}
+
+func (e *encoder) opaque(b []byte) {
+	e.u32(uint32(len(b)))
+	e.fixed(b)
+}
+
+// fixed writes fixed length opaque data.
+func (e *encoder) fixed(b []byte) {
+	e.buf = append(e.buf, b...)
+	e.buf = append(e.buf, make([]byte, pad(len(b)))...)
+}
+
+func (e *encoder) str(s string) {
+	e.opaque([]byte(s))
+}
+
+// pad returns the number of bytes needed to align n to a multiple of four.
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
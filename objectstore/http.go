@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	_ Bucket = (*HTTPBucket)(nil)
+)
+
+// HTTPBucket is a Bucket that reads objects using HTTP range requests. This
+// works with most object storage services, eg. for public buckets, S3 or GCS
+// presigned URLs, or Azure SAS URLs.
+type HTTPBucket struct {
+	// Client is used to make requests, defaults to http.DefaultClient.
+	Client *http.Client
+	// URL returns the URL of the named object. Only GET requests are made,
+	// so presigned URLs need only permit GET.
+	URL func(key string) (string, error)
+}
+
+// NewRangeReader returns a reader for length bytes of the named object
+// starting at offset.
+func (b *HTTPBucket) NewRangeReader(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	resp, err := b.get(ctx, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("server does not support range requests: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// Size returns the size of the named object, which is determined with a
+// single byte range request (as presigned URLs don't usually permit HEAD
+// requests).
+func (b *HTTPBucket) Size(ctx context.Context, key string) (int64, error) {
+	resp, err := b.get(ctx, key, 0, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/size
+		_, size, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if !ok || size == "*" {
+			return 0, fmt.Errorf("invalid content range: %q", resp.Header.Get("Content-Range"))
+		}
+
+		return strconv.ParseInt(size, 10, 64)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The object is empty.
+		return 0, nil
+	case http.StatusOK:
+		// Some servers ignore the range of empty objects.
+		if resp.ContentLength == 0 {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("server does not support range requests: %s", resp.Status)
+	default:
+		return 0, fmt.Errorf("server does not support range requests: %s", resp.Status)
+	}
+}
+
+func (b *HTTPBucket) get(ctx context.Context, key string, offset, length int64) (*http.Response, error) {
+	url, err := b.URL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	case resp.StatusCode >= 400 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package objectstore provides random access to objects in cloud object
+// storage (eg. S3, GCS, or Azure Blob Storage) using ranged reads, so that
+// archives can be opened in place with the existing Open functions (eg.
+// tarfs.Open or erofs.Open) without first being downloaded.
+//
+// Storage services are accessed through the Bucket interface, which is
+// simple to implement with the SDK of each service, so that none of them are
+// dependencies of this package. HTTPBucket supports any service that
+// accepts HTTP range requests, eg. public buckets or presigned URLs.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	_ io.ReaderAt = (*ReaderAt)(nil)
+)
+
+// Bucket is the interface implemented by object storage services.
+type Bucket interface {
+	// NewRangeReader returns a reader for length bytes of the named object
+	// starting at offset. The range is always within the object.
+	NewRangeReader(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Size returns the size in bytes of the named object.
+	Size(ctx context.Context, key string) (int64, error)
+}
+
+// ReaderAt reads an object using ranged reads, each ReadAt call issues a
+// single request. It is safe for concurrent use.
+type ReaderAt struct {
+	ctx    context.Context
+	bucket Bucket
+	key    string
+	size   int64
+}
+
+// Open returns a ReaderAt for the named object. The context is used for
+// every read, canceling it fails all subsequent reads.
+func Open(ctx context.Context, bucket Bucket, key string) (*ReaderAt, error) {
+	size, err := bucket.Size(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get size of object %q: %w", key, err)
+	}
+
+	return &ReaderAt{
+		ctx:    ctx,
+		bucket: bucket,
+		key:    key,
+		size:   size,
+	}, nil
+}
+
+// Size returns the size of the object in bytes.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of the object starting at off.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), r.size-off)
+	if length == 0 {
+		return 0, nil
+	}
+
+	body, err := r.bucket.NewRangeReader(r.ctx, r.key, off, length)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read object %q: %w", r.key, err)
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return n, fmt.Errorf("failed to read object %q: %w", r.key, err)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package objectstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/objectstore"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderAt(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, src.WriteFile("etc/motd", bytes.Repeat([]byte("hello\n"), 1000), 0o644))
+
+	var archive bytes.Buffer
+	require.NoError(t, tarfs.Create(&archive, src))
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		switch r.URL.Path {
+		case "/bucket/rootfs.tar":
+			http.ServeContent(w, r, "rootfs.tar", time.Time{}, bytes.NewReader(archive.Bytes()))
+		case "/bucket/empty":
+			http.ServeContent(w, r, "empty", time.Time{}, bytes.NewReader(nil))
+		case "/bucket/norange":
+			_, _ = w.Write(archive.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	bucket := &objectstore.HTTPBucket{
+		URL: func(key string) (string, error) {
+			return srv.URL + "/bucket/" + key, nil
+		},
+	}
+
+	ctx := context.Background()
+
+	t.Run("Open", func(t *testing.T) {
+		ra, err := objectstore.Open(ctx, bucket, "rootfs.tar")
+		require.NoError(t, err)
+		require.Equal(t, int64(archive.Len()), ra.Size())
+
+		fsys, err := tarfs.Open(ra)
+		require.NoError(t, err)
+
+		requests.Store(0)
+
+		data, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(data))
+
+		// Only the requested file is read.
+		require.Less(t, requests.Load(), int32(3))
+	})
+
+	t.Run("ReadAt", func(t *testing.T) {
+		ra, err := objectstore.Open(ctx, bucket, "rootfs.tar")
+		require.NoError(t, err)
+
+		buf := make([]byte, 16)
+		n, err := ra.ReadAt(buf, ra.Size()-8)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, 8, n)
+		require.Equal(t, archive.Bytes()[archive.Len()-8:], buf[:n])
+
+		_, err = ra.ReadAt(buf, ra.Size())
+		require.ErrorIs(t, err, io.EOF)
+
+		sr := io.NewSectionReader(ra, 0, ra.Size())
+		data, err := io.ReadAll(sr)
+		require.NoError(t, err)
+		require.Equal(t, archive.Bytes(), data)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		ra, err := objectstore.Open(ctx, bucket, "empty")
+		require.NoError(t, err)
+		require.Zero(t, ra.Size())
+
+		_, err = ra.ReadAt(make([]byte, 1), 0)
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := objectstore.Open(ctx, bucket, "missing")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("NoRangeSupport", func(t *testing.T) {
+		_, err := objectstore.Open(ctx, bucket, "norange")
+		require.ErrorContains(t, err, "does not support range requests")
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+
+		ra, err := objectstore.Open(ctx, bucket, "rootfs.tar")
+		require.NoError(t, err)
+
+		cancel()
+
+		_, err = ra.ReadAt(make([]byte, 1), 0)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Bucket", func(t *testing.T) {
+		// Buckets are simple to implement with any SDK.
+		ra, err := objectstore.Open(ctx, memBucket{"rootfs.tar": archive.Bytes()}, "rootfs.tar")
+		require.NoError(t, err)
+
+		fsys, err := tarfs.Open(ra)
+		require.NoError(t, err)
+
+		data, err := fs.ReadFile(fsys, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat("hello\n", 1000), string(data))
+	})
+}
+
+type memBucket map[string][]byte
+
+func (b memBucket) NewRangeReader(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	data, ok := b[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+func (b memBucket) Size(ctx context.Context, key string) (int64, error) {
+	data, ok := b[key]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+
+	return int64(len(data)), nil
+}
@@ -0,0 +1,329 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package ocifs provides access to the root filesystem of container images
+// stored in an OCI image layout [1] (eg. as written by "skopeo copy" or
+// "docker save"), with the layers of the image merged.
+//
+// The layout is read from an fs.FS, eg. os.DirFS for a layout directory, or a
+// tarfs.FS for a layout archive.
+//
+// [1] https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+package ocifs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"runtime"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/jsondoc"
+	"github.com/dpeckett/archivefs/tarfs"
+)
+
+// ErrNotFound is returned when a layout contains no image with the requested
+// name and platform.
+var ErrNotFound = archiveerrors.Define(fs.ErrNotExist, "image not found")
+
+// maxIndexDepth is the maximum nesting of indexes.
+const maxIndexDepth = 8
+
+// Image is a container image.
+type Image struct {
+	// Manifest is the manifest of the image.
+	Manifest Manifest
+	// Config is the configuration of the image.
+	Config Config
+	// RootFS is the root filesystem of the image, its layers merged (see
+	// archivefs.Overlay).
+	RootFS fs.FS
+
+	layers []*tarfs.FS
+}
+
+// Options configures how an image is opened.
+type Options struct {
+	// Name selects the image with the given name (see AnnotationRefName),
+	// if the layout contains more than one. Otherwise the first image
+	// for the platform is opened.
+	Name string
+	// Platform selects the image for the given platform, from multi-platform
+	// images. Defaults to linux on the architecture of the host. Images
+	// without a platform are assumed to match.
+	Platform *Platform
+	// Strict rejects layers that are unsafe to serve from untrusted sources
+	// (see tarfs.Options, symbolic links are never followed when resolving
+	// paths within a layer).
+	Strict bool
+	// Limits bounds the resources consumed when indexing each layer.
+	Limits tarfs.Limits
+}
+
+// Open opens the image for the platform of the host in an OCI image layout.
+// Layers are decompressed and spooled as they are indexed, and the digest
+// and size of every blob read is verified. The returned image must be
+// closed to release the spooled layers.
+func Open(layout fs.FS) (*Image, error) {
+	return OpenWithOptions(layout, nil)
+}
+
+// OpenWithOptions opens an image in an OCI image layout with the given
+// options.
+func OpenWithOptions(layout fs.FS, opts *Options) (*Image, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	platform := Platform{OS: "linux", Architecture: runtime.GOARCH}
+	if opts.Platform != nil {
+		platform = *opts.Platform
+	}
+
+	if err := checkLayout(layout); err != nil {
+		return nil, err
+	}
+
+	var index Index
+	if err := jsondoc.Read(layout, "index.json", &index); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var candidates []Descriptor
+	for _, desc := range index.Manifests {
+		if opts.Name == "" || desc.Annotations[AnnotationRefName] == opts.Name {
+			candidates = append(candidates, desc)
+		}
+	}
+
+	desc, err := findManifest(layout, candidates, platform, 0)
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil {
+		if opts.Name != "" {
+			return nil, fmt.Errorf("%w: %s for %s", ErrNotFound, opts.Name, platform)
+		}
+
+		return nil, fmt.Errorf("%w: for %s", ErrNotFound, platform)
+	}
+
+	img := &Image{}
+	if err := readBlobJSON(layout, *desc, &img.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if err := readBlobJSON(layout, img.Manifest.Config, &img.Config); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	tarOpts := &tarfs.Options{
+		Strict:     opts.Strict,
+		Limits:     opts.Limits,
+		Decompress: true,
+	}
+	if opts.Strict {
+		tarOpts.SymlinkPolicy = tarfs.SymlinkNoFollow
+	}
+
+	layers := make([]fs.FS, 0, len(img.Manifest.Layers))
+	for _, desc := range img.Manifest.Layers {
+		layer, err := openLayer(layout, desc, tarOpts)
+		if err != nil {
+			_ = img.Close()
+			return nil, fmt.Errorf("failed to open layer %s: %w", desc.Digest, err)
+		}
+
+		img.layers = append(img.layers, layer)
+		layers = append(layers, layer)
+	}
+
+	img.RootFS = archivefs.Overlay(layers...)
+
+	return img, nil
+}
+
+// Close releases the spooled layers of the image.
+func (img *Image) Close() error {
+	var errs []error
+	for _, layer := range img.layers {
+		errs = append(errs, layer.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkLayout checks the version of a layout.
+func checkLayout(layout fs.FS) error {
+	var marker struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := jsondoc.Read(layout, "oci-layout", &marker); err != nil {
+		return fmt.Errorf("failed to read oci-layout: %w", err)
+	}
+
+	if !strings.HasPrefix(marker.ImageLayoutVersion, "1.") {
+		return fmt.Errorf("%w: image layout version %q", archiveerrors.ErrUnsupportedFeature, marker.ImageLayoutVersion)
+	}
+
+	return nil
+}
+
+// findManifest returns the descriptor of the first image manifest for the
+// platform, searching nested indexes, or nil if there is none.
+func findManifest(layout fs.FS, descs []Descriptor, platform Platform, depth int) (*Descriptor, error) {
+	if depth > maxIndexDepth {
+		return nil, fmt.Errorf("%w: indexes nested more than %d deep", archiveerrors.ErrLimitExceeded, maxIndexDepth)
+	}
+
+	for _, desc := range descs {
+		if desc.Platform != nil && !platform.matches(*desc.Platform) {
+			continue
+		}
+
+		switch {
+		case isManifest(desc.MediaType):
+			return &desc, nil
+		case isIndex(desc.MediaType):
+			var index Index
+			if err := readBlobJSON(layout, desc, &index); err != nil {
+				return nil, fmt.Errorf("failed to read index: %w", err)
+			}
+
+			found, err := findManifest(layout, index.Manifests, platform, depth+1)
+			if err != nil || found != nil {
+				return found, err
+			}
+		}
+
+		// Other artifacts (eg. signatures) are ignored.
+	}
+
+	return nil, nil
+}
+
+// openLayer opens the tar archive of a layer.
+func openLayer(layout fs.FS, desc Descriptor, opts *tarfs.Options) (*tarfs.FS, error) {
+	if !isLayer(desc.MediaType) {
+		return nil, fmt.Errorf("%w: layer media type %s", archiveerrors.ErrUnsupportedFeature, desc.MediaType)
+	}
+
+	r, err := openBlob(layout, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	layer, err := tarfs.OpenReader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read any trailing data (eg. padding), so the digest is verified.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		_ = layer.Close()
+		return nil, err
+	}
+
+	return layer, nil
+}
+
+// readBlobJSON decodes the JSON document in a blob.
+func readBlobJSON(layout fs.FS, desc Descriptor, v any) error {
+	if desc.Size > jsondoc.MaxSize {
+		return fmt.Errorf("%w: blob %s is %d bytes", archiveerrors.ErrLimitExceeded, desc.Digest, desc.Size)
+	}
+
+	r, err := openBlob(layout, desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return jsondoc.Decode(r, "blob "+desc.Digest, v)
+}
+
+// openBlob opens the blob referenced by a descriptor. Reads fail once the
+// blob has been read entirely if its size or digest do not match the
+// descriptor.
+func openBlob(layout fs.FS, desc Descriptor) (io.ReadCloser, error) {
+	algorithm, encoded, _ := strings.Cut(desc.Digest, ":")
+
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("%w: digest algorithm %q", archiveerrors.ErrUnsupportedFeature, algorithm)
+	}
+
+	if len(encoded) != hex.EncodedLen(h.Size()) || strings.ToLower(encoded) != encoded {
+		return nil, fmt.Errorf("invalid digest %q: %w", desc.Digest, fs.ErrInvalid)
+	}
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %w", desc.Digest, fs.ErrInvalid)
+	}
+
+	if desc.Size < 0 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: -1, Detail: fmt.Sprintf("blob %s has negative size", desc.Digest)}
+	}
+
+	f, err := layout.Open("blobs/" + algorithm + "/" + encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobReader{
+		r:    io.TeeReader(io.LimitReader(f, desc.Size+1), h),
+		f:    f,
+		h:    h,
+		desc: desc,
+		want: encoded,
+	}, nil
+}
+
+// blobReader verifies the size and digest of a blob once it reaches EOF.
+type blobReader struct {
+	r    io.Reader
+	f    fs.File
+	h    hash.Hash
+	n    int64
+	desc Descriptor
+	want string
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.n += int64(n)
+
+	if br.n > br.desc.Size || (errors.Is(err, io.EOF) && br.n != br.desc.Size) {
+		return n, &archiveerrors.ErrCorrupted{Offset: -1, Detail: fmt.Sprintf("blob %s is not %d bytes", br.desc.Digest, br.desc.Size)}
+	}
+
+	if errors.Is(err, io.EOF) {
+		if got := hex.EncodeToString(br.h.Sum(nil)); got != br.want {
+			return n, fmt.Errorf("blob %s: %w", br.desc.Digest, tarfs.ErrDigestMismatch)
+		}
+	}
+
+	return n, err
+}
+
+func (br *blobReader) Close() error {
+	return br.f.Close()
+}
@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs/archivefstest"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/ocifs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCIFS(t *testing.T) {
+	layout := memfs.New()
+	require.NoError(t, layout.MkdirAll("blobs/sha256", 0o755))
+	require.NoError(t, layout.WriteFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644))
+
+	base := writeLayer(t, layout, ocifs.MediaTypeLayerGzip, map[string]string{
+		"etc/hostname": "base\n",
+		"etc/motd":     "hello\n",
+		"var/lib/a":    "a\n",
+	})
+	top := writeLayer(t, layout, ocifs.MediaTypeLayer, map[string]string{
+		"etc/hostname":         "top\n",
+		"etc/.wh.motd":         "",
+		"var/lib/.wh..wh..opq": "",
+		"var/lib/b":            "b\n",
+	})
+
+	amd64 := writeImage(t, layout, "amd64", base, top)
+	arm64 := writeImage(t, layout, "arm64", base)
+
+	list := writeJSON(t, layout, ocifs.MediaTypeIndex, ocifs.Index{
+		SchemaVersion: 2,
+		MediaType:     ocifs.MediaTypeIndex,
+		Manifests:     []ocifs.Descriptor{amd64, arm64},
+	})
+	list.Annotations = map[string]string{ocifs.AnnotationRefName: "latest"}
+
+	writeIndex(t, layout, list)
+
+	img, err := ocifs.OpenWithOptions(layout, &ocifs.Options{
+		Platform: &ocifs.Platform{OS: "linux", Architecture: "amd64"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, img.Close())
+	})
+
+	require.Equal(t, "amd64", img.Config.Architecture)
+	require.Equal(t, []string{"/bin/sh"}, img.Config.Config.Cmd)
+	require.Len(t, img.Manifest.Layers, 2)
+
+	require.NoError(t, archivefstest.TestFS(img.RootFS, "etc/hostname", "var/lib/b"))
+
+	data, err := fs.ReadFile(img.RootFS, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "top\n", string(data))
+
+	_, err = fs.Stat(img.RootFS, "etc/motd")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	entries, err := fs.ReadDir(img.RootFS, "var/lib")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "b", entries[0].Name())
+
+	t.Run("Platform", func(t *testing.T) {
+		img, err := ocifs.OpenWithOptions(layout, &ocifs.Options{
+			Name:     "latest",
+			Platform: &ocifs.Platform{OS: "linux", Architecture: "arm64"},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, img.Close())
+		})
+
+		require.Equal(t, "arm64", img.Config.Architecture)
+
+		data, err := fs.ReadFile(img.RootFS, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "hello\n", string(data))
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := ocifs.OpenWithOptions(layout, &ocifs.Options{
+			Platform: &ocifs.Platform{OS: "linux", Architecture: "riscv64"},
+		})
+		require.ErrorIs(t, err, ocifs.ErrNotFound)
+
+		_, err = ocifs.OpenWithOptions(layout, &ocifs.Options{
+			Name:     "stable",
+			Platform: &ocifs.Platform{OS: "linux", Architecture: "amd64"},
+		})
+		require.ErrorIs(t, err, ocifs.ErrNotFound)
+	})
+
+	t.Run("DigestMismatch", func(t *testing.T) {
+		corrupted := copyLayout(t, layout)
+
+		name := "blobs/sha256/" + top.Digest[len("sha256:"):]
+		data, err := fs.ReadFile(corrupted, name)
+		require.NoError(t, err)
+
+		data = bytes.Replace(data, []byte("top\n"), []byte("bad\n"), 1)
+		require.NoError(t, corrupted.WriteFile(name, data, 0o644))
+
+		_, err = ocifs.OpenWithOptions(corrupted, &ocifs.Options{
+			Platform: &ocifs.Platform{OS: "linux", Architecture: "amd64"},
+		})
+		require.ErrorIs(t, err, tarfs.ErrDigestMismatch)
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		corrupted := copyLayout(t, layout)
+
+		name := "blobs/sha256/" + base.Digest[len("sha256:"):]
+		data, err := fs.ReadFile(corrupted, name)
+		require.NoError(t, err)
+		require.NoError(t, corrupted.WriteFile(name, append(data, 0), 0o644))
+
+		_, err = ocifs.OpenWithOptions(corrupted, &ocifs.Options{
+			Platform: &ocifs.Platform{OS: "linux", Architecture: "arm64"},
+		})
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+
+	t.Run("UnsupportedLayer", func(t *testing.T) {
+		layout := copyLayout(t, layout)
+
+		encrypted := base
+		encrypted.MediaType = ocifs.MediaTypeLayerGzip + "+encrypted"
+		writeIndex(t, layout, writeImage(t, layout, "amd64", encrypted))
+
+		_, err := ocifs.OpenWithOptions(layout, &ocifs.Options{
+			Platform: &ocifs.Platform{OS: "linux", Architecture: "amd64"},
+		})
+		require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+	})
+
+	t.Run("InvalidDigest", func(t *testing.T) {
+		layout := copyLayout(t, layout)
+
+		writeIndex(t, layout, ocifs.Descriptor{
+			MediaType: ocifs.MediaTypeManifest,
+			Digest:    "sha256:../../../../etc/passwd",
+		})
+
+		_, err := ocifs.Open(layout)
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	})
+}
+
+// writeLayer writes a tar layer containing the given files to the layout.
+func writeLayer(t *testing.T, layout *memfs.FS, mediaType string, files map[string]string) ocifs.Descriptor {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(contents)),
+		}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	data := buf.Bytes()
+	if mediaType == ocifs.MediaTypeLayerGzip {
+		var gzBuf bytes.Buffer
+		gw := gzip.NewWriter(&gzBuf)
+		_, err := gw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		data = gzBuf.Bytes()
+	}
+
+	return writeBlob(t, layout, mediaType, data)
+}
+
+// writeImage writes the config and manifest of an image to the layout.
+func writeImage(t *testing.T, layout *memfs.FS, arch string, layers ...ocifs.Descriptor) ocifs.Descriptor {
+	platform := ocifs.Platform{OS: "linux", Architecture: arch}
+
+	config := writeJSON(t, layout, ocifs.MediaTypeConfig, ocifs.Config{
+		Platform: platform,
+		Config:   ocifs.ContainerConfig{Cmd: []string{"/bin/sh"}},
+		RootFS:   ocifs.RootFS{Type: "layers"},
+	})
+
+	desc := writeJSON(t, layout, ocifs.MediaTypeManifest, ocifs.Manifest{
+		SchemaVersion: 2,
+		MediaType:     ocifs.MediaTypeManifest,
+		Config:        config,
+		Layers:        layers,
+	})
+	desc.Platform = &platform
+
+	return desc
+}
+
+// writeIndex writes the index of the layout.
+func writeIndex(t *testing.T, layout *memfs.FS, manifests ...ocifs.Descriptor) {
+	data, err := json.Marshal(ocifs.Index{SchemaVersion: 2, Manifests: manifests})
+	require.NoError(t, err)
+	require.NoError(t, layout.WriteFile("index.json", data, 0o644))
+}
+
+func writeJSON(t *testing.T, layout *memfs.FS, mediaType string, v any) ocifs.Descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return writeBlob(t, layout, mediaType, data)
+}
+
+func writeBlob(t *testing.T, layout *memfs.FS, mediaType string, data []byte) ocifs.Descriptor {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	require.NoError(t, layout.WriteFile("blobs/sha256/"+digest, data, 0o644))
+
+	return ocifs.Descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + digest,
+		Size:      int64(len(data)),
+	}
+}
+
+// copyLayout returns a copy of a layout, so it can be modified.
+func copyLayout(t *testing.T, layout *memfs.FS) *memfs.FS {
+	dst := memfs.New()
+	require.NoError(t, fs.WalkDir(layout, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		if d.IsDir() {
+			return dst.MkdirAll(name, 0o755)
+		}
+
+		data, err := fs.ReadFile(layout, name)
+		if err != nil {
+			return err
+		}
+
+		return dst.WriteFile(name, data, 0o644)
+	}))
+
+	return dst
+}
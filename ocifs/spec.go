@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package ocifs
+
+import "strings"
+
+// Media types of the documents and layers of an image. The equivalent Docker
+// media types are also supported.
+const (
+	MediaTypeIndex         = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest      = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig        = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer         = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeLayerZstd     = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeDockerList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerImage   = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerLayer   = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeign = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// AnnotationRefName is the annotation holding the name (usually the tag) of
+// an image in the index of a layout.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// Descriptor references a blob of a layout, by its digest.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform is the operating system and CPU architecture an image runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns the platform in the form "os/architecture[/variant]".
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+
+	return s
+}
+
+// matches reports whether the platform of an image satisfies the platform
+// p. Any variant is accepted if p has none.
+func (p Platform) matches(other Platform) bool {
+	return p.OS == other.OS && p.Architecture == other.Architecture &&
+		(p.Variant == "" || p.Variant == other.Variant)
+}
+
+// Index lists the images of a layout, or of a multi-platform image.
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest describes the configuration and layers of an image.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Config is the configuration of an image.
+type Config struct {
+	Platform
+	Created string          `json:"created,omitempty"`
+	Author  string          `json:"author,omitempty"`
+	Config  ContainerConfig `json:"config"`
+	RootFS  RootFS          `json:"rootfs"`
+}
+
+// ContainerConfig holds the defaults for containers run from an image.
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// RootFS lists the digests of the uncompressed layers of an image.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeIndex || mediaType == mediaTypeDockerList
+}
+
+func isManifest(mediaType string) bool {
+	return mediaType == MediaTypeManifest || mediaType == mediaTypeDockerImage
+}
+
+// isLayer reports whether mediaType is a (possibly compressed) tar layer,
+// including non-distributable layers.
+func isLayer(mediaType string) bool {
+	switch mediaType {
+	case mediaTypeDockerLayer, mediaTypeDockerForeign:
+		return true
+	}
+
+	mediaType = strings.Replace(mediaType, ".nondistributable.", ".", 1)
+	return mediaType == MediaTypeLayer || mediaType == MediaTypeLayerGzip || mediaType == MediaTypeLayerZstd
+}
@@ -0,0 +1,409 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/dpeckett/archivefs/internal/readdir"
+)
+
+// WhiteoutFormat is the convention used by overlay layers to record
+// deleted entries.
+type WhiteoutFormat int
+
+const (
+	// WhiteoutOCI uses OCI image layer whiteouts, a file named ".wh.<name>"
+	// deletes name from lower layers, and a file named ".wh..wh..opq" makes
+	// its directory opaque (hiding the contents of lower layers).
+	WhiteoutOCI WhiteoutFormat = iota
+	// WhiteoutOverlayfs uses Linux overlayfs whiteouts, a character device
+	// with device number 0/0 deletes the entry from lower layers, and a
+	// directory with the trusted.overlay.opaque extended attribute set to
+	// "y" is opaque.
+	WhiteoutOverlayfs
+	// WhiteoutNone disables whiteouts, the layers are simply merged.
+	WhiteoutNone
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+)
+
+// OverlayOptions configures an overlay filesystem.
+type OverlayOptions struct {
+	// Whiteouts is the convention used by layers to record deleted entries.
+	Whiteouts WhiteoutFormat
+}
+
+var (
+	_ fs.ReadDirFS = (*overlayFS)(nil)
+	_ fs.StatFS    = (*overlayFS)(nil)
+	_ ReadLinkFS   = (*overlayFS)(nil)
+)
+
+// Overlay returns a read-only filesystem that merges the given layers, as
+// for container image layers. The first layer is the lowest, entries in
+// later layers replace those in earlier layers, and directories are merged.
+// Entries are deleted using OCI whiteouts.
+func Overlay(layers ...fs.FS) fs.FS {
+	return OverlayWithOptions(nil, layers...)
+}
+
+// OverlayWithOptions returns a read-only filesystem that merges the given
+// layers. See Overlay for details.
+func OverlayWithOptions(opts *OverlayOptions, layers ...fs.FS) fs.FS {
+	if opts == nil {
+		opts = &OverlayOptions{}
+	}
+
+	return &overlayFS{layers: layers, whiteouts: opts.Whiteouts}
+}
+
+type overlayFS struct {
+	layers    []fs.FS
+	whiteouts WhiteoutFormat
+}
+
+func (fsys *overlayFS) Open(name string) (fs.File, error) {
+	e, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.fi.IsDir() {
+		return fsys.layers[e.layers[0]].Open(e.path)
+	}
+
+	return &overlayDir{fsys: fsys, e: e}, nil
+}
+
+func (fsys *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.fi, nil
+}
+
+func (fsys *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	return fsys.readDir(e)
+}
+
+func (fsys *overlayFS) ReadLink(name string) (string, error) {
+	e, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if e.fi.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return readLink(fsys.layers[e.layers[0]], e.path)
+}
+
+func (fsys *overlayFS) StatLink(name string) (fs.FileInfo, error) {
+	e, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.fi, nil
+}
+
+// overlayEntry is an entry in the merged filesystem.
+type overlayEntry struct {
+	path string
+	fi   fs.FileInfo
+	// layers holds the indices of the layers that contribute to the entry,
+	// topmost first. Only directories have more than one layer.
+	layers []int
+}
+
+// resolve looks up the entry for name in the merged filesystem, following
+// symbolic links (including the final element, if follow is set).
+func (fsys *overlayFS) resolve(op, name string, follow bool) (*overlayEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	root, err := fsys.root()
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var links int
+	e := root
+	remaining := name
+	if remaining == "." {
+		remaining = ""
+	}
+
+	for remaining != "" {
+		var elem string
+		elem, remaining, _ = strings.Cut(remaining, "/")
+
+		if !e.fi.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+
+		child, err := fsys.lookup(e, elem)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		if child.fi.Mode()&fs.ModeSymlink != 0 && (remaining != "" || follow) {
+			links++
+			if links > MaxSymlinkHops {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+
+			target, err := readLink(fsys.layers[child.layers[0]], child.path)
+			if err != nil {
+				return nil, err
+			}
+
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(child.path), target)
+			}
+
+			// Restart resolution from the target of the link, links are
+			// confined to the root of the filesystem.
+			e, remaining = root, strings.TrimPrefix(path.Join("/", target, remaining), "/")
+			continue
+		}
+
+		e = child
+	}
+
+	return e, nil
+}
+
+// root returns the root directory of the merged filesystem.
+func (fsys *overlayFS) root() (*overlayEntry, error) {
+	e := &overlayEntry{path: "."}
+
+	for i := len(fsys.layers) - 1; i >= 0; i-- {
+		fi, err := fs.Stat(fsys.layers[i], ".")
+		if err != nil {
+			return nil, err
+		}
+
+		if e.fi == nil {
+			e.fi = fi
+		}
+		e.layers = append(e.layers, i)
+
+		if fsys.isOpaque(fsys.layers[i], ".", fi) {
+			break
+		}
+	}
+
+	if e.fi == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	return e, nil
+}
+
+// lookup finds the named child of a merged directory.
+func (fsys *overlayFS) lookup(dir *overlayEntry, name string) (*overlayEntry, error) {
+	if name == whiteoutOpaque || (fsys.whiteouts == WhiteoutOCI && strings.HasPrefix(name, whiteoutPrefix)) {
+		return nil, fs.ErrNotExist
+	}
+
+	childPath := path.Join(dir.path, name)
+
+	var e *overlayEntry
+	for _, i := range dir.layers {
+		layer := fsys.layers[i]
+
+		fi, err := lstat(layer, childPath)
+		if err == nil {
+			if fsys.isWhiteout(fi) {
+				break
+			}
+
+			if e == nil {
+				e = &overlayEntry{path: childPath, fi: fi}
+			} else if !fi.IsDir() {
+				// A file in a lower layer is hidden by a directory.
+				break
+			}
+			e.layers = append(e.layers, i)
+
+			if !fi.IsDir() || fsys.isOpaque(layer, childPath, fi) {
+				break
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		// Whiteouts only apply to lower layers.
+		if fsys.whiteouts == WhiteoutOCI {
+			if _, err := lstat(layer, path.Join(dir.path, whiteoutPrefix+name)); err == nil {
+				break
+			}
+		}
+	}
+
+	if e == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	return e, nil
+}
+
+// readDir returns the merged entries of a directory, sorted by name.
+func (fsys *overlayFS) readDir(dir *overlayEntry) ([]fs.DirEntry, error) {
+	seen := map[string]bool{}
+
+	var entries []fs.DirEntry
+	for _, i := range dir.layers {
+		layerEntries, err := fs.ReadDir(fsys.layers[i], dir.path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Entries are whited out for lower layers only.
+		var whiteouts []string
+		for _, de := range layerEntries {
+			name := de.Name()
+			if seen[name] {
+				continue
+			}
+
+			if fsys.whiteouts == WhiteoutOCI && strings.HasPrefix(name, whiteoutPrefix) {
+				if name != whiteoutOpaque {
+					whiteouts = append(whiteouts, strings.TrimPrefix(name, whiteoutPrefix))
+				}
+				continue
+			}
+
+			if fsys.whiteouts == WhiteoutOverlayfs && de.Type()&fs.ModeCharDevice != 0 {
+				fi, err := de.Info()
+				if err != nil {
+					return nil, err
+				}
+
+				if fsys.isWhiteout(fi) {
+					whiteouts = append(whiteouts, name)
+					continue
+				}
+			}
+
+			seen[name] = true
+			entries = append(entries, de)
+		}
+
+		for _, name := range whiteouts {
+			seen[name] = true
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+// isWhiteout reports whether fi is an overlayfs whiteout.
+func (fsys *overlayFS) isWhiteout(fi fs.FileInfo) bool {
+	if fsys.whiteouts != WhiteoutOverlayfs || fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+
+	major, minor, ok := LookupDevice(fi)
+	return ok && major == 0 && minor == 0
+}
+
+// isOpaque reports whether the directory at name hides the contents of
+// lower layers.
+func (fsys *overlayFS) isOpaque(layer fs.FS, name string, fi fs.FileInfo) bool {
+	switch fsys.whiteouts {
+	case WhiteoutOCI:
+		_, err := lstat(layer, path.Join(name, whiteoutOpaque))
+		return err == nil
+	case WhiteoutOverlayfs:
+		return Xattrs(fi)[opaqueXattr] == "y"
+	}
+
+	return false
+}
+
+// overlayDir is an open directory in the merged filesystem.
+type overlayDir struct {
+	fsys *overlayFS
+	e    *overlayEntry
+	readdir.Entries
+	read bool
+}
+
+func (d *overlayDir) Stat() (fs.FileInfo, error) {
+	return d.e.fi, nil
+}
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.e.path, Err: syscall.EISDIR}
+}
+
+func (d *overlayDir) Close() error {
+	return nil
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.readDir(d.e)
+		if err != nil {
+			return nil, err
+		}
+		d.Entries, d.read = readdir.New(entries), true
+	}
+
+	return d.Entries.ReadDir(n)
+}
+
+// lstat returns a FileInfo describing the named file, without following
+// symbolic links if supported by the filesystem.
+func lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if linkFS, ok := fsys.(ReadLinkFS); ok {
+		return linkFS.StatLink(name)
+	}
+
+	return fs.Stat(fsys, name)
+}
+
+func readLink(fsys fs.FS, name string) (string, error) {
+	linkFS, ok := fsys.(ReadLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	return linkFS.ReadLink(name)
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlay(t *testing.T) {
+	t.Run("OCI", func(t *testing.T) {
+		lower := memfs.New()
+		require.NoError(t, lower.MkdirAll("etc/ssl", 0o755))
+		require.NoError(t, lower.MkdirAll("var/cache", 0o755))
+		require.NoError(t, lower.WriteFile("etc/hostname", []byte("lower"), 0o644))
+		require.NoError(t, lower.WriteFile("etc/passwd", []byte("root"), 0o644))
+		require.NoError(t, lower.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o644))
+		require.NoError(t, lower.WriteFile("var/cache/a", []byte("a"), 0o644))
+
+		upper := memfs.New()
+		require.NoError(t, upper.MkdirAll("etc", 0o755))
+		require.NoError(t, upper.MkdirAll("var/cache", 0o755))
+		require.NoError(t, upper.WriteFile("etc/hostname", []byte("upper"), 0o644))
+		require.NoError(t, upper.WriteFile("etc/.wh.passwd", nil, 0o644))
+		require.NoError(t, upper.WriteFile("var/cache/.wh..wh..opq", nil, 0o644))
+		require.NoError(t, upper.WriteFile("var/cache/b", []byte("b"), 0o644))
+		require.NoError(t, upper.Symlink("etc/hostname", "hostname"))
+
+		fsys := archivefs.Overlay(lower, upper)
+
+		data, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "upper", string(data))
+
+		data, err = fs.ReadFile(fsys, "hostname")
+		require.NoError(t, err)
+		require.Equal(t, "upper", string(data))
+
+		_, err = fs.Stat(fsys, "etc/passwd")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fs.Stat(fsys, "etc/.wh.passwd")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		require.Equal(t, []string{"hostname", "ssl"}, readDirNames(t, fsys, "etc"))
+		require.Equal(t, []string{"b"}, readDirNames(t, fsys, "var/cache"))
+
+		target, err := fsys.(archivefs.ReadLinkFS).ReadLink("hostname")
+		require.NoError(t, err)
+		require.Equal(t, "etc/hostname", target)
+
+		require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "etc/ssl/cert.pem", "var/cache/b"))
+	})
+
+	t.Run("Overlayfs", func(t *testing.T) {
+		lower := memfs.New()
+		require.NoError(t, lower.MkdirAll("opaque", 0o755))
+		require.NoError(t, lower.WriteFile("deleted", []byte("deleted"), 0o644))
+		require.NoError(t, lower.WriteFile("kept", []byte("kept"), 0o644))
+		require.NoError(t, lower.WriteFile("opaque/hidden", []byte("hidden"), 0o644))
+
+		upper := memfs.New()
+		require.NoError(t, upper.MkdirAll("opaque", 0o755))
+		require.NoError(t, upper.SetXattr("opaque", "trusted.overlay.opaque", "y"))
+		require.NoError(t, upper.Mknod("deleted", fs.ModeDevice|fs.ModeCharDevice, 0, 0))
+		require.NoError(t, upper.WriteFile("opaque/visible", []byte("visible"), 0o644))
+
+		fsys := archivefs.OverlayWithOptions(&archivefs.OverlayOptions{
+			Whiteouts: archivefs.WhiteoutOverlayfs,
+		}, lower, upper)
+
+		_, err := fs.Stat(fsys, "deleted")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		require.Equal(t, []string{"kept", "opaque"}, readDirNames(t, fsys, "."))
+		require.Equal(t, []string{"visible"}, readDirNames(t, fsys, "opaque"))
+	})
+
+	t.Run("None", func(t *testing.T) {
+		lower := fstest.MapFS{
+			"a.txt": {Data: []byte("a")},
+		}
+		upper := fstest.MapFS{
+			".wh.a.txt": {Data: []byte{}},
+		}
+
+		fsys := archivefs.OverlayWithOptions(&archivefs.OverlayOptions{
+			Whiteouts: archivefs.WhiteoutNone,
+		}, lower, upper)
+
+		require.Equal(t, []string{".wh.a.txt", "a.txt"}, readDirNames(t, fsys, "."))
+	})
+}
+
+func readDirNames(t *testing.T, fsys fs.FS, name string) []string {
+	entries, err := fs.ReadDir(fsys, name)
+	require.NoError(t, err)
+
+	var names []string
+	for _, de := range entries {
+		names = append(names, de.Name())
+	}
+
+	return names
+}
@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+)
+
+// Owner may be implemented by the value returned from fs.FileInfo.Sys() to
+// supply the numeric owner of a file, eg. when creating an archive from a
+// filesystem.
+type Owner interface {
+	Owner() (uid, gid int)
+}
+
+// LookupOwner returns the numeric owner of a file, if known. It is taken from
+// a *tar.Header, an Owner implementation, or a platform specific stat
+// structure returned by fi.Sys().
+func LookupOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		return sys.Uid, sys.Gid, true
+	case Owner:
+		uid, gid = sys.Owner()
+		return uid, gid, true
+	}
+
+	return sysOwner(fi.Sys())
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"syscall"
+)
+
+// mapSysOwner returns a copy of sys with its owner mapped, if sys is a
+// platform specific type that records ownership.
+func mapSysOwner(sys any, mapOwner func(uid, gid int) (int, int)) (any, bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return nil, false
+	}
+
+	mapped := *stat
+	uid, gid := mapOwner(int(stat.Uid), int(stat.Gid))
+	mapped.Uid, mapped.Gid = uint32(uid), uint32(gid)
+
+	return &mapped, true
+}
+
+// sysOwner returns the owner recorded by sys, if it is a platform specific
+// type that records ownership.
+func sysOwner(sys any) (uid, gid int, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return int(stat.Uid), int(stat.Gid), true
+}
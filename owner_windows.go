@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+// mapSysOwner returns a copy of sys with its owner mapped, if sys is a
+// platform specific type that records ownership. Windows does not have
+// numeric owners.
+func mapSysOwner(sys any, mapOwner func(uid, gid int) (int, int)) (any, bool) {
+	return nil, false
+}
+
+// sysOwner returns the owner recorded by sys, if it is a platform specific
+// type that records ownership. Windows does not have numeric owners.
+func sysOwner(sys any) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
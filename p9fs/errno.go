@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package p9fs
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// errno is a Linux error number, as returned in Rlerror messages
+// (regardless of the platform the server is running on).
+type errno uint32
+
+const (
+	eNOENT       errno = 2
+	eIO          errno = 5
+	eBADF        errno = 9
+	eACCES       errno = 13
+	eEXIST       errno = 17
+	eNOTDIR      errno = 20
+	eISDIR       errno = 21
+	eINVAL       errno = 22
+	eROFS        errno = 30
+	eRANGE       errno = 34
+	eNAMETOOLONG errno = 36
+	eNODATA      errno = 61
+	eOPNOTSUPP   errno = 95
+)
+
+func (e errno) Error() string {
+	switch e {
+	case eNOENT:
+		return "no such file or directory"
+	case eIO:
+		return "input/output error"
+	case eBADF:
+		return "bad file descriptor"
+	case eACCES:
+		return "permission denied"
+	case eEXIST:
+		return "file exists"
+	case eNOTDIR:
+		return "not a directory"
+	case eISDIR:
+		return "is a directory"
+	case eINVAL:
+		return "invalid argument"
+	case eROFS:
+		return "read-only file system"
+	case eRANGE:
+		return "numerical result out of range"
+	case eNAMETOOLONG:
+		return "file name too long"
+	case eNODATA:
+		return "no data available"
+	case eOPNOTSUPP:
+		return "operation not supported"
+	}
+
+	return "unknown error"
+}
+
+// toErrno converts an error to the closest matching Linux error number.
+func toErrno(err error) errno {
+	var e errno
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, fs.ErrNotExist):
+		return eNOENT
+	case errors.Is(err, fs.ErrPermission):
+		return eACCES
+	case errors.Is(err, fs.ErrExist):
+		return eEXIST
+	case errors.Is(err, fs.ErrInvalid):
+		return eINVAL
+	case errors.Is(err, errors.ErrUnsupported):
+		return eOPNOTSUPP
+	}
+
+	return eIO
+}
@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package p9fs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Version is the protocol version implemented by the server.
+const Version = "9P2000.L"
+
+// Message types, see https://github.com/chaos/diod/blob/master/protocol.md
+const (
+	msgTlerror      = 6
+	msgRlerror      = 7
+	msgTstatfs      = 8
+	msgRstatfs      = 9
+	msgTlopen       = 12
+	msgRlopen       = 13
+	msgTlcreate     = 14
+	msgTsymlink     = 16
+	msgTmknod       = 18
+	msgTrename      = 20
+	msgTreadlink    = 22
+	msgRreadlink    = 23
+	msgTgetattr     = 24
+	msgRgetattr     = 25
+	msgTsetattr     = 26
+	msgTxattrwalk   = 30
+	msgRxattrwalk   = 31
+	msgTxattrcreate = 32
+	msgTreaddir     = 40
+	msgRreaddir     = 41
+	msgTfsync       = 50
+	msgRfsync       = 51
+	msgTlock        = 52
+	msgRlock        = 53
+	msgTgetlock     = 54
+	msgRgetlock     = 55
+	msgTlink        = 70
+	msgTmkdir       = 72
+	msgTrenameat    = 74
+	msgTunlinkat    = 76
+	msgTversion     = 100
+	msgRversion     = 101
+	msgTauth        = 102
+	msgTattach      = 104
+	msgRattach      = 105
+	msgTflush       = 108
+	msgRflush       = 109
+	msgTwalk        = 110
+	msgRwalk        = 111
+	msgTread        = 116
+	msgRread        = 117
+	msgTwrite       = 118
+	msgTclunk       = 120
+	msgRclunk       = 121
+	msgTremove      = 122
+)
+
+const (
+	// noTag is the tag used for Tversion messages.
+	noTag = 0xffff
+	// noFid indicates the absence of a fid (eg. the afid of Tattach).
+	noFid = 0xffffffff
+	// headerSize is the size of a message header: size[4] type[1] tag[2].
+	headerSize = 7
+	// minMessageSize is the smallest msize a client may negotiate.
+	minMessageSize = 4096
+	// maxIOSize is the maximum number of bytes returned by Tread and
+	// Treaddir, regardless of the negotiated msize.
+	maxIOSize = 1 << 20
+	// maxWalkElements is the maximum number of names in a Twalk message.
+	maxWalkElements = 16
+)
+
+// Qid types.
+const (
+	qidTypeDir     = 0x80
+	qidTypeSymlink = 0x02
+	qidTypeFile    = 0x00
+)
+
+// Directory entry types, as for the d_type field of struct dirent.
+const (
+	dtFIFO = 1
+	dtCHR  = 2
+	dtDIR  = 4
+	dtBLK  = 6
+	dtREG  = 8
+	dtLNK  = 10
+	dtSOCK = 12
+)
+
+const (
+	// getattrBasic is the set of fields returned by Rgetattr.
+	getattrBasic = 0x000007ff
+	// lockSuccess is the status returned by Rlock.
+	lockSuccess = 0
+	// lockTypeUnlock is the lock type returned by Rgetlock.
+	lockTypeUnlock = 2
+	// v9fsMagic is the filesystem type returned by Rstatfs.
+	v9fsMagic = 0x01021997
+	// openAccessMode masks the access mode of Tlopen flags.
+	openAccessMode = 0o3
+	// openTrunc is the Linux O_TRUNC flag.
+	openTrunc = 0o1000
+)
+
+var errShortMessage = errors.New("short message")
+
+// qid uniquely identifies a file on the server.
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// decoder reads the fields of a message, any error is sticky.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = errShortMessage
+		return make([]byte, n)
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+// encoder builds a message.
+type encoder struct {
+	buf []byte
+}
+
+// newEncoder returns an encoder for a message of the given type, the size
+// is filled in by bytes.
+func newEncoder(typ uint8, tag uint16) *encoder {
+	e := &encoder{buf: make([]byte, 4, 64)}
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+func (e *encoder) bytes() []byte {
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
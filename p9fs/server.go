@@ -0,0 +1,885 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package p9fs serves any filesystem read-only using the 9P2000.L protocol,
+// allowing archives to be mounted inside virtual machines and containers
+// (eg. via virtio-9p or a socket) without first extracting them.
+package p9fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/internal/vfs"
+)
+
+// DefaultMaxMessageSize is the default maximum size of a message.
+const DefaultMaxMessageSize = 1 << 20
+
+// Options configures a 9P server.
+type Options struct {
+	// MaxMessageSize is the maximum size of a message (ie. msize), the
+	// client may negotiate a smaller size. If zero, DefaultMaxMessageSize
+	// is used. Sizes below 4096 bytes are raised to 4096.
+	MaxMessageSize uint32
+}
+
+// Server serves a filesystem using the 9P2000.L protocol. Symbolic links are
+// only supported if the filesystem implements archivefs.ReadLinkFS.
+type Server struct {
+	fsys  fs.FS
+	msize uint32
+}
+
+// NewServer returns a server for fsys.
+func NewServer(fsys fs.FS, opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	msize := opts.MaxMessageSize
+	if msize == 0 {
+		msize = DefaultMaxMessageSize
+	}
+	msize = max(msize, minMessageSize)
+
+	return &Server{fsys: fsys, msize: msize}
+}
+
+// Serve accepts connections on l, serving each in a new goroutine. It
+// returns when l.Accept fails, eg. because the listener was closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			_ = s.ServeConn(rwc)
+		}()
+	}
+}
+
+// ServeConn serves requests on a single connection (eg. a virtio channel or
+// a socket) until it is closed by the client, it closes rwc before
+// returning. Requests are processed concurrently.
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	c := &conn{
+		fsys:     s.fsys,
+		w:        rwc,
+		msize:    s.msize,
+		fids:     map[uint32]*fid{},
+		inflight: map[uint16]chan struct{}{},
+	}
+	defer func() {
+		_ = rwc.Close()
+		c.wg.Wait()
+		c.clunkAll()
+	}()
+
+	r := bufio.NewReader(rwc)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < headerSize || n > s.msize {
+			return fmt.Errorf("invalid message size: %d", n)
+		}
+
+		buf := make([]byte, n-4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+
+		typ, tag := buf[0], binary.LittleEndian.Uint16(buf[1:])
+		d := &decoder{buf: buf[3:]}
+
+		// Version negotiation resets the session, so wait for any
+		// outstanding requests to complete first.
+		if typ == msgTversion {
+			c.wg.Wait()
+			if err := c.send(c.version(tag, d, s.msize)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		done := make(chan struct{})
+		c.mu.Lock()
+		c.inflight[tag] = done
+		c.mu.Unlock()
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer close(done)
+
+			resp, err := c.handle(typ, tag, d)
+			if err != nil {
+				resp = newEncoder(msgRlerror, tag)
+				resp.u32(uint32(toErrno(err)))
+			}
+
+			// Send errors will also cause the next read to fail.
+			_ = c.send(resp)
+
+			c.mu.Lock()
+			if c.inflight[tag] == done {
+				delete(c.inflight, tag)
+			}
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// conn is the state of a single connection.
+type conn struct {
+	fsys fs.FS
+	// msize is the negotiated maximum message size.
+	msize uint32
+
+	wmu sync.Mutex
+	w   io.Writer
+
+	mu       sync.Mutex
+	fids     map[uint32]*fid
+	inflight map[uint16]chan struct{}
+	wg       sync.WaitGroup
+}
+
+// fid is a reference to a file, held by the client.
+type fid struct {
+	mu   sync.Mutex
+	name string
+	qid  qid
+	// opened is set once the fid has been opened (via Tlopen or Txattrwalk).
+	opened bool
+	file   *vfs.File
+	// entries is the cached directory listing, for Treaddir.
+	entries []fs.DirEntry
+	// xattr is the value (or list of names) of an extended attribute, for
+	// fids created by Txattrwalk.
+	xattr   []byte
+	isXattr bool
+}
+
+func (c *conn) send(e *encoder) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.w.Write(e.bytes())
+	return err
+}
+
+func (c *conn) handle(typ uint8, tag uint16, d *decoder) (*encoder, error) {
+	var handler func(tag uint16, d *decoder) (*encoder, error)
+	switch typ {
+	case msgTattach:
+		handler = c.attach
+	case msgTwalk:
+		handler = c.walk
+	case msgTlopen:
+		handler = c.lopen
+	case msgTread:
+		handler = c.read
+	case msgTreaddir:
+		handler = c.readdir
+	case msgTgetattr:
+		handler = c.getattr
+	case msgTreadlink:
+		handler = c.readlink
+	case msgTstatfs:
+		handler = c.statfs
+	case msgTxattrwalk:
+		handler = c.xattrwalk
+	case msgTclunk:
+		handler = c.clunk
+	case msgTremove:
+		handler = c.remove
+	case msgTflush:
+		handler = c.flush
+	case msgTfsync:
+		handler = c.fsync
+	case msgTlock:
+		handler = c.lock
+	case msgTgetlock:
+		handler = c.getlock
+	case msgTlcreate, msgTsymlink, msgTmknod, msgTrename, msgTsetattr,
+		msgTxattrcreate, msgTlink, msgTmkdir, msgTrenameat, msgTunlinkat,
+		msgTwrite:
+		return nil, eROFS
+	default:
+		return nil, eOPNOTSUPP
+	}
+
+	return handler(tag, d)
+}
+
+func (c *conn) version(tag uint16, d *decoder, maxSize uint32) *encoder {
+	msize, version := d.u32(), d.str()
+
+	c.clunkAll()
+
+	if msize > maxSize {
+		msize = maxSize
+	}
+
+	// A tiny msize leaves no room for replies, refuse the session rather
+	// than letting the size arithmetic in read and readdir wrap around.
+	if d.err != nil || msize < minMessageSize || !strings.HasPrefix(version, Version) {
+		c.msize = minMessageSize
+		version = "unknown"
+	} else {
+		c.msize = msize
+		version = Version
+	}
+
+	e := newEncoder(msgRversion, tag)
+	e.u32(msize)
+	e.str(version)
+	return e
+}
+
+func (c *conn) attach(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, _, _, _, _ := d.u32(), d.u32(), d.str(), d.str(), d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	fi, err := vfs.Lstat(c.fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fid{name: ".", qid: qidOf(fi, ".")}
+	if err := c.newFid(fidNo, f); err != nil {
+		return nil, err
+	}
+
+	e := newEncoder(msgRattach, tag)
+	e.qid(f.qid)
+	return e, nil
+}
+
+func (c *conn) walk(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, newFidNo, nwname := d.u32(), d.u32(), d.u16()
+	if nwname > maxWalkElements {
+		return nil, eINVAL
+	}
+
+	names := make([]string, nwname)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	name, cur, opened := f.name, f.qid, f.opened
+	f.mu.Unlock()
+
+	if opened {
+		return nil, eBADF
+	}
+
+	var qids []qid
+	for i, elem := range names {
+		var err error
+		switch {
+		case cur.typ != qidTypeDir:
+			err = eNOTDIR
+		case elem == "" || elem == "." || strings.Contains(elem, "/"):
+			err = eINVAL
+		}
+
+		var next string
+		var fi fs.FileInfo
+		if err == nil {
+			next = path.Join(name, elem)
+			if elem == ".." {
+				next = path.Dir(name)
+			}
+
+			fi, err = vfs.Lstat(c.fsys, next)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+
+			break
+		}
+
+		name, cur = next, qidOf(fi, next)
+		qids = append(qids, cur)
+	}
+
+	// A partial walk does not create the new fid.
+	if len(qids) == len(names) {
+		if newFidNo == fidNo {
+			f.mu.Lock()
+			f.name, f.qid = name, cur
+			f.mu.Unlock()
+		} else if err := c.newFid(newFidNo, &fid{name: name, qid: cur}); err != nil {
+			return nil, err
+		}
+	}
+
+	e := newEncoder(msgRwalk, tag)
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return e, nil
+}
+
+func (c *conn) lopen(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, flags := d.u32(), d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	if flags&openAccessMode != 0 || flags&openTrunc != 0 {
+		return nil, eROFS
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.opened {
+		return nil, eBADF
+	}
+
+	if f.qid.typ != qidTypeDir {
+		file, err := vfs.Open(c.fsys, f.name)
+		if err != nil {
+			return nil, err
+		}
+
+		f.file = file
+	}
+	f.opened = true
+
+	e := newEncoder(msgRlopen, tag)
+	e.qid(f.qid)
+	e.u32(0)
+	return e, nil
+}
+
+func (c *conn) read(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, offset, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leave room for the header and count.
+	count = min(count, c.msize-headerSize-4, maxIOSize)
+
+	f.mu.Lock()
+	file, xattr, isXattr, opened, isDir := f.file, f.xattr, f.isXattr, f.opened, f.qid.typ == qidTypeDir
+	f.mu.Unlock()
+
+	var data []byte
+	switch {
+	case isXattr:
+		if offset < uint64(len(xattr)) {
+			data = xattr[offset:]
+		}
+		if len(data) > int(count) {
+			data = data[:count]
+		}
+	case !opened:
+		return nil, eBADF
+	case isDir:
+		return nil, eISDIR
+	default:
+		buf := make([]byte, count)
+		n, err := file.ReadAt(buf, int64(offset))
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		data = buf[:n]
+	}
+
+	e := newEncoder(msgRread, tag)
+	e.u32(uint32(len(data)))
+	e.buf = append(e.buf, data...)
+	return e, nil
+}
+
+func (c *conn) readdir(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, offset, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	count = min(count, c.msize-headerSize-4, maxIOSize)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.opened || f.qid.typ != qidTypeDir {
+		return nil, eNOTDIR
+	}
+
+	// Rewinding the directory refreshes the listing.
+	if offset == 0 || f.entries == nil {
+		entries, err := fs.ReadDir(c.fsys, f.name)
+		if err != nil {
+			return nil, err
+		}
+
+		f.entries = entries
+	}
+
+	e := newEncoder(msgRreaddir, tag)
+	e.u32(0)
+	start := len(e.buf)
+
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		de := f.entries[i]
+
+		// qid[13] offset[8] type[1] name[s]
+		if len(e.buf)-start+13+8+1+2+len(de.Name()) > int(count) {
+			break
+		}
+
+		name := path.Join(f.name, de.Name())
+		q := qid{typ: qidType(de.Type()), path: pathHash(name)}
+		if fi, err := de.Info(); err == nil {
+			q = qidOf(fi, name)
+		}
+
+		e.qid(q)
+		e.u64(i + 1)
+		e.u8(direntType(de.Type()))
+		e.str(de.Name())
+	}
+
+	binary.LittleEndian.PutUint32(e.buf[start-4:], uint32(len(e.buf)-start))
+	return e, nil
+}
+
+func (c *conn) getattr(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, _ := d.u32(), d.u64()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := f.path()
+
+	fi, err := vfs.Lstat(c.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := archivefs.NewEntryFromInfo(name, fi)
+
+	var rdev uint64
+	if fi.Mode()&fs.ModeDevice != 0 {
+		rdev = mkdev(entry.Major, entry.Minor)
+	}
+
+	mtime := fi.ModTime()
+	sec, nsec := uint64(mtime.Unix()), uint64(mtime.Nanosecond())
+
+	e := newEncoder(msgRgetattr, tag)
+	e.u64(getattrBasic)
+	e.qid(qidOf(fi, name))
+	e.u32(vfs.Mode(fi.Mode()))
+	e.u32(uint32(entry.Uid))
+	e.u32(uint32(entry.Gid))
+	e.u64(uint64(entry.Nlink))
+	e.u64(rdev)
+	e.u64(uint64(fi.Size()))
+	e.u64(4096)
+	e.u64((uint64(fi.Size()) + 511) / 512)
+	// The access and change times are reported as the modification time.
+	for i := 0; i < 3; i++ {
+		e.u64(sec)
+		e.u64(nsec)
+	}
+	// btime, gen and data_version are not supported.
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	return e, nil
+}
+
+func (c *conn) readlink(tag uint16, d *decoder) (*encoder, error) {
+	fidNo := d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	name, q := f.path()
+	if q.typ != qidTypeSymlink {
+		return nil, eINVAL
+	}
+
+	target, err := vfs.ReadLink(c.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	e := newEncoder(msgRreadlink, tag)
+	e.str(target)
+	return e, nil
+}
+
+func (c *conn) statfs(tag uint16, d *decoder) (*encoder, error) {
+	fidNo := d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	if _, err := c.getFid(fidNo); err != nil {
+		return nil, err
+	}
+
+	// The filesystem is read-only, so there is no free space.
+	e := newEncoder(msgRstatfs, tag)
+	e.u32(v9fsMagic)
+	e.u32(4096)
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	e.u32(255)
+	return e, nil
+}
+
+func (c *conn) xattrwalk(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, newFidNo, attr := d.u32(), d.u32(), d.str()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	f, err := c.getFid(fidNo)
+	if err != nil {
+		return nil, err
+	}
+
+	name, q := f.path()
+
+	fi, err := vfs.Lstat(c.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := archivefs.Xattrs(fi)
+
+	var data []byte
+	if attr == "" {
+		// List the names of the extended attributes.
+		names := make([]string, 0, len(xattrs))
+		for attr := range xattrs {
+			names = append(names, attr)
+		}
+		sort.Strings(names)
+
+		for _, attr := range names {
+			data = append(data, attr...)
+			data = append(data, 0)
+		}
+	} else {
+		value, ok := xattrs[attr]
+		if !ok {
+			return nil, eNODATA
+		}
+
+		data = []byte(value)
+	}
+
+	err = c.newFid(newFidNo, &fid{
+		name:    name,
+		qid:     q,
+		opened:  true,
+		xattr:   data,
+		isXattr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e := newEncoder(msgRxattrwalk, tag)
+	e.u64(uint64(len(data)))
+	return e, nil
+}
+
+func (c *conn) clunk(tag uint16, d *decoder) (*encoder, error) {
+	fidNo := d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	if err := c.clunkFid(fidNo); err != nil {
+		return nil, err
+	}
+
+	return newEncoder(msgRclunk, tag), nil
+}
+
+func (c *conn) remove(tag uint16, d *decoder) (*encoder, error) {
+	fidNo := d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	// The fid is clunked even if the remove fails.
+	if err := c.clunkFid(fidNo); err != nil {
+		return nil, err
+	}
+
+	return nil, eROFS
+}
+
+func (c *conn) flush(tag uint16, d *decoder) (*encoder, error) {
+	oldTag := d.u16()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	// Requests can't be interrupted, so wait for the flushed request to be
+	// answered before replying.
+	c.mu.Lock()
+	done, ok := c.inflight[oldTag]
+	c.mu.Unlock()
+
+	if ok && oldTag != tag {
+		<-done
+	}
+
+	return newEncoder(msgRflush, tag), nil
+}
+
+func (c *conn) fsync(tag uint16, d *decoder) (*encoder, error) {
+	fidNo := d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	if _, err := c.getFid(fidNo); err != nil {
+		return nil, err
+	}
+
+	return newEncoder(msgRfsync, tag), nil
+}
+
+func (c *conn) lock(tag uint16, d *decoder) (*encoder, error) {
+	fidNo := d.u32()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	if _, err := c.getFid(fidNo); err != nil {
+		return nil, err
+	}
+
+	// Files can't be modified, so locks are always granted.
+	e := newEncoder(msgRlock, tag)
+	e.u8(lockSuccess)
+	return e, nil
+}
+
+func (c *conn) getlock(tag uint16, d *decoder) (*encoder, error) {
+	fidNo, _, start, length, procID, clientID := d.u32(), d.u8(), d.u64(), d.u64(), d.u32(), d.str()
+	if d.err != nil {
+		return nil, eINVAL
+	}
+
+	if _, err := c.getFid(fidNo); err != nil {
+		return nil, err
+	}
+
+	e := newEncoder(msgRgetlock, tag)
+	e.u8(lockTypeUnlock)
+	e.u64(start)
+	e.u64(length)
+	e.u32(procID)
+	e.str(clientID)
+	return e, nil
+}
+
+func (c *conn) newFid(fidNo uint32, f *fid) error {
+	if fidNo == noFid {
+		return eBADF
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.fids[fidNo]; ok {
+		return eBADF
+	}
+
+	c.fids[fidNo] = f
+	return nil
+}
+
+func (c *conn) getFid(fidNo uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.fids[fidNo]
+	if !ok {
+		return nil, eBADF
+	}
+
+	return f, nil
+}
+
+func (c *conn) clunkFid(fidNo uint32) error {
+	c.mu.Lock()
+	f, ok := c.fids[fidNo]
+	delete(c.fids, fidNo)
+	c.mu.Unlock()
+
+	if !ok {
+		return eBADF
+	}
+
+	f.close()
+	return nil
+}
+
+func (c *conn) clunkAll() {
+	c.mu.Lock()
+	fids := c.fids
+	c.fids = map[uint32]*fid{}
+	c.mu.Unlock()
+
+	for _, f := range fids {
+		f.close()
+	}
+}
+
+// path returns the name and qid of the file referenced by the fid.
+func (f *fid) path() (string, qid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.name, f.qid
+}
+
+func (f *fid) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+	}
+}
+
+// qidOf returns the qid of a file. Files without an inode number are
+// identified by a hash of their path.
+func qidOf(fi fs.FileInfo, name string) qid {
+	q := qid{typ: qidType(fi.Mode()), path: pathHash(name)}
+	if ino := archivefs.NewEntryFromInfo(name, fi).Ino; ino != 0 {
+		q.path = ino
+	}
+
+	return q
+}
+
+func qidType(mode fs.FileMode) uint8 {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return qidTypeDir
+	case fs.ModeSymlink:
+		return qidTypeSymlink
+	}
+
+	return qidTypeFile
+}
+
+func pathHash(name string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return h.Sum64()
+}
+
+func direntType(mode fs.FileMode) uint8 {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return dtDIR
+	case fs.ModeSymlink:
+		return dtLNK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return dtCHR
+	case fs.ModeDevice:
+		return dtBLK
+	case fs.ModeNamedPipe:
+		return dtFIFO
+	case fs.ModeSocket:
+		return dtSOCK
+	}
+
+	return dtREG
+}
+
+// mkdev encodes a device number in the format used by Linux.
+func mkdev(major, minor uint32) uint64 {
+	return uint64(major&0xfff)<<8 | uint64(major&^0xfff)<<32 |
+		uint64(minor&0xff) | uint64(minor&^0xff)<<12
+}
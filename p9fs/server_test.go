@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package p9fs_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/p9fs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o600))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+	require.NoError(t, fsys.SetOwner("etc/hostname", 1000, 100))
+	require.NoError(t, fsys.SetXattr("etc/hostname", "user.comment", "hello"))
+
+	server := p9fs.NewServer(fsys, &p9fs.Options{MaxMessageSize: 8192})
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_ = server.ServeConn(serverConn)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, clientConn.Close())
+	})
+
+	c := &client{t: t, rw: clientConn}
+
+	// Tversion
+	r := c.rpc(100, func(m *request) {
+		m.u32(65536)
+		m.str("9P2000.L")
+	}, 101)
+	require.Equal(t, uint32(8192), r.u32())
+	require.Equal(t, "9P2000.L", r.str())
+
+	// Tattach
+	c.rpc(104, func(m *request) {
+		m.u32(0)
+		m.u32(0xffffffff)
+		m.str("root")
+		m.str("")
+		m.u32(0)
+	}, 105)
+
+	t.Run("Walk", func(t *testing.T) {
+		r := c.walk(0, 1, "etc", "ssl", "..", "hostname")
+		require.Equal(t, uint16(4), r.u16())
+		require.Equal(t, uint8(0x80), r.u8())
+		c.clunk(1)
+
+		// A partial walk returns the qids of the names that were found.
+		r = c.walk(0, 1, "etc", "missing")
+		require.Equal(t, uint16(1), r.u16())
+
+		// And does not create the new fid.
+		c.rpcError(120, func(m *request) { m.u32(1) }, 9)
+
+		c.rpcError(110, func(m *request) {
+			m.u32(0)
+			m.u32(1)
+			m.u16(1)
+			m.str("missing")
+		}, 2)
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		c.walk(0, 1, "etc", "name")
+		defer c.clunk(1)
+
+		r := c.rpc(22, func(m *request) { m.u32(1) }, 23)
+		require.Equal(t, "hostname", r.str())
+
+		c.walk(0, 2, "etc", "hostname")
+		defer c.clunk(2)
+
+		// Opening for writing is refused.
+		c.rpcError(12, func(m *request) {
+			m.u32(2)
+			m.u32(2)
+		}, 30)
+
+		c.rpc(12, func(m *request) {
+			m.u32(2)
+			m.u32(0)
+		}, 13)
+
+		r = c.rpc(116, func(m *request) {
+			m.u32(2)
+			m.u64(2)
+			m.u32(100)
+		}, 117)
+		require.Equal(t, "pha\n", string(r.next(int(r.u32()))))
+
+		r = c.rpc(24, func(m *request) {
+			m.u32(2)
+			m.u64(0x7ff)
+		}, 25)
+		require.Equal(t, uint64(0x7ff), r.u64())
+		r.next(13)
+		require.Equal(t, uint32(0o100644), r.u32())
+		require.Equal(t, uint32(1000), r.u32())
+		require.Equal(t, uint32(100), r.u32())
+		r.u64()
+		r.u64()
+		require.Equal(t, uint64(6), r.u64())
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		c.walk(0, 1, "etc")
+		defer c.clunk(1)
+
+		c.rpc(12, func(m *request) {
+			m.u32(1)
+			m.u32(0)
+		}, 13)
+
+		var names []string
+		var offset uint64
+		for {
+			// A small count forces the listing to be split.
+			r := c.rpc(40, func(m *request) {
+				m.u32(1)
+				m.u64(offset)
+				m.u32(40)
+			}, 41)
+
+			r = &response{buf: r.next(int(r.u32()))}
+			if len(r.buf) == 0 {
+				break
+			}
+
+			for len(r.buf) > 0 {
+				r.next(13)
+				offset = r.u64()
+				r.u8()
+				names = append(names, r.str())
+			}
+		}
+		require.Equal(t, []string{"hostname", "name", "ssl"}, names)
+	})
+
+	t.Run("Xattrs", func(t *testing.T) {
+		c.walk(0, 1, "etc", "hostname")
+		defer c.clunk(1)
+
+		r := c.rpc(30, func(m *request) {
+			m.u32(1)
+			m.u32(2)
+			m.str("")
+		}, 31)
+		require.Equal(t, uint64(13), r.u64())
+		c.clunk(2)
+
+		r = c.rpc(30, func(m *request) {
+			m.u32(1)
+			m.u32(2)
+			m.str("user.comment")
+		}, 31)
+		require.Equal(t, uint64(5), r.u64())
+
+		r = c.rpc(116, func(m *request) {
+			m.u32(2)
+			m.u64(0)
+			m.u32(100)
+		}, 117)
+		require.Equal(t, "hello", string(r.next(int(r.u32()))))
+		c.clunk(2)
+
+		c.rpcError(30, func(m *request) {
+			m.u32(1)
+			m.u32(2)
+			m.str("user.missing")
+		}, 61)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		// Tmkdir
+		c.rpcError(72, func(m *request) {
+			m.u32(0)
+			m.str("new")
+			m.u32(0o755)
+			m.u32(0)
+		}, 30)
+	})
+}
+
+func TestServerSmallMessageSize(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.WriteFile("hostname", []byte("alpha\n"), 0o644))
+
+	server := p9fs.NewServer(fsys, nil)
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_ = server.ServeConn(serverConn)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, clientConn.Close())
+	})
+
+	c := &client{t: t, rw: clientConn}
+
+	// A tiny msize is refused.
+	r := c.rpc(100, func(m *request) {
+		m.u32(0)
+		m.str("9P2000.L")
+	}, 101)
+	r.u32()
+	require.Equal(t, "unknown", r.str())
+
+	// And reads are still bounded by the minimum message size.
+	c.rpc(104, func(m *request) {
+		m.u32(0)
+		m.u32(0xffffffff)
+		m.str("root")
+		m.str("")
+		m.u32(0)
+	}, 105)
+
+	c.walk(0, 1, "hostname")
+	c.rpc(12, func(m *request) {
+		m.u32(1)
+		m.u32(0)
+	}, 13)
+
+	r = c.rpc(116, func(m *request) {
+		m.u32(1)
+		m.u64(0)
+		m.u32(0xffffffff)
+	}, 117)
+	require.Equal(t, "alpha\n", string(r.next(int(r.u32()))))
+}
+
+type client struct {
+	t   *testing.T
+	rw  io.ReadWriter
+	tag uint16
+}
+
+// rpc sends a request and returns the body of the response, which must be
+// of the given type.
+func (c *client) rpc(typ uint8, build func(m *request), want uint8) *response {
+	c.t.Helper()
+
+	gotType, r := c.call(typ, build)
+	if gotType == 7 {
+		c.t.Fatalf("unexpected error response: errno %d", r.u32())
+	}
+	require.Equal(c.t, want, gotType)
+
+	return r
+}
+
+// rpcError sends a request that must fail with the given Linux errno.
+func (c *client) rpcError(typ uint8, build func(m *request), errno uint32) {
+	c.t.Helper()
+
+	gotType, r := c.call(typ, build)
+	require.Equal(c.t, uint8(7), gotType)
+	require.Equal(c.t, errno, r.u32())
+}
+
+func (c *client) call(typ uint8, build func(m *request)) (uint8, *response) {
+	c.t.Helper()
+
+	tag := uint16(0xffff)
+	if typ != 100 {
+		c.tag++
+		tag = c.tag
+	}
+
+	m := &request{buf: make([]byte, 4)}
+	m.u8(typ)
+	m.u16(tag)
+	build(m)
+	binary.LittleEndian.PutUint32(m.buf, uint32(len(m.buf)))
+
+	_, err := c.rw.Write(m.buf)
+	require.NoError(c.t, err)
+
+	var size [4]byte
+	_, err = io.ReadFull(c.rw, size[:])
+	require.NoError(c.t, err)
+
+	buf := make([]byte, binary.LittleEndian.Uint32(size[:])-4)
+	_, err = io.ReadFull(c.rw, buf)
+	require.NoError(c.t, err)
+
+	r := &response{buf: buf}
+	gotType := r.u8()
+	require.Equal(c.t, tag, r.u16())
+
+	return gotType, r
+}
+
+func (c *client) walk(fid, newFid uint32, names ...string) *response {
+	c.t.Helper()
+
+	return c.rpc(110, func(m *request) {
+		m.u32(fid)
+		m.u32(newFid)
+		m.u16(uint16(len(names)))
+		for _, name := range names {
+			m.str(name)
+		}
+	}, 111)
+}
+
+func (c *client) clunk(fid uint32) {
+	c.t.Helper()
+
+	c.rpc(120, func(m *request) { m.u32(fid) }, 121)
+}
+
+// request is a 9P message being built.
+type request struct {
+	buf []byte
+}
+
+func (m *request) u8(v uint8) {
+	m.buf = append(m.buf, v)
+}
+
+func (m *request) u16(v uint16) {
+	m.buf = binary.LittleEndian.AppendUint16(m.buf, v)
+}
+
+func (m *request) u32(v uint32) {
+	m.buf = binary.LittleEndian.AppendUint32(m.buf, v)
+}
+
+func (m *request) u64(v uint64) {
+	m.buf = binary.LittleEndian.AppendUint64(m.buf, v)
+}
+
+func (m *request) str(v string) {
+	m.u16(uint16(len(v)))
+	m.buf = append(m.buf, v...)
+}
+
+// response is a 9P message being parsed.
+type response struct {
+	buf []byte
+}
+
+func (r *response) u8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *response) u16() uint16 {
+	return binary.LittleEndian.Uint16(r.next(2))
+}
+
+func (r *response) u32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *response) u64() uint64 {
+	return binary.LittleEndian.Uint64(r.next(8))
+}
+
+func (r *response) str() string {
+	return string(r.next(int(r.u16())))
+}
+
+func (r *response) next(n int) []byte {
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package rafs provides access to Nydus [1] RAFS v6 images, the lazily loaded
+// container image format.
+//
+// A RAFS v6 image consists of a bootstrap, an EROFS image holding the
+// metadata of the filesystem, and a set of blobs holding the contents of its
+// files. The blobs are the extra devices of the EROFS image, and are also
+// described by the blob table of the bootstrap.
+//
+// [1] https://nydus.dev
+package rafs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ fs.ReadDirFS         = (*Filesystem)(nil)
+	_ fs.StatFS            = (*Filesystem)(nil)
+	_ archivefs.ReadLinkFS = (*Filesystem)(nil)
+	_ archivefs.LinkFS     = (*Filesystem)(nil)
+	_ archivefs.SparseFS   = (*Filesystem)(nil)
+)
+
+// SuperBlockExtOffset is the offset of the RAFS v6 superblock extension,
+// which follows the EROFS superblock.
+var SuperBlockExtOffset = erofs.SuperBlockOffset + int64(binary.Size(erofs.SuperBlock{}))
+
+// superBlockMagicV5 is the magic number of RAFS v5 bootstraps.
+const superBlockMagicV5 = 0x52414653
+
+// SuperBlockExt represents the on-disk RAFS v6 superblock extension.
+type SuperBlockExt struct {
+	Flags               uint64     // Feature flags
+	BlobTableOffset     uint64     // Offset of the blob table
+	BlobTableSize       uint32     // Size of the blob table
+	ChunkSize           uint32     // Chunk size of files
+	ChunkTableOffset    uint64     // Offset of the chunk digest table
+	ChunkTableSize      uint64     // Size of the chunk digest table
+	PrefetchTableOffset uint64     // Offset of the prefetch table
+	PrefetchTableSize   uint32     // Size of the prefetch table
+	Padding             uint32     // Padding
+	Reserved            [200]uint8 // Reserved for future use
+}
+
+// BlobEntry represents an on-disk entry of the blob table.
+type BlobEntry struct {
+	BlobID               [64]uint8 // Hex digest of the blob
+	BlobIndex            uint32    // Index of the blob in the table
+	ChunkSize            uint32    // Chunk size of the blob
+	ChunkCount           uint32    // Number of chunks in the blob
+	Compressor           uint32    // Compression algorithm of chunks
+	Digester             uint32    // Digest algorithm of chunks
+	Features             uint32    // Feature flags
+	CompressedSize       uint64    // Size of the compressed blob
+	UncompressedSize     uint64    // Size of the uncompressed blob
+	TOCSize              uint32    // Size of the blob table of contents
+	MetaCompressor       uint32    // Compression algorithm of the chunk info array
+	MetaOffset           uint64    // Offset of the chunk info array in the blob
+	MetaCompressedSize   uint64    // Compressed size of the chunk info array
+	MetaUncompressedSize uint64    // Uncompressed size of the chunk info array
+	TOCDigest            [32]uint8 // SHA256 digest of the table of contents
+	MetaDigest           [32]uint8 // SHA256 digest of the blob metadata
+	MetaSize             uint64    // Size of the blob metadata
+	Reserved             [48]uint8 // Reserved for future use
+}
+
+var BlobEntrySize = int64(binary.Size(BlobEntry{}))
+
+// Compressor is the compression algorithm of the chunks of a blob.
+type Compressor uint32
+
+const (
+	CompressorNone     Compressor = 0
+	CompressorLZ4Block Compressor = 1
+	CompressorGzip     Compressor = 2
+	CompressorZstd     Compressor = 4
+)
+
+func (c Compressor) String() string {
+	switch c {
+	case CompressorNone:
+		return "none"
+	case CompressorLZ4Block:
+		return "lz4_block"
+	case CompressorGzip:
+		return "gzip"
+	case CompressorZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint32(c))
+	}
+}
+
+// Blob describes a blob of an image.
+type Blob struct {
+	// ID is the hex digest of the blob.
+	ID string
+	// ChunkSize is the size of the chunks of the blob.
+	ChunkSize uint32
+	// ChunkCount is the number of chunks in the blob.
+	ChunkCount uint32
+	// Compressor is the compression algorithm of the chunks.
+	Compressor Compressor
+	// CompressedSize is the size of the (compressed) blob.
+	CompressedSize uint64
+	// UncompressedSize is the size of the uncompressed data of the blob.
+	UncompressedSize uint64
+}
+
+// Options configures how an image is opened.
+type Options struct {
+	// Strict opens the bootstrap in strict mode (see erofs.Options).
+	Strict bool
+	// Blobs, if set, opens the uncompressed data of the blob with the given
+	// id, as addressed by the chunks of the image (eg. a blob cache file of
+	// nydusd, or the layer of an image built in tarfs mode). The contents of
+	// files stored in missing blobs (for which fs.ErrNotExist is returned)
+	// can't be read, but the rest of the image can be.
+	Blobs func(id string) (io.ReaderAt, error)
+}
+
+// Filesystem is a RAFS v6 image.
+type Filesystem struct {
+	*erofs.Filesystem
+	ext   SuperBlockExt
+	blobs []Blob
+}
+
+// Open opens the bootstrap of a RAFS v6 image, without its blobs (so only
+// the metadata of files can be read).
+func Open(bootstrap io.ReaderAt) (*Filesystem, error) {
+	return OpenWithOptions(bootstrap, nil)
+}
+
+// OpenWithOptions opens a RAFS v6 image with the given options.
+func OpenWithOptions(bootstrap io.ReaderAt, opts *Options) (*Filesystem, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	magic := make([]byte, 4)
+	if _, err := bootstrap.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(magic) == superBlockMagicV5 {
+		return nil, fmt.Errorf("%w: RAFS v5 images", archiveerrors.ErrUnsupportedFeature)
+	}
+
+	image, err := erofs.OpenImage(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := &Filesystem{}
+	if err := binary.Read(io.NewSectionReader(bootstrap, SuperBlockExtOffset, int64(binary.Size(fsys.ext))), binary.LittleEndian, &fsys.ext); err != nil {
+		return nil, &archiveerrors.ErrCorrupted{Offset: SuperBlockExtOffset, Detail: "truncated superblock extension", Err: err}
+	}
+
+	if fsys.ext.ChunkSize == 0 || bits.OnesCount32(fsys.ext.ChunkSize) != 1 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: SuperBlockExtOffset, Detail: fmt.Sprintf("invalid chunk size: %d", fsys.ext.ChunkSize)}
+	}
+
+	fsys.blobs, err = readBlobTable(bootstrap, &fsys.ext)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []io.ReaderAt
+	for i, slot := range image.DeviceSlots() {
+		var ra io.ReaderAt
+		if opts.Blobs != nil {
+			id := tag(slot.Tag[:])
+
+			ra, err = opts.Blobs(id)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("failed to open blob %d (%s): %w", i, id, err)
+				}
+				ra = nil
+			}
+		}
+
+		devices = append(devices, ra)
+	}
+
+	fsys.Filesystem, err = erofs.OpenWithOptions(bootstrap, &erofs.Options{
+		Strict:  opts.Strict,
+		Devices: devices,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// SuperBlockExt returns a copy of the superblock extension of the image.
+func (fsys *Filesystem) SuperBlockExt() SuperBlockExt {
+	return fsys.ext
+}
+
+// Blobs returns the blobs of the image, from its blob table.
+func (fsys *Filesystem) Blobs() []Blob {
+	return fsys.blobs
+}
+
+// Open opens the named file.
+func (fsys *Filesystem) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.Filesystem.Open(name)
+}
+
+// ReadDir reads the named directory, returning all its directory entries
+// sorted by filename.
+func (fsys *Filesystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.Filesystem.ReadDir(name)
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fsys *Filesystem) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.Filesystem.Stat(name)
+}
+
+// ReadLink returns the destination of the named symbolic link.
+func (fsys *Filesystem) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.Filesystem.ReadLink(name)
+}
+
+// StatLink returns a FileInfo describing the file without following any
+// symbolic links.
+func (fsys *Filesystem) StatLink(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.Filesystem.StatLink(name)
+}
+
+// FileID returns the inode number of the named file, without following any
+// symbolic links, and the number of hard links to it.
+func (fsys *Filesystem) FileID(name string) (id uint64, nlink int, err error) {
+	if !fs.ValidPath(name) {
+		return 0, 0, &fs.PathError{Op: "fileid", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return fsys.Filesystem.FileID(name)
+}
+
+// readBlobTable reads the blob table of an image.
+func readBlobTable(bootstrap io.ReaderAt, ext *SuperBlockExt) ([]Blob, error) {
+	off := int64(ext.BlobTableOffset)
+	if off < 0 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: SuperBlockExtOffset, Detail: "invalid blob table offset"}
+	}
+
+	// Blobs are addressed by 16-bit device ids.
+	count := int64(ext.BlobTableSize) / BlobEntrySize
+	if count > math.MaxUint16 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: SuperBlockExtOffset, Detail: fmt.Sprintf("invalid blob table size: %d", ext.BlobTableSize)}
+	}
+
+	entries := make([]BlobEntry, count)
+	if err := binary.Read(io.NewSectionReader(bootstrap, off, int64(len(entries))*BlobEntrySize), binary.LittleEndian, entries); err != nil {
+		return nil, &archiveerrors.ErrCorrupted{Offset: off, Detail: "truncated blob table", Err: err}
+	}
+
+	blobs := make([]Blob, 0, len(entries))
+	for _, e := range entries {
+		blobs = append(blobs, Blob{
+			ID:               tag(e.BlobID[:]),
+			ChunkSize:        e.ChunkSize,
+			ChunkCount:       e.ChunkCount,
+			Compressor:       Compressor(e.Compressor),
+			CompressedSize:   e.CompressedSize,
+			UncompressedSize: e.UncompressedSize,
+		})
+	}
+
+	return blobs, nil
+}
+
+// tag returns a NUL padded string.
+func tag(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
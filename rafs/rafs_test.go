@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package rafs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/archivefs/archivefstest"
+	"github.com/dpeckett/archivefs/erofs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/rafs"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	blockSize = 4096
+	blobID    = "6f5d3b4a2e1c0b9a8f7e6d5c4b3a2918f7e6d5c4b3a2918f7e6d5c4b3a291807"
+)
+
+func TestRAFS(t *testing.T) {
+	blob := bytes.Repeat([]byte{'a'}, blockSize)
+	blob = append(blob, bytes.Repeat([]byte{'b'}, blockSize)...)
+	blob = append(blob, bytes.Repeat([]byte{'c'}, blockSize)...)
+
+	// The file consists of the third and first blocks of the blob, followed
+	// by a hole.
+	want := slices.Concat(blob[2*blockSize:], blob[:blockSize], make([]byte, 100))
+
+	bootstrap := createBootstrap(t, int64(len(want)))
+
+	fsys, err := rafs.OpenWithOptions(bytes.NewReader(bootstrap), &rafs.Options{
+		Blobs: func(id string) (io.ReaderAt, error) {
+			if id != blobID {
+				return nil, fs.ErrNotExist
+			}
+
+			return bytes.NewReader(blob), nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []rafs.Blob{{
+		ID:               blobID,
+		ChunkSize:        blockSize,
+		ChunkCount:       3,
+		Compressor:       rafs.CompressorNone,
+		CompressedSize:   uint64(len(blob)),
+		UncompressedSize: uint64(len(blob)),
+	}}, fsys.Blobs())
+	require.Equal(t, uint32(blockSize), fsys.SuperBlockExt().ChunkSize)
+
+	require.NoError(t, archivefstest.TestFS(fsys, "hello"))
+
+	entries, err := fsys.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "hello", entries[0].Name())
+
+	data, err := fs.ReadFile(fsys, "hello")
+	require.NoError(t, err)
+	require.Equal(t, want, data)
+
+	extents, err := fsys.DataExtents("hello")
+	require.NoError(t, err)
+	require.Len(t, extents, 1)
+	require.Equal(t, int64(2*blockSize), extents[0].Length)
+
+	t.Run("Convert", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, fsys))
+
+		converted, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		data, err := fs.ReadFile(converted, "hello")
+		require.NoError(t, err)
+		require.Equal(t, want, data)
+	})
+
+	t.Run("MissingBlob", func(t *testing.T) {
+		fsys, err := rafs.Open(bytes.NewReader(bootstrap))
+		require.NoError(t, err)
+
+		fi, err := fsys.Stat("hello")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(want)), fi.Size())
+
+		_, err = fs.ReadFile(fsys, "hello")
+		require.ErrorIs(t, err, erofs.ErrDeviceNotFound)
+	})
+
+	t.Run("InvalidChunk", func(t *testing.T) {
+		corrupted := bytes.Clone(bootstrap)
+		// Point the first chunk beyond the end of the blob.
+		binary.LittleEndian.PutUint32(corrupted[chunkIndexesOff+4:], 3)
+
+		fsys, err := rafs.Open(bytes.NewReader(corrupted))
+		require.NoError(t, err)
+
+		_, err = fs.ReadFile(fsys, "hello")
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+
+	t.Run("V5", func(t *testing.T) {
+		v5 := make([]byte, 8192)
+		copy(v5, "SFAR")
+
+		_, err := rafs.Open(bytes.NewReader(v5))
+		require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+	})
+}
+
+const (
+	devTableOff     = 1536
+	blobTableOff    = 2048
+	metaOff         = blockSize
+	fileNid         = 3
+	chunkIndexesOff = metaOff + fileNid*32 + 32
+)
+
+// createBootstrap creates the bootstrap of a RAFS v6 image containing a
+// single file, named hello, whose chunks are stored in a blob.
+func createBootstrap(t *testing.T, size int64) []byte {
+	buf := make([]byte, 2*blockSize)
+
+	put := func(off int64, v any) {
+		var b bytes.Buffer
+		require.NoError(t, binary.Write(&b, binary.LittleEndian, v))
+		copy(buf[off:], b.Bytes())
+	}
+
+	put(erofs.SuperBlockOffset, erofs.SuperBlock{
+		Magic:           erofs.SuperBlockMagicV1,
+		BlockSizeBits:   12,
+		Inodes:          2,
+		Blocks:          2,
+		MetaBlockAddr:   1,
+		FeatureIncompat: erofs.FeatureIncompatChunkedFile | erofs.FeatureIncompatDeviceTable,
+		ExtraDevices:    1,
+		DevTableSlotOff: uint16(devTableOff / erofs.DeviceSlotSize),
+	})
+
+	put(rafs.SuperBlockExtOffset, rafs.SuperBlockExt{
+		BlobTableOffset: blobTableOff,
+		BlobTableSize:   uint32(rafs.BlobEntrySize),
+		ChunkSize:       blockSize,
+	})
+
+	slot := erofs.DeviceSlot{Blocks: 3}
+	copy(slot.Tag[:], blobID)
+	put(devTableOff, slot)
+
+	entry := rafs.BlobEntry{
+		ChunkSize:        blockSize,
+		ChunkCount:       3,
+		CompressedSize:   3 * blockSize,
+		UncompressedSize: 3 * blockSize,
+	}
+	copy(entry.BlobID[:], blobID)
+	put(blobTableOff, entry)
+
+	// The root directory, with its entries inline.
+	names := []string{".", "..", "hello"}
+	dirSize := int64(len(names))*erofs.DirentSize + int64(len(strings.Join(names, "")))
+
+	put(metaOff, erofs.InodeCompact{
+		Format: erofs.InodeDataLayoutFlatInline << erofs.InodeDataLayoutBit,
+		Mode:   erofs.S_IFDIR | 0o755,
+		Nlink:  2,
+		Size:   uint32(dirSize),
+	})
+
+	nameOff := int64(len(names)) * erofs.DirentSize
+	for i, name := range names {
+		dirent := erofs.Dirent{NameOff: uint16(nameOff), FileType: erofs.FT_DIR}
+		if name == "hello" {
+			dirent.Nid, dirent.FileType = fileNid, erofs.FT_REG_FILE
+		}
+		put(metaOff+32+int64(i)*erofs.DirentSize, dirent)
+
+		copy(buf[metaOff+32+nameOff:], name)
+		nameOff += int64(len(name))
+	}
+
+	// The file, with chunk indexes referring to the blob.
+	put(metaOff+fileNid*32, erofs.InodeCompact{
+		Format:       erofs.InodeDataLayoutChunkBased << erofs.InodeDataLayoutBit,
+		Mode:         erofs.S_IFREG | 0o644,
+		Nlink:        1,
+		Size:         uint32(size),
+		RawBlockAddr: erofs.ChunkFormatIndexes,
+	})
+
+	type chunkIndex struct {
+		Advise   uint16
+		DeviceID uint16
+		BlkAddr  uint32
+	}
+	put(chunkIndexesOff, []chunkIndex{
+		{DeviceID: 1, BlkAddr: 2},
+		{DeviceID: 1, BlkAddr: 0},
+		{BlkAddr: erofs.NullAddr},
+	})
+
+	return buf
+}
@@ -13,6 +13,10 @@ import (
 	"io/fs"
 )
 
+// MaxSymlinkHops is the maximum number of symbolic links followed when
+// resolving a single path (matching Linux's ELOOP limit).
+const MaxSymlinkHops = 40
+
 // ReadLinkFS is the interface that a file system must implement to
 // support the ReadLink and StatLink methods.
 // This is an experimental implementation of the API described in:
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"maps"
+)
+
+// ReadOnly returns a view of fsys that is guarded against mutation, eg. for
+// handing an archive (or a writable memfs.FS) to a plugin. Only the read
+// methods of fsys, and of the files opened from it, are exposed, so the view
+// can't be type asserted back to a writable filesystem or file.
+//
+// The values returned by fs.FileInfo.Sys() are replaced, so that callers
+// can't mutate metadata shared with fsys: with a deep copy of the underlying
+// *tar.Header if applicable, otherwise with a snapshot implementing Owner,
+// Device, ExtendedAttributes, FileID and FileAttributes (and AllocatedSize,
+// if known).
+func ReadOnly(fsys fs.FS) fs.FS {
+	return &mapInfoFS{fsys: fsys, mapInfo: readOnlyInfo}
+}
+
+// readOnlyInfo returns fi with its Sys() value replaced by a copy.
+func readOnlyInfo(fi fs.FileInfo) fs.FileInfo {
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		copied := *hdr
+		copied.PAXRecords = maps.Clone(hdr.PAXRecords)
+		copied.Xattrs = maps.Clone(hdr.Xattrs)
+		return &ownerFileInfo{FileInfo: fi, sys: &copied}
+	}
+
+	e := NewEntryFromInfo(fi.Name(), fi)
+	sys := readOnlySys{
+		uid:    e.Uid,
+		gid:    e.Gid,
+		major:  e.Major,
+		minor:  e.Minor,
+		xattrs: maps.Clone(e.Xattrs),
+		id:     e.Ino,
+		nlink:  e.Nlink,
+		attrs:  e.Attributes,
+	}
+
+	if allocated, ok := fi.Sys().(AllocatedSize); ok {
+		return &ownerFileInfo{FileInfo: fi, sys: &readOnlyAllocatedSys{readOnlySys: sys, allocated: allocated.AllocatedSize()}}
+	} else if size, ok := sysAllocatedSize(fi.Sys()); ok {
+		return &ownerFileInfo{FileInfo: fi, sys: &readOnlyAllocatedSys{readOnlySys: sys, allocated: size}}
+	}
+
+	return &ownerFileInfo{FileInfo: fi, sys: &sys}
+}
+
+// readOnlySys is a snapshot of the metadata of a file.
+type readOnlySys struct {
+	uid, gid     int
+	major, minor uint32
+	xattrs       map[string]string
+	id           uint64
+	nlink        int
+	attrs        uint32
+}
+
+func (sys *readOnlySys) Owner() (uid, gid int) {
+	return sys.uid, sys.gid
+}
+
+func (sys *readOnlySys) Device() (major, minor uint32) {
+	return sys.major, sys.minor
+}
+
+func (sys *readOnlySys) ExtendedAttributes() map[string]string {
+	return maps.Clone(sys.xattrs)
+}
+
+func (sys *readOnlySys) FileID() (id uint64, nlink int) {
+	return sys.id, sys.nlink
+}
+
+func (sys *readOnlySys) FileAttributes() uint32 {
+	return sys.attrs
+}
+
+// readOnlyAllocatedSys is a snapshot of the metadata of a file, for which the
+// allocated size is known.
+type readOnlyAllocatedSys struct {
+	readOnlySys
+	allocated int64
+}
+
+func (sys *readOnlyAllocatedSys) AllocatedSize() int64 {
+	return sys.allocated
+}
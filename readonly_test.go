@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	src := memfs.New()
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.WriteFile("etc/passwd", []byte("root:x:0:0::/root:/bin/sh\n"), 0o644))
+	require.NoError(t, src.SetOwner("etc/passwd", 1000, 1000))
+	require.NoError(t, src.SetXattr("etc/passwd", "user.comment", "hello"))
+
+	fsys := archivefs.ReadOnly(src)
+
+	require.NoError(t, fstest.TestFS(fsys, "etc/passwd"))
+
+	t.Run("Mutation", func(t *testing.T) {
+		_, ok := fsys.(*memfs.FS)
+		require.False(t, ok)
+
+		_, ok = fsys.(interface {
+			WriteFile(name string, data []byte, perm fs.FileMode) error
+		})
+		require.False(t, ok)
+
+		f, err := fsys.Open("etc/passwd")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		_, ok = f.(io.Writer)
+		require.False(t, ok)
+	})
+
+	t.Run("Sys", func(t *testing.T) {
+		fi, err := fs.Stat(fsys, "etc/passwd")
+		require.NoError(t, err)
+
+		_, ok := fi.Sys().(*memfs.FileInfoSys)
+		require.False(t, ok)
+
+		uid, gid := fi.Sys().(archivefs.Owner).Owner()
+		require.Equal(t, 1000, uid)
+		require.Equal(t, 1000, gid)
+
+		xattrs := fi.Sys().(archivefs.ExtendedAttributes).ExtendedAttributes()
+		require.Equal(t, map[string]string{"user.comment": "hello"}, xattrs)
+
+		// Mutating the returned metadata doesn't affect the filesystem.
+		xattrs["user.comment"] = "goodbye"
+
+		fi, err = fs.Stat(src, "etc/passwd")
+		require.NoError(t, err)
+		require.Equal(t, "hello", fi.Sys().(archivefs.ExtendedAttributes).ExtendedAttributes()["user.comment"])
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, tarfs.Create(&buf, src))
+
+		tarFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		fsys := archivefs.ReadOnly(tarFS)
+
+		fi, err := fs.Stat(fsys, "etc/passwd")
+		require.NoError(t, err)
+
+		hdr, ok := fi.Sys().(*tar.Header)
+		require.True(t, ok)
+		require.Equal(t, 1000, hdr.Uid)
+
+		hdr.Uid = 0
+		for key := range hdr.PAXRecords {
+			hdr.PAXRecords[key] = "mutated"
+		}
+
+		fi, err = fs.Stat(tarFS, "etc/passwd")
+		require.NoError(t, err)
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+		require.Equal(t, "hello", fi.Sys().(*tar.Header).PAXRecords["SCHILY.xattr.user.comment"])
+	})
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// ErrUnsafePath is returned by SanitizePath when a path is rejected by the
+// sanitization policy.
+var ErrUnsafePath = archiveerrors.Define(archiveerrors.ErrInsecurePath, "unsafe path")
+
+// SanitizeOptions is the policy for sanitizing paths. By default, paths are
+// cleaned rather than rejected.
+type SanitizeOptions struct {
+	// RejectAbsolute rejects absolute paths, rather than making them relative
+	// to the root.
+	RejectAbsolute bool
+	// RejectDotDot rejects paths containing ".." components, rather than
+	// resolving them lexically (never above the root).
+	RejectDotDot bool
+	// RejectReservedNames rejects paths that cannot be represented safely on
+	// Windows, ie. that contain reserved device names (eg. "CON" or "NUL.txt")
+	// or colons (eg. drive letters and alternate data streams).
+	RejectReservedNames bool
+}
+
+// SanitizePath converts the name of an archive entry into a clean, relative,
+// slash separated path, or an empty string for the root directory. Leading
+// and trailing whitespace is removed, and backslashes are treated as path
+// separators (as written by some Windows archivers).
+//
+// Paths rejected by the policy in opts fail with ErrUnsafePath.
+func SanitizePath(name string, opts *SanitizeOptions) (string, error) {
+	if opts == nil {
+		opts = &SanitizeOptions{}
+	}
+
+	cleaned := strings.ReplaceAll(strings.TrimSpace(name), `\`, "/")
+
+	if opts.RejectAbsolute && strings.HasPrefix(cleaned, "/") {
+		return "", &fs.PathError{Op: "sanitize", Path: name, Err: ErrUnsafePath}
+	}
+
+	for _, component := range strings.Split(cleaned, "/") {
+		if opts.RejectDotDot && component == ".." {
+			return "", &fs.PathError{Op: "sanitize", Path: name, Err: ErrUnsafePath}
+		}
+
+		if opts.RejectReservedNames && (strings.ContainsRune(component, ':') || isReservedName(component)) {
+			return "", &fs.PathError{Op: "sanitize", Path: name, Err: ErrUnsafePath}
+		}
+	}
+
+	// Rooting the path before cleaning it ensures leading "." and ".."
+	// components are removed without mangling the names of dotfiles.
+	return strings.TrimPrefix(path.Clean("/"+cleaned), "/"), nil
+}
+
+// CleanPath sanitizes a path with the default policy, which never fails. See
+// SanitizePath.
+func CleanPath(name string) string {
+	cleaned, _ := SanitizePath(name, nil)
+	return cleaned
+}
+
+// isReservedName reports whether name is a reserved Windows device name
+// (eg. "CON" or "NUL.txt").
+func isReservedName(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	base = strings.TrimRight(base, " ")
+
+	switch strings.ToUpper(base) {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+
+	if len(base) == 4 {
+		prefix := strings.ToUpper(base[:3])
+		if (prefix == "COM" || prefix == "LPT") && base[3] >= '1' && base[3] <= '9' {
+			return true
+		}
+	}
+
+	return false
+}
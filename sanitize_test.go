@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizePath(t *testing.T) {
+	t.Run("Clean", func(t *testing.T) {
+		vectors := map[string]string{
+			"":                 "",
+			".":                "",
+			"/":                "",
+			"./":               "",
+			"a/b":              "a/b",
+			" a/b/ ":           "a/b",
+			"./a//b/./c/":      "a/b/c",
+			"/etc/passwd":      "etc/passwd",
+			"../../etc/passwd": "etc/passwd",
+			"a/../../b":        "b",
+			"a/b/..":           "a",
+			".bashrc":          ".bashrc",
+			"..foo":            "..foo",
+			`dir\file`:         "dir/file",
+			`..\..\evil`:       "evil",
+		}
+
+		for name, want := range vectors {
+			got, err := archivefs.SanitizePath(name, nil)
+			require.NoError(t, err, name)
+			require.Equal(t, want, got, name)
+			require.Equal(t, want, archivefs.CleanPath(name), name)
+		}
+	})
+
+	vectors := []struct {
+		name     string
+		opts     archivefs.SanitizeOptions
+		accepted []string
+		rejected []string
+	}{{
+		name:     "RejectAbsolute",
+		opts:     archivefs.SanitizeOptions{RejectAbsolute: true},
+		accepted: []string{"a/b", "./a", "../a", " a"},
+		rejected: []string{"/a", " /a", `\a`, "/"},
+	}, {
+		name:     "RejectDotDot",
+		opts:     archivefs.SanitizeOptions{RejectDotDot: true},
+		accepted: []string{"a/b", "/a", "..a", "a..", ".../a"},
+		rejected: []string{"..", "../a", "a/../b", "a/..", `a\..\b`},
+	}, {
+		name:     "RejectReservedNames",
+		opts:     archivefs.SanitizeOptions{RejectReservedNames: true},
+		accepted: []string{"a/b", "console", "COM0", "LPT10", "nul-device"},
+		rejected: []string{"CON", "a/nul", "NUL.txt", "aux .tar.gz", "COM1", "lpt9.log", "C:/windows", "file:stream"},
+	}}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			for _, name := range v.accepted {
+				_, err := archivefs.SanitizePath(name, &v.opts)
+				require.NoError(t, err, name)
+			}
+
+			for _, name := range v.rejected {
+				_, err := archivefs.SanitizePath(name, &v.opts)
+				require.ErrorIs(t, err, archivefs.ErrUnsafePath, name)
+				require.ErrorIs(t, err, archiveerrors.ErrInsecurePath, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// ErrInvalidKey is returned when a key cannot be parsed.
+var ErrInvalidKey = errors.New("invalid key")
+
+const opensshMagic = "openssh-key-v1\x00"
+
+// ParsePublicKeys parses Ed25519 public keys in the format used by OpenSSH,
+// eg. the contents of an id_ed25519.pub, authorized_keys or allowed_signers
+// file. Blank lines and comments are ignored, as are any options or
+// principals preceding each key.
+func ParsePublicKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := parsePublicKeyLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no public keys found", ErrInvalidKey)
+	}
+
+	return keys, nil
+}
+
+// MarshalPublicKey returns an Ed25519 public key in the format used by
+// OpenSSH (eg. in authorized_keys files), with a trailing newline.
+func MarshalPublicKey(key ed25519.PublicKey) []byte {
+	return []byte(keyTypeEd25519 + " " + base64.StdEncoding.EncodeToString(marshalKey(key)) + "\n")
+}
+
+// ParsePrivateKey parses a PEM encoded Ed25519 private key, either an
+// unencrypted OpenSSH private key (as written by ssh-keygen) or a PKCS #8
+// private key (as written by openssl).
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data found", ErrInvalidKey)
+	}
+
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		return parseOpenSSHPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T keys", archiveerrors.ErrUnsupportedFeature, key)
+		}
+
+		return priv, nil
+	default:
+		return nil, fmt.Errorf("%w: %s keys", archiveerrors.ErrUnsupportedFeature, strings.ToLower(block.Type))
+	}
+}
+
+// parsePublicKeyLine parses a single line of an authorized_keys (or similar)
+// file, the key is the first field that names a key type.
+func parsePublicKeyLine(line string) (ed25519.PublicKey, error) {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if !isKeyType(field) {
+			continue
+		}
+
+		if field != keyTypeEd25519 {
+			return nil, fmt.Errorf("%w: %s keys", archiveerrors.ErrUnsupportedFeature, field)
+		}
+
+		if i+1 == len(fields) {
+			break
+		}
+
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+
+		return parseKey(blob)
+	}
+
+	return nil, fmt.Errorf("%w: not an SSH public key", ErrInvalidKey)
+}
+
+func isKeyType(field string) bool {
+	return strings.HasPrefix(field, "ssh-") || strings.HasPrefix(field, "ecdsa-") || strings.HasPrefix(field, "sk-")
+}
+
+// parseKey parses an Ed25519 public key in the SSH wire format.
+func parseKey(blob []byte) (ed25519.PublicKey, error) {
+	r := &reader{buf: blob}
+	keyType := r.string()
+	key := r.string()
+	if r.err != nil || len(r.buf) != 0 {
+		return nil, fmt.Errorf("%w: malformed public key", ErrInvalidKey)
+	}
+
+	if string(keyType) != keyTypeEd25519 {
+		return nil, fmt.Errorf("%w: %s keys", archiveerrors.ErrUnsupportedFeature, keyType)
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: malformed public key", ErrInvalidKey)
+	}
+
+	return ed25519.PublicKey(bytes.Clone(key)), nil
+}
+
+// marshalKey returns an Ed25519 public key in the SSH wire format.
+func marshalKey(key ed25519.PublicKey) []byte {
+	return appendString(appendString(nil, []byte(keyTypeEd25519)), key)
+}
+
+// parseOpenSSHPrivateKey parses the contents of an OpenSSH private key (see
+// PROTOCOL.key).
+func parseOpenSSHPrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	if !bytes.HasPrefix(data, []byte(opensshMagic)) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidKey)
+	}
+	r := &reader{buf: data[len(opensshMagic):]}
+
+	cipher := r.string()
+	kdf := r.string()
+	_ = r.string() // kdf options
+	n := r.uint32()
+	_ = r.string() // public key
+	private := r.string()
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: malformed private key", ErrInvalidKey)
+	}
+
+	if string(cipher) != "none" || string(kdf) != "none" {
+		return nil, fmt.Errorf("%w: encrypted private keys", archiveerrors.ErrUnsupportedFeature)
+	}
+
+	if n != 1 {
+		return nil, fmt.Errorf("%w: private key files with %d keys", archiveerrors.ErrUnsupportedFeature, n)
+	}
+
+	r = &reader{buf: private}
+	check1 := r.uint32()
+	check2 := r.uint32()
+	keyType := r.string()
+	if r.err != nil || check1 != check2 {
+		return nil, fmt.Errorf("%w: malformed private key", ErrInvalidKey)
+	}
+
+	if string(keyType) != keyTypeEd25519 {
+		return nil, fmt.Errorf("%w: %s keys", archiveerrors.ErrUnsupportedFeature, keyType)
+	}
+
+	pub := r.string()
+	priv := r.string()
+	if r.err != nil || len(pub) != ed25519.PublicKeySize || len(priv) != ed25519.PrivateKeySize ||
+		!bytes.Equal(priv[ed25519.SeedSize:], pub) {
+		return nil, fmt.Errorf("%w: malformed private key", ErrInvalidKey)
+	}
+
+	return ed25519.PrivateKey(bytes.Clone(priv)), nil
+}
@@ -0,0 +1,292 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package signature creates and verifies detached signatures of archives,
+// so that tampered archives can be rejected before they are used.
+//
+// The signed message is the mtree(5) manifest of the contents of an archive
+// (see Manifest), so a signature covers the contents and metadata of every
+// file, and remains valid if the archive is converted to another format.
+// Signatures use Ed25519 keys, and are in the format used by OpenSSH (see
+// PROTOCOL.sshsig), so they can also be created and verified with
+// "ssh-keygen -Y sign" and "ssh-keygen -Y verify" (of the manifest).
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// DefaultNamespace is the namespace in which archives are signed by default.
+// A signature is only valid in the namespace it was created in, so that it
+// can't be reused for another purpose.
+const DefaultNamespace = "archivefs"
+
+const (
+	magic          = "SSHSIG"
+	version        = 1
+	pemType        = "SSH SIGNATURE"
+	hashAlg        = "sha512"
+	keyTypeEd25519 = "ssh-ed25519"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signature is malformed, was not
+	// created by a trusted key, or does not match the archive (eg. because
+	// it has been modified).
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrMissingSignature is returned when a signature is required but none
+	// was provided.
+	ErrMissingSignature = errors.New("missing signature")
+)
+
+// Options configures the creation and verification of signatures.
+type Options struct {
+	// Namespace is the namespace of the signature, defaults to
+	// DefaultNamespace.
+	Namespace string
+}
+
+// Sign writes a detached signature of the contents of fsys to w, in the
+// PEM armored format used by OpenSSH. The key must be an Ed25519 key (eg. an
+// ed25519.PrivateKey, or a signer backed by an SSH agent or hardware token).
+func Sign(w io.Writer, fsys fs.FS, key crypto.Signer, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	manifest, err := Manifest(fsys)
+	if err != nil {
+		return err
+	}
+
+	return SignMessage(w, manifest, key, opts)
+}
+
+// SignMessage writes a detached signature of message to w, see Sign.
+func SignMessage(w io.Writer, message []byte, key crypto.Signer, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	pub, ok := key.Public().(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: %T signing keys", archiveerrors.ErrUnsupportedFeature, key.Public())
+	}
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	sig, err := key.Sign(rand.Reader, signedData(namespace, message), crypto.Hash(0))
+	if err != nil {
+		return fmt.Errorf("failed to sign: %w", err)
+	}
+
+	var blob []byte
+	blob = append(blob, magic...)
+	blob = binary.BigEndian.AppendUint32(blob, version)
+	blob = appendString(blob, marshalKey(pub))
+	blob = appendString(blob, []byte(namespace))
+	blob = appendString(blob, nil)
+	blob = appendString(blob, []byte(hashAlg))
+	blob = appendString(blob, appendString(appendString(nil, []byte(keyTypeEd25519)), sig))
+
+	return pem.Encode(w, &pem.Block{Type: pemType, Bytes: blob})
+}
+
+// Verify verifies a detached signature of the contents of fsys, created by
+// Sign, against a set of trusted public keys. Every file in fsys is read.
+// If the signature is invalid the returned error wraps ErrInvalidSignature.
+func Verify(fsys fs.FS, sig []byte, keys []ed25519.PublicKey, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	manifest, err := Manifest(fsys)
+	if err != nil {
+		return err
+	}
+
+	return VerifyMessage(manifest, sig, keys, opts)
+}
+
+// VerifyMessage verifies a detached signature of message, see Verify.
+func VerifyMessage(message, sig []byte, keys []ed25519.PublicKey, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	block, _ := pem.Decode(sig)
+	if block == nil || block.Type != pemType {
+		return fmt.Errorf("%w: not an SSH signature", ErrInvalidSignature)
+	}
+
+	s, err := parseSignature(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if s.namespace != namespace {
+		return fmt.Errorf("%w: signed in namespace %q, expected %q", ErrInvalidSignature, s.namespace, namespace)
+	}
+
+	trusted := false
+	for _, key := range keys {
+		if key.Equal(s.key) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("%w: signed by an untrusted key", ErrInvalidSignature)
+	}
+
+	if !ed25519.Verify(s.key, signedData(namespace, message), s.sig) {
+		return fmt.Errorf("%w: signature does not match", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+// Manifest returns the message that is signed for fsys, its mtree(5)
+// manifest. The root directory is omitted, as its metadata isn't preserved
+// by every format (eg. tar archives often lack an entry for it).
+func Manifest(fsys fs.FS) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := archivefs.WriteMtree(&buf, fsys, nil); err != nil {
+		return nil, err
+	}
+
+	// The root directory is always the first entry, after the header.
+	header, entries, _ := bytes.Cut(buf.Bytes(), []byte("\n"))
+	_, entries, _ = bytes.Cut(entries, []byte("\n"))
+
+	return slices.Concat(header, []byte("\n"), entries), nil
+}
+
+// signature is a parsed SSH signature.
+type signature struct {
+	key       ed25519.PublicKey
+	namespace string
+	sig       []byte
+}
+
+func parseSignature(blob []byte) (*signature, error) {
+	if !bytes.HasPrefix(blob, []byte(magic)) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidSignature)
+	}
+	r := &reader{buf: blob[len(magic):]}
+
+	if v := r.uint32(); v != version {
+		return nil, fmt.Errorf("%w: signature version %d", archiveerrors.ErrUnsupportedFeature, v)
+	}
+
+	publicKey := r.string()
+	namespace := r.string()
+	_ = r.string() // reserved
+	alg := r.string()
+	sigBlob := r.string()
+	if r.err != nil || len(r.buf) != 0 {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+	}
+
+	if string(alg) != hashAlg {
+		return nil, fmt.Errorf("%w: %s signature hashes", archiveerrors.ErrUnsupportedFeature, alg)
+	}
+
+	key, err := parseKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r = &reader{buf: sigBlob}
+	keyType := r.string()
+	sig := r.string()
+	if r.err != nil || len(r.buf) != 0 || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+	}
+
+	if string(keyType) != keyTypeEd25519 {
+		return nil, fmt.Errorf("%w: %s signatures", archiveerrors.ErrUnsupportedFeature, keyType)
+	}
+
+	return &signature{key: key, namespace: string(namespace), sig: sig}, nil
+}
+
+// signedData returns the data that is actually signed for a message.
+func signedData(namespace string, message []byte) []byte {
+	h := sha512.Sum512(message)
+
+	var data []byte
+	data = append(data, magic...)
+	data = appendString(data, []byte(namespace))
+	data = appendString(data, nil)
+	data = appendString(data, []byte(hashAlg))
+	data = appendString(data, h[:])
+
+	return data
+}
+
+// appendString appends an SSH wire format string (ie. with a 32-bit length
+// prefix).
+func appendString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// reader reads SSH wire format values, recording the first error.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) uint32() uint32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+
+	return v
+}
+
+func (r *reader) string() []byte {
+	n := r.uint32()
+	if r.err != nil || uint64(n) > uint64(len(r.buf)) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	s := r.buf[:n]
+	r.buf = r.buf[n:]
+
+	return s
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package signature_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/signature"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+
+	var sig bytes.Buffer
+	require.NoError(t, signature.Sign(&sig, fsys, priv, nil))
+	require.Contains(t, sig.String(), "-----BEGIN SSH SIGNATURE-----\n")
+
+	require.NoError(t, signature.Verify(fsys, sig.Bytes(), []ed25519.PublicKey{pub}, nil))
+
+	t.Run("Tampered", func(t *testing.T) {
+		tampered := memfs.New()
+		require.NoError(t, tampered.MkdirAll("etc", 0o755))
+		require.NoError(t, tampered.WriteFile("etc/hostname", []byte("alpha\n"), 0o666))
+		require.NoError(t, tampered.Symlink("hostname", "etc/name"))
+
+		err := signature.Verify(tampered, sig.Bytes(), []ed25519.PublicKey{pub}, nil)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+
+	t.Run("UntrustedKey", func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		err = signature.Verify(fsys, sig.Bytes(), []ed25519.PublicKey{other}, nil)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+
+		err = signature.Verify(fsys, sig.Bytes(), nil, nil)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+
+	t.Run("Namespace", func(t *testing.T) {
+		err := signature.Verify(fsys, sig.Bytes(), []ed25519.PublicKey{pub}, &signature.Options{Namespace: "file"})
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		err := signature.Verify(fsys, []byte("hello world"), []ed25519.PublicKey{pub}, nil)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+
+		block, _ := pem.Decode(sig.Bytes())
+		truncated := pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes[:len(block.Bytes)-1]})
+
+		err = signature.Verify(fsys, truncated, []ed25519.PublicKey{pub}, nil)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+
+	t.Run("UnsupportedKey", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		err = signature.Sign(&bytes.Buffer{}, fsys, key, nil)
+		require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+	})
+}
+
+func TestOpenSSH(t *testing.T) {
+	data, err := os.ReadFile("testdata/id_ed25519")
+	require.NoError(t, err)
+
+	priv, err := signature.ParsePrivateKey(data)
+	require.NoError(t, err)
+
+	data, err = os.ReadFile("testdata/id_ed25519.pub")
+	require.NoError(t, err)
+
+	keys, err := signature.ParsePublicKeys(data)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.True(t, keys[0].Equal(priv.Public()))
+
+	// Without the comment.
+	fields := bytes.Fields(data)
+	require.Equal(t, string(bytes.Join(fields[:2], []byte(" ")))+"\n", string(signature.MarshalPublicKey(keys[0])))
+
+	message, err := os.ReadFile("testdata/hello.txt")
+	require.NoError(t, err)
+
+	t.Run("Verify", func(t *testing.T) {
+		// Created with "ssh-keygen -Y sign -n archivefs".
+		sig, err := os.ReadFile("testdata/hello.txt.sig")
+		require.NoError(t, err)
+
+		require.NoError(t, signature.VerifyMessage(message, sig, keys, nil))
+
+		err = signature.VerifyMessage([]byte("goodbye world\n"), sig, keys, nil)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+
+	t.Run("Sign", func(t *testing.T) {
+		var sig bytes.Buffer
+		require.NoError(t, signature.SignMessage(&sig, message, priv, nil))
+
+		// Ed25519 signatures are deterministic.
+		want, err := os.ReadFile("testdata/hello.txt.sig")
+		require.NoError(t, err)
+
+		wantBlock, _ := pem.Decode(want)
+		gotBlock, _ := pem.Decode(sig.Bytes())
+		require.NotNil(t, gotBlock)
+		require.Equal(t, wantBlock.Bytes, gotBlock.Bytes)
+	})
+
+	t.Run("AllowedSigners", func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		allowed := "# trusted signers\n\nalice@example.com " + string(data) + "bob@example.com namespaces=\"archivefs\" " + string(signature.MarshalPublicKey(other))
+
+		keys, err := signature.ParsePublicKeys([]byte(allowed))
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		require.True(t, keys[1].Equal(other))
+	})
+
+	t.Run("UnsupportedKeys", func(t *testing.T) {
+		_, err := signature.ParsePublicKeys([]byte("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC test\n"))
+		require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+
+		_, err = signature.ParsePublicKeys([]byte("# nothing here\n"))
+		require.ErrorIs(t, err, signature.ErrInvalidKey)
+	})
+}
+
+func TestParsePrivateKeyPKCS8(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+
+	parsed, err := signature.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	require.True(t, priv.Equal(parsed))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err = x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+
+	_, err = signature.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+
+	_, err = signature.ParsePrivateKey([]byte("hello world"))
+	require.ErrorIs(t, err, signature.ErrInvalidKey)
+}
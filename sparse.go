@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"io/fs"
+)
+
+// Extent is a contiguous range of a file.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// End returns the offset immediately after the extent.
+func (e Extent) End() int64 {
+	return e.Offset + e.Length
+}
+
+// SparseFS is the interface that a file system must implement to enumerate
+// the holes in sparse files (eg. tar sparse entries, or chunked erofs inodes),
+// so that they can be preserved when the file is copied.
+type SparseFS interface {
+	fs.FS
+
+	// DataExtents returns the extents of the named regular file that contain
+	// data, in order of offset. The remainder of the file consists of holes,
+	// which read as zeros.
+	DataExtents(name string) ([]Extent, error)
+}
+
+// LookupDataExtents returns the extents of the named file that contain data,
+// using SparseFS if implemented by fsys. Otherwise the file is assumed to
+// contain no holes.
+func LookupDataExtents(fsys fs.FS, name string) ([]Extent, error) {
+	if sparseFS, ok := fsys.(SparseFS); ok {
+		return sparseFS.DataExtents(name)
+	}
+
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return nil, nil
+	}
+
+	return []Extent{{Length: fi.Size()}}, nil
+}
+
+// HasHoles reports whether a file of the given size, containing data only
+// within the given extents, has any holes.
+func HasHoles(extents []Extent, size int64) bool {
+	var offset int64
+	for _, e := range extents {
+		if e.Offset > offset {
+			return true
+		}
+		offset = max(offset, e.End())
+	}
+
+	return offset < size
+}
+
+// SeekData returns the offset of the first byte of data at or after offset,
+// as for lseek(2) with SEEK_DATA. It returns -1 if there is no data at or
+// after offset.
+func SeekData(extents []Extent, offset int64) int64 {
+	for _, e := range extents {
+		if offset < e.End() && e.Length > 0 {
+			return max(offset, e.Offset)
+		}
+	}
+
+	return -1
+}
+
+// SeekHole returns the offset of the first hole at or after offset in a file
+// of the given size, as for lseek(2) with SEEK_HOLE. The end of the file is
+// considered to be a hole.
+func SeekHole(extents []Extent, offset, size int64) int64 {
+	for _, e := range extents {
+		if offset < e.Offset {
+			break
+		}
+		if offset < e.End() {
+			offset = e.End()
+		}
+	}
+
+	return min(offset, size)
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparse(t *testing.T) {
+	// A 10 byte file, with data at [2, 6) (split into two extents) and [8, 9).
+	extents := []archivefs.Extent{{Offset: 2, Length: 2}, {Offset: 4, Length: 2}, {Offset: 8, Length: 1}}
+	const size = 10
+
+	t.Run("HasHoles", func(t *testing.T) {
+		require.True(t, archivefs.HasHoles(extents, size))
+		require.True(t, archivefs.HasHoles([]archivefs.Extent{{Length: 9}}, size))
+		require.True(t, archivefs.HasHoles(nil, size))
+		require.False(t, archivefs.HasHoles([]archivefs.Extent{{Length: 4}, {Offset: 4, Length: 6}}, size))
+		require.False(t, archivefs.HasHoles(nil, 0))
+	})
+
+	t.Run("SeekData", func(t *testing.T) {
+		want := []int64{2, 2, 2, 3, 4, 5, 8, 8, 8, -1, -1}
+		for offset := int64(0); offset <= size; offset++ {
+			require.Equal(t, want[offset], archivefs.SeekData(extents, offset), "offset %d", offset)
+		}
+	})
+
+	t.Run("SeekHole", func(t *testing.T) {
+		want := []int64{0, 1, 6, 6, 6, 6, 6, 7, 9, 9, 10}
+		for offset := int64(0); offset <= size; offset++ {
+			require.Equal(t, want[offset], archivefs.SeekHole(extents, offset, size), "offset %d", offset)
+		}
+	})
+
+	t.Run("LookupDataExtents", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"empty": {},
+			"file":  {Data: []byte("hello")},
+			"dir":   {Mode: fs.ModeDir | 0o755},
+		}
+
+		// Filesystems that don't implement SparseFS have no holes.
+		extents, err := archivefs.LookupDataExtents(fsys, "file")
+		require.NoError(t, err)
+		require.Equal(t, []archivefs.Extent{{Length: 5}}, extents)
+
+		extents, err = archivefs.LookupDataExtents(fsys, "empty")
+		require.NoError(t, err)
+		require.Empty(t, extents)
+
+		extents, err = archivefs.LookupDataExtents(fsys, "dir")
+		require.NoError(t, err)
+		require.Empty(t, extents)
+	})
+}
@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// SymlinkPolicy determines how symbolic links are extracted (or copied, see
+// copyfs), and how their targets are rewritten.
+type SymlinkPolicy int
+
+const (
+	// SymlinksUntouched creates symbolic links with their targets verbatim,
+	// so they may refer to paths outside of the extraction directory (eg.
+	// /etc/passwd). Nothing is ever written through them.
+	SymlinksUntouched SymlinkPolicy = iota
+	// SymlinksRelative rewrites absolute targets to be relative to the
+	// extraction directory, eg. a link at usr/bin/sh to /bin/busybox becomes
+	// ../../bin/busybox. Relative targets that would leave the extraction
+	// directory fail as for SymlinksFailEscaping.
+	SymlinksRelative
+	// SymlinksFailEscaping fails the extraction with an error wrapping
+	// ErrEscapesRoot if a link has an absolute target, or a relative target
+	// that would leave the extraction directory once the other links it
+	// passes through are followed (see SymlinkEscapes).
+	SymlinksFailEscaping
+	// SymlinksSkip doesn't extract symbolic links.
+	SymlinksSkip
+	// SymlinksFailAbsolute fails with an error wrapping ErrEscapesRoot if a
+	// link has an absolute target. Relative targets are left untouched.
+	SymlinksFailAbsolute
+)
+
+// Target applies the policy to target, the target of the symbolic link at
+// name in fsys, returning the target the link should be created with. It
+// fails with an error wrapping ErrEscapesRoot if the policy forbids the
+// target. Links to be skipped (SymlinksSkip) are left to the caller.
+func (p SymlinkPolicy) Target(fsys fs.FS, name, target string) (string, error) {
+	switch p {
+	case SymlinksUntouched, SymlinksSkip:
+		return target, nil
+	case SymlinksFailAbsolute:
+		if path.IsAbs(target) {
+			return "", fmt.Errorf("absolute symlink target %q: %w", target, ErrEscapesRoot)
+		}
+		return target, nil
+	}
+
+	if path.IsAbs(target) {
+		if p != SymlinksRelative {
+			return "", fmt.Errorf("absolute symlink target %q: %w", target, ErrEscapesRoot)
+		}
+		target = relativeTarget(name, target)
+	}
+
+	escapes, err := SymlinkEscapes(name, target, func(name string) (string, bool, error) {
+		return lookupLink(fsys, name)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if escapes {
+		return "", fmt.Errorf("symlink target %q: %w", target, ErrEscapesRoot)
+	}
+
+	return target, nil
+}
+
+// relativeTarget converts an absolute target, interpreted relative to the
+// root of the filesystem, into one relative to the directory containing the
+// link at name.
+func relativeTarget(name, target string) string {
+	var depth int
+	if dir := path.Dir(name); dir != "." {
+		depth = strings.Count(dir, "/") + 1
+	}
+
+	rel := strings.Repeat("../", depth) + strings.TrimPrefix(path.Clean(target), "/")
+	if rel == "" {
+		return "."
+	}
+
+	return strings.TrimSuffix(rel, "/")
+}
+
+// SymlinkEscapes reports whether the target of the symbolic link at name
+// would leave the root of a filesystem. The target is resolved one element at
+// a time, following the symbolic links it passes through as the kernel would
+// once they exist on disk, so that eg. a/../outside escapes if a is a link to
+// "..". Absolute targets are resolved from the root.
+//
+// readLink returns the target of the named entry, and whether it is a
+// symbolic link. Entries that are not symbolic links (or don't exist) are
+// resolved lexically.
+func SymlinkEscapes(name, target string, readLink func(name string) (target string, ok bool, err error)) (bool, error) {
+	var resolved []string
+	if dir := path.Dir(name); dir != "." && !path.IsAbs(target) {
+		resolved = strings.Split(dir, "/")
+	}
+
+	var links int
+	remaining := target
+	for remaining != "" {
+		var elem string
+		elem, remaining, _ = strings.Cut(remaining, "/")
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return true, nil
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, elem)
+
+		// The final element is not followed, links to other links are
+		// checked when those links are.
+		if strings.Trim(remaining, "/") == "" {
+			break
+		}
+
+		linkTarget, ok, err := readLink(path.Join(resolved...))
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		// Like the kernel, give up on loops (which can't escape).
+		links++
+		if links > MaxSymlinkHops {
+			return false, nil
+		}
+
+		resolved = resolved[:len(resolved)-1]
+		if path.IsAbs(linkTarget) {
+			resolved = resolved[:0]
+		}
+		remaining = linkTarget + "/" + remaining
+	}
+
+	return false, nil
+}
+
+// lookupLink returns the target of the named entry in fsys, if it is a
+// symbolic link. It is suitable for use with SymlinkEscapes.
+func lookupLink(fsys fs.FS, name string) (string, bool, error) {
+	fi, err := lstat(fsys, name)
+	if err != nil {
+		// Nothing can be resolved through entries that don't exist, or
+		// aren't directories.
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return "", false, nil
+	}
+
+	target, err := readLink(fsys, name)
+	if err != nil {
+		return "", false, err
+	}
+
+	return target, true, nil
+}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymlinkEscapes(t *testing.T) {
+	links := map[string]string{
+		"sub/a":    "..",
+		"sub/root": "/",
+		"loop":     "loop/x",
+	}
+
+	readLink := func(name string) (string, bool, error) {
+		target, ok := links[name]
+		return target, ok, nil
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		escapes bool
+	}{
+		{"sub/link", "../etc/passwd", false},
+		{"sub/link", "../../etc/passwd", true},
+		{"sub/link", "/etc/passwd", false},
+		{"sub/link", "/../etc/passwd", true},
+		{"sub/link", "a", false},
+		{"sub/link", "a/etc/passwd", false},
+		{"sub/link", "a/../etc/passwd", true},
+		{"sub/link", "root/../etc/passwd", true},
+		{"sub/link", "missing/../../etc/passwd", false},
+		{"sub/link", "missing/../../../etc/passwd", true},
+		{"link", "loop/x/../..", false},
+	}
+
+	for _, tt := range tests {
+		escapes, err := archivefs.SymlinkEscapes(tt.name, tt.target, readLink)
+		require.NoError(t, err)
+		require.Equal(t, tt.escapes, escapes, "%s -> %s", tt.name, tt.target)
+	}
+}
@@ -18,11 +18,31 @@ import (
 	"github.com/dpeckett/archivefs"
 )
 
+// CreateOptions configures how a tar archive is created.
+type CreateOptions struct {
+	// Filter, if set, is called for each path in the source filesystem and
+	// reports whether it should be included in the archive. Excluding a
+	// directory excludes everything beneath it.
+	Filter func(path string, d fs.DirEntry) (bool, error)
+}
+
 // Create creates a tar archive from the given filesystem.
 func Create(dst io.Writer, src fs.FS) error {
+	return CreateWithOptions(dst, src, nil)
+}
+
+// CreateWithOptions creates a tar archive from the given filesystem.
+func CreateWithOptions(dst io.Writer, src fs.FS, opts *CreateOptions) error {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
 	tw := tar.NewWriter(dst)
 	defer tw.Close()
 
+	// links holds the path of the first entry for each hard linked file.
+	links := map[uint64]string{}
+
 	return fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -34,6 +54,21 @@ func Create(dst io.Writer, src fs.FS) error {
 			return nil
 		}
 
+		if opts.Filter != nil {
+			include, err := opts.Filter(path, d)
+			if err != nil {
+				return err
+			}
+
+			if !include {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+
+				return nil
+			}
+		}
+
 		fi, err := d.Info()
 		if err != nil {
 			return err
@@ -58,11 +93,42 @@ func Create(dst io.Writer, src fs.FS) error {
 		}
 		hdr.Name = path
 
+		entry := archivefs.NewEntryFromInfo(path, fi)
+		hdr.Uid, hdr.Gid = entry.Uid, entry.Gid
+
+		if fi.Mode()&fs.ModeDevice != 0 {
+			hdr.Devmajor, hdr.Devminor = int64(entry.Major), int64(entry.Minor)
+		}
+
+		for attr, value := range entry.Xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[archivefs.PAXXattrPrefix+attr] = value
+		}
+
+		if d.Type().IsRegular() {
+			id, nlink, err := archivefs.LookupFileID(src, path, fi)
+			if err != nil {
+				return err
+			}
+
+			if id != 0 && nlink > 1 {
+				if target, ok := links[id]; ok {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = target
+					hdr.Size = 0
+				} else {
+					links[id] = path
+				}
+			}
+		}
+
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
 
-		if !d.Type().IsRegular() {
+		if hdr.Typeflag != tar.TypeReg {
 			return nil
 		}
 
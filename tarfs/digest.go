@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// ErrDigestMismatch is returned when the contents of a file (or an eStargz
+// chunk) do not match their expected digest.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// Manifest maps the paths of regular files in an archive to the expected
+// digest of their contents, in the form "<algorithm>:<hex>" (sha256 and
+// sha512 are supported, a bare hex digest is assumed to be sha256).
+type Manifest map[string]string
+
+// newDigestReader returns a reader that verifies the digest of everything
+// read from r once it reaches EOF.
+func newDigestReader(r io.Reader, name, digest string) (io.Reader, error) {
+	algorithm, want, ok := strings.Cut(digest, ":")
+	if !ok {
+		algorithm, want = "sha256", digest
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm for %s: %s: %w", name, algorithm, archiveerrors.ErrUnsupportedFeature)
+	}
+
+	return &digestReader{
+		r:    io.TeeReader(r, h),
+		h:    h,
+		name: name,
+		want: strings.ToLower(want),
+	}, nil
+}
+
+type digestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	name string
+	want string
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		if got := hex.EncodeToString(dr.h.Sum(nil)); got != dr.want {
+			return n, fmt.Errorf("%s: %w", dr.name, ErrDigestMismatch)
+		}
+	}
+
+	return n, err
+}
+
+// openVerified opens the contents of a dirent, verifying them against the
+// manifest if one was provided.
+func (fsys *FS) openVerified(d *dirent) (io.Reader, error) {
+	r, err := d.open()
+	if err != nil || fsys.manifest == nil || !d.Type().IsRegular() {
+		return r, err
+	}
+
+	digest, ok := fsys.manifest[d.Header.Name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the manifest: %w", d.Header.Name, ErrDigestMismatch)
+	}
+
+	return newDigestReader(r, d.Header.Name, digest)
+}
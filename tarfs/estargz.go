@@ -0,0 +1,372 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+const (
+	// estargzFooterSize is the size of an eStargz footer.
+	estargzFooterSize = 51
+	// legacyStargzFooterSize is the size of a legacy stargz footer.
+	legacyStargzFooterSize = 47
+	// estargzTOCName is the name of the tar entry containing the TOC.
+	estargzTOCName = "stargz.index.json"
+	// maxEStargzTOCSize is the maximum uncompressed size of the TOC.
+	maxEStargzTOCSize = 64 << 20
+)
+
+var errEStargzTOCTooLarge = fmt.Errorf("TOC is larger than %d bytes: %w", maxEStargzTOCSize, ErrLimitExceeded)
+
+// estargzTOC is the table of contents of an eStargz blob.
+type estargzTOC struct {
+	Version int                `json:"version"`
+	Entries []*estargzTOCEntry `json:"entries"`
+}
+
+// estargzTOCEntry is an entry in the eStargz TOC.
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+	InnerOffset int64             `json:"innerOffset,omitempty"`
+}
+
+// OpenEStargz opens an eStargz (seekable tar.gz) blob of the given size.
+// File contents are read lazily using the gzip stream offsets recorded in the
+// TOC, and each chunk is verified against its digest as it is read.
+func OpenEStargz(ra io.ReaderAt, size int64) (*FS, error) {
+	return OpenEStargzWithOptions(ra, size, nil)
+}
+
+// OpenEStargzWithOptions opens an eStargz blob of the given size. Entries of
+// the TOC are subject to the same strict mode checks and limits as those of
+// a tar archive. RecordRaw, RetainVersions, Spool and Decompress have no
+// effect, and Progress reports the bytes of the blob read to index it (ie.
+// the TOC and footer).
+func OpenEStargzWithOptions(ra io.ReaderAt, size int64, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	tocOffset, footerSize, err := readEStargzFooter(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	toc, err := readEStargzTOC(io.NewSectionReader(ra, tocOffset, size-footerSize-tocOffset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOC: %w", err)
+	}
+
+	// Group the chunks of each regular file together.
+	chunks := map[string][]*estargzTOCEntry{}
+	for _, e := range toc.Entries {
+		name := archivefs.CleanPath(e.Name)
+
+		switch e.Type {
+		case "reg":
+			chunks[name] = []*estargzTOCEntry{e}
+		case "chunk":
+			if _, ok := chunks[name]; !ok {
+				return nil, fmt.Errorf("chunk for unknown file %q", e.Name)
+			}
+
+			chunks[name] = append(chunks[name], e)
+		}
+	}
+
+	var sc *strictChecker
+	if opts.Strict {
+		sc = newStrictChecker()
+	}
+
+	var entries int
+	var totalSize int64
+	dirents := map[string]*dirent{}
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+
+		h, err := e.header()
+		if err != nil {
+			return nil, err
+		}
+		entries++
+
+		if err := opts.Limits.check(h, entries, &totalSize); err != nil {
+			return nil, err
+		}
+
+		if sc != nil {
+			if err := sc.check(h); err != nil {
+				return nil, err
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(entries, size-tocOffset)
+		}
+
+		name := archivefs.CleanPath(e.Name)
+
+		// Skip the junk root entry and the prefetch landmarks (which are not
+		// part of the original archive).
+		if name == "" || name == ".prefetch.landmark" || name == ".no.prefetch.landmark" {
+			continue
+		}
+
+		h.Name = name
+
+		addParentDirs(dirents, name)
+
+		d := &dirent{Header: *h}
+		if e.Type == "reg" {
+			d.data = estargzData(io.NewSectionReader(ra, 0, size), chunks[name], e.Size)
+		}
+
+		dirents[name] = d
+	}
+
+	fsys, err := newFS(dirents)
+	if err != nil {
+		return nil, err
+	}
+	fsys.symlinkPolicy = opts.SymlinkPolicy
+	fsys.manifest = opts.Manifest
+
+	return fsys, nil
+}
+
+func (e *estargzTOCEntry) header() (*tar.Header, error) {
+	h := &tar.Header{
+		Name:     e.Name,
+		Linkname: e.LinkName,
+		Size:     e.Size,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		Devmajor: e.DevMajor,
+		Devminor: e.DevMinor,
+	}
+
+	switch e.Type {
+	case "dir":
+		h.Typeflag = tar.TypeDir
+	case "reg":
+		h.Typeflag = tar.TypeReg
+	case "symlink":
+		h.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		h.Typeflag = tar.TypeLink
+	case "char":
+		h.Typeflag = tar.TypeChar
+	case "block":
+		h.Typeflag = tar.TypeBlock
+	case "fifo":
+		h.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("unsupported file type: %s, %s: %w", e.Name, e.Type, archiveerrors.ErrUnsupportedFeature)
+	}
+
+	if e.ModTime3339 != "" {
+		modTime, err := time.Parse(time.RFC3339, e.ModTime3339)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse modification time of %s: %w", e.Name, err)
+		}
+		h.ModTime = modTime
+	}
+
+	if len(e.Xattrs) > 0 {
+		h.PAXRecords = map[string]string{}
+		for key, value := range e.Xattrs {
+			h.PAXRecords[archivefs.PAXXattrPrefix+key] = string(value)
+		}
+	}
+
+	return h, nil
+}
+
+// estargzData returns a function that reads the contents of a regular file
+// by decompressing each of its chunks in turn.
+func estargzData(blob *io.SectionReader, chunks []*estargzTOCEntry, size int64) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		readers := make([]io.Reader, 0, len(chunks))
+		for i, c := range chunks {
+			end := size
+			if i+1 < len(chunks) {
+				end = chunks[i+1].ChunkOffset
+			}
+
+			digest := c.ChunkDigest
+			if digest == "" && len(chunks) == 1 {
+				digest = c.Digest
+			}
+
+			readers = append(readers, &estargzChunkReader{
+				blob:   blob,
+				offset: c.Offset,
+				inner:  c.InnerOffset,
+				size:   end - c.ChunkOffset,
+				digest: digest,
+			})
+		}
+
+		return io.MultiReader(readers...), nil
+	}
+}
+
+// estargzChunkReader lazily decompresses a single chunk and verifies its digest.
+type estargzChunkReader struct {
+	blob   *io.SectionReader
+	offset int64
+	inner  int64
+	size   int64
+	digest string
+	r      io.Reader
+}
+
+func (cr *estargzChunkReader) Read(p []byte) (int, error) {
+	if cr.r == nil {
+		// The gzip stream has no explicit length, so read until the end of the blob.
+		zr, err := gzip.NewReader(io.NewSectionReader(cr.blob, cr.offset, cr.blob.Size()-cr.offset))
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := io.CopyN(io.Discard, zr, cr.inner); err != nil {
+			return 0, err
+		}
+
+		cr.r = io.LimitReader(zr, cr.size)
+		if cr.digest != "" {
+			cr.r, err = newDigestReader(cr.r, fmt.Sprintf("chunk at offset %d", cr.offset), cr.digest)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return cr.r.Read(p)
+}
+
+// readEStargzFooter returns the offset of the TOC and the size of the footer.
+func readEStargzFooter(ra io.ReaderAt, size int64) (int64, int64, error) {
+	for _, footerSize := range []int64{estargzFooterSize, legacyStargzFooterSize} {
+		if size < footerSize {
+			continue
+		}
+
+		footer := make([]byte, footerSize)
+		if _, err := ra.ReadAt(footer, size-footerSize); err != nil {
+			return 0, 0, err
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(footer))
+		if err != nil {
+			continue
+		}
+
+		extra := zr.Header.Extra
+		if footerSize == estargzFooterSize {
+			// The eStargz footer wraps the payload in an "SG" subfield.
+			if len(extra) < 4 || extra[0] != 'S' || extra[1] != 'G' {
+				continue
+			}
+			extra = extra[4:]
+		}
+
+		if len(extra) != 22 || !strings.HasSuffix(string(extra), "STARGZ") {
+			continue
+		}
+
+		tocOffset, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to parse TOC offset: %w", err)
+		}
+
+		if tocOffset < 0 || tocOffset > size-footerSize {
+			return 0, 0, fmt.Errorf("invalid TOC offset: %d", tocOffset)
+		}
+
+		return tocOffset, footerSize, nil
+	}
+
+	return 0, 0, errors.New("invalid estargz footer")
+}
+
+func readEStargzTOC(r io.Reader) (*estargzTOC, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the decompressed stream (the TOC and its tar headers), so a
+	// small compressed TOC can't expand without limit.
+	lr := &io.LimitedReader{R: zr, N: maxEStargzTOCSize + 64<<10}
+
+	tr := tar.NewReader(lr)
+	h, err := tr.Next()
+	if err != nil {
+		if lr.N <= 0 {
+			return nil, errEStargzTOCTooLarge
+		}
+		return nil, err
+	}
+
+	if h.Name != estargzTOCName {
+		return nil, fmt.Errorf("unexpected TOC entry: %s", h.Name)
+	}
+
+	if h.Size > maxEStargzTOCSize {
+		return nil, errEStargzTOCTooLarge
+	}
+
+	var toc estargzTOC
+	if err := json.NewDecoder(tr).Decode(&toc); err != nil {
+		if lr.N <= 0 {
+			return nil, errEStargzTOCTooLarge
+		}
+		return nil, err
+	}
+
+	return &toc, nil
+}
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"context"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// ExtractOptions configures how an archive is extracted.
+type ExtractOptions struct {
+	// Workers is the number of files to extract concurrently, defaults to the
+	// number of CPUs.
+	Workers int
+	// PreserveOwner sets the owner of extracted files to the uid/gid recorded
+	// in the archive (this typically requires root).
+	PreserveOwner bool
+	// PreserveXattrs sets the extended attributes recorded in the archive on
+	// extracted files and directories (only supported on Linux).
+	PreserveXattrs bool
+}
+
+// ExtractAll extracts the contents of the filesystem into dir, preserving
+// modes, modification times, symbolic links and hard links. It is equivalent
+// to archivefs.Extract, with symbolic links created untouched.
+//
+// Deprecated: use archivefs.Extract, which supports any filesystem.
+func ExtractAll(ctx context.Context, fsys *FS, dir string, opts *ExtractOptions) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+
+	return archivefs.Extract(ctx, fsys, dir, &archivefs.ExtractOptions{
+		Concurrency:    opts.Workers,
+		PreserveOwner:  opts.PreserveOwner,
+		PreserveXattrs: opts.PreserveXattrs,
+	})
+}
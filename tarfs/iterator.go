@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ archivefs.Iterator = (*Iterator)(nil)
+)
+
+// Iterator provides sequential access to the entries of a tar archive, for
+// use when the archive is streamed and an io.ReaderAt is not available.
+// Entry names and symbolic link targets are sanitized as for Open, and PAX
+// global records are applied to each entry.
+type Iterator struct {
+	tr      *tar.Reader
+	globals map[string]string
+}
+
+// NewIterator returns an Iterator over the tar archive read from r.
+func NewIterator(r io.Reader) *Iterator {
+	return &Iterator{
+		tr:      tar.NewReader(r),
+		globals: map[string]string{},
+	}
+}
+
+// Next advances to the next entry in the archive. Any remaining data in the
+// current entry is discarded. io.EOF is returned at the end of the archive.
+func (it *Iterator) Next() (*archivefs.Entry, io.Reader, error) {
+	for {
+		h, err := it.tr.Next()
+		if err != nil {
+			return nil, nil, corrupted(-1, err)
+		}
+
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse, tar.TypeDir, tar.TypeLink, tar.TypeSymlink,
+			tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			// NOP
+		case tar.TypeXGlobalHeader:
+			mergeGlobalRecords(it.globals, h)
+			continue
+		default:
+			return nil, nil, fmt.Errorf("unsupported file type: %s, %c: %w", h.Name, h.Typeflag, archiveerrors.ErrUnsupportedFeature)
+		}
+
+		if err := applyGlobalRecords(it.globals, h); err != nil {
+			return nil, nil, err
+		}
+
+		h.Name = archivefs.CleanPath(h.Name)
+
+		// there might be a junk root entry.
+		if h.Name == "" {
+			continue
+		}
+
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			if strings.HasPrefix(h.Linkname, "./") {
+				h.Linkname = strings.TrimPrefix(h.Linkname, ".")
+			}
+			h.Linkname = filepath.Clean(h.Linkname)
+		case tar.TypeLink:
+			h.Linkname = archivefs.CleanPath(h.Linkname)
+		}
+
+		e := archivefs.NewEntryFromInfo(h.Name, h.FileInfo())
+		if h.Typeflag == tar.TypeLink {
+			e.HardLink = h.Linkname
+			e.Size = 0
+		}
+
+		return e, it.tr, nil
+	}
+}
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// ErrLimitExceeded is returned when an archive exceeds one of the configured
+// resource limits. It is the shared archiveerrors.ErrLimitExceeded.
+var ErrLimitExceeded = archiveerrors.ErrLimitExceeded
+
+// Limits bounds the resources consumed when indexing an archive, to defend
+// against archive bombs. A zero value for any limit means unlimited.
+type Limits struct {
+	// MaxEntries is the maximum number of entries in the archive.
+	MaxEntries int
+	// MaxTotalSize is the maximum total uncompressed size of all files.
+	MaxTotalSize int64
+	// MaxPathDepth is the maximum number of components in an entry path.
+	MaxPathDepth int
+	// MaxPathLength is the maximum length of an entry path in bytes.
+	MaxPathLength int
+}
+
+func (l *Limits) check(h *tar.Header, entries int, totalSize *int64) error {
+	if l.MaxEntries > 0 && entries > l.MaxEntries {
+		return fmt.Errorf("archive has more than %d entries: %w", l.MaxEntries, ErrLimitExceeded)
+	}
+
+	if l.MaxPathLength > 0 && len(h.Name) > l.MaxPathLength {
+		return fmt.Errorf("entry %q is longer than %d bytes: %w", h.Name, l.MaxPathLength, ErrLimitExceeded)
+	}
+
+	if l.MaxPathDepth > 0 {
+		if name := archivefs.CleanPath(h.Name); name != "" && strings.Count(name, "/")+1 > l.MaxPathDepth {
+			return fmt.Errorf("entry %q is deeper than %d components: %w", h.Name, l.MaxPathDepth, ErrLimitExceeded)
+		}
+	}
+
+	if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeGNUSparse {
+		*totalSize += h.Size
+		if l.MaxTotalSize > 0 && *totalSize > l.MaxTotalSize {
+			return fmt.Errorf("archive is larger than %d bytes: %w", l.MaxTotalSize, ErrLimitExceeded)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GlobalRecords returns the PAX global records (eg. the commit ID stored by
+// git-archive) that were in effect at the end of the archive.
+func (fsys *FS) GlobalRecords() map[string]string {
+	return maps.Clone(fsys.globalRecords)
+}
+
+// mergeGlobalRecords updates the set of global records with those from a
+// global header. Per the PAX spec, an empty value deletes the record.
+func mergeGlobalRecords(globals map[string]string, h *tar.Header) {
+	for key, value := range h.PAXRecords {
+		if value == "" {
+			delete(globals, key)
+		} else {
+			globals[key] = value
+		}
+	}
+}
+
+// applyGlobalRecords applies the global records to a header, unless they are
+// overridden by the header's own extended records.
+func applyGlobalRecords(globals map[string]string, h *tar.Header) error {
+	for key, value := range globals {
+		if _, ok := h.PAXRecords[key]; ok {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "path":
+			h.Name = value
+		case "linkpath":
+			h.Linkname = value
+		case "uname":
+			h.Uname = value
+		case "gname":
+			h.Gname = value
+		case "uid":
+			h.Uid, err = strconv.Atoi(value)
+		case "gid":
+			h.Gid, err = strconv.Atoi(value)
+		case "mtime":
+			h.ModTime, err = parsePAXTime(value)
+		case "atime":
+			h.AccessTime, err = parsePAXTime(value)
+		case "ctime":
+			h.ChangeTime, err = parsePAXTime(value)
+		case "size":
+			// The entry has already been read using its own size.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid global record %s=%q: %w", key, value, err)
+		}
+
+		if h.PAXRecords == nil {
+			h.PAXRecords = map[string]string{}
+		}
+		h.PAXRecords[key] = value
+	}
+
+	return nil
+}
+
+// parsePAXTime parses a PAX timestamp of the form "seconds[.nanoseconds]".
+func parsePAXTime(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nsec int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+
+		nsec, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if strings.HasPrefix(secs, "-") {
+			nsec = -nsec
+		}
+	}
+
+	return time.Unix(sec, nsec), nil
+}
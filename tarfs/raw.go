@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"errors"
+	"io"
+)
+
+var _ io.WriterTo = (*FS)(nil)
+
+// WriteTo reproduces the original archive byte-for-byte, including any
+// unusual padding or trailing data. The archive must have been opened with
+// Options.RecordRaw set.
+func (fsys *FS) WriteTo(w io.Writer) (int64, error) {
+	if fsys.raw == nil {
+		return 0, errors.New("raw archive metadata was not recorded")
+	}
+
+	var written int64
+	for _, seg := range fsys.raw.segments {
+		var n int64
+		var err error
+		if seg.data != nil {
+			var nn int
+			nn, err = w.Write(seg.data)
+			n = int64(nn)
+		} else {
+			n, err = io.Copy(w, io.NewSectionReader(fsys.raw.ra, seg.offset, seg.size))
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// rawSegment is a contiguous region of the original archive. Metadata (headers
+// and padding) is retained in memory, whereas file payloads are re-read from
+// the underlying archive on demand.
+type rawSegment struct {
+	data   []byte
+	offset int64
+	size   int64
+}
+
+// rawRecorder splits an archive into metadata and payload segments as it is
+// indexed.
+type rawRecorder struct {
+	ra       io.ReaderAt
+	segments []rawSegment
+	end      int64
+}
+
+// metadata records everything up to offset as raw metadata.
+func (rr *rawRecorder) metadata(offset int64) error {
+	if offset <= rr.end {
+		return nil
+	}
+
+	data := make([]byte, offset-rr.end)
+	if _, err := rr.ra.ReadAt(data, rr.end); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	rr.segments = append(rr.segments, rawSegment{data: data, offset: rr.end, size: int64(len(data))})
+	rr.end = offset
+
+	return nil
+}
+
+// payload records everything up to offset as file contents.
+func (rr *rawRecorder) payload(offset int64) {
+	if offset <= rr.end {
+		return
+	}
+
+	rr.segments = append(rr.segments, rawSegment{offset: rr.end, size: offset - rr.end})
+	rr.end = offset
+}
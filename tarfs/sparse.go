@@ -0,0 +1,297 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	_ archivefs.SparseFS = (*FS)(nil)
+)
+
+const (
+	blockSize = 512
+	// maxSparseMapSize bounds the size of a PAX 1.0 sparse map.
+	maxSparseMapSize = 1 << 20
+)
+
+// Offsets of fields within old GNU sparse headers.
+const (
+	gnuSparseOffset       = 386
+	gnuSparseEntries      = 4
+	gnuIsExtendedOffset   = 482
+	gnuExtSparseEntries   = 21
+	gnuExtIsExtendedIndex = 504
+	gnuSparseEntrySize    = 24
+)
+
+// ErrSparseMap is returned when the sparse map of an entry cannot be parsed.
+var ErrSparseMap = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "invalid sparse map")
+
+// DataExtents returns the extents of the named regular file that contain
+// data. Sparse entries (in any of the GNU formats) contain holes, other files
+// consist of a single extent.
+func (fsys *FS) DataExtents(name string) ([]archivefs.Extent, error) {
+	d, err := resolve(&fsys.root, name, fsys.symlinkPolicy)
+	if err != nil {
+		return nil, &fs.PathError{Op: "dataextents", Path: name, Err: err}
+	}
+
+	if !d.FileInfo().Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "dataextents", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if d.sparse != nil {
+		return slices.Clone(d.sparse), nil
+	}
+
+	if d.Size == 0 {
+		return nil, nil
+	}
+
+	return []archivefs.Extent{{Length: d.Size}}, nil
+}
+
+// readSparseMap reads the sparse map of the entry with the given header, the
+// first header block of which is at offset within the archive.
+func readSparseMap(ra io.ReaderAt, offset int64, h *tar.Header) ([]archivefs.Extent, error) {
+	var blk [blockSize]byte
+
+	// Skip any extension headers preceding the main header.
+	for {
+		if _, err := ra.ReadAt(blk[:], offset); err != nil {
+			return nil, err
+		}
+		offset += blockSize
+
+		typeflag := blk[156]
+		if typeflag != tar.TypeXHeader && typeflag != tar.TypeXGlobalHeader &&
+			typeflag != tar.TypeGNULongName && typeflag != tar.TypeGNULongLink {
+			break
+		}
+
+		size, err := parseNumeric(blk[124:136])
+		if err != nil {
+			return nil, err
+		}
+
+		offset += (size + blockSize - 1) &^ (blockSize - 1)
+	}
+
+	if blk[156] == tar.TypeGNUSparse {
+		extents, err := readOldGNUSparseMap(ra, offset, &blk)
+		if err != nil {
+			return nil, err
+		}
+
+		return normalizeExtents(extents), nil
+	}
+
+	var extents []archivefs.Extent
+	var err error
+	if h.PAXRecords["GNU.sparse.major"] == "1" && h.PAXRecords["GNU.sparse.minor"] == "0" {
+		// The map is stored at the start of the entry's data.
+		extents, err = readGNUSparseMap1x0(io.NewSectionReader(ra, offset, maxSparseMapSize))
+	} else {
+		// The reader converts 0.0 records into the 0.1 map.
+		extents, err = parseGNUSparseMap0x1(h.PAXRecords["GNU.sparse.map"])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeExtents(extents), nil
+}
+
+// readOldGNUSparseMap reads the sparse map stored in an old GNU sparse header,
+// and any extension blocks following it (at offset).
+func readOldGNUSparseMap(ra io.ReaderAt, offset int64, blk *[blockSize]byte) ([]archivefs.Extent, error) {
+	extents, err := appendGNUSparseEntries(nil, blk[gnuSparseOffset:], gnuSparseEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	for extended := blk[gnuIsExtendedOffset] != 0; extended; extended = blk[gnuExtIsExtendedIndex] != 0 {
+		if _, err := ra.ReadAt(blk[:], offset); err != nil {
+			return nil, err
+		}
+		offset += blockSize
+
+		if extents, err = appendGNUSparseEntries(extents, blk[:], gnuExtSparseEntries); err != nil {
+			return nil, err
+		}
+	}
+
+	return extents, nil
+}
+
+func appendGNUSparseEntries(extents []archivefs.Extent, b []byte, n int) ([]archivefs.Extent, error) {
+	for i := 0; i < n; i++ {
+		entry := b[i*gnuSparseEntrySize : (i+1)*gnuSparseEntrySize]
+		if entry[0] == 0 {
+			break
+		}
+
+		offset, err := parseNumeric(entry[:12])
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := parseNumeric(entry[12:])
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, archivefs.Extent{Offset: offset, Length: length})
+	}
+
+	return extents, nil
+}
+
+// readGNUSparseMap1x0 reads a PAX 1.0 sparse map, consisting of the number of
+// entries followed by the offset and length of each, as newline-terminated
+// decimal numbers.
+func readGNUSparseMap1x0(r io.Reader) ([]archivefs.Extent, error) {
+	var buf bytes.Buffer
+	var blk [blockSize]byte
+
+	nextToken := func() (int64, error) {
+		for bytes.IndexByte(buf.Bytes(), '\n') < 0 {
+			if _, err := io.ReadFull(r, blk[:]); err != nil {
+				return 0, fmt.Errorf("%w: %w", ErrSparseMap, err)
+			}
+			buf.Write(blk[:])
+		}
+
+		tok, _ := buf.ReadString('\n')
+		n, err := strconv.ParseInt(strings.TrimSuffix(tok, "\n"), 10, 64)
+		if err != nil || n < 0 {
+			return 0, ErrSparseMap
+		}
+
+		return n, nil
+	}
+
+	n, err := nextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var extents []archivefs.Extent
+	for i := int64(0); i < n; i++ {
+		offset, err := nextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := nextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, archivefs.Extent{Offset: offset, Length: length})
+	}
+
+	return extents, nil
+}
+
+// parseGNUSparseMap0x1 parses a PAX 0.1 sparse map, a comma separated list of
+// the offset and length of each entry.
+func parseGNUSparseMap0x1(s string) ([]archivefs.Extent, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(s, ",")
+	if len(fields)%2 != 0 {
+		return nil, ErrSparseMap
+	}
+
+	extents := make([]archivefs.Extent, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		offset, err1 := strconv.ParseInt(fields[i], 10, 64)
+		length, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || offset < 0 || length < 0 {
+			return nil, ErrSparseMap
+		}
+
+		extents = append(extents, archivefs.Extent{Offset: offset, Length: length})
+	}
+
+	return extents, nil
+}
+
+// normalizeExtents removes empty extents (eg. the terminating entry GNU tar
+// writes at the end of the file), and merges adjacent ones.
+func normalizeExtents(extents []archivefs.Extent) []archivefs.Extent {
+	normalized := []archivefs.Extent{}
+	for _, e := range extents {
+		if e.Length == 0 {
+			continue
+		}
+
+		if n := len(normalized); n > 0 && normalized[n-1].End() == e.Offset {
+			normalized[n-1].Length += e.Length
+			continue
+		}
+
+		normalized = append(normalized, e)
+	}
+
+	return normalized
+}
+
+// parseNumeric parses a numeric header field, in either octal or (if the high
+// bit of the first byte is set) base-256.
+func parseNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		if b[0]&0x40 != 0 {
+			// Negative.
+			return 0, ErrSparseMap
+		}
+
+		var n int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if n > math.MaxInt64>>8 {
+				return 0, ErrSparseMap
+			}
+			n = n<<8 | int64(c)
+		}
+
+		return n, nil
+	}
+
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(s, 8, 64)
+	if err != nil || n < 0 {
+		return 0, ErrSparseMap
+	}
+
+	return n, nil
+}
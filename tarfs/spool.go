@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dpeckett/archivefs/compression"
+)
+
+// DefaultSpoolMemoryLimit is the amount of data OpenReader will buffer in
+// memory before spilling to a temporary file.
+const DefaultSpoolMemoryLimit = compression.DefaultSpoolMemoryLimit
+
+// SpoolOptions configures how OpenReader buffers a non-seekable archive.
+type SpoolOptions = compression.SpoolOptions
+
+// OpenReader opens a tar archive from a non-seekable io.Reader, eg. an HTTP
+// response body or a pipe. The archive is spooled into memory, or a temporary
+// file for larger archives, as it is indexed. If Options.Decompress is set,
+// compressed archives are decompressed before they are spooled. The returned
+// FS must be closed to release the spooled data.
+func OpenReader(r io.Reader, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.Decompress {
+		dr, _, err := compression.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress archive: %w", err)
+		}
+		defer dr.Close()
+
+		r = dr
+	}
+
+	s := compression.NewSpool(r, &opts.Spool)
+
+	fsys, err := OpenWithOptions(s, opts)
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	fsys.closer = s
+
+	return fsys, nil
+}
+
+// Close releases any resources held by the filesystem. It is only required
+// for filesystems returned by OpenReader.
+func (fsys *FS) Close() error {
+	if fsys.closer == nil {
+		return nil
+	}
+
+	return fsys.closer.Close()
+}
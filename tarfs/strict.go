@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+var (
+	// ErrUnsafePath is returned in strict mode when an entry, or the target of
+	// a link, would escape the root of the archive.
+	ErrUnsafePath = archivefs.ErrUnsafePath
+	// ErrConflictingType is returned in strict mode when an entry is redefined
+	// with a different file type.
+	ErrConflictingType = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "conflicting entry type")
+	// ErrInvalidSize is returned in strict mode when an entry has a size that
+	// is impossible for its file type.
+	ErrInvalidSize = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "invalid entry size")
+)
+
+// strictChecker validates archive entries against the rules of strict mode.
+type strictChecker struct {
+	types map[string]fs.FileMode
+	// symlinks and hardlinks hold the raw targets of each link, which are
+	// resolved once the whole archive has been read (see finish).
+	symlinks  map[string]string
+	hardlinks map[string]string
+}
+
+func newStrictChecker() *strictChecker {
+	return &strictChecker{
+		types:     map[string]fs.FileMode{},
+		symlinks:  map[string]string{},
+		hardlinks: map[string]string{},
+	}
+}
+
+func (sc *strictChecker) check(h *tar.Header) error {
+	if escapesRoot("", h.Name) {
+		return fmt.Errorf("entry %q escapes archive root: %w", h.Name, ErrUnsafePath)
+	}
+
+	name := archivefs.CleanPath(h.Name)
+	if name == "" {
+		return nil
+	}
+
+	// Entries beneath a symlink would be written through the link on extraction.
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if sc.types[dir] == fs.ModeSymlink {
+			return fmt.Errorf("entry %q traverses symlink %q: %w", h.Name, dir, ErrUnsafePath)
+		}
+	}
+
+	switch h.Typeflag {
+	case tar.TypeSymlink:
+		sc.symlinks[name] = h.Linkname
+	case tar.TypeLink:
+		sc.hardlinks[name] = h.Linkname
+	}
+
+	switch h.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if h.Size < 0 {
+			return fmt.Errorf("entry %q has negative size %d: %w", h.Name, h.Size, ErrInvalidSize)
+		}
+	default:
+		if h.Size != 0 {
+			return fmt.Errorf("entry %q of type %c has non-zero size %d: %w", h.Name, h.Typeflag, h.Size, ErrInvalidSize)
+		}
+	}
+
+	typ := h.FileInfo().Mode().Type()
+	if prev, ok := sc.types[name]; ok && prev != typ {
+		return fmt.Errorf("entry %q redefined from %v to %v: %w", h.Name, prev, typ, ErrConflictingType)
+	}
+	sc.types[name] = typ
+
+	return nil
+}
+
+// finish checks that no link target escapes the root of the archive, once
+// the symbolic links it passes through are followed. A later entry may add a
+// link that an earlier target passes through, so this can only be done once
+// every entry has been read.
+func (sc *strictChecker) finish() error {
+	readLink := func(name string) (string, bool, error) {
+		target, ok := sc.symlinks[name]
+		return target, ok, nil
+	}
+
+	for _, name := range sortedKeys(sc.symlinks) {
+		escapes, err := archivefs.SymlinkEscapes(name, sc.symlinks[name], readLink)
+		if err != nil {
+			return err
+		}
+
+		if escapes {
+			return fmt.Errorf("symlink %q target %q escapes archive root: %w", name, sc.symlinks[name], ErrUnsafePath)
+		}
+	}
+
+	// Hard link targets are paths from the root of the archive.
+	for _, name := range sortedKeys(sc.hardlinks) {
+		escapes, err := archivefs.SymlinkEscapes(".", sc.hardlinks[name], readLink)
+		if err != nil {
+			return err
+		}
+
+		if escapes {
+			return fmt.Errorf("hardlink %q target %q escapes archive root: %w", name, sc.hardlinks[name], ErrUnsafePath)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+// escapesRoot reports whether walking the components of name, starting from
+// the directory base, would ever step above the root of the archive.
+func escapesRoot(base, name string) bool {
+	var depth int
+	for _, component := range strings.Split(filepath.ToSlash(base), "/") {
+		if component != "" && component != "." {
+			depth++
+		}
+	}
+
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
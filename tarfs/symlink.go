@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"fmt"
+	"path/filepath"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+)
+
+// ErrSymlinkPolicy is returned when resolving a path requires following a
+// symbolic link that is not permitted by the filesystem's SymlinkPolicy.
+var ErrSymlinkPolicy = archiveerrors.Define(archiveerrors.ErrInsecurePath, "symlink not permitted by policy")
+
+// SymlinkPolicy controls how symbolic links are followed when resolving paths.
+type SymlinkPolicy int
+
+const (
+	// SymlinkFollow follows all symbolic links, targets that would escape the
+	// archive are clamped to its root (this is the default).
+	SymlinkFollow SymlinkPolicy = iota
+	// SymlinkFollowWithinRoot follows symbolic links only if their target
+	// does not escape the root of the archive.
+	SymlinkFollowWithinRoot
+	// SymlinkErrorOnAbsolute follows relative symbolic links, but returns an
+	// error for links with absolute targets.
+	SymlinkErrorOnAbsolute
+	// SymlinkNoFollow never follows symbolic links.
+	SymlinkNoFollow
+)
+
+func (p SymlinkPolicy) check(d *dirent) error {
+	switch p {
+	case SymlinkFollowWithinRoot:
+		base := filepath.Dir(d.Header.Name)
+		if filepath.IsAbs(d.Linkname) {
+			base = ""
+		}
+
+		if escapesRoot(base, d.Linkname) {
+			return fmt.Errorf("symlink %q target %q escapes archive root: %w", d.Header.Name, d.Linkname, ErrSymlinkPolicy)
+		}
+	case SymlinkErrorOnAbsolute:
+		if filepath.IsAbs(d.Linkname) {
+			return fmt.Errorf("symlink %q has absolute target %q: %w", d.Header.Name, d.Linkname, ErrSymlinkPolicy)
+		}
+	case SymlinkNoFollow:
+		return fmt.Errorf("symlink %q: %w", d.Header.Name, ErrSymlinkPolicy)
+	}
+
+	return nil
+}
@@ -11,15 +11,19 @@ package tarfs
 
 import (
 	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
 
 	"github.com/dpeckett/archivefs"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/readdir"
 )
 
 var (
@@ -27,45 +31,183 @@ var (
 	_ fs.ReadDirFS         = (*FS)(nil)
 	_ fs.StatFS            = (*FS)(nil)
 	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ archivefs.LinkFS     = (*FS)(nil)
+	_ fs.ReadDirFile       = (*dir)(nil)
 )
 
 type FS struct {
-	root dirent
+	root          dirent
+	raw           *rawRecorder
+	closer        io.Closer
+	globalRecords map[string]string
+	versions      map[string][]*dirent
+	toc           []EntryOffsets
+	symlinkPolicy SymlinkPolicy
+	manifest      Manifest
 }
 
+// Options configures how a tar archive is indexed.
+type Options struct {
+	// Strict rejects archives containing entries that are unsafe to serve
+	// from untrusted sources, eg. paths or links that escape the root of the
+	// archive (once the symbolic links they pass through are followed),
+	// entries that change type, or entries with impossible sizes.
+	Strict bool
+	// RecordRaw retains the raw header bytes and padding of the archive so
+	// that it can be reproduced byte-for-byte with FS.WriteTo.
+	RecordRaw bool
+	// RetainVersions retains every entry for paths that are defined more than
+	// once, rather than only the last, so they can be enumerated with
+	// FS.Versions.
+	RetainVersions bool
+	// Progress, if set, is called after each entry is indexed with the number
+	// of entries and bytes of the archive that have been read so far.
+	Progress func(entries int, bytes int64)
+	// SymlinkPolicy controls how symbolic links are followed when resolving
+	// paths in the filesystem.
+	SymlinkPolicy SymlinkPolicy
+	// Manifest, if set, is used to verify the contents of every regular file
+	// as it is read. Reads fail with ErrDigestMismatch if the contents do not
+	// match, or the file is not listed in the manifest.
+	Manifest Manifest
+	// Limits bounds the resources consumed when indexing the archive.
+	Limits Limits
+	// Spool configures how OpenReader buffers non-seekable archives.
+	Spool SpoolOptions
+	// Decompress makes OpenReader detect and decompress compressed archives
+	// (see the compression package).
+	Decompress bool
+}
+
+// Open opens a tar archive from the given io.ReaderAt using the default options.
 func Open(ra io.ReaderAt) (*FS, error) {
-	r := &readerWithOffset{ra: ra}
+	return OpenWithOptions(ra, nil)
+}
+
+// OpenWithOptions opens a tar archive from the given io.ReaderAt.
+func OpenWithOptions(ra io.ReaderAt, opts *Options) (*FS, error) {
+	return OpenContext(context.Background(), ra, opts)
+}
+
+// OpenContext opens a tar archive from the given io.ReaderAt. Indexing is
+// aborted with the context's error if the context is cancelled.
+func OpenContext(ctx context.Context, ra io.ReaderAt, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	r := &readerWithOffset{ctx: ctx, ra: ra}
 	tr := tar.NewReader(r)
 
+	var sc *strictChecker
+	if opts.Strict {
+		sc = newStrictChecker()
+	}
+
+	var rr *rawRecorder
+	if opts.RecordRaw {
+		rr = &rawRecorder{ra: ra}
+	}
+
+	var entries int
+	var totalSize int64
+	globals := map[string]string{}
+
+	var versions map[string][]*dirent
+	if opts.RetainVersions {
+		versions = map[string][]*dirent{}
+	}
+
+	var toc []EntryOffsets
 	dirents := map[string]*dirent{}
+
+	// end is the offset of the end of the previous entry, the contents of
+	// which may not have been read yet.
+	var end int64
 	for {
+		if opts.Progress != nil && entries > 0 {
+			opts.Progress(entries, max(r.offset, end))
+		}
+
 		// round to next 512 byte boundary.
-		begin := (r.offset + 511) &^ 511
+		begin := (max(r.offset, end) + 511) &^ 511
+
+		if rr != nil {
+			rr.payload(r.offset)
+		}
 
 		h, err := tr.Next()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
+				if rr != nil {
+					// Retain the end-of-archive marker and any trailing data.
+					if _, err := io.Copy(io.Discard, r); err != nil {
+						return nil, err
+					}
+
+					if err := rr.metadata(r.offset); err != nil {
+						return nil, err
+					}
+				}
+
+				if opts.Progress != nil {
+					opts.Progress(entries, r.offset)
+				}
+
 				break
 			}
 
+			return nil, corrupted(begin, err)
+		}
+		entries++
+		dataOffset := r.offset
+
+		if err := opts.Limits.check(h, entries, &totalSize); err != nil {
 			return nil, err
 		}
 
+		if rr != nil {
+			if err := rr.metadata(r.offset); err != nil {
+				return nil, err
+			}
+		}
+
+		end = r.offset
+
 		switch h.Typeflag {
 		case tar.TypeReg, tar.TypeGNUSparse:
+			if rr == nil && !isSparse(h) {
+				// The contents are skipped by the next call to Next, seeking
+				// past them so that they are not read (eg. decompressed).
+				end = dataOffset + h.Size
+				break
+			}
+
 			// Discard the file contents (so that the reader is consumed).
 			if _, err := io.Copy(io.Discard, tr); err != nil {
-				return nil, fmt.Errorf("failed to read file %s: %w", h.Name, err)
+				return nil, fmt.Errorf("failed to read file %s: %w", h.Name, corrupted(dataOffset, err))
 			}
-		case tar.TypeDir, tar.TypeLink, tar.TypeSymlink:
+			end = r.offset
+		case tar.TypeDir, tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
 			// NOP
 		case tar.TypeXGlobalHeader:
-			continue // Ignore metadata-only entries.
+			mergeGlobalRecords(globals, h)
+			continue
 		default:
-			return nil, fmt.Errorf("unsupported file type: %s, %c", h.Name, h.Typeflag)
+			return nil, fmt.Errorf("unsupported file type: %s, %c: %w", h.Name, h.Typeflag, archiveerrors.ErrUnsupportedFeature)
 		}
 
-		h.Name = sanitizePath(h.Name)
+		if err := applyGlobalRecords(globals, h); err != nil {
+			return nil, err
+		}
+
+		if sc != nil {
+			if err := sc.check(h); err != nil {
+				return nil, err
+			}
+		}
+
+		h.Name = archivefs.CleanPath(h.Name)
 
 		// there might be a junk root entry.
 		if h.Name == "" {
@@ -80,33 +222,131 @@ func Open(ra io.ReaderAt) (*FS, error) {
 			h.Linkname = filepath.Clean(h.Linkname)
 		}
 
-		// Create a default directory entry for each parent directory.
-		for dir := filepath.Dir(h.Name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
-			// Create a default directory entry if it doesn't exist.
-			// Don't worry if we see one later, we'll just overwrite it.
-			dirents[dir] = &dirent{
-				Header: tar.Header{
-					Typeflag: tar.TypeDir,
-					Name:     dir,
-					Mode:     0o755,
-				},
+		addParentDirs(dirents, h.Name)
+
+		size := end - begin
+
+		offsets := &EntryOffsets{
+			Name:         h.Name,
+			HeaderOffset: begin,
+			DataOffset:   dataOffset,
+			DataLength:   end - dataOffset,
+		}
+		toc = append(toc, *offsets)
+
+		var sparse []archivefs.Extent
+		if isSparse(h) {
+			if sparse, err = readSparseMap(ra, begin, h); err != nil {
+				return nil, fmt.Errorf("failed to read sparse map of %s: %w", h.Name, err)
 			}
 		}
 
-		size := r.offset - begin
+		d := &dirent{
+			Header:  *h,
+			offsets: offsets,
+			sparse:  sparse,
+			data: func() (io.Reader, error) {
+				tr := tar.NewReader(io.NewSectionReader(ra, begin, size))
+				if _, err := tr.Next(); err != nil {
+					return nil, err
+				}
+
+				return tr, nil
+			},
+		}
+
+		if versions != nil {
+			versions[h.Name] = append(versions[h.Name], d)
+		}
+
+		dirents[h.Name] = d
+	}
+
+	if sc != nil {
+		if err := sc.finish(); err != nil {
+			return nil, err
+		}
+	}
+
+	fsys, err := newFS(dirents)
+	if err != nil {
+		return nil, err
+	}
+	fsys.raw = rr
+	fsys.globalRecords = globals
+	fsys.versions = versions
+	fsys.toc = toc
+	fsys.symlinkPolicy = opts.SymlinkPolicy
+	fsys.manifest = opts.Manifest
+
+	return fsys, nil
+}
+
+// isSparse reports whether an entry is a sparse file, the contents of which
+// are stored in a different size to the file.
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+
+	return false
+}
 
-		dirents[h.Name] = &dirent{
-			Header: *h,
-			data: func() io.Reader {
-				return io.NewSectionReader(ra, begin, size)
+// corrupted reports errors caused by malformed or truncated archives as
+// archiveerrors.ErrCorrupted, detected at the given offset.
+func corrupted(offset int64, err error) error {
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &archiveerrors.ErrCorrupted{Offset: offset, Err: err}
+	}
+
+	return err
+}
+
+// addParentDirs creates a default directory entry for each parent directory
+// of name that hasn't already been seen.
+func addParentDirs(dirents map[string]*dirent, name string) {
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := dirents[dir]; ok {
+			continue
+		}
+
+		dirents[dir] = &dirent{
+			Header: tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir,
+				Mode:     0o755,
 			},
 		}
 	}
+}
+
+// newFS builds the directory tree from a flat map of indexed entries.
+func newFS(dirents map[string]*dirent) (*FS, error) {
+	var paths []string
+	for path := range dirents {
+		paths = append(paths, path)
+	}
+
+	slices.Sort(paths)
+
+	// Number every entry (the root is 1), so that hard links can be
+	// identified.
+	for i, path := range paths {
+		dirents[path].ino = uint64(i) + 2
+	}
 
 	// Point hardlinks to the underlying dirent.
-	for path, d := range dirents {
+	nlinks := map[uint64]int{}
+	for _, path := range paths {
+		d := dirents[path]
 		if d.Typeflag == tar.TypeLink {
-			name := sanitizePath(d.Linkname)
+			name := archivefs.CleanPath(d.Linkname)
 			target, ok := dirents[name]
 			if !ok {
 				return nil, fmt.Errorf("failed to resolve hardlink %q: %w", name, fs.ErrNotExist)
@@ -114,16 +354,17 @@ func Open(ra io.ReaderAt) (*FS, error) {
 
 			targetCopy := *target
 			targetCopy.Header.Name = path
+			targetCopy.hardlink = name
 			dirents[path] = &targetCopy
+			d = &targetCopy
 		}
-	}
 
-	var paths []string
-	for path := range dirents {
-		paths = append(paths, path)
+		nlinks[d.ino]++
 	}
 
-	slices.Sort(paths)
+	for _, d := range dirents {
+		d.nlink = nlinks[d.ino]
+	}
 
 	root := dirent{
 		Header: tar.Header{
@@ -131,12 +372,14 @@ func Open(ra io.ReaderAt) (*FS, error) {
 			Name:     ".",
 			Mode:     0o755,
 		},
+		ino:   1,
+		nlink: 1,
 	}
 
 	for _, path := range paths {
 		d := dirents[path]
 
-		dir, err := resolve(&root, filepath.Dir(path))
+		dir, err := resolve(&root, filepath.Dir(path), SymlinkFollow)
 		if err != nil {
 			return nil, fmt.Errorf("failed to resolve directory %q: %w", filepath.Dir(path), err)
 		}
@@ -148,39 +391,50 @@ func Open(ra io.ReaderAt) (*FS, error) {
 }
 
 func (fsys *FS) Open(name string) (fs.File, error) {
-	d, err := resolve(&fsys.root, name)
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := resolve(&fsys.root, name, fsys.symlinkPolicy)
 	if err != nil {
 		return nil, err
 	}
 
-	tr := tar.NewReader(d.data())
-	if _, err := tr.Next(); err != nil {
+	// Use the original name (as we may be resolving a symlink).
+	renamed := *d
+	renamed.Header.Name = name
+
+	if d.IsDir() {
+		return &dir{file: file{dirent: &renamed, r: strings.NewReader("")}, Entries: readdir.New(d.readDir())}, nil
+	}
+
+	r, err := fsys.openVerified(d)
+	if err != nil {
 		return nil, fmt.Errorf("failed to read file %s: %w", name, err)
 	}
 
-	return &file{dirent: d, r: tr}, nil
+	return &file{dirent: &renamed, r: r}, nil
 }
 
 func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	d, err := resolve(&fsys.root, name)
-	if err != nil {
-		return nil, err
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
 	}
 
-	var children []fs.DirEntry
-	for _, child := range d.children {
-		children = append(children, child)
+	d, err := resolve(&fsys.root, name, fsys.symlinkPolicy)
+	if err != nil {
+		return nil, err
 	}
 
-	slices.SortFunc(children, func(a, b fs.DirEntry) int {
-		return strings.Compare(a.Name(), b.Name())
-	})
-
-	return children, nil
+	return d.readDir(), nil
 }
 
 func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
-	if sanitizePath(name) == "" {
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
 		d := &dirent{
 			Header: tar.Header{
 				Typeflag: tar.TypeDir,
@@ -192,7 +446,7 @@ func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
 		return d.Info()
 	}
 
-	d, err := resolve(&fsys.root, name)
+	d, err := resolve(&fsys.root, name, fsys.symlinkPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -208,7 +462,11 @@ func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
 // Experimental implementation of fs.ReadLinkFS:
 // https://github.com/golang/go/issues/49580
 func (fsys *FS) ReadLink(name string) (string, error) {
-	d, err := resolve(&fsys.root, filepath.Dir(name))
+	if !validPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := resolve(&fsys.root, filepath.Dir(name), fsys.symlinkPolicy)
 	if err != nil {
 		return "", err
 	}
@@ -229,7 +487,16 @@ func (fsys *FS) ReadLink(name string) (string, error) {
 // Experimental implementation of fs.ReadLinkFS:
 // https://github.com/golang/go/issues/49580
 func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
-	d, err := resolve(&fsys.root, filepath.Dir(name))
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	// The root can't be a symbolic link.
+	if name == "." {
+		return fsys.Stat(name)
+	}
+
+	d, err := resolve(&fsys.root, filepath.Dir(name), fsys.symlinkPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -242,10 +509,64 @@ func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
 	return d.Info()
 }
 
-func resolve(root *dirent, name string) (*dirent, error) {
+// FileID returns the id of the named entry, without following any symbolic
+// links, and the number of hard links to it. Hard links share the id of their
+// target. Ids are only meaningful within the filesystem.
+func (fsys *FS) FileID(name string) (id uint64, nlink int, err error) {
+	if !validPath(name) {
+		return 0, 0, &fs.PathError{Op: "fileid", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return fsys.root.ino, fsys.root.nlink, nil
+	}
+
+	d, err := resolve(&fsys.root, filepath.Dir(name), fsys.symlinkPolicy)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	d, found := d.findChild(filepath.Base(name))
+	if !found {
+		return 0, 0, fs.ErrNotExist
+	}
+
+	return d.ino, d.nlink, nil
+}
+
+// validPath reports whether name is a valid path, as for fs.ValidPath, except
+// that it needn't be UTF-8 as the names of tar entries are arbitrary bytes.
+func validPath(name string) bool {
+	if name == "." {
+		return true
+	}
+
+	for {
+		elem, rest, found := strings.Cut(name, "/")
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+
+		if !found {
+			return true
+		}
+
+		name = rest
+	}
+}
+
+// resolve looks up the named dirent, following symbolic links according to
+// the given policy.
+func resolve(root *dirent, name string, policy SymlinkPolicy) (*dirent, error) {
+	return resolveWithHops(root, name, policy, 0)
+}
+
+func resolveWithHops(root *dirent, name string, policy SymlinkPolicy, hops int) (*dirent, error) {
 	d := root
 
-	name = sanitizePath(name)
+	// Names are cleaned lexically, but unlike the names of entries,
+	// backslashes are not treated as separators.
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
 	if name == "" {
 		return d, nil
 	}
@@ -258,21 +579,26 @@ func resolve(root *dirent, name string) (*dirent, error) {
 		}
 
 		if d.Type()&fs.ModeSymlink != 0 {
-			// Resolve the symlink.
+			hops++
+			if hops > archivefs.MaxSymlinkHops {
+				return nil, fmt.Errorf("too many levels of symbolic links: %s: %w", name, fs.ErrInvalid)
+			}
+
+			if err := policy.check(d); err != nil {
+				return nil, err
+			}
+
+			// Resolve the symlink (relative targets are relative to the
+			// directory containing the link).
 			target := d.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(d.Header.Name), target)
+			}
 
 			var err error
-			if !filepath.IsAbs(target) && d.parent != nil {
-				d, err = resolve(d.parent, target)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				// The target is an absolute path or the dirent is the root dirent.
-				d, err = resolve(root, target)
-				if err != nil {
-					return nil, err
-				}
+			d, err = resolveWithHops(root, target, policy, hops)
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -280,10 +606,6 @@ func resolve(root *dirent, name string) (*dirent, error) {
 	return d, nil
 }
 
-func sanitizePath(name string) string {
-	return strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(filepath.ToSlash(strings.TrimSpace(name))), "."), "/")
-}
-
 type file struct {
 	*dirent
 	r io.Reader
@@ -301,13 +623,36 @@ func (f *file) Close() error {
 	return nil
 }
 
+// dir is an open directory.
+type dir struct {
+	file
+	readdir.Entries
+}
+
 var _ fs.DirEntry = &dirent{}
 
 type dirent struct {
 	tar.Header
 	parent   *dirent
 	children map[string]*dirent
-	data     func() io.Reader
+	data     func() (io.Reader, error)
+	offsets  *EntryOffsets
+	// sparse holds the extents of a sparse file that contain data.
+	sparse []archivefs.Extent
+	// hardlink is the path of the target, if this entry is a hard link.
+	hardlink string
+	// ino identifies the entry, hard links share the id of their target.
+	ino uint64
+	// nlink is the number of hard links to the entry.
+	nlink int
+}
+
+func (d *dirent) open() (io.Reader, error) {
+	if d.data == nil {
+		return strings.NewReader(""), nil
+	}
+
+	return d.data()
 }
 
 func (d *dirent) findChild(name string) (*dirent, bool) {
@@ -315,6 +660,20 @@ func (d *dirent) findChild(name string) (*dirent, bool) {
 	return c, ok
 }
 
+// readDir returns the children of the directory, sorted by name.
+func (d *dirent) readDir() []fs.DirEntry {
+	var children []fs.DirEntry
+	for _, child := range d.children {
+		children = append(children, child)
+	}
+
+	slices.SortFunc(children, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return children
+}
+
 func (d *dirent) addChild(child *dirent) {
 	if d.children == nil {
 		d.children = make(map[string]*dirent)
@@ -346,7 +705,7 @@ func (d *dirent) Type() fs.FileMode {
 	case tar.TypeSymlink:
 		return fs.ModeSymlink
 	case tar.TypeChar:
-		return fs.ModeCharDevice
+		return fs.ModeDevice | fs.ModeCharDevice
 	case tar.TypeBlock:
 		return fs.ModeDevice
 	case tar.TypeDir:
@@ -364,11 +723,33 @@ func (d *dirent) Info() (fs.FileInfo, error) {
 
 // readerWithOffset is a wrapper around io.ReaderAt that keeps track of the current offset.
 type readerWithOffset struct {
+	ctx    context.Context
 	ra     io.ReaderAt
 	offset int64
 }
 
+// Seek allows archive/tar to skip the contents of entries without reading
+// them.
+func (f *readerWithOffset) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	default:
+		return 0, errors.New("unsupported whence")
+	}
+
+	return f.offset, nil
+}
+
 func (f *readerWithOffset) Read(p []byte) (n int, err error) {
+	if f.ctx != nil {
+		if err := f.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+
 	n, err = f.ra.ReadAt(p, f.offset)
 	f.offset += int64(n)
 	return
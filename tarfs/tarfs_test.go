@@ -41,7 +41,11 @@ package tarfs_test
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/fs"
@@ -52,7 +56,11 @@ import (
 	"testing"
 	"time"
 
-	"github.com/dpeckett/archivefs/internal/testutil"
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/archivefstest"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/hashfs"
+	"github.com/dpeckett/archivefs/memfs"
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/stretchr/testify/require"
 )
@@ -222,14 +230,15 @@ func TestTarFS(t *testing.T) {
 	}, {
 		input: "testdata/pax-global-records.tar",
 		files: []file{{
-			Name:    "file1",
-			ModTime: time.Unix(0, 0),
+			// Renamed by the global path record.
+			Name:    "global1",
+			ModTime: time.Unix(1500000000, 0),
 		}, {
 			Name:    "file2",
-			ModTime: time.Unix(0, 0),
+			ModTime: time.Unix(1500000000, 0),
 		}, {
 			Name:    "file3",
-			ModTime: time.Unix(0, 0),
+			ModTime: time.Unix(1500000000, 0),
 		}, {
 			Name:    "file4",
 			ModTime: time.Unix(1400000000, 0),
@@ -397,7 +406,7 @@ func TestTarFS(t *testing.T) {
 				var fi fs.FileInfo
 				var sum string
 				if !file.IsSymlink {
-					f, err := fsys.Open(file.Name)
+					f, err := fsys.Open(strings.TrimSuffix(file.Name, "/"))
 					require.NoError(t, err, file.Name)
 
 					h := md5.New()
@@ -456,12 +465,25 @@ func TestTarFSDirHash(t *testing.T) {
 	fsys, err := tarfs.Open(f)
 	require.NoError(t, err)
 
-	h, err := testutil.HashFS(fsys)
+	h, err := hashfs.Hash(fsys, nil)
 	require.NoError(t, err)
 
 	require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
 }
 
+func TestTarFSConformance(t *testing.T) {
+	f, err := os.Open("testdata/toybox.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := tarfs.Open(f)
+	require.NoError(t, err)
+
+	require.NoError(t, archivefstest.TestFS(fsys, "etc/passwd", "init", "bin", "usr/bin/toybox"))
+}
+
 func TestTarFSReadlink(t *testing.T) {
 	f, err := os.Open("testdata/toybox.tar")
 	require.NoError(t, err)
@@ -563,8 +585,866 @@ func TestTarFSCreate(t *testing.T) {
 	dstFS, err := tarfs.Open(dstFile)
 	require.NoError(t, err)
 
-	h, err := testutil.HashFS(dstFS)
+	h, err := hashfs.Hash(dstFS, nil)
 	require.NoError(t, err)
 
 	require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
 }
+
+func TestTarFSStrict(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		f, err := os.Open("testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		_, err = tarfs.OpenWithOptions(f, &tarfs.Options{Strict: true})
+		require.NoError(t, err)
+	})
+
+	vectors := []struct {
+		name    string
+		headers []tar.Header
+		err     error
+	}{{
+		name: "PathTraversal",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeReg, Name: "../etc/passwd", Mode: 0o644},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "RelativeSymlinkEscape",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "a/link", Linkname: "../../etc", Mode: 0o777},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "AbsoluteSymlinkEscape",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/../etc", Mode: 0o777},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "ChainedSymlinkEscape",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "sub/a", Linkname: "..", Mode: 0o777},
+			{Typeflag: tar.TypeSymlink, Name: "sub/b", Linkname: "a/../etc/passwd", Mode: 0o777},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "ChainedSymlinkEscapeReordered",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "sub/b", Linkname: "a/../etc/passwd", Mode: 0o777},
+			{Typeflag: tar.TypeSymlink, Name: "sub/a", Linkname: "..", Mode: 0o777},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "HardlinkThroughSymlink",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "sub/a", Linkname: "..", Mode: 0o777},
+			{Typeflag: tar.TypeLink, Name: "passwd", Linkname: "sub/a/../etc/passwd", Mode: 0o644},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "WriteThroughSymlink",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/etc", Mode: 0o777},
+			{Typeflag: tar.TypeReg, Name: "link/passwd", Mode: 0o644},
+		},
+		err: tarfs.ErrUnsafePath,
+	}, {
+		name: "ConflictingType",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeDir, Name: "a/", Mode: 0o755},
+			{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644},
+		},
+		err: tarfs.ErrConflictingType,
+	}, {
+		name: "DirectoryWithSize",
+		headers: []tar.Header{
+			{Typeflag: tar.TypeDir, Name: "a/", Mode: 0o755, Size: 1024},
+		},
+		err: tarfs.ErrInvalidSize,
+	}}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range v.headers {
+				require.NoError(t, tw.WriteHeader(&hdr))
+			}
+			require.NoError(t, tw.Close())
+
+			_, err := tarfs.OpenWithOptions(bytes.NewReader(buf.Bytes()), &tarfs.Options{Strict: true})
+			require.ErrorIs(t, err, v.err)
+		})
+	}
+}
+
+func TestTarFSEStargz(t *testing.T) {
+	f, err := os.Open("testdata/toybox.estargz")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fi, err := f.Stat()
+	require.NoError(t, err)
+
+	fsys, err := tarfs.OpenEStargz(f, fi.Size())
+	require.NoError(t, err)
+
+	t.Run("DirHash", func(t *testing.T) {
+		h, err := hashfs.Hash(fsys, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+	})
+
+	t.Run("Landmarks", func(t *testing.T) {
+		_, err := fsys.Stat(".no.prefetch.landmark")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("ReadLink", func(t *testing.T) {
+		target, err := fsys.ReadLink("bin")
+		require.NoError(t, err)
+
+		require.Equal(t, "usr/bin", target)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		fi, err := fsys.Stat("bin/toybox")
+		require.NoError(t, err)
+
+		require.Equal(t, int64(849544), fi.Size())
+		require.Equal(t, fs.FileMode(0o555), fi.Mode())
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		var entries int
+		_, err := tarfs.OpenEStargzWithOptions(f, fi.Size(), &tarfs.Options{
+			Strict:   true,
+			Progress: func(n int, _ int64) { entries = n },
+		})
+		require.NoError(t, err)
+		require.Greater(t, entries, 1)
+
+		_, err = tarfs.OpenEStargzWithOptions(f, fi.Size(), &tarfs.Options{Limits: tarfs.Limits{MaxEntries: 1}})
+		require.ErrorIs(t, err, tarfs.ErrLimitExceeded)
+	})
+
+	t.Run("LargeTOC", func(t *testing.T) {
+		// A TOC that claims to be far larger than any real one.
+		var blob bytes.Buffer
+		zw := gzip.NewWriter(&blob)
+		tw := tar.NewWriter(zw)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "stargz.index.json", Typeflag: tar.TypeReg, Size: 1 << 40}))
+		require.NoError(t, zw.Close())
+
+		// The footer is an empty gzip stream, with the TOC offset in its
+		// extra field, and a single empty stored block.
+		blob.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0})
+		fmt.Fprintf(&blob, "%016xSTARGZ", 0)
+		blob.Write([]byte{1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0})
+
+		_, err := tarfs.OpenEStargz(bytes.NewReader(blob.Bytes()), int64(blob.Len()))
+		require.ErrorIs(t, err, tarfs.ErrLimitExceeded)
+	})
+}
+
+func TestTarFSWriteTo(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.tar")
+	require.NoError(t, err)
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			want, err := os.ReadFile(input)
+			require.NoError(t, err)
+
+			fsys, err := tarfs.OpenWithOptions(bytes.NewReader(want), &tarfs.Options{RecordRaw: true})
+			require.NoError(t, err)
+
+			var got bytes.Buffer
+			n, err := fsys.WriteTo(&got)
+			require.NoError(t, err)
+
+			require.Equal(t, int64(len(want)), n)
+			require.True(t, bytes.Equal(want, got.Bytes()))
+		})
+	}
+
+	t.Run("NotRecorded", func(t *testing.T) {
+		f, err := os.Open("testdata/gnu.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := tarfs.Open(f)
+		require.NoError(t, err)
+
+		_, err = fsys.WriteTo(io.Discard)
+		require.Error(t, err)
+	})
+}
+
+func TestTarFSProgress(t *testing.T) {
+	f, err := os.Open("testdata/toybox.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		var calls, lastEntries int
+		var lastBytes int64
+		_, err := tarfs.OpenWithOptions(f, &tarfs.Options{
+			Progress: func(entries int, bytes int64) {
+				require.GreaterOrEqual(t, entries, lastEntries)
+				require.GreaterOrEqual(t, bytes, lastBytes)
+
+				calls++
+				lastEntries, lastBytes = entries, bytes
+			},
+		})
+		require.NoError(t, err)
+
+		require.Greater(t, calls, 1)
+		require.Equal(t, 265, lastEntries)
+		require.Greater(t, lastBytes, int64(0))
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		_, err := tarfs.OpenContext(ctx, f, &tarfs.Options{
+			Progress: func(entries int, bytes int64) {
+				if entries == 10 {
+					cancel()
+				}
+			},
+		})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestTarFSLimits(t *testing.T) {
+	f, err := os.Open("testdata/toybox.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	vectors := []struct {
+		name   string
+		limits tarfs.Limits
+		err    error
+	}{
+		{name: "Unlimited"},
+		{name: "Generous", limits: tarfs.Limits{MaxEntries: 1000, MaxTotalSize: 1 << 20, MaxPathDepth: 10, MaxPathLength: 255}},
+		{name: "MaxEntries", limits: tarfs.Limits{MaxEntries: 10}, err: tarfs.ErrLimitExceeded},
+		{name: "MaxTotalSize", limits: tarfs.Limits{MaxTotalSize: 1024}, err: tarfs.ErrLimitExceeded},
+		{name: "MaxPathDepth", limits: tarfs.Limits{MaxPathDepth: 1}, err: tarfs.ErrLimitExceeded},
+		{name: "MaxPathLength", limits: tarfs.Limits{MaxPathLength: 4}, err: tarfs.ErrLimitExceeded},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			_, err := tarfs.OpenWithOptions(f, &tarfs.Options{Limits: v.limits})
+			if v.err != nil {
+				require.ErrorIs(t, err, v.err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTarFSCorrupted(t *testing.T) {
+	data, err := os.ReadFile("testdata/toybox.tar")
+	require.NoError(t, err)
+
+	// Truncate the archive within the data of an entry.
+	_, err = tarfs.Open(bytes.NewReader(data[:len(data)/2+100]))
+	require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+
+	// Corrupt the checksum of the first header.
+	corrupted := bytes.Clone(data)
+	copy(corrupted[148:156], "0000000\x00")
+
+	_, err = tarfs.Open(bytes.NewReader(corrupted))
+	var corruptedErr *archiveerrors.ErrCorrupted
+	require.ErrorAs(t, err, &corruptedErr)
+	require.Equal(t, int64(0), corruptedErr.Offset)
+}
+
+func TestTarFSOpenReader(t *testing.T) {
+	vectors := []struct {
+		name  string
+		spool tarfs.SpoolOptions
+		err   error
+	}{
+		{name: "Memory"},
+		{name: "TempFile", spool: tarfs.SpoolOptions{MemoryLimit: 64 * 1024, TempDir: t.TempDir()}},
+		{name: "MaxSize", spool: tarfs.SpoolOptions{MaxSize: 64 * 1024}, err: tarfs.ErrLimitExceeded},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			f, err := os.Open("testdata/toybox.tar")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			// Hide the io.ReaderAt implementation of the file.
+			fsys, err := tarfs.OpenReader(io.MultiReader(f), &tarfs.Options{Spool: v.spool})
+			if v.err != nil {
+				require.ErrorIs(t, err, v.err)
+				return
+			}
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, fsys.Close())
+			})
+
+			h, err := hashfs.Hash(fsys, nil)
+			require.NoError(t, err)
+
+			require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+
+			if v.spool.TempDir != "" {
+				entries, err := os.ReadDir(v.spool.TempDir)
+				require.NoError(t, err)
+				require.Len(t, entries, 1)
+			}
+		})
+	}
+
+	t.Run("Closed", func(t *testing.T) {
+		f, err := os.Open("testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := tarfs.OpenReader(io.MultiReader(f), nil)
+		require.NoError(t, err)
+
+		toybox, err := fsys.Open("bin/toybox")
+		require.NoError(t, err)
+		require.NoError(t, fsys.Close())
+
+		// Reading after the spooled archive is released fails cleanly.
+		_, err = toybox.Read(make([]byte, 16))
+		require.ErrorIs(t, err, fs.ErrClosed)
+	})
+}
+
+func TestTarFSOpenReaderDecompress(t *testing.T) {
+	toybox, err := os.ReadFile("testdata/toybox.tar")
+	require.NoError(t, err)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err = gw.Write(toybox)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	for name, data := range map[string][]byte{"Gzip": gzipped.Bytes(), "Uncompressed": toybox} {
+		t.Run(name, func(t *testing.T) {
+			fsys, err := tarfs.OpenReader(bytes.NewReader(data), &tarfs.Options{Decompress: true})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, fsys.Close())
+			})
+
+			h, err := hashfs.Hash(fsys, nil)
+			require.NoError(t, err)
+
+			require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+		})
+	}
+}
+
+func TestTarFSSpecialFiles(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0o755},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0o660, Devmajor: 8, Devminor: 0},
+		{Typeflag: tar.TypeFifo, Name: "dev/initctl", Mode: 0o600},
+	} {
+		require.NoError(t, tw.WriteHeader(&hdr))
+	}
+	require.NoError(t, tw.Close())
+
+	fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	vectors := []struct {
+		name     string
+		mode     fs.FileMode
+		devMajor int64
+		devMinor int64
+	}{
+		{name: "dev/null", mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, devMajor: 1, devMinor: 3},
+		{name: "dev/sda", mode: fs.ModeDevice | 0o660, devMajor: 8},
+		{name: "dev/initctl", mode: fs.ModeNamedPipe | 0o600},
+	}
+
+	entries, err := fsys.ReadDir("dev")
+	require.NoError(t, err)
+	require.Len(t, entries, len(vectors))
+
+	for _, v := range vectors {
+		t.Run(path.Base(v.name), func(t *testing.T) {
+			fi, err := fsys.Stat(v.name)
+			require.NoError(t, err)
+
+			require.Equal(t, v.mode, fi.Mode())
+
+			hdr, ok := fi.Sys().(*tar.Header)
+			require.True(t, ok)
+
+			require.Equal(t, v.devMajor, hdr.Devmajor)
+			require.Equal(t, v.devMinor, hdr.Devminor)
+		})
+	}
+}
+
+func TestTarFSGlobalRecords(t *testing.T) {
+	f, err := os.Open("testdata/pax-global-records.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := tarfs.Open(f)
+	require.NoError(t, err)
+
+	// The global path record was deleted by the second global header.
+	require.Equal(t, map[string]string{"mtime": "1500000000.0"}, fsys.GlobalRecords())
+}
+
+func TestTarFSVersions(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, content := range []string{"first", "second", "third"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "etc/passwd",
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}))
+
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	t.Run("Retained", func(t *testing.T) {
+		fsys, err := tarfs.OpenWithOptions(bytes.NewReader(buf.Bytes()), &tarfs.Options{RetainVersions: true})
+		require.NoError(t, err)
+
+		versions, err := fsys.Versions("etc/passwd")
+		require.NoError(t, err)
+		require.Len(t, versions, 3)
+
+		var contents []string
+		for _, v := range versions {
+			require.Equal(t, "etc/passwd", v.Header().Name)
+
+			f, err := v.Open()
+			require.NoError(t, err)
+
+			content, err := io.ReadAll(f)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			contents = append(contents, string(content))
+		}
+
+		require.Equal(t, []string{"first", "second", "third"}, contents)
+
+		// The filesystem only exposes the last version.
+		content, err := fs.ReadFile(fsys, "etc/passwd")
+		require.NoError(t, err)
+		require.Equal(t, "third", string(content))
+
+		_, err = fsys.Versions("etc/shadow")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("NotRetained", func(t *testing.T) {
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		_, err = fsys.Versions("etc/passwd")
+		require.Error(t, err)
+	})
+}
+
+func TestTarFSCreateFilter(t *testing.T) {
+	srcFile, err := os.Open("testdata/toybox.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srcFile.Close())
+	})
+
+	srcFS, err := tarfs.Open(srcFile)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, tarfs.CreateWithOptions(&buf, srcFS, &tarfs.CreateOptions{
+		Filter: func(path string, d fs.DirEntry) (bool, error) {
+			return path != "usr" && path != "etc/passwd", nil
+		},
+	}))
+
+	dstFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	_, err = dstFS.Stat("usr")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = dstFS.Stat("etc/passwd")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = dstFS.Stat("etc/group")
+	require.NoError(t, err)
+}
+
+func TestTarFSCreateMetadata(t *testing.T) {
+	srcFS := memfs.New()
+	require.NoError(t, srcFS.WriteFile("busybox", []byte("busybox"), 0o755))
+	require.NoError(t, srcFS.Link("busybox", "sh"))
+	require.NoError(t, srcFS.SetXattr("busybox", "user.comment", "hello"))
+
+	var buf bytes.Buffer
+	require.NoError(t, tarfs.Create(&buf, srcFS))
+
+	tr := tar.NewReader(&buf)
+
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "busybox", hdr.Name)
+	require.Equal(t, "hello", hdr.PAXRecords["SCHILY.xattr.user.comment"])
+
+	hdr, err = tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "sh", hdr.Name)
+	require.Equal(t, byte(tar.TypeLink), hdr.Typeflag)
+	require.Equal(t, "busybox", hdr.Linkname)
+
+	_, err = tr.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestTarFSOffsets(t *testing.T) {
+	f, err := os.Open("testdata/toybox.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := tarfs.Open(f)
+	require.NoError(t, err)
+
+	toc := fsys.TOC()
+	require.Len(t, toc, 265)
+
+	offsets, err := fsys.Offsets("usr/bin/toybox")
+	require.NoError(t, err)
+
+	require.Equal(t, "usr/bin/toybox", offsets.Name)
+	require.Equal(t, int64(849544), offsets.DataLength)
+	require.Zero(t, offsets.HeaderOffset%512)
+	require.Greater(t, offsets.DataOffset, offsets.HeaderOffset)
+	require.Contains(t, toc, *offsets)
+
+	// The payload can be read directly from the underlying archive.
+	want, err := fs.ReadFile(fsys, "usr/bin/toybox")
+	require.NoError(t, err)
+
+	got := make([]byte, offsets.DataLength)
+	_, err = f.ReadAt(got, offsets.DataOffset)
+	require.NoError(t, err)
+
+	require.Equal(t, want, got)
+
+	// Unknown entries have no offsets.
+	_, err = fsys.Offsets("does/not/exist")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// As are invalid names.
+	for _, name := range []string{"/usr/bin/toybox", "usr/bin/../bin/toybox", "usr/bin/toybox/"} {
+		_, err = fsys.Offsets(name)
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	}
+}
+
+func TestTarFSExtractAll(t *testing.T) {
+	t.Run("Toybox", func(t *testing.T) {
+		f, err := os.Open("testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := tarfs.Open(f)
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		require.NoError(t, tarfs.ExtractAll(context.Background(), fsys, dir, &tarfs.ExtractOptions{Workers: 4}))
+
+		h, err := hashfs.Hash(os.DirFS(dir), nil)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+
+		target, err := os.Readlink(filepath.Join(dir, "bin"))
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin", target)
+
+		want, err := fsys.Stat("usr/bin/toybox")
+		require.NoError(t, err)
+
+		got, err := os.Stat(filepath.Join(dir, "usr/bin/toybox"))
+		require.NoError(t, err)
+
+		require.Equal(t, want.Mode(), got.Mode())
+		require.True(t, want.ModTime().Equal(got.ModTime()))
+	})
+
+	t.Run("Hardlink", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644, Size: 5}))
+		_, err := tw.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "b", Linkname: "a"}))
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		require.NoError(t, tarfs.ExtractAll(context.Background(), fsys, dir, nil))
+
+		a, err := os.Stat(filepath.Join(dir, "a"))
+		require.NoError(t, err)
+
+		b, err := os.Stat(filepath.Join(dir, "b"))
+		require.NoError(t, err)
+
+		require.True(t, os.SameFile(a, b))
+	})
+
+	t.Run("NoOverwrite", func(t *testing.T) {
+		f, err := os.Open("testdata/gnu.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := tarfs.Open(f)
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(dir, "small.txt")))
+
+		err = tarfs.ExtractAll(context.Background(), fsys, dir, nil)
+		require.ErrorIs(t, err, fs.ErrExist)
+	})
+
+	t.Run("ExistingSymlink", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0o755}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a/x", Mode: 0o644}))
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		outside := t.TempDir()
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "a")))
+
+		err = tarfs.ExtractAll(context.Background(), fsys, dir, nil)
+		require.ErrorIs(t, err, archivefs.ErrEscapesRoot)
+
+		_, err = os.Lstat(filepath.Join(outside, "x"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestTarFSSymlinkPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644},
+		{Typeflag: tar.TypeSymlink, Name: "relative", Linkname: "etc/passwd", Mode: 0o777},
+		{Typeflag: tar.TypeSymlink, Name: "absolute", Linkname: "/etc/passwd", Mode: 0o777},
+		{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: "../etc/passwd", Mode: 0o777},
+		{Typeflag: tar.TypeSymlink, Name: "loop1", Linkname: "loop2", Mode: 0o777},
+		{Typeflag: tar.TypeSymlink, Name: "loop2", Linkname: "loop1", Mode: 0o777},
+	} {
+		require.NoError(t, tw.WriteHeader(&hdr))
+	}
+	require.NoError(t, tw.Close())
+
+	vectors := []struct {
+		policy   tarfs.SymlinkPolicy
+		relative bool
+		absolute bool
+		escape   bool
+	}{
+		{policy: tarfs.SymlinkFollow, relative: true, absolute: true, escape: true},
+		{policy: tarfs.SymlinkFollowWithinRoot, relative: true, absolute: true},
+		{policy: tarfs.SymlinkErrorOnAbsolute, relative: true, escape: true},
+		{policy: tarfs.SymlinkNoFollow},
+	}
+
+	for _, v := range vectors {
+		t.Run(fmt.Sprintf("Policy%d", v.policy), func(t *testing.T) {
+			fsys, err := tarfs.OpenWithOptions(bytes.NewReader(buf.Bytes()), &tarfs.Options{SymlinkPolicy: v.policy})
+			require.NoError(t, err)
+
+			for name, allowed := range map[string]bool{
+				"relative": v.relative,
+				"absolute": v.absolute,
+				"escape":   v.escape,
+			} {
+				_, err := fsys.Stat(name)
+				if allowed {
+					require.NoError(t, err, name)
+				} else {
+					require.ErrorIs(t, err, tarfs.ErrSymlinkPolicy, name)
+				}
+
+				// Links can always be inspected without following them.
+				_, err = fsys.StatLink(name)
+				require.NoError(t, err, name)
+			}
+
+			_, err = fsys.Stat("loop1")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestTarFSManifest(t *testing.T) {
+	f, err := os.Open("testdata/gnu.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := tarfs.OpenWithOptions(f, &tarfs.Options{
+		Manifest: tarfs.Manifest{
+			"small.txt":  "sha256:9c4be5c3a3b1d2d1b4a2b8e4fa7d3da2b4e7d2a8c3fa76d07e5b96e2a2b4c8e1",
+			"small2.txt": "sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("Google.com\n"))),
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("Valid", func(t *testing.T) {
+		content, err := fs.ReadFile(fsys, "small2.txt")
+		require.NoError(t, err)
+
+		require.Equal(t, "Google.com\n", string(content))
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		_, err := fs.ReadFile(fsys, "small.txt")
+		require.ErrorIs(t, err, tarfs.ErrDigestMismatch)
+	})
+
+	t.Run("Unlisted", func(t *testing.T) {
+		fsys, err := tarfs.OpenWithOptions(f, &tarfs.Options{
+			Manifest: tarfs.Manifest{},
+		})
+		require.NoError(t, err)
+
+		_, err = fsys.Open("small.txt")
+		require.ErrorIs(t, err, tarfs.ErrDigestMismatch)
+	})
+}
+
+func TestTarFSDataExtents(t *testing.T) {
+	f, err := os.Open("testdata/sparse-formats.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := tarfs.Open(f)
+	require.NoError(t, err)
+
+	var want []archivefs.Extent
+	for offset := int64(1); offset < 190; offset += 2 {
+		want = append(want, archivefs.Extent{Offset: offset, Length: 1})
+	}
+
+	for _, name := range []string{"sparse-gnu", "sparse-posix-0.0", "sparse-posix-0.1", "sparse-posix-1.0"} {
+		t.Run(name, func(t *testing.T) {
+			extents, err := fsys.DataExtents(name)
+			require.NoError(t, err)
+			require.Equal(t, want, extents)
+
+			// Holes read as zeros.
+			data, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err)
+
+			for i, b := range data {
+				if archivefs.SeekData(extents, int64(i)) != int64(i) {
+					require.Zero(t, b, "offset %d", i)
+				}
+			}
+		})
+	}
+
+	// Files that aren't sparse consist of a single extent.
+	extents, err := fsys.DataExtents("end")
+	require.NoError(t, err)
+	require.Equal(t, []archivefs.Extent{{Length: 4}}, extents)
+
+	t.Run("Archives", func(t *testing.T) {
+		tests := []struct {
+			input string
+			want  []archivefs.Extent
+		}{
+			// Generated by GNU tar v1.34 (with --sparse --format=posix).
+			{"testdata/sparse-holes.tar", []archivefs.Extent{{Length: 4096}, {Offset: 65536, Length: 4096}}},
+			{"testdata/gnu-nil-sparse-data.tar", []archivefs.Extent{{Length: 1000}}},
+			{"testdata/gnu-nil-sparse-hole.tar", []archivefs.Extent{}},
+			{"testdata/pax-nil-sparse-data.tar", []archivefs.Extent{{Length: 1000}}},
+			{"testdata/pax-nil-sparse-hole.tar", []archivefs.Extent{}},
+		}
+
+		for _, tt := range tests {
+			f, err := os.Open(tt.input)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			fsys, err := tarfs.Open(f)
+			require.NoError(t, err)
+
+			extents, err := fsys.DataExtents("sparse.db")
+			require.NoError(t, err, tt.input)
+			require.Equal(t, tt.want, extents, tt.input)
+		}
+	})
+
+	_, err = fsys.DataExtents("does/not/exist")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
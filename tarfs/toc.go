@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+)
+
+// EntryOffsets describes where an entry is stored within the underlying
+// io.ReaderAt of an archive.
+type EntryOffsets struct {
+	// Name is the sanitized path of the entry.
+	Name string
+	// HeaderOffset is the offset of the first header block of the entry
+	// (including any PAX or GNU extension headers).
+	HeaderOffset int64
+	// DataOffset is the offset of the entry's payload.
+	DataOffset int64
+	// DataLength is the length of the payload as stored in the archive,
+	// excluding padding. For sparse files this is the length of the stored
+	// fragments rather than the logical size of the file.
+	DataLength int64
+}
+
+// TOC returns the offsets of every entry in the archive, in archive order.
+// Entries that are redefined later in the archive are included.
+func (fsys *FS) TOC() []EntryOffsets {
+	return slices.Clone(fsys.toc)
+}
+
+// Offsets returns where the named entry is stored within the archive.
+// Symbolic links in the name are not followed, hard links report the offsets
+// of their target.
+func (fsys *FS) Offsets(name string) (*EntryOffsets, error) {
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "offsets", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := resolve(&fsys.root, filepath.Dir(name), fsys.symlinkPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	d, found := d.findChild(filepath.Base(name))
+	if !found {
+		return nil, fs.ErrNotExist
+	}
+
+	if d.offsets == nil {
+		return nil, errors.New("entry is not stored in the archive")
+	}
+
+	offsets := *d.offsets
+	return &offsets, nil
+}
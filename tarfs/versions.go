@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package tarfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// Version is one of the entries in an archive for a given path.
+type Version struct {
+	d *dirent
+}
+
+// Header returns the tar header of this version of the entry.
+func (v *Version) Header() *tar.Header {
+	hdr := v.d.Header
+	return &hdr
+}
+
+// Open opens the contents of this version of the entry.
+func (v *Version) Open() (fs.File, error) {
+	r, err := v.d.open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", v.d.Header.Name, err)
+	}
+
+	return &file{dirent: v.d, r: r}, nil
+}
+
+// Versions returns every entry in the archive for the named path, in archive
+// order (the last is the version visible in the filesystem). Symbolic links
+// in the name are not followed. The archive must have been opened with
+// Options.RetainVersions set.
+func (fsys *FS) Versions(name string) ([]Version, error) {
+	if fsys.versions == nil {
+		return nil, errors.New("entry versions were not retained")
+	}
+
+	ds, ok := fsys.versions[archivefs.CleanPath(name)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	versions := make([]Version, len(ds))
+	for i, d := range ds {
+		versions[i] = Version{d: d}
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"time"
+)
+
+// TimesOptions configures the normalization of file timestamps.
+type TimesOptions struct {
+	// Time is the timestamp given to every file. If zero, the Unix epoch is
+	// used.
+	Time time.Time
+	// Clamp, if set, only rewrites timestamps that are later than Time (as
+	// for SOURCE_DATE_EPOCH).
+	Clamp bool
+}
+
+// NormalizeTimes returns a read-only view of fsys with the modification time
+// of every file rewritten according to opts, so that archives created from
+// it are reproducible. The access and change times of *tar.Header values
+// returned by fs.FileInfo.Sys() are also rewritten.
+func NormalizeTimes(fsys fs.FS, opts *TimesOptions) fs.FS {
+	if opts == nil {
+		opts = &TimesOptions{}
+	}
+
+	epoch := opts.Time
+	if epoch.IsZero() {
+		epoch = time.Unix(0, 0)
+	}
+
+	clamp := opts.Clamp
+	normalize := func(t time.Time) time.Time {
+		if clamp && !t.After(epoch) {
+			return t
+		}
+
+		return epoch
+	}
+
+	return &mapInfoFS{fsys: fsys, mapInfo: func(fi fs.FileInfo) fs.FileInfo {
+		return normalizeTimesInfo(fi, normalize)
+	}}
+}
+
+// normalizeTimesInfo returns fi with its timestamps rewritten.
+func normalizeTimesInfo(fi fs.FileInfo, normalize func(time.Time) time.Time) fs.FileInfo {
+	sys := fi.Sys()
+	if hdr, ok := sys.(*tar.Header); ok {
+		normalized := *hdr
+		normalized.ModTime = normalize(hdr.ModTime)
+		if !hdr.AccessTime.IsZero() {
+			normalized.AccessTime = normalize(hdr.AccessTime)
+		}
+		if !hdr.ChangeTime.IsZero() {
+			normalized.ChangeTime = normalize(hdr.ChangeTime)
+		}
+		sys = &normalized
+	}
+
+	return &timesFileInfo{FileInfo: fi, modTime: normalize(fi.ModTime()), sys: sys}
+}
+
+type timesFileInfo struct {
+	fs.FileInfo
+	modTime time.Time
+	sys     any
+}
+
+func (fi *timesFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *timesFileInfo) Sys() any {
+	return fi.sys
+}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTimes(t *testing.T) {
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	src := fstest.MapFS{
+		"old.txt":        {Data: []byte("old"), ModTime: old},
+		"dir/recent.txt": {Data: []byte("recent"), ModTime: recent},
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		fsys := archivefs.NormalizeTimes(src, nil)
+
+		for _, name := range []string{"old.txt", "dir", "dir/recent.txt"} {
+			fi, err := fs.Stat(fsys, name)
+			require.NoError(t, err)
+			require.True(t, fi.ModTime().Equal(time.Unix(0, 0)), name)
+		}
+
+		require.NoError(t, fstest.TestFS(fsys, "old.txt", "dir/recent.txt"))
+	})
+
+	t.Run("Clamp", func(t *testing.T) {
+		fsys := archivefs.NormalizeTimes(src, &archivefs.TimesOptions{
+			Time:  epoch,
+			Clamp: true,
+		})
+
+		fi, err := fs.Stat(fsys, "old.txt")
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(old))
+
+		entries, err := fs.ReadDir(fsys, "dir")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		fi, err = entries[0].Info()
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(epoch))
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       "hello.txt",
+			Mode:       0o644,
+			ModTime:    recent,
+			AccessTime: recent,
+			ChangeTime: recent,
+			Format:     tar.FormatPAX,
+		}))
+		require.NoError(t, tw.Close())
+
+		tarFS, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		fsys := archivefs.NormalizeTimes(tarFS, &archivefs.TimesOptions{Time: epoch})
+
+		f, err := fsys.Open("hello.txt")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(epoch))
+
+		hdr := fi.Sys().(*tar.Header)
+		require.True(t, hdr.ModTime.Equal(epoch))
+		require.True(t, hdr.AccessTime.Equal(epoch))
+		require.True(t, hdr.ChangeTime.Equal(epoch))
+
+		var out bytes.Buffer
+		require.NoError(t, tarfs.Create(&out, fsys))
+
+		tr := tar.NewReader(&out)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			require.True(t, hdr.ModTime.Equal(epoch), hdr.Name)
+		}
+	})
+}
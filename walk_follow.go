@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+)
+
+// WalkDirFollow walks the file tree rooted at root, as for fs.WalkDir, but
+// also descends into symbolic links to directories. Files beneath a followed
+// link are reported with paths beneath the link (eg. "lib64/libc.so.6" for
+// "lib64 -> lib"), and the link itself is reported as a directory.
+//
+// Each directory is walked at most once via a symbolic link (identified by
+// its file id, see LinkFS, or otherwise its resolved path), so cycles and
+// repeated links to the same directory terminate. Links that would be
+// walked again, that are dangling, that point to anything other than a
+// directory, or that escape the root of fsys are reported as symbolic links
+// and not followed.
+//
+// Symbolic links are only recognized if fsys implements ReadLinkFS.
+func WalkDirFollow(fsys fs.FS, root string, fn fs.WalkDirFunc) error {
+	w := &followWalker{
+		fsys:     fsys,
+		resolver: &confinedFS{fsys: fsys, dir: "."},
+		fn:       fn,
+		visited:  map[walkKey]bool{},
+	}
+
+	realRoot, err := w.resolver.resolve("walk", root, true)
+	var fi fs.FileInfo
+	if err == nil {
+		fi, err = fs.Stat(fsys, realRoot)
+	}
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walk(root, realRoot, fs.FileInfoToDirEntry(fi))
+	}
+
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+
+	return err
+}
+
+// walkKey identifies a directory.
+type walkKey struct {
+	id   uint64
+	path string
+}
+
+type followWalker struct {
+	fsys     fs.FS
+	resolver *confinedFS
+	fn       fs.WalkDirFunc
+	visited  map[walkKey]bool
+}
+
+// walk visits name, which is realName once symbolic links are resolved.
+func (w *followWalker) walk(name, realName string, d fs.DirEntry) error {
+	if err := w.fn(name, d, nil); err != nil || !d.IsDir() {
+		if errors.Is(err, fs.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	key, err := w.key(realName)
+	if err != nil {
+		return w.walkErr(name, d, err)
+	}
+	w.visited[key] = true
+
+	entries, err := fs.ReadDir(w.fsys, realName)
+	if err != nil {
+		if err := w.walkErr(name, d, err); err != nil {
+			return err
+		}
+	}
+
+	for _, de := range entries {
+		childName := path.Join(name, de.Name())
+		childRealName := path.Join(realName, de.Name())
+
+		if de.Type()&fs.ModeSymlink != 0 {
+			if target, fi, ok := w.follow(childRealName); ok {
+				de = fs.FileInfoToDirEntry(&renamedFileInfo{FileInfo: fi, name: de.Name()})
+				childRealName = target
+			}
+		}
+
+		if err := w.walk(childName, childRealName, de); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkErr reports an error reading a directory, as for fs.WalkDir.
+func (w *followWalker) walkErr(name string, d fs.DirEntry, err error) error {
+	err = w.fn(name, d, err)
+	if err != nil && errors.Is(err, fs.SkipDir) && d.IsDir() {
+		err = nil
+	}
+
+	return err
+}
+
+// follow resolves a symbolic link, returning its target if it is a
+// directory that has not already been walked.
+func (w *followWalker) follow(name string) (string, fs.FileInfo, bool) {
+	target, err := w.resolver.resolve("walk", name, true)
+	if err != nil {
+		return "", nil, false
+	}
+
+	fi, err := lstat(w.fsys, target)
+	if err != nil || !fi.IsDir() {
+		return "", nil, false
+	}
+
+	key, err := w.key(target)
+	if err != nil || w.visited[key] {
+		return "", nil, false
+	}
+
+	return target, fi, true
+}
+
+// key returns the identity of a directory, given its resolved path.
+func (w *followWalker) key(realName string) (walkKey, error) {
+	id, _, err := LookupFileID(w.fsys, realName, nil)
+	if err != nil {
+		return walkKey{}, err
+	}
+
+	if id != 0 {
+		return walkKey{id: id}, nil
+	}
+
+	return walkKey{path: realName}, nil
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs_test
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkDirFollow(t *testing.T) {
+	fsys := memfs.New()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("usr/lib/libc.so", []byte("libc"), 0o644))
+	require.NoError(t, fsys.Symlink("hostname", "etc/name"))
+	require.NoError(t, fsys.Symlink("missing", "etc/dangling"))
+	require.NoError(t, fsys.Symlink("../../..", "etc/escape"))
+	require.NoError(t, fsys.Symlink("usr/lib", "lib64"))
+	require.NoError(t, fsys.Symlink("/usr/lib", "lib"))
+	require.NoError(t, fsys.Symlink("..", "usr/lib/parent"))
+	require.NoError(t, fsys.Symlink(".", "usr/lib/self"))
+
+	type visit struct {
+		path  string
+		isDir bool
+	}
+
+	walk := func(t *testing.T, root string, skip string) []visit {
+		var visits []visit
+		err := archivefs.WalkDirFollow(fsys, root, func(path string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			visits = append(visits, visit{path, d.IsDir()})
+			if path == skip {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return visits
+	}
+
+	expected := []visit{
+		{".", true},
+		{"etc", true},
+		{"etc/dangling", false},
+		{"etc/escape", false},
+		{"etc/hostname", false},
+		{"etc/name", false},
+		// The first link to usr/lib is followed.
+		{"lib", true},
+		{"lib/libc.so", false},
+		// The parent directory (usr) hasn't been walked yet.
+		{"lib/parent", true},
+		{"lib/parent/lib", true},
+		{"lib/parent/lib/libc.so", false},
+		{"lib/parent/lib/parent", false},
+		{"lib/parent/lib/self", false},
+		{"lib/self", false},
+		// Already walked.
+		{"lib64", false},
+		{"usr", true},
+		{"usr/lib", true},
+		{"usr/lib/libc.so", false},
+		{"usr/lib/parent", false},
+		{"usr/lib/self", false},
+	}
+
+	t.Run("Follow", func(t *testing.T) {
+		require.Equal(t, expected, walk(t, ".", ""))
+	})
+
+	t.Run("Root", func(t *testing.T) {
+		require.Equal(t, []visit{
+			{"lib64", true},
+			{"lib64/libc.so", false},
+			{"lib64/parent", true},
+			{"lib64/parent/lib", true},
+			{"lib64/parent/lib/libc.so", false},
+			{"lib64/parent/lib/parent", false},
+			{"lib64/parent/lib/self", false},
+			{"lib64/self", false},
+		}, walk(t, "lib64", ""))
+	})
+
+	t.Run("SkipDir", func(t *testing.T) {
+		var skipped []visit
+		for _, v := range expected {
+			if !strings.HasPrefix(v.path, "etc/") {
+				skipped = append(skipped, v)
+			}
+		}
+
+		require.Equal(t, skipped, walk(t, ".", "etc"))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		err := archivefs.WalkDirFollow(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if path == "lib/libc.so" {
+				return errStop
+			}
+			return err
+		})
+		require.ErrorIs(t, err, errStop)
+
+		err = archivefs.WalkDirFollow(fsys, "missing", func(path string, d fs.DirEntry, err error) error {
+			return err
+		})
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
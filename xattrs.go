@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archivefs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"strings"
+)
+
+// PAXXattrPrefix is the prefix of PAX records holding extended attributes.
+const PAXXattrPrefix = "SCHILY.xattr."
+
+// ExtendedAttributes may be implemented by the value returned from
+// fs.FileInfo.Sys() to supply the extended attributes of a file.
+type ExtendedAttributes interface {
+	ExtendedAttributes() map[string]string
+}
+
+// Xattrs returns the extended attributes of a file, if known. They are taken
+// from the PAX records of a *tar.Header, or an ExtendedAttributes
+// implementation, returned by fi.Sys().
+func Xattrs(fi fs.FileInfo) map[string]string {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		xattrs := map[string]string{}
+		for key, value := range sys.PAXRecords {
+			if attr, ok := strings.CutPrefix(key, PAXXattrPrefix); ok {
+				xattrs[attr] = value
+			}
+		}
+		return xattrs
+	case ExtendedAttributes:
+		return sys.ExtendedAttributes()
+	}
+
+	return nil
+}
@@ -0,0 +1,590 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package zipfs provides access to zip archives. Unlike archive/zip, symbolic
+// links (recorded with Unix mode bits) are supported, the numeric owners of
+// files are read from Info-ZIP Unix extra fields, and every file supports
+// random access.
+package zipfs
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/compression"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/internal/readdir"
+)
+
+var (
+	_ fs.FS                = (*FS)(nil)
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ fs.ReadDirFile       = (*dir)(nil)
+	_ io.ReadSeeker        = (*file)(nil)
+	_ io.ReaderAt          = (*file)(nil)
+	_ archivefs.Owner      = (*Entry)(nil)
+)
+
+// ErrCorrupted is returned when an archive is truncated or malformed.
+var ErrCorrupted = archiveerrors.Define(&archiveerrors.ErrCorrupted{Offset: -1}, "corrupted archive")
+
+// maxLinkTarget is the maximum size of the target of a symbolic link.
+const maxLinkTarget = 4096
+
+// Extra field ids of Info-ZIP Unix extra fields, which record the numeric
+// owner of a file.
+const (
+	extraUnixN   = 0x7875 // "ux", with variable size ids
+	extraUnixOld = 0x7855 // "Ux", with 16-bit ids
+)
+
+// flagEncrypted is the general purpose flag of encrypted files.
+const flagEncrypted = 0x1
+
+// FS is a filesystem that represents a zip archive.
+type FS struct {
+	ra    io.ReaderAt
+	root  *Entry
+	spool compression.SpoolOptions
+}
+
+// Options configures how an archive is opened.
+type Options struct {
+	// Strict enables the most defensive behavior, for archives from untrusted
+	// sources: archives containing files with ".." components in their names,
+	// or more than one file with the same name, are rejected as corrupted.
+	Strict bool
+	// Spool configures how compressed files are buffered when opened, to
+	// support random access.
+	Spool compression.SpoolOptions
+}
+
+// Open opens a zip archive of the given size from the given io.ReaderAt.
+func Open(ra io.ReaderAt, size int64) (*FS, error) {
+	return OpenWithOptions(ra, size, nil)
+}
+
+// OpenWithOptions opens a zip archive with the given options. Later files
+// replace earlier files with the same name.
+func OpenWithOptions(ra io.ReaderAt, size int64, opts *Options) (*FS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil && !(errors.Is(err, zip.ErrInsecurePath) && zr != nil) {
+		if errors.Is(err, zip.ErrFormat) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, corrupted(err)
+		}
+
+		return nil, err
+	}
+
+	fsys := &FS{
+		ra:    ra,
+		root:  newDir(""),
+		spool: opts.Spool,
+	}
+
+	seen := map[string]bool{}
+	for _, f := range zr.File {
+		e := &Entry{
+			Header:  &f.FileHeader,
+			name:    archivefs.CleanPath(f.Name),
+			mode:    f.Mode(),
+			modTime: f.Modified,
+			size:    int64(f.UncompressedSize64),
+			file:    f,
+		}
+		e.uid, e.gid = owner(f.Extra)
+
+		if opts.Strict {
+			if _, err := archivefs.SanitizePath(f.Name, &archivefs.SanitizeOptions{RejectDotDot: true}); err != nil {
+				return nil, corrupted(err)
+			}
+
+			if seen[e.name] {
+				return nil, corrupted(fmt.Errorf("duplicate file: %q", f.Name))
+			}
+			seen[e.name] = true
+		}
+
+		if e.mode&fs.ModeSymlink != 0 {
+			if e.target, err = readLink(f); err != nil {
+				return nil, fmt.Errorf("failed to read symbolic link %q: %w", f.Name, err)
+			}
+		}
+
+		if e.name == "" {
+			if !e.IsDir() {
+				return nil, corrupted(fmt.Errorf("root file %q is not a directory", f.Name))
+			}
+
+			e.children = fsys.root.children
+			fsys.root = e
+		} else if err := fsys.root.add(e); err != nil {
+			return nil, corrupted(err)
+		}
+	}
+
+	return fsys, nil
+}
+
+// Open opens the named file, following any symbolic links.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	e, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	e = e.renamed(name)
+
+	if e.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dir{Entry: e, Entries: readdir.New(entries)}, nil
+	}
+
+	f, err := fsys.openFile(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return f, nil
+}
+
+// ReadDir reads the named directory, following any symbolic links.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(e.children))
+	for _, child := range e.children {
+		entries = append(entries, child)
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+// Stat returns a FileInfo describing the named file, following any symbolic
+// links.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return e.renamed(name), nil
+}
+
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) ReadLink(name string) (string, error) {
+	e, err := fsys.lookup(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	if e.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return e.target, nil
+}
+
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	e, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return e, nil
+}
+
+// openFile opens a file for reading. Stored files are read in place (so
+// their checksums aren't verified), while compressed files are decompressed
+// into a spool as they are read.
+func (fsys *FS) openFile(e *Entry) (*file, error) {
+	if e.file.Flags&flagEncrypted != 0 {
+		return nil, fmt.Errorf("%w: encrypted files", archiveerrors.ErrUnsupportedFeature)
+	}
+
+	if e.file.Method == zip.Store {
+		offset, err := e.file.DataOffset()
+		if err != nil {
+			return nil, corrupted(err)
+		}
+
+		return &file{Entry: e, SectionReader: io.NewSectionReader(fsys.ra, offset, e.size)}, nil
+	}
+
+	rc, err := e.file.Open()
+	if err != nil {
+		if errors.Is(err, zip.ErrAlgorithm) {
+			return nil, fmt.Errorf("%w: compression method %d", archiveerrors.ErrUnsupportedFeature, e.file.Method)
+		}
+
+		return nil, corrupted(err)
+	}
+
+	spool := compression.NewSpool(rc, &fsys.spool)
+
+	return &file{
+		Entry:         e,
+		SectionReader: io.NewSectionReader(spool, 0, e.size),
+		closers:       []io.Closer{spool, rc},
+	}, nil
+}
+
+// lookup returns the named entry, following symbolic links in all but the
+// final component of the name.
+func (fsys *FS) lookup(name string) (*Entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	if name == "." {
+		return fsys.root, nil
+	}
+
+	parent, err := fsys.resolve(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := parent.children[path.Base(name)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return e, nil
+}
+
+// resolve returns the named entry, following symbolic links.
+func (fsys *FS) resolve(name string) (*Entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	return fsys.resolveWithHops(name, 0)
+}
+
+func (fsys *FS) resolveWithHops(name string, hops int) (*Entry, error) {
+	e := fsys.root
+
+	// Symbolic link targets are resolved lexically, never above the root.
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return e, nil
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if !e.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+
+		var ok bool
+		e, ok = e.children[component]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		if e.mode&fs.ModeSymlink != 0 {
+			hops++
+			if hops > archivefs.MaxSymlinkHops {
+				return nil, fmt.Errorf("too many levels of symbolic links: %s: %w", name, fs.ErrInvalid)
+			}
+
+			// Relative targets are relative to the directory containing the
+			// link.
+			target := e.target
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(e.name), target)
+			}
+
+			var err error
+			e, err = fsys.resolveWithHops(target, hops)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// corrupted wraps an error describing a malformed archive with ErrCorrupted.
+func corrupted(err error) error {
+	return &archiveerrors.ErrCorrupted{
+		Offset: -1,
+		Detail: err.Error(),
+		Err:    fmt.Errorf("%w: %w", ErrCorrupted, err),
+	}
+}
+
+// readLink reads the target of a symbolic link, stored as its contents.
+func readLink(f *zip.File) (string, error) {
+	if f.UncompressedSize64 > maxLinkTarget {
+		return "", corrupted(errors.New("target is too long"))
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	target, err := io.ReadAll(io.LimitReader(rc, maxLinkTarget+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(target) > maxLinkTarget {
+		return "", corrupted(errors.New("target is too long"))
+	}
+
+	return string(target), nil
+}
+
+// owner returns the numeric owner of a file from its extra fields (or root,
+// if none is recorded).
+func owner(extra []byte) (uid, gid int) {
+	for len(extra) >= 4 {
+		id := int(extra[0]) | int(extra[1])<<8
+		size := int(extra[2]) | int(extra[3])<<8
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		data := extra[:size]
+		extra = extra[size:]
+
+		switch id {
+		case extraUnixN:
+			// Version, followed by the size and value of each id.
+			if len(data) < 1 || data[0] != 1 {
+				continue
+			}
+			data = data[1:]
+
+			var ids [2]int
+			ok := true
+			for i := range ids {
+				if len(data) < 1 || int(data[0]) > len(data)-1 || data[0] > 8 {
+					ok = false
+					break
+				}
+
+				n := int(data[0])
+				for j := n; j > 0; j-- {
+					ids[i] = ids[i]<<8 | int(data[j])
+				}
+				data = data[1+n:]
+			}
+
+			if ok {
+				return ids[0], ids[1]
+			}
+		case extraUnixOld:
+			// Only the local header records the ids, but some writers also
+			// include them in the central directory.
+			if len(data) >= 4 {
+				uid, gid = int(data[0])|int(data[1])<<8, int(data[2])|int(data[3])<<8
+			}
+		}
+	}
+
+	return uid, gid
+}
+
+// Entry is a file in the archive. It implements fs.FileInfo and fs.DirEntry.
+type Entry struct {
+	// Header is the header of the file, or nil for directories that are
+	// implied by the names of other files.
+	Header   *zip.FileHeader
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	size     int64
+	uid, gid int
+	target   string
+	file     *zip.File
+	children map[string]*Entry
+}
+
+// newDir returns a default entry for a directory that is implied by the
+// names of other files.
+func newDir(name string) *Entry {
+	return &Entry{
+		name: name,
+		mode: fs.ModeDir | 0o755,
+	}
+}
+
+// add adds an entry beneath the directory, creating any missing parent
+// directories. An existing entry with the same name is replaced, keeping its
+// children if both are directories.
+func (d *Entry) add(e *Entry) error {
+	parent := d
+	dirName, base := path.Split(e.name)
+	if dirName != "" {
+		for _, component := range strings.Split(strings.TrimSuffix(dirName, "/"), "/") {
+			child, ok := parent.children[component]
+			if !ok {
+				child = newDir(path.Join(parent.name, component))
+				parent.setChild(component, child)
+			} else if !child.IsDir() {
+				return fmt.Errorf("parent %q of %q is not a directory", child.name, e.name)
+			}
+
+			parent = child
+		}
+	}
+
+	if existing, ok := parent.children[base]; ok && existing.IsDir() && e.IsDir() {
+		e.children = existing.children
+	}
+	parent.setChild(base, e)
+
+	return nil
+}
+
+func (d *Entry) setChild(name string, e *Entry) {
+	if d.children == nil {
+		d.children = map[string]*Entry{}
+	}
+
+	d.children[name] = e
+}
+
+// renamed returns the entry as found by the given name, as the entry may have
+// been reached through a symbolic link.
+func (e *Entry) renamed(name string) *Entry {
+	name = archivefs.CleanPath(name)
+	if name == "" || path.Base(name) == path.Base(e.name) {
+		return e
+	}
+
+	renamed := *e
+	renamed.name = name
+
+	return &renamed
+}
+
+func (e *Entry) Name() string {
+	if e.name == "" {
+		return "."
+	}
+
+	return path.Base(e.name)
+}
+
+func (e *Entry) Size() int64 {
+	if e.IsDir() {
+		return 0
+	}
+
+	return e.size
+}
+
+func (e *Entry) Mode() fs.FileMode {
+	return e.mode
+}
+
+func (e *Entry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *Entry) IsDir() bool {
+	return e.mode.IsDir()
+}
+
+func (e *Entry) Sys() any {
+	return e
+}
+
+// Owner returns the numeric owner of the file, as recorded by Info-ZIP Unix
+// extra fields (or root, if it isn't recorded).
+func (e *Entry) Owner() (uid, gid int) {
+	return e.uid, e.gid
+}
+
+func (e *Entry) Type() fs.FileMode {
+	return e.mode.Type()
+}
+
+func (e *Entry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+// file is an open file, which supports random access.
+type file struct {
+	*Entry
+	*io.SectionReader
+	closers []io.Closer
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.Entry, nil
+}
+
+func (f *file) Close() error {
+	var errs []error
+	for _, c := range f.closers {
+		errs = append(errs, c.Close())
+	}
+	f.closers = nil
+
+	return errors.Join(errs...)
+}
+
+// dir is an open directory.
+type dir struct {
+	*Entry
+	readdir.Entries
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.Entry, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package zipfs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/archivefstest"
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/zipfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZipFS(t *testing.T) {
+	contents := bytes.Repeat([]byte("hello world\n"), 1000)
+
+	archive := createArchive(t, []file{
+		{name: "bin/", mode: fs.ModeDir | 0o755},
+		{name: "bin/busybox", mode: 0o755, method: zip.Store, data: "busybox"},
+		{name: "sh", mode: fs.ModeSymlink | 0o777, data: "bin/busybox"},
+		{name: "sbin", mode: fs.ModeSymlink | 0o777, data: "/bin"},
+		{name: "etc/motd", mode: 0o644, method: zip.Deflate, data: string(contents), extra: unixExtra(1000, 100)},
+	})
+
+	fsys, err := zipfs.Open(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+
+	require.NoError(t, archivefstest.TestFS(fsys, "bin/busybox", "sh", "sbin", "etc/motd"))
+
+	data, err := fs.ReadFile(fsys, "sbin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", string(data))
+
+	target, err := fsys.ReadLink("sh")
+	require.NoError(t, err)
+	require.Equal(t, "bin/busybox", target)
+
+	fi, err := fsys.StatLink("sbin")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	fi, err = fsys.Stat("sbin")
+	require.NoError(t, err)
+	require.Equal(t, "sbin", fi.Name())
+	require.True(t, fi.IsDir())
+
+	fi, err = fsys.Stat("etc")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	fi, err = fsys.Stat("etc/motd")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(contents)), fi.Size())
+	uid, gid := fi.Sys().(archivefs.Owner).Owner()
+	require.Equal(t, [2]int{1000, 100}, [2]int{uid, gid})
+
+	for _, name := range []string{"bin/busybox", "etc/motd"} {
+		t.Run("ReadAt/"+name, func(t *testing.T) {
+			f, err := fsys.Open(name)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			want, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err)
+
+			buf := make([]byte, 3)
+			_, err = f.(io.ReaderAt).ReadAt(buf, int64(len(want)-4))
+			require.NoError(t, err)
+			require.Equal(t, want[len(want)-4:len(want)-1], buf)
+
+			_, err = f.(io.Seeker).Seek(2, io.SeekStart)
+			require.NoError(t, err)
+
+			rest, err := io.ReadAll(f)
+			require.NoError(t, err)
+			require.Equal(t, want[2:], rest)
+		})
+	}
+
+	t.Run("Closed", func(t *testing.T) {
+		f, err := fsys.Open("etc/motd")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		_, err = f.Read(make([]byte, 16))
+		require.ErrorIs(t, err, fs.ErrClosed)
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		_, err := zipfs.OpenWithOptions(bytes.NewReader(archive), int64(len(archive)), &zipfs.Options{Strict: true})
+		require.NoError(t, err)
+
+		for _, files := range [][]file{
+			{{name: "etc/motd", mode: 0o644}, {name: "etc/motd", mode: 0o644}},
+			{{name: "../etc/motd", mode: 0o644}},
+		} {
+			archive := createArchive(t, files)
+
+			_, err := zipfs.Open(bytes.NewReader(archive), int64(len(archive)))
+			require.NoError(t, err)
+
+			_, err = zipfs.OpenWithOptions(bytes.NewReader(archive), int64(len(archive)), &zipfs.Options{Strict: true})
+			require.ErrorIs(t, err, zipfs.ErrCorrupted)
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		archive := createArchive(t, []file{{name: "secret", mode: 0o600, data: "secret", flags: 0x1}})
+
+		fsys, err := zipfs.Open(bytes.NewReader(archive), int64(len(archive)))
+		require.NoError(t, err)
+
+		_, err = fsys.Open("secret")
+		require.ErrorIs(t, err, archiveerrors.ErrUnsupportedFeature)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		_, err := zipfs.Open(bytes.NewReader(archive[:len(archive)-10]), int64(len(archive)-10))
+		require.ErrorIs(t, err, &archiveerrors.ErrCorrupted{})
+	})
+}
+
+type file struct {
+	name   string
+	mode   fs.FileMode
+	method uint16
+	flags  uint16
+	extra  []byte
+	data   string
+}
+
+// createArchive creates a zip archive containing the given files.
+func createArchive(t *testing.T, files []file) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, f := range files {
+		h := &zip.FileHeader{
+			Name:   f.name,
+			Method: f.method,
+			Flags:  f.flags,
+			Extra:  f.extra,
+		}
+		h.SetMode(f.mode)
+
+		w, err := zw.CreateHeader(h)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte(f.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+// unixExtra returns an Info-ZIP Unix extra field recording the given owner.
+func unixExtra(uid, gid uint32) []byte {
+	return []byte{
+		0x75, 0x78, 11, 0, // Id and size
+		1,                                                              // Version
+		4, byte(uid), byte(uid >> 8), byte(uid >> 16), byte(uid >> 24), // UID
+		4, byte(gid), byte(gid >> 8), byte(gid >> 16), byte(gid >> 24), // GID
+	}
+}
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package zstdseekable
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxFrameSize is the largest decompressed frame size that is written, or
+// accepted when reading, as each frame is decompressed into memory in one go.
+const maxFrameSize = 256 << 20
+
+var errClosed = errors.New("writer is closed")
+
+// WriterOptions configures how a seekable zstd stream is written.
+type WriterOptions struct {
+	// FrameSize is the amount of data compressed in each independent frame,
+	// defaults to 1 MiB (and is at most 256 MiB). Smaller frames make random
+	// access cheaper at the cost of a lower compression ratio.
+	FrameSize int
+	// Level is the compression level, defaults to zstd.SpeedDefault.
+	Level zstd.EncoderLevel
+}
+
+// Writer compresses data into a seekable zstd stream, which can be read by
+// any zstd decoder. Each frame includes a checksum of its contents, so the
+// seek table doesn't.
+type Writer struct {
+	w         io.Writer
+	encoder   *zstd.Encoder
+	frameSize int
+	buf       []byte
+	table     []byte
+	frames    uint32
+	err       error
+}
+
+// NewWriter returns a Writer that writes a seekable zstd stream to w.
+func NewWriter(w io.Writer, opts *WriterOptions) (*Writer, error) {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+
+	frameSize := opts.FrameSize
+	if frameSize <= 0 {
+		frameSize = 1 << 20
+	}
+	frameSize = min(frameSize, maxFrameSize)
+
+	level := opts.Level
+	if level == 0 {
+		level = zstd.SpeedDefault
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:         w,
+		encoder:   encoder,
+		frameSize: frameSize,
+	}, nil
+}
+
+// Write compresses p, writing a frame each time a full frame of data has
+// been buffered.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	var n int
+	for len(p) > 0 {
+		chunk := min(len(p), w.frameSize-len(w.buf))
+		w.buf = append(w.buf, p[:chunk]...)
+		p = p[chunk:]
+		n += chunk
+
+		if len(w.buf) == w.frameSize {
+			if err := w.flushFrame(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close writes any buffered data and the seek table. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.flushFrame(); err != nil {
+			return err
+		}
+	}
+
+	// The seek table is stored in a skippable frame.
+	tableSize := len(w.table) + footerSize
+	table := make([]byte, 0, 8+tableSize)
+	table = binary.LittleEndian.AppendUint32(table, skippableFrameMagic)
+	table = binary.LittleEndian.AppendUint32(table, uint32(tableSize))
+	table = append(table, w.table...)
+	table = binary.LittleEndian.AppendUint32(table, w.frames)
+	table = append(table, 0) // descriptor, no checksums.
+	table = binary.LittleEndian.AppendUint32(table, seekableMagic)
+
+	if _, err := w.w.Write(table); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.err = errClosed
+	return w.encoder.Close()
+}
+
+func (w *Writer) flushFrame() error {
+	compressed := w.encoder.EncodeAll(w.buf, nil)
+	if _, err := w.w.Write(compressed); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.table = binary.LittleEndian.AppendUint32(w.table, uint32(len(compressed)))
+	w.table = binary.LittleEndian.AppendUint32(w.table, uint32(len(w.buf)))
+	w.frames++
+	w.buf = w.buf[:0]
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package zstdseekable implements the zstd seekable format [1], where data
+// is compressed as a sequence of independent frames followed by a seek table
+// (eg. as produced by `zstd --seekable`). This allows random access to the
+// decompressed data, so that seekable .tar.zst archives can be opened with
+// tarfs without decompressing the whole archive.
+//
+// [1] https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+package zstdseekable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	skippableFrameMagic = 0x184D2A5E
+	seekableMagic       = 0x8F92EAB1
+	// footerSize is the size of the seek table footer.
+	footerSize = 9
+	// checksumFlag is set in the seek table descriptor if entries include a
+	// checksum.
+	checksumFlag = 1 << 7
+	// maxFrames limits the size of the seek table that will be read.
+	maxFrames = 1 << 24
+	// cachedFrames is the number of decompressed frames that are cached.
+	cachedFrames = 4
+)
+
+// ErrNotSeekable is returned when the data does not end with a seek table.
+var ErrNotSeekable = errors.New("not a seekable zstd stream")
+
+var (
+	_ io.ReaderAt = (*Reader)(nil)
+)
+
+// frame is an entry of the seek table.
+type frame struct {
+	// offset is the offset of the compressed frame.
+	offset int64
+	// compressedSize is the size of the compressed frame.
+	compressedSize int64
+	// start is the offset of the decompressed frame.
+	start int64
+	// size is the size of the decompressed frame.
+	size int64
+}
+
+// Reader provides random access to the decompressed data of a seekable zstd
+// stream. Frames are decompressed on demand, and the most recently used are
+// cached. Checksums in the seek table are ignored, in favor of the checksums
+// of each frame (if present). It is safe for concurrent use.
+type Reader struct {
+	ra      io.ReaderAt
+	frames  []frame
+	size    int64
+	decoder *zstd.Decoder
+
+	mu    sync.Mutex
+	cache []cachedFrame
+}
+
+type cachedFrame struct {
+	index int
+	data  []byte
+}
+
+// Open reads the seek table of a seekable zstd stream of the given size.
+// It returns ErrNotSeekable if the stream has no seek table (eg. it is a
+// regular zstd stream).
+func Open(ra io.ReaderAt, size int64) (*Reader, error) {
+	if size < footerSize+8 {
+		return nil, ErrNotSeekable
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := ra.ReadAt(footer, size-footerSize); err != nil {
+		return nil, fmt.Errorf("failed to read seek table footer: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, ErrNotSeekable
+	}
+
+	numFrames := int64(binary.LittleEndian.Uint32(footer[0:]))
+	descriptor := footer[4]
+	if descriptor&0x7c != 0 {
+		return nil, &archiveerrors.ErrCorrupted{Offset: size - footerSize, Detail: fmt.Sprintf("reserved bits set in seek table descriptor: %#x", descriptor)}
+	}
+
+	if numFrames > maxFrames {
+		return nil, fmt.Errorf("too many frames in seek table: %d: %w", numFrames, archiveerrors.ErrLimitExceeded)
+	}
+
+	entrySize := int64(8)
+	if descriptor&checksumFlag != 0 {
+		entrySize += 4
+	}
+
+	// The seek table is stored in a skippable frame.
+	tableSize := numFrames*entrySize + footerSize
+	tableOffset := size - tableSize - 8
+	if tableOffset < 0 {
+		return nil, fmt.Errorf("%w: truncated seek table", ErrNotSeekable)
+	}
+
+	table := make([]byte, tableSize+8)
+	if _, err := ra.ReadAt(table, tableOffset); err != nil {
+		return nil, fmt.Errorf("failed to read seek table: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(table[0:]) != skippableFrameMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, fmt.Errorf("%w: invalid seek table frame header", ErrNotSeekable)
+	}
+
+	frames := make([]frame, numFrames)
+	var offset, start int64
+	for i := range frames {
+		entry := table[8+int64(i)*entrySize:]
+
+		frames[i] = frame{
+			offset:         offset,
+			compressedSize: int64(binary.LittleEndian.Uint32(entry[0:])),
+			start:          start,
+			size:           int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+
+		if frames[i].size > maxFrameSize {
+			return nil, fmt.Errorf("frame %d is larger than %d bytes: %w", i, maxFrameSize, archiveerrors.ErrLimitExceeded)
+		}
+
+		offset += frames[i].compressedSize
+		start += frames[i].size
+	}
+
+	if offset != tableOffset {
+		return nil, &archiveerrors.ErrCorrupted{Offset: tableOffset, Detail: fmt.Sprintf("seek table does not match size of compressed data (%d != %d)", offset, tableOffset)}
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxFrameSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		ra:      ra,
+		frames:  frames,
+		size:    start,
+		decoder: decoder,
+	}, nil
+}
+
+// Size returns the size of the decompressed data.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Frames returns the number of compressed frames.
+func (r *Reader) Frames() int {
+	return len(r.frames)
+}
+
+// ReadAt reads len(p) bytes of decompressed data starting at off.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		// Find the frame containing pos.
+		i := sort.Search(len(r.frames), func(i int) bool {
+			return r.frames[i].start+r.frames[i].size > pos
+		})
+
+		data, err := r.frame(i)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], data[pos-r.frames[i].start:])
+	}
+
+	return n, nil
+}
+
+// Close releases the resources of the decoder.
+func (r *Reader) Close() error {
+	r.decoder.Close()
+	return nil
+}
+
+// frame returns the decompressed contents of the i'th frame.
+func (r *Reader) frame(i int) ([]byte, error) {
+	r.mu.Lock()
+	for j, c := range r.cache {
+		if c.index == i {
+			// Move to the front.
+			copy(r.cache[1:j+1], r.cache[:j])
+			r.cache[0] = c
+			r.mu.Unlock()
+			return c.data, nil
+		}
+	}
+	r.mu.Unlock()
+
+	f := r.frames[i]
+
+	compressed := make([]byte, f.compressedSize)
+	if _, err := r.ra.ReadAt(compressed, f.offset); err != nil {
+		return nil, fmt.Errorf("failed to read frame %d: %w", i, err)
+	}
+
+	data, err := r.decoder.DecodeAll(compressed, make([]byte, 0, f.size))
+	if err != nil {
+		return nil, &archiveerrors.ErrCorrupted{Offset: f.offset, Detail: fmt.Sprintf("failed to decompress frame %d", i), Err: err}
+	}
+
+	if int64(len(data)) != f.size {
+		return nil, &archiveerrors.ErrCorrupted{Offset: f.offset, Detail: fmt.Sprintf("frame %d has unexpected size (%d != %d)", i, len(data), f.size)}
+	}
+
+	r.mu.Lock()
+	if len(r.cache) < cachedFrames {
+		r.cache = append(r.cache, cachedFrame{})
+	}
+	copy(r.cache[1:], r.cache)
+	r.cache[0] = cachedFrame{index: i, data: data}
+	r.mu.Unlock()
+
+	return data, nil
+}
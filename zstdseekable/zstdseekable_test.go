@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package zstdseekable_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	archiveerrors "github.com/dpeckett/archivefs/errors"
+	"github.com/dpeckett/archivefs/memfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/archivefs/zstdseekable"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 100*1024+17)
+	_, err := rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+	require.NoError(t, err)
+
+	var compressed bytes.Buffer
+	zw, err := zstdseekable.NewWriter(&compressed, &zstdseekable.WriterOptions{FrameSize: 4096})
+	require.NoError(t, err)
+
+	// Write in odd sized chunks, to span frames.
+	for chunk := data; len(chunk) > 0; {
+		n := min(len(chunk), 1000)
+		_, err := zw.Write(chunk[:n])
+		require.NoError(t, err)
+		chunk = chunk[n:]
+	}
+	require.NoError(t, zw.Close())
+
+	_, err = zw.Write([]byte("more"))
+	require.Error(t, err)
+
+	t.Run("ReadAt", func(t *testing.T) {
+		zr, err := zstdseekable.Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, zr.Close())
+		})
+
+		require.Equal(t, int64(len(data)), zr.Size())
+		require.Equal(t, 26, zr.Frames())
+
+		rng := rand.New(rand.NewSource(2))
+		for i := 0; i < 100; i++ {
+			off := rng.Intn(len(data))
+			size := rng.Intn(10000)
+
+			buf := make([]byte, size)
+			n, err := zr.ReadAt(buf, int64(off))
+			if off+size > len(data) {
+				require.ErrorIs(t, err, io.EOF)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, data[off:off+n], buf[:n])
+		}
+
+		all, err := io.ReadAll(io.NewSectionReader(zr, 0, zr.Size()))
+		require.NoError(t, err)
+		require.Equal(t, data, all)
+	})
+
+	t.Run("Compatible", func(t *testing.T) {
+		// Seekable streams can be read by any zstd decoder.
+		dec, err := zstd.NewReader(bytes.NewReader(compressed.Bytes()))
+		require.NoError(t, err)
+		defer dec.Close()
+
+		all, err := io.ReadAll(dec)
+		require.NoError(t, err)
+		require.Equal(t, data, all)
+	})
+
+	t.Run("NotSeekable", func(t *testing.T) {
+		enc, err := zstd.NewWriter(nil)
+		require.NoError(t, err)
+
+		regular := enc.EncodeAll(data, nil)
+		_, err = zstdseekable.Open(bytes.NewReader(regular), int64(len(regular)))
+		require.ErrorIs(t, err, zstdseekable.ErrNotSeekable)
+
+		// The compressed data is truncated.
+		truncated := compressed.Bytes()[100:]
+		_, err = zstdseekable.Open(bytes.NewReader(truncated), int64(len(truncated)))
+		require.Error(t, err)
+	})
+
+	t.Run("LargeFrame", func(t *testing.T) {
+		// Claim the last frame decompresses to 4 GiB.
+		large := bytes.Clone(compressed.Bytes())
+		entrySize := 8
+		if large[len(large)-5]&0x80 != 0 {
+			// Entries include a checksum.
+			entrySize = 12
+		}
+		binary.LittleEndian.PutUint32(large[len(large)-9-entrySize+4:], 0xffffffff)
+
+		_, err := zstdseekable.Open(bytes.NewReader(large), int64(len(large)))
+		require.ErrorIs(t, err, archiveerrors.ErrLimitExceeded)
+	})
+
+	t.Run("TarFS", func(t *testing.T) {
+		fsys := memfs.New()
+		require.NoError(t, fsys.MkdirAll("etc", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/data", data, 0o644))
+		require.NoError(t, fsys.WriteFile("etc/hostname", []byte("alpha\n"), 0o644))
+
+		var archive bytes.Buffer
+		require.NoError(t, tarfs.Create(&archive, fsys))
+
+		var compressed bytes.Buffer
+		zw, err := zstdseekable.NewWriter(&compressed, &zstdseekable.WriterOptions{FrameSize: 4096})
+		require.NoError(t, err)
+		_, err = zw.Write(archive.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		src := &countingReaderAt{ra: bytes.NewReader(compressed.Bytes())}
+		zr, err := zstdseekable.Open(src, int64(compressed.Len()))
+		require.NoError(t, err)
+
+		src.reads.Store(0)
+
+		tarFS, err := tarfs.Open(zr)
+		require.NoError(t, err)
+
+		// The contents of etc/data are skipped while indexing.
+		require.Less(t, int(src.reads.Load()), zr.Frames()/2)
+
+		hostname, err := fs.ReadFile(tarFS, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "alpha\n", string(hostname))
+
+		contents, err := fs.ReadFile(tarFS, "etc/data")
+		require.NoError(t, err)
+		require.Equal(t, data, contents)
+	})
+}
+
+type countingReaderAt struct {
+	ra    io.ReaderAt
+	reads atomic.Int32
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	return r.ra.ReadAt(p, off)
+}